@@ -534,6 +534,15 @@ const (
 	// indexes are enabled.
 	V23_2_PartiallyVisibleIndexes
 
+	// V23_2_AddSQLStatsCompactionRunsTable is the version where the
+	// system.sql_stats_compaction_runs table is created.
+	V23_2_AddSQLStatsCompactionRunsTable
+
+	// V23_2_AddSQLStatsLastExecutionTs is the version where the
+	// last_execution_ts column is added to system.statement_statistics and
+	// system.transaction_statistics.
+	V23_2_AddSQLStatsLastExecutionTs
+
 	// *************************************************
 	// Step (1) Add new versions here.
 	// Do not add new versions to a patch release.
@@ -927,6 +936,14 @@ var rawVersionsSingleton = keyedVersions{
 		Key:     V23_2_PartiallyVisibleIndexes,
 		Version: roachpb.Version{Major: 23, Minor: 1, Internal: 6},
 	},
+	{
+		Key:     V23_2_AddSQLStatsCompactionRunsTable,
+		Version: roachpb.Version{Major: 23, Minor: 1, Internal: 8},
+	},
+	{
+		Key:     V23_2_AddSQLStatsLastExecutionTs,
+		Version: roachpb.Version{Major: 23, Minor: 1, Internal: 10},
+	},
 
 	// *************************************************
 	// Step (2): Add new versions here.
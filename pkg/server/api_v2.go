@@ -197,6 +197,7 @@ func registerRoutes(
 		{"ranges/hot/", a.listHotRanges, true, adminRole, noOption, false},
 		{"ranges/{range_id:[0-9]+}/", a.listRange, true, adminRole, noOption, false},
 		{"health/", systemRoutes.health, false, regularRole, noOption, false},
+		{"health/sql-stats/", a.sqlStatsHealth, true, adminRole, noOption, true},
 		{"users/", a.listUsers, true, regularRole, noOption, false},
 		{"events/", a.listEvents, true, adminRole, noOption, false},
 		{"databases/", a.listDatabases, true, regularRole, noOption, false},
@@ -393,6 +394,28 @@ func (a *apiV2Server) health(w http.ResponseWriter, r *http.Request) {
 	writeJSONResponse(r.Context(), w, http.StatusNotImplemented, nil)
 }
 
+// swagger:operation GET /health/sql-stats/ sqlStatsHealth
+//
+// # Check the health of the SQL stats subsystem
+//
+// Returns the time of the last SQL stats flush of this node, the time and
+// outcome of the last SQL stats compaction run, the status of the compaction
+// schedule, and the memory used by the in-memory SQL stats of this node. The
+// parts that could not be read are listed in `errors`.
+//
+// ---
+// produces:
+// - application/json
+// responses:
+//
+//	"200":
+//	  description: SQL stats health snapshot
+func (a *apiV2Server) sqlStatsHealth(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	status := a.sqlServer.pgServer.SQLServer.GetSQLStatsController().HealthSnapshot(ctx)
+	writeJSONResponse(ctx, w, http.StatusOK, status)
+}
+
 // swagger:operation GET /rules/ rules
 //
 // # Get metric recording and alerting rule templates
@@ -24,6 +24,8 @@ import (
 
 	"github.com/cockroachdb/cockroach/pkg/base"
 	"github.com/cockroachdb/cockroach/pkg/server/serverpb"
+	"github.com/cockroachdb/cockroach/pkg/sql"
+	"github.com/cockroachdb/cockroach/pkg/sql/sqlstats/persistedsqlstats"
 	"github.com/cockroachdb/cockroach/pkg/testutils"
 	"github.com/cockroachdb/cockroach/pkg/testutils/serverutils"
 	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
@@ -159,6 +161,33 @@ func TestHealthV2(t *testing.T) {
 	require.NoError(t, resp.Body.Close())
 }
 
+func TestSQLStatsHealthV2(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	ctx := context.Background()
+	s, db, _ := serverutils.StartServer(t, base.TestServerArgs{})
+	defer s.Stopper().Stop(ctx)
+
+	_, err := db.Exec("SELECT 1")
+	require.NoError(t, err)
+	s.SQLServer().(*sql.Server).GetSQLStatsProvider().(*persistedsqlstats.PersistedSQLStats).Flush(ctx)
+
+	client, err := s.GetAdminHTTPClient()
+	require.NoError(t, err)
+	resp, err := client.Get(s.AdminURL() + apiV2Path + "health/sql-stats/")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var status persistedsqlstats.HealthStatus
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&status))
+	require.Empty(t, status.Errors)
+	require.False(t, status.LastFlush.IsZero())
+	require.Equal(t, "ACTIVE", status.ScheduleStatus)
+	require.Positive(t, status.MemoryLimitBytes)
+}
+
 // TestRulesV2 tests the /api/v2/rules endpoint to ensure it
 // returns valid YAML.
 func TestRulesV2(t *testing.T) {
@@ -1888,13 +1888,22 @@ func (n *Node) TenantSettings(
 		})
 	}
 
+	// Record the overrides sent to the tenant, see
+	// crdb_internal.tenant_setting_sent_status.
+	sent := w.RecordSentOverrides(args.TenantID)
+	defer sent.Close()
+
 	send := func(precedence kvpb.TenantSettingsPrecedence, overrides []kvpb.TenantSetting) error {
 		log.VInfof(ctx, 1, "sending precedence %d: %v", precedence, overrides)
-		return stream.Send(&kvpb.TenantSettingsEvent{
+		if err := stream.Send(&kvpb.TenantSettingsEvent{
 			Precedence:  precedence,
 			Incremental: false,
 			Overrides:   overrides,
-		})
+		}); err != nil {
+			return err
+		}
+		sent.Sent(precedence, overrides)
+		return nil
 	}
 
 	allOverrides, allCh := w.GetAllTenantOverrides()
@@ -57,6 +57,7 @@ import (
 	"github.com/cockroachdb/cockroach/pkg/server/settingswatcher"
 	"github.com/cockroachdb/cockroach/pkg/server/status"
 	"github.com/cockroachdb/cockroach/pkg/server/systemconfigwatcher"
+	"github.com/cockroachdb/cockroach/pkg/server/tenantsettingswatcher"
 	"github.com/cockroachdb/cockroach/pkg/server/tracedumper"
 	"github.com/cockroachdb/cockroach/pkg/settings"
 	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
@@ -395,6 +396,10 @@ type sqlServerArgs struct {
 	tenantTimeSeriesServer *ts.TenantServer
 
 	tenantCapabilitiesReader sql.SystemTenantOnly[tenantcapabilities.Reader]
+
+	// tenantSettingsWatcher reports the setting overrides sent to the tenants
+	// connected to this node.
+	tenantSettingsWatcher sql.SystemTenantOnly[*tenantsettingswatcher.Watcher]
 }
 
 type monitorAndMetrics struct {
@@ -1027,6 +1032,7 @@ func newSQLServer(ctx context.Context, cfg sqlServerArgs) (*SQLServer, error) {
 		EventsExporter:             cfg.eventsExporter,
 		NodeDescs:                  cfg.nodeDescs,
 		TenantCapabilitiesReader:   cfg.tenantCapabilitiesReader,
+		TenantSettingsWatcher:      cfg.tenantSettingsWatcher,
 		AutoConfigProvider:         cfg.AutoConfigProvider,
 	}
 
@@ -40,6 +40,9 @@ type overridesStore struct {
 		// this ever becomes a problem, we can periodically purge entries with no
 		// overrides.
 		tenants map[roachpb.TenantID]*tenantOverrides
+
+		// changeWatchers are notified of the settings whose overrides change.
+		changeWatchers map[*SettingOverrideWatcher]struct{}
 	}
 }
 
@@ -63,6 +66,55 @@ func newTenantOverrides(overrides []kvpb.TenantSetting) *tenantOverrides {
 
 func (s *overridesStore) Init() {
 	s.mu.tenants = make(map[roachpb.TenantID]*tenantOverrides)
+	s.mu.changeWatchers = make(map[*SettingOverrideWatcher]struct{})
+}
+
+func (s *overridesStore) watchChanges() *SettingOverrideWatcher {
+	sw := &SettingOverrideWatcher{
+		store:    s,
+		notifyCh: make(chan struct{}, 1),
+	}
+	sw.mu.pending = make(map[SettingOverrideChange]struct{})
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.mu.changeWatchers[sw] = struct{}{}
+	return sw
+}
+
+func (s *overridesStore) unwatchChanges(sw *SettingOverrideWatcher) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.mu.changeWatchers, sw)
+}
+
+// notifyChangeLocked notifies the change watchers that the override of the
+// given setting changed for the given tenant.
+func (s *overridesStore) notifyChangeLocked(tenantID roachpb.TenantID, name string) {
+	for sw := range s.mu.changeWatchers {
+		sw.addChange(SettingOverrideChange{TenantID: tenantID, Name: name})
+	}
+}
+
+// notifyDiffLocked notifies the change watchers of the settings whose
+// overrides differ between before and after, which are both ordered by Name.
+func (s *overridesStore) notifyDiffLocked(
+	tenantID roachpb.TenantID, before, after []kvpb.TenantSetting,
+) {
+	for len(before) > 0 || len(after) > 0 {
+		switch {
+		case len(after) == 0 || (len(before) > 0 && before[0].Name < after[0].Name):
+			s.notifyChangeLocked(tenantID, before[0].Name)
+			before = before[1:]
+		case len(before) == 0 || after[0].Name < before[0].Name:
+			s.notifyChangeLocked(tenantID, after[0].Name)
+			after = after[1:]
+		default:
+			if before[0].Value != after[0].Value {
+				s.notifyChangeLocked(tenantID, after[0].Name)
+			}
+			before, after = before[1:], after[1:]
+		}
+	}
 }
 
 // SetAll initializes the overrides for all tenants. Any existing overrides are
@@ -81,6 +133,7 @@ func (s *overridesStore) SetAll(allOverrides map[roachpb.TenantID][]kvpb.TenantS
 	for _, existing := range s.mu.tenants {
 		close(existing.changeCh)
 	}
+	previous := s.mu.tenants
 	s.mu.tenants = make(map[roachpb.TenantID]*tenantOverrides, len(allOverrides))
 
 	for tenantID, overrides := range allOverrides {
@@ -96,6 +149,22 @@ func (s *overridesStore) SetAll(allOverrides map[roachpb.TenantID][]kvpb.TenantS
 		}
 		s.mu.tenants[tenantID] = newTenantOverrides(overrides)
 	}
+
+	// Notify the change watchers of the overrides that actually changed.
+	if len(s.mu.changeWatchers) > 0 {
+		for tenantID, existing := range previous {
+			var after []kvpb.TenantSetting
+			if o, ok := s.mu.tenants[tenantID]; ok {
+				after = o.overrides
+			}
+			s.notifyDiffLocked(tenantID, existing.overrides, after)
+		}
+		for tenantID, o := range s.mu.tenants {
+			if _, ok := previous[tenantID]; !ok {
+				s.notifyDiffLocked(tenantID, nil /* before */, o.overrides)
+			}
+		}
+	}
 }
 
 // GetTenantOverrides retrieves the overrides for a given tenant.
@@ -123,7 +192,8 @@ func (s *overridesStore) GetTenantOverrides(tenantID roachpb.TenantID) *tenantOv
 
 // SetTenantOverride changes an override for the given tenant. If the setting
 // has an empty value, the existing override is removed; otherwise a new
-// override is added.
+// override is added. The change watchers are only notified if the override
+// differs from the existing one.
 func (s *overridesStore) SetTenantOverride(tenantID roachpb.TenantID, setting kvpb.TenantSetting) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -132,6 +202,15 @@ func (s *overridesStore) SetTenantOverride(tenantID roachpb.TenantID, setting kv
 		before = existing.overrides
 		close(existing.changeCh)
 	}
+	var previous settings.EncodedValue
+	if i := sort.Search(len(before), func(i int) bool {
+		return before[i].Name >= setting.Name
+	}); i < len(before) && before[i].Name == setting.Name {
+		previous = before[i].Value
+	}
+	if previous != setting.Value {
+		s.notifyChangeLocked(tenantID, setting.Name)
+	}
 	after := make([]kvpb.TenantSetting, 0, len(before)+1)
 	// 1. Add all settings up to setting.Name.
 	for len(before) > 0 && before[0].Name < setting.Name {
@@ -88,3 +88,81 @@ func TestOverridesStore(t *testing.T) {
 	o3 := s.GetTenantOverrides(t3)
 	expect(o3, "x=xx")
 }
+
+func TestOverridesStoreChangeWatcher(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	var s overridesStore
+	s.Init()
+	t1 := roachpb.MustMakeTenantID(1)
+	t2 := roachpb.MustMakeTenantID(2)
+	st := func(name, val string) kvpb.TenantSetting {
+		return kvpb.TenantSetting{
+			Name: name,
+			Value: settings.EncodedValue{
+				Value: val,
+			},
+		}
+	}
+	sw := s.watchChanges()
+	defer sw.Close()
+	expect := func(expected string) {
+		t.Helper()
+		select {
+		case <-sw.NotifyCh():
+		case <-time.After(15 * time.Second):
+			t.Fatalf("no notification")
+		}
+		var changes []string
+		for _, c := range sw.Changes() {
+			changes = append(changes, fmt.Sprintf("%d/%s", c.TenantID.InternalValue, c.Name))
+		}
+		if actual := strings.Join(changes, " "); actual != expected {
+			t.Errorf("expected: %s; got: %s", expected, actual)
+		}
+	}
+
+	s.SetAll(map[roachpb.TenantID][]kvpb.TenantSetting{
+		allTenantOverridesID: {st("a", "aa")},
+		t1:                   {st("a", "aa"), st("b", "bb")},
+	})
+	expect("0/a 1/a 1/b")
+
+	// Only the overrides that differ from the existing ones are reported.
+	s.SetAll(map[roachpb.TenantID][]kvpb.TenantSetting{
+		t1: {st("a", "aa"), st("b", "changed"), st("c", "cc")},
+		t2: {st("x", "xx")},
+	})
+	expect("0/a 1/b 1/c 2/x")
+
+	// Rapid changes are coalesced into a single notification.
+	s.SetTenantOverride(t1, st("b", "again"))
+	s.SetTenantOverride(t1, st("b", ""))
+	s.SetTenantOverride(t2, st("y", "yy"))
+	expect("1/b 2/y")
+	select {
+	case <-sw.NotifyCh():
+		t.Fatalf("unexpected notification")
+	default:
+	}
+
+	// Overrides set to their existing value, and removals of overrides that do
+	// not exist, are not reported.
+	s.SetTenantOverride(t2, st("y", "yy"))
+	s.SetTenantOverride(t1, st("b", ""))
+	s.SetTenantOverride(t1, st("z", ""))
+	s.SetTenantOverride(t2, st("x", "changed"))
+	expect("2/x")
+
+	// A closed watcher is no longer notified.
+	sw.Close()
+	s.SetTenantOverride(t1, st("d", "dd"))
+	select {
+	case <-sw.NotifyCh():
+		t.Fatalf("unexpected notification")
+	default:
+	}
+	if changes := sw.Changes(); len(changes) != 0 {
+		t.Errorf("unexpected changes: %v", changes)
+	}
+}
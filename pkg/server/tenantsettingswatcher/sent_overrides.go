@@ -0,0 +1,157 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package tenantsettingswatcher
+
+import (
+	"sort"
+
+	"github.com/cockroachdb/cockroach/pkg/kv/kvpb"
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/settings"
+	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
+)
+
+// SentStatus reports whether this node has sent to a tenant the
+// override of a setting that is in effect for it.
+type SentStatus struct {
+	TenantID roachpb.TenantID
+	// Sent is set if, on all the TenantSettings streams of the tenant open on
+	// this node, the last overrides sent to the tenant resolve the setting to
+	// the same override (or to no override) as the current overrides. The
+	// streams do not carry acknowledgements, so the receipt of the overrides by
+	// the tenant is not known.
+	Sent bool
+}
+
+// SentOverridesRecorder records the overrides sent to a tenant by a
+// TenantSettings stream, so that GetSentStatus can compare them to the
+// current overrides.
+type SentOverridesRecorder struct {
+	tracker  *sentOverridesTracker
+	tenantID roachpb.TenantID
+
+	mu struct {
+		syncutil.Mutex
+		// allTenants and tenant are the last all-tenant and tenant-specific
+		// overrides sent on the stream, ordered by Name.
+		allTenants, tenant []kvpb.TenantSetting
+	}
+}
+
+// sentOverridesTracker holds the SentOverridesRecorder of the open
+// TenantSettings streams.
+type sentOverridesTracker struct {
+	mu struct {
+		syncutil.Mutex
+		recorders map[*SentOverridesRecorder]struct{}
+	}
+}
+
+func (t *sentOverridesTracker) Init() {
+	t.mu.recorders = make(map[*SentOverridesRecorder]struct{})
+}
+
+// RecordSentOverrides returns a new SentOverridesRecorder for a
+// TenantSettings stream of the given tenant. The caller must Close the
+// recorder when the stream ends.
+func (w *Watcher) RecordSentOverrides(tenantID roachpb.TenantID) *SentOverridesRecorder {
+	r := &SentOverridesRecorder{
+		tracker:  &w.sentOverrides,
+		tenantID: tenantID,
+	}
+	w.sentOverrides.mu.Lock()
+	defer w.sentOverrides.mu.Unlock()
+	w.sentOverrides.mu.recorders[r] = struct{}{}
+	return r
+}
+
+// Sent records that the given overrides, with the given precedence, were sent
+// on the stream. The overrides replace the ones with the same precedence that
+// were previously sent. The caller must not modify the overrides slice.
+func (r *SentOverridesRecorder) Sent(
+	precedence kvpb.TenantSettingsPrecedence, overrides []kvpb.TenantSetting,
+) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	switch precedence {
+	case kvpb.AllTenantsOverrides:
+		r.mu.allTenants = overrides
+	case kvpb.SpecificTenantOverrides:
+		r.mu.tenant = overrides
+	}
+}
+
+// Close stops tracking the stream.
+func (r *SentOverridesRecorder) Close() {
+	r.tracker.mu.Lock()
+	defer r.tracker.mu.Unlock()
+	delete(r.tracker.mu.recorders, r)
+}
+
+// GetSentStatus returns, for each tenant with a TenantSettings stream
+// open on this node, whether the override of the given setting in effect for
+// the tenant was sent to it. The tenants are ordered by ID.
+//
+// The status is node-local: the tenants connected to other nodes are not
+// reported, and a tenant connected to several nodes is only reported for its
+// streams open on this node.
+//
+// The override in effect for a tenant is its tenant-specific override, if
+// any, or else the all-tenant override, as for ALTER TENANT ... SET CLUSTER
+// SETTING. An override that was sent is applied to the local view of the
+// tenant as soon as the tenant receives it.
+func (w *Watcher) GetSentStatus(name string) []SentStatus {
+	w.sentOverrides.mu.Lock()
+	recorders := make([]*SentOverridesRecorder, 0, len(w.sentOverrides.mu.recorders))
+	for r := range w.sentOverrides.mu.recorders {
+		recorders = append(recorders, r)
+	}
+	w.sentOverrides.mu.Unlock()
+
+	allTenants, _ := w.GetAllTenantOverrides()
+	sentByTenant := make(map[roachpb.TenantID]bool, len(recorders))
+	for _, r := range recorders {
+		tenant, _ := w.GetTenantOverrides(r.tenantID)
+		current, currentOK := resolveOverride(name, tenant, allTenants)
+
+		r.mu.Lock()
+		sent, sentOK := resolveOverride(name, r.mu.tenant, r.mu.allTenants)
+		r.mu.Unlock()
+
+		s, ok := sentByTenant[r.tenantID]
+		sentByTenant[r.tenantID] = (s || !ok) && currentOK == sentOK && current == sent
+	}
+
+	res := make([]SentStatus, 0, len(sentByTenant))
+	for tenantID, s := range sentByTenant {
+		res = append(res, SentStatus{TenantID: tenantID, Sent: s})
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].TenantID.InternalValue < res[j].TenantID.InternalValue
+	})
+	return res
+}
+
+// resolveOverride returns the value of the override of the given setting in
+// effect for a tenant with the given tenant-specific and all-tenant
+// overrides, both ordered by Name. ok is false if the setting is not
+// overridden.
+func resolveOverride(
+	name string, tenant, allTenants []kvpb.TenantSetting,
+) (value settings.EncodedValue, ok bool) {
+	for _, overrides := range [][]kvpb.TenantSetting{tenant, allTenants} {
+		i := sort.Search(len(overrides), func(i int) bool { return overrides[i].Name >= name })
+		if i < len(overrides) && overrides[i].Name == name {
+			return overrides[i].Value, true
+		}
+	}
+	return settings.EncodedValue{}, false
+}
@@ -0,0 +1,99 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package tenantsettingswatcher
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/kv/kvpb"
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/settings"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+)
+
+func TestSentStatus(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	w := New(nil /* clock */, nil /* f */, nil /* stopper */, nil /* st */)
+	t1 := roachpb.MustMakeTenantID(1)
+	t2 := roachpb.MustMakeTenantID(2)
+	st := func(name, val string) kvpb.TenantSetting {
+		return kvpb.TenantSetting{
+			Name: name,
+			Value: settings.EncodedValue{
+				Value: val,
+			},
+		}
+	}
+	expect := func(name, expected string) {
+		t.Helper()
+		var statuses []string
+		for _, s := range w.GetSentStatus(name) {
+			statuses = append(statuses, fmt.Sprintf("%d:%t", s.TenantID.InternalValue, s.Sent))
+		}
+		if actual := strings.Join(statuses, " "); actual != expected {
+			t.Errorf("%s: expected: %s; got: %s", name, expected, actual)
+		}
+	}
+	// sendAll emulates a TenantSettings stream sending the current overrides.
+	sendAll := func(r *SentOverridesRecorder, tenantID roachpb.TenantID) {
+		all, _ := w.GetAllTenantOverrides()
+		r.Sent(kvpb.AllTenantsOverrides, all)
+		tenant, _ := w.GetTenantOverrides(tenantID)
+		r.Sent(kvpb.SpecificTenantOverrides, tenant)
+	}
+
+	w.store.SetAll(map[roachpb.TenantID][]kvpb.TenantSetting{
+		allTenantOverridesID: {st("a", "aa")},
+		t1:                   {st("b", "bb")},
+	})
+	// No tenant is connected.
+	expect("a", "")
+
+	r1 := w.RecordSentOverrides(t1)
+	r2 := w.RecordSentOverrides(t2)
+	sendAll(r1, t1)
+	sendAll(r2, t2)
+	expect("a", "1:true 2:true")
+	expect("b", "1:true 2:true")
+	expect("c", "1:true 2:true")
+
+	// A new all-tenant override is not reported as sent until it is sent.
+	w.store.SetTenantOverride(allTenantOverridesID, st("c", "cc"))
+	expect("c", "1:false 2:false")
+	sendAll(r1, t1)
+	expect("c", "1:true 2:false")
+
+	// The tenant-specific override takes precedence over the all-tenant one.
+	w.store.SetTenantOverride(t2, st("a", "t2"))
+	expect("a", "1:true 2:false")
+	sendAll(r2, t2)
+	expect("a", "1:true 2:true")
+	expect("c", "1:true 2:true")
+
+	// The removal of an override also needs to be sent.
+	w.store.SetTenantOverride(t1, st("b", ""))
+	expect("b", "1:false 2:true")
+
+	// A tenant is only reported as sent once the override was sent on all its
+	// streams.
+	r1bis := w.RecordSentOverrides(t1)
+	sendAll(r1bis, t1)
+	expect("b", "1:false 2:true")
+	r1.Close()
+	expect("b", "1:true 2:true")
+
+	r1bis.Close()
+	r2.Close()
+	expect("a", "")
+}
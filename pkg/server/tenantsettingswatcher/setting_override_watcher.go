@@ -0,0 +1,99 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package tenantsettingswatcher
+
+import (
+	"sort"
+
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
+)
+
+// SettingOverrideChange identifies a setting override that was added, changed
+// or removed for a tenant, e.g. by ALTER TENANT ... SET CLUSTER SETTING or
+// ALTER TENANT ... RESET CLUSTER SETTING. The all-tenant overrides (ALTER
+// TENANT ALL) are reported with a zero TenantID.
+type SettingOverrideChange struct {
+	TenantID roachpb.TenantID
+	Name     string
+}
+
+// SettingOverrideWatcher notifies an in-process subscriber of the changes to
+// the tenant setting overrides, so that the subscriber does not need to poll
+// the overrides of every tenant to find out which ones changed.
+//
+// Notifications are coalesced: NotifyCh receives at most one pending signal,
+// and Changes returns the set of overrides that changed since the previous
+// call, in which an override that changed several times appears once.
+type SettingOverrideWatcher struct {
+	store *overridesStore
+
+	// notifyCh is signaled, without blocking, when changes are added to
+	// mu.pending.
+	notifyCh chan struct{}
+
+	mu struct {
+		syncutil.Mutex
+		pending map[SettingOverrideChange]struct{}
+	}
+}
+
+// WatchOverrideChanges returns a new SettingOverrideWatcher, which is notified
+// of all the changes to the overrides applied by the watcher from then on. The
+// changes applied by the initial scan of the tenant_settings table are
+// reported as well. The caller must Close the SettingOverrideWatcher when it
+// is no longer needed.
+func (w *Watcher) WatchOverrideChanges() *SettingOverrideWatcher {
+	return w.store.watchChanges()
+}
+
+// NotifyCh returns a channel that receives a value when there are changes
+// that were not yet retrieved with Changes.
+func (sw *SettingOverrideWatcher) NotifyCh() <-chan struct{} {
+	return sw.notifyCh
+}
+
+// Changes returns the changes to the overrides since the previous call,
+// ordered by tenant ID and setting name.
+func (sw *SettingOverrideWatcher) Changes() []SettingOverrideChange {
+	sw.mu.Lock()
+	pending := sw.mu.pending
+	sw.mu.pending = make(map[SettingOverrideChange]struct{})
+	sw.mu.Unlock()
+
+	changes := make([]SettingOverrideChange, 0, len(pending))
+	for c := range pending {
+		changes = append(changes, c)
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		if changes[i].TenantID != changes[j].TenantID {
+			return changes[i].TenantID.InternalValue < changes[j].TenantID.InternalValue
+		}
+		return changes[i].Name < changes[j].Name
+	})
+	return changes
+}
+
+// Close stops the notifications to the SettingOverrideWatcher.
+func (sw *SettingOverrideWatcher) Close() {
+	sw.store.unwatchChanges(sw)
+}
+
+func (sw *SettingOverrideWatcher) addChange(c SettingOverrideChange) {
+	sw.mu.Lock()
+	sw.mu.pending[c] = struct{}{}
+	sw.mu.Unlock()
+
+	select {
+	case sw.notifyCh <- struct{}{}:
+	default:
+	}
+}
@@ -57,6 +57,10 @@ type Watcher struct {
 	dec     RowDecoder
 	store   overridesStore
 
+	// sentOverrides tracks the overrides sent to the tenants, see
+	// RecordSentOverrides.
+	sentOverrides sentOverridesTracker
+
 	// startCh is closed once the rangefeed starts.
 	startCh  chan struct{}
 	startErr error
@@ -74,6 +78,7 @@ func New(
 		dec:     MakeRowDecoder(),
 	}
 	w.store.Init()
+	w.sentOverrides.Init()
 	return w
 }
 
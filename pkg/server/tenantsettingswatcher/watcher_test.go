@@ -113,3 +113,49 @@ func TestWatcher(t *testing.T) {
 	t3Overrides, _ = w.GetTenantOverrides(t3)
 	expect(t3Overrides, "qux=qux-t3")
 }
+
+func TestWatcherOverrideChanges(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	ctx := context.Background()
+	tc := testcluster.StartTestCluster(t, 1, base.TestClusterArgs{})
+	defer tc.Stopper().Stop(ctx)
+
+	r := sqlutils.MakeSQLRunner(tc.ServerConn(0))
+	s0 := tc.Server(0)
+	w := tenantsettingswatcher.New(
+		s0.Clock(),
+		s0.ExecutorConfig().(sql.ExecutorConfig).RangeFeedFactory,
+		s0.Stopper(),
+		s0.ClusterSettings(),
+	)
+	require.NoError(t, w.Start(ctx, s0.SystemTableIDResolver().(catalog.SystemTableIDResolver)))
+	sw := w.WatchOverrideChanges()
+	defer sw.Close()
+
+	t2 := roachpb.MustMakeTenantID(2)
+	var changes []tenantsettingswatcher.SettingOverrideChange
+	expect := func(expected ...tenantsettingswatcher.SettingOverrideChange) {
+		t.Helper()
+		// The changes of several statements may be delivered separately.
+		changes = changes[:0]
+		for len(changes) < len(expected) {
+			select {
+			case <-sw.NotifyCh():
+				changes = append(changes, sw.Changes()...)
+			case <-time.After(15 * time.Second):
+				t.Fatalf("expected changes %v, got %v", expected, changes)
+			}
+		}
+		require.Equal(t, expected, changes)
+	}
+
+	r.Exec(t, "INSERT INTO system.tenant_settings (tenant_id, name, value, value_type) VALUES (2, 'foo', 'foo-t2', 's')")
+	expect(tenantsettingswatcher.SettingOverrideChange{TenantID: t2, Name: "foo"})
+
+	r.Exec(t, "UPSERT INTO system.tenant_settings (tenant_id, name, value, value_type) VALUES (0, 'bar', 'bar-all', 's')")
+	expect(tenantsettingswatcher.SettingOverrideChange{Name: "bar"})
+
+	r.Exec(t, "DELETE FROM system.tenant_settings WHERE tenant_id = 2 AND name = 'foo'")
+	expect(tenantsettingswatcher.SettingOverrideChange{TenantID: t2, Name: "foo"})
+}
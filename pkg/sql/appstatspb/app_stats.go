@@ -145,6 +145,7 @@ func (s *StatementStatistics) Add(other *StatementStatistics) {
 		s.MaxRetries = other.MaxRetries
 	}
 	s.SQLType = other.SQLType
+	s.StatementTag = other.StatementTag
 	s.NumRows.Add(other.NumRows, s.Count, other.Count)
 	s.IdleLat.Add(other.IdleLat, s.Count, other.Count)
 	s.ParseLat.Add(other.ParseLat, s.Count, other.Count)
@@ -471,6 +471,7 @@ func addSystemDescriptorsToSchema(target *MetadataSchema) {
 	target.AddDescriptor(systemschema.StatementActivityTable)
 	target.AddDescriptor(systemschema.TransactionActivityTable)
 	target.AddDescriptorForSystemTenant(systemschema.TenantIDSequence)
+	target.AddDescriptor(systemschema.SQLStatsCompactionRunsTable)
 
 	// Adding a new system table? It should be added here to the metadata schema,
 	// and also created as a migration for older clusters.
@@ -482,7 +483,7 @@ func addSystemDescriptorsToSchema(target *MetadataSchema) {
 // NumSystemTablesForSystemTenant is the number of system tables defined on
 // the system tenant. This constant is only defined to avoid having to manually
 // update auto stats tests every time a new system table is added.
-const NumSystemTablesForSystemTenant = 51
+const NumSystemTablesForSystemTenant = 52
 
 // addSplitIDs adds a split point for each of the PseudoTableIDs to the supplied
 // MetadataSchema.
@@ -548,6 +548,7 @@ CREATE TABLE system.statement_statistics (
     contention_time FLOAT AS (` + contentionTimeComputeExpr + `) STORED,
     total_estimated_execution_time FLOAT AS (` + totalEstimatedExecutionTimeExpr + `) STORED,
     p99_latency FLOAT8 AS (` + p99LatencyComputeExpr + `) STORED,
+    last_execution_ts TIMESTAMPTZ,
 
     CONSTRAINT "primary" PRIMARY KEY (aggregated_ts, fingerprint_id, transaction_fingerprint_id, plan_hash, app_name, node_id)
       USING HASH WITH (bucket_count=8),
@@ -577,7 +578,8 @@ CREATE TABLE system.statement_statistics (
 			cpu_sql_nanos,
 			contention_time,
 			total_estimated_execution_time,
-			p99_latency
+			p99_latency,
+			last_execution_ts
 		)
 )
 `
@@ -602,6 +604,7 @@ CREATE TABLE system.transaction_statistics (
     contention_time FLOAT AS (` + contentionTimeComputeExpr + `) STORED,
     total_estimated_execution_time FLOAT AS (` + totalEstimatedExecutionTimeExpr + `) STORED,
     p99_latency FLOAT8 AS (` + p99LatencyComputeExpr + `) STORED,
+    last_execution_ts TIMESTAMPTZ,
 
     CONSTRAINT "primary" PRIMARY KEY (aggregated_ts, fingerprint_id, app_name, node_id)
       USING HASH WITH (bucket_count=8),
@@ -626,7 +629,8 @@ CREATE TABLE system.transaction_statistics (
 			cpu_sql_nanos,
 			contention_time,
 			total_estimated_execution_time,
-			p99_latency
+			p99_latency,
+			last_execution_ts
 		)
 );
 `
@@ -725,6 +729,26 @@ CREATE TABLE system.transaction_activity
 );
 `
 
+	// SQLStatsCompactionRunsTableSchema records a summary of each run of the
+	// SQL stats compaction. The run in progress, if any, is recorded with a
+	// NULL completed_at and duration, and the sqlliveness session of the node
+	// running it in session_id; it serves as the compaction lock.
+	SQLStatsCompactionRunsTableSchema = `
+CREATE TABLE system.sql_stats_compaction_runs (
+	id                 INT8        NOT NULL DEFAULT unique_rowid(),
+	completed_at       TIMESTAMPTZ DEFAULT now():::TIMESTAMPTZ,
+	job_id             INT8,
+	duration           INTERVAL,
+	stmt_rows_removed  INT8        NOT NULL,
+	txn_rows_removed   INT8        NOT NULL,
+	outcome            STRING      NOT NULL,
+	error              STRING,
+	session_id         BYTES,
+	CONSTRAINT "primary" PRIMARY KEY (id),
+	INDEX "completed_at_idx" (completed_at),
+	FAMILY "primary" (id, completed_at, job_id, duration, stmt_rows_removed, txn_rows_removed, outcome, error, session_id)
+);`
+
 	DatabaseRoleSettingsTableSchema = `
 CREATE TABLE system.database_role_settings (
     database_id  OID NOT NULL,
@@ -1201,6 +1225,7 @@ func MakeSystemTables() []SystemTable {
 		SystemTenantTasksTable,
 		StatementActivityTable,
 		TransactionActivityTable,
+		SQLStatsCompactionRunsTable,
 	}
 }
 
@@ -2637,6 +2662,7 @@ var (
 				{Name: "contention_time", ID: 17, Type: types.Float, Nullable: true, ComputeExpr: &contentionTimeComputeExprStr},
 				{Name: "total_estimated_execution_time", ID: 18, Type: types.Float, Nullable: true, ComputeExpr: &totalEstimatedExecutionTimeExprStr},
 				{Name: "p99_latency", ID: 19, Type: types.Float, Nullable: true, ComputeExpr: &p99LatencyComputeExprStr},
+				{Name: "last_execution_ts", ID: 20, Type: types.TimestampTZ, Nullable: true},
 			},
 			[]descpb.ColumnFamilyDescriptor{
 				{
@@ -2647,9 +2673,9 @@ var (
 						"aggregated_ts", "fingerprint_id", "transaction_fingerprint_id", "plan_hash", "app_name", "node_id",
 						"agg_interval", "metadata", "statistics", "plan", "index_recommendations", "execution_count",
 						"service_latency", "cpu_sql_nanos", "contention_time", "total_estimated_execution_time",
-						"p99_latency",
+						"p99_latency", "last_execution_ts",
 					},
-					ColumnIDs:       []descpb.ColumnID{11, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 12, 14, 15, 16, 17, 18, 19},
+					ColumnIDs:       []descpb.ColumnID{11, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 12, 14, 15, 16, 17, 18, 19, 20},
 					DefaultColumnID: 0,
 				},
 			},
@@ -2884,6 +2910,7 @@ var (
 				{Name: "contention_time", ID: 12, Type: types.Float, Nullable: true, ComputeExpr: &contentionTimeComputeExprStr},
 				{Name: "total_estimated_execution_time", ID: 13, Type: types.Float, Nullable: true, ComputeExpr: &totalEstimatedExecutionTimeExprStr},
 				{Name: "p99_latency", ID: 14, Type: types.Float, Nullable: true, ComputeExpr: &p99LatencyComputeExprStr},
+				{Name: "last_execution_ts", ID: 15, Type: types.TimestampTZ, Nullable: true},
 			},
 			[]descpb.ColumnFamilyDescriptor{
 				{
@@ -2893,9 +2920,9 @@ var (
 						"crdb_internal_aggregated_ts_app_name_fingerprint_id_node_id_shard_8",
 						"aggregated_ts", "fingerprint_id", "app_name", "node_id",
 						"agg_interval", "metadata", "statistics", "execution_count", "service_latency", "cpu_sql_nanos",
-						"contention_time", "total_estimated_execution_time", "p99_latency",
+						"contention_time", "total_estimated_execution_time", "p99_latency", "last_execution_ts",
 					},
-					ColumnIDs:       []descpb.ColumnID{8, 1, 2, 3, 4, 5, 6, 7, 9, 10, 11, 12, 13, 14},
+					ColumnIDs:       []descpb.ColumnID{8, 1, 2, 3, 4, 5, 6, 7, 9, 10, 11, 12, 13, 14, 15},
 					DefaultColumnID: 0,
 				},
 			},
@@ -3433,6 +3460,56 @@ var (
 		),
 	)
 
+	// SQLStatsCompactionRunsTable is the descriptor for the table recording a
+	// summary of each run of the SQL stats compaction.
+	SQLStatsCompactionRunsTable = makeSystemTable(
+		SQLStatsCompactionRunsTableSchema,
+		systemTable(
+			catconstants.SQLStatsCompactionRunsTableName,
+			descpb.InvalidID, // dynamically assigned
+			[]descpb.ColumnDescriptor{
+				{Name: "id", ID: 1, Type: types.Int, DefaultExpr: &uniqueRowIDString},
+				{Name: "completed_at", ID: 2, Type: types.TimestampTZ, DefaultExpr: &nowTZString, Nullable: true},
+				{Name: "job_id", ID: 3, Type: types.Int, Nullable: true},
+				{Name: "duration", ID: 4, Type: types.Interval, Nullable: true},
+				{Name: "stmt_rows_removed", ID: 5, Type: types.Int},
+				{Name: "txn_rows_removed", ID: 6, Type: types.Int},
+				{Name: "outcome", ID: 7, Type: types.String},
+				{Name: "error", ID: 8, Type: types.String, Nullable: true},
+				{Name: "session_id", ID: 9, Type: types.Bytes, Nullable: true},
+			},
+			[]descpb.ColumnFamilyDescriptor{
+				{
+					Name: "primary",
+					ID:   0,
+					ColumnNames: []string{
+						"id", "completed_at", "job_id", "duration",
+						"stmt_rows_removed", "txn_rows_removed", "outcome", "error",
+						"session_id",
+					},
+					ColumnIDs: []descpb.ColumnID{1, 2, 3, 4, 5, 6, 7, 8, 9},
+				},
+			},
+			descpb.IndexDescriptor{
+				Name:                tabledesc.LegacyPrimaryKeyIndexName,
+				ID:                  1,
+				Unique:              true,
+				KeyColumnNames:      []string{"id"},
+				KeyColumnDirections: singleASC,
+				KeyColumnIDs:        singleID1,
+			},
+			descpb.IndexDescriptor{
+				Name:                "completed_at_idx",
+				ID:                  2,
+				Unique:              false,
+				KeyColumnNames:      []string{"completed_at"},
+				KeyColumnDirections: singleASC,
+				KeyColumnIDs:        []descpb.ColumnID{2},
+				KeySuffixColumnIDs:  singleID1,
+				Version:             descpb.StrictIndexColumnIDGuaranteesVersion,
+			}),
+	)
+
 	// DatabaseRoleSettingsTable holds default values for session variables
 	// for each role and database combination. It is analogous to the
 	// pg_db_role_setting table in Postgres. Note that roles do not currently
@@ -13,7 +13,9 @@ package sql
 import (
 	"context"
 	"fmt"
+	"strings"
 
+	"github.com/cockroachdb/cockroach/pkg/base"
 	"github.com/cockroachdb/cockroach/pkg/jobs"
 	"github.com/cockroachdb/cockroach/pkg/jobs/jobspb"
 	"github.com/cockroachdb/cockroach/pkg/scheduledjobs"
@@ -21,11 +23,15 @@ import (
 	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
 	"github.com/cockroachdb/cockroach/pkg/sql/catalog/descs"
 	"github.com/cockroachdb/cockroach/pkg/sql/isql"
+	"github.com/cockroachdb/cockroach/pkg/sql/sem/eval"
 	"github.com/cockroachdb/cockroach/pkg/sql/sem/tree"
 	"github.com/cockroachdb/cockroach/pkg/sql/sessiondata"
 	"github.com/cockroachdb/cockroach/pkg/sql/sqlstats/persistedsqlstats"
 	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/cockroachdb/cockroach/pkg/util/log/eventpb"
+	"github.com/cockroachdb/cockroach/pkg/util/log/logpb"
 	"github.com/cockroachdb/cockroach/pkg/util/metric"
+	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
 	"github.com/cockroachdb/errors"
 )
 
@@ -42,11 +48,46 @@ func (r *sqlStatsCompactionResumer) Resume(ctx context.Context, execCtx interfac
 	log.Infof(ctx, "starting sql stats compaction job")
 	p := execCtx.(JobExecContext)
 
+	// While the maintenance is frozen, the run is skipped, and the schedule
+	// tries again at its next recurrence.
+	if persistedsqlstats.SQLStatsMaintenanceFrozen.Get(&r.st.SV) {
+		log.Infof(ctx, "skipping sql stats compaction: %s is set",
+			persistedsqlstats.SQLStatsMaintenanceFrozen.Key())
+		return nil
+	}
+
 	var (
 		scheduledJobID int64
 		err            error
 	)
 
+	// Make sure that no other compaction is running concurrently, e.g.
+	// because of a race in the job scheduler, or because one was requested
+	// with crdb_internal.sql_stats_compact_now(). Two concurrent compactions
+	// would contend heavily while deleting the same rows.
+	session, err := p.ExecCfg().SQLLiveness.Session(ctx)
+	if err != nil {
+		return err
+	}
+	var (
+		lock       persistedsqlstats.CompactionLock
+		lockHolder base.SQLInstanceID
+		locked     bool
+	)
+	if err = p.ExecCfg().InternalDB.Txn(ctx, func(ctx context.Context, txn isql.Txn) error {
+		lock, lockHolder, locked, err = persistedsqlstats.AcquireCompactionLock(
+			ctx, txn, r.st, session.ID(), r.job.ID(),
+		)
+		return err
+	}); err != nil {
+		return err
+	}
+	if !locked {
+		log.Infof(ctx, "a sql stats compaction is already running on node %d, skipping", lockHolder)
+		return nil
+	}
+	defer persistedsqlstats.ReleaseCompactionLock(ctx, p.ExecCfg().InternalDB, lock)
+
 	if err = p.ExecCfg().InternalDB.Txn(ctx, func(ctx context.Context, txn isql.Txn) error {
 		scheduledJobID, err = r.getScheduleID(ctx, txn, scheduledjobs.ProdJobSchedulerEnv)
 		if err != nil {
@@ -68,14 +109,52 @@ func (r *sqlStatsCompactionResumer) Resume(ctx context.Context, execCtx interfac
 		return err
 	}
 
+	statsMetrics := &p.ExecCfg().InternalDB.server.ServerMetrics.StatsMetrics
 	statsCompactor := persistedsqlstats.NewStatsCompactor(
 		r.st,
 		p.ExecCfg().InternalDB,
-		p.ExecCfg().InternalDB.server.ServerMetrics.StatsMetrics.SQLStatsRemovedRows,
+		persistedsqlstats.CompactorMetrics{
+			RowsRemoved:             statsMetrics.SQLStatsRemovedRows,
+			TxnRetries:              statsMetrics.SQLStatsCompactionTxnRetries,
+			SkippedRows:             statsMetrics.SQLStatsCompactionSkippedRows,
+			ThrottleWait:            statsMetrics.SQLStatsCompactionThrottleWait,
+			SanityThresholdExceeded: statsMetrics.SQLStatsCompactionSanityThresholdExceeded,
+			OldestRowAge:            statsMetrics.SQLStatsOldestRowAge,
+			DistinctAppNames:        statsMetrics.SQLStatsDistinctAppNames,
+		},
 		p.ExecCfg().SQLStatsTestingKnobs)
-	if err = statsCompactor.DeleteOldestEntries(ctx); err != nil {
+	statsCompactor.SetStopper(p.ExecCfg().DistSQLSrv.Stopper)
+	if err = r.resumeFromCheckpoint(ctx, p.ExecCfg().InternalDB, statsCompactor); err != nil {
+		return err
+	}
+	if err = statsCompactor.WaitForCleanupWindow(ctx); err != nil {
+		return err
+	}
+	r.maybeLogCompactionEvent(ctx, p, &eventpb.SqlStatsCompactionStart{}, jobs.StatusRunning)
+	start := timeutil.Now()
+	results, err := statsCompactor.DeleteOldestEntriesWithReport(ctx)
+	finishEvent := &eventpb.SqlStatsCompactionFinish{Duration: timeutil.Since(start).Nanoseconds()}
+	for _, result := range results {
+		finishEvent.RowsRemoved += result.Rows
+	}
+	finishStatus := jobs.StatusSucceeded
+	if err != nil {
+		finishEvent.Error = err.Error()
+		finishStatus = jobs.StatusFailed
+	}
+	r.maybeLogCompactionEvent(ctx, p, finishEvent, finishStatus)
+	if recordErr := persistedsqlstats.RecordCompactionRun(
+		ctx, p.ExecCfg().InternalDB, r.st, lock, r.job.ID(), timeutil.Since(start), results, err,
+	); recordErr != nil {
+		log.Warningf(ctx, "failed to record the sql stats compaction run: %v", recordErr)
+	}
+	if err != nil {
 		return err
 	}
+	if err = r.maybeReportBudgetExhausted(ctx, results); err != nil {
+		return err
+	}
+	p.ExecCfg().InternalDB.server.sqlStats.NotifyCompactionDone()
 
 	return r.maybeNotifyJobTerminated(
 		ctx,
@@ -84,6 +163,88 @@ func (r *sqlStatsCompactionResumer) Resume(ctx context.Context, execCtx interfac
 		jobs.StatusSucceeded)
 }
 
+// maybeLogCompactionEvent records the given event of the compaction run in
+// the event log if sql.stats.cleanup.event_log.enabled is set. A failure to
+// record the event is logged, and does not fail the run.
+func (r *sqlStatsCompactionResumer) maybeLogCompactionEvent(
+	ctx context.Context, p JobExecContext, event logpb.EventPayload, status jobs.Status,
+) {
+	if !persistedsqlstats.SQLStatsCleanupEventLogEnabled.Get(&r.st.SV) {
+		return
+	}
+	if err := p.ExecCfg().InternalDB.Txn(ctx, func(ctx context.Context, txn isql.Txn) error {
+		return LogEventForJobs(ctx, p.ExecCfg(), txn, event, int64(r.job.ID()),
+			r.job.Payload(), p.User(), status)
+	}); err != nil {
+		log.Warningf(ctx, "failed to log sql stats compaction event: %v", err)
+	}
+}
+
+// maybeReportBudgetExhausted records in the running status of the job that
+// the compaction reached sql.stats.cleanup.max_rows_per_run, and that the
+// remaining rows are left to the next runs.
+func (r *sqlStatsCompactionResumer) maybeReportBudgetExhausted(
+	ctx context.Context, results []eval.SQLStatsCompactionResult,
+) error {
+	var rowsRemoved int64
+	var tables []string
+	for _, result := range results {
+		rowsRemoved += result.Rows
+		if result.BudgetExhausted {
+			tables = append(tables, result.Table)
+		}
+	}
+	if len(tables) == 0 {
+		return nil
+	}
+	return r.job.NoTxn().RunningStatus(ctx, func(
+		_ context.Context, _ jobspb.Details,
+	) (jobs.RunningStatus, error) {
+		return jobs.RunningStatus(fmt.Sprintf(
+			"removed %d rows and reached %s, rows of %s may remain for the next run",
+			rowsRemoved, persistedsqlstats.SQLStatsCleanupMaxRowsPerRun.Key(),
+			strings.Join(tables, ", "))), nil
+	})
+}
+
+// compactionCheckpointInfoKey is the key of the checkpoint of the compaction
+// in the job_info of the compaction job.
+const compactionCheckpointInfoKey = "sql_stats_compaction_checkpoint"
+
+// resumeFromCheckpoint loads the checkpoint of a previous execution of the job,
+// e.g. on another node that was restarted, so that the compaction does not
+// compact again the hash buckets that were already compacted, and has the
+// compactor checkpoint its progress in the job_info of the job.
+func (r *sqlStatsCompactionResumer) resumeFromCheckpoint(
+	ctx context.Context, db isql.DB, statsCompactor *persistedsqlstats.StatsCompactor,
+) error {
+	var cp persistedsqlstats.CompactionCheckpoint
+	if err := db.Txn(ctx, func(ctx context.Context, txn isql.Txn) error {
+		data, ok, err := jobs.InfoStorageForJob(txn, r.job.ID()).Get(ctx, compactionCheckpointInfoKey)
+		if err != nil || !ok {
+			return err
+		}
+		cp, err = persistedsqlstats.UnmarshalCompactionCheckpoint(data)
+		return err
+	}); err != nil {
+		return err
+	}
+	if len(cp.Buckets) > 0 {
+		log.Infof(ctx, "resuming the sql stats compaction from its checkpoint")
+	}
+	statsCompactor.SetCheckpoint(cp,
+		func(ctx context.Context, cp persistedsqlstats.CompactionCheckpoint) error {
+			data, err := persistedsqlstats.MarshalCompactionCheckpoint(cp)
+			if err != nil {
+				return err
+			}
+			return db.Txn(ctx, func(ctx context.Context, txn isql.Txn) error {
+				return jobs.InfoStorageForJob(txn, r.job.ID()).Write(ctx, compactionCheckpointInfoKey, data)
+			})
+		})
+	return nil
+}
+
 // OnFailOrCancel implements the jobs.Resumer interface.
 func (r *sqlStatsCompactionResumer) OnFailOrCancel(
 	ctx context.Context, execCtx interface{}, _ error,
@@ -136,6 +297,10 @@ func (r *sqlStatsCompactionResumer) getScheduleID(
 
 type sqlStatsCompactionMetrics struct {
 	*jobs.ExecutorMetrics
+	// ScheduleLag is the delay, in seconds, between the time at which the last
+	// run of the schedule was due and the time at which its job was started. A
+	// lag that remains high indicates that the job scheduler does not keep up.
+	ScheduleLag *metric.Gauge
 }
 
 var _ metric.Struct = &sqlStatsCompactionMetrics{}
@@ -174,6 +339,8 @@ func (e *scheduledSQLStatsCompactionExecutor) ExecuteJob(
 ) error {
 	if err := e.createSQLStatsCompactionJob(ctx, cfg, sj, txn); err != nil {
 		e.metrics.NumFailed.Inc(1)
+	} else {
+		e.metrics.ScheduleLag.Update(int64(env.Now().Sub(sj.ScheduledRunTime()).Seconds()))
 	}
 
 	e.metrics.NumStarted.Inc(1)
@@ -252,6 +419,7 @@ func init() {
 			return &scheduledSQLStatsCompactionExecutor{
 				metrics: sqlStatsCompactionMetrics{
 					ExecutorMetrics: &m,
+					ScheduleLag:     metric.NewGauge(MetaSQLStatsCompactionScheduleLag),
 				},
 			}, nil
 		})
@@ -73,6 +73,7 @@ import (
 	"github.com/cockroachdb/cockroach/pkg/util/hlc"
 	"github.com/cockroachdb/cockroach/pkg/util/log"
 	"github.com/cockroachdb/cockroach/pkg/util/log/logcrash"
+	"github.com/cockroachdb/cockroach/pkg/util/log/logpb"
 	"github.com/cockroachdb/cockroach/pkg/util/log/severity"
 	"github.com/cockroachdb/cockroach/pkg/util/metric"
 	"github.com/cockroachdb/cockroach/pkg/util/mon"
@@ -429,12 +430,40 @@ func NewServer(cfg *ExecutorConfig, pool *mon.BytesMonitor) *Server {
 		DB: NewInternalDB(
 			s, MemoryMetrics{}, sqlStatsInternalExecutorMonitor,
 		),
-		SQLIDContainer: cfg.NodeInfo.NodeID,
-		JobRegistry:    s.cfg.JobRegistry,
-		Knobs:          cfg.SQLStatsTestingKnobs,
-		FlushCounter:   serverMetrics.StatsMetrics.SQLStatsFlushStarted,
-		FailureCounter: serverMetrics.StatsMetrics.SQLStatsFlushFailure,
-		FlushDuration:  serverMetrics.StatsMetrics.SQLStatsFlushDuration,
+		SQLIDContainer:      cfg.NodeInfo.NodeID,
+		JobRegistry:         s.cfg.JobRegistry,
+		ProtectedTimestamps: s.cfg.ProtectedTimestampProvider,
+		SQLLiveness:         s.cfg.SQLLiveness,
+		Knobs:               cfg.SQLStatsTestingKnobs,
+		FlushCounter:        serverMetrics.StatsMetrics.SQLStatsFlushStarted,
+		FailureCounter:      serverMetrics.StatsMetrics.SQLStatsFlushFailure,
+		FlushDuration:       serverMetrics.StatsMetrics.SQLStatsFlushDuration,
+		SampledOutCounter:   serverMetrics.StatsMetrics.SQLStatsFlushSampledOut,
+		FailureCountersByCategory: map[persistedsqlstats.FlushErrorCategory]*metric.Counter{
+			persistedsqlstats.FlushErrorRetryableKV:     serverMetrics.StatsMetrics.SQLStatsFlushErrorRetryableKV,
+			persistedsqlstats.FlushErrorMemory:          serverMetrics.StatsMetrics.SQLStatsFlushErrorMemory,
+			persistedsqlstats.FlushErrorContextCanceled: serverMetrics.StatsMetrics.SQLStatsFlushErrorContextCanceled,
+			persistedsqlstats.FlushErrorSchema:          serverMetrics.StatsMetrics.SQLStatsFlushErrorSchema,
+			persistedsqlstats.FlushErrorPermission:      serverMetrics.StatsMetrics.SQLStatsFlushErrorPermission,
+		},
+		DisabledSkipCounter: serverMetrics.StatsMetrics.SQLStatsFlushDisabledSkips,
+		OverrunCounter:      serverMetrics.StatsMetrics.SQLStatsFlushOverrun,
+		FlushTxnRetries:     serverMetrics.StatsMetrics.SQLStatsFlushTxnRetries,
+		FlushSequence:       serverMetrics.StatsMetrics.SQLStatsFlushSequence,
+		ScheduleClockSkew:   serverMetrics.StatsMetrics.SQLStatsScheduleClockSkew,
+		CompactorMetrics: persistedsqlstats.CompactorMetrics{
+			RowsRemoved:             serverMetrics.StatsMetrics.SQLStatsRemovedRows,
+			TxnRetries:              serverMetrics.StatsMetrics.SQLStatsCompactionTxnRetries,
+			SkippedRows:             serverMetrics.StatsMetrics.SQLStatsCompactionSkippedRows,
+			ThrottleWait:            serverMetrics.StatsMetrics.SQLStatsCompactionThrottleWait,
+			SanityThresholdExceeded: serverMetrics.StatsMetrics.SQLStatsCompactionSanityThresholdExceeded,
+			OldestRowAge:            serverMetrics.StatsMetrics.SQLStatsOldestRowAge,
+			DistinctAppNames:        serverMetrics.StatsMetrics.SQLStatsDistinctAppNames,
+		},
+		LogCompactionEvent: func(ctx context.Context, event logpb.EventPayload) {
+			event.CommonDetails().Timestamp = timeutil.Now().UnixNano()
+			InsertEventRecords(ctx, s.cfg, LogEverywhere, event)
+		},
 	}, memSQLStats)
 
 	s.sqlStats = persistedSQLStats
@@ -539,7 +568,26 @@ func makeServerMetrics(cfg *ExecutorConfig) ServerMetrics {
 				Duration: 6 * metricsSampleInterval,
 				Buckets:  metric.IOLatencyBuckets,
 			}),
-			SQLStatsRemovedRows: metric.NewCounter(MetaSQLStatsRemovedRows),
+			SQLStatsFlushSampledOut:  metric.NewCounter(MetaSQLStatsFlushSampledOut),
+			SQLStatsRemovedRows:      metric.NewCounter(MetaSQLStatsRemovedRows),
+			SQLStatsOldestRowAge:     metric.NewGauge(MetaSQLStatsOldestRowAge),
+			SQLStatsDistinctAppNames: metric.NewGauge(MetaSQLStatsDistinctAppNames),
+
+			SQLStatsFlushErrorRetryableKV:     metric.NewCounter(MetaSQLStatsFlushErrorRetryableKV),
+			SQLStatsFlushErrorMemory:          metric.NewCounter(MetaSQLStatsFlushErrorMemory),
+			SQLStatsFlushErrorContextCanceled: metric.NewCounter(MetaSQLStatsFlushErrorContextCanceled),
+			SQLStatsFlushErrorSchema:          metric.NewCounter(MetaSQLStatsFlushErrorSchema),
+			SQLStatsFlushErrorPermission:      metric.NewCounter(MetaSQLStatsFlushErrorPermission),
+
+			SQLStatsFlushDisabledSkips:                metric.NewCounter(MetaSQLStatsFlushDisabledSkips),
+			SQLStatsFlushOverrun:                      metric.NewCounter(MetaSQLStatsFlushOverrun),
+			SQLStatsFlushTxnRetries:                   metric.NewCounter(MetaSQLStatsFlushTxnRetries),
+			SQLStatsFlushSequence:                     metric.NewGauge(MetaSQLStatsFlushSequence),
+			SQLStatsCompactionTxnRetries:              metric.NewCounter(MetaSQLStatsCompactionTxnRetries),
+			SQLStatsCompactionSkippedRows:             metric.NewCounter(MetaSQLStatsCompactionSkippedRows),
+			SQLStatsCompactionThrottleWait:            metric.NewCounter(MetaSQLStatsCompactionThrottleWait),
+			SQLStatsCompactionSanityThresholdExceeded: metric.NewCounter(MetaSQLStatsCompactionSanityThresholdExceeded),
+			SQLStatsScheduleClockSkew:                 metric.NewGauge(MetaSQLStatsScheduleClockSkew),
 			SQLTxnStatsCollectionOverhead: metric.NewHistogram(metric.HistogramOptions{
 				Mode:     metric.HistogramModePreferHdrLatency,
 				Metadata: MetaSQLTxnStatsCollectionOverhead,
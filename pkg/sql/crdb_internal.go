@@ -2065,39 +2065,7 @@ CREATE TABLE crdb_internal.cluster_settings (
   description   STRING NOT NULL
 )`,
 	populate: func(ctx context.Context, p *planner, _ catalog.DatabaseDescriptor, addRow func(...tree.Datum) error) error {
-		if hasPriv, err := func() (bool, error) {
-			if hasAdmin, err := p.HasAdminRole(ctx); err != nil {
-				return false, err
-			} else if hasAdmin {
-				return true, nil
-			}
-			if hasModify, err := p.HasPrivilege(ctx, syntheticprivilege.GlobalPrivilegeObject, privilege.MODIFYCLUSTERSETTING, p.User()); err != nil {
-				return false, err
-			} else if hasModify {
-				return true, nil
-			}
-			if hasSqlModify, err := p.HasPrivilege(ctx, syntheticprivilege.GlobalPrivilegeObject, privilege.MODIFYSQLCLUSTERSETTING, p.User()); err != nil {
-				return false, err
-			} else if hasSqlModify {
-				return true, nil
-			}
-			if hasView, err := p.HasPrivilege(ctx, syntheticprivilege.GlobalPrivilegeObject, privilege.VIEWCLUSTERSETTING, p.User()); err != nil {
-				return false, err
-			} else if hasView {
-				return true, nil
-			}
-			if hasModify, err := p.HasRoleOption(ctx, roleoption.MODIFYCLUSTERSETTING); err != nil {
-				return false, err
-			} else if hasModify {
-				return true, nil
-			}
-			if hasView, err := p.HasRoleOption(ctx, roleoption.VIEWCLUSTERSETTING); err != nil {
-				return false, err
-			} else if hasView {
-				return true, nil
-			}
-			return false, nil
-		}(); err != nil {
+		if hasPriv, err := canViewClusterSettings(ctx, p); err != nil {
 			return err
 		} else if !hasPriv {
 			return pgerror.Newf(pgcode.InsufficientPrivilege,
@@ -2123,6 +2091,44 @@ CREATE TABLE crdb_internal.cluster_settings (
 	},
 }
 
+// canViewClusterSettings returns whether the user can read the cluster
+// settings, i.e. whether it has the admin role or any of the
+// MODIFYCLUSTERSETTING, MODIFYSQLCLUSTERSETTING and VIEWCLUSTERSETTING
+// privileges or role options.
+func canViewClusterSettings(ctx context.Context, p *planner) (bool, error) {
+	if hasAdmin, err := p.HasAdminRole(ctx); err != nil {
+		return false, err
+	} else if hasAdmin {
+		return true, nil
+	}
+	if hasModify, err := p.HasPrivilege(ctx, syntheticprivilege.GlobalPrivilegeObject, privilege.MODIFYCLUSTERSETTING, p.User()); err != nil {
+		return false, err
+	} else if hasModify {
+		return true, nil
+	}
+	if hasSqlModify, err := p.HasPrivilege(ctx, syntheticprivilege.GlobalPrivilegeObject, privilege.MODIFYSQLCLUSTERSETTING, p.User()); err != nil {
+		return false, err
+	} else if hasSqlModify {
+		return true, nil
+	}
+	if hasView, err := p.HasPrivilege(ctx, syntheticprivilege.GlobalPrivilegeObject, privilege.VIEWCLUSTERSETTING, p.User()); err != nil {
+		return false, err
+	} else if hasView {
+		return true, nil
+	}
+	if hasModify, err := p.HasRoleOption(ctx, roleoption.MODIFYCLUSTERSETTING); err != nil {
+		return false, err
+	} else if hasModify {
+		return true, nil
+	}
+	if hasView, err := p.HasRoleOption(ctx, roleoption.VIEWCLUSTERSETTING); err != nil {
+		return false, err
+	} else if hasView {
+		return true, nil
+	}
+	return false, nil
+}
+
 // crdbInternalSessionVariablesTable exposes the session variables.
 var crdbInternalSessionVariablesTable = virtualSchemaTable{
 	comment: `session variables (RAM)`,
@@ -6388,9 +6394,9 @@ FROM (
           transaction_fingerprint_id,
           plan_hash,
           app_name,
-          metadata,
+          ` + sqlstatsutil.DecompressedStmtMetadataSQL + ` AS metadata,
           statistics,
-          plan,
+          ` + sqlstatsutil.DecompressedPlanSQL + ` AS plan,
           agg_interval,
           index_recommendations
       FROM
@@ -6431,9 +6437,9 @@ CREATE VIEW crdb_internal.statement_statistics_persisted AS
           app_name,
           node_id,
           agg_interval,
-          metadata,
+          ` + sqlstatsutil.DecompressedStmtMetadataSQL + ` AS metadata,
           statistics,
-          plan,
+          ` + sqlstatsutil.DecompressedPlanSQL + ` AS plan,
           index_recommendations,
           indexes_usage,
           execution_count,
@@ -6566,9 +6572,9 @@ CREATE VIEW crdb_internal.statement_statistics_persisted_v22_2 AS
           app_name,
           node_id,
           agg_interval,
-          metadata,
+          ` + sqlstatsutil.DecompressedStmtMetadataSQL + ` AS metadata,
           statistics,
-          plan,
+          ` + sqlstatsutil.DecompressedPlanSQL + ` AS plan,
           index_recommendations
       FROM
           system.statement_statistics`,
@@ -55,6 +55,7 @@ import (
 	"github.com/cockroachdb/cockroach/pkg/server/serverpb"
 	"github.com/cockroachdb/cockroach/pkg/server/status/statuspb"
 	"github.com/cockroachdb/cockroach/pkg/server/telemetry"
+	"github.com/cockroachdb/cockroach/pkg/server/tenantsettingswatcher"
 	"github.com/cockroachdb/cockroach/pkg/settings"
 	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
 	"github.com/cockroachdb/cockroach/pkg/spanconfig"
@@ -1114,18 +1115,126 @@ var (
 		Measurement: "SQL Stats Flush",
 		Unit:        metric.Unit_COUNT,
 	}
+	MetaSQLStatsFlushErrorRetryableKV = metric.Metadata{
+		Name:        "sql.stats.flush.error.retryable_kv",
+		Help:        "Number of transient KV errors (e.g. transaction retry errors) encountered when flushing SQL Stats",
+		Measurement: "SQL Stats Flush",
+		Unit:        metric.Unit_COUNT,
+	}
+	MetaSQLStatsFlushErrorMemory = metric.Metadata{
+		Name:        "sql.stats.flush.error.memory",
+		Help:        "Number of memory budget errors encountered when flushing SQL Stats",
+		Measurement: "SQL Stats Flush",
+		Unit:        metric.Unit_COUNT,
+	}
+	MetaSQLStatsFlushErrorContextCanceled = metric.Metadata{
+		Name:        "sql.stats.flush.error.context_canceled",
+		Help:        "Number of flushes of SQL Stats that were canceled or timed out",
+		Measurement: "SQL Stats Flush",
+		Unit:        metric.Unit_COUNT,
+	}
+	MetaSQLStatsFlushErrorSchema = metric.Metadata{
+		Name:        "sql.stats.flush.error.schema",
+		Help:        "Number of errors caused by an unexpected schema of the SQL Stats tables encountered when flushing SQL Stats",
+		Measurement: "SQL Stats Flush",
+		Unit:        metric.Unit_COUNT,
+	}
+	MetaSQLStatsFlushErrorPermission = metric.Metadata{
+		Name:        "sql.stats.flush.error.permission",
+		Help:        "Number of errors caused by missing privileges on the SQL Stats tables encountered when flushing SQL Stats",
+		Measurement: "SQL Stats Flush",
+		Unit:        metric.Unit_COUNT,
+	}
 	MetaSQLStatsFlushDuration = metric.Metadata{
 		Name:        "sql.stats.flush.duration",
 		Help:        "Time took to in nanoseconds to complete SQL Stats flush",
 		Measurement: "SQL Stats Flush",
 		Unit:        metric.Unit_NANOSECONDS,
 	}
+	MetaSQLStatsFlushSampledOut = metric.Metadata{
+		Name:        "sql.stats.flush.sampled_out",
+		Help:        "Number of fingerprints not flushed due to SQL Stats fingerprint sampling",
+		Measurement: "SQL Stats Flush",
+		Unit:        metric.Unit_COUNT,
+	}
+	MetaSQLStatsFlushDisabledSkips = metric.Metadata{
+		Name:        "sql.stats.flush.disabled_skips",
+		Help:        "Number of SQL Stats flushes skipped because sql.metrics.statement_details.enabled is false",
+		Measurement: "SQL Stats Flush",
+		Unit:        metric.Unit_COUNT,
+	}
+	MetaSQLStatsFlushOverrun = metric.Metadata{
+		Name:        "sql.stats.flush.overrun",
+		Help:        "Number of SQL Stats flushes that took longer than sql.stats.aggregation.interval",
+		Measurement: "SQL Stats Flush",
+		Unit:        metric.Unit_COUNT,
+	}
+	MetaSQLStatsFlushTxnRetries = metric.Metadata{
+		Name:        "sql.stats.flush.txn_retries",
+		Help:        "Number of times a transaction writing flushed SQL Stats was retried",
+		Measurement: "SQL Stats Flush",
+		Unit:        metric.Unit_COUNT,
+	}
+	MetaSQLStatsFlushSequence = metric.Metadata{
+		Name:        "sql.stats.flush.sequence",
+		Help:        "Sequence number of the last flush of SQL Stats on this node that wrote all its fingerprints, which stops advancing if the flushes stall or fail",
+		Measurement: "SQL Stats Flush",
+		Unit:        metric.Unit_COUNT,
+	}
 	MetaSQLStatsRemovedRows = metric.Metadata{
 		Name:        "sql.stats.cleanup.rows_removed",
 		Help:        "Number of stale statistics rows that are removed",
 		Measurement: "SQL Stats Cleanup",
 		Unit:        metric.Unit_COUNT,
 	}
+	MetaSQLStatsCompactionTxnRetries = metric.Metadata{
+		Name:        "sql.stats.compaction.txn_retries",
+		Help:        "Number of times a transaction deleting stale statistics rows was retried",
+		Measurement: "SQL Stats Cleanup",
+		Unit:        metric.Unit_COUNT,
+	}
+	MetaSQLStatsCompactionSkippedRows = metric.Metadata{
+		Name:        "sql.stats.compaction.skipped_rows",
+		Help:        "Number of stale statistics rows that could not be deleted and were skipped",
+		Measurement: "SQL Stats Cleanup",
+		Unit:        metric.Unit_COUNT,
+	}
+	MetaSQLStatsCompactionThrottleWait = metric.Metadata{
+		Name:        "sql.stats.compaction.throttle_wait_seconds",
+		Help:        "Time spent by SQL Stats compaction waiting for sql.stats.cleanup.delete_rate_limit, in whole seconds",
+		Measurement: "SQL Stats Cleanup",
+		Unit:        metric.Unit_SECONDS,
+	}
+	MetaSQLStatsCompactionSanityThresholdExceeded = metric.Metadata{
+		Name:        "sql.stats.compaction.sanity_threshold_exceeded",
+		Help:        "Number of times a SQL Stats compaction run removed more than sql.stats.cleanup.sanity_fraction of the rows of a stats table",
+		Measurement: "SQL Stats Cleanup",
+		Unit:        metric.Unit_COUNT,
+	}
+	MetaSQLStatsScheduleClockSkew = metric.Metadata{
+		Name:        "sql.stats.schedule.clock_skew_seconds",
+		Help:        "Skew of the next run of the SQL Stats compaction schedule relative to the node clock, positive if delayed and negative if premature",
+		Measurement: "SQL Stats Cleanup",
+		Unit:        metric.Unit_SECONDS,
+	}
+	MetaSQLStatsCompactionScheduleLag = metric.Metadata{
+		Name:        "sql.stats.compaction.schedule_lag_seconds",
+		Help:        "Delay between the time at which the last run of the SQL Stats compaction schedule was due and the time at which its job was started, negative if premature",
+		Measurement: "SQL Stats Cleanup",
+		Unit:        metric.Unit_SECONDS,
+	}
+	MetaSQLStatsOldestRowAge = metric.Metadata{
+		Name:        "sql.stats.persisted.oldest_row_age_seconds",
+		Help:        "Age of the oldest row in system.statement_statistics and system.transaction_statistics, sampled during SQL Stats compaction",
+		Measurement: "SQL Stats Cleanup",
+		Unit:        metric.Unit_SECONDS,
+	}
+	MetaSQLStatsDistinctAppNames = metric.Metadata{
+		Name:        "sql.stats.persisted.distinct_app_names",
+		Help:        "Number of distinct application names in the persisted SQL stats, sampled during SQL Stats compaction",
+		Measurement: "SQL Stats Cleanup",
+		Unit:        metric.Unit_COUNT,
+	}
 	MetaSQLTxnStatsCollectionOverhead = metric.Metadata{
 		Name:        "sql.stats.txn_stats_collection.duration",
 		Help:        "Time took in nanoseconds to collect transaction stats",
@@ -1435,6 +1544,10 @@ type ExecutorConfig struct {
 
 	TenantCapabilitiesReader SystemTenantOnly[tenantcapabilities.Reader]
 
+	// TenantSettingsWatcher reports the setting overrides sent to the tenants
+	// connected to this node.
+	TenantSettingsWatcher SystemTenantOnly[*tenantsettingswatcher.Watcher]
+
 	// AutoConfigProvider informs the auto config runner job of new
 	// tasks to run.
 	AutoConfigProvider acprovider.Provider
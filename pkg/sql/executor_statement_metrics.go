@@ -78,10 +78,31 @@ type StatsMetrics struct {
 
 	DiscardedStatsCount *metric.Counter
 
-	SQLStatsFlushStarted  *metric.Counter
-	SQLStatsFlushFailure  *metric.Counter
-	SQLStatsFlushDuration metric.IHistogram
-	SQLStatsRemovedRows   *metric.Counter
+	SQLStatsFlushStarted    *metric.Counter
+	SQLStatsFlushFailure    *metric.Counter
+	SQLStatsFlushDuration   metric.IHistogram
+	SQLStatsFlushSampledOut *metric.Counter
+	SQLStatsRemovedRows     *metric.Counter
+
+	SQLStatsFlushDisabledSkips                *metric.Counter
+	SQLStatsFlushOverrun                      *metric.Counter
+	SQLStatsFlushTxnRetries                   *metric.Counter
+	SQLStatsFlushSequence                     *metric.Gauge
+	SQLStatsCompactionTxnRetries              *metric.Counter
+	SQLStatsCompactionSkippedRows             *metric.Counter
+	SQLStatsCompactionThrottleWait            *metric.Counter
+	SQLStatsCompactionSanityThresholdExceeded *metric.Counter
+	SQLStatsScheduleClockSkew                 *metric.Gauge
+
+	// Flush errors by category, see persistedsqlstats.ClassifyFlushError.
+	SQLStatsFlushErrorRetryableKV     *metric.Counter
+	SQLStatsFlushErrorMemory          *metric.Counter
+	SQLStatsFlushErrorContextCanceled *metric.Counter
+	SQLStatsFlushErrorSchema          *metric.Counter
+	SQLStatsFlushErrorPermission      *metric.Counter
+
+	SQLStatsOldestRowAge     *metric.Gauge
+	SQLStatsDistinctAppNames *metric.Gauge
 
 	SQLTxnStatsCollectionOverhead metric.IHistogram
 }
@@ -210,6 +231,7 @@ func (ex *connExecutor) recordStatementSummary(
 		Nodes:                nodes,
 		Regions:              regions,
 		StatementType:        stmt.AST.StatementType(),
+		StatementTag:         stmt.AST.StatementTag(),
 		Plan:                 planner.instrumentation.PlanForStats(ctx),
 		PlanGist:             planner.instrumentation.planGist.String(),
 		StatementError:       stmtErr,
@@ -624,6 +624,14 @@ func (c *DummyTenantOperator) UpdateTenantResourceLimits(
 	return errors.WithStack(errEvalTenant)
 }
 
+// GetTenantSettingSentStatus is part of the eval.TenantOperator
+// interface.
+func (c *DummyTenantOperator) GetTenantSettingSentStatus(
+	_ context.Context, _ string,
+) ([]eval.TenantSettingSentStatus, error) {
+	return nil, errors.WithStack(errEvalTenant)
+}
+
 // DummyPreparedStatementState implements the tree.PreparedStatementState
 // interface.
 type DummyPreparedStatementState struct{}
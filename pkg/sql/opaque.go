@@ -134,6 +134,8 @@ func planOpaque(ctx context.Context, p *planner, stmt tree.Statement) (planNode,
 		return p.AlterTenantSetClusterSetting(ctx, n)
 	case *tree.AlterTenantRename:
 		return p.alterRenameTenant(ctx, n)
+	case *tree.AlterTenantResetAllClusterSettings:
+		return p.AlterTenantResetAllClusterSettings(ctx, n)
 	case *tree.AlterTenantService:
 		return p.alterTenantService(ctx, n)
 	case *tree.AlterType:
@@ -323,6 +325,7 @@ func init() {
 		&tree.AlterTableSetSchema{},
 		&tree.AlterTenantCapability{},
 		&tree.AlterTenantRename{},
+		&tree.AlterTenantResetAllClusterSettings{},
 		&tree.AlterTenantSetClusterSetting{},
 		&tree.AlterTenantService{},
 		&tree.AlterType{},
@@ -677,6 +677,44 @@ func TestParseSQL(t *testing.T) {
 	}
 }
 
+// TestParseAlterTenantSettingBatch verifies that the ALTER TENANT ... SET
+// CLUSTER SETTING statements of a multi-statement string are parsed
+// separately, and that each of them round-trips on its own.
+func TestParseAlterTenantSettingBatch(t *testing.T) {
+	const batch = `ALTER TENANT 2 SET CLUSTER SETTING a = 1; ` +
+		`ALTER TENANT 2 SET CLUSTER SETTING b = 2; ` +
+		`ALTER TENANT [2] RESET CLUSTER SETTING c;`
+	expected := []string{
+		`ALTER TENANT 2 SET CLUSTER SETTING a = 1`,
+		`ALTER TENANT 2 SET CLUSTER SETTING b = 2`,
+		`ALTER TENANT [2] SET CLUSTER SETTING c = DEFAULT`,
+	}
+
+	stmts, err := parser.Parse(batch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stmts) != len(expected) {
+		t.Fatalf("expected %d statements, but found %d", len(expected), len(stmts))
+	}
+	for i, stmt := range stmts {
+		if _, ok := stmt.AST.(*tree.AlterTenantSetClusterSetting); !ok {
+			t.Errorf("expected *tree.AlterTenantSetClusterSetting, but found %T", stmt.AST)
+		}
+		formatted := stmt.AST.String()
+		if formatted != expected[i] {
+			t.Errorf("expected %q, but found %q", expected[i], formatted)
+		}
+		reparsed, err := parser.ParseOne(formatted)
+		if err != nil {
+			t.Fatalf("%s: %v", formatted, err)
+		}
+		if reparsedFormatted := reparsed.AST.String(); reparsedFormatted != formatted {
+			t.Errorf("expected %q to round-trip, but found %q", formatted, reparsedFormatted)
+		}
+	}
+}
+
 // TestParseNumPlaceholders verifies that Statement.NumPlaceholders is set
 // correctly.
 func TestParseNumPlaceholders(t *testing.T) {
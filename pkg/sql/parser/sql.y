@@ -419,6 +419,15 @@ func (u *sqlSymUnion) tenantCapabilities() []tree.TenantCapability {
     }
     return nil
 }
+func (u *sqlSymUnion) csettingAssignment() tree.SetClusterSetting {
+    return u.val.(tree.SetClusterSetting)
+}
+func (u *sqlSymUnion) csettingAssignments() []tree.SetClusterSetting {
+    if assignments, ok := u.val.([]tree.SetClusterSetting); ok {
+        return assignments
+    }
+    return nil
+}
 func (u *sqlSymUnion) persistence() tree.Persistence {
   return u.val.(tree.Persistence)
 }
@@ -1077,6 +1086,8 @@ func (u *sqlSymUnion) showCreateFormatOption() tree.ShowCreateFormatOption {
 
 // ALTER TENANT CLUSTER SETTINGS
 %type <tree.Statement> alter_tenant_csetting_stmt
+%type <tree.SetClusterSetting> csetting_assignment
+%type <[]tree.SetClusterSetting> csetting_assignment_list
 
 // ALTER TENANT CAPABILITY
 %type <tree.Statement> alter_tenant_capability_stmt
@@ -6593,7 +6604,10 @@ alter_tenant_replication_stmt:
 // %Category: Group
 // %Text:
 // ALTER TENANT { <tenant_spec> | ALL } SET CLUSTER SETTING <var> { TO | = } <value>
+// ALTER TENANT { <tenant_spec> | ALL } SET CLUSTER SETTING ( <var> { TO | = } <value> [, ...] )
 // ALTER TENANT { <tenant_spec> | ALL } RESET CLUSTER SETTING <var>
+// ALTER TENANT IN ( <select> ) SET CLUSTER SETTING <var> { TO | = } <value>
+// ALTER TENANT <tenant_spec> RESET ALL CLUSTER SETTINGS
 // %SeeAlso: SET CLUSTER SETTING
 alter_tenant_csetting_stmt:
   ALTER TENANT tenant_spec set_or_reset_csetting_stmt
@@ -6605,6 +6619,38 @@ alter_tenant_csetting_stmt:
       TenantSpec: $3.tenantSpec(),
     }
   }
+| ALTER TENANT tenant_spec SET CLUSTER SETTING '(' csetting_assignment_list ')'
+  {
+    /* SKIP DOC */
+    $$.val = &tree.AlterTenantSetClusterSetting{
+      TenantSpec: $3.tenantSpec(),
+      Settings: $8.csettingAssignments(),
+    }
+  }
+| ALTER TENANT tenant_spec RESET ALL CLUSTER SETTINGS
+  {
+    /* SKIP DOC */
+    $$.val = &tree.AlterTenantResetAllClusterSettings{
+      TenantSpec: $3.tenantSpec(),
+    }
+  }
+| ALTER TENANT IN select_with_parens set_or_reset_csetting_stmt
+  {
+    /* SKIP DOC */
+    csettingStmt := $5.stmt().(*tree.SetClusterSetting)
+    $$.val = &tree.AlterTenantSetClusterSetting{
+      SetClusterSetting: *csettingStmt,
+      TenantSelector: &tree.Subquery{Select: $4.selectStmt()},
+    }
+  }
+| ALTER TENANT IN select_with_parens SET CLUSTER SETTING '(' csetting_assignment_list ')'
+  {
+    /* SKIP DOC */
+    $$.val = &tree.AlterTenantSetClusterSetting{
+      TenantSelector: &tree.Subquery{Select: $4.selectStmt()},
+      Settings: $9.csettingAssignments(),
+    }
+  }
 | ALTER TENANT_ALL ALL set_or_reset_csetting_stmt
   {
     /* SKIP DOC */
@@ -6614,12 +6660,36 @@ alter_tenant_csetting_stmt:
       TenantSpec: &tree.TenantSpec{All: true},
     }
   }
+| ALTER TENANT_ALL ALL SET CLUSTER SETTING '(' csetting_assignment_list ')'
+  {
+    /* SKIP DOC */
+    $$.val = &tree.AlterTenantSetClusterSetting{
+      TenantSpec: &tree.TenantSpec{All: true},
+      Settings: $8.csettingAssignments(),
+    }
+  }
 | ALTER TENANT_ALL ALL error // SHOW HELP: ALTER TENANT CLUSTER SETTING
 
 set_or_reset_csetting_stmt:
   reset_csetting_stmt
 | set_csetting_stmt
 
+csetting_assignment:
+  var_name to_or_eq var_value
+  {
+    $$.val = tree.SetClusterSetting{Name: strings.Join($1.strs(), "."), Value: $3.expr()}
+  }
+
+csetting_assignment_list:
+  csetting_assignment
+  {
+    $$.val = []tree.SetClusterSetting{$1.csettingAssignment()}
+  }
+| csetting_assignment_list ',' csetting_assignment
+  {
+    $$.val = append($1.csettingAssignments(), $3.csettingAssignment())
+  }
+
 to_or_eq:
   '='
 | TO
@@ -22,7 +22,9 @@ import (
 	"unicode"
 
 	"github.com/cockroachdb/cockroach/pkg/keys"
+	"github.com/cockroachdb/cockroach/pkg/roachpb"
 	"github.com/cockroachdb/cockroach/pkg/security/username"
+	"github.com/cockroachdb/cockroach/pkg/settings"
 	"github.com/cockroachdb/cockroach/pkg/sql/catalog"
 	"github.com/cockroachdb/cockroach/pkg/sql/catalog/catalogkeys"
 	"github.com/cockroachdb/cockroach/pkg/sql/catalog/catenumpb"
@@ -244,6 +246,7 @@ var pgCatalog = virtualSchema{
 		catconstants.PgCatalogSubscriptionTableID:               pgCatalogSubscriptionTable,
 		catconstants.PgCatalogTablesTableID:                     pgCatalogTablesTable,
 		catconstants.PgCatalogTablespaceTableID:                 pgCatalogTablespaceTable,
+		catconstants.PgCatalogTenantSettingOverridesTableID:     pgCatalogTenantSettingOverridesTable,
 		catconstants.PgCatalogTimezoneAbbrevsTableID:            pgCatalogTimezoneAbbrevsTable,
 		catconstants.PgCatalogTimezoneNamesTableID:              pgCatalogTimezoneNamesTable,
 		catconstants.PgCatalogTransformTableID:                  pgCatalogTransformTable,
@@ -3086,6 +3089,123 @@ https://www.postgresql.org/docs/9.5/catalog-pg-tablespace.html`,
 	},
 }
 
+// pgCatalogTenantSettingOverridesTable is the tabular counterpart of SHOW
+// CLUSTER SETTINGS FOR TENANT, restricted to the overridden settings, so that
+// the overrides can be inspected by tools that only issue plain queries.
+//
+// In the system tenant, it lists the overrides stored in
+// system.tenant_settings for every tenant, resolved as SHOW CLUSTER SETTINGS
+// FOR TENANT does: a per-tenant override takes precedence over an all-tenants
+// override of the same setting. The all-tenants overrides are also listed
+// under tenant ID 0, where they are stored, and the overrides stored for the
+// system tenant or for a tenant that no longer exists are listed as well. In a
+// secondary tenant, it lists the overrides in effect for the tenant itself.
+//
+// As for the other pg_catalog tables, the rows that the user is not allowed
+// to see, i.e. all of them unless the user can view the cluster settings, are
+// omitted instead of causing an error.
+var pgCatalogTenantSettingOverridesTable = virtualSchemaTable{
+	comment: `setting overrides in effect for each tenant (CockroachDB only)`,
+	schema:  vtable.PGCatalogTenantSettingOverrides,
+	populate: func(ctx context.Context, p *planner, _ catalog.DatabaseDescriptor, addRow func(...tree.Datum) error) error {
+		if hasPriv, err := canViewClusterSettings(ctx, p); err != nil || !hasPriv {
+			return err
+		}
+		if !p.ExecCfg().Codec.ForSystemTenant() {
+			return addCurrentTenantSettingOverrides(p, addRow)
+		}
+
+		// For a given tenant and setting, the per-tenant override is ordered
+		// first. The all-tenants overrides (tenant_id 0) do not apply to the
+		// system tenant.
+		rows, err := p.InternalSQLTxn().QueryBufferedEx(
+			ctx, "pg-tenant-setting-overrides", p.txn, sessiondata.NodeUserSessionDataOverride, `
+WITH tenant_ids AS (
+  SELECT id FROM system.tenants
+  UNION SELECT tenant_id FROM system.tenant_settings
+)
+SELECT t.id, s.name, s.value, s.tenant_id
+FROM tenant_ids AS t
+JOIN system.tenant_settings AS s
+  ON s.tenant_id = t.id OR (s.tenant_id = 0 AND t.id NOT IN (0, $1))
+ORDER BY t.id, s.name, s.tenant_id DESC`,
+			roachpb.SystemTenantID.ToUint64(),
+		)
+		if err != nil {
+			return err
+		}
+		var prevTenantID tree.DInt
+		var prevName string
+		for i, r := range rows {
+			tenantID := tree.MustBeDInt(r[0])
+			name := string(tree.MustBeDString(r[1]))
+			if i > 0 && tenantID == prevTenantID && name == prevName {
+				// Overridden by the per-tenant override.
+				continue
+			}
+			prevTenantID, prevName = tenantID, name
+
+			// The overrides are stored encoded, as in the settings table.
+			// Unknown settings, e.g. set by a more recent version, are shown
+			// as is.
+			value := string(tree.MustBeDString(r[2]))
+			if setting, ok := settings.LookupForLocalAccess(name, true /* forSystemTenant */); ok {
+				if repr, err := setting.DecodeToString(value); err == nil {
+					value = repr
+				}
+			}
+			source := "per-tenant-override"
+			if tree.MustBeDInt(r[3]) == 0 {
+				source = "all-tenants-override"
+			}
+			if err := addRow(
+				tree.NewDInt(tenantID),  // tenant_id
+				tree.NewDString(name),   // variable
+				tree.NewDString(value),  // value
+				tree.NewDString(source), // source
+			); err != nil {
+				return err
+			}
+		}
+		return nil
+	},
+}
+
+// addCurrentTenantSettingOverrides adds a row to
+// pg_catalog.pg_tenant_setting_overrides for each setting of the current
+// secondary tenant that is overridden by the system tenant. The tenant only
+// receives the resolved overrides, so it cannot tell a per-tenant override
+// from an all-tenants override: the source of the rows is "override".
+func addCurrentTenantSettingOverrides(p *planner, addRow func(...tree.Datum) error) error {
+	st := p.ExecCfg().Settings
+	if st.OverridesInformer == nil {
+		return nil
+	}
+	_, tenID, err := keys.DecodeTenantPrefix(p.ExecCfg().Codec.TenantPrefix())
+	if err != nil {
+		return err
+	}
+	tenantID := tree.NewDInt(tree.DInt(tenID.ToUint64()))
+	for _, k := range settings.Keys(false /* forSystemTenant */) {
+		if !st.OverridesInformer.IsOverridden(k) {
+			continue
+		}
+		setting, ok := settings.LookupForLocalAccess(k, false /* forSystemTenant */)
+		if !ok {
+			continue
+		}
+		if err := addRow(
+			tenantID,                                // tenant_id
+			tree.NewDString(k),                      // variable
+			tree.NewDString(setting.String(&st.SV)), // value
+			tree.NewDString("override"),             // source
+		); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 var pgCatalogTriggerTable = virtualSchemaTable{
 	comment: `triggers (empty - feature does not exist)
 https://www.postgresql.org/docs/9.5/catalog-pg-trigger.html`,
@@ -7010,6 +7010,40 @@ table's zone configuration this will return NULL.`,
 		},
 	),
 
+	"crdb_internal.pause_sql_stats_compaction": makeBuiltin(
+		tree.FunctionProperties{
+			Category:         builtinconstants.CategorySystemInfo,
+			DistsqlBlocklist: true, // applicable only on the gateway
+		},
+		tree.Overload{
+			Types:      tree.ParamTypes{{Name: "ttl", Typ: types.Interval}},
+			ReturnType: tree.FixedReturnType(types.TimestampTZ),
+			Fn: func(ctx context.Context, evalCtx *eval.Context, args tree.Datums) (tree.Datum, error) {
+				isAdmin, err := evalCtx.SessionAccessor.HasAdminRole(ctx)
+				if err != nil {
+					return nil, err
+				}
+				if !isAdmin {
+					return nil, errors.New("crdb_internal.pause_sql_stats_compaction() requires admin privilege")
+				}
+				if evalCtx.SQLStatsController == nil {
+					return nil, errors.AssertionFailedf("sql stats controller not set")
+				}
+				ttl := time.Duration(tree.MustBeDInterval(args[0]).Nanos())
+				resumeAt, err := evalCtx.SQLStatsController.PauseSQLStatsCompaction(ctx, ttl)
+				if err != nil {
+					return nil, err
+				}
+				return tree.MakeDTimestampTZ(resumeAt, time.Microsecond)
+			},
+			Info: "This function is used to pause the SQL stats compaction schedule for " +
+				"the given duration, after which the compaction resumes automatically. " +
+				"Returns the time at which the compaction resumes. The duration cannot exceed " +
+				"sql.stats.cleanup.max_pause_duration.",
+			Volatility: volatility.Volatile,
+		},
+	),
+
 	builtinconstants.CreateSchemaTelemetryJobBuiltinName: makeBuiltin(
 		tree.FunctionProperties{
 			Category: builtinconstants.CategorySystemInfo,
@@ -2379,6 +2379,33 @@ var builtinOidsArray = []string{
 	2406: `crdb_internal.fingerprint(span: bytes[], stripped: bool) -> int`,
 	2407: `crdb_internal.tenant_span() -> bytes[]`,
 	2408: `crdb_internal.job_execution_details(job_id: int) -> jsonb`,
+	2409: `crdb_internal.tenants_with_setting_override(name: string) -> int`,
+	2410: `crdb_internal.pause_sql_stats_compaction(ttl: interval) -> timestamptz`,
+	2411: `crdb_internal.sql_stats_compaction_diff(proposed_max: int, proposed_age: interval) -> tuple{string AS table_name, int AS current_rows_to_delete, int AS proposed_rows_to_delete, int AS delta}`,
+	2412: `crdb_internal.sql_stats_mem_usage() -> tuple{int AS used_bytes, int AS limit_bytes}`,
+	2413: `crdb_internal.sql_stats_by_type() -> tuple{string AS statement_type, int AS fingerprint_count}`,
+	2414: `crdb_internal.sql_stats_compaction_coordinator() -> int`,
+	2415: `crdb_internal.flush_sql_stats() -> tuple{int AS written, int AS discarded, interval AS duration}`,
+	2416: `crdb_internal.sql_stats_compact_now(dry_run: bool) -> tuple{string AS table_name, int AS rows_deleted, bool AS dry_run}`,
+	2417: `crdb_internal.sql_stats_storage_bytes() -> tuple{string AS table_name, int AS range_count, int AS approximate_disk_bytes, int AS live_bytes, int AS total_bytes}`,
+	2418: `crdb_internal.sql_stats_compaction_preview() -> tuple{string AS table_name, string AS predicate, int AS row_limit}`,
+	2419: `crdb_internal.validate_schedule_recurrence(expr: string) -> tuple{bool AS valid, string AS error, timestamptz[] AS next_runs, bool AS interval_too_long, bool AS interval_too_short}`,
+	2420: `crdb_internal.validate_schedule_recurrence(expr: string, num_runs: int) -> tuple{bool AS valid, string AS error, timestamptz[] AS next_runs, bool AS interval_too_long, bool AS interval_too_short}`,
+	2421: `crdb_internal.sql_stats_binding_policy() -> tuple{string AS table_name, string AS binding_policy, int AS row_count, int AS rows_over_limit}`,
+	2422: `crdb_internal.tenant_setting_sent_status(name: string) -> tuple{int AS tenant_id, bool AS sent}`,
+	2423: `crdb_internal.sql_stats_schedules() -> tuple{int AS schedule_id, string AS schedule_name, string AS state, string AS status, string AS recurrence, timestamptz AS next_run, timestamptz AS last_run}`,
+	2424: `crdb_internal.sql_stats_top_live(n: int) -> tuple{bytes AS fingerprint_id, bytes AS transaction_fingerprint_id, string AS app_name, string AS query, int AS count, float AS service_latency_mean, timestamptz AS last_exec_at}`,
+	2425: `crdb_internal.sql_stats_compaction_diff(proposed_max: int, proposed_age: interval, max_staleness: interval) -> tuple{string AS table_name, int AS current_rows_to_delete, int AS proposed_rows_to_delete, int AS delta}`,
+	2426: `crdb_internal.sql_stats_by_type(max_staleness: interval) -> tuple{string AS statement_type, int AS fingerprint_count}`,
+	2427: `crdb_internal.sql_stats_compaction_preview(max_staleness: interval) -> tuple{string AS table_name, string AS predicate, int AS row_limit}`,
+	2428: `crdb_internal.sql_stats_binding_policy(max_staleness: interval) -> tuple{string AS table_name, string AS binding_policy, int AS row_count, int AS rows_over_limit}`,
+	2429: `crdb_internal.sql_stats_retention_horizon() -> timestamptz`,
+	2430: `crdb_internal.sql_stats_fingerprint_detail(fingerprint_id: bytes, app_name: string) -> tuple{string AS source, timestamptz AS aggregated_ts, int AS execution_count, timestamptz AS last_flush_at}`,
+	2431: `crdb_internal.sql_stats_fingerprint_detail(fingerprint_id: bytes, app_name: string, max_staleness: interval) -> tuple{string AS source, timestamptz AS aggregated_ts, int AS execution_count, timestamptz AS last_flush_at}`,
+	2432: `crdb_internal.sql_stats_for_app(app_name: string) -> tuple{bytes AS fingerprint_id, int AS execution_count, int AS windows, timestamptz AS first_aggregated_ts, timestamptz AS last_aggregated_ts}`,
+	2433: `crdb_internal.sql_stats_for_app(app_name: string, max_staleness: interval) -> tuple{bytes AS fingerprint_id, int AS execution_count, int AS windows, timestamptz AS first_aggregated_ts, timestamptz AS last_aggregated_ts}`,
+	2434: `crdb_internal.sql_stats_for_app(app_name: string, since: timestamptz) -> tuple{bytes AS fingerprint_id, int AS execution_count, int AS windows, timestamptz AS first_aggregated_ts, timestamptz AS last_aggregated_ts}`,
+	2435: `crdb_internal.sql_stats_for_app(app_name: string, since: timestamptz, max_staleness: interval) -> tuple{bytes AS fingerprint_id, int AS execution_count, int AS windows, timestamptz AS first_aggregated_ts, timestamptz AS last_aggregated_ts}`,
 }
 
 var builtinOidsBySignature map[string]oid.Oid
@@ -421,6 +421,43 @@ var generators = map[string]builtinDefinition{
 		),
 	),
 
+	"crdb_internal.tenants_with_setting_override": makeBuiltin(
+		tree.FunctionProperties{
+			Category:         builtinconstants.CategorySystemInfo,
+			DistsqlBlocklist: true, // applicable only on the gateway
+		},
+		makeGeneratorOverload(
+			tree.ParamTypes{
+				{Name: "name", Typ: types.String},
+			},
+			types.Int,
+			makeTenantsWithSettingOverrideGenerator,
+			"Returns the IDs of the tenants that have a tenant-specific override "+
+				"for the given cluster setting. Overrides set for all tenants via "+
+				"ALTER TENANT ALL are not included.",
+			volatility.Stable,
+		),
+	),
+
+	"crdb_internal.tenant_setting_sent_status": makeBuiltin(
+		tree.FunctionProperties{
+			Category:         builtinconstants.CategorySystemInfo,
+			DistsqlBlocklist: true, // applicable only on the gateway
+		},
+		makeGeneratorOverload(
+			tree.ParamTypes{
+				{Name: "name", Typ: types.String},
+			},
+			tenantSettingSentGeneratorType,
+			makeTenantSettingSentGenerator,
+			"Returns, for each tenant connected to the current node, whether the "+
+				"override of the given cluster setting in effect for the tenant, set with "+
+				"ALTER TENANT SET CLUSTER SETTING, was sent to the tenant by the current node. "+
+				"The status is node-local, and the receipt by the tenant is not acknowledged.",
+			volatility.Volatile,
+		),
+	),
+
 	"crdb_internal.list_sql_keys_in_range": makeBuiltin(
 		tree.FunctionProperties{
 			Category: builtinconstants.CategorySystemInfo,
@@ -1966,6 +2003,84 @@ type checkConsistencyGenerator struct {
 
 var _ eval.ValueGenerator = &checkConsistencyGenerator{}
 
+// makeTenantsWithSettingOverrideGenerator creates a generator to support
+// the crdb_internal.tenants_with_setting_override(name) builtin. It reads
+// system.tenant_settings, which is where ALTER TENANT ... SET CLUSTER
+// SETTING stores its overrides. Rows with tenant_id = 0 hold the override
+// for all tenants and are excluded.
+func makeTenantsWithSettingOverrideGenerator(
+	ctx context.Context, evalCtx *eval.Context, args tree.Datums,
+) (_ eval.ValueGenerator, retErr error) {
+	if !evalCtx.Codec.ForSystemTenant() {
+		return nil, pgerror.New(pgcode.InsufficientPrivilege,
+			"crdb_internal.tenants_with_setting_override can only be called by system operators")
+	}
+	isAdmin, err := evalCtx.SessionAccessor.HasAdminRole(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !isAdmin {
+		return nil, pgerror.New(pgcode.InsufficientPrivilege,
+			"crdb_internal.tenants_with_setting_override requires admin privileges")
+	}
+
+	name := strings.ToLower(string(tree.MustBeDString(args[0])))
+	it, err := evalCtx.Planner.QueryIteratorEx(
+		ctx,
+		"crdb_internal.tenants_with_setting_override",
+		sessiondata.NodeUserSessionDataOverride,
+		`SELECT tenant_id FROM system.tenant_settings WHERE name = $1 AND tenant_id <> 0 ORDER BY tenant_id`,
+		name,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		retErr = errors.CombineErrors(retErr, it.Close())
+	}()
+
+	tenantIDs := tree.NewDArray(types.Int)
+	var ok bool
+	for ok, err = it.Next(ctx); ok; ok, err = it.Next(ctx) {
+		if err := tenantIDs.Append(it.Cur()[0]); err != nil {
+			return nil, err
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &arrayValueGenerator{array: tenantIDs}, nil
+}
+
+var tenantSettingSentGeneratorType = types.MakeLabeledTuple(
+	[]*types.T{types.Int, types.Bool},
+	[]string{"tenant_id", "sent"},
+)
+
+// makeTenantSettingSentGenerator creates a generator to support the
+// crdb_internal.tenant_setting_sent_status(name) builtin. The override
+// in effect for a tenant is compared to the last overrides sent to the tenant
+// by this node, see eval.TenantOperator.GetTenantSettingSentStatus.
+// The other nodes are not consulted.
+func makeTenantSettingSentGenerator(
+	ctx context.Context, evalCtx *eval.Context, args tree.Datums,
+) (eval.ValueGenerator, error) {
+	statuses, err := evalCtx.Tenant.GetTenantSettingSentStatus(
+		ctx, string(tree.MustBeDString(args[0])),
+	)
+	if err != nil {
+		return nil, err
+	}
+	rows := make([]tree.Datums, 0, len(statuses))
+	for _, s := range statuses {
+		rows = append(rows, tree.Datums{
+			tree.NewDInt(tree.DInt(s.TenantID.ToUint64())),
+			tree.MakeDBool(tree.DBool(s.Sent)),
+		})
+	}
+	return &sqlStatsRowsGenerator{typ: tenantSettingSentGeneratorType, rows: rows}, nil
+}
+
 func makeCheckConsistencyGenerator(
 	ctx context.Context, evalCtx *eval.Context, args tree.Datums,
 ) (eval.ValueGenerator, error) {
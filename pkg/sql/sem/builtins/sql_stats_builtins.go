@@ -0,0 +1,1011 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package builtins
+
+import (
+	"context"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/kv"
+	"github.com/cockroachdb/cockroach/pkg/sql/pgwire/pgcode"
+	"github.com/cockroachdb/cockroach/pkg/sql/pgwire/pgerror"
+	"github.com/cockroachdb/cockroach/pkg/sql/sem/builtins/builtinconstants"
+	"github.com/cockroachdb/cockroach/pkg/sql/sem/eval"
+	"github.com/cockroachdb/cockroach/pkg/sql/sem/tree"
+	"github.com/cockroachdb/cockroach/pkg/sql/sem/volatility"
+	"github.com/cockroachdb/cockroach/pkg/sql/types"
+	"github.com/cockroachdb/cockroach/pkg/util/duration"
+	"github.com/cockroachdb/errors"
+)
+
+func init() {
+	for k, v := range sqlStatsBuiltins {
+		registerBuiltin(k, v)
+	}
+}
+
+// sqlStatsBuiltins contains the built-in functions used to inspect and
+// manage the persisted SQL stats subsystem, indexed by name.
+//
+// For use in other packages, see AllBuiltinNames and GetBuiltinProperties().
+var sqlStatsBuiltins = map[string]builtinDefinition{
+	"crdb_internal.sql_stats_compaction_diff": makeBuiltin(
+		tree.FunctionProperties{
+			Category:         builtinconstants.CategorySystemInfo,
+			DistsqlBlocklist: true, // applicable only on the gateway
+		},
+		makeGeneratorOverload(
+			tree.ParamTypes{
+				{Name: "proposed_max", Typ: types.Int},
+				{Name: "proposed_age", Typ: types.Interval},
+			},
+			sqlStatsCompactionDiffGeneratorType,
+			makeSQLStatsCompactionDiffGenerator,
+			sqlStatsCompactionDiffInfo,
+			volatility.Volatile,
+		),
+		makeGeneratorOverload(
+			tree.ParamTypes{
+				{Name: "proposed_max", Typ: types.Int},
+				{Name: "proposed_age", Typ: types.Interval},
+				{Name: "max_staleness", Typ: types.Interval},
+			},
+			sqlStatsCompactionDiffGeneratorType,
+			makeSQLStatsCompactionDiffGenerator,
+			sqlStatsCompactionDiffInfo+" "+sqlStatsMaxStalenessInfo,
+			volatility.Volatile,
+		),
+	),
+	"crdb_internal.sql_stats_mem_usage": makeBuiltin(
+		tree.FunctionProperties{
+			Category:         builtinconstants.CategorySystemInfo,
+			DistsqlBlocklist: true, // applicable only on the gateway
+		},
+		makeGeneratorOverload(
+			tree.ParamTypes{},
+			sqlStatsMemUsageGeneratorType,
+			makeSQLStatsMemUsageGenerator,
+			"Returns the number of bytes currently used by the in-memory SQL stats "+
+				"of the gateway node, and the memory limit that applies to them. "+
+				"Fingerprints are evicted from memory before being flushed when the "+
+				"in-memory stats run out of memory.",
+			volatility.Volatile,
+		),
+	),
+	"crdb_internal.sql_stats_by_type": makeBuiltin(
+		tree.FunctionProperties{
+			Category:         builtinconstants.CategorySystemInfo,
+			DistsqlBlocklist: true, // applicable only on the gateway
+		},
+		makeGeneratorOverload(
+			tree.ParamTypes{},
+			sqlStatsByTypeGeneratorType,
+			makeSQLStatsByTypeGenerator,
+			sqlStatsByTypeInfo,
+			volatility.Volatile,
+		),
+		makeGeneratorOverload(
+			tree.ParamTypes{{Name: "max_staleness", Typ: types.Interval}},
+			sqlStatsByTypeGeneratorType,
+			makeSQLStatsByTypeGenerator,
+			sqlStatsByTypeInfo+" "+sqlStatsMaxStalenessInfo,
+			volatility.Volatile,
+		),
+	),
+	"crdb_internal.sql_stats_storage_bytes": makeBuiltin(
+		tree.FunctionProperties{
+			Category:         builtinconstants.CategorySystemInfo,
+			DistsqlBlocklist: true, // applicable only on the gateway
+		},
+		makeGeneratorOverload(
+			tree.ParamTypes{},
+			sqlStatsStorageBytesGeneratorType,
+			makeSQLStatsStorageBytesGenerator,
+			"Returns, for each persisted SQL stats table, its number of ranges and "+
+				"its estimated storage in bytes: on disk, in live rows, and in total "+
+				"including the MVCC history. The estimates are derived from the range "+
+				"statistics rather than a scan of the tables. Together with the "+
+				"sql.stats.persisted.oldest_row_age_seconds metric, they help size "+
+				"sql.stats.persisted_rows.max.",
+			volatility.Volatile,
+		),
+	),
+	"crdb_internal.flush_sql_stats": makeBuiltin(
+		tree.FunctionProperties{
+			Category:         builtinconstants.CategorySystemInfo,
+			DistsqlBlocklist: true, // applicable only on the gateway
+		},
+		makeGeneratorOverload(
+			tree.ParamTypes{},
+			sqlStatsFlushGeneratorType,
+			makeSQLStatsFlushGenerator,
+			"Flushes the in-memory SQL stats of the gateway node into the persisted "+
+				"SQL stats, and returns the number of fingerprints written and discarded "+
+				"as well as the duration of the flush. The flush is subject to "+
+				"sql.stats.flush.enabled and sql.stats.flush.minimum_interval, and is "+
+				"canceled if it does not complete within a minute.",
+			volatility.Volatile,
+		),
+	),
+	"crdb_internal.sql_stats_compact_now": makeBuiltin(
+		tree.FunctionProperties{
+			Category:         builtinconstants.CategorySystemInfo,
+			DistsqlBlocklist: true, // applicable only on the gateway
+		},
+		makeGeneratorOverload(
+			tree.ParamTypes{{Name: "dry_run", Typ: types.Bool}},
+			sqlStatsCompactNowGeneratorType,
+			makeSQLStatsCompactNowGenerator,
+			"Compacts the persisted SQL stats on the gateway node according to the "+
+				"current retention policy, and returns the number of rows removed from "+
+				"each table. If dry_run is true, the tables are only read, and the "+
+				"returned counts are the estimated numbers of rows that the compaction "+
+				"would remove, counted with the same retention rules as the compaction. "+
+				"The compaction ignores sql.stats.cleanup.window, and fails if the SQL "+
+				"stats compaction job is running. It is recorded in "+
+				"system.sql_stats_compaction_runs and in the event log as the runs of "+
+				"the job are.",
+			volatility.Volatile,
+		),
+	),
+	"crdb_internal.sql_stats_compaction_preview": makeBuiltin(
+		tree.FunctionProperties{
+			Category:         builtinconstants.CategorySystemInfo,
+			DistsqlBlocklist: true, // applicable only on the gateway
+		},
+		makeGeneratorOverload(
+			tree.ParamTypes{},
+			sqlStatsCompactionPreviewGeneratorType,
+			makeSQLStatsCompactionPreviewGenerator,
+			sqlStatsCompactionPreviewInfo,
+			volatility.Volatile,
+		),
+		makeGeneratorOverload(
+			tree.ParamTypes{{Name: "max_staleness", Typ: types.Interval}},
+			sqlStatsCompactionPreviewGeneratorType,
+			makeSQLStatsCompactionPreviewGenerator,
+			sqlStatsCompactionPreviewInfo+" "+sqlStatsMaxStalenessInfo,
+			volatility.Volatile,
+		),
+	),
+	"crdb_internal.sql_stats_binding_policy": makeBuiltin(
+		tree.FunctionProperties{
+			Category:         builtinconstants.CategorySystemInfo,
+			DistsqlBlocklist: true, // applicable only on the gateway
+		},
+		makeGeneratorOverload(
+			tree.ParamTypes{},
+			sqlStatsBindingPolicyGeneratorType,
+			makeSQLStatsBindingPolicyGenerator,
+			sqlStatsBindingPolicyInfo,
+			volatility.Volatile,
+		),
+		makeGeneratorOverload(
+			tree.ParamTypes{{Name: "max_staleness", Typ: types.Interval}},
+			sqlStatsBindingPolicyGeneratorType,
+			makeSQLStatsBindingPolicyGenerator,
+			sqlStatsBindingPolicyInfo+" "+sqlStatsMaxStalenessInfo,
+			volatility.Volatile,
+		),
+	),
+	"crdb_internal.sql_stats_schedules": makeBuiltin(
+		tree.FunctionProperties{
+			Category:         builtinconstants.CategorySystemInfo,
+			DistsqlBlocklist: true, // applicable only on the gateway
+		},
+		makeGeneratorOverload(
+			tree.ParamTypes{},
+			sqlStatsSchedulesGeneratorType,
+			makeSQLStatsSchedulesGenerator,
+			"Returns the schedules of the SQL stats subsystem, such as the SQL stats "+
+				"compaction schedule, with their state (ACTIVE or PAUSED), their status "+
+				"message, their recurrence, their next run, or NULL if they are paused, "+
+				"and their last run, i.e. the creation time of the most recent job they "+
+				"started, or NULL if they have not started any job yet.",
+			volatility.Volatile,
+		),
+	),
+	"crdb_internal.sql_stats_top_live": makeBuiltin(
+		tree.FunctionProperties{
+			Category:         builtinconstants.CategorySystemInfo,
+			DistsqlBlocklist: true, // applicable only on the gateway
+		},
+		makeGeneratorOverload(
+			tree.ParamTypes{{Name: "n", Typ: types.Int}},
+			sqlStatsTopLiveGeneratorType,
+			makeSQLStatsTopLiveGenerator,
+			"Returns the n statement fingerprints with the highest execution counts "+
+				"among the in-memory SQL stats of the gateway node, i.e. the executions "+
+				"since its last flush, by decreasing count. The persisted SQL stats "+
+				"are not read. At most 1000 fingerprints are returned.",
+			volatility.Volatile,
+		),
+	),
+	"crdb_internal.sql_stats_fingerprint_detail": makeBuiltin(
+		tree.FunctionProperties{
+			Category:         builtinconstants.CategorySystemInfo,
+			DistsqlBlocklist: true, // applicable only on the gateway
+		},
+		makeGeneratorOverload(
+			tree.ParamTypes{
+				{Name: "fingerprint_id", Typ: types.Bytes},
+				{Name: "app_name", Typ: types.String},
+			},
+			sqlStatsFingerprintDetailGeneratorType,
+			makeSQLStatsFingerprintDetailGenerator,
+			sqlStatsFingerprintDetailInfo,
+			volatility.Volatile,
+		),
+		makeGeneratorOverload(
+			tree.ParamTypes{
+				{Name: "fingerprint_id", Typ: types.Bytes},
+				{Name: "app_name", Typ: types.String},
+				{Name: "max_staleness", Typ: types.Interval},
+			},
+			sqlStatsFingerprintDetailGeneratorType,
+			makeSQLStatsFingerprintDetailGenerator,
+			sqlStatsFingerprintDetailInfo+" "+sqlStatsMaxStalenessInfo,
+			volatility.Volatile,
+		),
+	),
+	"crdb_internal.sql_stats_for_app": makeBuiltin(
+		tree.FunctionProperties{
+			Category:         builtinconstants.CategorySystemInfo,
+			DistsqlBlocklist: true, // applicable only on the gateway
+		},
+		makeGeneratorOverload(
+			tree.ParamTypes{{Name: "app_name", Typ: types.String}},
+			sqlStatsForAppGeneratorType,
+			makeSQLStatsForAppGenerator,
+			sqlStatsForAppInfo,
+			volatility.Volatile,
+		),
+		makeGeneratorOverload(
+			tree.ParamTypes{
+				{Name: "app_name", Typ: types.String},
+				{Name: "max_staleness", Typ: types.Interval},
+			},
+			sqlStatsForAppGeneratorType,
+			makeSQLStatsForAppGenerator,
+			sqlStatsForAppInfo+" "+sqlStatsMaxStalenessInfo,
+			volatility.Volatile,
+		),
+		makeGeneratorOverload(
+			tree.ParamTypes{
+				{Name: "app_name", Typ: types.String},
+				{Name: "since", Typ: types.TimestampTZ},
+			},
+			sqlStatsForAppGeneratorType,
+			makeSQLStatsForAppGenerator,
+			sqlStatsForAppInfo+" "+sqlStatsForAppSinceInfo,
+			volatility.Volatile,
+		),
+		makeGeneratorOverload(
+			tree.ParamTypes{
+				{Name: "app_name", Typ: types.String},
+				{Name: "since", Typ: types.TimestampTZ},
+				{Name: "max_staleness", Typ: types.Interval},
+			},
+			sqlStatsForAppGeneratorType,
+			makeSQLStatsForAppGenerator,
+			sqlStatsForAppInfo+" "+sqlStatsForAppSinceInfo+" "+sqlStatsMaxStalenessInfo,
+			volatility.Volatile,
+		),
+	),
+	"crdb_internal.validate_schedule_recurrence": makeBuiltin(
+		tree.FunctionProperties{
+			Category:         builtinconstants.CategorySystemInfo,
+			DistsqlBlocklist: true, // applicable only on the gateway
+		},
+		makeGeneratorOverload(
+			tree.ParamTypes{{Name: "expr", Typ: types.String}},
+			validateScheduleRecurrenceGeneratorType,
+			makeValidateScheduleRecurrenceGenerator,
+			validateScheduleRecurrenceInfo+" The next 5 runs are returned.",
+			volatility.Volatile,
+		),
+		makeGeneratorOverload(
+			tree.ParamTypes{
+				{Name: "expr", Typ: types.String},
+				{Name: "num_runs", Typ: types.Int},
+			},
+			validateScheduleRecurrenceGeneratorType,
+			makeValidateScheduleRecurrenceGenerator,
+			validateScheduleRecurrenceInfo+" The next num_runs runs are returned.",
+			volatility.Volatile,
+		),
+	),
+	"crdb_internal.sql_stats_compaction_coordinator": makeBuiltin(
+		tree.FunctionProperties{
+			Category:         builtinconstants.CategorySystemInfo,
+			DistsqlBlocklist: true, // applicable only on the gateway
+		},
+		tree.Overload{
+			Types:      tree.ParamTypes{},
+			ReturnType: tree.FixedReturnType(types.Int),
+			Fn: func(ctx context.Context, evalCtx *eval.Context, _ tree.Datums) (tree.Datum, error) {
+				if err := checkSQLStatsAdmin(ctx, evalCtx, "crdb_internal.sql_stats_compaction_coordinator"); err != nil {
+					return nil, err
+				}
+				instanceID, ok, err := evalCtx.SQLStatsController.GetSQLStatsCompactionCoordinator(ctx)
+				if err != nil {
+					return nil, err
+				}
+				if !ok {
+					return tree.DNull, nil
+				}
+				return tree.NewDInt(tree.DInt(instanceID)), nil
+			},
+			Info: "Returns the ID of the node (SQL instance) running the SQL stats " +
+				"compaction job, or NULL if no compaction job is running.",
+			Volatility: volatility.Volatile,
+		},
+	),
+	"crdb_internal.sql_stats_retention_horizon": makeBuiltin(
+		tree.FunctionProperties{
+			Category:         builtinconstants.CategorySystemInfo,
+			DistsqlBlocklist: true, // applicable only on the gateway
+		},
+		tree.Overload{
+			Types:      tree.ParamTypes{},
+			ReturnType: tree.FixedReturnType(types.TimestampTZ),
+			Fn: func(ctx context.Context, evalCtx *eval.Context, _ tree.Datums) (tree.Datum, error) {
+				if err := checkSQLStatsAdmin(ctx, evalCtx, "crdb_internal.sql_stats_retention_horizon"); err != nil {
+					return nil, err
+				}
+				horizon, ok, err := evalCtx.SQLStatsController.GetSQLStatsRetentionHorizon(ctx)
+				if err != nil {
+					return nil, err
+				}
+				if !ok {
+					return tree.DNull, nil
+				}
+				return tree.MakeDTimestampTZ(horizon, time.Microsecond)
+			},
+			Info: "Returns the estimated oldest timestamp from which the persisted " +
+				"SQL stats are retained once the SQL stats compaction enforces the " +
+				"current retention policy, i.e. the most recent of the cutoff of " +
+				"sql.stats.persisted_rows.max_age and the timestamp of the oldest rows " +
+				"kept under sql.stats.persisted_rows.max, or NULL if neither limits the " +
+				"stats. The estimate does not account for the rows retained or removed " +
+				"by the other cleanup settings. The tables are only read.",
+			Volatility: volatility.Volatile,
+		},
+	),
+}
+
+const (
+	sqlStatsCompactionDiffInfo = "Compares, for each persisted SQL stats table, " +
+		"the number of rows that the SQL stats compaction job would remove under " +
+		"the current retention policy and under a proposed policy that keeps at " +
+		"most proposed_max rows and removes rows older than proposed_age. A " +
+		"proposed_max or proposed_age of zero means no row cap or no age limit, " +
+		"respectively. The tables are only read."
+	sqlStatsByTypeInfo = "Returns the number of distinct statement fingerprints " +
+		"in the persisted SQL stats, grouped by statement type. The statement type " +
+		"is the statement tag recorded when the fingerprint was flushed (e.g. " +
+		"SELECT, INSERT, CREATE TABLE)."
+	sqlStatsCompactionPreviewInfo = "Returns the selections of rows that the SQL " +
+		"stats compaction would remove from each persisted SQL stats table under " +
+		"the current retention policy: the rows matching the predicate are " +
+		"removed oldest first, up to row_limit rows, or without limit if " +
+		"row_limit is NULL. The tables are only read."
+	sqlStatsBindingPolicyInfo = "Returns, for each persisted SQL stats table, " +
+		"the retention policy that currently limits it: row_cap if more rows " +
+		"exceed sql.stats.persisted_rows.max than sql.stats.persisted_rows.max_age, " +
+		"max_age otherwise, or none if the table is within both limits. Also " +
+		"returns the number of rows of the table and the number of rows over the " +
+		"binding limit. The tables are only read."
+	sqlStatsFingerprintDetailInfo = "Returns the execution counts of a statement " +
+		"fingerprint of an application: first the count recorded in memory by the " +
+		"gateway node since its last flush (source memory, with a NULL " +
+		"aggregated_ts), then the persisted counts of the 1000 most recent " +
+		"aggregation windows across all nodes (source persisted), most recent " +
+		"first. Each row also holds the time of the last flush of the gateway " +
+		"node, or NULL if it has not flushed yet. The in-memory and persisted " +
+		"counts are not read atomically."
+	sqlStatsForAppInfo = "Returns the persisted execution counts of the " +
+		"statement fingerprints of an application, aggregated across all the " +
+		"aggregation windows, transactions, plans, and nodes, along with the " +
+		"number of windows in which each fingerprint was executed and the start " +
+		"times of the first and last of them. The 1000 most executed " +
+		"fingerprints are returned, by decreasing count. The in-memory SQL stats " +
+		"and the stats of the internal applications are not read."
+	sqlStatsForAppSinceInfo = "With since, only the aggregation windows " +
+		"starting at or after since are read, which bounds the scan of the " +
+		"tables; otherwise, all the persisted windows are read."
+	sqlStatsMaxStalenessInfo = "By default, the tables are read with follower " +
+		"reads. With max_staleness, they are read as of max_staleness ago instead, " +
+		"so the results miss at most max_staleness of the latest changes; a " +
+		"max_staleness of zero reads the current data, at the risk of contending " +
+		"with the writes to the tables. A max_staleness larger than the garbage " +
+		"collection TTL of the tables fails."
+)
+
+// getSQLStatsReadOptions returns the options of the scans of the persisted SQL
+// stats tables given the optional max_staleness argument at index idx of args.
+func getSQLStatsReadOptions(args tree.Datums, idx int) (eval.SQLStatsReadOptions, error) {
+	if len(args) <= idx {
+		return eval.SQLStatsReadOptions{}, nil
+	}
+	maxStaleness := time.Duration(tree.MustBeDInterval(args[idx]).Nanos())
+	if maxStaleness < 0 {
+		return eval.SQLStatsReadOptions{}, pgerror.Newf(pgcode.InvalidParameterValue,
+			"max_staleness must be non-negative, got %s", maxStaleness)
+	}
+	return eval.SQLStatsReadOptions{BoundedStaleness: true, MaxStaleness: maxStaleness}, nil
+}
+
+// checkSQLStatsAdmin returns an error if the current user does not have the
+// admin role, which is required by the SQL stats builtins that expose or
+// modify cluster-wide state.
+func checkSQLStatsAdmin(ctx context.Context, evalCtx *eval.Context, builtinName string) error {
+	isAdmin, err := evalCtx.SessionAccessor.HasAdminRole(ctx)
+	if err != nil {
+		return err
+	}
+	if !isAdmin {
+		return pgerror.Newf(pgcode.InsufficientPrivilege, "%s requires admin privileges", builtinName)
+	}
+	if evalCtx.SQLStatsController == nil {
+		return errors.AssertionFailedf("sql stats controller not set")
+	}
+	return nil
+}
+
+// sqlStatsRowsGenerator is a ValueGenerator over a precomputed set of rows.
+// The SQL stats builtins compute their (small) results upfront through the
+// SQLStatsController and use it to return them. It is also used by
+// crdb_internal.tenant_setting_sent_status.
+type sqlStatsRowsGenerator struct {
+	typ  *types.T
+	rows []tree.Datums
+	idx  int
+}
+
+var _ eval.ValueGenerator = &sqlStatsRowsGenerator{}
+
+// ResolvedType implements the eval.ValueGenerator interface.
+func (g *sqlStatsRowsGenerator) ResolvedType() *types.T { return g.typ }
+
+// Start implements the eval.ValueGenerator interface.
+func (g *sqlStatsRowsGenerator) Start(_ context.Context, _ *kv.Txn) error {
+	g.idx = -1
+	return nil
+}
+
+// Next implements the eval.ValueGenerator interface.
+func (g *sqlStatsRowsGenerator) Next(_ context.Context) (bool, error) {
+	g.idx++
+	return g.idx < len(g.rows), nil
+}
+
+// Values implements the eval.ValueGenerator interface.
+func (g *sqlStatsRowsGenerator) Values() (tree.Datums, error) {
+	return g.rows[g.idx], nil
+}
+
+// Close implements the eval.ValueGenerator interface.
+func (g *sqlStatsRowsGenerator) Close(_ context.Context) {}
+
+var sqlStatsCompactionDiffGeneratorType = types.MakeLabeledTuple(
+	[]*types.T{types.String, types.Int, types.Int, types.Int},
+	[]string{"table_name", "current_rows_to_delete", "proposed_rows_to_delete", "delta"},
+)
+
+func makeSQLStatsCompactionDiffGenerator(
+	ctx context.Context, evalCtx *eval.Context, args tree.Datums,
+) (eval.ValueGenerator, error) {
+	if err := checkSQLStatsAdmin(ctx, evalCtx, "crdb_internal.sql_stats_compaction_diff"); err != nil {
+		return nil, err
+	}
+	proposedMaxRows := int64(tree.MustBeDInt(args[0]))
+	if proposedMaxRows < 0 {
+		return nil, pgerror.Newf(pgcode.InvalidParameterValue,
+			"proposed_max must be non-negative, got %d", proposedMaxRows)
+	}
+	proposedMaxAge := time.Duration(tree.MustBeDInterval(args[1]).Nanos())
+	if proposedMaxAge < 0 {
+		return nil, pgerror.Newf(pgcode.InvalidParameterValue,
+			"proposed_age must be non-negative, got %s", proposedMaxAge)
+	}
+	opts, err := getSQLStatsReadOptions(args, 2)
+	if err != nil {
+		return nil, err
+	}
+
+	diffs, err := evalCtx.SQLStatsController.DiffSQLStatsCompactionPolicy(
+		ctx, proposedMaxRows, proposedMaxAge, opts,
+	)
+	if err != nil {
+		return nil, err
+	}
+	rows := make([]tree.Datums, 0, len(diffs))
+	for _, diff := range diffs {
+		rows = append(rows, tree.Datums{
+			tree.NewDString(diff.Table),
+			tree.NewDInt(tree.DInt(diff.CurrentRowsToDelete)),
+			tree.NewDInt(tree.DInt(diff.ProposedRowsToDelete)),
+			tree.NewDInt(tree.DInt(diff.ProposedRowsToDelete - diff.CurrentRowsToDelete)),
+		})
+	}
+	return &sqlStatsRowsGenerator{typ: sqlStatsCompactionDiffGeneratorType, rows: rows}, nil
+}
+
+var sqlStatsMemUsageGeneratorType = types.MakeLabeledTuple(
+	[]*types.T{types.Int, types.Int},
+	[]string{"used_bytes", "limit_bytes"},
+)
+
+func makeSQLStatsMemUsageGenerator(
+	ctx context.Context, evalCtx *eval.Context, _ tree.Datums,
+) (eval.ValueGenerator, error) {
+	if err := checkSQLStatsAdmin(ctx, evalCtx, "crdb_internal.sql_stats_mem_usage"); err != nil {
+		return nil, err
+	}
+	usedBytes, limitBytes := evalCtx.SQLStatsController.GetSQLStatsMemoryUsage(ctx)
+	return &sqlStatsRowsGenerator{
+		typ: sqlStatsMemUsageGeneratorType,
+		rows: []tree.Datums{{
+			tree.NewDInt(tree.DInt(usedBytes)),
+			tree.NewDInt(tree.DInt(limitBytes)),
+		}},
+	}, nil
+}
+
+var sqlStatsByTypeGeneratorType = types.MakeLabeledTuple(
+	[]*types.T{types.String, types.Int},
+	[]string{"statement_type", "fingerprint_count"},
+)
+
+func makeSQLStatsByTypeGenerator(
+	ctx context.Context, evalCtx *eval.Context, args tree.Datums,
+) (eval.ValueGenerator, error) {
+	if err := checkSQLStatsAdmin(ctx, evalCtx, "crdb_internal.sql_stats_by_type"); err != nil {
+		return nil, err
+	}
+	opts, err := getSQLStatsReadOptions(args, 0)
+	if err != nil {
+		return nil, err
+	}
+	counts, err := evalCtx.SQLStatsController.GetSQLStatsFingerprintCountsByType(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	rows := make([]tree.Datums, 0, len(counts))
+	for _, c := range counts {
+		rows = append(rows, tree.Datums{
+			tree.NewDString(c.StatementType),
+			tree.NewDInt(tree.DInt(c.FingerprintCount)),
+		})
+	}
+	return &sqlStatsRowsGenerator{typ: sqlStatsByTypeGeneratorType, rows: rows}, nil
+}
+
+var sqlStatsStorageBytesGeneratorType = types.MakeLabeledTuple(
+	[]*types.T{types.String, types.Int, types.Int, types.Int, types.Int},
+	[]string{"table_name", "range_count", "approximate_disk_bytes", "live_bytes", "total_bytes"},
+)
+
+func makeSQLStatsStorageBytesGenerator(
+	ctx context.Context, evalCtx *eval.Context, _ tree.Datums,
+) (eval.ValueGenerator, error) {
+	if err := checkSQLStatsAdmin(ctx, evalCtx, "crdb_internal.sql_stats_storage_bytes"); err != nil {
+		return nil, err
+	}
+	storage, err := evalCtx.SQLStatsController.GetSQLStatsStorageBytes(ctx)
+	if err != nil {
+		return nil, err
+	}
+	rows := make([]tree.Datums, 0, len(storage))
+	for _, s := range storage {
+		rows = append(rows, tree.Datums{
+			tree.NewDString(s.Table),
+			tree.NewDInt(tree.DInt(s.RangeCount)),
+			tree.NewDInt(tree.DInt(s.ApproximateDiskBytes)),
+			tree.NewDInt(tree.DInt(s.LiveBytes)),
+			tree.NewDInt(tree.DInt(s.TotalBytes)),
+		})
+	}
+	return &sqlStatsRowsGenerator{typ: sqlStatsStorageBytesGeneratorType, rows: rows}, nil
+}
+
+var sqlStatsFlushGeneratorType = types.MakeLabeledTuple(
+	[]*types.T{types.Int, types.Int, types.Interval},
+	[]string{"written", "discarded", "duration"},
+)
+
+func makeSQLStatsFlushGenerator(
+	ctx context.Context, evalCtx *eval.Context, _ tree.Datums,
+) (eval.ValueGenerator, error) {
+	if err := checkSQLStatsAdmin(ctx, evalCtx, "crdb_internal.flush_sql_stats"); err != nil {
+		return nil, err
+	}
+	report, err := evalCtx.SQLStatsController.FlushSQLStats(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &sqlStatsRowsGenerator{
+		typ: sqlStatsFlushGeneratorType,
+		rows: []tree.Datums{{
+			tree.NewDInt(tree.DInt(report.Written)),
+			tree.NewDInt(tree.DInt(report.Discarded)),
+			tree.NewDInterval(
+				duration.MakeDuration(report.Duration.Nanoseconds(), 0 /* days */, 0 /* months */),
+				types.DefaultIntervalTypeMetadata,
+			),
+		}},
+	}, nil
+}
+
+var sqlStatsCompactNowGeneratorType = types.MakeLabeledTuple(
+	[]*types.T{types.String, types.Int, types.Bool},
+	[]string{"table_name", "rows_deleted", "dry_run"},
+)
+
+func makeSQLStatsCompactNowGenerator(
+	ctx context.Context, evalCtx *eval.Context, args tree.Datums,
+) (eval.ValueGenerator, error) {
+	if err := checkSQLStatsAdmin(ctx, evalCtx, "crdb_internal.sql_stats_compact_now"); err != nil {
+		return nil, err
+	}
+	dryRun := bool(tree.MustBeDBool(args[0]))
+	results, err := evalCtx.SQLStatsController.CompactSQLStatsNow(ctx, dryRun)
+	if err != nil {
+		return nil, err
+	}
+	rows := make([]tree.Datums, 0, len(results))
+	for _, r := range results {
+		rows = append(rows, tree.Datums{
+			tree.NewDString(r.Table),
+			tree.NewDInt(tree.DInt(r.Rows)),
+			tree.MakeDBool(tree.DBool(dryRun)),
+		})
+	}
+	return &sqlStatsRowsGenerator{typ: sqlStatsCompactNowGeneratorType, rows: rows}, nil
+}
+
+var sqlStatsCompactionPreviewGeneratorType = types.MakeLabeledTuple(
+	[]*types.T{types.String, types.String, types.Int},
+	[]string{"table_name", "predicate", "row_limit"},
+)
+
+func makeSQLStatsCompactionPreviewGenerator(
+	ctx context.Context, evalCtx *eval.Context, args tree.Datums,
+) (eval.ValueGenerator, error) {
+	if err := checkSQLStatsAdmin(ctx, evalCtx, "crdb_internal.sql_stats_compaction_preview"); err != nil {
+		return nil, err
+	}
+	opts, err := getSQLStatsReadOptions(args, 0)
+	if err != nil {
+		return nil, err
+	}
+	selections, err := evalCtx.SQLStatsController.PreviewSQLStatsCompaction(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	rows := make([]tree.Datums, 0, len(selections))
+	for _, sel := range selections {
+		limit := tree.DNull
+		if sel.Limit >= 0 {
+			limit = tree.NewDInt(tree.DInt(sel.Limit))
+		}
+		rows = append(rows, tree.Datums{
+			tree.NewDString(sel.Table),
+			tree.NewDString(sel.Predicate),
+			limit,
+		})
+	}
+	return &sqlStatsRowsGenerator{typ: sqlStatsCompactionPreviewGeneratorType, rows: rows}, nil
+}
+
+var sqlStatsBindingPolicyGeneratorType = types.MakeLabeledTuple(
+	[]*types.T{types.String, types.String, types.Int, types.Int},
+	[]string{"table_name", "binding_policy", "row_count", "rows_over_limit"},
+)
+
+func makeSQLStatsBindingPolicyGenerator(
+	ctx context.Context, evalCtx *eval.Context, args tree.Datums,
+) (eval.ValueGenerator, error) {
+	if err := checkSQLStatsAdmin(ctx, evalCtx, "crdb_internal.sql_stats_binding_policy"); err != nil {
+		return nil, err
+	}
+	opts, err := getSQLStatsReadOptions(args, 0)
+	if err != nil {
+		return nil, err
+	}
+	policies, err := evalCtx.SQLStatsController.GetSQLStatsBindingPolicies(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	rows := make([]tree.Datums, 0, len(policies))
+	for _, p := range policies {
+		rows = append(rows, tree.Datums{
+			tree.NewDString(p.Table),
+			tree.NewDString(p.Policy),
+			tree.NewDInt(tree.DInt(p.RowCount)),
+			tree.NewDInt(tree.DInt(p.RowsOverLimit)),
+		})
+	}
+	return &sqlStatsRowsGenerator{typ: sqlStatsBindingPolicyGeneratorType, rows: rows}, nil
+}
+
+var sqlStatsSchedulesGeneratorType = types.MakeLabeledTuple(
+	[]*types.T{
+		types.Int, types.String, types.String, types.String, types.String,
+		types.TimestampTZ, types.TimestampTZ,
+	},
+	[]string{
+		"schedule_id", "schedule_name", "state", "status", "recurrence",
+		"next_run", "last_run",
+	},
+)
+
+func makeSQLStatsSchedulesGenerator(
+	ctx context.Context, evalCtx *eval.Context, _ tree.Datums,
+) (eval.ValueGenerator, error) {
+	if err := checkSQLStatsAdmin(ctx, evalCtx, "crdb_internal.sql_stats_schedules"); err != nil {
+		return nil, err
+	}
+	schedules, err := evalCtx.SQLStatsController.GetSQLStatsSchedules(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// makeOptionalTimestamp returns NULL for the zero time.
+	makeOptionalTimestamp := func(t time.Time) (tree.Datum, error) {
+		if t.IsZero() {
+			return tree.DNull, nil
+		}
+		return tree.MakeDTimestampTZ(t, time.Microsecond)
+	}
+	rows := make([]tree.Datums, 0, len(schedules))
+	for _, sched := range schedules {
+		status := tree.DNull
+		if sched.Status != "" {
+			status = tree.NewDString(sched.Status)
+		}
+		nextRun, err := makeOptionalTimestamp(sched.NextRun)
+		if err != nil {
+			return nil, err
+		}
+		lastRun, err := makeOptionalTimestamp(sched.LastRun)
+		if err != nil {
+			return nil, err
+		}
+		rows = append(rows, tree.Datums{
+			tree.NewDInt(tree.DInt(sched.ScheduleID)),
+			tree.NewDString(sched.Name),
+			tree.NewDString(sched.State),
+			status,
+			tree.NewDString(sched.Recurrence),
+			nextRun,
+			lastRun,
+		})
+	}
+	return &sqlStatsRowsGenerator{typ: sqlStatsSchedulesGeneratorType, rows: rows}, nil
+}
+
+// maxSQLStatsTopLiveFingerprints is the maximum number of fingerprints
+// returned by crdb_internal.sql_stats_top_live, see
+// persistedsqlstats.MaxTopFingerprints.
+const maxSQLStatsTopLiveFingerprints = 1000
+
+var sqlStatsTopLiveGeneratorType = types.MakeLabeledTuple(
+	[]*types.T{
+		types.Bytes, types.Bytes, types.String, types.String, types.Int,
+		types.Float, types.TimestampTZ,
+	},
+	[]string{
+		"fingerprint_id", "transaction_fingerprint_id", "app_name", "query",
+		"count", "service_latency_mean", "last_exec_at",
+	},
+)
+
+func makeSQLStatsTopLiveGenerator(
+	ctx context.Context, evalCtx *eval.Context, args tree.Datums,
+) (eval.ValueGenerator, error) {
+	if err := checkSQLStatsAdmin(ctx, evalCtx, "crdb_internal.sql_stats_top_live"); err != nil {
+		return nil, err
+	}
+	n := int(tree.MustBeDInt(args[0]))
+	if n < 0 || n > maxSQLStatsTopLiveFingerprints {
+		return nil, pgerror.Newf(pgcode.InvalidParameterValue,
+			"n must be between 0 and %d, got %d", maxSQLStatsTopLiveFingerprints, n)
+	}
+	summaries := evalCtx.SQLStatsController.GetSQLStatsTopLiveFingerprints(ctx, n)
+	rows := make([]tree.Datums, 0, len(summaries))
+	for _, summary := range summaries {
+		lastExecAt, err := tree.MakeDTimestampTZ(summary.LastExecAt, time.Microsecond)
+		if err != nil {
+			return nil, err
+		}
+		rows = append(rows, tree.Datums{
+			tree.NewDBytes(tree.DBytes(summary.FingerprintID)),
+			tree.NewDBytes(tree.DBytes(summary.TransactionFingerprintID)),
+			tree.NewDString(summary.AppName),
+			tree.NewDString(summary.Query),
+			tree.NewDInt(tree.DInt(summary.Count)),
+			tree.NewDFloat(tree.DFloat(summary.ServiceLatencyMean)),
+			lastExecAt,
+		})
+	}
+	return &sqlStatsRowsGenerator{typ: sqlStatsTopLiveGeneratorType, rows: rows}, nil
+}
+
+var sqlStatsFingerprintDetailGeneratorType = types.MakeLabeledTuple(
+	[]*types.T{types.String, types.TimestampTZ, types.Int, types.TimestampTZ},
+	[]string{"source", "aggregated_ts", "execution_count", "last_flush_at"},
+)
+
+func makeSQLStatsFingerprintDetailGenerator(
+	ctx context.Context, evalCtx *eval.Context, args tree.Datums,
+) (eval.ValueGenerator, error) {
+	if err := checkSQLStatsAdmin(ctx, evalCtx, "crdb_internal.sql_stats_fingerprint_detail"); err != nil {
+		return nil, err
+	}
+	fingerprintID := []byte(tree.MustBeDBytes(args[0]))
+	appName := string(tree.MustBeDString(args[1]))
+	opts, err := getSQLStatsReadOptions(args, 2)
+	if err != nil {
+		return nil, err
+	}
+	detail, err := evalCtx.SQLStatsController.GetSQLStatsFingerprintDetail(
+		ctx, fingerprintID, appName, opts,
+	)
+	if err != nil {
+		return nil, err
+	}
+	lastFlushAt := tree.DNull
+	if !detail.LastFlushAt.IsZero() {
+		if lastFlushAt, err = tree.MakeDTimestampTZ(detail.LastFlushAt, time.Microsecond); err != nil {
+			return nil, err
+		}
+	}
+	rows := make([]tree.Datums, 0, len(detail.PersistedWindows)+1)
+	rows = append(rows, tree.Datums{
+		tree.NewDString("memory"),
+		tree.DNull,
+		tree.NewDInt(tree.DInt(detail.InMemoryCount)),
+		lastFlushAt,
+	})
+	for _, w := range detail.PersistedWindows {
+		aggregatedTs, err := tree.MakeDTimestampTZ(w.AggregatedTs, time.Microsecond)
+		if err != nil {
+			return nil, err
+		}
+		rows = append(rows, tree.Datums{
+			tree.NewDString("persisted"),
+			aggregatedTs,
+			tree.NewDInt(tree.DInt(w.Count)),
+			lastFlushAt,
+		})
+	}
+	return &sqlStatsRowsGenerator{typ: sqlStatsFingerprintDetailGeneratorType, rows: rows}, nil
+}
+
+var sqlStatsForAppGeneratorType = types.MakeLabeledTuple(
+	[]*types.T{types.Bytes, types.Int, types.Int, types.TimestampTZ, types.TimestampTZ},
+	[]string{
+		"fingerprint_id", "execution_count", "windows", "first_aggregated_ts",
+		"last_aggregated_ts",
+	},
+)
+
+func makeSQLStatsForAppGenerator(
+	ctx context.Context, evalCtx *eval.Context, args tree.Datums,
+) (eval.ValueGenerator, error) {
+	if err := checkSQLStatsAdmin(ctx, evalCtx, "crdb_internal.sql_stats_for_app"); err != nil {
+		return nil, err
+	}
+	appName := string(tree.MustBeDString(args[0]))
+	// The optional since argument comes before max_staleness.
+	var since time.Time
+	stalenessIdx := 1
+	if len(args) > 1 {
+		if ts, ok := args[1].(*tree.DTimestampTZ); ok {
+			since = ts.Time
+			stalenessIdx = 2
+		}
+	}
+	opts, err := getSQLStatsReadOptions(args, stalenessIdx)
+	if err != nil {
+		return nil, err
+	}
+	fingerprints, err := evalCtx.SQLStatsController.GetSQLStatsForApp(ctx, appName, since, opts)
+	if err != nil {
+		return nil, err
+	}
+	rows := make([]tree.Datums, 0, len(fingerprints))
+	for _, f := range fingerprints {
+		first, err := tree.MakeDTimestampTZ(f.FirstAggregatedTs, time.Microsecond)
+		if err != nil {
+			return nil, err
+		}
+		last, err := tree.MakeDTimestampTZ(f.LastAggregatedTs, time.Microsecond)
+		if err != nil {
+			return nil, err
+		}
+		rows = append(rows, tree.Datums{
+			tree.NewDBytes(tree.DBytes(f.FingerprintID)),
+			tree.NewDInt(tree.DInt(f.ExecutionCount)),
+			tree.NewDInt(tree.DInt(f.Windows)),
+			first,
+			last,
+		})
+	}
+	return &sqlStatsRowsGenerator{typ: sqlStatsForAppGeneratorType, rows: rows}, nil
+}
+
+const validateScheduleRecurrenceInfo = "Validates a candidate value of " +
+	"sql.stats.cleanup.recurrence without applying it. Returns whether the " +
+	"setting would accept the cron expression and, if not, why; the next times " +
+	"at which the SQL stats compaction would run under it; and whether it would " +
+	"be rejected for running the compaction more frequently than " +
+	"sql.stats.cleanup.min_recurrence_interval (interval_too_short), or would " +
+	"make the schedule monitor warn that the next run is more than 24 hours " +
+	"away (interval_too_long)."
+
+// defaultValidateScheduleRecurrenceRuns and maxValidateScheduleRecurrenceRuns
+// are the default and maximum numbers of runs returned by
+// crdb_internal.validate_schedule_recurrence.
+const (
+	defaultValidateScheduleRecurrenceRuns = 5
+	maxValidateScheduleRecurrenceRuns     = 100
+)
+
+var validateScheduleRecurrenceGeneratorType = types.MakeLabeledTuple(
+	[]*types.T{types.Bool, types.String, types.TimestampTZArray, types.Bool, types.Bool},
+	[]string{"valid", "error", "next_runs", "interval_too_long", "interval_too_short"},
+)
+
+func makeValidateScheduleRecurrenceGenerator(
+	ctx context.Context, evalCtx *eval.Context, args tree.Datums,
+) (eval.ValueGenerator, error) {
+	if err := checkSQLStatsAdmin(ctx, evalCtx, "crdb_internal.validate_schedule_recurrence"); err != nil {
+		return nil, err
+	}
+	expr := string(tree.MustBeDString(args[0]))
+	numRuns := defaultValidateScheduleRecurrenceRuns
+	if len(args) > 1 {
+		n := int(tree.MustBeDInt(args[1]))
+		if n < 0 || n > maxValidateScheduleRecurrenceRuns {
+			return nil, pgerror.Newf(pgcode.InvalidParameterValue,
+				"num_runs must be between 0 and %d, got %d", maxValidateScheduleRecurrenceRuns, n)
+		}
+		numRuns = n
+	}
+	res := evalCtx.SQLStatsController.ValidateSQLStatsCompactionRecurrence(ctx, expr, numRuns)
+
+	errStr := tree.DNull
+	if res.Err != nil {
+		errStr = tree.NewDString(res.Err.Error())
+	}
+	nextRuns := tree.NewDArray(types.TimestampTZ)
+	for _, t := range res.NextRuns {
+		ts, err := tree.MakeDTimestampTZ(t, time.Microsecond)
+		if err != nil {
+			return nil, err
+		}
+		if err := nextRuns.Append(ts); err != nil {
+			return nil, err
+		}
+	}
+	return &sqlStatsRowsGenerator{
+		typ: validateScheduleRecurrenceGeneratorType,
+		rows: []tree.Datums{{
+			tree.MakeDBool(tree.DBool(res.Err == nil)),
+			errStr,
+			nextRuns,
+			tree.MakeDBool(tree.DBool(res.IntervalTooLong)),
+			tree.MakeDBool(tree.DBool(res.IntervalTooShort)),
+		}},
+	}, nil
+}
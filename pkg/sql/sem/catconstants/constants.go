@@ -81,6 +81,7 @@ const (
 	TransactionStatisticsTableName         SystemTableName = "transaction_statistics"
 	StatementActivityTableName             SystemTableName = "statement_activity"
 	TransactionActivityTableName           SystemTableName = "transaction_activity"
+	SQLStatsCompactionRunsTableName        SystemTableName = "sql_stats_compaction_runs"
 	DatabaseRoleSettingsTableName          SystemTableName = "database_role_settings"
 	TenantUsageTableName                   SystemTableName = "tenant_usage"
 	SQLInstancesTableName                  SystemTableName = "sql_instances"
@@ -394,6 +395,7 @@ const (
 	PgCatalogSubscriptionTableID
 	PgCatalogTablesTableID
 	PgCatalogTablespaceTableID
+	PgCatalogTenantSettingOverridesTableID
 	PgCatalogTimezoneAbbrevsTableID
 	PgCatalogTimezoneNamesTableID
 	PgCatalogTransformTableID
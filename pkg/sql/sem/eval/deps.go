@@ -598,6 +598,21 @@ type TenantOperator interface {
 		asOf time.Time,
 		asOfConsumedRequestUnits float64,
 	) error
+
+	// GetTenantSettingSentStatus returns, for each tenant connected to
+	// this node, whether this node sent to the tenant the override of the
+	// given cluster setting in effect for it. The status is node-local.
+	GetTenantSettingSentStatus(
+		ctx context.Context, name string,
+	) ([]TenantSettingSentStatus, error)
+}
+
+// TenantSettingSentStatus reports whether the override of a cluster
+// setting in effect for a tenant, set with ALTER TENANT ... SET CLUSTER
+// SETTING, was sent to the tenant by the current node.
+type TenantSettingSentStatus struct {
+	TenantID roachpb.TenantID
+	Sent     bool
 }
 
 // JoinTokenCreator is capable of creating and persisting join tokens, allowing
@@ -625,6 +640,205 @@ type GossipOperator interface {
 type SQLStatsController interface {
 	ResetClusterSQLStats(ctx context.Context) error
 	CreateSQLStatsCompactionSchedule(ctx context.Context) error
+	PauseSQLStatsCompaction(ctx context.Context, pauseDuration time.Duration) (resumeAt time.Time, err error)
+	DiffSQLStatsCompactionPolicy(
+		ctx context.Context, proposedMaxRows int64, proposedMaxAge time.Duration, opts SQLStatsReadOptions,
+	) ([]SQLStatsCompactionPolicyDiff, error)
+	GetSQLStatsMemoryUsage(ctx context.Context) (usedBytes, limitBytes int64)
+	GetSQLStatsFingerprintCountsByType(
+		ctx context.Context, opts SQLStatsReadOptions,
+	) ([]SQLStatsFingerprintTypeCount, error)
+	GetSQLStatsCompactionCoordinator(ctx context.Context) (instanceID int64, ok bool, err error)
+	FlushSQLStats(ctx context.Context) (SQLStatsFlushReport, error)
+	CompactSQLStatsNow(ctx context.Context, dryRun bool) ([]SQLStatsCompactionResult, error)
+	GetSQLStatsStorageBytes(ctx context.Context) ([]SQLStatsTableStorage, error)
+	PreviewSQLStatsCompaction(
+		ctx context.Context, opts SQLStatsReadOptions,
+	) ([]SQLStatsCompactionSelection, error)
+	GetSQLStatsBindingPolicies(
+		ctx context.Context, opts SQLStatsReadOptions,
+	) ([]SQLStatsBindingPolicy, error)
+	GetSQLStatsRetentionHorizon(ctx context.Context) (horizon time.Time, ok bool, err error)
+	GetSQLStatsSchedules(ctx context.Context) ([]SQLStatsSchedule, error)
+	GetSQLStatsTopLiveFingerprints(ctx context.Context, n int) []SQLStatsFingerprintSummary
+	GetSQLStatsFingerprintDetail(
+		ctx context.Context, fingerprintID []byte, appName string, opts SQLStatsReadOptions,
+	) (SQLStatsFingerprintDetail, error)
+	GetSQLStatsForApp(
+		ctx context.Context, appName string, since time.Time, opts SQLStatsReadOptions,
+	) ([]SQLStatsAppFingerprint, error)
+	ValidateSQLStatsCompactionRecurrence(
+		ctx context.Context, expr string, numRuns int,
+	) SQLStatsRecurrenceValidation
+}
+
+// SQLStatsReadOptions configures the scans of the persisted SQL stats tables
+// run by the SQL stats controller on behalf of the builtins that only read
+// them. By default, the scans are follower reads.
+type SQLStatsReadOptions struct {
+	// BoundedStaleness, if set, makes the scans read the tables as of
+	// MaxStaleness ago, or their current data if MaxStaleness is zero.
+	BoundedStaleness bool
+	MaxStaleness     time.Duration
+}
+
+// SQLStatsCompactionPolicyDiff compares, for one of the persisted SQL stats
+// tables, the number of rows that the SQL stats compaction job would remove
+// under the current retention policy and under a proposed one.
+type SQLStatsCompactionPolicyDiff struct {
+	Table                string
+	CurrentRowsToDelete  int64
+	ProposedRowsToDelete int64
+}
+
+// SQLStatsCompactionResult is, for one of the persisted SQL stats tables, the
+// number of rows removed by a compaction run, or the number of rows that it
+// would remove in the case of a dry run.
+type SQLStatsCompactionResult struct {
+	Table string
+	Rows  int64
+	// BudgetExhausted is set if the compaction run stopped removing rows from
+	// the table because it reached sql.stats.cleanup.max_rows_per_run, in
+	// which case rows may remain to be removed by the next runs.
+	BudgetExhausted bool
+}
+
+// SQLStatsCompactionSelection describes a selection of rows that a
+// compaction run would remove from one of the persisted SQL stats tables: the
+// rows matching Predicate, oldest first, up to Limit rows.
+type SQLStatsCompactionSelection struct {
+	Table string
+	// Predicate is a human-readable summary of the rows eligible for removal.
+	Predicate string
+	// Limit is the maximum number of rows removed, or -1 if all the rows
+	// matching Predicate are removed.
+	Limit int64
+}
+
+// SQLStatsBindingPolicy identifies, for one of the persisted SQL stats
+// tables, the retention policy that currently limits it.
+type SQLStatsBindingPolicy struct {
+	Table string
+	// Policy is "row_cap" (sql.stats.persisted_rows.max), "max_age"
+	// (sql.stats.persisted_rows.max_age), or "none" if the table is within all
+	// the limits.
+	Policy   string
+	RowCount int64
+	// RowsOverLimit is the number of rows exceeding the binding limit.
+	RowsOverLimit int64
+}
+
+// SQLStatsSchedule describes one of the schedules of the SQL stats subsystem,
+// such as the SQL stats compaction schedule.
+type SQLStatsSchedule struct {
+	ScheduleID int64
+	Name       string
+	// State is PAUSED if the schedule has no next run, ACTIVE otherwise.
+	State string
+	// Status is the status message of the schedule, e.g. the reason why its
+	// last run failed, or empty if it has none.
+	Status     string
+	Recurrence string
+	// NextRun is the zero time if the schedule is paused.
+	NextRun time.Time
+	// LastRun is the creation time of the most recent job started by the
+	// schedule, or the zero time if it has not started any job yet.
+	LastRun time.Time
+}
+
+// SQLStatsFingerprintSummary summarizes the in-memory statistics of a
+// statement fingerprint on the gateway node.
+type SQLStatsFingerprintSummary struct {
+	// FingerprintID and TransactionFingerprintID are encoded as in the
+	// persisted SQL stats tables.
+	FingerprintID            []byte
+	TransactionFingerprintID []byte
+	AppName                  string
+	Query                    string
+	Count                    int64
+	// ServiceLatencyMean is the mean service latency, in seconds.
+	ServiceLatencyMean float64
+	LastExecAt         time.Time
+}
+
+// SQLStatsFingerprintDetail combines the in-memory and the persisted
+// statistics of a statement fingerprint of an application.
+type SQLStatsFingerprintDetail struct {
+	// InMemoryCount is the number of executions recorded by the gateway node
+	// since its last flush, i.e. not persisted yet.
+	InMemoryCount int64
+	// PersistedWindows are the persisted counts of the fingerprint by
+	// aggregation window, most recent first.
+	PersistedWindows []SQLStatsFingerprintWindow
+	// LastFlushAt is the start time of the last flush of the gateway node, or
+	// the zero time if it has not flushed yet.
+	LastFlushAt time.Time
+}
+
+// SQLStatsFingerprintWindow is the number of executions of a statement
+// fingerprint persisted for one aggregation window, across all the nodes,
+// transactions and plans.
+type SQLStatsFingerprintWindow struct {
+	AggregatedTs time.Time
+	Count        int64
+}
+
+// SQLStatsAppFingerprint is the persisted execution count of a statement
+// fingerprint of an application, aggregated across all the aggregation
+// windows, transactions, plans, and nodes.
+type SQLStatsAppFingerprint struct {
+	// FingerprintID is encoded as in the persisted SQL stats tables.
+	FingerprintID  []byte
+	ExecutionCount int64
+	// Windows is the number of aggregation windows in which the fingerprint
+	// was executed, the first and last of which start at FirstAggregatedTs
+	// and LastAggregatedTs.
+	Windows           int64
+	FirstAggregatedTs time.Time
+	LastAggregatedTs  time.Time
+}
+
+// SQLStatsRecurrenceValidation is the result of the validation of a candidate
+// value of sql.stats.cleanup.recurrence.
+type SQLStatsRecurrenceValidation struct {
+	// Err is the reason why the recurrence would be rejected by
+	// sql.stats.cleanup.recurrence, or nil if it would be accepted.
+	Err error
+	// NextRuns are the next times at which the compaction would run under
+	// the recurrence. It is empty if the recurrence cannot be parsed.
+	NextRuns []time.Time
+	// IntervalTooLong is set if the next run under the recurrence is far
+	// enough in the future for the schedule monitor to warn about it.
+	IntervalTooLong bool
+	// IntervalTooShort is set if the recurrence would run the compaction more
+	// frequently than allowed by sql.stats.cleanup.min_recurrence_interval.
+	IntervalTooShort bool
+}
+
+// SQLStatsTableStorage is the estimated storage used by one of the persisted
+// SQL stats tables, as derived from the MVCC stats of its ranges.
+type SQLStatsTableStorage struct {
+	Table                string
+	RangeCount           int64
+	ApproximateDiskBytes int64
+	LiveBytes            int64
+	TotalBytes           int64
+}
+
+// SQLStatsFingerprintTypeCount is the number of distinct statement
+// fingerprints of a given statement type (e.g. SELECT, INSERT) in the
+// persisted SQL stats.
+type SQLStatsFingerprintTypeCount struct {
+	StatementType    string
+	FingerprintCount int64
+}
+
+// SQLStatsFlushReport summarizes the outcome of a flush of the in-memory SQL
+// stats of the gateway node.
+type SQLStatsFlushReport struct {
+	Written   int64
+	Discarded int64
+	Duration  time.Duration
 }
 
 // SchemaTelemetryController is an interface embedded in EvalCtx which can be
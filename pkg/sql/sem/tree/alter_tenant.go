@@ -10,6 +10,8 @@
 
 package tree
 
+import "fmt"
+
 // ReplicationCutoverTime represent the user-specified cutover time
 type ReplicationCutoverTime struct {
 	Timestamp Expr
@@ -92,6 +94,63 @@ type TenantSpec struct {
 	All    bool
 }
 
+// TenantSpecKind is the way in which a TenantSpec designates tenants.
+type TenantSpecKind int8
+
+const (
+	// TenantSpecByID designates a tenant by ID, e.g. ALTER TENANT [2].
+	TenantSpecByID TenantSpecKind = iota
+	// TenantSpecByName designates a tenant by name, e.g. ALTER TENANT foo.
+	TenantSpecByName
+	// TenantSpecAll designates all the tenants, i.e. ALTER TENANT ALL.
+	TenantSpecAll
+)
+
+// String implements the fmt.Stringer interface.
+func (k TenantSpecKind) String() string {
+	switch k {
+	case TenantSpecByID:
+		return "id"
+	case TenantSpecByName:
+		return "name"
+	case TenantSpecAll:
+		return "all"
+	default:
+		return fmt.Sprintf("TenantSpecKind(%d)", int8(k))
+	}
+}
+
+// Kind returns the way in which the TenantSpec designates tenants.
+func (n *TenantSpec) Kind() TenantSpecKind {
+	switch {
+	case n.All:
+		return TenantSpecAll
+	case n.IsName:
+		return TenantSpecByName
+	default:
+		return TenantSpecByID
+	}
+}
+
+// ID returns the expression of the tenant ID if the TenantSpec designates a
+// tenant by ID.
+func (n *TenantSpec) ID() (_ Expr, ok bool) {
+	if n.Kind() != TenantSpecByID {
+		return nil, false
+	}
+	return n.Expr, true
+}
+
+// Name returns the expression of the tenant name if the TenantSpec
+// designates a tenant by name. A bare identifier, as in ALTER TENANT foo, is
+// returned as an *UnresolvedName.
+func (n *TenantSpec) Name() (_ Expr, ok bool) {
+	if n.Kind() != TenantSpecByName {
+		return nil, false
+	}
+	return n.Expr, true
+}
+
 // alreadyDelimitedAsSyntacticDExpr is an interface that marks
 // Expr types for which there is never an ambiguity when
 // the expression syntax is followed by a non-reserved
@@ -146,6 +205,11 @@ func (n *TenantSpec) Format(ctx *FmtCtx) {
 		// not a simple identifier and is not already enclosed in
 		// parentheses.
 		_, canOmitParentheses := n.Expr.(alreadyDelimitedAsSyntacticDExpr)
+		if _, isPlaceholder := n.Expr.(*Placeholder); isPlaceholder && ctx.placeholderFormat != nil {
+			// The placeholder may be replaced by an arbitrary value, e.g. a
+			// negative number, which is not well-delimited.
+			canOmitParentheses = false
+		}
 		if !canOmitParentheses {
 			ctx.WriteByte('(')
 		}
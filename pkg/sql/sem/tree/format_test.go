@@ -73,6 +73,44 @@ func TestFormatStatement(t *testing.T) {
 	}
 }
 
+func TestFormatTenantSpecPlaceholder(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+	testData := []struct {
+		stmt     string
+		value    string
+		expected string
+	}{
+		{`ALTER TENANT $1 SET CLUSTER SETTING a = 3`, `'foo'`,
+			`ALTER TENANT ('foo') SET CLUSTER SETTING a = 3`},
+		{`ALTER TENANT $1 SET CLUSTER SETTING a = 3`, `-5`,
+			`ALTER TENANT (-5) SET CLUSTER SETTING a = 3`},
+		{`ALTER TENANT [$1] SET CLUSTER SETTING a = 3`, `-5`,
+			`ALTER TENANT [-5] SET CLUSTER SETTING a = 3`},
+	}
+
+	for i, test := range testData {
+		t.Run(fmt.Sprintf("%d %s", i, test.stmt), func(t *testing.T) {
+			stmt, err := parser.ParseOne(test.stmt)
+			if err != nil {
+				t.Fatal(err)
+			}
+			f := tree.NewFmtCtx(tree.FmtSimple, tree.FmtPlaceholderFormat(
+				func(ctx *tree.FmtCtx, _ *tree.Placeholder) {
+					ctx.WriteString(test.value)
+				}))
+			f.FormatNode(stmt.AST)
+			if stmtStr := f.CloseAndGetString(); stmtStr != test.expected {
+				t.Fatalf("expected %q, got %q", test.expected, stmtStr)
+			}
+			// The formatted statement must remain parsable.
+			if _, err := parser.ParseOne(test.expected); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
 func TestFormatTableName(t *testing.T) {
 	defer leaktest.AfterTest(t)()
 	defer log.Scope(t).Close(t)
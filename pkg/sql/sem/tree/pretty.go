@@ -2353,6 +2353,50 @@ func (node *AlterTableAddColumn) doc(p *PrettyCfg) pretty.Doc {
 	)
 }
 
+func (node *AlterTenantSetClusterSetting) doc(p *PrettyCfg) pretty.Doc {
+	// The keywords are emitted as such, rather than as part of the text of
+	// the statement, so that they follow p.Case.
+	var tenant pretty.Doc
+	switch {
+	case node.TenantSelector != nil:
+		tenant = pretty.ConcatSpace(pretty.Keyword("IN"), p.Doc(node.TenantSelector))
+	case node.TenantSpec.All:
+		tenant = pretty.Keyword("ALL")
+	default:
+		tenant = p.Doc(node.TenantSpec)
+	}
+	title := pretty.ConcatSpace(pretty.Keyword("ALTER TENANT"), tenant)
+	formatAssignment := func(s *SetClusterSetting) pretty.Doc {
+		ctx := NewFmtCtx(p.fmtFlags())
+		s.formatAssignment(ctx)
+		return pretty.Text(strings.TrimSpace(ctx.String()))
+	}
+	var body pretty.Doc
+	if len(node.Settings) == 0 {
+		body = formatAssignment(&node.SetClusterSetting)
+	} else {
+		settings := make([]pretty.Doc, len(node.Settings))
+		for i := range node.Settings {
+			settings[i] = formatAssignment(&node.Settings[i])
+		}
+		body = p.bracket("(", p.commaSeparated(settings...), ")")
+	}
+	body = pretty.ConcatSpace(pretty.Keyword("SET CLUSTER SETTING"), body)
+	if len(node.Settings) == 0 {
+		// A single setting is always kept on one line.
+		return pretty.ConcatSpace(title, body)
+	}
+	// Final layout for the list form:
+	//
+	// ALTER TENANT spec
+	//     SET CLUSTER SETTING (
+	//         a = 1,
+	//         b = 2
+	//     )
+	//
+	return p.nestUnder(title, body)
+}
+
 func (node *Prepare) doc(p *PrettyCfg) pretty.Doc {
 	return p.rlTable(node.docTable(p)...)
 }
@@ -215,6 +215,55 @@ func BenchmarkPrettyData(b *testing.B) {
 	}
 }
 
+// TestPrettyAlterTenantSetClusterSettingCase checks that the keywords of
+// ALTER TENANT ... SET CLUSTER SETTING follow the case mode of the pretty
+// printer, while the setting names, values and tenant names are preserved.
+func TestPrettyAlterTenantSetClusterSettingCase(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	tests := []struct {
+		sql   string
+		lower string
+		upper string
+	}{
+		{
+			sql:   `ALTER TENANT [10] SET CLUSTER SETTING a = 'Value'`,
+			lower: `alter tenant [10] set cluster setting a = 'Value'`,
+			upper: `ALTER TENANT [10] SET CLUSTER SETTING a = 'Value'`,
+		},
+		{
+			sql:   `alter tenant all set cluster setting a = 1`,
+			lower: `alter tenant all set cluster setting a = 1`,
+			upper: `ALTER TENANT ALL SET CLUSTER SETTING a = 1`,
+		},
+		{
+			sql:   `ALTER TENANT "Tenant" SET CLUSTER SETTING (a = 1, b = 'x')`,
+			lower: `alter tenant "Tenant" set cluster setting (a = 1, b = 'x')`,
+			upper: `ALTER TENANT "Tenant" SET CLUSTER SETTING (a = 1, b = 'x')`,
+		},
+	}
+	for _, test := range tests {
+		stmt, err := parser.ParseOne(test.sql)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, tc := range []struct {
+			caseFn   func(string) string
+			expected string
+		}{
+			{caseFn: strings.ToLower, expected: test.lower},
+			{caseFn: strings.ToUpper, expected: test.upper},
+		} {
+			cfg := tree.DefaultPrettyCfg()
+			cfg.Case = tc.caseFn
+			if got := cfg.Pretty(stmt.AST); got != tc.expected {
+				t.Errorf("%s: got:\n%s\nexpected:\n%s", test.sql, got, tc.expected)
+			}
+		}
+	}
+}
+
 func TestPrettyExprs(t *testing.T) {
 	defer leaktest.AfterTest(t)()
 	defer log.Scope(t).Close(t)
@@ -72,7 +72,11 @@ type SetClusterSetting struct {
 // Format implements the NodeFormatter interface.
 func (node *SetClusterSetting) Format(ctx *FmtCtx) {
 	ctx.WriteString("SET CLUSTER SETTING ")
+	node.formatAssignment(ctx)
+}
 
+// formatAssignment formats the "name = value" part of the statement.
+func (node *SetClusterSetting) formatAssignment(ctx *FmtCtx) {
 	// Cluster setting names never contain PII and should be distinguished
 	// for feature tracking purposes.
 	ctx.WithFlags(ctx.flags & ^FmtAnonymize & ^FmtMarkRedactionNode, func() {
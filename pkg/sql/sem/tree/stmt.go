@@ -490,6 +490,17 @@ func (*AlterTenantSetClusterSetting) StatementType() StatementType { return Type
 // StatementTag returns a short string identifying the type of statement.
 func (*AlterTenantSetClusterSetting) StatementTag() string { return "ALTER TENANT SET CLUSTER SETTING" }
 
+// StatementReturnType implements the Statement interface.
+func (*AlterTenantResetAllClusterSettings) StatementReturnType() StatementReturnType { return Ack }
+
+// StatementType implements the Statement interface.
+func (*AlterTenantResetAllClusterSettings) StatementType() StatementType { return TypeDCL }
+
+// StatementTag returns a short string identifying the type of statement.
+func (*AlterTenantResetAllClusterSettings) StatementTag() string {
+	return "ALTER TENANT RESET ALL CLUSTER SETTINGS"
+}
+
 // StatementReturnType implements the Statement interface.
 func (*AlterTenantReplication) StatementReturnType() StatementReturnType { return Rows }
 
@@ -2172,6 +2183,7 @@ func (n *AlterTableOwner) String() string                     { return AsString(
 func (n *AlterTableSetSchema) String() string                 { return AsString(n) }
 func (n *AlterTenantCapability) String() string               { return AsString(n) }
 func (n *AlterTenantSetClusterSetting) String() string        { return AsString(n) }
+func (n *AlterTenantResetAllClusterSettings) String() string  { return AsString(n) }
 func (n *AlterTenantRename) String() string                   { return AsString(n) }
 func (n *AlterTenantReplication) String() string              { return AsString(n) }
 func (n *AlterTenantService) String() string                  { return AsString(n) }
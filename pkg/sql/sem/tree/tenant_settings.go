@@ -15,14 +15,74 @@ package tree
 type AlterTenantSetClusterSetting struct {
 	SetClusterSetting
 	TenantSpec *TenantSpec
+
+	// TenantSelector is populated instead of TenantSpec when the tenants
+	// to modify are selected by a subquery returning tenant IDs, which is
+	// evaluated when the statement is executed:
+	//   ALTER TENANT IN (SELECT id FROM ...) SET CLUSTER SETTING a = 1
+	TenantSelector Expr
+
+	// Settings is populated instead of the embedded SetClusterSetting when
+	// the statement uses the list form:
+	//   ALTER TENANT ... SET CLUSTER SETTING (a = 1, b = 2)
+	// All the settings in the list are applied atomically.
+	Settings []SetClusterSetting
+}
+
+// Assignments returns the setting assignments carried by the statement,
+// regardless of whether it uses the single or the list form.
+func (n *AlterTenantSetClusterSetting) Assignments() []SetClusterSetting {
+	if len(n.Settings) > 0 {
+		return n.Settings
+	}
+	return []SetClusterSetting{n.SetClusterSetting}
+}
+
+// Tenant returns the tenant(s) designated by the statement. ok is false if
+// the tenants are instead selected by a subquery, see TenantSelector.
+func (n *AlterTenantSetClusterSetting) Tenant() (_ TenantSpec, ok bool) {
+	if n.TenantSelector != nil || n.TenantSpec == nil {
+		return TenantSpec{}, false
+	}
+	return *n.TenantSpec, true
 }
 
 // Format implements the NodeFormatter interface.
 func (n *AlterTenantSetClusterSetting) Format(ctx *FmtCtx) {
 	ctx.WriteString("ALTER TENANT ")
-	ctx.FormatNode(n.TenantSpec)
+	if n.TenantSelector != nil {
+		ctx.WriteString("IN ")
+		ctx.FormatNode(n.TenantSelector)
+	} else {
+		ctx.FormatNode(n.TenantSpec)
+	}
 	ctx.WriteByte(' ')
-	ctx.FormatNode(&n.SetClusterSetting)
+	if len(n.Settings) == 0 {
+		ctx.FormatNode(&n.SetClusterSetting)
+		return
+	}
+	ctx.WriteString("SET CLUSTER SETTING (")
+	for i := range n.Settings {
+		if i > 0 {
+			ctx.WriteString(", ")
+		}
+		n.Settings[i].formatAssignment(ctx)
+	}
+	ctx.WriteByte(')')
+}
+
+// AlterTenantResetAllClusterSettings represents an ALTER TENANT ... RESET ALL
+// CLUSTER SETTINGS statement, which removes all the overrides specific to a
+// tenant.
+type AlterTenantResetAllClusterSettings struct {
+	TenantSpec *TenantSpec
+}
+
+// Format implements the NodeFormatter interface.
+func (n *AlterTenantResetAllClusterSettings) Format(ctx *FmtCtx) {
+	ctx.WriteString("ALTER TENANT ")
+	ctx.FormatNode(n.TenantSpec)
+	ctx.WriteString(" RESET ALL CLUSTER SETTINGS")
 }
 
 // ShowTenantClusterSetting represents a SHOW CLUSTER SETTING ... FOR TENANT statement.
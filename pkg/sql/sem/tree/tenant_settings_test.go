@@ -0,0 +1,64 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package tree_test
+
+import (
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/parser"
+	"github.com/cockroachdb/cockroach/pkg/sql/sem/tree"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAlterTenantSetClusterSettingTenant(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	testData := []struct {
+		stmt string
+		ok   bool
+		kind tree.TenantSpecKind
+		expr string
+	}{
+		{`ALTER TENANT [2] SET CLUSTER SETTING a = 1`, true, tree.TenantSpecByID, `2`},
+		{`ALTER TENANT [$1] SET CLUSTER SETTING a = 1`, true, tree.TenantSpecByID, `$1`},
+		{`ALTER TENANT foo SET CLUSTER SETTING a = 1`, true, tree.TenantSpecByName, `foo`},
+		{`ALTER TENANT ('foo') SET CLUSTER SETTING a = 1`, true, tree.TenantSpecByName, `('foo')`},
+		{`ALTER TENANT ALL SET CLUSTER SETTING a = 1`, true, tree.TenantSpecAll, ``},
+		{`ALTER TENANT ALL SET CLUSTER SETTING (a = 1, b = 2)`, true, tree.TenantSpecAll, ``},
+		{`ALTER TENANT IN (SELECT 2) SET CLUSTER SETTING a = 1`, false, 0, ``},
+	}
+	for _, test := range testData {
+		t.Run(test.stmt, func(t *testing.T) {
+			stmt, err := parser.ParseOne(test.stmt)
+			require.NoError(t, err)
+			spec, ok := stmt.AST.(*tree.AlterTenantSetClusterSetting).Tenant()
+			require.Equal(t, test.ok, ok)
+			if !ok {
+				return
+			}
+			require.Equal(t, test.kind, spec.Kind())
+
+			idExpr, isID := spec.ID()
+			nameExpr, isName := spec.Name()
+			require.Equal(t, test.kind == tree.TenantSpecByID, isID)
+			require.Equal(t, test.kind == tree.TenantSpecByName, isName)
+			switch test.kind {
+			case tree.TenantSpecByID:
+				require.Equal(t, test.expr, tree.AsString(idExpr))
+			case tree.TenantSpecByName:
+				require.Equal(t, test.expr, tree.AsString(nameExpr))
+			}
+		})
+	}
+}
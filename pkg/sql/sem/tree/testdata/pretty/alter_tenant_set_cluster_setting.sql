@@ -0,0 +1 @@
+ALTER TENANT [10] SET CLUSTER SETTING sql.defaults.idle_in_session_timeout = '500ms'
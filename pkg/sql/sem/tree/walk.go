@@ -977,6 +977,7 @@ func (n *AlterTenantCapability) walkStmt(v Visitor) Statement {
 // copyNode makes a copy of this Statement without recursing in any child Statements.
 func (n *AlterTenantSetClusterSetting) copyNode() *AlterTenantSetClusterSetting {
 	stmtCopy := *n
+	stmtCopy.Settings = append([]SetClusterSetting(nil), n.Settings...)
 	return &stmtCopy
 }
 
@@ -990,12 +991,34 @@ func (n *AlterTenantSetClusterSetting) walkStmt(v Visitor) Statement {
 			ret.Value = e
 		}
 	}
-	ts, changed := walkTenantSpec(v, n.TenantSpec)
-	if changed {
-		if ret == n {
-			ret = n.copyNode()
+	for i := range n.Settings {
+		if n.Settings[i].Value == nil {
+			continue
+		}
+		e, changed := WalkExpr(v, n.Settings[i].Value)
+		if changed {
+			if ret == n {
+				ret = n.copyNode()
+			}
+			ret.Settings[i].Value = e
+		}
+	}
+	if n.TenantSelector != nil {
+		e, changed := WalkExpr(v, n.TenantSelector)
+		if changed {
+			if ret == n {
+				ret = n.copyNode()
+			}
+			ret.TenantSelector = e
+		}
+	} else {
+		ts, changed := walkTenantSpec(v, n.TenantSpec)
+		if changed {
+			if ret == n {
+				ret = n.copyNode()
+			}
+			ret.TenantSpec = ts
 		}
-		ret.TenantSpec = ts
 	}
 	return ret
 }
@@ -1133,6 +1156,23 @@ func (n *ShowTenant) walkStmt(v Visitor) Statement {
 	return ret
 }
 
+// copyNode makes a copy of this Statement without recursing in any child Statements.
+func (n *AlterTenantResetAllClusterSettings) copyNode() *AlterTenantResetAllClusterSettings {
+	stmtCopy := *n
+	return &stmtCopy
+}
+
+// walkStmt is part of the walkableStmt interface.
+func (n *AlterTenantResetAllClusterSettings) walkStmt(v Visitor) Statement {
+	ret := n
+	ts, changed := walkTenantSpec(v, n.TenantSpec)
+	if changed {
+		ret = n.copyNode()
+		ret.TenantSpec = ts
+	}
+	return ret
+}
+
 // copyNode makes a copy of this Statement without recursing in any child Statements.
 func (n *AlterTenantRename) copyNode() *AlterTenantRename {
 	stmtCopy := *n
@@ -1946,6 +1986,7 @@ func (stmt *BeginTransaction) walkStmt(v Visitor) Statement {
 var _ walkableStmt = &AlterTenantCapability{}
 var _ walkableStmt = &AlterTenantRename{}
 var _ walkableStmt = &AlterTenantReplication{}
+var _ walkableStmt = &AlterTenantResetAllClusterSettings{}
 var _ walkableStmt = &AlterTenantService{}
 var _ walkableStmt = &AlterTenantSetClusterSetting{}
 var _ walkableStmt = &Backup{}
@@ -23,6 +23,7 @@ import (
 	"github.com/cockroachdb/cockroach/pkg/sql/sem/tree"
 	"github.com/cockroachdb/cockroach/pkg/sql/sessiondata"
 	"github.com/cockroachdb/cockroach/pkg/sql/sqlstats/persistedsqlstats"
+	"github.com/cockroachdb/cockroach/pkg/sql/sqlstats/persistedsqlstats/sqlstatsutil"
 	"github.com/cockroachdb/cockroach/pkg/util/log"
 	"github.com/cockroachdb/cockroach/pkg/util/metric"
 	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
@@ -286,7 +287,7 @@ INTO system.public.statement_activity (aggregated_ts, fingerprint_id, transactio
             agg_interval,
             metadata,
             statistics,
-            plan,
+            `+sqlstatsutil.DecompressedPlanSQL+`,
             index_recommendations,
             (statistics -> 'execution_statistics' ->> 'cnt')::int,
             ((statistics -> 'execution_statistics' ->> 'cnt')::float) *
@@ -445,7 +446,7 @@ INTO system.public.statement_activity
             agg_interval,
             metadata,
             statistics,
-            plan,
+            `+sqlstatsutil.DecompressedPlanSQL+`,
             index_recommendations,
             (statistics -> 'execution_statistics' ->> 'cnt')::int,
             ((statistics -> 'execution_statistics' ->> 'cnt')::float) *
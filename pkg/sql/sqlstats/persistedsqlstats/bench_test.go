@@ -367,3 +367,60 @@ func BenchmarkSqlStatsPersisted(b *testing.B) {
 		})
 	}
 }
+
+// BenchmarkSQLStatsFlushStaging compares the flush writing each fingerprint in
+// its own transaction to the staged flush (sql.stats.flush.staging.enabled),
+// with all the nodes of the cluster flushing concurrently. Besides the
+// duration of the flushes, it reports the number of retries of the
+// transactions of the flush, which measures their contention.
+func BenchmarkSQLStatsFlushStaging(b *testing.B) {
+	skip.UnderShort(b)
+	defer log.Scope(b).Close(b)
+
+	const numNodes = 3
+	for _, staging := range []bool{false, true} {
+		b.Run(fmt.Sprintf("staging=%t", staging), func(b *testing.B) {
+			ctx := context.Background()
+			tc := testcluster.StartTestCluster(b, numNodes, base.TestClusterArgs{})
+			defer tc.Stopper().Stop(ctx)
+
+			sqlRunners := make([]*sqlutils.SQLRunner, numNodes)
+			for i := range sqlRunners {
+				sqlRunners[i] = sqlutils.MakeSQLRunner(tc.ServerConn(i))
+			}
+			sqlRunners[0].Exec(b, fmt.Sprintf("SET CLUSTER SETTING sql.stats.flush.staging.enabled = %t", staging))
+
+			var retries int64
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				// Each application name makes for a distinct row of the stats
+				// tables.
+				for _, sqlRunner := range sqlRunners {
+					for j := 0; j < 500; j++ {
+						sqlRunner.Exec(b, fmt.Sprintf("SET application_name = 'bench_%d'", j))
+						sqlRunner.Exec(b, "SELECT 1")
+					}
+				}
+				b.StartTimer()
+
+				var wg sync.WaitGroup
+				for nodeIdx := 0; nodeIdx < numNodes; nodeIdx++ {
+					wg.Add(1)
+					go func(nodeIdx int) {
+						defer wg.Done()
+						tc.Server(nodeIdx).SQLServer().(*sql.Server).GetSQLStatsProvider().(*persistedsqlstats.PersistedSQLStats).Flush(ctx)
+					}(nodeIdx)
+				}
+				wg.Wait()
+			}
+			b.StopTimer()
+
+			for nodeIdx := 0; nodeIdx < numNodes; nodeIdx++ {
+				retries += tc.Server(nodeIdx).SQLServer().(*sql.Server).
+					ServerMetrics.StatsMetrics.SQLStatsFlushTxnRetries.Count()
+			}
+			b.ReportMetric(float64(retries)/float64(b.N), "retries/op")
+		})
+	}
+}
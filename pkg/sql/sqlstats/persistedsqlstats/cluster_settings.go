@@ -83,16 +83,207 @@ var SQLStatsFlushJitter = settings.RegisterFloatSetting(
 	},
 )
 
+// SQLStatsFlushSamplingEnabled is the cluster setting that enables the
+// sampling of new distinct fingerprints of applications which generate a
+// large number of distinct fingerprints, e.g. because they do not use
+// parameterized queries.
+var SQLStatsFlushSamplingEnabled = settings.RegisterBoolSetting(
+	settings.TenantWritable,
+	"sql.stats.flush.sampling.enabled",
+	"if set, only a fraction of the new distinct fingerprints of an application "+
+		"are flushed once the application exceeds "+
+		"sql.stats.flush.sampling.app_fingerprint_threshold distinct fingerprints "+
+		"in an aggregation interval",
+	false, /* defaultValue */
+)
+
+// SQLStatsFlushSamplingAppFingerprintThreshold is the number of distinct
+// fingerprints an application can flush within an aggregation interval
+// before its new fingerprints start being sampled.
+var SQLStatsFlushSamplingAppFingerprintThreshold = settings.RegisterIntSetting(
+	settings.TenantWritable,
+	"sql.stats.flush.sampling.app_fingerprint_threshold",
+	"number of distinct fingerprints an application can flush within an "+
+		"aggregation interval before its new fingerprints are sampled",
+	1000, /* defaultValue */
+	settings.NonNegativeInt,
+)
+
+// SQLStatsFlushSamplingFraction is the fraction of new distinct fingerprints
+// that are flushed for an application that exceeded
+// SQLStatsFlushSamplingAppFingerprintThreshold.
+var SQLStatsFlushSamplingFraction = settings.RegisterFloatSetting(
+	settings.TenantWritable,
+	"sql.stats.flush.sampling.fraction",
+	"fraction of the new distinct fingerprints that are flushed for an "+
+		"application that exceeded sql.stats.flush.sampling.app_fingerprint_threshold",
+	0.1, /* defaultValue */
+	func(f float64) error {
+		if f < 0 || f > 1 {
+			return errors.Newf("%f is not in [0, 1]", f)
+		}
+		return nil
+	},
+)
+
 // SQLStatsMaxPersistedRows specifies maximum number of rows that will be
 // retained in system.statement_statistics and system.transaction_statistics.
+// Zero disables the row cap, in which case the rows are only removed based on
+// their age (see SQLStatsMaxPersistedRowsAge).
 var SQLStatsMaxPersistedRows = settings.RegisterIntSetting(
 	settings.TenantWritable,
 	"sql.stats.persisted_rows.max",
 	"maximum number of rows of statement and transaction"+
-		" statistics that will be persisted in the system tables",
+		" statistics that will be persisted in the system tables;"+
+		" 0 disables the row cap, in which case rows are only removed once they"+
+		" are older than sql.stats.persisted_rows.max_age (if both are disabled,"+
+		" the default row cap is used)",
 	1000000, /* defaultValue */
+	settings.NonNegativeInt,
 ).WithPublic()
 
+// SQLStatsMaxPersistedRowsAge specifies the maximum age of the rows retained
+// in system.statement_statistics and system.transaction_statistics, based on
+// their aggregation timestamp. Zero disables the age limit.
+var SQLStatsMaxPersistedRowsAge = settings.RegisterDurationSetting(
+	settings.TenantWritable,
+	"sql.stats.persisted_rows.max_age",
+	"maximum age of the rows of statement and transaction statistics that"+
+		" will be persisted in the system tables, based on their aggregation"+
+		" timestamp; 0 disables the age limit, otherwise it must be at least 1m",
+	0, /* defaultValue */
+	validateMaxPersistedRowsAge,
+)
+
+// minMaxPersistedRowsAge is the smallest non-zero value of
+// SQLStatsMaxPersistedRowsAge. A shorter age limit would remove the rows
+// shortly after they are flushed.
+const minMaxPersistedRowsAge = time.Minute
+
+// validateMaxPersistedRowsAge rejects the values of
+// SQLStatsMaxPersistedRowsAge that are negative or, unless zero, shorter than
+// minMaxPersistedRowsAge.
+//
+// Disabling both the row cap and the age limit can't be rejected here, since
+// the validation functions of the settings only see the value being set; the
+// default row cap is used instead in that case, see getRetentionPolicy.
+func validateMaxPersistedRowsAge(v time.Duration) error {
+	if err := settings.NonNegativeDuration(v); err != nil {
+		return err
+	}
+	if v != 0 && v < minMaxPersistedRowsAge {
+		return errors.Newf("cannot be set to a value shorter than %s, "+
+			"use 0 to disable the age limit", minMaxPersistedRowsAge)
+	}
+	return nil
+}
+
+// SQLStatsCleanupRetainRecentlyExecuted specifies whether the age limit defined
+// by SQLStatsMaxPersistedRowsAge applies to the last execution of each
+// fingerprint rather than to the aggregation timestamp of each row. The last
+// execution of a fingerprint by an application is the latest last_execution_ts
+// of its rows, see notRecentlyExecutedPredicate.
+var SQLStatsCleanupRetainRecentlyExecuted = settings.RegisterBoolSetting(
+	settings.TenantWritable,
+	"sql.stats.cleanup.retain_recently_executed.enabled",
+	"if set, the rows of the fingerprints executed within"+
+		" sql.stats.persisted_rows.max_age are retained regardless of their"+
+		" aggregation timestamp, and only the rows of the fingerprints that were"+
+		" not executed since are removed based on their age",
+	false, /* defaultValue */
+)
+
+// SQLStatsCleanupRetainLatestPerFingerprint specifies whether the compaction
+// job retains the most recent aggregation window of each distinct fingerprint,
+// so that the persisted stats keep track of every fingerprint of the workload.
+// The row cap (SQLStatsMaxPersistedRows) becomes a soft cap: the tables can
+// exceed it by up to the number of distinct fingerprints.
+var SQLStatsCleanupRetainLatestPerFingerprint = settings.RegisterBoolSetting(
+	settings.TenantWritable,
+	"sql.stats.cleanup.retain_latest_per_fingerprint",
+	"if set, the SQL stats compaction job never removes the most recent "+
+		"aggregation window of a fingerprint, neither because of "+
+		"sql.stats.persisted_rows.max nor because of "+
+		"sql.stats.persisted_rows.max_age; the row cap then becomes a soft cap "+
+		"that the stats tables can exceed by up to the number of distinct "+
+		"fingerprints",
+	false, /* defaultValue */
+)
+
+// SQLStatsCleanupRetainIndexRecommendationSources is the cluster setting that
+// protects the statement fingerprints with index recommendations from the row
+// cap: their rows are only removed if removing all the other candidate rows
+// is not enough to bring the stats tables under the cap. The age limit still
+// applies to them. See also RegisterProtectedFingerprintsProvider.
+var SQLStatsCleanupRetainIndexRecommendationSources = settings.RegisterBoolSetting(
+	settings.TenantWritable,
+	"sql.stats.cleanup.retain_index_recommendation_sources.enabled",
+	"if set, the SQL stats compaction job removes the rows of the statement "+
+		"fingerprints with index recommendations last when enforcing "+
+		"sql.stats.persisted_rows.max",
+	false, /* defaultValue */
+)
+
+// evictionOrder is the order in which the compaction removes the rows of a
+// hash bucket to enforce the row cap, see SQLStatsCleanupEvictionOrder.
+type evictionOrder int64
+
+const (
+	evictionOrderOldest evictionOrder = iota
+	evictionOrderLargestApp
+)
+
+// SQLStatsCleanupEvictionOrder is the cluster setting that controls which rows
+// the compaction removes first to enforce the row cap. With oldest, the oldest
+// rows are removed regardless of their application, so an application that
+// persists many fingerprints can evict the stats of all the others. With
+// largest_app, the rows are taken from the applications with the most rows
+// first, oldest first within each application, which preserves the recent
+// stats of the small applications at the expense of the recent stats of the
+// large ones. It costs an additional scan of each hash bucket to count the
+// rows of each application. The age limit is enforced separately, and is
+// not affected.
+var SQLStatsCleanupEvictionOrder = settings.RegisterEnumSetting(
+	settings.TenantWritable,
+	"sql.stats.cleanup.eviction_order",
+	"order in which the SQL stats compaction job removes rows to enforce "+
+		"sql.stats.persisted_rows.max: oldest removes the oldest rows first, "+
+		"largest_app removes the rows of the applications with the most rows first",
+	"oldest",
+	map[int64]string{
+		int64(evictionOrderOldest):     "oldest",
+		int64(evictionOrderLargestApp): "largest_app",
+	},
+)
+
+// SQLStatsCleanupPinnedAppNames is the cluster setting listing the
+// applications whose rows are never removed by the compaction, neither by the
+// row cap nor by the age limit, see getPinnedPredicate. The pinned rows still
+// count towards the row cap, so the other applications get less room.
+var SQLStatsCleanupPinnedAppNames = settings.RegisterStringSetting(
+	settings.TenantWritable,
+	"sql.stats.cleanup.pinned_app_names",
+	"comma-separated list of application names whose statement and "+
+		"transaction statistics are never removed by the SQL stats compaction "+
+		"job, as long as they have fewer than "+
+		"sql.stats.cleanup.pinned_app_names.max_rows rows",
+	"", /* defaultValue */
+)
+
+// SQLStatsCleanupMaxPinnedRows is a safety cap on the number of rows of the
+// pinned applications (see SQLStatsCleanupPinnedAppNames) in each stats
+// table. Above it, the rows of the pinned applications are compacted as the
+// other rows, so that pinning cannot lead to unbounded growth of the tables.
+var SQLStatsCleanupMaxPinnedRows = settings.RegisterIntSetting(
+	settings.TenantWritable,
+	"sql.stats.cleanup.pinned_app_names.max_rows",
+	"maximum number of rows of the applications listed in "+
+		"sql.stats.cleanup.pinned_app_names in each stats table; above it, "+
+		"their rows are removed by the SQL stats compaction job as the other rows",
+	100000, /* defaultValue */
+	settings.NonNegativeInt,
+)
+
 // SQLStatsCleanupRecurrence is the cron-tab string specifying the recurrence
 // for SQL Stats cleanup job.
 var SQLStatsCleanupRecurrence = settings.RegisterValidatedStringSetting(
@@ -100,21 +291,50 @@ var SQLStatsCleanupRecurrence = settings.RegisterValidatedStringSetting(
 	"sql.stats.cleanup.recurrence",
 	"cron-tab recurrence for SQL Stats cleanup job",
 	"@hourly", /* defaultValue */
-	func(_ *settings.Values, s string) error {
-		if _, err := cron.ParseStandard(s); err != nil {
+	func(sv *settings.Values, s string) error {
+		schedule, err := cron.ParseStandard(s)
+		if err != nil {
 			return errors.Wrap(err, "invalid cron expression")
 		}
-		return nil
+		minInterval := SQLStatsCleanupMinRecurrenceInterval.Default()
+		if sv != nil {
+			minInterval = SQLStatsCleanupMinRecurrenceInterval.Get(sv)
+		}
+		return checkScheduleIntervalNotTooShort(schedule, minInterval)
 	},
 ).WithPublic()
 
+// SQLStatsCleanupMinRecurrenceInterval is the cluster setting that controls
+// the minimum interval between two runs of the SQL Stats cleanup job allowed
+// by sql.stats.cleanup.recurrence. This prevents the compaction job from
+// being scheduled so frequently that it overloads the cluster.
+var SQLStatsCleanupMinRecurrenceInterval = settings.RegisterDurationSetting(
+	settings.TenantWritable,
+	"sql.stats.cleanup.min_recurrence_interval",
+	"the minimum interval between two runs of the SQL Stats cleanup job that "+
+		"can be configured using sql.stats.cleanup.recurrence",
+	time.Minute,
+	settings.NonNegativeDuration,
+)
+
 // SQLStatsAggregationInterval is the cluster setting that controls the aggregation
 // interval for stats when we flush to disk.
+//
+// Each node persists one row per fingerprint and aggregation window, so the
+// number of rows grows inversely with the interval: going from 1h to 10m
+// multiplies by up to six the rows written for the fingerprints executed
+// throughout the hour. The rows record the interval they were aggregated over
+// (agg_interval) and are not rewritten when the setting changes: only the rows
+// flushed afterwards use the new interval.
 var SQLStatsAggregationInterval = settings.RegisterDurationSetting(
 	settings.TenantWritable,
 	"sql.stats.aggregation.interval",
 	"the interval at which we aggregate SQL execution statistics upon flush, "+
-		"this value must be greater than or equal to sql.stats.flush.interval",
+		"this value must be greater than or equal to sql.stats.flush.interval; "+
+		"changing it only affects the stats flushed afterwards. "+
+		"A finer interval increases the number of rows persisted for each "+
+		"fingerprint, up to one per node and interval, and thus the size of the "+
+		"stats tables and the work of the compaction job",
 	time.Hour,
 	settings.NonNegativeDurationWithMaximum(time.Hour*24),
 )
@@ -129,3 +349,349 @@ var CompactionJobRowsToDeletePerTxn = settings.RegisterIntSetting(
 	10000,
 	settings.NonNegativeInt,
 )
+
+// SQLStatsCleanupCatchUpEnabled is the cluster setting that controls whether
+// the compaction job runs in catch-up mode when it detects a large backlog of
+// rows, e.g. after the cluster was down for a long period of time. In catch-up
+// mode, each compaction run only deletes a bounded number of rows and leaves
+// the remainder to the subsequent runs of the schedule.
+var SQLStatsCleanupCatchUpEnabled = settings.RegisterBoolSetting(
+	settings.TenantWritable,
+	"sql.stats.cleanup.catchup.enabled",
+	"if set, a compaction run that detects a large backlog of rows deletes "+
+		"a bounded number of rows and defers the rest to subsequent runs",
+	false, /* defaultValue */
+)
+
+// SQLStatsCleanupCatchUpBacklogThreshold is the cluster setting that controls
+// how large the backlog has to be for the compaction job to enter catch-up
+// mode. It is expressed as a multiple of sql.stats.persisted_rows.max.
+var SQLStatsCleanupCatchUpBacklogThreshold = settings.RegisterFloatSetting(
+	settings.TenantWritable,
+	"sql.stats.cleanup.catchup.backlog_threshold",
+	"multiple of sql.stats.persisted_rows.max above which a stats table is "+
+		"considered to have a compaction backlog",
+	2.0, /* defaultValue */
+	settings.PositiveFloat,
+)
+
+// SQLStatsCleanupCatchUpRowsPerRun is the cluster setting that controls the
+// maximum number of rows that a compaction run in catch-up mode deletes from
+// each stats table.
+var SQLStatsCleanupCatchUpRowsPerRun = settings.RegisterIntSetting(
+	settings.TenantWritable,
+	"sql.stats.cleanup.catchup.rows_per_run",
+	"maximum number of rows deleted from each stats table per compaction run "+
+		"in catch-up mode",
+	100000, /* defaultValue */
+	settings.PositiveInt,
+)
+
+// SQLStatsCleanupGCHintEnabled is the cluster setting that controls whether
+// the compaction job enqueues the ranges of a stats table into the MVCC GC
+// queue after removing a large number of rows from it. This reclaims the
+// space used by the removed rows, as well as the cost of scanning over them,
+// sooner than if the GC queue were left to get to the ranges on its own.
+var SQLStatsCleanupGCHintEnabled = settings.RegisterBoolSetting(
+	settings.TenantWritable,
+	"sql.stats.cleanup.gc_hint.enabled",
+	"if set, the ranges of a stats table are enqueued for MVCC garbage "+
+		"collection after a compaction run removes a large number of rows "+
+		"from it; see sql.stats.cleanup.gc_hint.threshold",
+	false, /* defaultValue */
+)
+
+// SQLStatsCleanupGCHintThreshold is the cluster setting that controls how
+// many rows a compaction run has to remove from a stats table for its ranges
+// to be enqueued into the MVCC GC queue.
+var SQLStatsCleanupGCHintThreshold = settings.RegisterIntSetting(
+	settings.TenantWritable,
+	"sql.stats.cleanup.gc_hint.threshold",
+	"minimum number of rows removed from a stats table by a compaction run "+
+		"for its ranges to be enqueued for MVCC garbage collection",
+	100000, /* defaultValue */
+	settings.PositiveInt,
+)
+
+// SQLStatsCleanupMaxPauseDuration is the cluster setting that limits how long
+// the SQL Stats compaction schedule can be paused for using
+// crdb_internal.pause_sql_stats_compaction(). Pausing the compaction for too
+// long may result in unbounded growth of the persisted stats tables.
+var SQLStatsCleanupMaxPauseDuration = settings.RegisterDurationSetting(
+	settings.TenantWritable,
+	"sql.stats.cleanup.max_pause_duration",
+	"the maximum duration for which the SQL Stats compaction can be paused "+
+		"using crdb_internal.pause_sql_stats_compaction()",
+	24*time.Hour,
+	settings.PositiveDuration,
+)
+
+// SQLStatsCleanupWindow is the cluster setting that confines the removal of
+// rows by the SQL Stats compaction job to a daily time window, e.g. the
+// off-peak hours of the cluster. If the compaction job is started outside the
+// window, it waits until the window opens. See ParseCleanupWindow for the
+// format of the window.
+var SQLStatsCleanupWindow = settings.RegisterValidatedStringSetting(
+	settings.TenantWritable,
+	"sql.stats.cleanup.window",
+	"daily time window, of the form 'HH:MM-HH:MM [time zone]' (e.g. "+
+		"'01:00-05:00 UTC'), within which the SQL Stats cleanup job removes "+
+		"rows; a job started outside the window waits until it opens, and a "+
+		"job stops between two batches of removed rows once the window closes; "+
+		"empty to allow the cleanup at any time",
+	"", /* defaultValue */
+	func(_ *settings.Values, s string) error {
+		_, err := ParseCleanupWindow(s)
+		return err
+	},
+)
+
+// SQLStatsCleanupCoalesceWindowsEnabled is the cluster setting that controls
+// whether the compaction job merges the rows of a fingerprint that belong to
+// the same window of the aggregation interval before applying the retention
+// policy. Such rows are left behind when the aggregation interval is made
+// coarser, or when the clock of a node is skewed.
+var SQLStatsCleanupCoalesceWindowsEnabled = settings.RegisterBoolSetting(
+	settings.TenantWritable,
+	"sql.stats.cleanup.coalesce_windows.enabled",
+	"if set, the SQL Stats cleanup job merges the rows of a fingerprint that "+
+		"belong to the same window of sql.stats.aggregation.interval into a "+
+		"single row before removing stale rows; the rows written by different "+
+		"nodes are not merged, since node_id is part of the key of a row",
+	false, /* defaultValue */
+)
+
+// SQLStatsCleanupWindowGrace is the cluster setting that defines the grace
+// period during which the rows of an aggregation window are neither removed
+// nor coalesced by the SQL Stats compaction job. The compaction never touches
+// the windows that start after the window containing now minus the grace
+// period, so that it does not race with the flushes that are still writing to
+// a window that just ended. Zero stands for one aggregation interval.
+var SQLStatsCleanupWindowGrace = settings.RegisterDurationSetting(
+	settings.TenantWritable,
+	"sql.stats.cleanup.window_grace",
+	"duration after the end of a window of sql.stats.aggregation.interval "+
+		"during which the SQL Stats cleanup job does not remove or coalesce the "+
+		"rows of the window, on top of the current window which is never "+
+		"touched; 0 stands for one aggregation interval",
+	0, /* defaultValue */
+	settings.NonNegativeDuration,
+)
+
+// SQLStatsCleanupMaxRowsPerRun is the cluster setting that limits the number
+// of rows that a run of the SQL Stats compaction job removes across both
+// stats tables. The remaining rows are removed by the subsequent runs, which
+// bounds the load and the duration of each run. Zero disables the limit.
+var SQLStatsCleanupMaxRowsPerRun = settings.RegisterIntSetting(
+	settings.TenantWritable,
+	"sql.stats.cleanup.max_rows_per_run",
+	"maximum number of rows removed from the stats tables by a run of the SQL "+
+		"Stats cleanup job, the remaining rows being removed by the next runs; "+
+		"the limit is split evenly between the statement and transaction "+
+		"statistics tables, and the rows left unused on the statement "+
+		"statistics table go to the transaction statistics table; "+
+		"0 means no limit",
+	0, /* defaultValue */
+	settings.NonNegativeInt,
+)
+
+// SQLStatsCleanupDeleteRateLimit is the cluster setting that limits the rate,
+// in rows per second, at which the SQL Stats compaction job removes rows. The
+// job waits between its deletions as needed to stay under the limit, which
+// spreads the load of a large removal over time instead of deleting in
+// bursts. Zero disables the limit.
+var SQLStatsCleanupDeleteRateLimit = settings.RegisterIntSetting(
+	settings.TenantWritable,
+	"sql.stats.cleanup.delete_rate_limit",
+	"maximum number of rows per second removed from the stats tables by the "+
+		"SQL Stats cleanup job; 0 means no limit",
+	0, /* defaultValue */
+	settings.NonNegativeInt,
+)
+
+// SQLStatsFlushCompressText is the cluster setting that enables the
+// compression of the statement text and of the plan of the statement
+// statistics that are persisted by the flush, when they are at least
+// SQLStatsFlushCompressTextMinSize long. The compressed fields are
+// decompressed by the readers of the statistics, including the virtual tables
+// and the export, but not in the columns of system.statement_statistics.
+var SQLStatsFlushCompressText = settings.RegisterBoolSetting(
+	settings.TenantWritable,
+	"sql.stats.flush.compress_text",
+	"if set, the statement text and the plan of the persisted statement "+
+		"statistics are compressed when they are at least "+
+		"sql.stats.flush.compress_text.min_size long; the crdb_internal tables "+
+		"show them decompressed, but in the metadata and plan columns of "+
+		"system.statement_statistics they are stored under the queryCompressed "+
+		"and compressed keys respectively",
+	false, /* defaultValue */
+)
+
+// SQLStatsFlushCompressTextMinSize is the size of the statement text or plan
+// above which it is compressed by the flush, see SQLStatsFlushCompressText.
+// Smaller fields do not compress well enough to make up for the CPU spent on
+// compression.
+var SQLStatsFlushCompressTextMinSize = settings.RegisterByteSizeSetting(
+	settings.TenantWritable,
+	"sql.stats.flush.compress_text.min_size",
+	"minimum size of the statement text or plan of the persisted statement "+
+		"statistics compressed when sql.stats.flush.compress_text is set",
+	1<<10, /* defaultValue */
+)
+
+// SQLStatsFlushStagingEnabled is the cluster setting that makes the flush
+// stage the in-memory stats of the node, and then merge them into the stats
+// tables in batches of rows, each in its own transaction, instead of writing
+// each fingerprint in its own transaction. See flushStmtStatsStaged.
+var SQLStatsFlushStagingEnabled = settings.RegisterBoolSetting(
+	settings.TenantWritable,
+	"sql.stats.flush.staging.enabled",
+	"if set, the SQL stats flush merges the statistics of all the "+
+		"fingerprints of the node into the stats tables in batches of rows, with "+
+		"a transaction per batch, instead of one transaction per fingerprint",
+	false, /* defaultValue */
+)
+
+// SQLStatsFlushHashAppNames is the cluster setting that makes the flush
+// persist the statistics of the applications under a hash of their name,
+// since the application names can contain personally identifiable
+// information. See maybeHashAppName.
+var SQLStatsFlushHashAppNames = settings.RegisterBoolSetting(
+	settings.TenantWritable,
+	"sql.stats.flush.hash_app_names",
+	"if set, the SQL stats flush replaces the application names with a stable "+
+		"hash keyed by cluster.secret in the stats tables; internal application "+
+		"names are persisted as is",
+	false, /* defaultValue */
+)
+
+// SQLStatsCleanupDeleteParallelism is the cluster setting that controls the
+// number of hash buckets of a stats table from which the SQL Stats cleanup
+// job removes rows concurrently. The deletions of all the buckets remain
+// bounded by sql.stats.cleanup.delete_rate_limit.
+var SQLStatsCleanupDeleteParallelism = settings.RegisterIntSetting(
+	settings.TenantWritable,
+	"sql.stats.cleanup.delete_parallelism",
+	"maximum number of hash buckets of a stats table from which the SQL Stats "+
+		"cleanup job removes rows concurrently",
+	1, /* defaultValue */
+	settings.PositiveInt,
+)
+
+// SQLStatsCleanupVerify is the cluster setting that makes the SQL Stats
+// cleanup job check that the stats tables are under
+// sql.stats.persisted_rows.max after each run. See verifyRowCap.
+var SQLStatsCleanupVerify = settings.RegisterBoolSetting(
+	settings.TenantWritable,
+	"sql.stats.cleanup.verify",
+	"if set, the SQL Stats cleanup job checks after each run whether the stats "+
+		"tables are still above sql.stats.persisted_rows.max, logs a warning if "+
+		"so, and compacts again the hash buckets in which rows failed to be removed",
+	false, /* defaultValue */
+)
+
+// SQLStatsCleanupAppNameTTLs is the cluster setting mapping application name
+// patterns to a time to live, after which the SQL Stats cleanup job removes
+// the rows of the matching applications regardless of
+// sql.stats.persisted_rows.max_age. See getAppNameTTLRemovals.
+var SQLStatsCleanupAppNameTTLs = settings.RegisterValidatedStringSetting(
+	settings.TenantWritable,
+	"sql.stats.cleanup.app_name_ttls",
+	"comma-separated list of pattern=ttl entries (e.g. 'batch_%=1h,etl=30m'); "+
+		"the SQL Stats cleanup job removes the statement and transaction "+
+		"statistics of the applications whose name matches the LIKE pattern once "+
+		"they are older than the ttl, even if sql.stats.persisted_rows.max_age "+
+		"would retain them longer",
+	"", /* defaultValue */
+	func(_ *settings.Values, s string) error {
+		_, err := parseAppNameTTLs(s)
+		return err
+	},
+)
+
+// SQLStatsMaintenanceFrozen is the cluster setting that freezes the
+// background maintenance of the persisted SQL stats, e.g. during upgrades or
+// restores. While it is set, the flushes and the compaction runs are skipped.
+// The in-memory stats keep accumulating, up to their memory limit, and are
+// flushed once the freeze is lifted. The compaction schedule keeps running,
+// and each of its runs is deferred to the next recurrence.
+var SQLStatsMaintenanceFrozen = settings.RegisterBoolSetting(
+	settings.TenantWritable,
+	"sql.stats.maintenance.frozen",
+	"if set, the SQL stats flush and the SQL stats compaction job do nothing; "+
+		"the statistics are retained in memory, up to their memory limit, until "+
+		"the setting is cleared",
+	false, /* defaultValue */
+)
+
+// SQLStatsCleanupEventLogEnabled is the cluster setting that makes each run
+// of the SQL Stats cleanup job record a start and a finish event in the event
+// log, so that the runs can be monitored through system.eventlog.
+var SQLStatsCleanupEventLogEnabled = settings.RegisterBoolSetting(
+	settings.TenantWritable,
+	"sql.stats.cleanup.event_log.enabled",
+	"if set, each run of the SQL Stats cleanup job records a "+
+		"sql_stats_compaction_start and a sql_stats_compaction_finish event, with "+
+		"the number of rows removed and the duration of the run, in the event log",
+	false, /* defaultValue */
+)
+
+// SQLStatsCleanupRetainPerPlan is the cluster setting that protects the most
+// recent aggregation window of each distinct plan of a statement fingerprint
+// from the row cap, so that the persisted stats keep the data used to analyze
+// plan regressions: these rows are only removed if removing all the other
+// candidate rows is not enough to bring the stats tables under the cap. The
+// age limit still applies to them.
+var SQLStatsCleanupRetainPerPlan = settings.RegisterBoolSetting(
+	settings.TenantWritable,
+	"sql.stats.cleanup.retain_per_plan",
+	"if set, the SQL stats compaction job removes the most recent aggregation "+
+		"window of each plan hash of a statement fingerprint last when enforcing "+
+		"sql.stats.persisted_rows.max",
+	false, /* defaultValue */
+)
+
+// SQLStatsCleanupSanityFraction is the cluster setting that flags the
+// compaction runs deleting an unexpectedly large fraction of the rows of a
+// stats table, which usually indicates a misconfigured retention policy, see
+// checkDeletionSanity. The runs are not stopped.
+var SQLStatsCleanupSanityFraction = settings.RegisterFloatSetting(
+	settings.TenantWritable,
+	"sql.stats.cleanup.sanity_fraction",
+	"fraction of the rows of a stats table above which a SQL stats compaction "+
+		"run removing them logs a warning and increments "+
+		"sql.stats.compaction.sanity_threshold_exceeded; 0 disables the check",
+	0.5, /* defaultValue */
+	func(f float64) error {
+		if f < 0 || f > 1 {
+			return errors.Newf("%f is not in [0, 1]", f)
+		}
+		return nil
+	},
+)
+
+// SQLStatsCleanupRollupEnabled is the cluster setting that controls whether
+// the compaction job rolls up the rows older than
+// sql.stats.cleanup.rollup_after into daily windows, see rollupWindows.
+var SQLStatsCleanupRollupEnabled = settings.RegisterBoolSetting(
+	settings.TenantWritable,
+	"sql.stats.cleanup.rollup.enabled",
+	"if set, the SQL Stats cleanup job merges the rows of a fingerprint that "+
+		"are older than sql.stats.cleanup.rollup_after into a single row per day "+
+		"before removing stale rows; the rows written by different nodes are not "+
+		"merged, since node_id is part of the key of a row",
+	false, /* defaultValue */
+)
+
+// SQLStatsCleanupRollupAfter is the cluster setting that defines the age,
+// based on their aggregation timestamp, after which the rows are rolled up
+// into daily windows if sql.stats.cleanup.rollup.enabled is set.
+var SQLStatsCleanupRollupAfter = settings.RegisterDurationSetting(
+	settings.TenantWritable,
+	"sql.stats.cleanup.rollup_after",
+	"age of the rows of statement and transaction statistics, based on their "+
+		"aggregation timestamp, after which the SQL Stats cleanup job rolls them "+
+		"up into daily windows if sql.stats.cleanup.rollup.enabled is set",
+	7*24*time.Hour, /* defaultValue */
+	settings.NonNegativeDurationWithMinimum(rollupInterval),
+)
@@ -0,0 +1,123 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package persistedsqlstats
+
+import (
+	"context"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/sem/eval"
+	"github.com/cockroachdb/cockroach/pkg/sql/sem/tree"
+	"github.com/cockroachdb/cockroach/pkg/sql/sessiondata"
+	"github.com/cockroachdb/errors"
+)
+
+// The retention policies reported by BindingPolicies.
+const (
+	// bindingPolicyRowCap is sql.stats.persisted_rows.max.
+	bindingPolicyRowCap = "row_cap"
+	// bindingPolicyMaxAge is sql.stats.persisted_rows.max_age.
+	bindingPolicyMaxAge = "max_age"
+	// bindingPolicyNone is reported for the tables within all the limits.
+	bindingPolicyNone = "none"
+)
+
+// BindingPolicies returns, for each persisted stats table, the retention
+// policy that currently limits it: the row cap if more rows exceed the row
+// cap than the age limit, the age limit if more rows exceed the age limit, or
+// none if the table is within both limits. The number of rows over the binding
+// limit is the number of rows that the next compaction run would remove if
+// nothing else retained them, see DiffPolicies for what the estimate does not
+// take into account.
+//
+// The tables are only read, using a single scan per table.
+func (c *StatsCompactor) BindingPolicies(ctx context.Context) ([]eval.SQLStatsBindingPolicy, error) {
+	maxRows, maxAge := c.getRetentionPolicy(ctx)
+	ageCutoff, err := c.getAgeCutoff(maxAge)
+	if err != nil {
+		return nil, err
+	}
+	policies := make([]eval.SQLStatsBindingPolicy, 0, 2)
+	for _, ops := range []*cleanupOperations{stmtStatsCleanupOps, txnStatsCleanupOps} {
+		policy, err := c.bindingPolicyForTable(ctx, ops, maxRows, ageCutoff)
+		if err != nil {
+			return nil, err
+		}
+		policies = append(policies, policy)
+	}
+	return policies, nil
+}
+
+func (c *StatsCompactor) bindingPolicyForTable(
+	ctx context.Context, ops *cleanupOperations, maxRows int64, ageCutoff *tree.DTimestampTZ,
+) (policy eval.SQLStatsBindingPolicy, retErr error) {
+	policy.Table = ops.table
+
+	graceCutoff, err := tree.MakeDTimestampTZ(c.getGraceCutoff(), time.Microsecond)
+	if err != nil {
+		return policy, err
+	}
+	// The policy diff statement counts the expired rows for two age cutoffs,
+	// only the first one is used here.
+	it, err := c.db.Executor().QueryIteratorEx(ctx,
+		"sql-stats-binding-policy",
+		nil, /* txn */
+		sessiondata.NodeUserSessionDataOverride,
+		ops.getPolicyDiffStmt(
+			c.getAOSTClause(),
+			false, /* retainRecentlyExecuted */
+			false, /* withLastExecutionTs */
+		),
+		graceCutoff,
+		ageCutoff,
+		ageCutoff,
+	)
+	if err != nil {
+		return policy, err
+	}
+	defer func() {
+		retErr = errors.CombineErrors(retErr, it.Close())
+	}()
+
+	// The row cap is enforced per hash bucket, so the rows over the row cap
+	// are summed over the buckets.
+	limitPerShard := computeRowLimitPerShard(maxRows)
+	var rowsOverRowCap, expiredRows int64
+	var ok bool
+	for ok, err = it.Next(ctx); ok; ok, err = it.Next(ctx) {
+		row := it.Cur()
+		shardIdx := int(tree.MustBeDInt(row[0]))
+		if shardIdx < 0 || shardIdx >= len(limitPerShard) {
+			return policy, errors.AssertionFailedf("unexpected hash bucket %d", shardIdx)
+		}
+		rowCount := int64(tree.MustBeDInt(row[1]))
+		policy.RowCount += rowCount
+		if rowCount > limitPerShard[shardIdx] {
+			rowsOverRowCap += rowCount - limitPerShard[shardIdx]
+		}
+		expiredRows += int64(tree.MustBeDInt(row[3]))
+	}
+	if err != nil {
+		return policy, err
+	}
+
+	switch {
+	case rowsOverRowCap == 0 && expiredRows == 0:
+		policy.Policy = bindingPolicyNone
+	case expiredRows > rowsOverRowCap:
+		policy.Policy = bindingPolicyMaxAge
+		policy.RowsOverLimit = expiredRows
+	default:
+		policy.Policy = bindingPolicyRowCap
+		policy.RowsOverLimit = rowsOverRowCap
+	}
+	return policy, nil
+}
@@ -0,0 +1,96 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package persistedsqlstats
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
+)
+
+// CompactionCheckpoint records the hash buckets of each stats table that a
+// compaction run brought under the row cap, so that the run can be resumed
+// after an interruption, e.g. once the compaction job is adopted by another
+// node, without compacting these buckets again.
+type CompactionCheckpoint struct {
+	// Buckets maps the name of each stats table to the indexes of its hash
+	// buckets that were compacted.
+	Buckets map[string][]int64 `json:"buckets"`
+}
+
+// MarshalCompactionCheckpoint encodes the checkpoint, e.g. to store it in
+// system.job_info.
+func MarshalCompactionCheckpoint(cp CompactionCheckpoint) ([]byte, error) {
+	return json.Marshal(cp)
+}
+
+// UnmarshalCompactionCheckpoint decodes a checkpoint encoded with
+// MarshalCompactionCheckpoint.
+func UnmarshalCompactionCheckpoint(data []byte) (CompactionCheckpoint, error) {
+	var cp CompactionCheckpoint
+	err := json.Unmarshal(data, &cp)
+	return cp, err
+}
+
+// compactionCheckpointer tracks the checkpoint of the runs of a compactor,
+// see StatsCompactor.SetCheckpoint.
+type compactionCheckpointer struct {
+	syncutil.Mutex
+	cp   CompactionCheckpoint
+	save func(context.Context, CompactionCheckpoint) error
+}
+
+// SetCheckpoint resumes the compaction from the given checkpoint: the hash
+// buckets it records are not compacted again to enforce the row cap. The
+// other removals, e.g. of the expired rows, run again, since they are cheap
+// once their rows were removed. Each hash bucket brought under the row cap is
+// added to the checkpoint, which is then passed to save.
+func (c *StatsCompactor) SetCheckpoint(
+	cp CompactionCheckpoint, save func(context.Context, CompactionCheckpoint) error,
+) {
+	c.checkpoint.Lock()
+	defer c.checkpoint.Unlock()
+	c.checkpoint.cp = cp
+	c.checkpoint.save = save
+}
+
+// isBucketCheckpointed returns whether the given hash bucket of the table is
+// recorded in the checkpoint.
+func (c *StatsCompactor) isBucketCheckpointed(table string, shardIdx int64) bool {
+	c.checkpoint.Lock()
+	defer c.checkpoint.Unlock()
+	for _, idx := range c.checkpoint.cp.Buckets[table] {
+		if idx == shardIdx {
+			return true
+		}
+	}
+	return false
+}
+
+// checkpointBucket records that the given hash bucket of the table was
+// brought under the row cap. A failure to save the checkpoint is logged: the
+// bucket is then compacted again if the run is resumed.
+func (c *StatsCompactor) checkpointBucket(ctx context.Context, table string, shardIdx int64) {
+	c.checkpoint.Lock()
+	defer c.checkpoint.Unlock()
+	if c.checkpoint.save == nil {
+		return
+	}
+	if c.checkpoint.cp.Buckets == nil {
+		c.checkpoint.cp.Buckets = make(map[string][]int64, 2)
+	}
+	c.checkpoint.cp.Buckets[table] = append(c.checkpoint.cp.Buckets[table], shardIdx)
+	if err := c.checkpoint.save(ctx, c.checkpoint.cp); err != nil {
+		log.Warningf(ctx, "failed to checkpoint the compaction of %s: %v", table, err)
+	}
+}
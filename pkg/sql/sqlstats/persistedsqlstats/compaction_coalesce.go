@@ -0,0 +1,266 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package persistedsqlstats
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/appstatspb"
+	"github.com/cockroachdb/cockroach/pkg/sql/isql"
+	"github.com/cockroachdb/cockroach/pkg/sql/sem/tree"
+	"github.com/cockroachdb/cockroach/pkg/sql/sessiondata"
+	"github.com/cockroachdb/cockroach/pkg/sql/sqlstats/persistedsqlstats/sqlstatsutil"
+	"github.com/cockroachdb/cockroach/pkg/util/json"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/cockroachdb/errors"
+)
+
+// coalesceMaxWindowsPerRun is the maximum number of windows coalesced by a
+// single compaction run for each stats table. The remaining windows are
+// coalesced by the subsequent runs.
+const coalesceMaxWindowsPerRun = 10000
+
+// zeroTimeUnixOffset is the number of seconds from the zero time.Time, from
+// which time.Time.Truncate rounds, to the Unix epoch. The windows computed in
+// SQL are offset by it, so that they are aligned as the aggregation
+// timestamps of the flush and the cutoffs of the compaction, which are
+// computed with time.Time.Truncate.
+var zeroTimeUnixOffset = float64(-time.Time{}.Unix())
+
+// coalesceWindows merges the rows of a fingerprint that belong to the same
+// window of the current aggregation interval into a single row, whose
+// aggregated_ts is the start of the window and whose agg_interval is the
+// aggregation interval. Such rows are left behind when the aggregation
+// interval is made coarser, or when the aggregation timestamps of a node are
+// skewed. The statistics of the merged rows are combined, e.g. their
+// execution counts are summed, and the other columns of the most recent row,
+// e.g. its metadata and plan, are kept, since they reflect the latest
+// executions of the fingerprint. A window holding a single row of the
+// fingerprint that does not start at the window or has a finer agg_interval
+// is converted in the same way. The rows with a coarser agg_interval, e.g.
+// the ones rolled up by rollupWindows, are left as is. The rows of the windows in the grace period
+// (see getGraceCutoff), which include the current window, are not merged,
+// since they may still be updated by the flush.
+//
+// Since node_id is part of the key of a fingerprint, the rows written by
+// different nodes for the same window are not merged.
+func (c *StatsCompactor) coalesceWindows(ctx context.Context, ops *cleanupOperations) error {
+	aggInterval := SQLStatsAggregationInterval.Get(&c.st.SV)
+	if aggInterval <= 0 {
+		return nil
+	}
+	windows, err := c.getWindowsToCoalesce(ctx, ops, aggInterval, c.getGraceCutoff())
+	if err != nil {
+		return err
+	}
+
+	var rowsMerged int64
+	for _, w := range windows {
+		if c.cleanupWindowClosed(ctx) {
+			break
+		}
+		merged, err := c.coalesceWindow(ctx, ops, w, aggInterval)
+		if err != nil {
+			return err
+		}
+		rowsMerged += merged
+		if err := c.waitForDeleteRate(ctx, merged); err != nil {
+			return err
+		}
+	}
+	if rowsMerged > 0 {
+		log.Infof(ctx, "coalesced %d rows of %s into %d aggregation windows",
+			rowsMerged, ops.table, len(windows))
+	}
+	return nil
+}
+
+// coalescedWindow identifies the rows of a fingerprint within a window of
+// the aggregation interval.
+type coalescedWindow struct {
+	key   tree.Datums
+	start time.Time
+}
+
+// getWindowsToCoalesce returns up to coalesceMaxWindowsPerRun windows of the
+// given aggregation interval, preceding graceCutoff, that contain more than
+// one row of the same fingerprint, or a row that does not start at the window
+// or whose agg_interval is finer than the aggregation interval.
+func (c *StatsCompactor) getWindowsToCoalesce(
+	ctx context.Context, ops *cleanupOperations, aggInterval time.Duration, graceCutoff time.Time,
+) (windows []coalescedWindow, retErr error) {
+	keyColumns := strings.Join(ops.keyColumns, ", ")
+	stmt := fmt.Sprintf(`
+SELECT %[1]s, window_ts
+FROM (
+  SELECT %[1]s, aggregated_ts, agg_interval,
+    to_timestamp(floor((extract(epoch FROM aggregated_ts) + $4) / $1) * $1 - $4) AS window_ts
+  FROM %[2]s %[3]s
+  WHERE aggregated_ts < $2
+)
+GROUP BY %[1]s, window_ts
+HAVING count(*) > 1 OR bool_or(aggregated_ts != window_ts OR agg_interval < $5::INTERVAL)
+LIMIT $3`, keyColumns, ops.table, c.getAOSTClause())
+
+	it, err := c.db.Executor().QueryIteratorEx(ctx,
+		"sql-stats-windows-to-coalesce",
+		nil, /* txn */
+		sessiondata.NodeUserSessionDataOverride,
+		stmt,
+		aggInterval.Seconds(),
+		graceCutoff,
+		coalesceMaxWindowsPerRun,
+		zeroTimeUnixOffset,
+		aggInterval,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		retErr = errors.CombineErrors(retErr, it.Close())
+	}()
+
+	var ok bool
+	for ok, err = it.Next(ctx); ok; ok, err = it.Next(ctx) {
+		row := it.Cur()
+		key := make(tree.Datums, len(ops.keyColumns))
+		copy(key, row[:len(ops.keyColumns)])
+		windows = append(windows, coalescedWindow{
+			key:   key,
+			start: tree.MustBeDTimestampTZ(row[len(ops.keyColumns)]).Time,
+		})
+	}
+	return windows, err
+}
+
+// coalesceWindow merges the rows of the given window into its most recent
+// row in a single transaction, and returns the number of rows that were
+// merged into another row.
+func (c *StatsCompactor) coalesceWindow(
+	ctx context.Context, ops *cleanupOperations, w coalescedWindow, aggInterval time.Duration,
+) (rowsMerged int64, _ error) {
+	// The key columns are bound to the placeholders following the window
+	// bounds.
+	windowArgs := append([]interface{}{w.start, w.start.Add(aggInterval)}, w.key...)
+	windowPredicate := "aggregated_ts >= $1 AND aggregated_ts < $2" +
+		ops.keyPredicates(3 /* firstPlaceholder */)
+
+	err := c.db.Txn(ctx, func(ctx context.Context, txn isql.Txn) error {
+		rowsMerged = 0
+		it, err := txn.QueryIteratorEx(ctx, "sql-stats-read-window-to-coalesce", txn.KV(),
+			sessiondata.NodeUserSessionDataOverride,
+			fmt.Sprintf(`
+SELECT aggregated_ts, statistics FROM %s
+WHERE %s
+ORDER BY aggregated_ts
+FOR UPDATE`, ops.table, windowPredicate),
+			windowArgs...,
+		)
+		if err != nil {
+			return err
+		}
+		var latestAggTs *tree.DTimestampTZ
+		var statistics []json.JSON
+		var ok bool
+		for ok, err = it.Next(ctx); ok; ok, err = it.Next(ctx) {
+			row := it.Cur()
+			latestAggTs = tree.MustBeDTimestampTZ(row[0])
+			statistics = append(statistics, tree.MustBeDJSON(row[1]).JSON)
+		}
+		if err = errors.CombineErrors(err, it.Close()); err != nil {
+			return err
+		}
+		// The rows of the window may have been removed by the retention
+		// policy.
+		if len(statistics) == 0 {
+			return nil
+		}
+
+		merged := statistics[0]
+		if len(statistics) > 1 {
+			if merged, err = ops.mergeStatistics(statistics); err != nil {
+				return errors.Wrapf(err, "merging %d rows of %s", len(statistics), ops.table)
+			}
+		}
+
+		deleted, err := txn.ExecEx(ctx, "sql-stats-delete-coalesced-rows", txn.KV(),
+			sessiondata.NodeUserSessionDataOverride,
+			fmt.Sprintf("DELETE FROM %s WHERE %s AND aggregated_ts != $%d",
+				ops.table, windowPredicate, len(windowArgs)+1),
+			append(windowArgs, latestAggTs)...,
+		)
+		if err != nil {
+			return err
+		}
+		if _, err := txn.ExecEx(ctx, "sql-stats-update-coalesced-row", txn.KV(),
+			sessiondata.NodeUserSessionDataOverride,
+			fmt.Sprintf(`
+UPDATE %s
+SET aggregated_ts = $1, agg_interval = $2, statistics = $3
+WHERE aggregated_ts = $4%s`, ops.table, ops.keyPredicates(5 /* firstPlaceholder */)),
+			append([]interface{}{w.start, aggInterval, tree.NewDJSON(merged), latestAggTs}, w.key...)...,
+		); err != nil {
+			return err
+		}
+		rowsMerged = int64(deleted)
+		return nil
+	})
+	return rowsMerged, err
+}
+
+// mergeStmtStatistics combines the given statement statistics, encoded as in
+// the statistics column of system.statement_statistics.
+func mergeStmtStatistics(statistics []json.JSON) (json.JSON, error) {
+	var merged appstatspb.StatementStatistics
+	for i, stats := range statistics {
+		var cur appstatspb.StatementStatistics
+		if err := sqlstatsutil.DecodeStmtStatsStatisticsJSON(stats, &cur); err != nil {
+			return nil, err
+		}
+		if i == 0 {
+			merged = cur
+		} else {
+			merged.Add(&cur)
+		}
+	}
+	return sqlstatsutil.BuildStmtStatisticsJSON(&merged)
+}
+
+// mergeTxnStatistics combines the given transaction statistics, encoded as in
+// the statistics column of system.transaction_statistics.
+func mergeTxnStatistics(statistics []json.JSON) (json.JSON, error) {
+	var merged appstatspb.CollectedTransactionStatistics
+	for i, stats := range statistics {
+		var cur appstatspb.TransactionStatistics
+		if err := sqlstatsutil.DecodeTxnStatsStatisticsJSON(stats, &cur); err != nil {
+			return nil, err
+		}
+		if i == 0 {
+			merged.Stats = cur
+		} else {
+			merged.Stats.Add(&cur)
+		}
+	}
+	return sqlstatsutil.BuildTxnStatisticsJSON(&merged)
+}
+
+// keyPredicates returns the predicates restricting the key columns of the
+// table to the values bound to the placeholders starting at firstPlaceholder.
+func (c *cleanupOperations) keyPredicates(firstPlaceholder int) string {
+	var predicates strings.Builder
+	for i, col := range c.keyColumns {
+		fmt.Fprintf(&predicates, " AND %s = $%d", col, firstPlaceholder+i)
+	}
+	return predicates.String()
+}
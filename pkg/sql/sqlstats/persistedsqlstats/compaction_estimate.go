@@ -0,0 +1,174 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package persistedsqlstats
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/sem/eval"
+	"github.com/cockroachdb/cockroach/pkg/sql/sem/tree"
+	"github.com/cockroachdb/cockroach/pkg/sql/sessiondata"
+	"github.com/cockroachdb/errors"
+)
+
+// EstimateRowsToRemove returns, for each stats table, the number of rows that
+// DeleteOldestEntriesWithReport would remove under the current retention
+// policy, without removing any. The rows are counted with the predicates of
+// the removals of a run (see getCompactionPolicy and getAgeRemovals): the
+// rows of the applications with a ttl, the expired rows, with the retention
+// of the recently executed fingerprints, of the latest window of each
+// fingerprint and of the pinned applications, then the rows over the row cap
+// of each hash bucket, in catch-up mode if needed. The protected fingerprints
+// only change which rows the row cap removes, not how many. As for a run, the
+// estimate is bounded by sql.stats.cleanup.max_rows_per_run, and does not
+// include the rows merged by coalesceWindows and rollupWindows.
+//
+// The tables are only read, using a single scan per table.
+func (c *StatsCompactor) EstimateRowsToRemove(
+	ctx context.Context,
+) ([]eval.SQLStatsCompactionResult, error) {
+	if err := c.loadStatsProtections(ctx); err != nil {
+		return nil, err
+	}
+	defer func() { c.protectedSince = nil }()
+
+	policy, err := c.getCompactionPolicy(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	c.resetRowBudget()
+
+	results := make([]eval.SQLStatsCompactionResult, 0, len(policy.tables))
+	for i, table := range policy.tables {
+		c.allocateTableRowBudget(int64(len(policy.tables) - i))
+		rowsToRemove, err := c.estimateRowsToRemoveForTable(ctx, &policy, table)
+		if err != nil {
+			return nil, err
+		}
+		result := eval.SQLStatsCompactionResult{
+			Table: table.ops.table,
+			Rows:  c.reserveRowBudget(rowsToRemove),
+		}
+		result.BudgetExhausted = result.Rows < rowsToRemove
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// estimateRowsToRemoveForTable returns the number of rows of the given table
+// that a run would remove, regardless of the budget of the run, see
+// EstimateRowsToRemove.
+func (c *StatsCompactor) estimateRowsToRemoveForTable(
+	ctx context.Context, policy *compactionPolicy, table compactionTable,
+) (totalRowsToRemove int64, _ error) {
+	removals, err := c.getAgeRemovals(policy, table)
+	if err != nil {
+		return 0, err
+	}
+	graceCutoff, err := tree.MakeDTimestampTZ(c.getGraceCutoff(), time.Microsecond)
+	if err != nil {
+		return 0, err
+	}
+	qargs := []interface{}{graceCutoff, policy.staleAgeCutoff}
+	agePredicates := make([]string, len(removals))
+	for i, removal := range removals {
+		qargs = append(qargs, removal.cutoff)
+		cutoffPlaceholder := fmt.Sprintf("$%d", len(qargs))
+		agePredicates[i] = "s.aggregated_ts < " + cutoffPlaceholder +
+			removal.getPredicates(table.ops, policy, cutoffPlaceholder)
+	}
+	// The row cap removes the rows matching the same predicates as
+	// removeStaleRowsForShard.
+	rowCapPredicates := table.pinnedPredicate
+	if policy.retainLatest {
+		rowCapPredicates += table.ops.notLatestWindowPredicate()
+	}
+
+	rows, err := c.db.Executor().QueryBufferedEx(ctx,
+		"sql-stats-compaction-estimate",
+		nil, /* txn */
+		sessiondata.NodeUserSessionDataOverride,
+		table.ops.getEstimateStmt(c.getAOSTClause(), agePredicates, rowCapPredicates),
+		qargs...,
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	rowLimitPerShard := computeRowLimitPerShard(policy.maxPersistedRows)
+	existingRowCountPerShard := make([]int64, len(rowLimitPerShard))
+	expiredRowCountPerShard := make([]int64, len(rowLimitPerShard))
+	removableRowCountPerShard := make([]int64, len(rowLimitPerShard))
+	var totalRowCount int64
+	for _, row := range rows {
+		shardIdx := int(tree.MustBeDInt(row[0]))
+		if shardIdx < 0 || shardIdx >= len(rowLimitPerShard) {
+			return 0, errors.AssertionFailedf("unexpected hash bucket %d", shardIdx)
+		}
+		// The rows removed based on their age are removed before the row
+		// cap is enforced, so they are not counted by it.
+		ageRowsToRemove := int64(tree.MustBeDInt(row[2]))
+		totalRowsToRemove += ageRowsToRemove
+		existingRowCountPerShard[shardIdx] = int64(tree.MustBeDInt(row[1])) - ageRowsToRemove
+		expiredRowCountPerShard[shardIdx] = int64(tree.MustBeDInt(row[3]))
+		removableRowCountPerShard[shardIdx] = int64(tree.MustBeDInt(row[4]))
+		totalRowCount += existingRowCountPerShard[shardIdx]
+	}
+
+	maxRowsToRemovePerShard := c.computeCatchUpRowLimitPerShard(totalRowCount, policy.maxPersistedRows)
+	for shardIdx, rowLimit := range rowLimitPerShard {
+		rowsToRemove := computeRowsToRemoveForShard(
+			existingRowCountPerShard[shardIdx], expiredRowCountPerShard[shardIdx],
+			rowLimit, maxRowsToRemovePerShard,
+		)
+		if rowsToRemove > removableRowCountPerShard[shardIdx] {
+			rowsToRemove = removableRowCountPerShard[shardIdx]
+		}
+		totalRowsToRemove += rowsToRemove
+	}
+	return totalRowsToRemove, nil
+}
+
+// getEstimateStmt returns the statement counting, for each hash bucket of the
+// table, its rows, the rows matching any of the given age predicates, i.e. the
+// rows removed based on their age, and, out of the other rows, the ones older
+// than the stale age cutoff ($2) and the ones that the row cap can remove,
+// i.e. the ones older than the grace cutoff ($1) that match rowCapPredicates.
+func (c *cleanupOperations) getEstimateStmt(
+	aostClause string, agePredicates []string, rowCapPredicates string,
+) string {
+	removedByAge := "false"
+	if len(agePredicates) > 0 {
+		removedByAge = "(" + strings.Join(agePredicates, ")\n        OR (") + ")"
+	}
+	return fmt.Sprintf(`
+      SELECT
+        %[1]s,
+        count(*),
+        count(*) FILTER (WHERE removed_by_age),
+        count(*) FILTER (WHERE NOT removed_by_age AND aggregated_ts < $2),
+        count(*) FILTER (WHERE NOT removed_by_age AND removable_by_row_cap)
+      FROM (
+        SELECT
+          %[1]s,
+          aggregated_ts,
+          %[3]s AS removed_by_age,
+          (s.aggregated_ts < $1%[4]s) AS removable_by_row_cap
+        FROM %[2]s AS s
+      )
+      %[5]s
+      GROUP BY %[1]s`,
+		c.shardColumn, c.table, removedByAge, rowCapPredicates, aostClause)
+}
@@ -0,0 +1,122 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package persistedsqlstats
+
+import (
+	"context"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/lexbase"
+	"github.com/cockroachdb/cockroach/pkg/sql/sem/tree"
+	"github.com/cockroachdb/cockroach/pkg/sql/sessiondata"
+	"github.com/cockroachdb/errors"
+)
+
+// removeLargestAppRowsForShard deletes up to rowsToRemove rows of the given
+// hash bucket that match the given predicates, taking them from the
+// applications with the most rows in the bucket first, see
+// computeEvictionsByApp. The rows of each application are removed oldest
+// first. Fewer rows are removed if the predicates exclude some of the rows of
+// the selected applications, in which case the caller removes the remaining
+// rows oldest first. The number of rows that were removed is returned.
+func (c *StatsCompactor) removeLargestAppRowsForShard(
+	ctx context.Context, ops *cleanupOperations, shardIdx, rowsToRemove int64, predicates string,
+) (totalRowsRemoved int64, _ error) {
+	appNames, appRowCounts, err := c.getAppRowCountsForShard(ctx, ops, shardIdx)
+	if err != nil {
+		return 0, err
+	}
+	evictions := computeEvictionsByApp(appRowCounts, rowsToRemove)
+	for i, appName := range appNames {
+		if evictions[i] == 0 {
+			// The applications are sorted by decreasing row count, so no
+			// other application has rows to evict.
+			break
+		}
+		rowsRemoved, err := c.removeOldestRowsForShard(
+			ctx, ops, shardIdx, evictions[i],
+			predicates+"\n        AND s.app_name = "+lexbase.EscapeSQLString(appName),
+		)
+		totalRowsRemoved += rowsRemoved
+		if err != nil {
+			return totalRowsRemoved, err
+		}
+	}
+	return totalRowsRemoved, nil
+}
+
+// getAppRowCountsForShard returns the names of the applications with rows in
+// the given hash bucket that can be removed, i.e. that are older than the
+// grace cutoff, along with their number of such rows, by decreasing row count.
+func (c *StatsCompactor) getAppRowCountsForShard(
+	ctx context.Context, ops *cleanupOperations, shardIdx int64,
+) (appNames []string, rowCounts []int64, _ error) {
+	graceCutoff, err := tree.MakeDTimestampTZ(c.getGraceCutoff(), time.Microsecond)
+	if err != nil {
+		return nil, nil, err
+	}
+	rows, err := c.db.Executor().QueryBufferedEx(ctx,
+		"scan-app-row-count",
+		nil, /* txn */
+		sessiondata.NodeUserSessionDataOverride,
+		ops.getAppRowCountStmt(c.getAOSTClause()),
+		shardIdx,
+		graceCutoff,
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, row := range rows {
+		if len(row) != 2 {
+			return nil, nil, errors.AssertionFailedf("unexpected number of column returned")
+		}
+		appNames = append(appNames, string(tree.MustBeDString(row[0])))
+		rowCounts = append(rowCounts, int64(tree.MustBeDInt(row[1])))
+	}
+	return appNames, rowCounts, nil
+}
+
+// computeEvictionsByApp distributes the removal of rowsToRemove rows among
+// applications with the given row counts, sorted in decreasing order. The
+// rows are always taken from the application with the most remaining rows,
+// so the row counts of the largest applications are leveled down to a common
+// count, and the smaller applications only lose rows once the larger ones are
+// down to their count. The returned slice holds the number of rows to remove
+// from each application.
+func computeEvictionsByApp(rowCounts []int64, rowsToRemove int64) []int64 {
+	evictions := make([]int64, len(rowCounts))
+	remaining := rowsToRemove
+	for i := range rowCounts {
+		// Applications 0 to i are down to the count of application i, and
+		// can be further leveled down to the count of the next application.
+		var nextCount int64
+		if i+1 < len(rowCounts) {
+			nextCount = rowCounts[i+1]
+		}
+		leveledApps := int64(i + 1)
+		if capacity := (rowCounts[i] - nextCount) * leveledApps; capacity < remaining {
+			remaining -= capacity
+			continue
+		}
+		level := rowCounts[i] - remaining/leveledApps
+		extra := remaining % leveledApps
+		for j := 0; j <= i; j++ {
+			evictions[j] = rowCounts[j] - level
+			if int64(j) < extra {
+				evictions[j]++
+			}
+		}
+		return evictions
+	}
+	// There are fewer rows than rowsToRemove.
+	copy(evictions, rowCounts)
+	return evictions
+}
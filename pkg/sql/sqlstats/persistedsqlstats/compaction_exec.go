@@ -13,17 +13,28 @@ package persistedsqlstats
 import (
 	"context"
 	"fmt"
+	"math"
+	"sync/atomic"
 	"time"
 
+	"github.com/cockroachdb/cockroach/pkg/clusterversion"
 	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
 	"github.com/cockroachdb/cockroach/pkg/sql/catalog/systemschema"
 	"github.com/cockroachdb/cockroach/pkg/sql/isql"
+	"github.com/cockroachdb/cockroach/pkg/sql/sem/eval"
 	"github.com/cockroachdb/cockroach/pkg/sql/sem/tree"
 	"github.com/cockroachdb/cockroach/pkg/sql/sessiondata"
 	"github.com/cockroachdb/cockroach/pkg/sql/sqlstats"
+	"github.com/cockroachdb/cockroach/pkg/util/ctxgroup"
+	"github.com/cockroachdb/cockroach/pkg/util/json"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
 	"github.com/cockroachdb/cockroach/pkg/util/metric"
+	"github.com/cockroachdb/cockroach/pkg/util/quotapool"
+	"github.com/cockroachdb/cockroach/pkg/util/stop"
+	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
 	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
 	"github.com/cockroachdb/errors"
+	"github.com/cockroachdb/logtags"
 )
 
 // StatsCompactor is responsible for compacting older SQL Stats. It is
@@ -32,83 +43,1005 @@ type StatsCompactor struct {
 	st *cluster.Settings
 	db isql.DB
 
-	rowsRemovedCounter *metric.Counter
+	metrics CompactorMetrics
 
 	knobs *sqlstats.TestingKnobs
 
-	scratch struct {
-		qargs []interface{}
+	// budget tracks the rows removed by a run of DeleteOldestEntriesWithReport
+	// against sql.stats.cleanup.max_rows_per_run. It is shared by the hash
+	// buckets processed concurrently, see forEachShard. The budget of the run
+	// is split between the stats tables, see allocateTableRowBudget.
+	budget struct {
+		syncutil.Mutex
+		// runRemaining is the number of rows that the run can still remove
+		// across the tables. It is negative if the run is not limited.
+		runRemaining int64
+		// remaining is the number of rows that the run can still remove from
+		// the current table. It is negative if the run is not limited.
+		remaining int64
+		// exhausted is set when the removal from the current table stopped
+		// because the budget ran out.
+		exhausted bool
 	}
+
+	// deleteRateLimiter paces the deletions of a run of
+	// DeleteOldestEntriesWithReport according to
+	// sql.stats.cleanup.delete_rate_limit. It is shared by the hash buckets
+	// processed concurrently, so that the limit applies to the whole run.
+	deleteRateLimiter *quotapool.RateLimiter
+	// throttleWaitNanos is the time spent waiting for deleteRateLimiter,
+	// updated atomically. The ThrottleWait metric counts whole seconds, so the
+	// fraction of a second left by a wait is carried over to the next one.
+	throttleWaitNanos int64
+
+	// readOpts configures the scans of the stats tables, see SetReadOptions.
+	readOpts eval.SQLStatsReadOptions
+
+	// protectedSince, if set, is the earliest aggregated_ts protected by the
+	// active protections of the stats, as loaded at the start of the current
+	// run, see loadStatsProtections.
+	protectedSince *time.Time
+
+	// checkpoint tracks the hash buckets brought under the row cap, see
+	// SetCheckpoint.
+	checkpoint compactionCheckpointer
+
+	// cleanupWindow tracks the cleanup window of the runs, see
+	// WaitForCleanupWindow.
+	cleanupWindow struct {
+		// enforced is set once WaitForCleanupWindow was called.
+		enforced bool
+		// closed is set atomically once the current run noticed that the
+		// window closed.
+		closed int32
+	}
+
+	// protectedFingerprints holds the fingerprints protected by the current
+	// run, see getProtectedPredicate.
+	protectedFingerprints *tree.DArray
+
+	// skippedRows counts the rows of each hash bucket of each table that the
+	// current run could not delete, see removeOldestRowsIndividually.
+	skippedRows struct {
+		syncutil.Mutex
+		byTable map[string][]int64
+	}
+
+	// rowCapReports holds the rowCapReport of each table compacted by the
+	// current run, see verifyRowCap.
+	rowCapReports map[string]*rowCapReport
+
+	// oldestAggTs is the aggregated_ts of the oldest row of the tables
+	// compacted by the current run, see recordOldestRowAge.
+	oldestAggTs time.Time
+
+	// stopper runs the enqueuing of the ranges of the compacted tables for
+	// MVCC GC as asynchronous tasks, see SetStopper.
+	stopper *stop.Stopper
+}
+
+// gcHintTimeout bounds the enqueuing of the ranges of a table for MVCC GC,
+// see maybeEnqueueForGC.
+const gcHintTimeout = time.Minute
+
+// gcHintsInFlight holds the tables whose ranges are being enqueued for MVCC GC,
+// so that the hints of successive runs do not pile up.
+var gcHintsInFlight struct {
+	syncutil.Mutex
+	tables map[string]struct{}
+}
+
+// startGCHint marks the ranges of the table as being enqueued for MVCC GC. It
+// returns false if they already are.
+func startGCHint(table string) bool {
+	gcHintsInFlight.Lock()
+	defer gcHintsInFlight.Unlock()
+	if _, ok := gcHintsInFlight.tables[table]; ok {
+		return false
+	}
+	if gcHintsInFlight.tables == nil {
+		gcHintsInFlight.tables = make(map[string]struct{}, 2)
+	}
+	gcHintsInFlight.tables[table] = struct{}{}
+	return true
+}
+
+// finishGCHint marks the ranges of the table as no longer being enqueued for
+// MVCC GC.
+func finishGCHint(table string) {
+	gcHintsInFlight.Lock()
+	defer gcHintsInFlight.Unlock()
+	delete(gcHintsInFlight.tables, table)
+}
+
+// CompactorMetrics contains the metrics updated by the StatsCompactor.
+type CompactorMetrics struct {
+	// RowsRemoved counts the number of stale rows removed.
+	RowsRemoved *metric.Counter
+	// TxnRetries counts the number of times a transaction deleting stale rows
+	// was retried, e.g. due to contention with the flush. It may be nil.
+	TxnRetries *metric.Counter
+	// SkippedRows counts the number of stale rows that could not be deleted,
+	// see removeOldestRowsIndividually. It may be nil.
+	SkippedRows *metric.Counter
+	// ThrottleWait counts the time, in seconds, spent waiting for
+	// sql.stats.cleanup.delete_rate_limit. It may be nil.
+	ThrottleWait *metric.Counter
+	// SanityThresholdExceeded counts the compaction runs that removed more
+	// than sql.stats.cleanup.sanity_fraction of the rows of a stats table, see
+	// checkDeletionSanity. It may be nil.
+	SanityThresholdExceeded *metric.Counter
+	// OldestRowAge is set to the age, in seconds, of the oldest row in
+	// system.statement_statistics and system.transaction_statistics, as
+	// observed during the most recent compaction run. It may be nil.
+	OldestRowAge *metric.Gauge
+	// DistinctAppNames is set to the number of distinct application names
+	// across both stats tables, as observed during the most recent compaction
+	// run. It may be nil.
+	DistinctAppNames *metric.Gauge
 }
 
 // NewStatsCompactor returns a new instance of StatsCompactor.
 func NewStatsCompactor(
-	setting *cluster.Settings,
-	db isql.DB,
-	rowsRemovedCounter *metric.Counter,
-	knobs *sqlstats.TestingKnobs,
+	setting *cluster.Settings, db isql.DB, metrics CompactorMetrics, knobs *sqlstats.TestingKnobs,
 ) *StatsCompactor {
 	return &StatsCompactor{
-		st:                 setting,
-		db:                 db,
-		rowsRemovedCounter: rowsRemovedCounter,
-		knobs:              knobs,
+		st:                setting,
+		db:                db,
+		metrics:           metrics,
+		knobs:             knobs,
+		deleteRateLimiter: quotapool.NewRateLimiter("sql-stats-compaction", quotapool.Inf(), 0),
 	}
 }
 
+// SetStopper makes the compactor enqueue the ranges of the tables it compacted
+// for MVCC GC as asynchronous tasks of the given stopper, see
+// maybeEnqueueForGC. Without a stopper, the ranges are not enqueued.
+func (c *StatsCompactor) SetStopper(stopper *stop.Stopper) {
+	c.stopper = stopper
+}
+
+// SetReadOptions configures the scans of the stats tables run by the
+// compactor, e.g. by DiffPolicies. The removals are not affected.
+func (c *StatsCompactor) SetReadOptions(opts eval.SQLStatsReadOptions) {
+	c.readOpts = opts
+}
+
+// getAOSTClause returns the AS OF SYSTEM TIME clause of the scans of the stats
+// tables, see getReadAOSTClause.
+func (c *StatsCompactor) getAOSTClause() string {
+	return getReadAOSTClause(c.knobs, c.readOpts)
+}
+
+// getReadAOSTClause returns the AS OF SYSTEM TIME clause of the scans of the
+// stats tables under the given read options. The scans are follower reads
+// unless opts.BoundedStaleness is set, in which case they read the tables as
+// of opts.MaxStaleness ago, or their current data if it is below a
+// microsecond. The reads
+// use an exact staleness equal to the bound rather than with_max_staleness(),
+// which is limited to single-row lookups.
+func getReadAOSTClause(knobs *sqlstats.TestingKnobs, opts eval.SQLStatsReadOptions) string {
+	if !opts.BoundedStaleness {
+		return knobs.GetAOSTClause()
+	}
+	if opts.MaxStaleness < time.Microsecond {
+		return ""
+	}
+	return fmt.Sprintf("AS OF SYSTEM TIME '-%dus'", opts.MaxStaleness.Microseconds())
+}
+
 // DeleteOldestEntries removes the oldest statement and transaction statistics
 // that exceeded the limit defined by `sql.stats.persisted_rows.max`
-// (persistedsqlstats.SQLStatsMaxPersistedRows).
+// (persistedsqlstats.SQLStatsMaxPersistedRows), as well as the ones older than
+// `sql.stats.persisted_rows.max_age`
+// (persistedsqlstats.SQLStatsMaxPersistedRowsAge). The other settings applied
+// by a run are described by compact and compactionPolicy.
 func (c *StatsCompactor) DeleteOldestEntries(ctx context.Context) error {
-	if err := c.removeStaleRowsPerShard(
-		ctx,
-		stmtStatsCleanupOps,
-	); err != nil {
-		return err
+	_, err := c.DeleteOldestEntriesWithReport(ctx)
+	return err
+}
+
+// DeleteOldestEntriesWithReport is like DeleteOldestEntries, but also returns
+// the number of rows removed from each stats table by the retention policy,
+// and whether rows may remain to be removed from the table because the run
+// reached sql.stats.cleanup.max_rows_per_run. The rows merged by
+// coalesceWindows are not included.
+//
+// The number of rows of each stats table before and after the run is logged.
+// It is derived from the row counts used to plan the removal, so no extra scan
+// is needed, and it does not account for the rows merged by coalesceWindows.
+//
+// If `sql.stats.cleanup.verify` is set, the run then checks that the tables
+// are under the row cap, see verifyRowCap.
+func (c *StatsCompactor) DeleteOldestEntriesWithReport(
+	ctx context.Context,
+) ([]eval.SQLStatsCompactionResult, error) {
+	results, err := c.compact(ctx)
+	if err != nil || !SQLStatsCleanupVerify.Get(&c.st.SV) {
+		return results, err
 	}
+	return c.verifyRowCap(ctx, results)
+}
 
-	return c.removeStaleRowsPerShard(
-		ctx,
-		txnStatsCleanupOps,
-	)
+// compact runs the removals of DeleteOldestEntriesWithReport once. The rows
+// are first merged by coalesceWindows and rollupWindows, if enabled, then
+// removed under the policy returned by getCompactionPolicy.
+func (c *StatsCompactor) compact(ctx context.Context) ([]eval.SQLStatsCompactionResult, error) {
+	if err := c.loadStatsProtections(ctx); err != nil {
+		return nil, err
+	}
+	defer func() { c.protectedSince = nil }()
+	c.resetSkippedRows()
+	c.rowCapReports = make(map[string]*rowCapReport, 2)
+	c.oldestAggTs = time.Time{}
+	// The rows merged by coalesceWindows and rollupWindows are also paced by
+	// sql.stats.cleanup.delete_rate_limit.
+	c.updateDeleteRateLimit()
+
+	if SQLStatsCleanupCoalesceWindowsEnabled.Get(&c.st.SV) {
+		for _, ops := range []*cleanupOperations{stmtStatsCleanupOps, txnStatsCleanupOps} {
+			if err := c.coalesceWindows(ctx, ops); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if SQLStatsCleanupRollupEnabled.Get(&c.st.SV) {
+		for _, ops := range []*cleanupOperations{stmtStatsCleanupOps, txnStatsCleanupOps} {
+			if err := c.rollupWindows(ctx, ops); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	policy, err := c.getCompactionPolicy(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	c.resetRowBudget()
+
+	results := make([]eval.SQLStatsCompactionResult, 0, len(policy.tables))
+	appNames := make(map[string]struct{})
+	for i, table := range policy.tables {
+		result := eval.SQLStatsCompactionResult{Table: table.ops.table}
+		c.allocateTableRowBudget(int64(len(policy.tables) - i))
+		c.setRowBudgetExhausted(false)
+		removals, err := c.getAgeRemovals(&policy, table)
+		if err != nil {
+			return nil, err
+		}
+		var ageRowsRemoved int64
+		for _, removal := range removals {
+			rowsRemoved, err := c.removeExpiredRowsPerShard(
+				ctx,
+				table.ops.getExpiredDeleteStmt(removal.getPredicates(table.ops, &policy, "$3")),
+				removal.cutoff,
+			)
+			ageRowsRemoved += rowsRemoved
+			if err != nil {
+				return nil, err
+			}
+		}
+		rowCount, rowsRemoved, err := c.removeStaleRowsPerShard(ctx, &policy, table, appNames)
+		if err != nil {
+			return nil, err
+		}
+		result.Rows = ageRowsRemoved + rowsRemoved
+		// The row count is the one used to plan the removal of the stale rows,
+		// so the rows removed based on their age separately are added back
+		// rather than counted again.
+		rowCountBefore := rowCount + ageRowsRemoved
+		log.Infof(ctx, "compaction of %s: %d rows before, %d rows after",
+			table.ops.table, rowCountBefore, rowCountBefore-result.Rows)
+		c.checkDeletionSanity(ctx, table.ops.table, rowCountBefore, result.Rows)
+		result.BudgetExhausted = c.isRowBudgetExhausted()
+		if result.BudgetExhausted {
+			log.Infof(ctx, "removed %d rows from %s, reached %s; the remaining rows "+
+				"are deferred to the next run", result.Rows, table.ops.table,
+				SQLStatsCleanupMaxRowsPerRun.Key())
+		}
+		results = append(results, result)
+	}
+	c.recordOldestRowAge()
+	if c.metrics.DistinctAppNames != nil {
+		c.metrics.DistinctAppNames.Update(int64(len(appNames)))
+	}
+	return results, nil
 }
 
-func (c *StatsCompactor) removeStaleRowsPerShard(
-	ctx context.Context, ops *cleanupOperations,
-) error {
-	rowLimitPerShard := c.getRowLimitPerShard()
-	for shardIdx, rowLimit := range rowLimitPerShard {
-		var existingRowCount int64
+// compactionPolicy is the retention policy enforced by a compaction run, as
+// derived from the cluster settings at the start of the run, see
+// getCompactionPolicy.
+type compactionPolicy struct {
+	// maxPersistedRows is the row cap of each table, see getRetentionPolicy.
+	maxPersistedRows int64
+	// ageCutoff is the aggregated_ts before which the rows are expired, see
+	// getAgeCutoff.
+	ageCutoff *tree.DTimestampTZ
+	// staleAgeCutoff is the age cutoff enforced along with the row cap by
+	// removeStaleRowsPerShard. It precedes all the rows if the expired rows
+	// are removed separately.
+	staleAgeCutoff *tree.DTimestampTZ
+
+	// retainRecentlyExecuted is set if the age limit only applies to the
+	// fingerprints that were not executed within the maximum age, see
+	// sql.stats.cleanup.retain_recently_executed.enabled.
+	retainRecentlyExecuted bool
+	withLastExecutionTs    bool
+	// retainLatest is set if the most recent aggregation window of each
+	// fingerprint is never removed, see
+	// sql.stats.cleanup.retain_latest_per_fingerprint.
+	retainLatest bool
+	// evictLargestAppFirst is set if the row cap is enforced on the
+	// applications with the most rows first, see
+	// sql.stats.cleanup.eviction_order.
+	evictLargestAppFirst bool
+	// removeExpiredSeparately is set if the expired rows are removed by
+	// removeExpiredRowsPerShard rather than along with the row cap, see
+	// getAgeRemovals.
+	removeExpiredSeparately bool
+
+	// tables are the stats tables to compact, in order.
+	tables []compactionTable
+}
+
+// compactionTable is a stats table compacted by a run, along with the
+// predicates excluding rows from its removals, see getPinnedPredicate and
+// getProtectedPredicate.
+type compactionTable struct {
+	ops                *cleanupOperations
+	pinnedPredicate    string
+	protectedPredicate string
+}
+
+// getCompactionPolicy returns the retention policy of a run.
+func (c *StatsCompactor) getCompactionPolicy(ctx context.Context) (compactionPolicy, error) {
+	var p compactionPolicy
+	var maxAge time.Duration
+	p.maxPersistedRows, maxAge = c.getRetentionPolicy(ctx)
+	var err error
+	if p.ageCutoff, err = c.getAgeCutoff(maxAge); err != nil {
+		return p, err
+	}
+
+	protectedPredicate, err := c.getProtectedPredicate(ctx)
+	if err != nil {
+		return p, err
+	}
+	stmtPinnedPredicate, err := c.getPinnedPredicate(ctx, stmtStatsCleanupOps)
+	if err != nil {
+		return p, err
+	}
+	txnPinnedPredicate, err := c.getPinnedPredicate(ctx, txnStatsCleanupOps)
+	if err != nil {
+		return p, err
+	}
+	p.tables = []compactionTable{
+		{
+			ops:                stmtStatsCleanupOps,
+			pinnedPredicate:    stmtPinnedPredicate,
+			protectedPredicate: protectedPredicate,
+		},
+		{
+			ops:             txnStatsCleanupOps,
+			pinnedPredicate: txnPinnedPredicate,
+		},
+	}
+
+	// When some of the expired rows are retained, or when some fingerprints
+	// are protected from the row cap only, or when the row cap does not evict
+	// the oldest rows first, or when the rows of some applications are pinned,
+	// the rows are removed based on their
+	// age separately, and removeStaleRowsPerShard only enforces the row cap.
+	p.retainRecentlyExecuted = maxAge > 0 && SQLStatsCleanupRetainRecentlyExecuted.Get(&c.st.SV)
+	p.withLastExecutionTs = c.hasLastExecutionTs(ctx)
+	p.retainLatest = SQLStatsCleanupRetainLatestPerFingerprint.Get(&c.st.SV)
+	p.evictLargestAppFirst =
+		evictionOrder(SQLStatsCleanupEvictionOrder.Get(&c.st.SV)) == evictionOrderLargestApp
+	p.removeExpiredSeparately = maxAge > 0 && (p.retainRecentlyExecuted || p.retainLatest ||
+		protectedPredicate != "" || p.evictLargestAppFirst ||
+		stmtPinnedPredicate != "" || txnPinnedPredicate != "")
+	p.staleAgeCutoff = p.ageCutoff
+	if p.removeExpiredSeparately {
+		if p.staleAgeCutoff, err = c.getAgeCutoff(0 /* maxAge */); err != nil {
+			return p, err
+		}
+	}
+	return p, nil
+}
+
+// ageRemoval is a removal of the rows of a table that are older than cutoff,
+// see getAgeRemovals.
+type ageRemoval struct {
+	cutoff                 *tree.DTimestampTZ
+	retainRecentlyExecuted bool
+	// predicate excludes rows from the removal, e.g. the rows of the pinned
+	// applications, or restricts it, e.g. to the rows of an application with
+	// a ttl.
+	predicate string
+}
+
+// getAgeRemovals returns the removals of the rows of the given table based on
+// their age, in the order in which they are run: the removals of the rows of
+// the applications with a ttl (see getAppNameTTLRemovals), then the removal of
+// the expired rows if they are not removed along with the row cap.
+func (c *StatsCompactor) getAgeRemovals(
+	policy *compactionPolicy, table compactionTable,
+) ([]ageRemoval, error) {
+	removals, err := c.getAppNameTTLRemovals(table.pinnedPredicate)
+	if err != nil {
+		return nil, err
+	}
+	if policy.removeExpiredSeparately {
+		removals = append(removals, ageRemoval{
+			cutoff:                 policy.ageCutoff,
+			retainRecentlyExecuted: policy.retainRecentlyExecuted,
+			predicate:              table.pinnedPredicate,
+		})
+	}
+	return removals, nil
+}
+
+// getPredicates returns the predicates of the removal, given the placeholder
+// of its cutoff, see cleanupOperations.getExpiredPredicates.
+func (r ageRemoval) getPredicates(
+	ops *cleanupOperations, policy *compactionPolicy, cutoffPlaceholder string,
+) string {
+	return ops.getExpiredPredicates(cutoffPlaceholder, r.retainRecentlyExecuted,
+		policy.withLastExecutionTs, policy.retainLatest, r.predicate)
+}
+
+// checkDeletionSanity logs a warning and increments the
+// SanityThresholdExceeded metric if a run removed more than
+// sql.stats.cleanup.sanity_fraction of the rowCountBefore rows of the given
+// table. Such a run usually follows a change of the retention policy, e.g. a
+// lower sql.stats.persisted_rows.max, but may also be the sign of a
+// misconfiguration, so it is flagged rather than stopped.
+func (c *StatsCompactor) checkDeletionSanity(
+	ctx context.Context, table string, rowCountBefore, rowsRemoved int64,
+) {
+	sanityFraction := SQLStatsCleanupSanityFraction.Get(&c.st.SV)
+	if sanityFraction == 0 || rowCountBefore == 0 ||
+		float64(rowsRemoved) <= sanityFraction*float64(rowCountBefore) {
+		return
+	}
+	if c.metrics.SanityThresholdExceeded != nil {
+		c.metrics.SanityThresholdExceeded.Inc(1)
+	}
+	log.Warningf(ctx, "the SQL stats compaction removed %d of the %d rows (%.0f%%) of %s, "+
+		"more than %s (%.0f%%); check the retention settings, e.g. %s and %s",
+		rowsRemoved, rowCountBefore, 100*float64(rowsRemoved)/float64(rowCountBefore), table,
+		SQLStatsCleanupSanityFraction.Key(), 100*sanityFraction,
+		SQLStatsMaxPersistedRows.Key(), SQLStatsMaxPersistedRowsAge.Key())
+}
+
+// getRetentionPolicy returns the maximum number of rows to keep in each stats
+// table, and the maximum age of the rows. Zero disables the corresponding
+// limit. Disabling both limits would lead to unbounded growth of the tables,
+// so the default row cap is used in that case.
+func (c *StatsCompactor) getRetentionPolicy(
+	ctx context.Context,
+) (maxPersistedRows int64, maxAge time.Duration) {
+	maxPersistedRows = SQLStatsMaxPersistedRows.Get(&c.st.SV)
+	maxAge = SQLStatsMaxPersistedRowsAge.Get(&c.st.SV)
+	if maxPersistedRows == 0 && maxAge == 0 {
+		maxPersistedRows = SQLStatsMaxPersistedRows.Default()
+		log.Warningf(ctx, "both %s and %s are disabled, using a row cap of %d instead",
+			SQLStatsMaxPersistedRows.Key(), SQLStatsMaxPersistedRowsAge.Key(), maxPersistedRows)
+	}
+	return maxPersistedRows, maxAge
+}
+
+// getAgeCutoff returns the aggregated_ts before which rows are older than
+// maxAge. Rows in the grace period are never removed, so the cutoff is never
+// more recent than getGraceCutoff. If maxAge is zero, the returned cutoff
+// precedes all the rows.
+func (c *StatsCompactor) getAgeCutoff(maxAge time.Duration) (*tree.DTimestampTZ, error) {
+	graceCutoff := c.getGraceCutoff()
+	var ageCutoff time.Time
+	if maxAge > 0 {
+		ageCutoff = c.getTimeNow().Add(-maxAge)
+		if ageCutoff.After(graceCutoff) {
+			ageCutoff = graceCutoff
+		}
+	}
+	return tree.MakeDTimestampTZ(ageCutoff, time.Microsecond)
+}
 
+// getGraceCutoff returns the aggregated_ts from which rows are neither
+// removed nor coalesced, see sql.stats.cleanup.window_grace. It is the start
+// of the aggregation window containing now minus the grace period, so the
+// current window is always excluded. During a compaction run, the cutoff
+// does not exceed the earliest aggregated_ts protected by ProtectStats.
+func (c *StatsCompactor) getGraceCutoff() time.Time {
+	aggInterval := SQLStatsAggregationInterval.Get(&c.st.SV)
+	grace := SQLStatsCleanupWindowGrace.Get(&c.st.SV)
+	if grace == 0 {
+		grace = aggInterval
+	}
+	cutoff := c.getTimeNow().Add(-grace).Truncate(aggInterval)
+	if c.protectedSince != nil && c.protectedSince.Before(cutoff) {
+		cutoff = *c.protectedSince
+	}
+	return cutoff
+}
+
+// removeStaleRowsPerShard enforces the row cap of the policy, along with its
+// staleAgeCutoff, on the given table, shard by shard. It returns the number of
+// rows of the table counted to plan the removal, and the number of rows
+// removed.
+func (c *StatsCompactor) removeStaleRowsPerShard(
+	ctx context.Context,
+	policy *compactionPolicy,
+	table compactionTable,
+	appNames map[string]struct{},
+) (totalRowCount, totalRowsRemoved int64, _ error) {
+	ops := table.ops
+	rowLimitPerShard := computeRowLimitPerShard(policy.maxPersistedRows)
+	existingRowCountPerShard := make([]int64, len(rowLimitPerShard))
+	expiredRowCountPerShard := make([]int64, len(rowLimitPerShard))
+	for shardIdx := range rowLimitPerShard {
+		var shardOldestAggTs time.Time
 		if err := c.getRowCountForShard(
 			ctx,
-			ops.getScanStmt(c.knobs),
+			ops.getScanStmt(c.getAOSTClause()),
 			shardIdx,
-			&existingRowCount,
+			policy.staleAgeCutoff,
+			&existingRowCountPerShard[shardIdx],
+			&expiredRowCountPerShard[shardIdx],
+			&shardOldestAggTs,
+			appNames,
 		); err != nil {
-			return err
+			return 0, 0, err
+		}
+		totalRowCount += existingRowCountPerShard[shardIdx]
+		if !shardOldestAggTs.IsZero() && (c.oldestAggTs.IsZero() || shardOldestAggTs.Before(c.oldestAggTs)) {
+			c.oldestAggTs = shardOldestAggTs
 		}
+	}
+
+	maxRowsToRemovePerShard := c.getCatchUpRowLimitPerShard(ctx, ops, totalRowCount, policy.maxPersistedRows)
 
+	rowsRemovedPerShard := make([]int64, len(rowLimitPerShard))
+	err := c.forEachShard(ctx, func(ctx context.Context, shardIdx int64) (err error) {
+		if c.isBucketCheckpointed(ops.table, shardIdx) {
+			return nil
+		}
+		existingRowCount, rowLimit := existingRowCountPerShard[shardIdx], rowLimitPerShard[shardIdx]
 		if c.knobs != nil && c.knobs.OnCleanupStartForShard != nil {
-			c.knobs.OnCleanupStartForShard(shardIdx, existingRowCount, rowLimit)
+			c.knobs.OnCleanupStartForShard(int(shardIdx), existingRowCount, rowLimit)
 		}
 
-		if err := c.removeStaleRowsForShard(
-			ctx,
-			ops,
-			int64(shardIdx),
-			existingRowCount,
-			rowLimit,
+		rowsToRemove := computeRowsToRemoveForShard(
+			existingRowCount, expiredRowCountPerShard[shardIdx], rowLimit, maxRowsToRemovePerShard,
+		)
+		rowsRemovedPerShard[shardIdx], err = c.removeStaleRowsForShard(
+			ctx, policy, table, shardIdx, rowsToRemove,
+		)
+		// A bucket whose removal was cut short by the budget of the run or
+		// by the cleanup window is compacted again when the run resumes.
+		if err == nil && !c.isRowBudgetExhausted() && !c.cleanupWindowClosed(ctx) {
+			c.checkpointBucket(ctx, ops.table, shardIdx)
+		}
+		return err
+	})
+	for _, rowsRemoved := range rowsRemovedPerShard {
+		totalRowsRemoved += rowsRemoved
+	}
+	if err != nil {
+		return totalRowCount, totalRowsRemoved, err
+	}
+
+	report := &rowCapReport{
+		rowCount:          totalRowCount - totalRowsRemoved,
+		catchUp:           maxRowsToRemovePerShard > 0,
+		remainingPerShard: make(map[int64]int64),
+		policy:            policy,
+		table:             table,
+	}
+	for shardIdx, existingRowCount := range existingRowCountPerShard {
+		remaining := existingRowCount - rowsRemovedPerShard[shardIdx] - rowLimitPerShard[shardIdx]
+		// The rows of the bucket that were not skipped because of an error
+		// no longer match the removal predicates, e.g. they are in the grace
+		// period, pinned or protected, so they would not be removed by another
+		// pass either.
+		if skipped := c.getSkippedRows(ops.table, int64(shardIdx)); remaining > skipped {
+			remaining = skipped
+		}
+		if remaining > 0 {
+			report.remainingPerShard[int64(shardIdx)] = remaining
+		}
+	}
+	c.rowCapReports[ops.table] = report
+
+	c.maybeEnqueueForGC(ctx, ops, totalRowsRemoved)
+	return totalRowCount, totalRowsRemoved, nil
+}
+
+// removeExpiredRowsPerShard deletes the rows older than ageCutoff that are
+// selected by the given statement, see cleanupOperations.getExpiredDeleteStmt.
+// As for removeStaleRowsForShard, the removal is broken into multiple
+// transactions that each delete up to sql.stats.cleanup.rows_to_delete_per_txn
+// rows. It returns the number of rows removed. The removal stops when the
+// budget of the run is exhausted, in which case expired rows may remain.
+func (c *StatsCompactor) removeExpiredRowsPerShard(
+	ctx context.Context, stmt string, ageCutoff *tree.DTimestampTZ,
+) (totalRowsRemoved int64, _ error) {
+	maxDeleteRowsPerTxn := CompactionJobRowsToDeletePerTxn.Get(&c.st.SV)
+	rowsRemovedPerShard := make([]int64, systemschema.SQLStatsHashShardBucketCount)
+	err := c.forEachShard(ctx, func(ctx context.Context, shardIdx int64) error {
+		for {
+			if c.cleanupWindowClosed(ctx) {
+				return nil
+			}
+			limit := c.reserveRowBudget(maxDeleteRowsPerTxn)
+			if limit == 0 {
+				c.setRowBudgetExhausted(true)
+				return nil
+			}
+			_, rowsRemoved, err := c.executeDeleteStmt(ctx, stmt, []interface{}{
+				tree.NewDInt(tree.DInt(shardIdx)),
+				tree.NewDInt(tree.DInt(limit)),
+				ageCutoff,
+			})
+			c.releaseRowBudget(limit - rowsRemoved)
+			if err != nil {
+				return err
+			}
+			c.metrics.RowsRemoved.Inc(rowsRemoved)
+			rowsRemovedPerShard[shardIdx] += rowsRemoved
+			if err := c.waitForDeleteRate(ctx, rowsRemoved); err != nil {
+				return err
+			}
+			if rowsRemoved < limit {
+				return nil
+			}
+		}
+	})
+	for _, rowsRemoved := range rowsRemovedPerShard {
+		totalRowsRemoved += rowsRemoved
+	}
+	return totalRowsRemoved, err
+}
+
+// forEachShard calls fn for each hash bucket of the stats tables. Up to
+// sql.stats.cleanup.delete_parallelism buckets are processed concurrently,
+// each of them in its own transactions. The first error cancels the
+// processing of the remaining buckets, and is returned.
+func (c *StatsCompactor) forEachShard(
+	ctx context.Context, fn func(ctx context.Context, shardIdx int64) error,
+) error {
+	parallelism := SQLStatsCleanupDeleteParallelism.Get(&c.st.SV)
+	if parallelism > systemschema.SQLStatsHashShardBucketCount {
+		parallelism = systemschema.SQLStatsHashShardBucketCount
+	}
+	if parallelism <= 1 {
+		for shardIdx := int64(0); shardIdx < systemschema.SQLStatsHashShardBucketCount; shardIdx++ {
+			if err := fn(ctx, shardIdx); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	var nextShardIdx int64
+	g := ctxgroup.WithContext(ctx)
+	for i := int64(0); i < parallelism; i++ {
+		g.GoCtx(func(ctx context.Context) error {
+			for {
+				shardIdx := atomic.AddInt64(&nextShardIdx, 1) - 1
+				if shardIdx >= systemschema.SQLStatsHashShardBucketCount {
+					return nil
+				}
+				if err := fn(ctx, shardIdx); err != nil {
+					return err
+				}
+			}
+		})
+	}
+	return g.Wait()
+}
+
+// resetRowBudget sets the budget of the run to
+// sql.stats.cleanup.max_rows_per_run.
+func (c *StatsCompactor) resetRowBudget() {
+	c.budget.Lock()
+	defer c.budget.Unlock()
+	c.budget.runRemaining = SQLStatsCleanupMaxRowsPerRun.Get(&c.st.SV)
+	if c.budget.runRemaining == 0 {
+		c.budget.runRemaining = -1
+	}
+	c.budget.remaining = c.budget.runRemaining
+}
+
+// allocateTableRowBudget sets the budget of the next table to its share of the
+// remaining budget of the run, given the number of tables left to compact,
+// including this one. The first table thus cannot use up the budget of the
+// tables compacted after it, which get the rows it did not remove on top of
+// their own share.
+func (c *StatsCompactor) allocateTableRowBudget(tablesLeft int64) {
+	c.budget.Lock()
+	defer c.budget.Unlock()
+	if c.budget.runRemaining < 0 || tablesLeft <= 1 {
+		c.budget.remaining = c.budget.runRemaining
+		return
+	}
+	// Round up so that a non-zero budget is never split into zero shares.
+	c.budget.remaining = (c.budget.runRemaining + tablesLeft - 1) / tablesLeft
+}
+
+// reserveRowBudget deducts up to the given number of rows to remove from the
+// remaining budget of the current table, and returns the number of rows that
+// can be removed. The rows that end up not being removed are returned to the budget
+// with releaseRowBudget, so that the hash buckets processed concurrently
+// never remove more rows than the budget allows.
+func (c *StatsCompactor) reserveRowBudget(rows int64) int64 {
+	c.budget.Lock()
+	defer c.budget.Unlock()
+	if c.budget.remaining < 0 {
+		return rows
+	}
+	if rows > c.budget.remaining {
+		rows = c.budget.remaining
+	}
+	c.budget.remaining -= rows
+	c.budget.runRemaining -= rows
+	return rows
+}
+
+// releaseRowBudget returns rows reserved with reserveRowBudget that were not
+// removed to the budget of the run.
+func (c *StatsCompactor) releaseRowBudget(rows int64) {
+	c.budget.Lock()
+	defer c.budget.Unlock()
+	if c.budget.remaining >= 0 && rows > 0 {
+		c.budget.remaining += rows
+		c.budget.runRemaining += rows
+	}
+}
+
+// resetSkippedRows clears the counts of the rows that could not be deleted,
+// at the start of a run.
+func (c *StatsCompactor) resetSkippedRows() {
+	c.skippedRows.Lock()
+	defer c.skippedRows.Unlock()
+	c.skippedRows.byTable = make(map[string][]int64, 2)
+}
+
+// addSkippedRows records that the given number of rows of the given hash
+// bucket of the table could not be deleted by the current run.
+func (c *StatsCompactor) addSkippedRows(table string, shardIdx, rows int64) {
+	c.skippedRows.Lock()
+	defer c.skippedRows.Unlock()
+	if c.skippedRows.byTable == nil {
+		c.skippedRows.byTable = make(map[string][]int64, 2)
+	}
+	perShard, ok := c.skippedRows.byTable[table]
+	if !ok {
+		perShard = make([]int64, systemschema.SQLStatsHashShardBucketCount)
+		c.skippedRows.byTable[table] = perShard
+	}
+	perShard[shardIdx] += rows
+}
+
+// getSkippedRows returns the number of rows of the given hash bucket of the
+// table that could not be deleted by the current run.
+func (c *StatsCompactor) getSkippedRows(table string, shardIdx int64) int64 {
+	c.skippedRows.Lock()
+	defer c.skippedRows.Unlock()
+	if perShard, ok := c.skippedRows.byTable[table]; ok {
+		return perShard[shardIdx]
+	}
+	return 0
+}
+
+func (c *StatsCompactor) setRowBudgetExhausted(exhausted bool) {
+	c.budget.Lock()
+	defer c.budget.Unlock()
+	c.budget.exhausted = exhausted
+}
+
+func (c *StatsCompactor) isRowBudgetExhausted() bool {
+	c.budget.Lock()
+	defer c.budget.Unlock()
+	return c.budget.exhausted
+}
+
+// updateDeleteRateLimit applies sql.stats.cleanup.delete_rate_limit to the
+// deletions of the run. The token bucket holds up to one second worth of rows.
+func (c *StatsCompactor) updateDeleteRateLimit() {
+	if rate := SQLStatsCleanupDeleteRateLimit.Get(&c.st.SV); rate > 0 {
+		c.deleteRateLimiter.UpdateLimit(quotapool.Limit(rate), rate)
+	} else {
+		c.deleteRateLimiter.UpdateLimit(quotapool.Inf(), 0)
+	}
+}
+
+// waitForDeleteRate accounts for the rows removed by a deletion against
+// sql.stats.cleanup.delete_rate_limit, and waits until the rate of the
+// deletions of the run is back under the limit. A deletion larger than the
+// token bucket puts it in debt, so the next deletion waits longer. The time
+// spent waiting is counted in the ThrottleWait metric.
+func (c *StatsCompactor) waitForDeleteRate(ctx context.Context, rowsRemoved int64) error {
+	start := timeutil.Now()
+	err := c.deleteRateLimiter.WaitN(ctx, rowsRemoved)
+	if c.metrics.ThrottleWait != nil {
+		waited := timeutil.Since(start).Nanoseconds()
+		total := atomic.AddInt64(&c.throttleWaitNanos, waited)
+		// Only count the seconds completed by this wait.
+		c.metrics.ThrottleWait.Inc(total/int64(time.Second) - (total-waited)/int64(time.Second))
+	}
+	return err
+}
+
+// maybeEnqueueForGC enqueues the ranges of the table into the MVCC GC queue
+// if the compaction removed at least sql.stats.cleanup.gc_hint.threshold rows
+// from it, and sql.stats.cleanup.gc_hint.enabled is set. Only the ranges with
+// a replica on this node can be enqueued, and the removed rows are only
+// collected once they are older than the GC TTL of the table.
+//
+// The hint is an optimization, so it is best-effort: the ranges are enqueued
+// by an asynchronous task of the stopper set with SetStopper, so that the run
+// does not wait for them, and errors are logged and otherwise ignored. The
+// hint is skipped if there is no stopper, or if the ranges of the table are
+// still being enqueued by a previous run.
+func (c *StatsCompactor) maybeEnqueueForGC(
+	ctx context.Context, ops *cleanupOperations, rowsRemoved int64,
+) {
+	if !SQLStatsCleanupGCHintEnabled.Get(&c.st.SV) ||
+		rowsRemoved < SQLStatsCleanupGCHintThreshold.Get(&c.st.SV) {
+		return
+	}
+	if c.stopper == nil {
+		log.VEventf(ctx, 2, "not enqueuing the ranges of %s for MVCC GC: no stopper", ops.table)
+		return
+	}
+	if !startGCHint(ops.table) {
+		log.VEventf(ctx, 2, "not enqueuing the ranges of %s for MVCC GC: "+
+			"the ranges of a previous run are still being enqueued", ops.table)
+		return
+	}
+	// The task outlives the run, so it does not inherit its cancellation.
+	taskCtx := logtags.AddTags(context.Background(), logtags.FromContext(ctx))
+	if err := c.stopper.RunAsyncTask(taskCtx, "sql-stats-enqueue-for-gc", func(ctx context.Context) {
+		defer finishGCHint(ops.table)
+		ctx, cancel := c.stopper.WithCancelOnQuiesce(ctx)
+		defer cancel()
+		ctx, cancelTimeout := context.WithTimeout(ctx, gcHintTimeout)
+		defer cancelTimeout()
+		c.enqueueForGC(ctx, ops, rowsRemoved)
+	}); err != nil {
+		finishGCHint(ops.table)
+		log.VEventf(ctx, 2, "not enqueuing the ranges of %s for MVCC GC: %v", ops.table, err)
+	}
+}
+
+// enqueueForGC enqueues the ranges of the table into the MVCC GC queue, see
+// maybeEnqueueForGC.
+func (c *StatsCompactor) enqueueForGC(
+	ctx context.Context, ops *cleanupOperations, rowsRemoved int64,
+) {
+	rangeIDs, err := c.getRangeIDs(ctx, ops)
+	if err != nil {
+		log.Warningf(ctx, "unable to look up the ranges of %s for MVCC GC: %v", ops.table, err)
+		return
+	}
+	var enqueued int
+	for _, rangeID := range rangeIDs {
+		if _, err := c.db.Executor().ExecEx(ctx,
+			"sql-stats-enqueue-for-gc",
+			nil, /* txn */
+			sessiondata.NodeUserSessionDataOverride,
+			`SELECT crdb_internal.kv_enqueue_replica($1, 'mvccGC', true /* skip_should_queue */)`,
+			rangeID,
 		); err != nil {
-			return err
+			// The range has no replica on this node, or the stores cannot be
+			// accessed (e.g. from a secondary tenant).
+			log.VEventf(ctx, 2, "unable to enqueue range %d of %s for MVCC GC: %v", rangeID, ops.table, err)
+			continue
 		}
+		enqueued++
 	}
+	log.Infof(ctx, "removed %d rows from %s, enqueued %d out of %d ranges for MVCC GC",
+		rowsRemoved, ops.table, enqueued, len(rangeIDs))
+}
 
-	return nil
+// getRangeIDs returns the IDs of the ranges of the table.
+func (c *StatsCompactor) getRangeIDs(
+	ctx context.Context, ops *cleanupOperations,
+) (rangeIDs []int64, retErr error) {
+	it, err := c.db.Executor().QueryIteratorEx(ctx,
+		"sql-stats-table-ranges",
+		nil, /* txn */
+		sessiondata.NodeUserSessionDataOverride,
+		fmt.Sprintf("SELECT range_id FROM [SHOW RANGES FROM TABLE %s]", ops.table),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		retErr = errors.CombineErrors(retErr, it.Close())
+	}()
+
+	var ok bool
+	for ok, err = it.Next(ctx); ok; ok, err = it.Next(ctx) {
+		rangeIDs = append(rangeIDs, int64(tree.MustBeDInt(it.Cur()[0])))
+	}
+	return rangeIDs, err
 }
 
+// getCatchUpRowLimitPerShard returns the maximum number of rows that can be
+// removed from each hash bucket of the table during this run. If catch-up
+// mode is disabled, if the row cap is disabled, or if the table does not have
+// a large backlog of rows, zero is returned, which indicates that there is no
+// limit.
+//
+// In catch-up mode, the per-run budget defined by
+// sql.stats.cleanup.catchup.rows_per_run is evenly distributed across all
+// hash buckets so that every bucket makes progress on each run.
+func (c *StatsCompactor) getCatchUpRowLimitPerShard(
+	ctx context.Context, ops *cleanupOperations, totalRowCount, maxPersistedRows int64,
+) int64 {
+	rowLimitPerShard := c.computeCatchUpRowLimitPerShard(totalRowCount, maxPersistedRows)
+	if rowLimitPerShard > 0 {
+		log.Infof(ctx, "%s has a compaction backlog (%d rows, limit %d), "+
+			"compacting in catch-up mode with up to %d rows removed in this run",
+			ops.table, totalRowCount, maxPersistedRows, SQLStatsCleanupCatchUpRowsPerRun.Get(&c.st.SV))
+	}
+	return rowLimitPerShard
+}
+
+// computeCatchUpRowLimitPerShard is like getCatchUpRowLimitPerShard, without
+// logging.
+func (c *StatsCompactor) computeCatchUpRowLimitPerShard(totalRowCount, maxPersistedRows int64) int64 {
+	if !SQLStatsCleanupCatchUpEnabled.Get(&c.st.SV) || maxPersistedRows == 0 {
+		return 0
+	}
+	backlogThreshold := SQLStatsCleanupCatchUpBacklogThreshold.Get(&c.st.SV)
+	if float64(totalRowCount) <= float64(maxPersistedRows)*backlogThreshold {
+		return 0
+	}
+
+	// Round up so that we never end up with a zero budget, which would mean
+	// no limit.
+	rowsPerRun := SQLStatsCleanupCatchUpRowsPerRun.Get(&c.st.SV)
+	shardCount := int64(systemschema.SQLStatsHashShardBucketCount)
+	return (rowsPerRun + shardCount - 1) / shardCount
+}
+
+// recordOldestRowAge updates the OldestRowAge gauge with the age of the oldest
+// row in the stats tables, based on the aggregated_ts values sampled while
+// counting the rows of each hash bucket. Empty tables are reported as having
+// an age of zero.
+func (c *StatsCompactor) recordOldestRowAge() {
+	gauge := c.metrics.OldestRowAge
+	if gauge == nil {
+		return
+	}
+	if c.oldestAggTs.IsZero() {
+		gauge.Update(0)
+		return
+	}
+	age := c.getTimeNow().Sub(c.oldestAggTs)
+	if age < 0 {
+		age = 0
+	}
+	gauge.Update(int64(age.Seconds()))
+}
+
+// getRowCountForShard returns the number of rows in the given hash bucket,
+// the number of those rows that are older than ageCutoff, as well as the
+// aggregated_ts of the oldest row in the bucket. oldestAggTs is left untouched
+// if the bucket is empty. The application names of the rows in the bucket
+// are added to appNames.
 func (c *StatsCompactor) getRowCountForShard(
-	ctx context.Context, stmt string, shardIdx int, count *int64,
+	ctx context.Context,
+	stmt string,
+	shardIdx int,
+	ageCutoff *tree.DTimestampTZ,
+	count, expiredCount *int64,
+	oldestAggTs *time.Time,
+	appNames map[string]struct{},
 ) error {
 	row, err := c.db.Executor().QueryRowEx(ctx,
 		"scan-row-count",
@@ -116,29 +1049,46 @@ func (c *StatsCompactor) getRowCountForShard(
 		sessiondata.NodeUserSessionDataOverride,
 		stmt,
 		shardIdx,
+		ageCutoff,
 	)
 	if err != nil {
 		return err
 	}
 
-	if row.Len() != 1 {
+	if row.Len() != 4 {
 		return errors.AssertionFailedf("unexpected number of column returned")
 	}
 	*count = int64(tree.MustBeDInt(row[0]))
+	*expiredCount = int64(tree.MustBeDInt(row[1]))
+	if row[2] != tree.DNull {
+		*oldestAggTs = tree.MustBeDTimestampTZ(row[2]).Time
+	}
+	if row[3] != tree.DNull {
+		for _, appName := range tree.MustBeDArray(row[3]).Array {
+			appNames[string(tree.MustBeDString(appName))] = struct{}{}
+		}
+	}
 
 	return nil
 }
 
-// getRowLimitPerShard calculates the max number of rows we can keep per hash
-// bucket. It calculates using the cluster setting sql.stats.persisted_rows.max.
+// computeRowLimitPerShard distributes maxPersistedRows across hash buckets.
 //
 // It calculates as follows:
-// * quotient, remainder = sql.stats.persisted_rows.max / bucket count
+// * quotient, remainder = maxPersistedRows / bucket count
 // * limitPerShard[0:remainder] = quotient
 // * limitPerShard[remainder:] = quotient + 1
-func (c *StatsCompactor) getRowLimitPerShard() []int64 {
+//
+// A maxPersistedRows of zero means that the row cap is disabled, in which
+// case no bucket has a limit.
+func computeRowLimitPerShard(maxPersistedRows int64) []int64 {
 	limitPerShard := make([]int64, systemschema.SQLStatsHashShardBucketCount)
-	maxPersistedRows := SQLStatsMaxPersistedRows.Get(&c.st.SV)
+	if maxPersistedRows == 0 {
+		for shardIdx := range limitPerShard {
+			limitPerShard[shardIdx] = math.MaxInt64
+		}
+		return limitPerShard
+	}
 
 	for shardIdx := int64(0); shardIdx < systemschema.SQLStatsHashShardBucketCount; shardIdx++ {
 		limitPerShard[shardIdx] = maxPersistedRows / (systemschema.SQLStatsHashShardBucketCount - shardIdx)
@@ -148,123 +1098,378 @@ func (c *StatsCompactor) getRowLimitPerShard() []int64 {
 	return limitPerShard
 }
 
-// removeStaleRowsForShard deletes the oldest rows in the given hash bucket.
-// It breaks the removal operation into multiple smaller transactions where
-// each transaction will delete up to maxDeleteRowsPerTxn rows. This is to
-// avoid having one large transaction.
+// removeStaleRowsForShard deletes up to rowsToRemove of the oldest rows in
+// the given hash bucket of the table, see computeRowsToRemoveForShard. It
+// breaks the removal operation into multiple smaller transactions where each
+// transaction will delete up to maxDeleteRowsPerTxn rows. This is to avoid
+// having one large transaction. If retainLatest is set, the most recent row of
+// each fingerprint is not removed, even if the bucket remains over its limit.
+// If evictLargestAppFirst is set, the rows are first taken from the
+// applications with the most rows, see removeLargestAppRowsForShard. The rows
+// excluded by the pinned predicate of the table are never removed, and the
+// ones excluded by its protected predicate are only removed once no other row
+// can be removed. The removal is also bounded by the budget of the run: the
+// rows to remove are reserved from the budget upfront, and the ones that were
+// not removed are returned to it. The number of rows that were removed is
+// returned.
 func (c *StatsCompactor) removeStaleRowsForShard(
 	ctx context.Context,
-	ops *cleanupOperations,
-	shardIdx int64,
-	existingRowCountPerShard, maxRowLimitPerShard int64,
-) error {
-	var err error
+	policy *compactionPolicy,
+	table compactionTable,
+	shardIdx, rowsToRemove int64,
+) (totalRowsRemoved int64, err error) {
+	ops, protectedPredicate := table.ops, table.protectedPredicate
+	if budgeted := c.reserveRowBudget(rowsToRemove); budgeted < rowsToRemove {
+		c.setRowBudgetExhausted(true)
+		rowsToRemove = budgeted
+	}
+	defer func() {
+		c.releaseRowBudget(rowsToRemove - totalRowsRemoved)
+	}()
+
+	predicates := table.pinnedPredicate
+	if policy.retainLatest {
+		predicates += ops.notLatestWindowPredicate()
+	}
+	if policy.evictLargestAppFirst && rowsToRemove > 0 {
+		totalRowsRemoved, err = c.removeLargestAppRowsForShard(
+			ctx, ops, shardIdx, rowsToRemove, predicates+protectedPredicate,
+		)
+		if err != nil {
+			return totalRowsRemoved, err
+		}
+	}
+	if protectedPredicate != "" {
+		rowsRemoved, err := c.removeOldestRowsForShard(
+			ctx, ops, shardIdx, rowsToRemove-totalRowsRemoved, predicates+protectedPredicate,
+		)
+		totalRowsRemoved += rowsRemoved
+		if err != nil {
+			return totalRowsRemoved, err
+		}
+	}
+	rowsRemoved, err := c.removeOldestRowsForShard(
+		ctx, ops, shardIdx, rowsToRemove-totalRowsRemoved, predicates,
+	)
+	return totalRowsRemoved + rowsRemoved, err
+}
+
+// removeOldestRowsForShard deletes up to rowsToRemove of the oldest rows of
+// the given hash bucket that match the given predicates, see
+// removeStaleRowsForShard.
+func (c *StatsCompactor) removeOldestRowsForShard(
+	ctx context.Context, ops *cleanupOperations, shardIdx, rowsToRemove int64, predicates string,
+) (totalRowsRemoved int64, err error) {
 	var lastDeletedRow tree.Datums
 	var qargs []interface{}
 	maxDeleteRowsPerTxn := CompactionJobRowsToDeletePerTxn.Get(&c.st.SV)
 
-	if rowsToRemove := existingRowCountPerShard - maxRowLimitPerShard; rowsToRemove > 0 {
-		for remainToBeRemoved := rowsToRemove; remainToBeRemoved > 0; {
-			rowsToRemovePerTxn := remainToBeRemoved
-			if remainToBeRemoved > maxDeleteRowsPerTxn {
-				rowsToRemovePerTxn = maxDeleteRowsPerTxn
-			}
+	for remainToBeRemoved := rowsToRemove; remainToBeRemoved > 0; {
+		if c.cleanupWindowClosed(ctx) {
+			break
+		}
+		rowsToRemovePerTxn := remainToBeRemoved
+		if remainToBeRemoved > maxDeleteRowsPerTxn {
+			rowsToRemovePerTxn = maxDeleteRowsPerTxn
+		}
 
-			stmt := ops.getDeleteStmt(lastDeletedRow)
-			qargs, err = c.getQargs(shardIdx, rowsToRemovePerTxn, lastDeletedRow)
-			if err != nil {
-				return err
-			}
+		qargs, err = c.getQargs(qargs, shardIdx, rowsToRemovePerTxn, lastDeletedRow)
+		if err != nil {
+			return totalRowsRemoved, err
+		}
+		var stmt string
+		stmt, qargs = c.bindProtectedFingerprints(ops.getDeleteStmt(lastDeletedRow, predicates), qargs)
 
-			var rowsRemoved int64
+		var rowsRemoved int64
 
-			lastDeletedRow, rowsRemoved, err = c.executeDeleteStmt(
-				ctx,
-				stmt,
-				qargs,
-			)
-			if err != nil {
-				return err
-			}
-			c.rowsRemovedCounter.Inc(rowsToRemovePerTxn)
-
-			// If we removed less rows compared to what we intended, it means something
-			// else is interfering with the cleanup job, likely a human operator.
-			// This can happen when the operator forgot to cancel the job when manual
-			// intervention is happening.
-			if rowsRemoved < rowsToRemovePerTxn {
-				break
+		prevDeletedRow := lastDeletedRow
+		lastDeletedRow, rowsRemoved, err = c.executeDeleteStmt(
+			ctx,
+			stmt,
+			qargs,
+		)
+		if err != nil {
+			if ctx.Err() != nil || !isRowSpecificDeleteError(err) {
+				return totalRowsRemoved, err
 			}
+			// Some of the rows may not be deletable. Rather than failing the
+			// run, the remaining rows of the bucket are removed one at a time,
+			// skipping the ones that cannot be deleted.
+			log.Warningf(ctx, "failed to remove stale rows of %s, removing them one at a time: %v",
+				ops.table, err)
+			rowsRemoved, err = c.removeOldestRowsIndividually(
+				ctx, ops, shardIdx, remainToBeRemoved, predicates, prevDeletedRow,
+			)
+			return totalRowsRemoved + rowsRemoved, err
+		}
+		c.metrics.RowsRemoved.Inc(rowsRemoved)
+		totalRowsRemoved += rowsRemoved
+		if err := c.waitForDeleteRate(ctx, rowsRemoved); err != nil {
+			return totalRowsRemoved, err
+		}
 
-			remainToBeRemoved -= rowsToRemovePerTxn
-
+		// If we removed less rows compared to what we intended, it means something
+		// else is interfering with the cleanup job, likely a human operator.
+		// This can happen when the operator forgot to cancel the job when manual
+		// intervention is happening. With restrictive predicates, it also means
+		// that no other row matches them.
+		if rowsRemoved < rowsToRemovePerTxn {
+			break
 		}
+
+		remainToBeRemoved -= rowsToRemovePerTxn
 	}
 
-	return nil
+	return totalRowsRemoved, nil
+}
+
+// computeRowsToRemoveForShard returns the number of rows that
+// removeStaleRowsForShard attempts to remove from a hash bucket. Rows are
+// removed oldest first, so removing expiredRowCount rows removes exactly the
+// expired rows.
+func computeRowsToRemoveForShard(
+	existingRowCount, expiredRowCount, maxRowLimit, maxRowsToRemove int64,
+) int64 {
+	rowsToRemove := existingRowCount - maxRowLimit
+	if expiredRowCount > rowsToRemove {
+		rowsToRemove = expiredRowCount
+	}
+	if maxRowsToRemove > 0 && rowsToRemove > maxRowsToRemove {
+		rowsToRemove = maxRowsToRemove
+	}
+	if rowsToRemove < 0 {
+		return 0
+	}
+	return rowsToRemove
 }
 
+// executeDeleteStmt runs the given DELETE statement in its own transaction,
+// and returns the last deleted row and the number of deleted rows. Each retry
+// of the transaction is counted in the TxnRetries metric.
 func (c *StatsCompactor) executeDeleteStmt(
 	ctx context.Context, delStmt string, qargs []interface{},
 ) (lastRow tree.Datums, rowsDeleted int64, err error) {
-	it, err := c.db.Executor().QueryIteratorEx(ctx,
-		"delete-old-sql-stats",
-		nil, /* txn */
-		sessiondata.NodeUserSessionDataOverride,
-		delStmt,
-		qargs...,
-	)
-	if err != nil {
-		return nil, 0, err
-	}
-	defer func() {
-		err = errors.CombineErrors(err, it.Close())
-	}()
+	attempts := 0
+	err = c.db.Txn(ctx, func(ctx context.Context, txn isql.Txn) (err error) {
+		attempts++
+		if attempts > 1 && c.metrics.TxnRetries != nil {
+			c.metrics.TxnRetries.Inc(1)
+		}
+		lastRow, rowsDeleted = nil, 0
+		if err := c.beforeDelete(delStmt, qargs); err != nil {
+			return err
+		}
 
-	var ok bool
-	for ok, err = it.Next(ctx); ok; ok, err = it.Next(ctx) {
-		lastRow = it.Cur()
-		rowsDeleted++
-	}
+		it, err := txn.QueryIteratorEx(ctx,
+			"delete-old-sql-stats",
+			txn.KV(),
+			sessiondata.NodeUserSessionDataOverride,
+			delStmt,
+			qargs...,
+		)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			err = errors.CombineErrors(err, it.Close())
+		}()
+
+		var ok bool
+		for ok, err = it.Next(ctx); ok; ok, err = it.Next(ctx) {
+			lastRow = it.Cur()
+			rowsDeleted++
+		}
+		return err
+	})
 
 	return lastRow, rowsDeleted, err
 }
 
+// getQargs returns the arguments of the DELETE statement built by
+// cleanupOperations.getDeleteStmt. The arguments are appended to qargs, which
+// is reused by the successive deletions of a hash bucket.
 func (c *StatsCompactor) getQargs(
-	shardIdx, limit int64, lastDeletedRow tree.Datums,
+	qargs []interface{}, shardIdx, limit int64, lastDeletedRow tree.Datums,
 ) ([]interface{}, error) {
-	size := len(lastDeletedRow) + 2
-	if cap(c.scratch.qargs) < size {
-		c.scratch.qargs = make([]interface{}, 0, size)
+	size := len(lastDeletedRow) + 3
+	if cap(qargs) < size {
+		qargs = make([]interface{}, 0, size)
 	}
-	c.scratch.qargs = c.scratch.qargs[:0]
+	qargs = qargs[:0]
 
-	c.scratch.qargs = append(c.scratch.qargs, tree.NewDInt(tree.DInt(shardIdx)))
-	c.scratch.qargs = append(c.scratch.qargs, tree.NewDInt(tree.DInt(limit)))
+	qargs = append(qargs, tree.NewDInt(tree.DInt(shardIdx)))
+	qargs = append(qargs, tree.NewDInt(tree.DInt(limit)))
 
-	now := timeutil.Now()
-	if c.knobs != nil && c.knobs.StubTimeNow != nil {
-		now = c.knobs.StubTimeNow()
-	}
-	aggInterval := SQLStatsAggregationInterval.Get(&c.st.SV)
-	aggTs := now.Truncate(aggInterval)
-	datum, err := tree.MakeDTimestampTZ(aggTs, time.Microsecond)
+	datum, err := tree.MakeDTimestampTZ(c.getGraceCutoff(), time.Microsecond)
 	if err != nil {
 		return nil, err
 	}
-	c.scratch.qargs = append(c.scratch.qargs, datum)
+	qargs = append(qargs, datum)
 
 	for _, value := range lastDeletedRow {
-		c.scratch.qargs = append(c.scratch.qargs, value)
+		qargs = append(qargs, value)
 	}
 
-	return c.scratch.qargs, nil
+	return qargs, nil
+}
+
+// DiffPolicies estimates, for each persisted stats table, the number of rows
+// that a compaction run would remove under the current retention policy and
+// under a proposed policy that keeps at most proposedMaxRows rows and removes
+// rows older than proposedMaxAge. Zero disables the corresponding limit of the
+// proposed policy, as for the cluster settings defining the current policy.
+// If sql.stats.cleanup.retain_recently_executed.enabled is set, the rows of
+// the fingerprints executed within the age limit of a policy are not counted
+// as expired under it. The estimate does not take catch-up mode into account,
+// nor the retention of the latest window of each fingerprint
+// (sql.stats.cleanup.retain_latest_per_fingerprint).
+//
+// The tables are only read, using a single scan per table.
+func (c *StatsCompactor) DiffPolicies(
+	ctx context.Context, proposedMaxRows int64, proposedMaxAge time.Duration,
+) ([]eval.SQLStatsCompactionPolicyDiff, error) {
+	currentMaxRows, currentMaxAge := c.getRetentionPolicy(ctx)
+	currentAgeCutoff, err := c.getAgeCutoff(currentMaxAge)
+	if err != nil {
+		return nil, err
+	}
+	// As for the current policy, a proposed policy without any limit falls
+	// back to the default row cap.
+	if proposedMaxRows == 0 && proposedMaxAge == 0 {
+		proposedMaxRows = SQLStatsMaxPersistedRows.Default()
+	}
+	proposedAgeCutoff, err := c.getAgeCutoff(proposedMaxAge)
+	if err != nil {
+		return nil, err
+	}
+
+	retainRecentlyExecuted := SQLStatsCleanupRetainRecentlyExecuted.Get(&c.st.SV)
+	diffs := make([]eval.SQLStatsCompactionPolicyDiff, 0, 2)
+	for _, ops := range []*cleanupOperations{stmtStatsCleanupOps, txnStatsCleanupOps} {
+		diff, err := c.diffPoliciesForTable(
+			ctx, ops, currentMaxRows, currentAgeCutoff, proposedMaxRows, proposedAgeCutoff,
+			retainRecentlyExecuted,
+		)
+		if err != nil {
+			return nil, err
+		}
+		diffs = append(diffs, diff)
+	}
+	return diffs, nil
+}
+
+func (c *StatsCompactor) diffPoliciesForTable(
+	ctx context.Context,
+	ops *cleanupOperations,
+	currentMaxRows int64,
+	currentAgeCutoff *tree.DTimestampTZ,
+	proposedMaxRows int64,
+	proposedAgeCutoff *tree.DTimestampTZ,
+	retainRecentlyExecuted bool,
+) (diff eval.SQLStatsCompactionPolicyDiff, retErr error) {
+	diff.Table = ops.table
+
+	// Rows in the grace period are never removed.
+	graceCutoff, err := tree.MakeDTimestampTZ(c.getGraceCutoff(), time.Microsecond)
+	if err != nil {
+		return diff, err
+	}
+
+	it, err := c.db.Executor().QueryIteratorEx(ctx,
+		"sql-stats-compaction-policy-diff",
+		nil, /* txn */
+		sessiondata.NodeUserSessionDataOverride,
+		ops.getPolicyDiffStmt(c.getAOSTClause(), retainRecentlyExecuted, c.hasLastExecutionTs(ctx)),
+		graceCutoff,
+		currentAgeCutoff,
+		proposedAgeCutoff,
+	)
+	if err != nil {
+		return diff, err
+	}
+	defer func() {
+		retErr = errors.CombineErrors(retErr, it.Close())
+	}()
+
+	currentLimitPerShard := computeRowLimitPerShard(currentMaxRows)
+	proposedLimitPerShard := computeRowLimitPerShard(proposedMaxRows)
+	// The expired rows are removed first, and the row cap then removes the
+	// oldest rows that remain, so a policy removes whichever is larger of the
+	// rows exceeding the row limit and the expired rows, out of the removable
+	// rows.
+	rowsToDelete := func(rowCount, rowLimit, expiredRows, removableRows int64) int64 {
+		rowsToDelete := rowCount - rowLimit
+		if expiredRows > rowsToDelete {
+			rowsToDelete = expiredRows
+		}
+		if rowsToDelete < 0 {
+			return 0
+		}
+		if rowsToDelete > removableRows {
+			return removableRows
+		}
+		return rowsToDelete
+	}
+
+	var ok bool
+	for ok, err = it.Next(ctx); ok; ok, err = it.Next(ctx) {
+		row := it.Cur()
+		shardIdx := int(tree.MustBeDInt(row[0]))
+		if shardIdx < 0 || shardIdx >= len(currentLimitPerShard) {
+			return diff, errors.AssertionFailedf("unexpected hash bucket %d", shardIdx)
+		}
+		rowCount := int64(tree.MustBeDInt(row[1]))
+		removableRows := int64(tree.MustBeDInt(row[2]))
+		currentExpiredRows := int64(tree.MustBeDInt(row[3]))
+		proposedExpiredRows := int64(tree.MustBeDInt(row[4]))
+
+		diff.CurrentRowsToDelete += rowsToDelete(
+			rowCount, currentLimitPerShard[shardIdx], currentExpiredRows, removableRows,
+		)
+		diff.ProposedRowsToDelete += rowsToDelete(
+			rowCount, proposedLimitPerShard[shardIdx], proposedExpiredRows, removableRows,
+		)
+	}
+	return diff, err
+}
+
+// hasLastExecutionTs returns whether the stats tables have the
+// last_execution_ts column, see lastExecutionExpr.
+func (c *StatsCompactor) hasLastExecutionTs(ctx context.Context) bool {
+	return c.st.Version.IsActive(ctx, clusterversion.V23_2_AddSQLStatsLastExecutionTs)
+}
+
+func (c *StatsCompactor) getTimeNow() time.Time {
+	if c.knobs != nil && c.knobs.StubTimeNow != nil {
+		return c.knobs.StubTimeNow()
+	}
+	return timeutil.Now()
 }
 
 type cleanupOperations struct {
+	table string
+	// shardColumn is the hash bucket column of the primary key of the table.
+	shardColumn             string
 	initialScanStmtTemplate string
-	unconstrainedDeleteStmt string
-	constrainedDeleteStmt   string
+	appRowCountStmtTemplate string
+	policyDiffStmtTemplate  string
+	// retainedRowStmtTemplate returns the aggregated_ts of the oldest row of a
+	// hash bucket that remains once a number of its oldest rows are removed,
+	// see RetentionHorizon.
+	retainedRowStmtTemplate string
+	// The delete statements are templates for additional predicates that
+	// restrict the rows that can be removed, see getDeleteStmt and
+	// getExpiredDeleteStmt. The rows are aliased as s.
+	unconstrainedDeleteStmtTemplate string
+	constrainedDeleteStmtTemplate   string
+	expiredDeleteStmtTemplate       string
+
+	// keyColumns are the primary key columns that identify a fingerprint,
+	// i.e. all of them but aggregated_ts.
+	keyColumns []string
+	// mergeStatistics combines the statistics of several rows of a
+	// fingerprint, see coalesceWindows.
+	mergeStatistics func(statistics []json.JSON) (json.JSON, error)
 }
 
 // TODO(#91600): Add deterministic execbuilder tests for these queries at
@@ -272,26 +1477,55 @@ type cleanupOperations struct {
 // When changing the constraint queries below, make sure to also change the queries in those tests.
 var (
 	stmtStatsCleanupOps = &cleanupOperations{
+		table:       "system.statement_statistics",
+		shardColumn: "crdb_internal_aggregated_ts_app_name_fingerprint_id_node_id_plan_hash_transaction_fingerprint_id_shard_8",
 		initialScanStmtTemplate: `
-      SELECT count(*)
+      SELECT count(*), count(*) FILTER (WHERE aggregated_ts < $2), min(aggregated_ts),
+        array_agg(DISTINCT app_name)
       FROM system.statement_statistics
       %s
       WHERE crdb_internal_aggregated_ts_app_name_fingerprint_id_node_id_plan_hash_transaction_fingerprint_id_shard_8 = $1`,
-		unconstrainedDeleteStmt: `
+		appRowCountStmtTemplate: `
+      SELECT app_name, count(*) AS row_count
+      FROM system.statement_statistics
+      %s
+      WHERE crdb_internal_aggregated_ts_app_name_fingerprint_id_node_id_plan_hash_transaction_fingerprint_id_shard_8 = $1
+        AND aggregated_ts < $2
+      GROUP BY app_name
+      ORDER BY row_count DESC, app_name`,
+		policyDiffStmtTemplate: `
+      SELECT
+        crdb_internal_aggregated_ts_app_name_fingerprint_id_node_id_plan_hash_transaction_fingerprint_id_shard_8,
+        count(*),
+        count(*) FILTER (WHERE aggregated_ts < $1),
+        count(*) FILTER (WHERE aggregated_ts < $2%[3]s),
+        count(*) FILTER (WHERE aggregated_ts < $3%[4]s)
+      FROM %[1]s
+      %[2]s
+      GROUP BY crdb_internal_aggregated_ts_app_name_fingerprint_id_node_id_plan_hash_transaction_fingerprint_id_shard_8`,
+		retainedRowStmtTemplate: `
+      SELECT aggregated_ts
+      FROM system.statement_statistics
+      %s
+      WHERE crdb_internal_aggregated_ts_app_name_fingerprint_id_node_id_plan_hash_transaction_fingerprint_id_shard_8 = $1
+      ORDER BY aggregated_ts ASC
+      OFFSET $2
+      LIMIT 1`,
+		unconstrainedDeleteStmtTemplate: `
       DELETE FROM system.statement_statistics
       WHERE (aggregated_ts, fingerprint_id, transaction_fingerprint_id, plan_hash, app_name, node_id) IN (
         SELECT aggregated_ts, fingerprint_id, transaction_fingerprint_id, plan_hash, app_name, node_id
-        FROM system.statement_statistics
+        FROM system.statement_statistics AS s
         WHERE crdb_internal_aggregated_ts_app_name_fingerprint_id_node_id_plan_hash_transaction_fingerprint_id_shard_8 = $1
-          AND aggregated_ts < $3
+          AND aggregated_ts < $3%s
         ORDER BY aggregated_ts ASC
         LIMIT $2
       ) RETURNING aggregated_ts, fingerprint_id, transaction_fingerprint_id, plan_hash, app_name, node_id`,
-		constrainedDeleteStmt: `
+		constrainedDeleteStmtTemplate: `
     DELETE FROM system.statement_statistics
     WHERE (aggregated_ts, fingerprint_id, transaction_fingerprint_id, plan_hash, app_name, node_id) IN (
     SELECT aggregated_ts, fingerprint_id, transaction_fingerprint_id, plan_hash, app_name, node_id
-    FROM system.statement_statistics
+    FROM system.statement_statistics AS s
     WHERE crdb_internal_aggregated_ts_app_name_fingerprint_id_node_id_plan_hash_transaction_fingerprint_id_shard_8 = $1
     AND (
       (
@@ -303,32 +1537,75 @@ var (
         node_id
         ) >= ($4, $5, $6, $7, $8, $9)
       )
-        AND aggregated_ts < $3
+        AND aggregated_ts < $3%s
       ORDER BY aggregated_ts ASC
       LIMIT $2
     ) RETURNING aggregated_ts, fingerprint_id, transaction_fingerprint_id, plan_hash, app_name, node_id`,
+		expiredDeleteStmtTemplate: `
+    DELETE FROM system.statement_statistics
+    WHERE (aggregated_ts, fingerprint_id, transaction_fingerprint_id, plan_hash, app_name, node_id) IN (
+      SELECT aggregated_ts, fingerprint_id, transaction_fingerprint_id, plan_hash, app_name, node_id
+      FROM system.statement_statistics AS s
+      WHERE crdb_internal_aggregated_ts_app_name_fingerprint_id_node_id_plan_hash_transaction_fingerprint_id_shard_8 = $1
+        AND aggregated_ts < $3%s
+      ORDER BY aggregated_ts ASC
+      LIMIT $2
+    ) RETURNING aggregated_ts`,
+		keyColumns: []string{
+			"fingerprint_id", "transaction_fingerprint_id", "plan_hash", "app_name", "node_id",
+		},
+		mergeStatistics: mergeStmtStatistics,
 	}
 	txnStatsCleanupOps = &cleanupOperations{
+		table:       "system.transaction_statistics",
+		shardColumn: "crdb_internal_aggregated_ts_app_name_fingerprint_id_node_id_shard_8",
 		initialScanStmtTemplate: `
-      SELECT count(*)
+      SELECT count(*), count(*) FILTER (WHERE aggregated_ts < $2), min(aggregated_ts),
+        array_agg(DISTINCT app_name)
       FROM system.transaction_statistics
       %s
       WHERE crdb_internal_aggregated_ts_app_name_fingerprint_id_node_id_shard_8 = $1`,
-		unconstrainedDeleteStmt: `
+		appRowCountStmtTemplate: `
+      SELECT app_name, count(*) AS row_count
+      FROM system.transaction_statistics
+      %s
+      WHERE crdb_internal_aggregated_ts_app_name_fingerprint_id_node_id_shard_8 = $1
+        AND aggregated_ts < $2
+      GROUP BY app_name
+      ORDER BY row_count DESC, app_name`,
+		policyDiffStmtTemplate: `
+      SELECT
+        crdb_internal_aggregated_ts_app_name_fingerprint_id_node_id_shard_8,
+        count(*),
+        count(*) FILTER (WHERE aggregated_ts < $1),
+        count(*) FILTER (WHERE aggregated_ts < $2%[3]s),
+        count(*) FILTER (WHERE aggregated_ts < $3%[4]s)
+      FROM %[1]s
+      %[2]s
+      GROUP BY crdb_internal_aggregated_ts_app_name_fingerprint_id_node_id_shard_8`,
+		retainedRowStmtTemplate: `
+      SELECT aggregated_ts
+      FROM system.transaction_statistics
+      %s
+      WHERE crdb_internal_aggregated_ts_app_name_fingerprint_id_node_id_shard_8 = $1
+      ORDER BY aggregated_ts ASC
+      OFFSET $2
+      LIMIT 1`,
+		unconstrainedDeleteStmtTemplate: `
     DELETE FROM system.transaction_statistics
     WHERE (aggregated_ts, fingerprint_id, app_name, node_id) IN (
       SELECT aggregated_ts, fingerprint_id, app_name, node_id
-      FROM system.transaction_statistics
+      FROM system.transaction_statistics AS s
       WHERE crdb_internal_aggregated_ts_app_name_fingerprint_id_node_id_shard_8 = $1
-        AND aggregated_ts < $3
+        AND aggregated_ts < $3%s
       ORDER BY aggregated_ts ASC
       LIMIT $2
     ) RETURNING aggregated_ts, fingerprint_id, app_name, node_id`,
-		constrainedDeleteStmt: `
+		constrainedDeleteStmtTemplate: `
     DELETE FROM system.transaction_statistics
       WHERE (aggregated_ts, fingerprint_id, app_name, node_id) IN (
       SELECT aggregated_ts, fingerprint_id, app_name, node_id
-      FROM system.transaction_statistics
+      FROM system.transaction_statistics AS s
       WHERE crdb_internal_aggregated_ts_app_name_fingerprint_id_node_id_shard_8 = $1
       AND (
         (
@@ -338,21 +1615,133 @@ var (
         node_id
         ) >= ($4, $5, $6, $7)
       )
-        AND aggregated_ts < $3
+        AND aggregated_ts < $3%s
       ORDER BY aggregated_ts ASC
       LIMIT $2
     ) RETURNING aggregated_ts, fingerprint_id, app_name, node_id`,
+		expiredDeleteStmtTemplate: `
+    DELETE FROM system.transaction_statistics
+    WHERE (aggregated_ts, fingerprint_id, app_name, node_id) IN (
+      SELECT aggregated_ts, fingerprint_id, app_name, node_id
+      FROM system.transaction_statistics AS s
+      WHERE crdb_internal_aggregated_ts_app_name_fingerprint_id_node_id_shard_8 = $1
+        AND aggregated_ts < $3%s
+      ORDER BY aggregated_ts ASC
+      LIMIT $2
+    ) RETURNING aggregated_ts`,
+		keyColumns:      []string{"fingerprint_id", "app_name", "node_id"},
+		mergeStatistics: mergeTxnStatistics,
 	}
 )
 
-func (c *cleanupOperations) getScanStmt(knobs *sqlstats.TestingKnobs) string {
-	return fmt.Sprintf(c.initialScanStmtTemplate, knobs.GetAOSTClause())
+func (c *cleanupOperations) getScanStmt(aostClause string) string {
+	return fmt.Sprintf(c.initialScanStmtTemplate, aostClause)
+}
+
+func (c *cleanupOperations) getAppRowCountStmt(aostClause string) string {
+	return fmt.Sprintf(c.appRowCountStmtTemplate, aostClause)
 }
 
-func (c *cleanupOperations) getDeleteStmt(lastDeletedRow tree.Datums) string {
+// getPolicyDiffStmt returns the statement counting, for each hash bucket, the
+// rows of the table, the ones older than the grace cutoff ($1), and the ones
+// older than two age cutoffs ($2 and $3). If retainRecentlyExecuted is set,
+// the rows of the fingerprints executed since an age cutoff are not counted
+// as older than it, as getExpiredDeleteStmt does not remove them.
+func (c *cleanupOperations) getPolicyDiffStmt(
+	aostClause string, retainRecentlyExecuted, withLastExecutionTs bool,
+) string {
+	if !retainRecentlyExecuted {
+		return fmt.Sprintf(c.policyDiffStmtTemplate, c.table, aostClause, "", "")
+	}
+	// The last execution of the fingerprint of each row is computed with a
+	// window function, so that the table is still scanned once.
+	source := fmt.Sprintf(`(
+        SELECT %s, aggregated_ts,
+          max(%s) OVER (PARTITION BY fingerprint_id, app_name) AS last_execution
+        FROM %s AS s
+      )`, c.shardColumn, lastExecutionExpr("s", withLastExecutionTs), c.table)
+	return fmt.Sprintf(c.policyDiffStmtTemplate, source, aostClause,
+		" AND last_execution < $2", " AND last_execution < $3")
+}
+
+func (c *cleanupOperations) getRetainedRowStmt(aostClause string) string {
+	return fmt.Sprintf(c.retainedRowStmtTemplate, aostClause)
+}
+
+// getDeleteStmt returns the statement removing the oldest rows of a hash
+// bucket that match the given additional predicates, starting after
+// lastDeletedRow if it is set.
+func (c *cleanupOperations) getDeleteStmt(lastDeletedRow tree.Datums, predicates string) string {
 	if len(lastDeletedRow) == 0 {
-		return c.unconstrainedDeleteStmt
+		return fmt.Sprintf(c.unconstrainedDeleteStmtTemplate, predicates)
+	}
+
+	return fmt.Sprintf(c.constrainedDeleteStmtTemplate, predicates)
+}
+
+// getExpiredDeleteStmt returns the statement removing the rows of a hash
+// bucket that are older than the age cutoff ($3) and match the given
+// predicates, see getExpiredPredicates.
+func (c *cleanupOperations) getExpiredDeleteStmt(predicates string) string {
+	return fmt.Sprintf(c.expiredDeleteStmtTemplate, predicates)
+}
+
+// getExpiredPredicates returns the predicates restricting the removal of the
+// rows older than an age cutoff, given the placeholder of the cutoff. If
+// retainRecentlyExecuted is set, only the rows of the fingerprints that were
+// not executed since the cutoff are removed, see notRecentlyExecutedPredicate.
+// If retainLatest is set, the most recent row of each fingerprint is not
+// removed. The rows excluded by pinnedPredicate are not removed either.
+func (c *cleanupOperations) getExpiredPredicates(
+	cutoffPlaceholder string,
+	retainRecentlyExecuted, withLastExecutionTs, retainLatest bool,
+	pinnedPredicate string,
+) string {
+	predicates := pinnedPredicate
+	if retainRecentlyExecuted {
+		predicates += c.notRecentlyExecutedPredicate(cutoffPlaceholder, withLastExecutionTs)
+	}
+	if retainLatest {
+		predicates += c.notLatestWindowPredicate()
 	}
+	return predicates
+}
+
+// notRecentlyExecutedPredicate restricts the removal to the rows of the
+// fingerprints that were not executed by their application since the age
+// cutoff, according to the last_execution_ts of their rows, see
+// lastExecutionExpr.
+func (c *cleanupOperations) notRecentlyExecutedPredicate(
+	cutoffPlaceholder string, withLastExecutionTs bool,
+) string {
+	return fmt.Sprintf(`
+        AND NOT EXISTS (
+          SELECT 1 FROM %s AS r
+          WHERE r.fingerprint_id = s.fingerprint_id AND r.app_name = s.app_name
+            AND %s >= %s
+        )`, c.table, lastExecutionExpr("r", withLastExecutionTs), cutoffPlaceholder)
+}
+
+// lastExecutionExpr returns the expression of the last execution of the
+// fingerprint within the row aliased as alias. It is the last_execution_ts
+// of the row if withLastExecutionTs is set, i.e. once the column exists (see
+// V23_2_AddSQLStatsLastExecutionTs). The rows persisted before, which have no
+// last_execution_ts, fall back to their aggregated_ts, i.e. to the start of
+// their aggregation window.
+func lastExecutionExpr(alias string, withLastExecutionTs bool) string {
+	if withLastExecutionTs {
+		return fmt.Sprintf("COALESCE(%[1]s.last_execution_ts, %[1]s.aggregated_ts)", alias)
+	}
+	return alias + ".aggregated_ts"
+}
 
-	return c.constrainedDeleteStmt
+// notLatestWindowPredicate restricts the removal to the rows of the
+// fingerprints that have a more recent row, so that the latest aggregation
+// window of each fingerprint is retained.
+func (c *cleanupOperations) notLatestWindowPredicate() string {
+	return fmt.Sprintf(`
+        AND EXISTS (
+          SELECT 1 FROM %s AS r
+          WHERE r.fingerprint_id = s.fingerprint_id AND r.aggregated_ts > s.aggregated_ts
+        )`, c.table)
 }
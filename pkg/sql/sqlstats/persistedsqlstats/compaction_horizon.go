@@ -0,0 +1,130 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package persistedsqlstats
+
+import (
+	"context"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/sem/tree"
+	"github.com/cockroachdb/cockroach/pkg/sql/sessiondata"
+	"github.com/cockroachdb/errors"
+)
+
+// RetentionHorizon estimates how far back the persisted stats go once the
+// current retention policy is enforced: the returned horizon is the oldest
+// aggregated_ts from which the compaction retains the stats of both tables in
+// every hash bucket. It is the most recent of the age cutoff of
+// sql.stats.persisted_rows.max_age and, for the hash buckets over their share
+// of sql.stats.persisted_rows.max, the aggregated_ts of the oldest row that
+// remains once the rows over the cap are removed, mirroring
+// removeStaleRowsPerShard. The rows in the grace period are never removed, so
+// the horizon never exceeds the grace cutoff. If no policy limits the tables,
+// ok is false.
+//
+// As for DiffPolicies, the estimate assumes that the rows are removed oldest
+// first, and does not account for the rows retained by the other cleanup
+// settings, e.g. sql.stats.cleanup.pinned_app_names, or removed by
+// sql.stats.cleanup.app_name_ttls. The tables are only read.
+func (c *StatsCompactor) RetentionHorizon(ctx context.Context) (horizon time.Time, ok bool, _ error) {
+	maxRows, maxAge := c.getRetentionPolicy(ctx)
+	ageCutoff, err := c.getAgeCutoff(maxAge)
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	if maxAge > 0 {
+		horizon = ageCutoff.Time
+	}
+	for _, ops := range []*cleanupOperations{stmtStatsCleanupOps, txnStatsCleanupOps} {
+		rowCapHorizon, err := c.rowCapHorizonForTable(ctx, ops, maxRows)
+		if err != nil {
+			return time.Time{}, false, err
+		}
+		if rowCapHorizon.After(horizon) {
+			horizon = rowCapHorizon
+		}
+	}
+	return horizon, !horizon.IsZero(), nil
+}
+
+// rowCapHorizonForTable returns the most recent, over the hash buckets of the
+// given table, of the aggregated_ts of the oldest row that remains once the
+// rows over the row cap of the bucket are removed, or the zero time if no
+// bucket is over its row cap.
+func (c *StatsCompactor) rowCapHorizonForTable(
+	ctx context.Context, ops *cleanupOperations, maxRows int64,
+) (horizon time.Time, _ error) {
+	graceCutoffTime := c.getGraceCutoff()
+	graceCutoff, err := tree.MakeDTimestampTZ(graceCutoffTime, time.Microsecond)
+	if err != nil {
+		return time.Time{}, err
+	}
+	// The policy diff statement counts the rows older than three cutoffs,
+	// only the first one is used here.
+	rows, err := c.db.Executor().QueryBufferedEx(ctx,
+		"sql-stats-retention-horizon",
+		nil, /* txn */
+		sessiondata.NodeUserSessionDataOverride,
+		ops.getPolicyDiffStmt(
+			c.getAOSTClause(),
+			false, /* retainRecentlyExecuted */
+			false, /* withLastExecutionTs */
+		),
+		graceCutoff,
+		graceCutoff,
+		graceCutoff,
+	)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	limitPerShard := computeRowLimitPerShard(maxRows)
+	for _, row := range rows {
+		shardIdx := int64(tree.MustBeDInt(row[0]))
+		if shardIdx < 0 || shardIdx >= int64(len(limitPerShard)) {
+			return time.Time{}, errors.AssertionFailedf("unexpected hash bucket %d", shardIdx)
+		}
+		rowCount := int64(tree.MustBeDInt(row[1]))
+		removableRows := int64(tree.MustBeDInt(row[2]))
+		rowsToRemove := rowCount - limitPerShard[shardIdx]
+		if rowsToRemove <= 0 {
+			continue
+		}
+		if rowsToRemove > removableRows {
+			rowsToRemove = removableRows
+		}
+
+		// The oldest remaining row is the one following the removed rows. If
+		// it is in the grace period, or if all the rows are removed, the
+		// bucket retains its rows from the grace cutoff.
+		shardHorizon := graceCutoffTime
+		retainedRow, err := c.db.Executor().QueryRowEx(ctx,
+			"sql-stats-retained-row",
+			nil, /* txn */
+			sessiondata.NodeUserSessionDataOverride,
+			ops.getRetainedRowStmt(c.getAOSTClause()),
+			shardIdx,
+			rowsToRemove,
+		)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if retainedRow != nil {
+			if ts := tree.MustBeDTimestampTZ(retainedRow[0]).Time; ts.Before(shardHorizon) {
+				shardHorizon = ts
+			}
+		}
+		if shardHorizon.After(horizon) {
+			horizon = shardHorizon
+		}
+	}
+	return horizon, nil
+}
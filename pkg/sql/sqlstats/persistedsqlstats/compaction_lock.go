@@ -0,0 +1,186 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package persistedsqlstats
+
+import (
+	"context"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/base"
+	"github.com/cockroachdb/cockroach/pkg/clusterversion"
+	"github.com/cockroachdb/cockroach/pkg/jobs/jobspb"
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/sql/isql"
+	"github.com/cockroachdb/cockroach/pkg/sql/sem/tree"
+	"github.com/cockroachdb/cockroach/pkg/sql/sessiondata"
+	"github.com/cockroachdb/cockroach/pkg/sql/sqlliveness"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/cockroachdb/logtags"
+)
+
+// The compaction lock ensures that a single compaction runs cluster-wide at a
+// time, be it a run of the compaction job or a compaction requested with
+// crdb_internal.sql_stats_compact_now(). Two concurrent compactions would
+// contend heavily while deleting the same rows.
+//
+// The lock is the row of the run in progress in
+// system.sql_stats_compaction_runs: its outcome is CompactionRunRunning, and
+// its session_id is the ID of the sqlliveness session of the node running the
+// compaction. The lock is released once the run is recorded, see
+// RecordCompactionRun, or expires with the session of the holder, e.g. if the
+// node running the compaction died.
+//
+// The table is created by V23_2_AddSQLStatsCompactionRunsTable. Until the
+// cluster is upgraded to this version, compactions are not serialized.
+
+// CompactionLock is a lease on the compaction lock, see AcquireCompactionLock.
+type CompactionLock struct {
+	// runID is the ID of the row of the run in
+	// system.sql_stats_compaction_runs, or 0 if the lock could not be taken
+	// because the table does not exist yet.
+	runID int64
+}
+
+// AcquireCompactionLock claims the compaction lock on behalf of the given
+// sqlliveness session, for a run of the given job, or of no job if jobID is
+// jobspb.InvalidJobID. The runs in progress are read and the new run is
+// written in txn, so that two concurrent claims cannot both succeed. If the
+// lock is held by a live session, ok is false and holder is the ID of the SQL
+// instance holding it, or 0 if the instance is unknown. Otherwise, the lease
+// that must be passed to RecordCompactionRun and ReleaseCompactionLock is
+// returned. The runs in progress of dead sessions are recorded as failed.
+func AcquireCompactionLock(
+	ctx context.Context,
+	txn isql.Txn,
+	st *cluster.Settings,
+	sessionID sqlliveness.SessionID,
+	jobID jobspb.JobID,
+) (lock CompactionLock, holder base.SQLInstanceID, ok bool, _ error) {
+	if !st.Version.IsActive(ctx, clusterversion.V23_2_AddSQLStatsCompactionRunsTable) {
+		log.VEventf(ctx, 2, "running the sql stats compaction without the compaction lock, "+
+			"the cluster is not upgraded to %s yet", clusterversion.V23_2_AddSQLStatsCompactionRunsTable)
+		return CompactionLock{}, 0, true, nil
+	}
+	rows, err := txn.QueryBufferedEx(ctx, "read-sql-stats-compaction-lock", txn.KV(),
+		sessiondata.NodeUserSessionDataOverride,
+		`SELECT session_id, crdb_internal.sql_liveness_is_alive(session_id)
+FROM system.sql_stats_compaction_runs
+WHERE outcome = $1
+FOR UPDATE`,
+		CompactionRunRunning,
+	)
+	if err != nil {
+		return CompactionLock{}, 0, false, err
+	}
+	for _, row := range rows {
+		if !tree.MustBeDBool(row[1]) {
+			continue
+		}
+		holder, err := getSessionInstanceID(ctx, txn, []byte(tree.MustBeDBytes(row[0])))
+		if err != nil {
+			return CompactionLock{}, 0, false, err
+		}
+		return CompactionLock{}, holder, false, nil
+	}
+
+	// The remaining runs in progress are the runs of dead sessions.
+	if _, err := txn.ExecEx(ctx, "clear-sql-stats-compaction-lock", txn.KV(),
+		sessiondata.NodeUserSessionDataOverride,
+		`UPDATE system.sql_stats_compaction_runs
+SET outcome = $2, error = $3, completed_at = now(), session_id = NULL
+WHERE outcome = $1`,
+		CompactionRunRunning, CompactionRunFailed,
+		"the run was abandoned, the session of its node expired",
+	); err != nil {
+		return CompactionLock{}, 0, false, err
+	}
+	var jobIDArg interface{}
+	if jobID != jobspb.InvalidJobID {
+		jobIDArg = jobID
+	}
+	row, err := txn.QueryRowEx(ctx, "claim-sql-stats-compaction-lock", txn.KV(),
+		sessiondata.NodeUserSessionDataOverride,
+		`INSERT INTO system.sql_stats_compaction_runs
+  (completed_at, job_id, stmt_rows_removed, txn_rows_removed, outcome, session_id)
+VALUES (NULL, $1, 0, 0, $2, $3)
+RETURNING id`,
+		jobIDArg, CompactionRunRunning, []byte(sessionID),
+	)
+	if err != nil {
+		return CompactionLock{}, 0, false, err
+	}
+	return CompactionLock{runID: int64(tree.MustBeDInt(row[0]))}, 0, true, nil
+}
+
+// ReleaseCompactionLock releases a lease acquired with AcquireCompactionLock,
+// if the run was not recorded with RecordCompactionRun, e.g. because it
+// failed before compacting the tables: its row is removed. The lease is
+// released even if ctx is canceled, e.g. because the compaction job was
+// paused, since it would otherwise only expire with the session of this node.
+func ReleaseCompactionLock(ctx context.Context, db isql.DB, lock CompactionLock) {
+	if lock.runID == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(
+		logtags.AddTags(context.Background(), logtags.FromContext(ctx)), time.Minute)
+	defer cancel()
+	if _, err := db.Executor().ExecEx(ctx, "release-sql-stats-compaction-lock", nil, /* txn */
+		sessiondata.NodeUserSessionDataOverride,
+		`DELETE FROM system.sql_stats_compaction_runs WHERE id = $1 AND outcome = $2`,
+		lock.runID, CompactionRunRunning,
+	); err != nil {
+		log.Warningf(ctx, "failed to release the sql stats compaction lock, "+
+			"it is held until the session of this node expires: %v", err)
+	}
+}
+
+// GetCompactionCoordinator returns the ID of the SQL instance holding the
+// compaction lock (see AcquireCompactionLock). ok is false if no live session
+// holds the lock.
+func GetCompactionCoordinator(
+	ctx context.Context, txn isql.Txn, st *cluster.Settings,
+) (instanceID base.SQLInstanceID, ok bool, _ error) {
+	if !st.Version.IsActive(ctx, clusterversion.V23_2_AddSQLStatsCompactionRunsTable) {
+		return 0, false, nil
+	}
+	row, err := txn.QueryRowEx(ctx, "get-sql-stats-compaction-coordinator", txn.KV(),
+		sessiondata.NodeUserSessionDataOverride,
+		`SELECT session_id FROM system.sql_stats_compaction_runs
+WHERE outcome = $1
+  AND crdb_internal.sql_liveness_is_alive(session_id)
+LIMIT 1`,
+		CompactionRunRunning,
+	)
+	if err != nil {
+		return 0, false, err
+	}
+	if row == nil {
+		return 0, false, nil
+	}
+	instanceID, err = getSessionInstanceID(ctx, txn, []byte(tree.MustBeDBytes(row[0])))
+	return instanceID, err == nil, err
+}
+
+// getSessionInstanceID returns the ID of the SQL instance owning the given
+// sqlliveness session, or 0 if the instance is not found.
+func getSessionInstanceID(
+	ctx context.Context, txn isql.Txn, sessionID []byte,
+) (base.SQLInstanceID, error) {
+	row, err := txn.QueryRowEx(ctx, "get-sql-stats-compaction-lock-instance", txn.KV(),
+		sessiondata.NodeUserSessionDataOverride,
+		`SELECT id FROM system.sql_instances WHERE session_id = $1 LIMIT 1`,
+		sessionID,
+	)
+	if err != nil || row == nil {
+		return 0, err
+	}
+	return base.SQLInstanceID(tree.MustBeDInt(row[0])), nil
+}
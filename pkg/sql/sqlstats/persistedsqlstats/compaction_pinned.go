@@ -0,0 +1,94 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package persistedsqlstats
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/cockroachdb/cockroach/pkg/settings"
+	"github.com/cockroachdb/cockroach/pkg/sql/lexbase"
+	"github.com/cockroachdb/cockroach/pkg/sql/sem/tree"
+	"github.com/cockroachdb/cockroach/pkg/sql/sessiondata"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/cockroachdb/errors"
+)
+
+// pinnedRowsWarningFraction is the fraction of
+// sql.stats.cleanup.pinned_app_names.max_rows above which the compaction logs
+// a warning, so that operators can act before the pinned rows stop being
+// retained.
+const pinnedRowsWarningFraction = 0.8
+
+// getPinnedAppNames returns the application names listed in
+// sql.stats.cleanup.pinned_app_names.
+func getPinnedAppNames(sv *settings.Values) []string {
+	var appNames []string
+	for _, appName := range strings.Split(SQLStatsCleanupPinnedAppNames.Get(sv), ",") {
+		if appName = strings.TrimSpace(appName); appName != "" {
+			appNames = append(appNames, appName)
+		}
+	}
+	return appNames
+}
+
+// getPinnedPredicate returns the predicate excluding the rows of the pinned
+// applications (see sql.stats.cleanup.pinned_app_names) of the given table
+// from all the removals, or an empty string if no application is pinned. If
+// the pinned applications have more rows in the table than
+// sql.stats.cleanup.pinned_app_names.max_rows, their rows are not excluded,
+// and a warning is logged.
+func (c *StatsCompactor) getPinnedPredicate(
+	ctx context.Context, ops *cleanupOperations,
+) (string, error) {
+	appNames := getPinnedAppNames(&c.st.SV)
+	if len(appNames) == 0 {
+		return "", nil
+	}
+	// The rows of the pinned applications may be persisted under the hash of
+	// their name, see sql.stats.flush.hash_app_names.
+	appNames = persistedAppNames(&c.st.SV, appNames)
+	quotedAppNames := make([]string, len(appNames))
+	for i, appName := range appNames {
+		quotedAppNames[i] = lexbase.EscapeSQLString(appName)
+	}
+	appNameList := strings.Join(quotedAppNames, ", ")
+
+	row, err := c.db.Executor().QueryRowEx(ctx,
+		"scan-pinned-row-count",
+		nil, /* txn */
+		sessiondata.NodeUserSessionDataOverride,
+		fmt.Sprintf("SELECT count(*) FROM %s %s WHERE app_name IN (%s)",
+			ops.table, c.getAOSTClause(), appNameList),
+	)
+	if err != nil {
+		return "", err
+	}
+	if row == nil {
+		return "", errors.AssertionFailedf("unexpected empty result when counting pinned rows")
+	}
+	pinnedRows := int64(tree.MustBeDInt(row[0]))
+	maxPinnedRows := SQLStatsCleanupMaxPinnedRows.Get(&c.st.SV)
+	if pinnedRows > maxPinnedRows {
+		log.Warningf(ctx, "%s holds %d rows of the applications in %s, more than %s (%d); "+
+			"they are not retained by this run", ops.table, pinnedRows,
+			SQLStatsCleanupPinnedAppNames.Key(), SQLStatsCleanupMaxPinnedRows.Key(), maxPinnedRows)
+		return "", nil
+	}
+	if float64(pinnedRows) > pinnedRowsWarningFraction*float64(maxPinnedRows) {
+		log.Warningf(ctx, "%s holds %d rows of the applications in %s, close to %s (%d), "+
+			"above which they are no longer retained", ops.table, pinnedRows,
+			SQLStatsCleanupPinnedAppNames.Key(), SQLStatsCleanupMaxPinnedRows.Key(), maxPinnedRows)
+	}
+	return fmt.Sprintf(`
+        AND s.app_name NOT IN (%s)`, appNameList), nil
+}
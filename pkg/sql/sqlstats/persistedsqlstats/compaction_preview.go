@@ -0,0 +1,158 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package persistedsqlstats
+
+import (
+	"context"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/sem/eval"
+	"github.com/cockroachdb/cockroach/pkg/sql/sem/tree"
+)
+
+// PreviewSelections returns, for each persisted stats table, the selections
+// of rows that DeleteOldestEntries would remove under the current retention
+// policy, without removing any row. Each selection corresponds to one of the
+// deletions of the compaction: the rows matching its predicate are removed
+// oldest first, up to its limit.
+//
+// When the age limit is enforced separately from the row cap (see
+// sql.stats.cleanup.retain_recently_executed.enabled,
+// sql.stats.cleanup.retain_latest_per_fingerprint, the protected fingerprints,
+// sql.stats.cleanup.eviction_order and sql.stats.cleanup.pinned_app_names),
+// the expired rows are removed first, without limit. The limit of the row cap
+// is computed from the current rows, so it is an upper bound in that case. The
+// limits do not account for sql.stats.cleanup.max_rows_per_run, which bounds
+// the number of rows removed across all the selections. The rows merged by
+// coalesceWindows are not included.
+func (c *StatsCompactor) PreviewSelections(
+	ctx context.Context,
+) ([]eval.SQLStatsCompactionSelection, error) {
+	maxPersistedRows, maxAge := c.getRetentionPolicy(ctx)
+	ageCutoff, err := c.getAgeCutoff(maxAge)
+	if err != nil {
+		return nil, err
+	}
+	graceCutoff, err := tree.MakeDTimestampTZ(c.getGraceCutoff(), time.Microsecond)
+	if err != nil {
+		return nil, err
+	}
+
+	protectedPredicate, err := c.getProtectedPredicate(ctx)
+	if err != nil {
+		return nil, err
+	}
+	pinnedPredicates := make(map[*cleanupOperations]string, 2)
+	for _, ops := range []*cleanupOperations{stmtStatsCleanupOps, txnStatsCleanupOps} {
+		if pinnedPredicates[ops], err = c.getPinnedPredicate(ctx, ops); err != nil {
+			return nil, err
+		}
+	}
+
+	retainRecentlyExecuted := maxAge > 0 && SQLStatsCleanupRetainRecentlyExecuted.Get(&c.st.SV)
+	retainLatest := SQLStatsCleanupRetainLatestPerFingerprint.Get(&c.st.SV)
+	evictLargestAppFirst :=
+		evictionOrder(SQLStatsCleanupEvictionOrder.Get(&c.st.SV)) == evictionOrderLargestApp
+	removeExpiredSeparately := maxAge > 0 && (retainRecentlyExecuted || retainLatest ||
+		protectedPredicate != "" || evictLargestAppFirst ||
+		pinnedPredicates[stmtStatsCleanupOps] != "" || pinnedPredicates[txnStatsCleanupOps] != "")
+	staleAgeCutoff := ageCutoff
+	if removeExpiredSeparately {
+		if staleAgeCutoff, err = c.getAgeCutoff(0 /* maxAge */); err != nil {
+			return nil, err
+		}
+	}
+
+	var selections []eval.SQLStatsCompactionSelection
+	for _, ops := range []*cleanupOperations{stmtStatsCleanupOps, txnStatsCleanupOps} {
+		if removeExpiredSeparately {
+			predicate := "aggregated_ts < " + ageCutoff.String()
+			if retainRecentlyExecuted {
+				predicate += " AND fingerprint not executed by the application since " + ageCutoff.String()
+			}
+			if retainLatest {
+				predicate += " AND not the latest row of the fingerprint"
+			}
+			if pinnedPredicates[ops] != "" {
+				predicate += " AND application not pinned"
+			}
+			selections = append(selections, eval.SQLStatsCompactionSelection{
+				Table:     ops.table,
+				Predicate: predicate,
+				Limit:     -1,
+			})
+		}
+
+		limit, err := c.getStaleRowLimit(ctx, ops, maxPersistedRows, staleAgeCutoff)
+		if err != nil {
+			return nil, err
+		}
+		predicate := "aggregated_ts < " + graceCutoff.String()
+		if retainLatest {
+			predicate += " AND not the latest row of the fingerprint"
+		}
+		if pinnedPredicates[ops] != "" {
+			predicate += " AND application not pinned"
+		}
+		if evictLargestAppFirst {
+			predicate += ", largest applications first"
+		}
+		if protectedPredicate != "" && ops == stmtStatsCleanupOps {
+			predicate += ", protected fingerprints last"
+		}
+		selections = append(selections, eval.SQLStatsCompactionSelection{
+			Table:     ops.table,
+			Predicate: predicate,
+			Limit:     limit,
+		})
+	}
+	return selections, nil
+}
+
+// getStaleRowLimit returns the number of rows that removeStaleRowsPerShard
+// would attempt to remove from the table, i.e. the sum of the limits of its
+// deletions across all hash buckets.
+func (c *StatsCompactor) getStaleRowLimit(
+	ctx context.Context, ops *cleanupOperations, maxPersistedRows int64, ageCutoff *tree.DTimestampTZ,
+) (int64, error) {
+	rowLimitPerShard := computeRowLimitPerShard(maxPersistedRows)
+	existingRowCountPerShard := make([]int64, len(rowLimitPerShard))
+	expiredRowCountPerShard := make([]int64, len(rowLimitPerShard))
+	var totalRowCount int64
+	for shardIdx := range rowLimitPerShard {
+		var oldestAggTs time.Time
+		if err := c.getRowCountForShard(
+			ctx,
+			ops.getScanStmt(c.getAOSTClause()),
+			shardIdx,
+			ageCutoff,
+			&existingRowCountPerShard[shardIdx],
+			&expiredRowCountPerShard[shardIdx],
+			&oldestAggTs,
+			make(map[string]struct{}), /* appNames */
+		); err != nil {
+			return 0, err
+		}
+		totalRowCount += existingRowCountPerShard[shardIdx]
+	}
+
+	maxRowsToRemovePerShard := c.computeCatchUpRowLimitPerShard(totalRowCount, maxPersistedRows)
+	var limit int64
+	for shardIdx, rowLimit := range rowLimitPerShard {
+		limit += computeRowsToRemoveForShard(
+			existingRowCountPerShard[shardIdx],
+			expiredRowCountPerShard[shardIdx],
+			rowLimit,
+			maxRowsToRemovePerShard,
+		)
+	}
+	return limit, nil
+}
@@ -0,0 +1,169 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package persistedsqlstats
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/appstatspb"
+	"github.com/cockroachdb/cockroach/pkg/sql/sem/tree"
+	"github.com/cockroachdb/cockroach/pkg/sql/sqlstats/persistedsqlstats/sqlstatsutil"
+	"github.com/cockroachdb/cockroach/pkg/sql/types"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
+)
+
+// maxProtectedFingerprints bounds the number of protected fingerprints bound
+// to the removal statements of a compaction run. The fingerprints past the
+// limit are not protected.
+const maxProtectedFingerprints = 10000
+
+// protectedFingerprintsPlaceholder stands for the placeholder of the protected
+// fingerprints in the predicate returned by getProtectedPredicate. It is
+// replaced with an actual placeholder once the other arguments of the
+// statement are known, see bindProtectedFingerprints.
+const protectedFingerprintsPlaceholder = "$protected_fingerprints"
+
+// ProtectedFingerprintsProvider returns the statement fingerprints whose rows
+// the compaction removes last, e.g. because they are the source of index
+// recommendations.
+type ProtectedFingerprintsProvider func(ctx context.Context) ([]appstatspb.StmtFingerprintID, error)
+
+var protectedFingerprints struct {
+	syncutil.Mutex
+	providers map[int]ProtectedFingerprintsProvider
+	nextID    int
+}
+
+// RegisterProtectedFingerprintsProvider registers a provider of protected
+// statement fingerprints, which is consulted at the start of each compaction
+// run. The rows of the protected fingerprints in
+// system.statement_statistics are only removed to enforce the row cap if
+// removing all the other candidate rows is not enough. They remain subject to
+// the age limit. The returned function unregisters the provider.
+func RegisterProtectedFingerprintsProvider(p ProtectedFingerprintsProvider) (unregister func()) {
+	protectedFingerprints.Lock()
+	defer protectedFingerprints.Unlock()
+	if protectedFingerprints.providers == nil {
+		protectedFingerprints.providers = make(map[int]ProtectedFingerprintsProvider)
+	}
+	id := protectedFingerprints.nextID
+	protectedFingerprints.nextID++
+	protectedFingerprints.providers[id] = p
+	return func() {
+		protectedFingerprints.Lock()
+		defer protectedFingerprints.Unlock()
+		delete(protectedFingerprints.providers, id)
+	}
+}
+
+// getProtectedFingerprints returns the sorted, deduplicated union of the
+// fingerprints returned by the registered providers, up to
+// maxProtectedFingerprints of them. A provider that fails is logged and
+// skipped, so that the compaction still runs, without protecting its
+// fingerprints.
+func getProtectedFingerprints(ctx context.Context) []appstatspb.StmtFingerprintID {
+	protectedFingerprints.Lock()
+	providers := make([]ProtectedFingerprintsProvider, 0, len(protectedFingerprints.providers))
+	for _, p := range protectedFingerprints.providers {
+		providers = append(providers, p)
+	}
+	protectedFingerprints.Unlock()
+
+	seen := make(map[appstatspb.StmtFingerprintID]struct{})
+	var ids []appstatspb.StmtFingerprintID
+	for _, p := range providers {
+		providedIDs, err := p(ctx)
+		if err != nil {
+			log.Warningf(ctx, "failed to fetch protected fingerprints, "+
+				"their rows are not protected by this compaction: %v", err)
+			continue
+		}
+		for _, id := range providedIDs {
+			if _, ok := seen[id]; !ok {
+				seen[id] = struct{}{}
+				ids = append(ids, id)
+			}
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	if len(ids) > maxProtectedFingerprints {
+		log.Warningf(ctx, "only protecting %d of the %d protected fingerprints",
+			maxProtectedFingerprints, len(ids))
+		ids = ids[:maxProtectedFingerprints]
+	}
+	return ids
+}
+
+// getProtectedPredicate returns the predicate excluding the rows of the
+// protected statement fingerprints from the removal, or an empty string if no
+// fingerprint is protected. The protected fingerprints are the ones returned
+// by the registered ProtectedFingerprintsProvider, and, if
+// sql.stats.cleanup.retain_index_recommendation_sources.enabled is set, the
+// ones with index recommendations. If sql.stats.cleanup.retain_per_plan is
+// set, the most recent row of each plan hash of a fingerprint is protected as
+// well. Only the rows of system.statement_statistics are protected.
+//
+// The fingerprints returned by the providers are passed to the statements as
+// an array argument, which the statements built with the predicate must bind
+// with bindProtectedFingerprints.
+func (c *StatsCompactor) getProtectedPredicate(ctx context.Context) (string, error) {
+	c.protectedFingerprints = nil
+	var conditions []string
+	if ids := getProtectedFingerprints(ctx); len(ids) > 0 {
+		c.protectedFingerprints = tree.NewDArray(types.Bytes)
+		for _, id := range ids {
+			if err := c.protectedFingerprints.Append(tree.NewDBytes(tree.DBytes(
+				sqlstatsutil.EncodeUint64ToBytes(uint64(id)),
+			))); err != nil {
+				return "", err
+			}
+		}
+		conditions = append(conditions, "s.fingerprint_id = ANY("+protectedFingerprintsPlaceholder+")")
+	}
+	if SQLStatsCleanupRetainIndexRecommendationSources.Get(&c.st.SV) {
+		conditions = append(conditions, `EXISTS (
+            SELECT 1 FROM system.statement_statistics AS r
+            WHERE r.fingerprint_id = s.fingerprint_id AND cardinality(r.index_recommendations) > 0
+          )`)
+	}
+	if SQLStatsCleanupRetainPerPlan.Get(&c.st.SV) {
+		conditions = append(conditions, `NOT EXISTS (
+            SELECT 1 FROM system.statement_statistics AS r
+            WHERE r.fingerprint_id = s.fingerprint_id AND r.plan_hash = s.plan_hash
+              AND r.aggregated_ts > s.aggregated_ts
+          )`)
+	}
+	if len(conditions) == 0 {
+		return "", nil
+	}
+	return fmt.Sprintf(`
+        AND NOT (
+          %s
+        )`, strings.Join(conditions, "\n          OR ")), nil
+}
+
+// bindProtectedFingerprints binds the protected fingerprints to the given
+// statement if it holds the predicate returned by getProtectedPredicate: the
+// placeholder of the fingerprints is replaced with the one following qargs,
+// and the fingerprints are appended to qargs.
+func (c *StatsCompactor) bindProtectedFingerprints(
+	stmt string, qargs []interface{},
+) (string, []interface{}) {
+	if !strings.Contains(stmt, protectedFingerprintsPlaceholder) {
+		return stmt, qargs
+	}
+	stmt = strings.ReplaceAll(stmt, protectedFingerprintsPlaceholder, fmt.Sprintf("$%d", len(qargs)+1))
+	return stmt, append(qargs, c.protectedFingerprints)
+}
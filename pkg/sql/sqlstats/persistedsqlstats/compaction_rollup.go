@@ -0,0 +1,69 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package persistedsqlstats
+
+import (
+	"context"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+)
+
+// rollupInterval is the width of the windows into which rollupWindows merges
+// the old rows.
+const rollupInterval = 24 * time.Hour
+
+// rollupWindows merges the rows of a fingerprint that are older than
+// sql.stats.cleanup.rollup_after and belong to the same day (in UTC) into a
+// single row, whose aggregated_ts is the start of the day and whose
+// agg_interval is a day. A day holding a single row of a fingerprint is
+// converted in the same way, so that all the rolled up rows have a daily
+// aggregation interval. As for coalesceWindows, the statistics of the merged
+// rows are combined, e.g. their execution counts are summed and their latency
+// distributions merged, so that the long-term trends are kept with fewer rows.
+//
+// Only the days that end before the grace cutoff (see getGraceCutoff) are
+// rolled up, so that the rows still updated by the flush are not merged. At
+// most coalesceMaxWindowsPerRun days of fingerprints are rolled up by a run,
+// the remaining ones are rolled up by the subsequent runs.
+func (c *StatsCompactor) rollupWindows(ctx context.Context, ops *cleanupOperations) error {
+	cutoff := c.getTimeNow().Add(-SQLStatsCleanupRollupAfter.Get(&c.st.SV))
+	if graceCutoff := c.getGraceCutoff(); graceCutoff.Before(cutoff) {
+		cutoff = graceCutoff
+	}
+	// Time.Truncate rounds down to a multiple of the duration since the zero
+	// time, i.e. to midnight UTC, as the windows computed in SQL.
+	cutoff = cutoff.Truncate(rollupInterval)
+
+	windows, err := c.getWindowsToCoalesce(ctx, ops, rollupInterval, cutoff)
+	if err != nil {
+		return err
+	}
+	var rowsMerged int64
+	for _, w := range windows {
+		if c.cleanupWindowClosed(ctx) {
+			break
+		}
+		merged, err := c.coalesceWindow(ctx, ops, w, rollupInterval)
+		if err != nil {
+			return err
+		}
+		rowsMerged += merged
+		if err := c.waitForDeleteRate(ctx, merged); err != nil {
+			return err
+		}
+	}
+	if rowsMerged > 0 {
+		log.Infof(ctx, "rolled up %d rows of %s into %d daily windows",
+			rowsMerged, ops.table, len(windows))
+	}
+	return nil
+}
@@ -0,0 +1,152 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package persistedsqlstats
+
+import (
+	"context"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/clusterversion"
+	"github.com/cockroachdb/cockroach/pkg/jobs/jobspb"
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/sql/isql"
+	"github.com/cockroachdb/cockroach/pkg/sql/sem/eval"
+	"github.com/cockroachdb/cockroach/pkg/sql/sem/tree"
+	"github.com/cockroachdb/cockroach/pkg/sql/sessiondata"
+	"github.com/cockroachdb/errors"
+)
+
+const (
+	// CompactionRunSucceeded and CompactionRunFailed are the outcomes recorded
+	// in system.sql_stats_compaction_runs.
+	CompactionRunSucceeded = "succeeded"
+	CompactionRunFailed    = "failed"
+	// CompactionRunRunning is the outcome of the run in progress, which holds
+	// the compaction lock, see AcquireCompactionLock.
+	CompactionRunRunning = "running"
+)
+
+// MaxRecordedCompactionRuns is the number of most recent compaction runs
+// retained in system.sql_stats_compaction_runs, see RecordCompactionRun.
+const MaxRecordedCompactionRuns = 1000
+
+// RecordCompactionRun writes the summary of a compaction run to
+// system.sql_stats_compaction_runs: the number of rows it removed from each
+// of the persisted SQL stats tables, how long it took, and whether it failed
+// with runErr. The summary is written to the row of the run in progress held
+// by lock, which releases the compaction lock, or to a new row if the lock
+// has no row. The runs older than the MaxRecordedCompactionRuns most recent
+// ones are then removed from the table. It is a no-op until the cluster is
+// upgraded to the version creating the table.
+func RecordCompactionRun(
+	ctx context.Context,
+	db isql.DB,
+	st *cluster.Settings,
+	lock CompactionLock,
+	jobID jobspb.JobID,
+	duration time.Duration,
+	results []eval.SQLStatsCompactionResult,
+	runErr error,
+) error {
+	if !st.Version.IsActive(ctx, clusterversion.V23_2_AddSQLStatsCompactionRunsTable) {
+		return nil
+	}
+	var stmtRowsRemoved, txnRowsRemoved int64
+	for _, result := range results {
+		switch result.Table {
+		case "system.statement_statistics":
+			stmtRowsRemoved += result.Rows
+		case "system.transaction_statistics":
+			txnRowsRemoved += result.Rows
+		}
+	}
+	outcome := CompactionRunSucceeded
+	var errMsg interface{}
+	if runErr != nil {
+		outcome = CompactionRunFailed
+		errMsg = runErr.Error()
+	}
+	var err error
+	if lock.runID != 0 {
+		_, err = db.Executor().ExecEx(ctx,
+			"record-sql-stats-compaction-run",
+			nil, /* txn */
+			sessiondata.NodeUserSessionDataOverride,
+			`UPDATE system.sql_stats_compaction_runs
+SET completed_at = now(), duration = $2, stmt_rows_removed = $3, txn_rows_removed = $4,
+    outcome = $5, error = $6, session_id = NULL
+WHERE id = $1`,
+			lock.runID, duration, stmtRowsRemoved, txnRowsRemoved, outcome, errMsg,
+		)
+	} else {
+		var jobIDArg interface{}
+		if jobID != jobspb.InvalidJobID {
+			jobIDArg = jobID
+		}
+		_, err = db.Executor().ExecEx(ctx,
+			"record-sql-stats-compaction-run",
+			nil, /* txn */
+			sessiondata.NodeUserSessionDataOverride,
+			`INSERT INTO system.sql_stats_compaction_runs
+  (job_id, duration, stmt_rows_removed, txn_rows_removed, outcome, error)
+VALUES ($1, $2, $3, $4, $5, $6)`,
+			jobIDArg, duration, stmtRowsRemoved, txnRowsRemoved, outcome, errMsg,
+		)
+	}
+	if err != nil {
+		return err
+	}
+	// The table is trimmed after each run, so that there are few runs to
+	// remove, and they are found through completed_at_idx. The run in
+	// progress, with a NULL completed_at, is never removed.
+	_, err = db.Executor().ExecEx(ctx,
+		"trim-sql-stats-compaction-runs",
+		nil, /* txn */
+		sessiondata.NodeUserSessionDataOverride,
+		`DELETE FROM system.sql_stats_compaction_runs
+WHERE completed_at <= (
+  SELECT completed_at FROM system.sql_stats_compaction_runs
+  WHERE completed_at IS NOT NULL
+  ORDER BY completed_at DESC
+  OFFSET $1
+  LIMIT 1
+)`,
+		MaxRecordedCompactionRuns,
+	)
+	return errors.Wrap(err, "trimming system.sql_stats_compaction_runs")
+}
+
+// GetLastCompactionRun returns the completion time and the outcome of the most
+// recent completed compaction run recorded in system.sql_stats_compaction_runs. ok is
+// false if no run was recorded yet, or if the cluster is not yet upgraded to
+// the version creating the table. The lookup is a single-row reverse scan of
+// completed_at_idx, so it is cheap enough to be served by the health endpoint.
+func GetLastCompactionRun(
+	ctx context.Context, db isql.DB, st *cluster.Settings,
+) (completedAt time.Time, outcome string, ok bool, _ error) {
+	if !st.Version.IsActive(ctx, clusterversion.V23_2_AddSQLStatsCompactionRunsTable) {
+		return time.Time{}, "", false, nil
+	}
+	row, err := db.Executor().QueryRowEx(ctx,
+		"get-last-sql-stats-compaction-run",
+		nil, /* txn */
+		sessiondata.NodeUserSessionDataOverride,
+		`SELECT completed_at, outcome
+FROM system.sql_stats_compaction_runs@completed_at_idx
+WHERE completed_at IS NOT NULL
+ORDER BY completed_at DESC
+LIMIT 1`,
+	)
+	if err != nil || row == nil {
+		return time.Time{}, "", false, err
+	}
+	return tree.MustBeDTimestampTZ(row[0]).Time, string(tree.MustBeDString(row[1])), true, nil
+}
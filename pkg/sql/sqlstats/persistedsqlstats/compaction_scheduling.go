@@ -12,21 +12,33 @@ package persistedsqlstats
 
 import (
 	"context"
+	"fmt"
+	"strings"
+	"time"
 
 	"github.com/cockroachdb/cockroach/pkg/jobs"
 	"github.com/cockroachdb/cockroach/pkg/jobs/jobspb"
+	"github.com/cockroachdb/cockroach/pkg/kv/kvpb"
 	"github.com/cockroachdb/cockroach/pkg/scheduledjobs"
 	"github.com/cockroachdb/cockroach/pkg/security/username"
 	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
 	"github.com/cockroachdb/cockroach/pkg/sql/isql"
+	"github.com/cockroachdb/cockroach/pkg/sql/pgwire/pgcode"
+	"github.com/cockroachdb/cockroach/pkg/sql/pgwire/pgerror"
 	"github.com/cockroachdb/cockroach/pkg/sql/sem/tree"
 	"github.com/cockroachdb/cockroach/pkg/sql/sessiondata"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/cockroachdb/cockroach/pkg/util/retry"
 	"github.com/cockroachdb/errors"
 	pbtypes "github.com/gogo/protobuf/types"
 )
 
 const compactionScheduleName = "sql-stats-compaction"
 
+// sqlStatsScheduleNames are the names of all the schedules of the SQL Stats
+// subsystem, see LoadSQLStatsSchedules.
+var sqlStatsScheduleNames = []string{compactionScheduleName}
+
 // ErrDuplicatedSchedules indicates that there is already a schedule for sql
 // stats compaction job existing in the system.scheduled_jobs table.
 var ErrDuplicatedSchedules = errors.New("creating multiple sql stats compaction is disallowed")
@@ -61,14 +73,9 @@ func CreateSQLStatsCompactionScheduleIfNotYetExist(
 	compactionSchedule.SetScheduleLabel(compactionScheduleName)
 	compactionSchedule.SetOwner(username.NodeUserName())
 
-	args, err := pbtypes.MarshalAny(&ScheduledSQLStatsCompactorExecutionArgs{})
-	if err != nil {
+	if err := setCompactionExecutionDetails(compactionSchedule); err != nil {
 		return nil, err
 	}
-	compactionSchedule.SetExecutionDetails(
-		tree.ScheduledSQLStatsCompactionExecutor.InternalName(),
-		jobspb.ExecutionArguments{Args: args},
-	)
 
 	compactionSchedule.SetScheduleStatus(string(jobs.StatusPending))
 	if err := jobs.ScheduledJobTxn(txn).Create(ctx, compactionSchedule); err != nil {
@@ -78,6 +85,120 @@ func CreateSQLStatsCompactionScheduleIfNotYetExist(
 	return compactionSchedule, nil
 }
 
+// setCompactionExecutionDetails sets the executor type and the execution
+// arguments of the given schedule to the ones of the SQL Stats compaction.
+func setCompactionExecutionDetails(sj *jobs.ScheduledJob) error {
+	args, err := pbtypes.MarshalAny(&ScheduledSQLStatsCompactorExecutionArgs{})
+	if err != nil {
+		return err
+	}
+	sj.SetExecutionDetails(
+		tree.ScheduledSQLStatsCompactionExecutor.InternalName(),
+		jobspb.ExecutionArguments{Args: args},
+	)
+	return nil
+}
+
+// pausedUntilStatusPrefix prefixes the status of a schedule paused by
+// PauseSQLStatsCompactionSchedule until the pause expires.
+const pausedUntilStatusPrefix = "paused until"
+
+// PauseSQLStatsCompactionSchedule pauses the SQL Stats compaction schedule for
+// the given duration. Rather than pausing the schedule indefinitely, the next
+// run of the schedule is pushed back to the end of the pause, at which point
+// the schedule runs again and resumes its usual recurrence. The time at which
+// the compaction resumes is returned.
+//
+// The pause duration is capped by sql.stats.cleanup.max_pause_duration to
+// avoid unbounded growth of the persisted stats tables. The end of the pause
+// is computed with the clock of env, which the scheduled job system uses to
+// decide when the schedule runs.
+func PauseSQLStatsCompactionSchedule(
+	ctx context.Context,
+	txn isql.Txn,
+	st *cluster.Settings,
+	env scheduledjobs.JobSchedulerEnv,
+	pauseDuration time.Duration,
+) (resumeAt time.Time, _ error) {
+	if pauseDuration <= 0 {
+		return time.Time{}, pgerror.Newf(pgcode.InvalidParameterValue,
+			"pause duration must be positive, got %s", pauseDuration)
+	}
+	if maxPause := SQLStatsCleanupMaxPauseDuration.Get(&st.SV); pauseDuration > maxPause {
+		return time.Time{}, errors.WithHintf(
+			pgerror.Newf(pgcode.InvalidParameterValue,
+				"pause duration %s exceeds the maximum of %s", pauseDuration, maxPause),
+			"The maximum can be changed using the %s cluster setting.",
+			SQLStatsCleanupMaxPauseDuration.Key())
+	}
+
+	sj, err := loadCompactionSchedule(ctx, txn)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	resumeAt = env.Now().Add(pauseDuration)
+	sj.SetNextRun(resumeAt)
+	sj.SetScheduleStatus(pausedUntilStatusPrefix+" %s", resumeAt.Format(time.RFC3339))
+	if err := jobs.ScheduledJobTxn(txn).Update(ctx, sj); err != nil {
+		return time.Time{}, err
+	}
+	return resumeAt, nil
+}
+
+// isCompactionScheduleTemporarilyPaused returns whether the next run of the
+// given schedule was pushed back by PauseSQLStatsCompactionSchedule, and the
+// schedule has not run since.
+func isCompactionScheduleTemporarilyPaused(sj *jobs.ScheduledJob) bool {
+	return strings.HasPrefix(sj.ScheduleStatus(), pausedUntilStatusPrefix)
+}
+
+// ReassignCompactionScheduleOwner changes the owner of the SQL Stats
+// compaction schedule to newOwner, which must be an existing user. This is
+// used to repair a schedule whose owner was dropped, since the scheduled job
+// system cannot run the schedule on behalf of a user that does not exist.
+func ReassignCompactionScheduleOwner(
+	ctx context.Context, txn isql.Txn, newOwner username.SQLUsername,
+) error {
+	valid, err := isValidScheduleOwner(ctx, txn, newOwner)
+	if err != nil {
+		return err
+	}
+	if !valid {
+		return pgerror.Newf(pgcode.UndefinedObject, "role/user %s does not exist", newOwner)
+	}
+
+	sj, err := loadCompactionSchedule(ctx, txn)
+	if err != nil {
+		return err
+	}
+	if sj.Owner() == newOwner {
+		return nil
+	}
+	sj.SetOwner(newOwner)
+	return jobs.ScheduledJobTxn(txn).Update(ctx, sj)
+}
+
+// isValidScheduleOwner returns whether the given user can own the SQL Stats
+// compaction schedule. The node user does not have an entry in system.users,
+// but is always valid.
+func isValidScheduleOwner(
+	ctx context.Context, txn isql.Txn, owner username.SQLUsername,
+) (bool, error) {
+	if owner.IsNodeUser() {
+		return true, nil
+	}
+	row, err := txn.QueryRowEx(ctx, "check-sql-stats-schedule-owner", txn.KV(),
+		sessiondata.NodeUserSessionDataOverride,
+		"SELECT 1 FROM system.users WHERE username = $1",
+		owner.Normalized(),
+	)
+	if err != nil {
+		return false, err
+	}
+	return row != nil, nil
+}
+
 // CreateCompactionJob creates a system.jobs record.
 // We do not need to worry about checking if the job already exist;
 // at most 1 job semantics are enforced by scheduled jobs system.
@@ -99,6 +220,182 @@ func CreateCompactionJob(
 	return jobID, nil
 }
 
+// CompactionScheduleStatus returns the status of the SQL Stats compaction
+// schedule, as reported in the schedule_status column of SHOW SCHEDULE: PAUSED
+// if the schedule has no next run, ACTIVE otherwise. It returns
+// errScheduleNotFound if the schedule does not exist.
+func CompactionScheduleStatus(
+	ctx context.Context, ie isql.Executor, env scheduledjobs.JobSchedulerEnv,
+) (string, error) {
+	row, err := ie.QueryRowEx(
+		ctx,
+		"load-sql-stats-schedule-status",
+		nil, /* txn */
+		sessiondata.NodeUserSessionDataOverride,
+		fmt.Sprintf(`
+SELECT (CASE WHEN next_run IS NULL THEN 'PAUSED' ELSE 'ACTIVE' END)
+FROM %s
+WHERE schedule_name = $1`, env.ScheduledJobsTableName()),
+		compactionScheduleName,
+	)
+	if err != nil {
+		return "", err
+	}
+	if row == nil {
+		return "", errScheduleNotFound
+	}
+	return string(tree.MustBeDString(row[0])), nil
+}
+
+// scheduleStoreRetryOptions are the options used by runScheduleStoreTxn to
+// retry the transient failures to access system.scheduled_jobs.
+var scheduleStoreRetryOptions = retry.Options{
+	InitialBackoff: 50 * time.Millisecond,
+	MaxBackoff:     time.Second,
+	Multiplier:     2,
+	MaxRetries:     5,
+}
+
+// runScheduleStoreTxn runs fn, which reads or updates the SQL Stats
+// compaction schedule, in a transaction. If the transaction fails because of a
+// transient failure to access system.scheduled_jobs, e.g. because its range is
+// unavailable, it is retried with backoff. Once the retries are exhausted, the
+// returned error is marked with ErrScheduleStoreUnavailable, so that callers
+// can tell it apart from a permanent failure, such as the schedule not being
+// found.
+func runScheduleStoreTxn(
+	ctx context.Context, db isql.DB, fn func(ctx context.Context, txn isql.Txn) error,
+) (err error) {
+	for r := retry.StartWithCtx(ctx, scheduleStoreRetryOptions); r.Next(); {
+		err = db.Txn(ctx, fn)
+		if err == nil || !isTransientScheduleStoreError(err) {
+			return err
+		}
+		log.VEventf(ctx, 2, "transient failure to access the sql stats compaction schedule: %v", err)
+	}
+	if ctx.Err() != nil {
+		return errors.CombineErrors(ctx.Err(), err)
+	}
+	return errors.Mark(
+		errors.Wrapf(err, "accessing the sql stats compaction schedule"), ErrScheduleStoreUnavailable,
+	)
+}
+
+// isScheduleNotFoundError returns whether err indicates that the SQL Stats
+// compaction schedule does not exist.
+func isScheduleNotFoundError(err error) bool {
+	return errors.Is(err, errScheduleNotFound) || jobs.HasScheduledJobNotFoundError(err)
+}
+
+// isTransientScheduleStoreError returns whether err may be a transient
+// failure to access system.scheduled_jobs, after which the operation can be
+// retried. Only the retryable errors, the ambiguous results and the
+// unavailability of the range or of the connection are transient. The other
+// errors, including the uncategorized ones, are not retried.
+func isTransientScheduleStoreError(err error) bool {
+	if isScheduleNotFoundError(err) || errors.Is(err, ErrDuplicatedSchedules) {
+		return false
+	}
+	if errors.HasType(err, (*kvpb.ReplicaUnavailableError)(nil)) ||
+		errors.HasType(err, (*kvpb.AmbiguousResultError)(nil)) ||
+		errors.HasInterface(err, (*kvpb.ClientVisibleRetryError)(nil)) ||
+		errors.HasInterface(err, (*kvpb.ClientVisibleAmbiguousError)(nil)) ||
+		pgerror.IsSQLRetryableError(err) {
+		return true
+	}
+	switch pgerror.GetPGCode(err) {
+	case pgcode.RangeUnavailable, pgcode.InternalConnectionFailure, pgcode.ConnectionFailure,
+		pgcode.StatementCompletionUnknown, pgcode.SerializationFailure:
+		return true
+	default:
+		return false
+	}
+}
+
+// loadCompactionSchedule loads the SQL Stats compaction schedule. It returns
+// errScheduleNotFound if the schedule does not exist.
+func loadCompactionSchedule(ctx context.Context, txn isql.Txn) (sj *jobs.ScheduledJob, _ error) {
+	row, err := txn.QueryRowEx(
+		ctx,
+		"load-sql-stats-scheduled-job",
+		txn.KV(),
+		sessiondata.NodeUserSessionDataOverride,
+		"SELECT schedule_id FROM system.scheduled_jobs WHERE schedule_name = $1",
+		compactionScheduleName,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if row == nil {
+		return nil, errScheduleNotFound
+	}
+
+	scheduledJobID := int64(tree.MustBeDInt(row[0]))
+
+	sj, err = jobs.ScheduledJobTxn(txn).Load(ctx, scheduledjobs.ProdJobSchedulerEnv, scheduledJobID)
+	if err != nil {
+		return nil, err
+	}
+
+	return sj, nil
+}
+
+// LoadSQLStatsSchedules loads the schedules of the SQL Stats subsystem, in the
+// order of their IDs. Along with each schedule, it returns the creation time
+// of the most recent job started by the schedule, or the zero time if the
+// schedule has not started any job yet.
+func LoadSQLStatsSchedules(
+	ctx context.Context, db isql.DB, env scheduledjobs.JobSchedulerEnv,
+) (schedules []*jobs.ScheduledJob, lastRuns []time.Time, _ error) {
+	rows, err := db.Executor().QueryBufferedEx(
+		ctx,
+		"list-sql-stats-schedules",
+		nil, /* txn */
+		sessiondata.NodeUserSessionDataOverride,
+		fmt.Sprintf(`
+SELECT schedule_id
+FROM %s
+WHERE schedule_name = ANY($1)
+ORDER BY schedule_id`, env.ScheduledJobsTableName()),
+		sqlStatsScheduleNames,
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, row := range rows {
+		sj, err := jobs.ScheduledJobDB(db).Load(ctx, env, int64(tree.MustBeDInt(row[0])))
+		if err != nil {
+			return nil, nil, err
+		}
+		lastRunRow, err := db.Executor().QueryRowEx(
+			ctx,
+			"load-sql-stats-schedule-last-run",
+			nil, /* txn */
+			sessiondata.NodeUserSessionDataOverride,
+			fmt.Sprintf(`
+SELECT max(created)
+FROM %s
+WHERE created_by_type = $1 AND created_by_id = $2`, env.SystemJobsTableName()),
+			jobs.CreatedByScheduledJobs,
+			sj.ScheduleID(),
+		)
+		if err != nil {
+			return nil, nil, err
+		}
+		if lastRunRow == nil {
+			return nil, nil, errors.AssertionFailedf("unexpected empty result when loading the last run")
+		}
+		var lastRun time.Time
+		if lastRunRow[0] != tree.DNull {
+			lastRun = tree.MustBeDTimestamp(lastRunRow[0]).Time
+		}
+		schedules = append(schedules, sj)
+		lastRuns = append(lastRuns, lastRun)
+	}
+	return schedules, lastRuns, nil
+}
+
 func checkExistingCompactionSchedule(ctx context.Context, txn isql.Txn) (exists bool, _ error) {
 	query := "SELECT count(*) FROM system.scheduled_jobs WHERE schedule_name = $1"
 
@@ -0,0 +1,193 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package persistedsqlstats
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/pgwire/pgcode"
+	"github.com/cockroachdb/cockroach/pkg/sql/pgwire/pgerror"
+	"github.com/cockroachdb/cockroach/pkg/sql/sem/tree"
+	"github.com/cockroachdb/cockroach/pkg/sql/sessiondata"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/cockroachdb/errors"
+)
+
+// isRowSpecificDeleteError returns whether err, returned by the deletion of
+// some stale rows, may be caused by some of the deleted rows only, e.g.
+// because they are corrupted, so that the other rows can still be deleted.
+// The other errors, e.g. unavailable ranges or ambiguous results, are not
+// specific to the rows and fail the compaction run: the retryable errors are
+// already retried by the transaction, and the next run retries the others.
+func isRowSpecificDeleteError(err error) bool {
+	if errors.HasAssertionFailure(err) {
+		// The decoding failures of corrupted rows are assertion failures.
+		return true
+	}
+	switch pgerror.GetPGCode(err) {
+	case pgcode.DataCorrupted, pgcode.IndexCorrupted:
+		return true
+	default:
+		return false
+	}
+}
+
+// removeOldestRowsIndividually deletes up to rowsToRemove of the oldest rows
+// of the given hash bucket that match the given predicates, following
+// lastRow if it is set, one row at a time. It is used once a batched
+// deletion of removeOldestRowsForShard failed because some of the rows cannot
+// be deleted, see isRowSpecificDeleteError: the rows that cannot be
+// deleted are skipped and counted in the SkippedRows metric, with a warning
+// logged for each batch holding such rows, so that the other rows are still
+// removed. The skipped rows count towards rowsToRemove, so that the removal
+// stays bounded. The number of rows that were removed is returned.
+func (c *StatsCompactor) removeOldestRowsIndividually(
+	ctx context.Context,
+	ops *cleanupOperations,
+	shardIdx, rowsToRemove int64,
+	predicates string,
+	lastRow tree.Datums,
+) (totalRowsRemoved int64, err error) {
+	var qargs []interface{}
+	maxRowsPerBatch := CompactionJobRowsToDeletePerTxn.Get(&c.st.SV)
+	delStmt := ops.getDeleteRowStmt()
+
+	for remainToBeRemoved := rowsToRemove; remainToBeRemoved > 0; {
+		if c.cleanupWindowClosed(ctx) {
+			break
+		}
+		limit := remainToBeRemoved
+		if limit > maxRowsPerBatch {
+			limit = maxRowsPerBatch
+		}
+		qargs, err = c.getQargs(qargs, shardIdx, limit, lastRow)
+		if err != nil {
+			return totalRowsRemoved, err
+		}
+		var stmt string
+		stmt, qargs = c.bindProtectedFingerprints(ops.getRemovalCandidatesStmt(lastRow, predicates), qargs)
+		candidates, err := c.db.Executor().QueryBufferedEx(ctx,
+			"scan-old-sql-stats",
+			nil, /* txn */
+			sessiondata.NodeUserSessionDataOverride,
+			stmt,
+			qargs...,
+		)
+		if err != nil {
+			return totalRowsRemoved, err
+		}
+
+		var rowsRemoved, rowsSkipped int64
+		var firstErr error
+		for _, row := range candidates {
+			if len(row) != len(ops.keyColumns)+1 {
+				return totalRowsRemoved, errors.AssertionFailedf("unexpected number of column returned")
+			}
+			if err := c.deleteRow(ctx, delStmt, row); err != nil {
+				if ctx.Err() != nil || !isRowSpecificDeleteError(err) {
+					return totalRowsRemoved, err
+				}
+				if firstErr == nil {
+					firstErr = err
+				}
+				rowsSkipped++
+				continue
+			}
+			rowsRemoved++
+		}
+		if rowsSkipped > 0 {
+			c.addSkippedRows(ops.table, shardIdx, rowsSkipped)
+			if c.metrics.SkippedRows != nil {
+				c.metrics.SkippedRows.Inc(rowsSkipped)
+			}
+			log.Warningf(ctx, "skipped %d stale rows of %s that could not be deleted: %v",
+				rowsSkipped, ops.table, firstErr)
+		}
+		c.metrics.RowsRemoved.Inc(rowsRemoved)
+		totalRowsRemoved += rowsRemoved
+		if err := c.waitForDeleteRate(ctx, rowsRemoved); err != nil {
+			return totalRowsRemoved, err
+		}
+
+		if int64(len(candidates)) < limit {
+			break
+		}
+		lastRow = candidates[len(candidates)-1]
+		remainToBeRemoved -= limit
+	}
+
+	return totalRowsRemoved, nil
+}
+
+// deleteRow deletes the row identified by the given aggregated_ts and key
+// columns, in its own transaction.
+func (c *StatsCompactor) deleteRow(ctx context.Context, delStmt string, row tree.Datums) error {
+	qargs := make([]interface{}, len(row))
+	for i, value := range row {
+		qargs[i] = value
+	}
+	if err := c.beforeDelete(delStmt, qargs); err != nil {
+		return err
+	}
+	_, err := c.db.Executor().ExecEx(ctx,
+		"delete-old-sql-stats-row",
+		nil, /* txn */
+		sessiondata.NodeUserSessionDataOverride,
+		delStmt,
+		qargs...,
+	)
+	return err
+}
+
+// beforeDelete calls the BeforeCompactionDelete testing knob, if set, with
+// the given DELETE statement and its arguments.
+func (c *StatsCompactor) beforeDelete(stmt string, qargs []interface{}) error {
+	if c.knobs != nil && c.knobs.BeforeCompactionDelete != nil {
+		return c.knobs.BeforeCompactionDelete(stmt, qargs)
+	}
+	return nil
+}
+
+// getRemovalCandidatesStmt returns the statement selecting the primary key,
+// without the hash bucket, of the rows that the DELETE statement built by
+// getDeleteStmt removes, with the same arguments, see getQargs. Unlike the
+// DELETE statement, the rows start strictly after lastRow if it is set, and
+// they are fully ordered, so that the rows that were skipped are not
+// selected again.
+func (c *cleanupOperations) getRemovalCandidatesStmt(
+	lastRow tree.Datums, predicates string,
+) string {
+	columns := strings.Join(append([]string{"aggregated_ts"}, c.keyColumns...), ", ")
+	var bound string
+	if len(lastRow) > 0 {
+		placeholders := make([]string, len(lastRow))
+		for i := range lastRow {
+			placeholders[i] = fmt.Sprintf("$%d", i+4)
+		}
+		bound = fmt.Sprintf(`
+        AND (%s) > (%s)`, columns, strings.Join(placeholders, ", "))
+	}
+	return fmt.Sprintf(`
+      SELECT %[1]s
+      FROM %[2]s AS s
+      WHERE %[3]s = $1%[4]s
+        AND aggregated_ts < $3%[5]s
+      ORDER BY %[1]s
+      LIMIT $2`, columns, c.table, c.shardColumn, bound, predicates)
+}
+
+// getDeleteRowStmt returns the statement deleting the row identified by its
+// aggregated_ts ($1) and key columns (from $2).
+func (c *cleanupOperations) getDeleteRowStmt() string {
+	return fmt.Sprintf(`DELETE FROM %s WHERE aggregated_ts = $1%s`, c.table, c.keyPredicates(2))
+}
@@ -12,8 +12,11 @@ package persistedsqlstats_test
 
 import (
 	"context"
+	gosql "database/sql"
 	"fmt"
+	"math"
 	"regexp"
+	"strings"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -25,20 +28,29 @@ import (
 	"github.com/cockroachdb/cockroach/pkg/kv/kvserver"
 	"github.com/cockroachdb/cockroach/pkg/roachpb"
 	"github.com/cockroachdb/cockroach/pkg/sql"
+	"github.com/cockroachdb/cockroach/pkg/sql/appstatspb"
 	"github.com/cockroachdb/cockroach/pkg/sql/catalog"
 	"github.com/cockroachdb/cockroach/pkg/sql/catalog/systemschema"
 	"github.com/cockroachdb/cockroach/pkg/sql/isql"
+	"github.com/cockroachdb/cockroach/pkg/sql/pgwire/pgcode"
+	"github.com/cockroachdb/cockroach/pkg/sql/pgwire/pgerror"
+	"github.com/cockroachdb/cockroach/pkg/sql/sem/tree"
 	"github.com/cockroachdb/cockroach/pkg/sql/sessiondata"
 	"github.com/cockroachdb/cockroach/pkg/sql/sqlstats"
 	"github.com/cockroachdb/cockroach/pkg/sql/sqlstats/persistedsqlstats"
 	"github.com/cockroachdb/cockroach/pkg/sql/tests"
+	"github.com/cockroachdb/cockroach/pkg/testutils"
 	"github.com/cockroachdb/cockroach/pkg/testutils/serverutils"
 	"github.com/cockroachdb/cockroach/pkg/testutils/sqlutils"
+	"github.com/cockroachdb/cockroach/pkg/util/ctxgroup"
 	"github.com/cockroachdb/cockroach/pkg/util/encoding"
 	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
 	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/cockroachdb/cockroach/pkg/util/log/logpb"
 	"github.com/cockroachdb/cockroach/pkg/util/metric"
+	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
 	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
+	"github.com/cockroachdb/errors"
 	"github.com/stretchr/testify/require"
 )
 
@@ -53,7 +65,7 @@ func TestSQLStatsCompactorNilTestingKnobCheck(t *testing.T) {
 	statsCompactor := persistedsqlstats.NewStatsCompactor(
 		server.ClusterSettings(),
 		server.InternalDB().(isql.DB),
-		metric.NewCounter(metric.Metadata{}),
+		persistedsqlstats.CompactorMetrics{RowsRemoved: metric.NewCounter(metric.Metadata{})},
 		nil, /* knobs */
 	)
 
@@ -191,7 +203,7 @@ func TestSQLStatsCompactor(t *testing.T) {
 			statsCompactor := persistedsqlstats.NewStatsCompactor(
 				server.ClusterSettings(),
 				server.InternalDB().(isql.DB),
-				metric.NewCounter(metric.Metadata{}),
+				persistedsqlstats.CompactorMetrics{RowsRemoved: metric.NewCounter(metric.Metadata{})},
 				&sqlstats.TestingKnobs{
 					AOSTClause:             "AS OF SYSTEM TIME '-1us'",
 					OnCleanupStartForShard: cleanupInterceptor.intercept,
@@ -261,6 +273,2568 @@ func TestSQLStatsCompactor(t *testing.T) {
 	}
 }
 
+func TestSQLStatsCompactorCatchUpMode(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	ctx := context.Background()
+	server, conn, _ := serverutils.StartServer(
+		t, base.TestServerArgs{
+			Knobs: base.TestingKnobs{
+				SQLStatsKnobs: &sqlstats.TestingKnobs{
+					AOSTClause: "AS OF SYSTEM TIME '-1us'",
+					StubTimeNow: func() time.Time {
+						return timeutil.Now().Add(-2 * time.Hour)
+					},
+				},
+			},
+		},
+	)
+	defer server.Stopper().Stop(ctx)
+
+	sqlConn := sqlutils.MakeSQLRunner(conn)
+	sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.flush.interval = '24h'")
+	sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.cleanup.recurrence = '@yearly'")
+	sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.persisted_rows.max = 8")
+	sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.cleanup.catchup.enabled = true")
+	sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.cleanup.catchup.backlog_threshold = 2")
+	sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.cleanup.catchup.rows_per_run = 16")
+
+	generateFingerprints(t, sqlConn, 100 /* distinctFingerprints */)
+	server.SQLServer().(*sql.Server).
+		GetSQLStatsProvider().(*persistedsqlstats.PersistedSQLStats).Flush(ctx)
+
+	statsCompactor := persistedsqlstats.NewStatsCompactor(
+		server.ClusterSettings(),
+		server.InternalDB().(isql.DB),
+		persistedsqlstats.CompactorMetrics{RowsRemoved: metric.NewCounter(metric.Metadata{})},
+		&sqlstats.TestingKnobs{
+			AOSTClause: "AS OF SYSTEM TIME '-1us'",
+			StubTimeNow: func() time.Time {
+				return timeutil.Now()
+			},
+		},
+	)
+
+	stmtStatsCnt, _ := getPersistedStatsEntry(t, sqlConn)
+	require.GreaterOrEqual(t, stmtStatsCnt, 100)
+
+	// Each run in catch-up mode removes at most 16 rows (2 per shard).
+	require.NoError(t, statsCompactor.DeleteOldestEntries(ctx))
+	stmtStatsCntAfterFirstRun, _ := getPersistedStatsEntry(t, sqlConn)
+	require.Less(t, stmtStatsCntAfterFirstRun, stmtStatsCnt)
+	require.LessOrEqual(t, stmtStatsCnt-stmtStatsCntAfterFirstRun, 16)
+
+	// Subsequent runs make further progress.
+	require.NoError(t, statsCompactor.DeleteOldestEntries(ctx))
+	stmtStatsCntAfterSecondRun, _ := getPersistedStatsEntry(t, sqlConn)
+	require.Less(t, stmtStatsCntAfterSecondRun, stmtStatsCntAfterFirstRun)
+
+	// Once catch-up mode is disabled, a single run enforces the row limit.
+	sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.cleanup.catchup.enabled = false")
+	require.NoError(t, statsCompactor.DeleteOldestEntries(ctx))
+	stmtStatsCnt, txnStatsCnt := getPersistedStatsEntry(t, sqlConn)
+	require.GreaterOrEqual(t, 8, stmtStatsCnt)
+	require.GreaterOrEqual(t, 8, txnStatsCnt)
+}
+
+func TestSQLStatsCompactorOldestRowAge(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	ctx := context.Background()
+	server, conn, _ := serverutils.StartServer(
+		t, base.TestServerArgs{
+			Knobs: base.TestingKnobs{
+				SQLStatsKnobs: &sqlstats.TestingKnobs{
+					AOSTClause: "AS OF SYSTEM TIME '-1us'",
+					StubTimeNow: func() time.Time {
+						return timeutil.Now().Add(-2 * time.Hour)
+					},
+				},
+			},
+		},
+	)
+	defer server.Stopper().Stop(ctx)
+
+	sqlConn := sqlutils.MakeSQLRunner(conn)
+	sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.flush.interval = '24h'")
+	sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.cleanup.recurrence = '@yearly'")
+
+	metrics := persistedsqlstats.CompactorMetrics{
+		RowsRemoved:  metric.NewCounter(metric.Metadata{}),
+		OldestRowAge: metric.NewGauge(metric.Metadata{}),
+	}
+	statsCompactor := persistedsqlstats.NewStatsCompactor(
+		server.ClusterSettings(),
+		server.InternalDB().(isql.DB),
+		metrics,
+		&sqlstats.TestingKnobs{
+			AOSTClause: "AS OF SYSTEM TIME '-1us'",
+		},
+	)
+
+	// Empty tables are reported with an age of zero.
+	sqlConn.Exec(t, "SELECT crdb_internal.reset_sql_stats()")
+	require.NoError(t, statsCompactor.DeleteOldestEntries(ctx))
+	require.Zero(t, metrics.OldestRowAge.Value())
+
+	// The stats are flushed into an aggregation bucket that is two hours old.
+	generateFingerprints(t, sqlConn, 10 /* distinctFingerprints */)
+	server.SQLServer().(*sql.Server).
+		GetSQLStatsProvider().(*persistedsqlstats.PersistedSQLStats).Flush(ctx)
+
+	require.NoError(t, statsCompactor.DeleteOldestEntries(ctx))
+	minAge := int64((2 * time.Hour).Seconds())
+	maxAge := int64((3 * time.Hour).Seconds())
+	require.GreaterOrEqual(t, metrics.OldestRowAge.Value(), minAge)
+	require.LessOrEqual(t, metrics.OldestRowAge.Value(), maxAge)
+}
+
+func TestSQLStatsCompactorDistinctAppNames(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	ctx := context.Background()
+	server, conn, _ := serverutils.StartServer(t, base.TestServerArgs{})
+	defer server.Stopper().Stop(ctx)
+
+	sqlConn := sqlutils.MakeSQLRunner(conn)
+	sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.flush.interval = '24h'")
+	sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.cleanup.recurrence = '@yearly'")
+	sqlConn.Exec(t, "SELECT crdb_internal.reset_sql_stats()")
+
+	metrics := persistedsqlstats.CompactorMetrics{
+		RowsRemoved:      metric.NewCounter(metric.Metadata{}),
+		DistinctAppNames: metric.NewGauge(metric.Metadata{}),
+	}
+	statsCompactor := persistedsqlstats.NewStatsCompactor(
+		server.ClusterSettings(),
+		server.InternalDB().(isql.DB),
+		metrics,
+		&sqlstats.TestingKnobs{
+			AOSTClause: "AS OF SYSTEM TIME '-1us'",
+		},
+	)
+
+	for _, appName := range []string{"app_a", "app_b", "app_c"} {
+		sqlConn.Exec(t, "SET application_name = $1", appName)
+		sqlConn.Exec(t, "SELECT 1")
+	}
+	sqlConn.Exec(t, "RESET application_name")
+	server.SQLServer().(*sql.Server).
+		GetSQLStatsProvider().(*persistedsqlstats.PersistedSQLStats).Flush(ctx)
+
+	require.NoError(t, statsCompactor.DeleteOldestEntries(ctx))
+
+	// The stats of the internal queries are persisted as well, under their
+	// own application names.
+	var expected int64
+	sqlConn.QueryRow(t, `
+SELECT count(*) FROM (
+  SELECT app_name FROM system.statement_statistics
+  UNION
+  SELECT app_name FROM system.transaction_statistics
+)`).Scan(&expected)
+	require.GreaterOrEqual(t, expected, int64(3))
+	require.Equal(t, expected, metrics.DistinctAppNames.Value())
+}
+
+func TestSQLStatsCompactorAgeOnlyRetention(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	ctx := context.Background()
+	var stubTime atomic.Value
+	stubTime.Store(timeutil.Now().Add(-2 * time.Hour))
+	server, conn, _ := serverutils.StartServer(
+		t, base.TestServerArgs{
+			Knobs: base.TestingKnobs{
+				SQLStatsKnobs: &sqlstats.TestingKnobs{
+					AOSTClause: "AS OF SYSTEM TIME '-1us'",
+					StubTimeNow: func() time.Time {
+						return stubTime.Load().(time.Time)
+					},
+				},
+			},
+		},
+	)
+	defer server.Stopper().Stop(ctx)
+
+	sqlConn := sqlutils.MakeSQLRunner(conn)
+	sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.flush.interval = '24h'")
+	sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.cleanup.recurrence = '@yearly'")
+	sqlConn.Exec(t, "SELECT crdb_internal.reset_sql_stats()")
+
+	// Flush a first set of stats into an aggregation interval that is two
+	// hours old, and a second one into the current interval.
+	sqlStats := server.SQLServer().(*sql.Server).
+		GetSQLStatsProvider().(*persistedsqlstats.PersistedSQLStats)
+	generateFingerprints(t, sqlConn, 10 /* distinctFingerprints */)
+	sqlStats.Flush(ctx)
+	stubTime.Store(timeutil.Now())
+	generateFingerprints(t, sqlConn, 10 /* distinctFingerprints */)
+	sqlStats.Flush(ctx)
+
+	countRows := func(table string, old bool) (cnt int) {
+		cmp := ">="
+		if old {
+			cmp = "<"
+		}
+		sqlConn.QueryRow(t, fmt.Sprintf(
+			"SELECT count(*) FROM %s WHERE aggregated_ts %s now() - INTERVAL '1h'", table, cmp,
+		)).Scan(&cnt)
+		return cnt
+	}
+	tables := []string{"system.statement_statistics", "system.transaction_statistics"}
+	recentRows := make([]int, len(tables))
+	for i, table := range tables {
+		require.Greater(t, countRows(table, true /* old */), 0)
+		recentRows[i] = countRows(table, false /* old */)
+		require.Greater(t, recentRows[i], 0)
+	}
+
+	// Without a row cap, only the rows older than the age limit are removed,
+	// however many rows the tables hold.
+	sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.persisted_rows.max = 0")
+	sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.persisted_rows.max_age = '1h'")
+	statsCompactor := persistedsqlstats.NewStatsCompactor(
+		server.ClusterSettings(),
+		server.InternalDB().(isql.DB),
+		persistedsqlstats.CompactorMetrics{RowsRemoved: metric.NewCounter(metric.Metadata{})},
+		&sqlstats.TestingKnobs{
+			AOSTClause: "AS OF SYSTEM TIME '-1us'",
+		},
+	)
+	require.NoError(t, statsCompactor.DeleteOldestEntries(ctx))
+	for i, table := range tables {
+		require.Zero(t, countRows(table, true /* old */))
+		require.Equal(t, recentRows[i], countRows(table, false /* old */))
+	}
+
+	sqlConn.ExpectErr(t, "cannot be set to a negative value",
+		"SET CLUSTER SETTING sql.stats.persisted_rows.max = -1")
+	sqlConn.ExpectErr(t, "cannot be set to a negative duration",
+		"SET CLUSTER SETTING sql.stats.persisted_rows.max_age = '-1h'")
+	sqlConn.ExpectErr(t, "cannot be set to a value shorter than 1m0s",
+		"SET CLUSTER SETTING sql.stats.persisted_rows.max_age = '10s'")
+	sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.persisted_rows.max_age = '0s'")
+}
+
+func TestSQLStatsCompactorRetainRecentlyExecuted(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	ctx := context.Background()
+	var stubTime atomic.Value
+	stubTime.Store(timeutil.Now().Add(-2 * time.Hour))
+	server, conn, _ := serverutils.StartServer(
+		t, base.TestServerArgs{
+			Knobs: base.TestingKnobs{
+				SQLStatsKnobs: &sqlstats.TestingKnobs{
+					AOSTClause: "AS OF SYSTEM TIME '-1us'",
+					StubTimeNow: func() time.Time {
+						return stubTime.Load().(time.Time)
+					},
+				},
+			},
+		},
+	)
+	defer server.Stopper().Stop(ctx)
+
+	sqlConn := sqlutils.MakeSQLRunner(conn)
+	sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.flush.interval = '24h'")
+	sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.cleanup.recurrence = '@yearly'")
+	sqlConn.Exec(t, "SELECT crdb_internal.reset_sql_stats()")
+
+	// Flush a first set of stats into an aggregation interval that is two
+	// hours old, and re-execute some of the fingerprints in the current
+	// interval. All the fingerprints are also executed in the current interval
+	// by another application, which must not retain the rows of the first one.
+	sqlStats := server.SQLServer().(*sql.Server).
+		GetSQLStatsProvider().(*persistedsqlstats.PersistedSQLStats)
+	generateFingerprints(t, sqlConn, 10 /* distinctFingerprints */)
+	sqlStats.Flush(ctx)
+	stubTime.Store(timeutil.Now())
+	generateFingerprints(t, sqlConn, 3 /* distinctFingerprints */)
+	sqlConn.Exec(t, "SET application_name = 'other_app'")
+	generateFingerprints(t, sqlConn, 10 /* distinctFingerprints */)
+	sqlConn.Exec(t, "RESET application_name")
+	sqlStats.Flush(ctx)
+
+	tables := []string{"system.statement_statistics", "system.transaction_statistics"}
+	for _, table := range tables {
+		var cnt int
+		sqlConn.QueryRow(t, fmt.Sprintf(
+			"SELECT count(*) FROM %s WHERE last_execution_ts IS NULL", table,
+		)).Scan(&cnt)
+		require.Zero(t, cnt, "last_execution_ts is not populated in %s", table)
+	}
+
+	// countOldRows returns the number of rows older than the age limit of the
+	// fingerprints that were, or were not, executed by the same application
+	// within the age limit.
+	countOldRows := func(table string, executedRecently bool) (cnt int) {
+		not := "NOT"
+		if executedRecently {
+			not = ""
+		}
+		sqlConn.QueryRow(t, fmt.Sprintf(`
+SELECT count(*) FROM %[1]s AS s
+WHERE aggregated_ts < now() - INTERVAL '1h'
+AND %[2]s EXISTS (
+  SELECT 1 FROM %[1]s AS r
+  WHERE r.fingerprint_id = s.fingerprint_id
+  AND r.app_name = s.app_name
+  AND r.last_execution_ts >= now() - INTERVAL '1h'
+)`, table, not)).Scan(&cnt)
+		return cnt
+	}
+	recentlyExecutedRows := make([]int, len(tables))
+	for i, table := range tables {
+		require.Greater(t, countOldRows(table, false /* executedRecently */), 0)
+		recentlyExecutedRows[i] = countOldRows(table, true /* executedRecently */)
+		require.Greater(t, recentlyExecutedRows[i], 0)
+	}
+
+	// Only the old rows of the fingerprints that were not executed within the
+	// age limit are removed.
+	sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.persisted_rows.max = 0")
+	sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.persisted_rows.max_age = '1h'")
+	sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.cleanup.retain_recently_executed.enabled = true")
+	statsCompactor := persistedsqlstats.NewStatsCompactor(
+		server.ClusterSettings(),
+		server.InternalDB().(isql.DB),
+		persistedsqlstats.CompactorMetrics{RowsRemoved: metric.NewCounter(metric.Metadata{})},
+		&sqlstats.TestingKnobs{
+			AOSTClause: "AS OF SYSTEM TIME '-1us'",
+		},
+	)
+	// The estimate of the dry run of the compaction excludes the retained
+	// rows as well.
+	estimates, err := statsCompactor.EstimateRowsToRemove(ctx)
+	require.NoError(t, err)
+	for i, table := range tables {
+		require.Equal(t, table, estimates[i].Table)
+		require.Equal(t, int64(countOldRows(table, false /* executedRecently */)), estimates[i].Rows)
+	}
+	require.NoError(t, statsCompactor.DeleteOldestEntries(ctx))
+	for i, table := range tables {
+		require.Zero(t, countOldRows(table, false /* executedRecently */))
+		require.Equal(t, recentlyExecutedRows[i], countOldRows(table, true /* executedRecently */))
+	}
+}
+
+func TestSQLStatsCompactorRetainLatestPerFingerprint(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	ctx := context.Background()
+	var stubTime atomic.Value
+	stubTime.Store(timeutil.Now().Add(-2 * time.Hour))
+	server, conn, _ := serverutils.StartServer(
+		t, base.TestServerArgs{
+			Knobs: base.TestingKnobs{
+				SQLStatsKnobs: &sqlstats.TestingKnobs{
+					AOSTClause: "AS OF SYSTEM TIME '-1us'",
+					StubTimeNow: func() time.Time {
+						return stubTime.Load().(time.Time)
+					},
+				},
+			},
+		},
+	)
+	defer server.Stopper().Stop(ctx)
+
+	sqlConn := sqlutils.MakeSQLRunner(conn)
+	sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.flush.interval = '24h'")
+	sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.cleanup.recurrence = '@yearly'")
+	sqlConn.Exec(t, "SELECT crdb_internal.reset_sql_stats()")
+
+	// Flush a first set of stats into an aggregation interval that is two
+	// hours old, and re-execute some of the fingerprints in the current
+	// interval.
+	sqlStats := server.SQLServer().(*sql.Server).
+		GetSQLStatsProvider().(*persistedsqlstats.PersistedSQLStats)
+	generateFingerprints(t, sqlConn, 10 /* distinctFingerprints */)
+	sqlStats.Flush(ctx)
+	stubTime.Store(timeutil.Now())
+	generateFingerprints(t, sqlConn, 3 /* distinctFingerprints */)
+	sqlStats.Flush(ctx)
+
+	tables := []string{"system.statement_statistics", "system.transaction_statistics"}
+	countFingerprints := func(table string) (cnt int) {
+		sqlConn.QueryRow(t,
+			fmt.Sprintf("SELECT count(DISTINCT fingerprint_id) FROM %s", table),
+		).Scan(&cnt)
+		return cnt
+	}
+	// countSupersededRows returns the number of rows of the fingerprints that
+	// have a more recent row.
+	countSupersededRows := func(table string) (cnt int) {
+		sqlConn.QueryRow(t, fmt.Sprintf(`
+SELECT count(*) FROM %[1]s AS s
+WHERE EXISTS (
+  SELECT 1 FROM %[1]s AS r
+  WHERE r.fingerprint_id = s.fingerprint_id AND r.aggregated_ts > s.aggregated_ts
+)`, table)).Scan(&cnt)
+		return cnt
+	}
+	fingerprints := make([]int, len(tables))
+	for i, table := range tables {
+		fingerprints[i] = countFingerprints(table)
+		require.Greater(t, countSupersededRows(table), 0)
+	}
+
+	// A row cap far below the number of fingerprints removes all the rows but
+	// the latest one of each fingerprint.
+	sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.persisted_rows.max = 1")
+	sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.cleanup.retain_latest_per_fingerprint = true")
+	statsCompactor := persistedsqlstats.NewStatsCompactor(
+		server.ClusterSettings(),
+		server.InternalDB().(isql.DB),
+		persistedsqlstats.CompactorMetrics{RowsRemoved: metric.NewCounter(metric.Metadata{})},
+		&sqlstats.TestingKnobs{
+			AOSTClause: "AS OF SYSTEM TIME '-1us'",
+		},
+	)
+	require.NoError(t, statsCompactor.DeleteOldestEntries(ctx))
+	for i, table := range tables {
+		require.Equal(t, fingerprints[i], countFingerprints(table))
+		require.Zero(t, countSupersededRows(table))
+	}
+}
+
+func TestSQLStatsCompactorProtectedFingerprints(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	ctx := context.Background()
+	var stubTime atomic.Value
+	stubTime.Store(timeutil.Now().Add(-2 * time.Hour))
+	server, conn, _ := serverutils.StartServer(
+		t, base.TestServerArgs{
+			Knobs: base.TestingKnobs{
+				SQLStatsKnobs: &sqlstats.TestingKnobs{
+					AOSTClause: "AS OF SYSTEM TIME '-1us'",
+					StubTimeNow: func() time.Time {
+						return stubTime.Load().(time.Time)
+					},
+				},
+			},
+		},
+	)
+	defer server.Stopper().Stop(ctx)
+
+	sqlConn := sqlutils.MakeSQLRunner(conn)
+	sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.flush.interval = '24h'")
+	sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.cleanup.recurrence = '@yearly'")
+	sqlConn.Exec(t, "SELECT crdb_internal.reset_sql_stats()")
+
+	sqlStats := server.SQLServer().(*sql.Server).
+		GetSQLStatsProvider().(*persistedsqlstats.PersistedSQLStats)
+	generateFingerprints(t, sqlConn, 20 /* distinctFingerprints */)
+	sqlStats.Flush(ctx)
+	stubTime.Store(timeutil.Now())
+
+	// Protect a fingerprint with a single row, in a hash bucket that holds
+	// other rows.
+	var fingerprintIDBuffer []byte
+	sqlConn.QueryRow(t, `
+SELECT fingerprint_id FROM (
+  SELECT fingerprint_id,
+    count(*) OVER (PARTITION BY fingerprint_id) AS fingerprint_rows,
+    count(*) OVER (PARTITION BY crdb_internal_aggregated_ts_app_name_fingerprint_id_node_id_plan_hash_transaction_fingerprint_id_shard_8) AS bucket_rows
+  FROM system.statement_statistics
+)
+WHERE fingerprint_rows = 1 AND bucket_rows > 1
+LIMIT 1`).Scan(&fingerprintIDBuffer)
+	_, fingerprintID, err := encoding.DecodeUint64Ascending(fingerprintIDBuffer)
+	require.NoError(t, err)
+	unregister := persistedsqlstats.RegisterProtectedFingerprintsProvider(
+		func(ctx context.Context) ([]appstatspb.StmtFingerprintID, error) {
+			return []appstatspb.StmtFingerprintID{appstatspb.StmtFingerprintID(fingerprintID)}, nil
+		})
+	defer unregister()
+
+	// A row cap of one row per hash bucket keeps the protected row, and
+	// removes the other rows of its bucket.
+	sqlConn.Exec(t, fmt.Sprintf("SET CLUSTER SETTING sql.stats.persisted_rows.max = %d",
+		systemschema.SQLStatsHashShardBucketCount))
+	statsCompactor := persistedsqlstats.NewStatsCompactor(
+		server.ClusterSettings(),
+		server.InternalDB().(isql.DB),
+		persistedsqlstats.CompactorMetrics{RowsRemoved: metric.NewCounter(metric.Metadata{})},
+		&sqlstats.TestingKnobs{
+			AOSTClause: "AS OF SYSTEM TIME '-1us'",
+		},
+	)
+	require.NoError(t, statsCompactor.DeleteOldestEntries(ctx))
+
+	var protectedRows, bucketRows int
+	sqlConn.QueryRow(t, `
+SELECT count(*) FILTER (WHERE fingerprint_id = $1), count(*)
+FROM system.statement_statistics
+WHERE crdb_internal_aggregated_ts_app_name_fingerprint_id_node_id_plan_hash_transaction_fingerprint_id_shard_8 IN (
+  SELECT crdb_internal_aggregated_ts_app_name_fingerprint_id_node_id_plan_hash_transaction_fingerprint_id_shard_8
+  FROM system.statement_statistics WHERE fingerprint_id = $1
+)`, fingerprintIDBuffer).Scan(&protectedRows, &bucketRows)
+	require.Equal(t, 1, protectedRows)
+	require.Equal(t, 1, bucketRows)
+
+	// A provider that fails does not fail the compaction, and the fingerprints
+	// of the other providers remain protected.
+	unregisterFailing := persistedsqlstats.RegisterProtectedFingerprintsProvider(
+		func(ctx context.Context) ([]appstatspb.StmtFingerprintID, error) {
+			return nil, errors.New("injected error")
+		})
+	defer unregisterFailing()
+	require.NoError(t, statsCompactor.DeleteOldestEntries(ctx))
+	sqlConn.QueryRow(t,
+		"SELECT count(*) FROM system.statement_statistics WHERE fingerprint_id = $1",
+		fingerprintIDBuffer,
+	).Scan(&protectedRows)
+	require.Equal(t, 1, protectedRows)
+	unregisterFailing()
+
+	// Without protected fingerprints, the compaction removes the oldest rows
+	// as usual, including the row of the fingerprint that was protected.
+	unregister()
+	sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.persisted_rows.max = 1")
+	require.NoError(t, statsCompactor.DeleteOldestEntries(ctx))
+	var totalRows int
+	sqlConn.QueryRow(t, "SELECT count(*) FROM system.statement_statistics").Scan(&totalRows)
+	require.LessOrEqual(t, totalRows, 1)
+}
+
+func TestSQLStatsCompactorRetainPerPlan(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	ctx := context.Background()
+	var stubTime atomic.Value
+	stubTime.Store(timeutil.Now().Add(-3 * time.Hour))
+	server, conn, _ := serverutils.StartServer(
+		t, base.TestServerArgs{
+			Knobs: base.TestingKnobs{
+				SQLStatsKnobs: &sqlstats.TestingKnobs{
+					AOSTClause: "AS OF SYSTEM TIME '-1us'",
+					StubTimeNow: func() time.Time {
+						return stubTime.Load().(time.Time)
+					},
+				},
+			},
+		},
+	)
+	defer server.Stopper().Stop(ctx)
+
+	sqlConn := sqlutils.MakeSQLRunner(conn)
+	sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.flush.interval = '24h'")
+	sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.cleanup.recurrence = '@yearly'")
+	sqlConn.Exec(t, "SELECT crdb_internal.reset_sql_stats()")
+
+	// All the fingerprints are executed in an older window, and only half of
+	// them in a more recent one, so that the most recent window of the other
+	// half is the oldest one.
+	sqlStats := server.SQLServer().(*sql.Server).
+		GetSQLStatsProvider().(*persistedsqlstats.PersistedSQLStats)
+	sqlConn.Exec(t, "SET application_name = 'plans'")
+	generateFingerprints(t, sqlConn, 20 /* distinctFingerprints */)
+	sqlStats.Flush(ctx)
+	stubTime.Store(timeutil.Now().Add(-2 * time.Hour))
+	generateFingerprints(t, sqlConn, 10 /* distinctFingerprints */)
+	sqlStats.Flush(ctx)
+	sqlConn.Exec(t, "RESET application_name")
+	stubTime.Store(timeutil.Now())
+	sqlConn.Exec(t, "DELETE FROM system.statement_statistics WHERE app_name != 'plans'")
+
+	const latestPerPlanPredicate = `NOT EXISTS (
+  SELECT 1 FROM system.statement_statistics AS r
+  WHERE r.fingerprint_id = s.fingerprint_id AND r.plan_hash = s.plan_hash
+    AND r.aggregated_ts > s.aggregated_ts
+)`
+	var latestRows, maxLatestRowsPerShard int
+	sqlConn.QueryRow(t, fmt.Sprintf(`
+SELECT sum(cnt), max(cnt) FROM (
+  SELECT count(*) AS cnt
+  FROM system.statement_statistics AS s
+  WHERE %s
+  GROUP BY crdb_internal_aggregated_ts_app_name_fingerprint_id_node_id_plan_hash_transaction_fingerprint_id_shard_8
+)`, latestPerPlanPredicate)).Scan(&latestRows, &maxLatestRowsPerShard)
+	require.Greater(t, latestRows, 0)
+
+	// With a row cap that leaves room for the most recent row of each plan in
+	// every hash bucket, these rows are all retained, although some of them are
+	// the oldest rows.
+	sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.cleanup.retain_per_plan = true")
+	sqlConn.Exec(t, fmt.Sprintf("SET CLUSTER SETTING sql.stats.persisted_rows.max = %d",
+		maxLatestRowsPerShard*systemschema.SQLStatsHashShardBucketCount))
+	statsCompactor := persistedsqlstats.NewStatsCompactor(
+		server.ClusterSettings(),
+		server.InternalDB().(isql.DB),
+		persistedsqlstats.CompactorMetrics{RowsRemoved: metric.NewCounter(metric.Metadata{})},
+		&sqlstats.TestingKnobs{
+			AOSTClause: "AS OF SYSTEM TIME '-1us'",
+		},
+	)
+	require.NoError(t, statsCompactor.DeleteOldestEntries(ctx))
+	var latestRowsAfter int
+	sqlConn.QueryRow(t, fmt.Sprintf(
+		"SELECT count(*) FROM system.statement_statistics AS s WHERE app_name = 'plans' AND %s",
+		latestPerPlanPredicate,
+	)).Scan(&latestRowsAfter)
+	require.Equal(t, latestRows, latestRowsAfter)
+
+	// The row cap still applies to these rows once no other row can be
+	// removed.
+	sqlConn.Exec(t, fmt.Sprintf("SET CLUSTER SETTING sql.stats.persisted_rows.max = %d",
+		systemschema.SQLStatsHashShardBucketCount))
+	require.NoError(t, statsCompactor.DeleteOldestEntries(ctx))
+	var totalRows int
+	sqlConn.QueryRow(t,
+		"SELECT count(*) FROM system.statement_statistics WHERE app_name = 'plans'",
+	).Scan(&totalRows)
+	require.LessOrEqual(t, totalRows, systemschema.SQLStatsHashShardBucketCount)
+}
+
+func TestSQLStatsCompactorEvictionOrder(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	ctx := context.Background()
+	var stubTime atomic.Value
+	stubTime.Store(timeutil.Now().Add(-2 * time.Hour))
+	server, conn, _ := serverutils.StartServer(
+		t, base.TestServerArgs{
+			Knobs: base.TestingKnobs{
+				SQLStatsKnobs: &sqlstats.TestingKnobs{
+					AOSTClause: "AS OF SYSTEM TIME '-1us'",
+					StubTimeNow: func() time.Time {
+						return stubTime.Load().(time.Time)
+					},
+				},
+			},
+		},
+	)
+	defer server.Stopper().Stop(ctx)
+
+	sqlConn := sqlutils.MakeSQLRunner(conn)
+	sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.flush.interval = '24h'")
+	sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.cleanup.recurrence = '@yearly'")
+	sqlConn.Exec(t, "SELECT crdb_internal.reset_sql_stats()")
+
+	// A large application with many fingerprints, and a small one with a
+	// single fingerprint.
+	sqlConn.Exec(t, "SET application_name = 'large_app'")
+	generateFingerprints(t, sqlConn, 200 /* distinctFingerprints */)
+	sqlConn.Exec(t, "SET application_name = 'small_app'")
+	sqlConn.Exec(t, "SELECT 1")
+	sqlConn.Exec(t, "RESET application_name")
+	server.SQLServer().(*sql.Server).
+		GetSQLStatsProvider().(*persistedsqlstats.PersistedSQLStats).Flush(ctx)
+	stubTime.Store(timeutil.Now())
+
+	tables := []string{"system.statement_statistics", "system.transaction_statistics"}
+	// Only keep the rows of the two applications, so that the rows of the
+	// internal queries do not take part in the eviction.
+	for _, table := range tables {
+		sqlConn.Exec(t, fmt.Sprintf(
+			"DELETE FROM %s WHERE app_name NOT IN ('large_app', 'small_app')", table))
+	}
+	countRows := func(table, appName string) (cnt int) {
+		sqlConn.QueryRow(t,
+			fmt.Sprintf("SELECT count(*) FROM %s WHERE app_name = $1", table), appName,
+		).Scan(&cnt)
+		return cnt
+	}
+	smallAppRows := make([]int, len(tables))
+	for i, table := range tables {
+		smallAppRows[i] = countRows(table, "small_app")
+		require.Greater(t, smallAppRows[i], 0)
+	}
+
+	// With a limit of 8 rows per hash bucket, the buckets of the large
+	// application are over the limit, and the small application has fewer
+	// rows than half the limit in any bucket, so its rows are all retained.
+	const rowLimitPerShard = 8
+	sqlConn.Exec(t, fmt.Sprintf("SET CLUSTER SETTING sql.stats.persisted_rows.max = %d",
+		rowLimitPerShard*systemschema.SQLStatsHashShardBucketCount))
+	sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.cleanup.eviction_order = 'largest_app'")
+	statsCompactor := persistedsqlstats.NewStatsCompactor(
+		server.ClusterSettings(),
+		server.InternalDB().(isql.DB),
+		persistedsqlstats.CompactorMetrics{RowsRemoved: metric.NewCounter(metric.Metadata{})},
+		&sqlstats.TestingKnobs{
+			AOSTClause: "AS OF SYSTEM TIME '-1us'",
+		},
+	)
+	require.NoError(t, statsCompactor.DeleteOldestEntries(ctx))
+	for i, table := range tables {
+		require.Equal(t, smallAppRows[i], countRows(table, "small_app"), table)
+		require.LessOrEqual(t,
+			countRows(table, "small_app")+countRows(table, "large_app"),
+			rowLimitPerShard*systemschema.SQLStatsHashShardBucketCount, table)
+	}
+}
+
+func TestSQLStatsCompactorPinnedAppNames(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	ctx := context.Background()
+	var stubTime atomic.Value
+	stubTime.Store(timeutil.Now().Add(-2 * time.Hour))
+	server, conn, _ := serverutils.StartServer(
+		t, base.TestServerArgs{
+			Knobs: base.TestingKnobs{
+				SQLStatsKnobs: &sqlstats.TestingKnobs{
+					AOSTClause: "AS OF SYSTEM TIME '-1us'",
+					StubTimeNow: func() time.Time {
+						return stubTime.Load().(time.Time)
+					},
+				},
+			},
+		},
+	)
+	defer server.Stopper().Stop(ctx)
+
+	sqlConn := sqlutils.MakeSQLRunner(conn)
+	sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.flush.interval = '24h'")
+	sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.cleanup.recurrence = '@yearly'")
+	sqlConn.Exec(t, "SELECT crdb_internal.reset_sql_stats()")
+
+	for _, appName := range []string{"pinned_app", "other_app"} {
+		sqlConn.Exec(t, "SET application_name = $1", appName)
+		generateFingerprints(t, sqlConn, 10 /* distinctFingerprints */)
+	}
+	sqlConn.Exec(t, "RESET application_name")
+	server.SQLServer().(*sql.Server).
+		GetSQLStatsProvider().(*persistedsqlstats.PersistedSQLStats).Flush(ctx)
+	stubTime.Store(timeutil.Now())
+
+	tables := []string{"system.statement_statistics", "system.transaction_statistics"}
+	countRows := func(table, appName string) (cnt int) {
+		sqlConn.QueryRow(t,
+			fmt.Sprintf("SELECT count(*) FROM %s WHERE app_name = $1", table), appName,
+		).Scan(&cnt)
+		return cnt
+	}
+	pinnedRows := make([]int, len(tables))
+	for i, table := range tables {
+		pinnedRows[i] = countRows(table, "pinned_app")
+		require.Greater(t, pinnedRows[i], 0)
+		require.Greater(t, countRows(table, "other_app"), 0)
+	}
+
+	// A row cap of one row removes all the rows but the ones of the pinned
+	// application, and at most one other row.
+	sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.persisted_rows.max = 1")
+	sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.cleanup.pinned_app_names = ' unknown_app, pinned_app'")
+	statsCompactor := persistedsqlstats.NewStatsCompactor(
+		server.ClusterSettings(),
+		server.InternalDB().(isql.DB),
+		persistedsqlstats.CompactorMetrics{RowsRemoved: metric.NewCounter(metric.Metadata{})},
+		&sqlstats.TestingKnobs{
+			AOSTClause: "AS OF SYSTEM TIME '-1us'",
+		},
+	)
+	require.NoError(t, statsCompactor.DeleteOldestEntries(ctx))
+	for i, table := range tables {
+		require.Equal(t, pinnedRows[i], countRows(table, "pinned_app"), table)
+		require.LessOrEqual(t, countRows(table, "other_app"), 1, table)
+	}
+
+	// Above the safety cap, the rows of the pinned application are removed as
+	// the other rows.
+	sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.cleanup.pinned_app_names.max_rows = 1")
+	require.NoError(t, statsCompactor.DeleteOldestEntries(ctx))
+	for _, table := range tables {
+		require.LessOrEqual(t, countRows(table, "pinned_app"), 1, table)
+	}
+}
+
+func TestSQLStatsCompactorAppNameTTLs(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	ctx := context.Background()
+	var stubTime atomic.Value
+	stubTime.Store(timeutil.Now().Add(-2 * time.Hour))
+	server, conn, _ := serverutils.StartServer(
+		t, base.TestServerArgs{
+			Knobs: base.TestingKnobs{
+				SQLStatsKnobs: &sqlstats.TestingKnobs{
+					AOSTClause: "AS OF SYSTEM TIME '-1us'",
+					StubTimeNow: func() time.Time {
+						return stubTime.Load().(time.Time)
+					},
+				},
+			},
+		},
+	)
+	defer server.Stopper().Stop(ctx)
+
+	sqlConn := sqlutils.MakeSQLRunner(conn)
+	sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.flush.interval = '24h'")
+	sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.cleanup.recurrence = '@yearly'")
+	sqlConn.Exec(t, "SELECT crdb_internal.reset_sql_stats()")
+
+	for _, appName := range []string{"batch_nightly", "batch_hourly", "other_app"} {
+		sqlConn.Exec(t, "SET application_name = $1", appName)
+		generateFingerprints(t, sqlConn, 10 /* distinctFingerprints */)
+	}
+	sqlConn.Exec(t, "RESET application_name")
+	server.SQLServer().(*sql.Server).
+		GetSQLStatsProvider().(*persistedsqlstats.PersistedSQLStats).Flush(ctx)
+	stubTime.Store(timeutil.Now())
+
+	tables := []string{"system.statement_statistics", "system.transaction_statistics"}
+	countRows := func(table, appName string) (cnt int) {
+		sqlConn.QueryRow(t,
+			fmt.Sprintf("SELECT count(*) FROM %s WHERE app_name = $1", table), appName,
+		).Scan(&cnt)
+		return cnt
+	}
+	otherRows := make([]int, len(tables))
+	for i, table := range tables {
+		otherRows[i] = countRows(table, "other_app")
+		require.Greater(t, otherRows[i], 0)
+		require.Greater(t, countRows(table, "batch_nightly"), 0)
+	}
+
+	// The invalid mappings are rejected.
+	sqlConn.ExpectErr(t, "expected pattern=ttl",
+		"SET CLUSTER SETTING sql.stats.cleanup.app_name_ttls = 'batch_%'")
+	sqlConn.ExpectErr(t, "the ttl must be positive",
+		"SET CLUSTER SETTING sql.stats.cleanup.app_name_ttls = 'batch_%=0s'")
+
+	// Neither the row cap nor the age limit removes any row.
+	sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.persisted_rows.max = 100000")
+	sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.persisted_rows.max_age = '720h'")
+	statsCompactor := persistedsqlstats.NewStatsCompactor(
+		server.ClusterSettings(),
+		server.InternalDB().(isql.DB),
+		persistedsqlstats.CompactorMetrics{RowsRemoved: metric.NewCounter(metric.Metadata{})},
+		&sqlstats.TestingKnobs{
+			AOSTClause: "AS OF SYSTEM TIME '-1us'",
+		},
+	)
+	require.NoError(t, statsCompactor.DeleteOldestEntries(ctx))
+	for i, table := range tables {
+		require.Equal(t, otherRows[i], countRows(table, "other_app"), table)
+		require.Greater(t, countRows(table, "batch_nightly"), 0, table)
+	}
+
+	// The rows of the batch applications are older than their ttl, while the
+	// ttl of other_app is longer than the age of its rows.
+	sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.cleanup.app_name_ttls = 'batch_%=1h, other_app=24h'")
+	require.NoError(t, statsCompactor.DeleteOldestEntries(ctx))
+	for i, table := range tables {
+		require.Zero(t, countRows(table, "batch_nightly"), table)
+		require.Zero(t, countRows(table, "batch_hourly"), table)
+		require.Equal(t, otherRows[i], countRows(table, "other_app"), table)
+	}
+}
+
+func TestSQLStatsCompactorCoalesceWindows(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	ctx := context.Background()
+	fakeTime := &stubTime{}
+	fakeTime.setTime(time.Date(2023, 1, 1, 10, 35, 0, 0, time.UTC))
+	server, conn, _ := serverutils.StartServer(t, base.TestServerArgs{
+		Knobs: base.TestingKnobs{
+			SQLStatsKnobs: &sqlstats.TestingKnobs{
+				StubTimeNow: fakeTime.Now,
+			},
+		},
+	})
+	defer server.Stopper().Stop(ctx)
+
+	sqlConn := sqlutils.MakeSQLRunner(conn)
+	sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.flush.interval = '24h'")
+	sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.cleanup.recurrence = '@yearly'")
+	sqlStats := server.SQLServer().(*sql.Server).
+		GetSQLStatsProvider().(*persistedsqlstats.PersistedSQLStats)
+
+	// Flush the stats of the same fingerprint into two windows of 10 minutes,
+	// which both belong to the same window once the interval is made coarser.
+	sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.aggregation.interval = '10m'")
+	sqlConn.Exec(t, "SET application_name = 'coalesce'")
+	sqlConn.Exec(t, "SELECT 1")
+	sqlStats.Flush(ctx)
+	fakeTime.setTime(time.Date(2023, 1, 1, 10, 45, 0, 0, time.UTC))
+	sqlConn.Exec(t, "SELECT 1")
+	sqlStats.Flush(ctx)
+	sqlConn.Exec(t, "RESET application_name")
+	sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.aggregation.interval = '1h'")
+
+	stmtStatsQuery := `
+SELECT aggregated_ts::STRING, agg_interval::STRING, (statistics -> 'statistics' ->> 'cnt')::INT
+FROM system.statement_statistics
+WHERE app_name = 'coalesce' AND metadata ->> 'query' = 'SELECT _'
+ORDER BY aggregated_ts`
+	txnStatsQuery := `
+SELECT count(*), sum((statistics -> 'statistics' ->> 'cnt')::INT)
+FROM system.transaction_statistics
+WHERE app_name = 'coalesce'`
+	sqlConn.CheckQueryResults(t, stmtStatsQuery, [][]string{
+		{"2023-01-01 10:30:00+00", "00:10:00", "1"},
+		{"2023-01-01 10:40:00+00", "00:10:00", "1"},
+	})
+	var txnRowsBefore, txnCountBefore int
+	sqlConn.QueryRow(t, txnStatsQuery).Scan(&txnRowsBefore, &txnCountBefore)
+	require.Greater(t, txnRowsBefore, 1)
+
+	statsCompactor := persistedsqlstats.NewStatsCompactor(
+		server.ClusterSettings(),
+		server.InternalDB().(isql.DB),
+		persistedsqlstats.CompactorMetrics{RowsRemoved: metric.NewCounter(metric.Metadata{})},
+		&sqlstats.TestingKnobs{
+			AOSTClause: "AS OF SYSTEM TIME '-1us'",
+			StubTimeNow: func() time.Time {
+				return time.Date(2023, 1, 1, 13, 0, 0, 0, time.UTC)
+			},
+		},
+	)
+
+	// The rows are only merged if coalescing is enabled.
+	require.NoError(t, statsCompactor.DeleteOldestEntries(ctx))
+	sqlConn.CheckQueryResults(t, `SELECT count(*) FROM (`+stmtStatsQuery+`)`, [][]string{{"2"}})
+
+	sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.cleanup.coalesce_windows.enabled = true")
+	require.NoError(t, statsCompactor.DeleteOldestEntries(ctx))
+	sqlConn.CheckQueryResults(t, stmtStatsQuery, [][]string{
+		{"2023-01-01 10:00:00+00", "01:00:00", "2"},
+	})
+	var txnRowsAfter, txnCountAfter int
+	sqlConn.QueryRow(t, txnStatsQuery).Scan(&txnRowsAfter, &txnCountAfter)
+	require.Less(t, txnRowsAfter, txnRowsBefore)
+	require.Equal(t, txnCountBefore, txnCountAfter)
+}
+
+func TestSQLStatsCompactorRollup(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	ctx := context.Background()
+	fakeTime := &stubTime{}
+	server, conn, _ := serverutils.StartServer(t, base.TestServerArgs{
+		Knobs: base.TestingKnobs{
+			SQLStatsKnobs: &sqlstats.TestingKnobs{
+				StubTimeNow: fakeTime.Now,
+			},
+		},
+	})
+	defer server.Stopper().Stop(ctx)
+
+	sqlConn := sqlutils.MakeSQLRunner(conn)
+	sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.flush.interval = '24h'")
+	sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.cleanup.recurrence = '@yearly'")
+	sqlStats := server.SQLServer().(*sql.Server).
+		GetSQLStatsProvider().(*persistedsqlstats.PersistedSQLStats)
+
+	// Flush the stats of the same fingerprint into three hourly windows of
+	// the first day, and a single window of the second day.
+	sqlConn.Exec(t, "SET application_name = 'rollup'")
+	for _, ts := range []time.Time{
+		time.Date(2023, 1, 1, 10, 35, 0, 0, time.UTC),
+		time.Date(2023, 1, 1, 11, 35, 0, 0, time.UTC),
+		time.Date(2023, 1, 1, 13, 35, 0, 0, time.UTC),
+		time.Date(2023, 1, 2, 9, 35, 0, 0, time.UTC),
+	} {
+		fakeTime.setTime(ts)
+		sqlConn.Exec(t, "SELECT 1")
+		sqlStats.Flush(ctx)
+	}
+	sqlConn.Exec(t, "RESET application_name")
+
+	stmtStatsQuery := `
+SELECT aggregated_ts::STRING, agg_interval::STRING, (statistics -> 'statistics' ->> 'cnt')::INT
+FROM system.statement_statistics
+WHERE app_name = 'rollup' AND metadata ->> 'query' = 'SELECT _'
+ORDER BY aggregated_ts`
+	txnStatsQuery := `
+SELECT count(*), sum((statistics -> 'statistics' ->> 'cnt')::INT)
+FROM system.transaction_statistics
+WHERE app_name = 'rollup'`
+	sqlConn.CheckQueryResults(t, stmtStatsQuery, [][]string{
+		{"2023-01-01 10:00:00+00", "01:00:00", "1"},
+		{"2023-01-01 11:00:00+00", "01:00:00", "1"},
+		{"2023-01-01 13:00:00+00", "01:00:00", "1"},
+		{"2023-01-02 09:00:00+00", "01:00:00", "1"},
+	})
+	var txnRowsBefore, txnCountBefore int
+	sqlConn.QueryRow(t, txnStatsQuery).Scan(&txnRowsBefore, &txnCountBefore)
+	require.Greater(t, txnRowsBefore, 1)
+
+	statsCompactor := persistedsqlstats.NewStatsCompactor(
+		server.ClusterSettings(),
+		server.InternalDB().(isql.DB),
+		persistedsqlstats.CompactorMetrics{RowsRemoved: metric.NewCounter(metric.Metadata{})},
+		&sqlstats.TestingKnobs{
+			AOSTClause: "AS OF SYSTEM TIME '-1us'",
+			StubTimeNow: func() time.Time {
+				return time.Date(2023, 1, 10, 12, 0, 0, 0, time.UTC)
+			},
+		},
+	)
+
+	// The rows are only rolled up if the rollup is enabled.
+	sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.cleanup.rollup_after = '8d'")
+	require.NoError(t, statsCompactor.DeleteOldestEntries(ctx))
+	sqlConn.CheckQueryResults(t, `SELECT count(*) FROM (`+stmtStatsQuery+`)`, [][]string{{"4"}})
+
+	// Only the first day ends before the rollup cutoff, and the counts of its
+	// rows are conserved.
+	sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.cleanup.rollup.enabled = true")
+	require.NoError(t, statsCompactor.DeleteOldestEntries(ctx))
+	sqlConn.CheckQueryResults(t, stmtStatsQuery, [][]string{
+		{"2023-01-01 00:00:00+00", "24:00:00", "3"},
+		{"2023-01-02 09:00:00+00", "01:00:00", "1"},
+	})
+	var txnRowsAfter, txnCountAfter int
+	sqlConn.QueryRow(t, txnStatsQuery).Scan(&txnRowsAfter, &txnCountAfter)
+	require.Less(t, txnRowsAfter, txnRowsBefore)
+	require.Equal(t, txnCountBefore, txnCountAfter)
+
+	// Once the second day ends before the rollup cutoff, its single row is
+	// converted to a daily row as well, and the rolled up first day is left
+	// as is.
+	sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.cleanup.rollup_after = '7d'")
+	require.NoError(t, statsCompactor.DeleteOldestEntries(ctx))
+	sqlConn.CheckQueryResults(t, stmtStatsQuery, [][]string{
+		{"2023-01-01 00:00:00+00", "24:00:00", "3"},
+		{"2023-01-02 00:00:00+00", "24:00:00", "1"},
+	})
+}
+
+func TestSQLStatsCompactorGCHint(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	ctx := context.Background()
+	server, conn, _ := serverutils.StartServer(
+		t, base.TestServerArgs{
+			Knobs: base.TestingKnobs{
+				SQLStatsKnobs: &sqlstats.TestingKnobs{
+					AOSTClause: "AS OF SYSTEM TIME '-1us'",
+					StubTimeNow: func() time.Time {
+						return timeutil.Now().Add(-2 * time.Hour)
+					},
+				},
+			},
+		},
+	)
+	defer server.Stopper().Stop(ctx)
+
+	sqlConn := sqlutils.MakeSQLRunner(conn)
+	sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.flush.interval = '24h'")
+	sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.cleanup.recurrence = '@yearly'")
+	sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.persisted_rows.max = 8")
+	sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.cleanup.gc_hint.enabled = true")
+	sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.cleanup.gc_hint.threshold = 10")
+
+	generateFingerprints(t, sqlConn, 50 /* distinctFingerprints */)
+	server.SQLServer().(*sql.Server).
+		GetSQLStatsProvider().(*persistedsqlstats.PersistedSQLStats).Flush(ctx)
+
+	statsCompactor := persistedsqlstats.NewStatsCompactor(
+		server.ClusterSettings(),
+		server.InternalDB().(isql.DB),
+		persistedsqlstats.CompactorMetrics{RowsRemoved: metric.NewCounter(metric.Metadata{})},
+		&sqlstats.TestingKnobs{
+			AOSTClause: "AS OF SYSTEM TIME '-1us'",
+		},
+	)
+	statsCompactor.SetStopper(server.Stopper())
+	require.NoError(t, statsCompactor.DeleteOldestEntries(ctx))
+
+	// All the replicas are on the single node, so all the ranges of the
+	// statement stats table are enqueued, in the background.
+	testutils.SucceedsSoon(t, func() error {
+		log.FlushFileSinks()
+		entries, err := log.FetchEntriesFromFiles(
+			0, /* startTimestamp */
+			math.MaxInt64,
+			100, /* maxEntries */
+			regexp.MustCompile(`from system\.statement_statistics, enqueued \d+ out of \d+ ranges for MVCC GC`),
+			log.WithFlattenedSensitiveData,
+		)
+		if err != nil {
+			return err
+		}
+		if len(entries) == 0 {
+			return errors.New("the ranges of system.statement_statistics were not enqueued yet")
+		}
+		match := regexp.MustCompile(`enqueued (\d+) out of (\d+) ranges`).FindStringSubmatch(entries[0].Message)
+		require.NotNil(t, match)
+		require.NotEqual(t, "0", match[1])
+		require.Equal(t, match[2], match[1])
+		return nil
+	})
+}
+
+func TestSQLStatsCleanupWindow(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	at := func(hour, min int) time.Time {
+		return time.Date(2023, time.March, 1, hour, min, 0, 0, time.UTC)
+	}
+
+	t.Run("parse", func(t *testing.T) {
+		for _, tc := range []struct {
+			window string
+			errRE  string
+		}{
+			{window: ""},
+			{window: "01:00-05:00"},
+			{window: "01:00-05:00 UTC"},
+			{window: "22:30-02:00 America/New_York"},
+			{window: "01:00", errRE: "expected HH:MM-HH:MM"},
+			{window: "01:00-05:00 UTC extra", errRE: "expected HH:MM-HH:MM"},
+			{window: "1am-5am", errRE: "invalid start of cleanup window"},
+			{window: "01:00-25:00", errRE: "invalid end of cleanup window"},
+			{window: "01:00-05:00 Nowhere/Special", errRE: "invalid time zone"},
+			{window: "01:00-01:00", errRE: "start and end must differ"},
+		} {
+			_, err := persistedsqlstats.ParseCleanupWindow(tc.window)
+			if tc.errRE == "" {
+				require.NoError(t, err, tc.window)
+			} else {
+				require.True(t, testutils.IsError(err, tc.errRE),
+					"%s: expected error matching %q, got %v", tc.window, tc.errRE, err)
+			}
+		}
+	})
+
+	t.Run("time until open", func(t *testing.T) {
+		for _, tc := range []struct {
+			window   string
+			now      time.Time
+			expected time.Duration
+		}{
+			{window: "01:00-05:00", now: at(0, 30), expected: 30 * time.Minute},
+			{window: "01:00-05:00", now: at(1, 0), expected: 0},
+			{window: "01:00-05:00", now: at(4, 59), expected: 0},
+			{window: "01:00-05:00", now: at(5, 0), expected: 20 * time.Hour},
+			{window: "22:00-02:00", now: at(23, 0), expected: 0},
+			{window: "22:00-02:00", now: at(1, 0), expected: 0},
+			{window: "22:00-02:00", now: at(12, 0), expected: 10 * time.Hour},
+			{window: "01:00-05:00 Asia/Tokyo", now: at(16, 0), expected: 0},
+			{window: "01:00-05:00 Asia/Tokyo", now: at(15, 0), expected: time.Hour},
+		} {
+			w, err := persistedsqlstats.ParseCleanupWindow(tc.window)
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, w.TimeUntilOpen(tc.now), "%s at %s", tc.window, tc.now)
+		}
+	})
+
+	t.Run("compaction waits for the window", func(t *testing.T) {
+		ctx := context.Background()
+		server, conn, _ := serverutils.StartServer(t, base.TestServerArgs{})
+		defer server.Stopper().Stop(ctx)
+
+		var now atomic.Value
+		now.Store(at(12, 0))
+		statsCompactor := persistedsqlstats.NewStatsCompactor(
+			server.ClusterSettings(),
+			server.InternalDB().(isql.DB),
+			persistedsqlstats.CompactorMetrics{RowsRemoved: metric.NewCounter(metric.Metadata{})},
+			&sqlstats.TestingKnobs{
+				StubTimeNow: func() time.Time { return now.Load().(time.Time) },
+			},
+		)
+
+		// Without a window, the compaction runs at any time.
+		require.NoError(t, statsCompactor.WaitForCleanupWindow(ctx))
+
+		sqlConn := sqlutils.MakeSQLRunner(conn)
+		sqlConn.ExpectErr(t, "invalid cleanup window",
+			"SET CLUSTER SETTING sql.stats.cleanup.window = 'nightly'")
+		sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.cleanup.window = '01:00-05:00 UTC'")
+
+		// Outside the window, the compaction is deferred until the window
+		// opens.
+		shortCtx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+		defer cancel()
+		require.ErrorIs(t, statsCompactor.WaitForCleanupWindow(shortCtx), context.DeadlineExceeded)
+
+		now.Store(at(2, 0))
+		require.NoError(t, statsCompactor.WaitForCleanupWindow(ctx))
+	})
+
+	t.Run("compaction stops when the window closes", func(t *testing.T) {
+		ctx := context.Background()
+		server, conn, _ := serverutils.StartServer(t, base.TestServerArgs{})
+		defer server.Stopper().Stop(ctx)
+
+		sqlConn := sqlutils.MakeSQLRunner(conn)
+		sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.flush.interval = '24h'")
+		sqlConn.Exec(t, "SELECT crdb_internal.reset_sql_stats()")
+		generateFingerprints(t, sqlConn, 20 /* distinctFingerprints */)
+		server.SQLServer().(*sql.Server).
+			GetSQLStatsProvider().(*persistedsqlstats.PersistedSQLStats).Flush(ctx)
+		stmtStatsCnt, _ := getPersistedStatsEntry(t, sqlConn)
+
+		// The window is open for an hour around the current time, and the
+		// first deletion moves the clock of the compactor past it.
+		realNow := timeutil.Now().UTC()
+		sqlConn.Exec(t, fmt.Sprintf("SET CLUSTER SETTING sql.stats.cleanup.window = '%s-%s UTC'",
+			realNow.Add(-time.Hour).Format("15:04"), realNow.Add(time.Hour).Format("15:04")))
+		sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.cleanup.rows_to_delete_per_txn = 1")
+		sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.cleanup.delete_parallelism = 1")
+		sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.persisted_rows.max = 1")
+		var clockOffset int64
+		metrics := persistedsqlstats.CompactorMetrics{RowsRemoved: metric.NewCounter(metric.Metadata{})}
+		statsCompactor := persistedsqlstats.NewStatsCompactor(
+			server.ClusterSettings(),
+			server.InternalDB().(isql.DB),
+			metrics,
+			&sqlstats.TestingKnobs{
+				AOSTClause: "AS OF SYSTEM TIME '-1us'",
+				StubTimeNow: func() time.Time {
+					return timeutil.Now().Add(time.Duration(atomic.LoadInt64(&clockOffset)))
+				},
+				BeforeCompactionDelete: func(stmt string, qargs []interface{}) error {
+					atomic.StoreInt64(&clockOffset, int64(3*time.Hour))
+					return nil
+				},
+			},
+		)
+		require.NoError(t, statsCompactor.WaitForCleanupWindow(ctx))
+
+		// The batch started within the window completes, and the compaction
+		// stops cleanly before the next one.
+		require.NoError(t, statsCompactor.DeleteOldestEntries(ctx))
+		require.Equal(t, int64(1), metrics.RowsRemoved.Count())
+		stmtStatsCntAfter, txnStatsCntAfter := getPersistedStatsEntry(t, sqlConn)
+		require.Less(t, stmtStatsCntAfter, stmtStatsCnt)
+		require.Greater(t, stmtStatsCntAfter, 1)
+		require.Greater(t, txnStatsCntAfter, 1)
+	})
+}
+
+func TestSQLStatsCompactorTxnRetries(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	ctx := context.Background()
+	// injectRetry is set to inject a retry error into the next transaction
+	// deleting rows from system.statement_statistics.
+	var injectRetry int32
+	server, conn, _ := serverutils.StartServer(
+		t, base.TestServerArgs{
+			Knobs: base.TestingKnobs{
+				SQLStatsKnobs: &sqlstats.TestingKnobs{
+					AOSTClause: "AS OF SYSTEM TIME '-1us'",
+					StubTimeNow: func() time.Time {
+						return timeutil.Now().Add(-2 * time.Hour)
+					},
+				},
+				Store: &kvserver.StoreTestingKnobs{
+					TestingRequestFilter: func(_ context.Context, ba *kvpb.BatchRequest) *kvpb.Error {
+						req, ok := ba.GetArg(kvpb.Delete)
+						if !ok || ba.Txn == nil {
+							return nil
+						}
+						_, tableID, _ := encoding.DecodeUvarintAscending(req.(*kvpb.DeleteRequest).Key)
+						if tableID == stmtStatsTableID && atomic.CompareAndSwapInt32(&injectRetry, 1, 0) {
+							return kvpb.NewErrorWithTxn(kvpb.NewTransactionRetryError(
+								kvpb.RETRY_REASON_UNKNOWN, "injected retry"), ba.Txn)
+						}
+						return nil
+					},
+				},
+			},
+		},
+	)
+	defer server.Stopper().Stop(ctx)
+
+	sqlConn := sqlutils.MakeSQLRunner(conn)
+	sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.flush.interval = '24h'")
+	sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.cleanup.recurrence = '@yearly'")
+	sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.persisted_rows.max = 8")
+
+	generateFingerprints(t, sqlConn, 50 /* distinctFingerprints */)
+	server.SQLServer().(*sql.Server).
+		GetSQLStatsProvider().(*persistedsqlstats.PersistedSQLStats).Flush(ctx)
+
+	metrics := persistedsqlstats.CompactorMetrics{
+		RowsRemoved: metric.NewCounter(metric.Metadata{}),
+		TxnRetries:  metric.NewCounter(metric.Metadata{}),
+	}
+	statsCompactor := persistedsqlstats.NewStatsCompactor(
+		server.ClusterSettings(),
+		server.InternalDB().(isql.DB),
+		metrics,
+		&sqlstats.TestingKnobs{
+			AOSTClause: "AS OF SYSTEM TIME '-1us'",
+		},
+	)
+
+	atomic.StoreInt32(&injectRetry, 1)
+	require.NoError(t, statsCompactor.DeleteOldestEntries(ctx))
+	require.Zero(t, atomic.LoadInt32(&injectRetry), "no retry error was injected")
+	require.Equal(t, int64(1), metrics.TxnRetries.Count())
+	require.NotZero(t, metrics.RowsRemoved.Count())
+}
+
+func TestSQLStatsCompactionPolicyDiff(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	ctx := context.Background()
+	var stubTime atomic.Value
+	stubTime.Store(timeutil.Now().Add(-2 * time.Hour))
+	server, conn, _ := serverutils.StartServer(
+		t, base.TestServerArgs{
+			Knobs: base.TestingKnobs{
+				SQLStatsKnobs: &sqlstats.TestingKnobs{
+					AOSTClause: "AS OF SYSTEM TIME '-1us'",
+					StubTimeNow: func() time.Time {
+						return stubTime.Load().(time.Time)
+					},
+				},
+			},
+		},
+	)
+	defer server.Stopper().Stop(ctx)
+
+	sqlConn := sqlutils.MakeSQLRunner(conn)
+	sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.flush.interval = '24h'")
+	sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.cleanup.recurrence = '@yearly'")
+	sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.persisted_rows.max = 8")
+	sqlConn.Exec(t, "SELECT crdb_internal.reset_sql_stats()")
+
+	// Flush the stats into an aggregation interval that is two hours old, so
+	// that all the rows can be removed by the compaction.
+	generateFingerprints(t, sqlConn, 20 /* distinctFingerprints */)
+	server.SQLServer().(*sql.Server).
+		GetSQLStatsProvider().(*persistedsqlstats.PersistedSQLStats).Flush(ctx)
+	stubTime.Store(timeutil.Now())
+	stmtStatsCnt, txnStatsCnt := getPersistedStatsEntry(t, sqlConn)
+
+	type diff struct {
+		table                          string
+		current, proposed, delta, rows int
+	}
+	getDiff := func(proposedMax int, proposedAge string) []diff {
+		rows := sqlConn.Query(t, `
+SELECT table_name, current_rows_to_delete, proposed_rows_to_delete, delta
+FROM crdb_internal.sql_stats_compaction_diff($1, $2::INTERVAL)
+ORDER BY table_name`, proposedMax, proposedAge)
+		var diffs []diff
+		for rows.Next() {
+			var d diff
+			require.NoError(t, rows.Scan(&d.table, &d.current, &d.proposed, &d.delta))
+			require.Equal(t, d.proposed-d.current, d.delta)
+			diffs = append(diffs, d)
+		}
+		require.NoError(t, rows.Err())
+		require.Len(t, diffs, 2)
+		require.Equal(t, "system.statement_statistics", diffs[0].table)
+		require.Equal(t, "system.transaction_statistics", diffs[1].table)
+		diffs[0].rows, diffs[1].rows = stmtStatsCnt, txnStatsCnt
+		return diffs
+	}
+
+	// The current policy removes the rows exceeding the row limit.
+	for _, d := range getDiff(8 /* proposedMax */, "0s" /* proposedAge */) {
+		require.Equal(t, 0, d.delta)
+		require.Greater(t, d.current, 0)
+		require.LessOrEqual(t, d.current, d.rows-8)
+	}
+
+	// A policy with a higher row limit removes fewer rows.
+	for _, d := range getDiff(1000 /* proposedMax */, "0s" /* proposedAge */) {
+		require.Equal(t, 0, d.proposed)
+		require.Equal(t, -d.current, d.delta)
+	}
+
+	// A policy with an age limit removes all the rows that are too old.
+	for _, d := range getDiff(1000 /* proposedMax */, "1h" /* proposedAge */) {
+		require.Equal(t, d.rows, d.proposed)
+	}
+
+	// The diff does not modify the tables.
+	stmtStatsCntAfter, txnStatsCntAfter := getPersistedStatsEntry(t, sqlConn)
+	require.Equal(t, stmtStatsCnt, stmtStatsCntAfter)
+	require.Equal(t, txnStatsCnt, txnStatsCntAfter)
+
+	sqlConn.ExpectErr(t, "proposed_max must be non-negative",
+		"SELECT * FROM crdb_internal.sql_stats_compaction_diff(-1, '0s')")
+}
+
+func TestSQLStatsCompactNow(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	ctx := context.Background()
+	var stubTime atomic.Value
+	stubTime.Store(timeutil.Now().Add(-2 * time.Hour))
+	server, conn, _ := serverutils.StartServer(
+		t, base.TestServerArgs{
+			Knobs: base.TestingKnobs{
+				SQLStatsKnobs: &sqlstats.TestingKnobs{
+					AOSTClause: "AS OF SYSTEM TIME '-1us'",
+					StubTimeNow: func() time.Time {
+						return stubTime.Load().(time.Time)
+					},
+				},
+			},
+		},
+	)
+	defer server.Stopper().Stop(ctx)
+
+	sqlConn := sqlutils.MakeSQLRunner(conn)
+	sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.flush.interval = '24h'")
+	sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.cleanup.recurrence = '@yearly'")
+	sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.persisted_rows.max = 8")
+	sqlConn.Exec(t, "SELECT crdb_internal.reset_sql_stats()")
+
+	// Flush the stats into an aggregation interval that is two hours old, so
+	// that all the rows can be removed by the compaction.
+	generateFingerprints(t, sqlConn, 20 /* distinctFingerprints */)
+	server.SQLServer().(*sql.Server).
+		GetSQLStatsProvider().(*persistedsqlstats.PersistedSQLStats).Flush(ctx)
+	stubTime.Store(timeutil.Now())
+	stmtStatsCnt, txnStatsCnt := getPersistedStatsEntry(t, sqlConn)
+
+	compactNow := func(dryRun bool) (stmtRowsDeleted, txnRowsDeleted int) {
+		rows := sqlConn.Query(t, `
+SELECT table_name, rows_deleted, dry_run
+FROM crdb_internal.sql_stats_compact_now($1)
+ORDER BY table_name`, dryRun)
+		var tables []string
+		var deleted []int
+		for rows.Next() {
+			var table string
+			var rowsDeleted int
+			var isDryRun bool
+			require.NoError(t, rows.Scan(&table, &rowsDeleted, &isDryRun))
+			require.Equal(t, dryRun, isDryRun)
+			tables = append(tables, table)
+			deleted = append(deleted, rowsDeleted)
+		}
+		require.NoError(t, rows.Err())
+		require.Equal(t,
+			[]string{"system.statement_statistics", "system.transaction_statistics"}, tables)
+		return deleted[0], deleted[1]
+	}
+
+	// The dry run reports the rows exceeding the row limit, without removing
+	// them.
+	stmtCandidates, txnCandidates := compactNow(true /* dryRun */)
+	require.Greater(t, stmtCandidates, 0)
+	require.Greater(t, txnCandidates, 0)
+	stmtStatsCntAfter, txnStatsCntAfter := getPersistedStatsEntry(t, sqlConn)
+	require.Equal(t, stmtStatsCnt, stmtStatsCntAfter)
+	require.Equal(t, txnStatsCnt, txnStatsCntAfter)
+
+	// The compaction reports the rows it actually removed, which are the ones
+	// estimated by the dry run.
+	sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.cleanup.event_log.enabled = true")
+	stmtRowsDeleted, txnRowsDeleted := compactNow(false /* dryRun */)
+	require.Equal(t, stmtCandidates, stmtRowsDeleted)
+	require.Equal(t, txnCandidates, txnRowsDeleted)
+	stmtStatsCntAfter, txnStatsCntAfter = getPersistedStatsEntry(t, sqlConn)
+	require.Equal(t, stmtStatsCnt-stmtRowsDeleted, stmtStatsCntAfter)
+	require.Equal(t, txnStatsCnt-txnRowsDeleted, txnStatsCntAfter)
+
+	// As the runs of the compaction job, the compaction is recorded in
+	// system.sql_stats_compaction_runs, in the event log and in the metrics.
+	sqlConn.CheckQueryResults(t, `
+SELECT outcome, stmt_rows_removed, txn_rows_removed
+FROM system.sql_stats_compaction_runs
+WHERE job_id IS NULL`,
+		[][]string{{
+			persistedsqlstats.CompactionRunSucceeded,
+			fmt.Sprint(stmtRowsDeleted), fmt.Sprint(txnRowsDeleted),
+		}},
+	)
+	sqlConn.CheckQueryResultsRetry(t, `
+SELECT "eventType", info::JSONB->>'Status', (info::JSONB->>'RowsRemoved')::INT8
+FROM system.eventlog
+WHERE "eventType" LIKE 'sql_stats_compaction_%'
+ORDER BY timestamp`,
+		[][]string{
+			{"sql_stats_compaction_start", string(jobs.StatusRunning), "NULL"},
+			{"sql_stats_compaction_finish", string(jobs.StatusSucceeded),
+				fmt.Sprint(stmtRowsDeleted + txnRowsDeleted)},
+		},
+	)
+	var rowsRemovedMetric int
+	sqlConn.QueryRow(t, `
+SELECT value
+FROM crdb_internal.node_metrics
+WHERE name = 'sql.stats.cleanup.rows_removed'`,
+	).Scan(&rowsRemovedMetric)
+	require.Equal(t, stmtRowsDeleted+txnRowsDeleted, rowsRemovedMetric)
+
+	// Once compacted, there is nothing left to remove.
+	stmtCandidates, txnCandidates = compactNow(true /* dryRun */)
+	require.Zero(t, stmtCandidates)
+	require.Zero(t, txnCandidates)
+}
+
+// TestSQLStatsCompactionTenantOverrides verifies that the compaction of each
+// tenant is governed by the overrides of the SQL stats settings set for it by
+// ALTER TENANT SET CLUSTER SETTING.
+func TestSQLStatsCompactionTenantOverrides(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	ctx := context.Background()
+	var stubTime atomic.Value
+	stubTime.Store(timeutil.Now().Add(-2 * time.Hour))
+	knobs := &sqlstats.TestingKnobs{
+		AOSTClause: "AS OF SYSTEM TIME '-1us'",
+		StubTimeNow: func() time.Time {
+			return stubTime.Load().(time.Time)
+		},
+		JobMonitorUpdateCheckInterval: time.Second,
+	}
+	server, conn, _ := serverutils.StartServer(t, base.TestServerArgs{
+		DefaultTestTenant: base.TestTenantDisabled,
+	})
+	defer server.Stopper().Stop(ctx)
+	systemConn := sqlutils.MakeSQLRunner(conn)
+
+	type tenant struct {
+		id         roachpb.TenantID
+		maxRows    int
+		recurrence string
+		sqlConn    *sqlutils.SQLRunner
+	}
+	tenants := []*tenant{
+		{id: roachpb.MustMakeTenantID(10), maxRows: 8, recurrence: "@weekly"},
+		{id: roachpb.MustMakeTenantID(11), maxRows: 1000, recurrence: "@monthly"},
+	}
+	for _, tn := range tenants {
+		_, db := serverutils.StartTenant(t, server, base.TestTenantArgs{
+			TenantID:     tn.id,
+			TestingKnobs: base.TestingKnobs{SQLStatsKnobs: knobs},
+		})
+		tn.sqlConn = sqlutils.MakeSQLRunner(db)
+		tn.sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.flush.interval = '24h'")
+		tn.sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.flush.minimum_interval = '0s'")
+
+		systemConn.Exec(t, fmt.Sprintf(
+			"ALTER TENANT [%d] SET CLUSTER SETTING sql.stats.persisted_rows.max = %d",
+			tn.id.ToUint64(), tn.maxRows))
+		systemConn.Exec(t, fmt.Sprintf(
+			"ALTER TENANT [%d] SET CLUSTER SETTING sql.stats.cleanup.recurrence = '%s'",
+			tn.id.ToUint64(), tn.recurrence))
+	}
+
+	for _, tn := range tenants {
+		// The overrides are propagated to the tenant asynchronously, and the
+		// schedule of the tenant picks up its recurrence override.
+		tn.sqlConn.CheckQueryResultsRetry(t,
+			"SHOW CLUSTER SETTING sql.stats.persisted_rows.max",
+			[][]string{{fmt.Sprint(tn.maxRows)}})
+		tn.sqlConn.CheckQueryResultsRetry(t, `
+SELECT recurrence FROM crdb_internal.sql_stats_schedules()
+WHERE schedule_name = 'sql-stats-compaction'`, [][]string{{tn.recurrence}})
+
+		tn.sqlConn.Exec(t, "SELECT crdb_internal.reset_sql_stats()")
+		generateFingerprints(t, tn.sqlConn, 20 /* distinctFingerprints */)
+		tn.sqlConn.Exec(t, "SELECT * FROM crdb_internal.flush_sql_stats()")
+	}
+	stubTime.Store(timeutil.Now())
+
+	for _, tn := range tenants {
+		stmtStatsCnt, txnStatsCnt := getPersistedStatsEntry(t, tn.sqlConn)
+		require.Greater(t, stmtStatsCnt, 8, "tenant %s", tn.id)
+		require.Greater(t, txnStatsCnt, 8, "tenant %s", tn.id)
+
+		tn.sqlConn.Exec(t, "SELECT * FROM crdb_internal.sql_stats_compact_now(false)")
+		stmtStatsCntAfter, txnStatsCntAfter := getPersistedStatsEntry(t, tn.sqlConn)
+		if stmtStatsCnt > tn.maxRows {
+			require.LessOrEqual(t, stmtStatsCntAfter, tn.maxRows, "tenant %s", tn.id)
+			require.LessOrEqual(t, txnStatsCntAfter, tn.maxRows, "tenant %s", tn.id)
+		} else {
+			require.Equal(t, stmtStatsCnt, stmtStatsCntAfter, "tenant %s", tn.id)
+			require.Equal(t, txnStatsCnt, txnStatsCntAfter, "tenant %s", tn.id)
+		}
+	}
+}
+
+func TestSQLStatsCompactionPreview(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	ctx := context.Background()
+	var stubTime atomic.Value
+	stubTime.Store(timeutil.Now().Add(-2 * time.Hour))
+	server, conn, _ := serverutils.StartServer(
+		t, base.TestServerArgs{
+			Knobs: base.TestingKnobs{
+				SQLStatsKnobs: &sqlstats.TestingKnobs{
+					AOSTClause: "AS OF SYSTEM TIME '-1us'",
+					StubTimeNow: func() time.Time {
+						return stubTime.Load().(time.Time)
+					},
+				},
+			},
+		},
+	)
+	defer server.Stopper().Stop(ctx)
+
+	sqlConn := sqlutils.MakeSQLRunner(conn)
+	sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.flush.interval = '24h'")
+	sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.cleanup.recurrence = '@yearly'")
+	sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.persisted_rows.max = 8")
+	sqlConn.Exec(t, "SELECT crdb_internal.reset_sql_stats()")
+
+	generateFingerprints(t, sqlConn, 20 /* distinctFingerprints */)
+	server.SQLServer().(*sql.Server).
+		GetSQLStatsProvider().(*persistedsqlstats.PersistedSQLStats).Flush(ctx)
+	stubTime.Store(timeutil.Now())
+
+	type selection struct {
+		table     string
+		predicate string
+		limit     gosql.NullInt64
+	}
+	preview := func() []selection {
+		rows := sqlConn.Query(t, `
+SELECT table_name, predicate, row_limit
+FROM crdb_internal.sql_stats_compaction_preview()`)
+		var selections []selection
+		for rows.Next() {
+			var sel selection
+			require.NoError(t, rows.Scan(&sel.table, &sel.predicate, &sel.limit))
+			selections = append(selections, sel)
+		}
+		require.NoError(t, rows.Err())
+		return selections
+	}
+
+	// With the row cap alone, there is a single selection per table, whose
+	// limit is the number of rows that the compaction removes.
+	selections := preview()
+	require.Len(t, selections, 2)
+	limits := make(map[string]int64)
+	for _, sel := range selections {
+		require.Contains(t, sel.predicate, "aggregated_ts < ")
+		require.True(t, sel.limit.Valid)
+		require.Greater(t, sel.limit.Int64, int64(0))
+		limits[sel.table] = sel.limit.Int64
+	}
+	rows := sqlConn.QueryStr(t, "SELECT table_name, rows_deleted FROM crdb_internal.sql_stats_compact_now(false)")
+	require.Len(t, rows, 2)
+	for _, row := range rows {
+		require.Equal(t, fmt.Sprint(limits[row[0]]), row[1], "rows deleted from %s", row[0])
+	}
+
+	// Once compacted, nothing is selected.
+	for _, sel := range preview() {
+		require.Zero(t, sel.limit.Int64, "rows selected from %s", sel.table)
+	}
+
+	// When the age limit is enforced separately, the expired rows are
+	// selected without limit.
+	sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.persisted_rows.max_age = '1h'")
+	sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.cleanup.retain_latest_per_fingerprint = true")
+	selections = preview()
+	require.Len(t, selections, 4)
+	var unlimited int
+	for _, sel := range selections {
+		require.Contains(t, sel.predicate, "not the latest row of the fingerprint")
+		if !sel.limit.Valid {
+			unlimited++
+		}
+	}
+	require.Equal(t, 2, unlimited)
+}
+
+func TestSQLStatsBindingPolicy(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	ctx := context.Background()
+	var stubTime atomic.Value
+	stubTime.Store(timeutil.Now().Add(-2 * time.Hour))
+	server, conn, _ := serverutils.StartServer(
+		t, base.TestServerArgs{
+			Knobs: base.TestingKnobs{
+				SQLStatsKnobs: &sqlstats.TestingKnobs{
+					AOSTClause: "AS OF SYSTEM TIME '-1us'",
+					StubTimeNow: func() time.Time {
+						return stubTime.Load().(time.Time)
+					},
+				},
+			},
+		},
+	)
+	defer server.Stopper().Stop(ctx)
+
+	sqlConn := sqlutils.MakeSQLRunner(conn)
+	sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.flush.interval = '24h'")
+	sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.cleanup.recurrence = '@yearly'")
+	sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.persisted_rows.max = 8")
+	sqlConn.Exec(t, "SELECT crdb_internal.reset_sql_stats()")
+
+	generateFingerprints(t, sqlConn, 20 /* distinctFingerprints */)
+	server.SQLServer().(*sql.Server).
+		GetSQLStatsProvider().(*persistedsqlstats.PersistedSQLStats).Flush(ctx)
+	stubTime.Store(timeutil.Now())
+
+	type bindingPolicy struct {
+		policy        string
+		rowCount      int64
+		rowsOverLimit int64
+	}
+	bindingPolicies := func() map[string]bindingPolicy {
+		rows := sqlConn.Query(t, `
+SELECT table_name, binding_policy, row_count, rows_over_limit
+FROM crdb_internal.sql_stats_binding_policy()`)
+		policies := make(map[string]bindingPolicy)
+		for rows.Next() {
+			var table string
+			var p bindingPolicy
+			require.NoError(t, rows.Scan(&table, &p.policy, &p.rowCount, &p.rowsOverLimit))
+			policies[table] = p
+		}
+		require.NoError(t, rows.Err())
+		require.Len(t, policies, 2)
+		return policies
+	}
+
+	// With the row cap alone, the row cap is binding.
+	for table, p := range bindingPolicies() {
+		require.Equal(t, "row_cap", p.policy, table)
+		require.Greater(t, p.rowsOverLimit, int64(0), table)
+		require.LessOrEqual(t, p.rowsOverLimit, p.rowCount, table)
+	}
+
+	// All the rows are older than the age limit, which is thus binding.
+	sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.persisted_rows.max = 0")
+	sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.persisted_rows.max_age = '1h'")
+	for table, p := range bindingPolicies() {
+		require.Equal(t, "max_age", p.policy, table)
+		require.Equal(t, p.rowCount, p.rowsOverLimit, table)
+	}
+
+	// Within all the limits, no policy is binding.
+	sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.persisted_rows.max_age = '24h'")
+	for table, p := range bindingPolicies() {
+		require.Equal(t, "none", p.policy, table)
+		require.Zero(t, p.rowsOverLimit, table)
+	}
+}
+
+func TestSQLStatsRetentionHorizon(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	ctx := context.Background()
+	var stubTime atomic.Value
+	stubTime.Store(timeutil.Now().Add(-2 * time.Hour))
+	server, conn, _ := serverutils.StartServer(
+		t, base.TestServerArgs{
+			Knobs: base.TestingKnobs{
+				SQLStatsKnobs: &sqlstats.TestingKnobs{
+					AOSTClause: "AS OF SYSTEM TIME '-1us'",
+					StubTimeNow: func() time.Time {
+						return stubTime.Load().(time.Time)
+					},
+				},
+			},
+		},
+	)
+	defer server.Stopper().Stop(ctx)
+
+	sqlConn := sqlutils.MakeSQLRunner(conn)
+	sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.flush.interval = '24h'")
+	sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.cleanup.recurrence = '@yearly'")
+	sqlConn.Exec(t, "SELECT crdb_internal.reset_sql_stats()")
+
+	generateFingerprints(t, sqlConn, 20 /* distinctFingerprints */)
+	server.SQLServer().(*sql.Server).
+		GetSQLStatsProvider().(*persistedsqlstats.PersistedSQLStats).Flush(ctx)
+	now := timeutil.Now()
+	stubTime.Store(now)
+
+	var aggregatedTs time.Time
+	sqlConn.QueryRow(t, "SELECT max(aggregated_ts) FROM system.statement_statistics").Scan(&aggregatedTs)
+
+	retentionHorizon := func() (horizon gosql.NullTime) {
+		sqlConn.QueryRow(t, "SELECT crdb_internal.sql_stats_retention_horizon()").Scan(&horizon)
+		return horizon
+	}
+
+	// Within the default row cap and without age limit, the stats are not
+	// limited.
+	sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.persisted_rows.max = 0")
+	require.False(t, retentionHorizon().Valid)
+
+	// With the age limit alone, the horizon is its cutoff.
+	sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.persisted_rows.max_age = '24h'")
+	horizon := retentionHorizon()
+	require.True(t, horizon.Valid)
+	require.WithinDuration(t, now.Add(-24*time.Hour), horizon.Time, time.Second)
+
+	// The rows are older than the age limit, but the rows in the grace period
+	// are retained.
+	sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.persisted_rows.max_age = '1m'")
+	horizon = retentionHorizon()
+	require.True(t, horizon.Valid)
+	graceCutoff := now.Add(-time.Hour).Truncate(time.Hour)
+	require.True(t, graceCutoff.Equal(horizon.Time), "expected %s, found %s", graceCutoff, horizon.Time)
+
+	// With a row cap binding, the horizon is the aggregation window of the
+	// oldest retained rows, and the compaction does retain the stats from it.
+	sqlConn.Exec(t, "RESET CLUSTER SETTING sql.stats.persisted_rows.max_age")
+	sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.persisted_rows.max = 8")
+	horizon = retentionHorizon()
+	require.True(t, horizon.Valid)
+	require.True(t, aggregatedTs.Equal(horizon.Time), "expected %s, found %s", aggregatedTs, horizon.Time)
+	sqlConn.Exec(t, "SELECT crdb_internal.sql_stats_compact_now()")
+	sqlConn.CheckQueryResults(t, fmt.Sprintf(`
+SELECT count(*) FROM system.statement_statistics WHERE aggregated_ts < '%s'`,
+		horizon.Time.Format(time.RFC3339Nano)), [][]string{{"0"}})
+}
+
+func TestSQLStatsCompactorSkipsUndeletableRows(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	ctx := context.Background()
+	var stubTime atomic.Value
+	stubTime.Store(timeutil.Now().Add(-2 * time.Hour))
+	server, conn, _ := serverutils.StartServer(
+		t, base.TestServerArgs{
+			Knobs: base.TestingKnobs{
+				SQLStatsKnobs: &sqlstats.TestingKnobs{
+					AOSTClause: "AS OF SYSTEM TIME '-1us'",
+					StubTimeNow: func() time.Time {
+						return stubTime.Load().(time.Time)
+					},
+				},
+			},
+		},
+	)
+	defer server.Stopper().Stop(ctx)
+
+	sqlConn := sqlutils.MakeSQLRunner(conn)
+	sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.flush.interval = '24h'")
+	sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.cleanup.recurrence = '@yearly'")
+	sqlConn.Exec(t, "SELECT crdb_internal.reset_sql_stats()")
+
+	for _, appName := range []string{"deletable", "undeletable"} {
+		sqlConn.Exec(t, "SET application_name = $1", appName)
+		generateFingerprints(t, sqlConn, 20 /* distinctFingerprints */)
+	}
+	sqlConn.Exec(t, "RESET application_name")
+	server.SQLServer().(*sql.Server).
+		GetSQLStatsProvider().(*persistedsqlstats.PersistedSQLStats).Flush(ctx)
+	stubTime.Store(timeutil.Now())
+
+	tables := []string{"system.statement_statistics", "system.transaction_statistics"}
+	for _, table := range tables {
+		sqlConn.Exec(t, fmt.Sprintf(
+			"DELETE FROM %s WHERE app_name NOT IN ('deletable', 'undeletable')", table))
+	}
+	countRows := func(table, appName string) (cnt int) {
+		sqlConn.QueryRow(t,
+			fmt.Sprintf("SELECT count(*) FROM %s WHERE app_name = $1", table), appName,
+		).Scan(&cnt)
+		return cnt
+	}
+	undeletableRows := make([]int, len(tables))
+	for i, table := range tables {
+		undeletableRows[i] = countRows(table, "undeletable")
+	}
+
+	// The batched deletions always fail, and so do the deletions of the rows
+	// of the undeletable application.
+	errUndeletable := pgerror.New(pgcode.DataCorrupted, "undeletable row")
+	metrics := persistedsqlstats.CompactorMetrics{
+		RowsRemoved: metric.NewCounter(metric.Metadata{}),
+		SkippedRows: metric.NewCounter(metric.Metadata{}),
+	}
+	statsCompactor := persistedsqlstats.NewStatsCompactor(
+		server.ClusterSettings(),
+		server.InternalDB().(isql.DB),
+		metrics,
+		&sqlstats.TestingKnobs{
+			AOSTClause: "AS OF SYSTEM TIME '-1us'",
+			BeforeCompactionDelete: func(stmt string, qargs []interface{}) error {
+				if strings.Contains(stmt, "RETURNING") {
+					return errUndeletable
+				}
+				for _, arg := range qargs {
+					if d, ok := arg.(*tree.DString); ok && string(*d) == "undeletable" {
+						return errUndeletable
+					}
+				}
+				return nil
+			},
+		},
+	)
+
+	// Keep a single row per hash bucket, so that each bucket holding several
+	// rows of the undeletable application has rows to skip.
+	sqlConn.Exec(t, fmt.Sprintf("SET CLUSTER SETTING sql.stats.persisted_rows.max = %d",
+		systemschema.SQLStatsHashShardBucketCount))
+	require.NoError(t, statsCompactor.DeleteOldestEntries(ctx))
+	require.Greater(t, metrics.SkippedRows.Count(), int64(0))
+	require.Greater(t, metrics.RowsRemoved.Count(), int64(0))
+	for i, table := range tables {
+		require.Equal(t, undeletableRows[i], countRows(table, "undeletable"), table)
+		require.LessOrEqual(t, countRows(table, "deletable"),
+			systemschema.SQLStatsHashShardBucketCount, table)
+	}
+
+	// An error that is not specific to the deleted rows, e.g. an unavailable
+	// range, fails the run instead of skipping the rows.
+	errUnavailable := errors.New("range unavailable")
+	skippedRows := metrics.SkippedRows.Count()
+	failingCompactor := persistedsqlstats.NewStatsCompactor(
+		server.ClusterSettings(),
+		server.InternalDB().(isql.DB),
+		metrics,
+		&sqlstats.TestingKnobs{
+			AOSTClause: "AS OF SYSTEM TIME '-1us'",
+			BeforeCompactionDelete: func(stmt string, qargs []interface{}) error {
+				return errUnavailable
+			},
+		},
+	)
+	sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.persisted_rows.max = 1")
+	require.ErrorIs(t, failingCompactor.DeleteOldestEntries(ctx), errUnavailable)
+	require.Equal(t, skippedRows, metrics.SkippedRows.Count())
+}
+
+func TestSQLStatsCompactorSanityFraction(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	ctx := context.Background()
+	var stubTime atomic.Value
+	knobs := &sqlstats.TestingKnobs{
+		AOSTClause: "AS OF SYSTEM TIME '-1us'",
+		StubTimeNow: func() time.Time {
+			return stubTime.Load().(time.Time)
+		},
+	}
+	server, conn, _ := serverutils.StartServer(t, base.TestServerArgs{
+		Knobs: base.TestingKnobs{SQLStatsKnobs: knobs},
+	})
+	defer server.Stopper().Stop(ctx)
+
+	sqlConn := sqlutils.MakeSQLRunner(conn)
+	sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.flush.interval = '24h'")
+	sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.cleanup.recurrence = '@yearly'")
+	sqlConn.Exec(t, "SELECT crdb_internal.reset_sql_stats()")
+	sqlStats := server.SQLServer().(*sql.Server).
+		GetSQLStatsProvider().(*persistedsqlstats.PersistedSQLStats)
+
+	// persistFingerprints persists the stats of 20 fingerprints of the given
+	// application, and only keeps the rows of the test applications, so that
+	// the number of rows of the tables is known.
+	persistFingerprints := func(appName string) {
+		stubTime.Store(timeutil.Now().Add(-2 * time.Hour))
+		sqlConn.Exec(t, "SET application_name = $1", appName)
+		generateFingerprints(t, sqlConn, 20 /* distinctFingerprints */)
+		sqlConn.Exec(t, "RESET application_name")
+		sqlStats.Flush(ctx)
+		stubTime.Store(timeutil.Now())
+		for _, table := range []string{"system.statement_statistics", "system.transaction_statistics"} {
+			sqlConn.Exec(t, fmt.Sprintf(
+				"DELETE FROM %s WHERE app_name NOT IN ('first_app', 'second_app')", table))
+		}
+	}
+
+	metrics := persistedsqlstats.CompactorMetrics{
+		RowsRemoved:             metric.NewCounter(metric.Metadata{}),
+		SanityThresholdExceeded: metric.NewCounter(metric.Metadata{}),
+	}
+	statsCompactor := persistedsqlstats.NewStatsCompactor(
+		server.ClusterSettings(),
+		server.InternalDB().(isql.DB),
+		metrics,
+		knobs,
+	)
+	// Keep at most a single row per hash bucket.
+	sqlConn.Exec(t, fmt.Sprintf("SET CLUSTER SETTING sql.stats.persisted_rows.max = %d",
+		systemschema.SQLStatsHashShardBucketCount))
+
+	// The runs removing less than the sanity fraction of the rows are not
+	// flagged.
+	persistFingerprints("first_app")
+	sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.cleanup.sanity_fraction = 0.99")
+	require.NoError(t, statsCompactor.DeleteOldestEntries(ctx))
+	require.Greater(t, metrics.RowsRemoved.Count(), int64(0))
+	require.Zero(t, metrics.SanityThresholdExceeded.Count())
+
+	// The runs removing more are flagged for each table, and still remove
+	// the rows.
+	persistFingerprints("second_app")
+	stmtCnt, txnCnt := getPersistedStatsEntry(t, sqlConn)
+	require.Greater(t, stmtCnt, 2*systemschema.SQLStatsHashShardBucketCount)
+	require.Greater(t, txnCnt, 2*systemschema.SQLStatsHashShardBucketCount)
+	sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.cleanup.sanity_fraction = 0.5")
+	require.NoError(t, statsCompactor.DeleteOldestEntries(ctx))
+	require.Equal(t, int64(2), metrics.SanityThresholdExceeded.Count())
+	stmtCnt, txnCnt = getPersistedStatsEntry(t, sqlConn)
+	require.LessOrEqual(t, stmtCnt, systemschema.SQLStatsHashShardBucketCount)
+	require.LessOrEqual(t, txnCnt, systemschema.SQLStatsHashShardBucketCount)
+
+	// The check can be disabled.
+	persistFingerprints("first_app")
+	sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.cleanup.sanity_fraction = 0")
+	require.NoError(t, statsCompactor.DeleteOldestEntries(ctx))
+	require.Equal(t, int64(2), metrics.SanityThresholdExceeded.Count())
+}
+
+func TestSQLStatsCompactorMaxRowsPerRun(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	ctx := context.Background()
+	var stubTime atomic.Value
+	stubTime.Store(timeutil.Now().Add(-2 * time.Hour))
+	knobs := &sqlstats.TestingKnobs{
+		AOSTClause: "AS OF SYSTEM TIME '-1us'",
+		StubTimeNow: func() time.Time {
+			return stubTime.Load().(time.Time)
+		},
+	}
+	server, conn, _ := serverutils.StartServer(t, base.TestServerArgs{
+		Knobs: base.TestingKnobs{SQLStatsKnobs: knobs},
+	})
+	defer server.Stopper().Stop(ctx)
+
+	sqlConn := sqlutils.MakeSQLRunner(conn)
+	sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.flush.interval = '24h'")
+	sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.cleanup.recurrence = '@yearly'")
+	sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.persisted_rows.max = 8")
+	sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.cleanup.max_rows_per_run = 5")
+	sqlConn.Exec(t, "SELECT crdb_internal.reset_sql_stats()")
+
+	generateFingerprints(t, sqlConn, 20 /* distinctFingerprints */)
+	server.SQLServer().(*sql.Server).
+		GetSQLStatsProvider().(*persistedsqlstats.PersistedSQLStats).Flush(ctx)
+	stubTime.Store(timeutil.Now())
+	stmtStatsCnt, txnStatsCnt := getPersistedStatsEntry(t, sqlConn)
+
+	statsCompactor := persistedsqlstats.NewStatsCompactor(
+		server.ClusterSettings(),
+		server.InternalDB().(isql.DB),
+		persistedsqlstats.CompactorMetrics{RowsRemoved: metric.NewCounter(metric.Metadata{})},
+		knobs,
+	)
+
+	// Each run removes at most 5 rows across both tables, and reports that
+	// rows remain until the backlog is cleared. The budget is split between
+	// the tables, so the statement table, which is compacted first, does not
+	// starve the transaction table.
+	var runs int
+	var totalRowsRemoved int
+	for {
+		runs++
+		require.Less(t, runs, 100, "compaction did not converge")
+		results, err := statsCompactor.DeleteOldestEntriesWithReport(ctx)
+		require.NoError(t, err)
+		require.Len(t, results, 2)
+		if runs == 1 {
+			require.Equal(t, int64(3), results[0].Rows, "rows removed from %s", results[0].Table)
+			require.Equal(t, int64(2), results[1].Rows, "rows removed from %s", results[1].Table)
+		}
+		var rowsRemoved int64
+		var exhausted bool
+		for _, result := range results {
+			rowsRemoved += result.Rows
+			exhausted = exhausted || result.BudgetExhausted
+		}
+		require.LessOrEqual(t, rowsRemoved, int64(5))
+		totalRowsRemoved += int(rowsRemoved)
+		if !exhausted {
+			break
+		}
+		require.Positive(t, rowsRemoved)
+	}
+	require.Greater(t, runs, 1)
+
+	// Once the backlog is cleared, the tables are compacted as if the runs
+	// were not limited.
+	stmtStatsCntAfter, txnStatsCntAfter := getPersistedStatsEntry(t, sqlConn)
+	require.Equal(t, stmtStatsCnt+txnStatsCnt-totalRowsRemoved, stmtStatsCntAfter+txnStatsCntAfter)
+	sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.cleanup.max_rows_per_run = 0")
+	results, err := statsCompactor.DeleteOldestEntriesWithReport(ctx)
+	require.NoError(t, err)
+	for _, result := range results {
+		require.Zero(t, result.Rows, "rows removed from %s", result.Table)
+		require.False(t, result.BudgetExhausted)
+	}
+}
+
+func TestSQLStatsCompactorDeleteRateLimit(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	ctx := context.Background()
+	var stubTime atomic.Value
+	stubTime.Store(timeutil.Now().Add(-2 * time.Hour))
+	knobs := &sqlstats.TestingKnobs{
+		AOSTClause: "AS OF SYSTEM TIME '-1us'",
+		StubTimeNow: func() time.Time {
+			return stubTime.Load().(time.Time)
+		},
+	}
+	server, conn, _ := serverutils.StartServer(t, base.TestServerArgs{
+		Knobs: base.TestingKnobs{SQLStatsKnobs: knobs},
+	})
+	defer server.Stopper().Stop(ctx)
+
+	const rateLimit = 10
+	sqlConn := sqlutils.MakeSQLRunner(conn)
+	sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.flush.interval = '24h'")
+	sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.cleanup.recurrence = '@yearly'")
+	sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.persisted_rows.max = 8")
+	sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.cleanup.rows_to_delete_per_txn = 1")
+	sqlConn.Exec(t, fmt.Sprintf("SET CLUSTER SETTING sql.stats.cleanup.delete_rate_limit = %d", rateLimit))
+	sqlConn.Exec(t, "SELECT crdb_internal.reset_sql_stats()")
+
+	generateFingerprints(t, sqlConn, 30 /* distinctFingerprints */)
+	server.SQLServer().(*sql.Server).
+		GetSQLStatsProvider().(*persistedsqlstats.PersistedSQLStats).Flush(ctx)
+	stubTime.Store(timeutil.Now())
+
+	metrics := persistedsqlstats.CompactorMetrics{
+		RowsRemoved:  metric.NewCounter(metric.Metadata{}),
+		ThrottleWait: metric.NewCounter(metric.Metadata{}),
+	}
+	statsCompactor := persistedsqlstats.NewStatsCompactor(
+		server.ClusterSettings(),
+		server.InternalDB().(isql.DB),
+		metrics,
+		knobs,
+	)
+	start := timeutil.Now()
+	results, err := statsCompactor.DeleteOldestEntriesWithReport(ctx)
+	require.NoError(t, err)
+	elapsed := timeutil.Since(start)
+	var rowsRemoved int64
+	for _, result := range results {
+		rowsRemoved += result.Rows
+	}
+	require.Greater(t, rowsRemoved, int64(3*rateLimit))
+
+	// The token bucket initially holds one second worth of rows, and the
+	// wait for the last deletion is not observed, so the run lasts at least
+	// as long as the removal of the other rows at the limit.
+	minDuration := time.Duration(rowsRemoved-rateLimit-1) * time.Second / rateLimit
+	require.GreaterOrEqual(t, elapsed, minDuration)
+
+	// The time spent waiting for the rate limiter is part of the run. It is
+	// counted in whole seconds.
+	throttleWait := time.Duration(metrics.ThrottleWait.Count()) * time.Second
+	require.Greater(t, throttleWait, time.Duration(0))
+	require.LessOrEqual(t, throttleWait, elapsed)
+}
+
+func TestSQLStatsCompactorDeleteParallelism(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	ctx := context.Background()
+	var stubTime atomic.Value
+	stubTime.Store(timeutil.Now().Add(-2 * time.Hour))
+	var shardsStarted int64
+	knobs := &sqlstats.TestingKnobs{
+		AOSTClause: "AS OF SYSTEM TIME '-1us'",
+		StubTimeNow: func() time.Time {
+			return stubTime.Load().(time.Time)
+		},
+		OnCleanupStartForShard: func(_ int, _, _ int64) {
+			atomic.AddInt64(&shardsStarted, 1)
+		},
+	}
+	server, conn, _ := serverutils.StartServer(t, base.TestServerArgs{
+		Knobs: base.TestingKnobs{SQLStatsKnobs: knobs},
+	})
+	defer server.Stopper().Stop(ctx)
+
+	const maxPersistedRows = 8
+	sqlConn := sqlutils.MakeSQLRunner(conn)
+	sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.flush.interval = '24h'")
+	sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.cleanup.recurrence = '@yearly'")
+	sqlConn.Exec(t, fmt.Sprintf("SET CLUSTER SETTING sql.stats.persisted_rows.max = %d", maxPersistedRows))
+	sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.cleanup.rows_to_delete_per_txn = 1")
+	sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.cleanup.delete_parallelism = 4")
+	sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.cleanup.max_rows_per_run = 5")
+	sqlConn.Exec(t, "SELECT crdb_internal.reset_sql_stats()")
+
+	generateFingerprints(t, sqlConn, 30 /* distinctFingerprints */)
+	server.SQLServer().(*sql.Server).
+		GetSQLStatsProvider().(*persistedsqlstats.PersistedSQLStats).Flush(ctx)
+	stubTime.Store(timeutil.Now())
+
+	statsCompactor := persistedsqlstats.NewStatsCompactor(
+		server.ClusterSettings(),
+		server.InternalDB().(isql.DB),
+		persistedsqlstats.CompactorMetrics{RowsRemoved: metric.NewCounter(metric.Metadata{})},
+		knobs,
+	)
+
+	// The hash buckets processed concurrently share the budget of the run.
+	results, err := statsCompactor.DeleteOldestEntriesWithReport(ctx)
+	require.NoError(t, err)
+	var rowsRemoved int64
+	for _, result := range results {
+		rowsRemoved += result.Rows
+	}
+	require.Equal(t, int64(5), rowsRemoved)
+
+	// Without a budget, all the buckets of both tables are compacted.
+	sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.cleanup.max_rows_per_run = 0")
+	atomic.StoreInt64(&shardsStarted, 0)
+	_, err = statsCompactor.DeleteOldestEntriesWithReport(ctx)
+	require.NoError(t, err)
+	require.Equal(t, int64(2*systemschema.SQLStatsHashShardBucketCount), atomic.LoadInt64(&shardsStarted))
+	stmtStatsCnt, txnStatsCnt := getPersistedStatsEntry(t, sqlConn)
+	require.LessOrEqual(t, stmtStatsCnt, maxPersistedRows)
+	require.LessOrEqual(t, txnStatsCnt, maxPersistedRows)
+}
+
+func TestSQLStatsCompactorCheckpoint(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	ctx := context.Background()
+	server, conn, _ := serverutils.StartServer(
+		t, base.TestServerArgs{
+			Knobs: base.TestingKnobs{
+				SQLStatsKnobs: &sqlstats.TestingKnobs{
+					AOSTClause: "AS OF SYSTEM TIME '-1us'",
+					StubTimeNow: func() time.Time {
+						return timeutil.Now().Add(-2 * time.Hour)
+					},
+				},
+			},
+		},
+	)
+	defer server.Stopper().Stop(ctx)
+
+	sqlConn := sqlutils.MakeSQLRunner(conn)
+	sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.flush.interval = '24h'")
+	sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.cleanup.recurrence = '@yearly'")
+	sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.persisted_rows.max = 1")
+	sqlConn.Exec(t, "SELECT crdb_internal.reset_sql_stats()")
+
+	generateFingerprints(t, sqlConn, 20 /* distinctFingerprints */)
+	server.SQLServer().(*sql.Server).
+		GetSQLStatsProvider().(*persistedsqlstats.PersistedSQLStats).Flush(ctx)
+	stmtStatsCnt, _ := getPersistedStatsEntry(t, sqlConn)
+
+	statsCompactor := persistedsqlstats.NewStatsCompactor(
+		server.ClusterSettings(),
+		server.InternalDB().(isql.DB),
+		persistedsqlstats.CompactorMetrics{RowsRemoved: metric.NewCounter(metric.Metadata{})},
+		&sqlstats.TestingKnobs{
+			AOSTClause: "AS OF SYSTEM TIME '-1us'",
+		},
+	)
+
+	// Resume from a checkpoint in which all the buckets of
+	// system.statement_statistics were compacted.
+	allBuckets := make([]int64, systemschema.SQLStatsHashShardBucketCount)
+	for i := range allBuckets {
+		allBuckets[i] = int64(i)
+	}
+	var saved persistedsqlstats.CompactionCheckpoint
+	statsCompactor.SetCheckpoint(
+		persistedsqlstats.CompactionCheckpoint{
+			Buckets: map[string][]int64{"system.statement_statistics": allBuckets},
+		},
+		func(ctx context.Context, cp persistedsqlstats.CompactionCheckpoint) error {
+			data, err := persistedsqlstats.MarshalCompactionCheckpoint(cp)
+			if err != nil {
+				return err
+			}
+			saved, err = persistedsqlstats.UnmarshalCompactionCheckpoint(data)
+			return err
+		},
+	)
+	require.NoError(t, statsCompactor.DeleteOldestEntries(ctx))
+
+	// The checkpointed buckets were not compacted again, while the ones of
+	// system.transaction_statistics were, and were added to the checkpoint.
+	stmtStatsCntAfter, txnStatsCntAfter := getPersistedStatsEntry(t, sqlConn)
+	require.Equal(t, stmtStatsCnt, stmtStatsCntAfter)
+	require.LessOrEqual(t, txnStatsCntAfter, 1)
+	require.ElementsMatch(t, allBuckets, saved.Buckets["system.statement_statistics"])
+	require.ElementsMatch(t, allBuckets, saved.Buckets["system.transaction_statistics"])
+}
+
+func TestSQLStatsCompactorVerify(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	ctx := context.Background()
+	server, conn, _ := serverutils.StartServer(
+		t, base.TestServerArgs{
+			Knobs: base.TestingKnobs{
+				SQLStatsKnobs: &sqlstats.TestingKnobs{
+					AOSTClause: "AS OF SYSTEM TIME '-1us'",
+					StubTimeNow: func() time.Time {
+						return timeutil.Now().Add(-2 * time.Hour)
+					},
+				},
+			},
+		},
+	)
+	defer server.Stopper().Stop(ctx)
+
+	sqlConn := sqlutils.MakeSQLRunner(conn)
+	sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.flush.interval = '24h'")
+	sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.cleanup.recurrence = '@yearly'")
+	sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.persisted_rows.max = 5")
+	sqlConn.Exec(t, "SELECT crdb_internal.reset_sql_stats()")
+
+	generateFingerprints(t, sqlConn, 20 /* distinctFingerprints */)
+	server.SQLServer().(*sql.Server).
+		GetSQLStatsProvider().(*persistedsqlstats.PersistedSQLStats).Flush(ctx)
+
+	// The batched deletions always fail, and the deletion of each row fails
+	// the first time it is attempted, so that the first pass of a run skips
+	// all the rows it tries to remove.
+	errFirstAttempt := pgerror.New(pgcode.DataCorrupted, "first attempt to delete the row")
+	var mu syncutil.Mutex
+	attempted := make(map[string]struct{})
+	statsCompactor := persistedsqlstats.NewStatsCompactor(
+		server.ClusterSettings(),
+		server.InternalDB().(isql.DB),
+		persistedsqlstats.CompactorMetrics{RowsRemoved: metric.NewCounter(metric.Metadata{})},
+		&sqlstats.TestingKnobs{
+			AOSTClause: "AS OF SYSTEM TIME '-1us'",
+			BeforeCompactionDelete: func(stmt string, qargs []interface{}) error {
+				if strings.Contains(stmt, "RETURNING") {
+					return errFirstAttempt
+				}
+				mu.Lock()
+				defer mu.Unlock()
+				key := fmt.Sprint(qargs...)
+				if _, ok := attempted[key]; ok {
+					return nil
+				}
+				attempted[key] = struct{}{}
+				return errFirstAttempt
+			},
+		},
+	)
+	fetchWarnings := func(pattern string) []logpb.Entry {
+		log.FlushFileSinks()
+		entries, err := log.FetchEntriesFromFiles(
+			0, /* startTimestamp */
+			math.MaxInt64,
+			100, /* maxEntries */
+			regexp.MustCompile(pattern),
+			log.WithFlattenedSensitiveData,
+		)
+		require.NoError(t, err)
+		return entries
+	}
+
+	// The verification is off by default, so the skipped rows remain until
+	// the next run.
+	require.NoError(t, statsCompactor.DeleteOldestEntries(ctx))
+	stmtStatsCnt, txnStatsCnt := getPersistedStatsEntry(t, sqlConn)
+	require.Greater(t, stmtStatsCnt, 5)
+	require.Greater(t, txnStatsCnt, 5)
+	require.Empty(t, fetchWarnings(`rows after compaction`))
+
+	// Once enabled, the rows skipped by the first pass are removed by the
+	// second one, and the tables end up under the row cap.
+	sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.cleanup.verify = true")
+	func() {
+		mu.Lock()
+		defer mu.Unlock()
+		attempted = make(map[string]struct{})
+	}()
+	require.NoError(t, statsCompactor.DeleteOldestEntries(ctx))
+	stmtStatsCnt, txnStatsCnt = getPersistedStatsEntry(t, sqlConn)
+	require.LessOrEqual(t, stmtStatsCnt, 5)
+	require.LessOrEqual(t, txnStatsCnt, 5)
+	for _, table := range []string{"statement_statistics", "transaction_statistics"} {
+		require.NotEmpty(t, fetchWarnings(`system\.`+table+` holds \d+ rows after compaction, `+
+			`more than sql\.stats\.persisted_rows\.max \(5\); compacting \d+ hash buckets again`))
+		require.Empty(t, fetchWarnings(`system\.`+table+` holds \d+ rows after compacting it again`))
+	}
+}
+
+func TestSQLStatsCompactorWindowGrace(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	ctx := context.Background()
+	fakeTime := &stubTime{}
+	server, conn, _ := serverutils.StartServer(t, base.TestServerArgs{
+		Knobs: base.TestingKnobs{
+			SQLStatsKnobs: &sqlstats.TestingKnobs{
+				StubTimeNow: fakeTime.Now,
+			},
+		},
+	})
+	defer server.Stopper().Stop(ctx)
+
+	sqlConn := sqlutils.MakeSQLRunner(conn)
+	sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.flush.interval = '24h'")
+	sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.cleanup.recurrence = '@yearly'")
+	sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.persisted_rows.max_age = '1m'")
+	sqlConn.Exec(t, "SELECT crdb_internal.reset_sql_stats()")
+	sqlStats := server.SQLServer().(*sql.Server).
+		GetSQLStatsProvider().(*persistedsqlstats.PersistedSQLStats)
+
+	// All the statements of the test run in the same session, so that their
+	// statistics are recorded under the same application name.
+	graceConn, err := conn.Conn(ctx)
+	require.NoError(t, err)
+	defer graceConn.Close()
+	execAndFlush := func(ctx context.Context, stmt string) error {
+		if _, err := graceConn.ExecContext(ctx, stmt); err != nil {
+			return err
+		}
+		sqlStats.Flush(ctx)
+		return nil
+	}
+	_, err = graceConn.ExecContext(ctx, "SET application_name = 'window_grace'")
+	require.NoError(t, err)
+
+	// Flush stats into a window that ended long ago, and into the window that
+	// is about to end.
+	fakeTime.setTime(time.Date(2023, 1, 1, 8, 30, 0, 0, time.UTC))
+	require.NoError(t, execAndFlush(ctx, "SELECT 1"))
+	fakeTime.setTime(time.Date(2023, 1, 1, 10, 59, 0, 0, time.UTC))
+	require.NoError(t, execAndFlush(ctx, "SELECT 1"))
+
+	// The clock of the compactor is past the end of the window, while the
+	// flushes are still writing to it.
+	statsCompactor := persistedsqlstats.NewStatsCompactor(
+		server.ClusterSettings(),
+		server.InternalDB().(isql.DB),
+		persistedsqlstats.CompactorMetrics{RowsRemoved: metric.NewCounter(metric.Metadata{})},
+		&sqlstats.TestingKnobs{
+			AOSTClause: "AS OF SYSTEM TIME '-1us'",
+			StubTimeNow: func() time.Time {
+				return time.Date(2023, 1, 1, 11, 1, 0, 0, time.UTC)
+			},
+		},
+	)
+
+	const concurrentFlushes = 10
+	g := ctxgroup.WithContext(ctx)
+	g.GoCtx(func(ctx context.Context) error {
+		for i := 1; i <= concurrentFlushes; i++ {
+			stmt := "SELECT 1" + strings.Repeat(", 1", i)
+			if err := execAndFlush(ctx, stmt); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	g.GoCtx(func(ctx context.Context) error {
+		for i := 0; i < 3; i++ {
+			if err := statsCompactor.DeleteOldestEntries(ctx); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	require.NoError(t, g.Wait())
+	require.NoError(t, statsCompactor.DeleteOldestEntries(ctx))
+
+	countRows := func(predicate string) string {
+		return `
+SELECT count(*) FROM system.statement_statistics
+WHERE app_name = 'window_grace' AND metadata ->> 'query' LIKE 'SELECT _%'
+  AND aggregated_ts ` + predicate
+	}
+	// The expired rows are removed, but none of the rows of the window in the
+	// grace period.
+	sqlConn.CheckQueryResults(t,
+		countRows("< '2023-01-01 10:00:00+00'"), [][]string{{"0"}})
+	sqlConn.CheckQueryResults(t,
+		countRows("= '2023-01-01 10:00:00+00'"), [][]string{{fmt.Sprint(concurrentFlushes + 1)}})
+
+	// Once the grace period is shorter than the time elapsed since the end of
+	// the window, its rows are removed.
+	sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.cleanup.window_grace = '1s'")
+	require.NoError(t, statsCompactor.DeleteOldestEntries(ctx))
+	sqlConn.CheckQueryResults(t,
+		countRows("= '2023-01-01 10:00:00+00'"), [][]string{{"0"}})
+}
+
+func TestSQLStatsCompactorEmptyTables(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	ctx := context.Background()
+	server, conn, _ := serverutils.StartServer(t, base.TestServerArgs{})
+	defer server.Stopper().Stop(ctx)
+
+	sqlConn := sqlutils.MakeSQLRunner(conn)
+	sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.flush.enabled = false")
+	sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.cleanup.recurrence = '@yearly'")
+	sqlConn.Exec(t, "SELECT crdb_internal.reset_sql_stats()")
+	stmtStatsCnt, txnStatsCnt := getPersistedStatsEntry(t, sqlConn)
+	require.Zero(t, stmtStatsCnt)
+	require.Zero(t, txnStatsCnt)
+
+	metrics := persistedsqlstats.CompactorMetrics{
+		RowsRemoved:      metric.NewCounter(metric.Metadata{}),
+		OldestRowAge:     metric.NewGauge(metric.Metadata{}),
+		DistinctAppNames: metric.NewGauge(metric.Metadata{}),
+	}
+	statsCompactor := persistedsqlstats.NewStatsCompactor(
+		server.ClusterSettings(),
+		server.InternalDB().(isql.DB),
+		metrics,
+		&sqlstats.TestingKnobs{AOSTClause: "AS OF SYSTEM TIME '-1us'"},
+	)
+
+	// Every part of the retention policy that scans the tables is enabled, so
+	// that none of them can assume that the tables have rows.
+	for _, setting := range []string{
+		"sql.stats.persisted_rows.max = 1",
+		"sql.stats.persisted_rows.max_age = '1h'",
+		"sql.stats.cleanup.catchup.enabled = true",
+		"sql.stats.cleanup.coalesce_windows.enabled = true",
+		"sql.stats.cleanup.retain_latest_per_fingerprint = true",
+		"sql.stats.cleanup.retain_recently_executed.enabled = true",
+	} {
+		sqlConn.Exec(t, "SET CLUSTER SETTING "+setting)
+	}
+
+	// The compaction of empty tables is a no-op, which should complete well
+	// within the timeout.
+	timeoutCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	results, err := statsCompactor.DeleteOldestEntriesWithReport(timeoutCtx)
+	require.NoError(t, err)
+	require.Len(t, results, 2)
+	for _, result := range results {
+		require.Zero(t, result.Rows, "rows removed from %s", result.Table)
+	}
+	require.Zero(t, metrics.RowsRemoved.Count())
+	require.Zero(t, metrics.OldestRowAge.Value())
+	require.Zero(t, metrics.DistinctAppNames.Value())
+
+	diffs, err := statsCompactor.DiffPolicies(timeoutCtx, 1 /* proposedMaxRows */, time.Hour)
+	require.NoError(t, err)
+	for _, diff := range diffs {
+		require.Zero(t, diff.CurrentRowsToDelete, "rows to delete from %s", diff.Table)
+		require.Zero(t, diff.ProposedRowsToDelete, "rows to delete from %s", diff.Table)
+	}
+}
+
 func TestSQLStatsCompactionJobMarkedAsAutomatic(t *testing.T) {
 	defer leaktest.AfterTest(t)()
 	defer log.Scope(t).Close(t)
@@ -297,6 +2871,196 @@ func TestSQLStatsCompactionJobMarkedAsAutomatic(t *testing.T) {
 	t.Logf("test complete")
 }
 
+func TestSQLStatsCompactionLock(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	var cleanupCalls int32
+	blockCh := make(chan struct{})
+	params, _ := tests.CreateTestServerParams()
+	params.Knobs.JobsTestingKnobs = jobs.NewTestingKnobsWithShortIntervals()
+	params.Knobs.SQLStatsKnobs = &sqlstats.TestingKnobs{
+		OnCleanupStartForShard: func(_ int, _, _ int64) {
+			// Block the first compaction job while it holds the lock.
+			if atomic.AddInt32(&cleanupCalls, 1) == 1 {
+				<-blockCh
+			}
+		},
+	}
+
+	ctx := context.Background()
+	server, conn, _ := serverutils.StartServer(t, params)
+	defer server.Stopper().Stop(ctx)
+
+	sqlDB := sqlutils.MakeSQLRunner(conn)
+	jobStatusQuery := "SELECT status FROM crdb_internal.jobs WHERE job_id = %d"
+
+	firstJobID, err := launchSQLStatsCompactionJob(server)
+	require.NoError(t, err)
+	testutils.SucceedsSoon(t, func() error {
+		if atomic.LoadInt32(&cleanupCalls) == 0 {
+			return errors.New("first compaction job has not started yet")
+		}
+		return nil
+	})
+
+	// The lock is the row of the run in progress of the first job.
+	runsQuery := fmt.Sprintf(`
+SELECT job_id, outcome, completed_at IS NULL, session_id IS NOT NULL
+FROM system.sql_stats_compaction_runs
+WHERE job_id = %d`, firstJobID)
+	sqlDB.CheckQueryResults(t, runsQuery,
+		[][]string{{fmt.Sprint(firstJobID), "running", "true", "true"}})
+
+	// The second compaction job must not do any work while the first one is
+	// running.
+	secondJobID, err := launchSQLStatsCompactionJob(server)
+	require.NoError(t, err)
+	sqlDB.CheckQueryResultsRetry(t, fmt.Sprintf(jobStatusQuery, secondJobID), [][]string{{"succeeded"}})
+	require.Equal(t, int32(1), atomic.LoadInt32(&cleanupCalls))
+
+	// Once the first job is done, the lock is released and subsequent
+	// compaction jobs run normally.
+	close(blockCh)
+	sqlDB.CheckQueryResultsRetry(t, fmt.Sprintf(jobStatusQuery, firstJobID), [][]string{{"succeeded"}})
+	callsAfterFirstJob := atomic.LoadInt32(&cleanupCalls)
+	sqlDB.CheckQueryResults(t, runsQuery,
+		[][]string{{fmt.Sprint(firstJobID), "succeeded", "false", "false"}})
+
+	thirdJobID, err := launchSQLStatsCompactionJob(server)
+	require.NoError(t, err)
+	sqlDB.CheckQueryResultsRetry(t, fmt.Sprintf(jobStatusQuery, thirdJobID), [][]string{{"succeeded"}})
+	require.Greater(t, atomic.LoadInt32(&cleanupCalls), callsAfterFirstJob)
+}
+
+func TestSQLStatsCompactionCoordinator(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	var cleanupStarted, cleanupCalls int32
+	blockCh := make(chan struct{})
+	params, _ := tests.CreateTestServerParams()
+	params.Knobs.JobsTestingKnobs = jobs.NewTestingKnobsWithShortIntervals()
+	params.Knobs.SQLStatsKnobs = &sqlstats.TestingKnobs{
+		OnCleanupStartForShard: func(_ int, _, _ int64) {
+			atomic.AddInt32(&cleanupCalls, 1)
+			if atomic.CompareAndSwapInt32(&cleanupStarted, 0, 1) {
+				<-blockCh
+			}
+		},
+	}
+
+	ctx := context.Background()
+	server, conn, _ := serverutils.StartServer(t, params)
+	defer server.Stopper().Stop(ctx)
+
+	sqlDB := sqlutils.MakeSQLRunner(conn)
+	coordinatorQuery := "SELECT crdb_internal.sql_stats_compaction_coordinator()"
+	sqlDB.CheckQueryResults(t, coordinatorQuery, [][]string{{"NULL"}})
+
+	jobID, err := launchSQLStatsCompactionJob(server)
+	require.NoError(t, err)
+	testutils.SucceedsSoon(t, func() error {
+		if atomic.LoadInt32(&cleanupStarted) == 0 {
+			return errors.New("compaction job has not started yet")
+		}
+		return nil
+	})
+
+	// The job is blocked on the node of the test server.
+	sqlDB.CheckQueryResults(t, coordinatorQuery,
+		[][]string{{fmt.Sprint(server.SQLInstanceID())}})
+
+	// The compaction job holds the compaction lock, so a compaction cannot be
+	// requested concurrently.
+	sqlDB.ExpectErr(t,
+		fmt.Sprintf("a SQL stats compaction is already running on node %d", server.SQLInstanceID()),
+		"SELECT * FROM crdb_internal.sql_stats_compact_now(false)")
+
+	close(blockCh)
+	jobStatusQuery := "SELECT status FROM crdb_internal.jobs WHERE job_id = %d"
+	sqlDB.CheckQueryResultsRetry(t, fmt.Sprintf(jobStatusQuery, jobID), [][]string{{"succeeded"}})
+	sqlDB.CheckQueryResultsRetry(t, coordinatorQuery, [][]string{{"NULL"}})
+
+	// Conversely, a compaction job does not do any work while a requested
+	// compaction holds the lock.
+	blockCh = make(chan struct{})
+	atomic.StoreInt32(&cleanupStarted, 0)
+	compactNowErr := make(chan error, 1)
+	go func() {
+		_, err := conn.Exec("SELECT * FROM crdb_internal.sql_stats_compact_now(false)")
+		compactNowErr <- err
+	}()
+	testutils.SucceedsSoon(t, func() error {
+		if atomic.LoadInt32(&cleanupStarted) == 0 {
+			return errors.New("compaction has not started yet")
+		}
+		return nil
+	})
+	sqlDB.CheckQueryResults(t, coordinatorQuery,
+		[][]string{{fmt.Sprint(server.SQLInstanceID())}})
+	callsBeforeJob := atomic.LoadInt32(&cleanupCalls)
+	jobID, err = launchSQLStatsCompactionJob(server)
+	require.NoError(t, err)
+	sqlDB.CheckQueryResultsRetry(t, fmt.Sprintf(jobStatusQuery, jobID), [][]string{{"succeeded"}})
+	require.Equal(t, callsBeforeJob, atomic.LoadInt32(&cleanupCalls))
+
+	close(blockCh)
+	require.NoError(t, <-compactNowErr)
+	sqlDB.CheckQueryResults(t, coordinatorQuery, [][]string{{"NULL"}})
+}
+
+func TestSQLStatsCompactionNotify(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	params, _ := tests.CreateTestServerParams()
+	params.Knobs.JobsTestingKnobs = jobs.NewTestingKnobsWithShortIntervals()
+
+	ctx := context.Background()
+	server, _, _ := serverutils.StartServer(t, params)
+	defer server.Stopper().Stop(ctx)
+
+	sqlStats := server.SQLServer().(*sql.Server).
+		GetSQLStatsProvider().(*persistedsqlstats.PersistedSQLStats)
+	// Every subscriber is notified of each compaction.
+	notifyCh, unsubscribe := sqlStats.CompactionNotifyCh()
+	defer unsubscribe()
+	otherNotifyCh, unsubscribeOther := sqlStats.CompactionNotifyCh()
+	defer unsubscribeOther()
+	// An unsubscribed channel is no longer signaled.
+	unsubscribedCh, unsubscribe3 := sqlStats.CompactionNotifyCh()
+	unsubscribe3()
+
+	// Nobody drains the channels for the first two compactions: they must
+	// complete anyway, and leave a single pending signal.
+	for i := 0; i < 2; i++ {
+		jobID, err := launchSQLStatsCompactionJob(server)
+		require.NoError(t, err)
+		require.NoError(t, server.JobRegistry().(*jobs.Registry).WaitForJobs(
+			ctx, []jobspb.JobID{jobID},
+		))
+	}
+
+	for _, ch := range []<-chan struct{}{notifyCh, otherNotifyCh} {
+		select {
+		case <-ch:
+		case <-time.After(testutils.DefaultSucceedsSoonDuration):
+			t.Fatal("no compaction notification received")
+		}
+		select {
+		case <-ch:
+			t.Fatal("unexpected second compaction notification")
+		default:
+		}
+	}
+	select {
+	case <-unsubscribedCh:
+		t.Fatal("unexpected compaction notification after unsubscribing")
+	default:
+	}
+}
+
 func launchSQLStatsCompactionJob(server serverutils.TestServerInterface) (jobspb.JobID, error) {
 	return persistedsqlstats.CreateCompactionJob(
 		context.Background(), nil /* createdByInfo */, nil, /* txn */
@@ -431,3 +3195,36 @@ func (c *cleanupInterceptor) intercept(shardIdx int, existingCountInShard, shard
 func (c *cleanupInterceptor) getExpectedNumberOfWideScans() int64 {
 	return systemschema.SQLStatsHashShardBucketCount*2 + atomic.LoadInt64(&c.expectedNumberOfWideScans)
 }
+
+func TestRecordCompactionRunTrimsOldRuns(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	ctx := context.Background()
+	params, _ := tests.CreateTestServerParams()
+	server, conn, _ := serverutils.StartServer(t, params)
+	defer server.Stopper().Stop(ctx)
+
+	sqlDB := sqlutils.MakeSQLRunner(conn)
+	sqlDB.Exec(t, `
+INSERT INTO system.sql_stats_compaction_runs
+  (completed_at, duration, stmt_rows_removed, txn_rows_removed, outcome)
+SELECT now() - i * '1m'::INTERVAL, '1s', 0, 0, 'succeeded'
+FROM generate_series(1, $1) AS g(i)`, persistedsqlstats.MaxRecordedCompactionRuns)
+
+	require.NoError(t, persistedsqlstats.RecordCompactionRun(ctx,
+		server.InternalDB().(isql.DB), server.ClusterSettings(),
+		persistedsqlstats.CompactionLock{}, jobspb.InvalidJobID,
+		time.Second, nil /* results */, nil /* runErr */))
+
+	// The oldest run was removed to make room for the new one.
+	sqlDB.CheckQueryResults(t, `
+SELECT count(*), max(completed_at) > now() - '1m'::INTERVAL
+FROM system.sql_stats_compaction_runs`,
+		[][]string{{fmt.Sprint(persistedsqlstats.MaxRecordedCompactionRuns), "true"}})
+	sqlDB.CheckQueryResults(t, fmt.Sprintf(`
+SELECT count(*) FROM system.sql_stats_compaction_runs
+WHERE completed_at < now() - %d * '1m'::INTERVAL + '30s'::INTERVAL`,
+		persistedsqlstats.MaxRecordedCompactionRuns),
+		[][]string{{"0"}})
+}
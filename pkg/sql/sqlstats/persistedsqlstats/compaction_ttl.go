@@ -0,0 +1,95 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package persistedsqlstats
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/lexbase"
+	"github.com/cockroachdb/errors"
+)
+
+// appNameTTL is an entry of sql.stats.cleanup.app_name_ttls: the rows of the
+// applications whose name matches the LIKE pattern are removed once they are
+// older than ttl.
+type appNameTTL struct {
+	pattern string
+	ttl     time.Duration
+}
+
+// parseAppNameTTLs parses the value of sql.stats.cleanup.app_name_ttls, a
+// comma-separated list of pattern=ttl entries, where the ttl is a positive Go
+// duration (e.g. 90m).
+func parseAppNameTTLs(s string) ([]appNameTTL, error) {
+	var ttls []appNameTTL
+	for _, entry := range strings.Split(s, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		// The ttl follows the last '=', so that the patterns can contain '='.
+		sep := strings.LastIndexByte(entry, '=')
+		if sep < 0 {
+			return nil, errors.Newf("invalid entry %q: expected pattern=ttl", entry)
+		}
+		pattern := strings.TrimSpace(entry[:sep])
+		if pattern == "" {
+			return nil, errors.Newf("invalid entry %q: empty pattern", entry)
+		}
+		ttl, err := time.ParseDuration(strings.TrimSpace(entry[sep+1:]))
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid ttl in entry %q", entry)
+		}
+		if ttl <= 0 {
+			return nil, errors.Newf("invalid entry %q: the ttl must be positive", entry)
+		}
+		ttls = append(ttls, appNameTTL{pattern: pattern, ttl: ttl})
+	}
+	return ttls, nil
+}
+
+// getAppNameTTLRemovals returns the removals of the rows of a table that are
+// older than the ttl of their application in sql.stats.cleanup.app_name_ttls.
+// The rows that are retained from the age limit, i.e. the ones excluded by
+// pinnedPredicate, the latest window of each fingerprint if
+// sql.stats.cleanup.retain_latest_per_fingerprint is set, and the rows of the
+// fingerprints executed within the ttl if
+// sql.stats.cleanup.retain_recently_executed.enabled is set, are also
+// retained from the ttl. A ttl longer than sql.stats.persisted_rows.max_age removes no
+// more rows than the age limit, so the mapping can only shorten the retention
+// of the matching applications. The rows persisted under the hash of an
+// application name (see sql.stats.flush.hash_app_names) only match the
+// pattern equal to that name, since a hash cannot be matched against a LIKE
+// pattern.
+func (c *StatsCompactor) getAppNameTTLRemovals(pinnedPredicate string) ([]ageRemoval, error) {
+	ttls, err := parseAppNameTTLs(SQLStatsCleanupAppNameTTLs.Get(&c.st.SV))
+	if err != nil {
+		return nil, err
+	}
+	retainRecentlyExecuted := SQLStatsCleanupRetainRecentlyExecuted.Get(&c.st.SV)
+	removals := make([]ageRemoval, 0, len(ttls))
+	for _, t := range ttls {
+		cutoff, err := c.getAgeCutoff(t.ttl)
+		if err != nil {
+			return nil, err
+		}
+		removals = append(removals, ageRemoval{
+			cutoff:                 cutoff,
+			retainRecentlyExecuted: retainRecentlyExecuted,
+			predicate: pinnedPredicate + fmt.Sprintf(
+				"\n        AND (s.app_name LIKE %s OR s.app_name = %s)",
+				lexbase.EscapeSQLString(t.pattern),
+				lexbase.EscapeSQLString(hashAppName(&c.st.SV, t.pattern))),
+		})
+	}
+	return removals, nil
+}
@@ -0,0 +1,119 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package persistedsqlstats
+
+import (
+	"context"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/catalog/systemschema"
+	"github.com/cockroachdb/cockroach/pkg/sql/sem/eval"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+)
+
+// rowCapReport describes a stats table after a compaction run, as derived
+// from the row counts used to plan the removal of its stale rows.
+type rowCapReport struct {
+	// rowCount is the number of rows left in the table by the run.
+	rowCount int64
+	// catchUp is set if the table was compacted in catch-up mode, in which
+	// case it is expected to remain above the row cap.
+	catchUp bool
+	// remainingPerShard is the number of rows above the limit of each hash
+	// bucket that another pass may remove: the rows that the run failed to
+	// delete. The rows that no longer match the removal predicates, e.g.
+	// because they are in the grace period, pinned or protected, are not
+	// included, and the buckets that only hold such rows are left out.
+	remainingPerShard map[int64]int64
+	// policy and table are the ones under which the rows of the table were
+	// removed by the run, and under which another pass removes them.
+	policy *compactionPolicy
+	table  compactionTable
+}
+
+// verifyRowCap checks that the stats tables are under
+// sql.stats.persisted_rows.max after a compaction run that returned the given
+// results. The row counts are the ones used to plan the run, less the rows it
+// removed, so no extra scan of the tables is needed; they do not account for
+// the rows written by the flushes since the run started. A warning is logged
+// for each table that is still above the cap, e.g. because of a bug, and the
+// hash buckets in which rows could be removed are compacted once more, see
+// rowCapReport. This second pass draws from what the run left of the
+// sql.stats.cleanup.max_rows_per_run budget, split between the tables again. The tables still above
+// the cap are then reported again. The rows that the retention policy keeps on
+// purpose, such as the ones in the grace period, the ones protected by
+// ProtectStats or the ones of the pinned applications, can keep a table above
+// the cap.
+//
+// The tables on which the run reached sql.stats.cleanup.max_rows_per_run, or
+// that were compacted in catch-up mode, are expected to remain above the cap,
+// so they are not checked. The returned results include the rows removed by
+// both passes.
+func (c *StatsCompactor) verifyRowCap(
+	ctx context.Context, results []eval.SQLStatsCompactionResult,
+) ([]eval.SQLStatsCompactionResult, error) {
+	maxPersistedRows, _ := c.getRetentionPolicy(ctx)
+	if maxPersistedRows == 0 {
+		return results, nil
+	}
+	for i := range results {
+		result := &results[i]
+		report, ok := c.rowCapReports[result.Table]
+		if !ok || result.BudgetExhausted || report.catchUp || report.rowCount <= maxPersistedRows {
+			continue
+		}
+		if len(report.remainingPerShard) == 0 {
+			log.Warningf(ctx, "%s holds %d rows after compaction, more than %s (%d); "+
+				"the remaining rows cannot be removed yet",
+				result.Table, report.rowCount, SQLStatsMaxPersistedRows.Key(), maxPersistedRows)
+			continue
+		}
+		log.Warningf(ctx, "%s holds %d rows after compaction, more than %s (%d); "+
+			"compacting %d hash buckets again",
+			result.Table, report.rowCount, SQLStatsMaxPersistedRows.Key(), maxPersistedRows,
+			len(report.remainingPerShard))
+		c.allocateTableRowBudget(int64(len(results) - i))
+		c.setRowBudgetExhausted(false)
+		rowsRemoved, err := c.removeRemainingRows(ctx, report)
+		result.Rows += rowsRemoved
+		report.rowCount -= rowsRemoved
+		if err != nil {
+			return nil, err
+		}
+		result.BudgetExhausted = c.isRowBudgetExhausted()
+		if report.rowCount > maxPersistedRows {
+			log.Warningf(ctx, "%s holds %d rows after compacting it again, more than %s (%d)",
+				result.Table, report.rowCount, SQLStatsMaxPersistedRows.Key(), maxPersistedRows)
+		}
+	}
+	return results, nil
+}
+
+// removeRemainingRows removes the rows of the given report that another pass
+// may remove, and returns the number of rows removed.
+func (c *StatsCompactor) removeRemainingRows(
+	ctx context.Context, report *rowCapReport,
+) (totalRowsRemoved int64, _ error) {
+	rowsRemovedPerShard := make([]int64, systemschema.SQLStatsHashShardBucketCount)
+	err := c.forEachShard(ctx, func(ctx context.Context, shardIdx int64) (err error) {
+		remaining, ok := report.remainingPerShard[shardIdx]
+		if !ok {
+			return nil
+		}
+		rowsRemovedPerShard[shardIdx], err = c.removeStaleRowsForShard(
+			ctx, report.policy, report.table, shardIdx, remaining,
+		)
+		return err
+	})
+	for _, rowsRemoved := range rowsRemovedPerShard {
+		totalRowsRemoved += rowsRemoved
+	}
+	return totalRowsRemoved, err
+}
@@ -0,0 +1,188 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package persistedsqlstats
+
+import (
+	"context"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
+	"github.com/cockroachdb/errors"
+)
+
+// cleanupWindowRecheckInterval is the maximum duration for which
+// WaitForCleanupWindow waits before checking the cleanup window again, so
+// that changes to sql.stats.cleanup.window are picked up by a deferred
+// compaction.
+const cleanupWindowRecheckInterval = time.Minute
+
+// CleanupWindow is the daily time window, configured by
+// sql.stats.cleanup.window, within which the compaction job is allowed to
+// remove rows. A window whose end precedes its start wraps around midnight.
+type CleanupWindow struct {
+	// Start and End are the offsets of the bounds of the window from
+	// midnight. The window includes Start and excludes End.
+	Start, End time.Duration
+	// Location is the time zone in which the bounds are interpreted.
+	Location *time.Location
+}
+
+// ParseCleanupWindow parses a cleanup window of the form "HH:MM-HH:MM",
+// optionally followed by a time zone name, e.g. "01:00-05:00 UTC". The time
+// zone defaults to UTC. An empty string parses to a nil window, which means
+// that the compaction can run at any time.
+func ParseCleanupWindow(s string) (*CleanupWindow, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil, nil
+	}
+
+	fields := strings.Fields(s)
+	if len(fields) > 2 {
+		return nil, errors.Newf("invalid cleanup window %q: expected HH:MM-HH:MM [time zone]", s)
+	}
+	w := &CleanupWindow{Location: time.UTC}
+	if len(fields) == 2 {
+		loc, err := timeutil.LoadLocation(fields[1])
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid time zone in cleanup window %q", s)
+		}
+		w.Location = loc
+	}
+
+	bounds := strings.Split(fields[0], "-")
+	if len(bounds) != 2 {
+		return nil, errors.Newf("invalid cleanup window %q: expected HH:MM-HH:MM [time zone]", s)
+	}
+	var err error
+	if w.Start, err = parseTimeOfDay(bounds[0]); err != nil {
+		return nil, errors.Wrapf(err, "invalid start of cleanup window %q", s)
+	}
+	if w.End, err = parseTimeOfDay(bounds[1]); err != nil {
+		return nil, errors.Wrapf(err, "invalid end of cleanup window %q", s)
+	}
+	if w.Start == w.End {
+		return nil, errors.Newf("invalid cleanup window %q: start and end must differ", s)
+	}
+	return w, nil
+}
+
+// parseTimeOfDay parses a time of day of the form "HH:MM" and returns its
+// offset from midnight.
+func parseTimeOfDay(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// TimeUntilOpen returns the duration from now until the window opens, or
+// zero if now is within the window.
+func (w *CleanupWindow) TimeUntilOpen(now time.Time) time.Duration {
+	now = now.In(w.Location)
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, w.Location)
+	sinceMidnight := now.Sub(midnight)
+
+	var inWindow bool
+	if w.Start < w.End {
+		inWindow = sinceMidnight >= w.Start && sinceMidnight < w.End
+	} else {
+		inWindow = sinceMidnight >= w.Start || sinceMidnight < w.End
+	}
+	if inWindow {
+		return 0
+	}
+
+	untilOpen := w.Start - sinceMidnight
+	if untilOpen < 0 {
+		untilOpen += 24 * time.Hour
+	}
+	return untilOpen
+}
+
+// String implements the fmt.Stringer interface.
+func (w *CleanupWindow) String() string {
+	midnight := time.Time{}
+	return midnight.Add(w.Start).Format("15:04") + "-" +
+		midnight.Add(w.End).Format("15:04") + " " + w.Location.String()
+}
+
+// WaitForCleanupWindow blocks until the current time is within the cleanup
+// window configured by sql.stats.cleanup.window, so that the compaction only
+// removes rows during off-peak hours. It returns immediately if no window is
+// configured, and returns an error if the context is canceled while waiting.
+//
+// Once WaitForCleanupWindow was called, the runs of the compactor stop
+// between two batches of removed rows when the window closes, see
+// cleanupWindowClosed.
+func (c *StatsCompactor) WaitForCleanupWindow(ctx context.Context) error {
+	c.cleanupWindow.enforced = true
+	atomic.StoreInt32(&c.cleanupWindow.closed, 0)
+	var loggedWindow string
+	for {
+		window, err := ParseCleanupWindow(SQLStatsCleanupWindow.Get(&c.st.SV))
+		if err != nil {
+			// The setting is validated when it is set, so this is unexpected.
+			// We'd rather compact outside the window than never compact.
+			log.Warningf(ctx, "ignoring %s: %v", SQLStatsCleanupWindow.Key(), err)
+			return nil
+		}
+		if window == nil {
+			return nil
+		}
+		untilOpen := window.TimeUntilOpen(c.getTimeNow())
+		if untilOpen == 0 {
+			return nil
+		}
+		if windowStr := window.String(); windowStr != loggedWindow {
+			log.Infof(ctx, "deferring sql stats compaction by %s until the cleanup window (%s) opens",
+				untilOpen, windowStr)
+			loggedWindow = windowStr
+		}
+
+		wait := untilOpen
+		if wait > cleanupWindowRecheckInterval {
+			wait = cleanupWindowRecheckInterval
+		}
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// cleanupWindowClosed returns whether the current run must stop because the
+// cleanup window closed since WaitForCleanupWindow returned. It is checked
+// between the batches of rows removed by the run, so that the rows removed so
+// far remain removed and the next run resumes the removal. The run removes
+// no more rows once the window closed, even if it reopens, e.g. because the
+// setting changed.
+func (c *StatsCompactor) cleanupWindowClosed(ctx context.Context) bool {
+	if !c.cleanupWindow.enforced {
+		return false
+	}
+	if atomic.LoadInt32(&c.cleanupWindow.closed) != 0 {
+		return true
+	}
+	window, err := ParseCleanupWindow(SQLStatsCleanupWindow.Get(&c.st.SV))
+	if err != nil || window == nil || window.TimeUntilOpen(c.getTimeNow()) == 0 {
+		return false
+	}
+	if atomic.CompareAndSwapInt32(&c.cleanupWindow.closed, 0, 1) {
+		log.Infof(ctx, "the cleanup window (%s) closed, stopping the sql stats compaction", window)
+	}
+	return true
+}
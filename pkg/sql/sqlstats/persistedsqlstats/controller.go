@@ -12,12 +12,30 @@ package persistedsqlstats
 
 import (
 	"context"
+	"fmt"
+	"time"
 
+	"github.com/cockroachdb/cockroach/pkg/base"
+	"github.com/cockroachdb/cockroach/pkg/jobs"
+	"github.com/cockroachdb/cockroach/pkg/jobs/jobspb"
+	"github.com/cockroachdb/cockroach/pkg/keys"
+	"github.com/cockroachdb/cockroach/pkg/scheduledjobs"
 	"github.com/cockroachdb/cockroach/pkg/server/serverpb"
 	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
 	"github.com/cockroachdb/cockroach/pkg/sql/isql"
+	"github.com/cockroachdb/cockroach/pkg/sql/pgwire/pgcode"
+	"github.com/cockroachdb/cockroach/pkg/sql/pgwire/pgerror"
+	"github.com/cockroachdb/cockroach/pkg/sql/sem/eval"
+	"github.com/cockroachdb/cockroach/pkg/sql/sem/tree"
 	"github.com/cockroachdb/cockroach/pkg/sql/sessiondata"
+	"github.com/cockroachdb/cockroach/pkg/sql/sqlstats"
+	"github.com/cockroachdb/cockroach/pkg/sql/sqlstats/persistedsqlstats/sqlstatsutil"
 	"github.com/cockroachdb/cockroach/pkg/sql/sqlstats/sslocal"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/cockroachdb/cockroach/pkg/util/log/eventpb"
+	"github.com/cockroachdb/cockroach/pkg/util/metric"
+	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
+	"github.com/cockroachdb/errors"
 )
 
 // Controller implements the SQL Stats subsystem control plane. This exposes
@@ -26,8 +44,10 @@ import (
 // subsystem.
 type Controller struct {
 	*sslocal.Controller
-	db isql.DB
-	st *cluster.Settings
+	sqlStats *PersistedSQLStats
+	db       isql.DB
+	st       *cluster.Settings
+	knobs    *sqlstats.TestingKnobs
 }
 
 // NewController returns a new instance of sqlstats.Controller.
@@ -36,20 +56,378 @@ func NewController(
 ) *Controller {
 	return &Controller{
 		Controller: sslocal.NewController(sqlStats.SQLStats, status),
+		sqlStats:   sqlStats,
 		db:         db,
 		st:         sqlStats.cfg.Settings,
+		knobs:      sqlStats.cfg.Knobs,
 	}
 }
 
 // CreateSQLStatsCompactionSchedule implements the tree.SQLStatsController
 // interface.
 func (s *Controller) CreateSQLStatsCompactionSchedule(ctx context.Context) error {
-	return s.db.Txn(ctx, func(ctx context.Context, txn isql.Txn) error {
+	return runScheduleStoreTxn(ctx, s.db, func(ctx context.Context, txn isql.Txn) error {
 		_, err := CreateSQLStatsCompactionScheduleIfNotYetExist(ctx, txn, s.st)
 		return err
 	})
 }
 
+// PauseSQLStatsCompaction implements the eval.SQLStatsController interface.
+func (s *Controller) PauseSQLStatsCompaction(
+	ctx context.Context, pauseDuration time.Duration,
+) (resumeAt time.Time, err error) {
+	err = runScheduleStoreTxn(ctx, s.db, func(ctx context.Context, txn isql.Txn) error {
+		resumeAt, err = PauseSQLStatsCompactionSchedule(
+			ctx, txn, s.st, scheduledjobs.ProdJobSchedulerEnv, pauseDuration)
+		return err
+	})
+	return resumeAt, err
+}
+
+// DiffSQLStatsCompactionPolicy implements the eval.SQLStatsController
+// interface.
+func (s *Controller) DiffSQLStatsCompactionPolicy(
+	ctx context.Context,
+	proposedMaxRows int64,
+	proposedMaxAge time.Duration,
+	opts eval.SQLStatsReadOptions,
+) ([]eval.SQLStatsCompactionPolicyDiff, error) {
+	compactor := NewStatsCompactor(s.st, s.db, CompactorMetrics{}, s.knobs)
+	compactor.SetReadOptions(opts)
+	return compactor.DiffPolicies(ctx, proposedMaxRows, proposedMaxAge)
+}
+
+// CompactSQLStatsNow implements the eval.SQLStatsController interface. With
+// dryRun, it returns the number of rows that a compaction run would remove from
+// each stats table under the current retention policy, see
+// StatsCompactor.EstimateRowsToRemove. Otherwise, it runs the compaction on
+// this node and returns the number of rows removed.
+// The compaction is not subject to sql.stats.cleanup.window, and fails if a
+// compaction job is running, since both would remove the same rows, or if
+// sql.stats.maintenance.frozen is set.
+func (s *Controller) CompactSQLStatsNow(
+	ctx context.Context, dryRun bool,
+) ([]eval.SQLStatsCompactionResult, error) {
+	if dryRun {
+		compactor := NewStatsCompactor(s.st, s.db, CompactorMetrics{}, s.knobs)
+		return compactor.EstimateRowsToRemove(ctx)
+	}
+
+	if err := s.checkCanCompactNow(ctx); err != nil {
+		return nil, err
+	}
+	return s.compactNow(ctx)
+}
+
+// checkCanCompactNow returns an error if the compaction cannot run outside of
+// the compaction job, i.e. if another compaction is running or if
+// sql.stats.maintenance.frozen is set. It is only a preliminary check, which
+// allows the callers to fail before doing anything else: the compaction itself
+// is guarded by the compaction lock, see compactNow.
+func (s *Controller) checkCanCompactNow(ctx context.Context) error {
+	if SQLStatsMaintenanceFrozen.Get(&s.st.SV) {
+		return pgerror.Newf(pgcode.ObjectNotInPrerequisiteState,
+			"the SQL stats maintenance is frozen by %s", SQLStatsMaintenanceFrozen.Key())
+	}
+	instanceID, running, err := s.GetSQLStatsCompactionCoordinator(ctx)
+	if err != nil {
+		return err
+	}
+	if running {
+		return errCompactionAlreadyRunning(base.SQLInstanceID(instanceID))
+	}
+	return nil
+}
+
+// errCompactionAlreadyRunning is returned when a compaction requested through
+// the Controller cannot run because the given SQL instance holds the
+// compaction lock.
+func errCompactionAlreadyRunning(holder base.SQLInstanceID) error {
+	return pgerror.Newf(pgcode.ObjectNotInPrerequisiteState,
+		"a SQL stats compaction is already running on node %d", holder)
+}
+
+// compactNow runs the compaction on this node, see CompactSQLStatsNow. As the
+// compaction job, it holds the compaction lock while it runs, records the run
+// in system.sql_stats_compaction_runs and in the event log, and updates the
+// compaction metrics.
+func (s *Controller) compactNow(ctx context.Context) ([]eval.SQLStatsCompactionResult, error) {
+	if s.sqlStats.cfg.SQLLiveness == nil {
+		return nil, errors.AssertionFailedf("no sqlliveness session to hold the sql stats compaction lock")
+	}
+	session, err := s.sqlStats.cfg.SQLLiveness.Session(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		lock   CompactionLock
+		holder base.SQLInstanceID
+		ok     bool
+	)
+	if err := s.db.Txn(ctx, func(ctx context.Context, txn isql.Txn) (err error) {
+		lock, holder, ok, err = AcquireCompactionLock(ctx, txn, s.st, session.ID(), jobspb.InvalidJobID)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, errCompactionAlreadyRunning(holder)
+	}
+	defer ReleaseCompactionLock(ctx, s.db, lock)
+
+	metrics := s.sqlStats.cfg.CompactorMetrics
+	if metrics.RowsRemoved == nil {
+		metrics.RowsRemoved = metric.NewCounter(metric.Metadata{})
+	}
+	compactor := NewStatsCompactor(s.st, s.db, metrics, s.knobs)
+	compactor.SetStopper(s.sqlStats.stopper)
+	s.maybeLogCompactionEvent(ctx, &eventpb.SqlStatsCompactionStart{}, jobs.StatusRunning)
+	start := timeutil.Now()
+	results, err := compactor.DeleteOldestEntriesWithReport(ctx)
+	finishEvent := &eventpb.SqlStatsCompactionFinish{Duration: timeutil.Since(start).Nanoseconds()}
+	for _, result := range results {
+		finishEvent.RowsRemoved += result.Rows
+	}
+	finishStatus := jobs.StatusSucceeded
+	if err != nil {
+		finishEvent.Error = err.Error()
+		finishStatus = jobs.StatusFailed
+	}
+	s.maybeLogCompactionEvent(ctx, finishEvent, finishStatus)
+	if recordErr := RecordCompactionRun(
+		ctx, s.db, s.st, lock, jobspb.InvalidJobID, timeutil.Since(start), results, err,
+	); recordErr != nil {
+		log.Warningf(ctx, "failed to record the sql stats compaction run: %v", recordErr)
+	}
+	if err != nil {
+		return results, err
+	}
+	s.sqlStats.NotifyCompactionDone()
+	return results, nil
+}
+
+// maybeLogCompactionEvent records the given event of a run of compactNow in
+// the event log if sql.stats.cleanup.event_log.enabled is set, as the
+// compaction job does for its runs. The run has no job, so the event has no
+// job ID.
+func (s *Controller) maybeLogCompactionEvent(
+	ctx context.Context, event eventpb.EventWithCommonJobPayload, status jobs.Status,
+) {
+	if !SQLStatsCleanupEventLogEnabled.Get(&s.st.SV) || s.sqlStats.cfg.LogCompactionEvent == nil {
+		return
+	}
+	m := event.CommonJobDetails()
+	m.JobType = jobspb.TypeAutoSQLStatsCompaction.String()
+	m.Status = string(status)
+	m.Description = "crdb_internal.sql_stats_compact_now()"
+	s.sqlStats.cfg.LogCompactionEvent(ctx, event)
+}
+
+// PreviewSQLStatsCompaction implements the eval.SQLStatsController
+// interface, see StatsCompactor.PreviewSelections.
+func (s *Controller) PreviewSQLStatsCompaction(
+	ctx context.Context, opts eval.SQLStatsReadOptions,
+) ([]eval.SQLStatsCompactionSelection, error) {
+	compactor := NewStatsCompactor(s.st, s.db, CompactorMetrics{}, s.knobs)
+	compactor.SetReadOptions(opts)
+	return compactor.PreviewSelections(ctx)
+}
+
+// GetSQLStatsBindingPolicies implements the eval.SQLStatsController
+// interface, see StatsCompactor.BindingPolicies.
+func (s *Controller) GetSQLStatsBindingPolicies(
+	ctx context.Context, opts eval.SQLStatsReadOptions,
+) ([]eval.SQLStatsBindingPolicy, error) {
+	compactor := NewStatsCompactor(s.st, s.db, CompactorMetrics{}, s.knobs)
+	compactor.SetReadOptions(opts)
+	return compactor.BindingPolicies(ctx)
+}
+
+// GetSQLStatsRetentionHorizon implements the eval.SQLStatsController
+// interface, see StatsCompactor.RetentionHorizon.
+func (s *Controller) GetSQLStatsRetentionHorizon(
+	ctx context.Context,
+) (horizon time.Time, ok bool, err error) {
+	compactor := NewStatsCompactor(s.st, s.db, CompactorMetrics{}, s.knobs)
+	return compactor.RetentionHorizon(ctx)
+}
+
+// GetSQLStatsTopLiveFingerprints implements the eval.SQLStatsController
+// interface, see PersistedSQLStats.TopFingerprints.
+func (s *Controller) GetSQLStatsTopLiveFingerprints(
+	ctx context.Context, n int,
+) []eval.SQLStatsFingerprintSummary {
+	top := s.sqlStats.TopFingerprints(ctx, n)
+	summaries := make([]eval.SQLStatsFingerprintSummary, len(top))
+	for i, t := range top {
+		summaries[i] = eval.SQLStatsFingerprintSummary{
+			FingerprintID:            sqlstatsutil.EncodeUint64ToBytes(uint64(t.FingerprintID)),
+			TransactionFingerprintID: sqlstatsutil.EncodeUint64ToBytes(uint64(t.TransactionFingerprintID)),
+			AppName:                  t.AppName,
+			Query:                    t.Query,
+			Count:                    t.Count,
+			ServiceLatencyMean:       t.ServiceLatencyMean,
+			LastExecAt:               t.LastExecAt,
+		}
+	}
+	return summaries
+}
+
+// GetSQLStatsSchedules implements the eval.SQLStatsController interface, see
+// LoadSQLStatsSchedules.
+func (s *Controller) GetSQLStatsSchedules(ctx context.Context) ([]eval.SQLStatsSchedule, error) {
+	sjs, lastRuns, err := LoadSQLStatsSchedules(ctx, s.db, scheduledjobs.ProdJobSchedulerEnv)
+	if err != nil {
+		return nil, err
+	}
+	schedules := make([]eval.SQLStatsSchedule, len(sjs))
+	for i, sj := range sjs {
+		state := "ACTIVE"
+		if sj.IsPaused() {
+			state = "PAUSED"
+		}
+		schedules[i] = eval.SQLStatsSchedule{
+			ScheduleID: sj.ScheduleID(),
+			Name:       sj.ScheduleLabel(),
+			State:      state,
+			Status:     sj.ScheduleStatus(),
+			Recurrence: sj.ScheduleExpr(),
+			NextRun:    sj.NextRun(),
+			LastRun:    lastRuns[i],
+		}
+	}
+	return schedules, nil
+}
+
+// ValidateSQLStatsCompactionRecurrence implements the
+// eval.SQLStatsController interface, see ValidateScheduleRecurrence.
+func (s *Controller) ValidateSQLStatsCompactionRecurrence(
+	ctx context.Context, expr string, numRuns int,
+) eval.SQLStatsRecurrenceValidation {
+	return ValidateScheduleRecurrence(&s.st.SV, expr, timeutil.Now(), numRuns)
+}
+
+// GetSQLStatsStorageBytes implements the eval.SQLStatsController interface.
+// The storage of each stats table is estimated from the span stats of the
+// table, which are derived from the MVCC stats of its ranges rather than from
+// a scan of the table.
+func (s *Controller) GetSQLStatsStorageBytes(
+	ctx context.Context,
+) ([]eval.SQLStatsTableStorage, error) {
+	tables := []struct {
+		name string
+		id   int
+	}{
+		{name: "system.statement_statistics", id: keys.StatementStatisticsTableID},
+		{name: "system.transaction_statistics", id: keys.TransactionStatisticsTableID},
+	}
+	storage := make([]eval.SQLStatsTableStorage, 0, len(tables))
+	for _, table := range tables {
+		row, err := s.db.Executor().QueryRowEx(
+			ctx,
+			"sql-stats-storage-bytes",
+			nil, /* txn */
+			sessiondata.NodeUserSessionDataOverride,
+			`
+SELECT range_count, approximate_disk_bytes, live_bytes, total_bytes
+FROM crdb_internal.tenant_span_stats($1, $2)`,
+			keys.SystemDatabaseID,
+			table.id,
+		)
+		if err != nil {
+			return nil, errors.Wrapf(err, "estimating the storage of %s", table.name)
+		}
+		if row == nil {
+			return nil, errors.AssertionFailedf("no span stats for %s", table.name)
+		}
+		storage = append(storage, eval.SQLStatsTableStorage{
+			Table:                table.name,
+			RangeCount:           int64(tree.MustBeDInt(row[0])),
+			ApproximateDiskBytes: int64(tree.MustBeDInt(row[1])),
+			LiveBytes:            int64(tree.MustBeDInt(row[2])),
+			TotalBytes:           int64(tree.MustBeDInt(row[3])),
+		})
+	}
+	return storage, nil
+}
+
+// GetSQLStatsFingerprintCountsByType implements the eval.SQLStatsController
+// interface. The statement type of a fingerprint is the statement tag recorded
+// in its metadata when it was flushed (e.g. SELECT, INSERT, CREATE TABLE). The
+// rows flushed before the tag was recorded are counted under an empty type.
+func (s *Controller) GetSQLStatsFingerprintCountsByType(
+	ctx context.Context, opts eval.SQLStatsReadOptions,
+) (counts []eval.SQLStatsFingerprintTypeCount, retErr error) {
+	it, err := s.db.Executor().QueryIteratorEx(
+		ctx,
+		"sql-stats-fingerprints-by-type",
+		nil, /* txn */
+		sessiondata.NodeUserSessionDataOverride,
+		fmt.Sprintf(`
+SELECT COALESCE(metadata ->> 'stmtTag', '') AS statement_type,
+       count(DISTINCT fingerprint_id)
+FROM system.statement_statistics %s
+GROUP BY statement_type
+ORDER BY statement_type`, getReadAOSTClause(s.knobs, opts)),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		retErr = errors.CombineErrors(retErr, it.Close())
+	}()
+
+	var ok bool
+	for ok, err = it.Next(ctx); ok; ok, err = it.Next(ctx) {
+		row := it.Cur()
+		counts = append(counts, eval.SQLStatsFingerprintTypeCount{
+			StatementType:    string(tree.MustBeDString(row[0])),
+			FingerprintCount: int64(tree.MustBeDInt(row[1])),
+		})
+	}
+	return counts, err
+}
+
+// GetSQLStatsCompactionCoordinator implements the eval.SQLStatsController
+// interface.
+func (s *Controller) GetSQLStatsCompactionCoordinator(
+	ctx context.Context,
+) (instanceID int64, ok bool, err error) {
+	err = s.db.Txn(ctx, func(ctx context.Context, txn isql.Txn) error {
+		id, found, err := GetCompactionCoordinator(ctx, txn, s.st)
+		instanceID, ok = int64(id), found
+		return err
+	})
+	return instanceID, ok, err
+}
+
+// forceFlushTimeout bounds the duration of the flushes requested through
+// FlushSQLStats.
+const forceFlushTimeout = time.Minute
+
+// FlushSQLStats implements the eval.SQLStatsController interface. It flushes
+// the in-memory SQL stats of this node, giving up after forceFlushTimeout.
+// The timeout also applies when the call joins a flush already in progress;
+// the flush itself is not interrupted and keeps going in the background.
+func (s *Controller) FlushSQLStats(ctx context.Context) (eval.SQLStatsFlushReport, error) {
+	ctx, cancel := context.WithTimeout(ctx, forceFlushTimeout)
+	defer cancel()
+
+	report := s.sqlStats.FlushWithReport(ctx)
+	if err := ctx.Err(); err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			return eval.SQLStatsFlushReport{}, pgerror.Wrapf(err, pgcode.QueryCanceled,
+				"flush of SQL stats did not complete within %s", forceFlushTimeout)
+		}
+		return eval.SQLStatsFlushReport{}, err
+	}
+	return eval.SQLStatsFlushReport{
+		Written:   report.Written,
+		Discarded: report.Discarded,
+		Duration:  report.Duration,
+	}, nil
+}
+
 // ResetClusterSQLStats implements the tree.SQLStatsController interface. This
 // method resets both the cluster-wide in-memory stats (via RPC fanout) and
 // persisted stats (via TRUNCATE SQL statement)
@@ -15,16 +15,21 @@ package persistedsqlstats_test
 
 import (
 	"context"
+	"encoding/json"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/cockroachdb/cockroach/pkg/base"
 	"github.com/cockroachdb/cockroach/pkg/sql"
+	"github.com/cockroachdb/cockroach/pkg/sql/sqlstats"
 	"github.com/cockroachdb/cockroach/pkg/sql/sqlstats/persistedsqlstats"
 	"github.com/cockroachdb/cockroach/pkg/sql/tests"
 	"github.com/cockroachdb/cockroach/pkg/testutils/serverutils"
 	"github.com/cockroachdb/cockroach/pkg/testutils/sqlutils"
 	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
 	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
 	"github.com/stretchr/testify/require"
 )
 
@@ -162,3 +167,382 @@ WHERE app_name = $1
 			`expected %s to be found in txn stats, but it was not.`, query)
 	}
 }
+
+func TestSQLStatsMemUsage(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	ctx := context.Background()
+	params, _ := tests.CreateTestServerParams()
+	server, conn, _ := serverutils.StartServer(t, params)
+	defer server.Stopper().Stop(ctx)
+
+	sqlDB := sqlutils.MakeSQLRunner(conn)
+	sqlDB.Exec(t, "SELECT 1")
+
+	var usedBytes, limitBytes int64
+	sqlDB.QueryRow(t,
+		"SELECT used_bytes, limit_bytes FROM crdb_internal.sql_stats_mem_usage()",
+	).Scan(&usedBytes, &limitBytes)
+	require.Greater(t, usedBytes, int64(0))
+	require.GreaterOrEqual(t, limitBytes, usedBytes)
+}
+
+func TestSQLStatsStorageBytes(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	ctx := context.Background()
+	params, _ := tests.CreateTestServerParams()
+	server, conn, _ := serverutils.StartServer(t, params)
+	defer server.Stopper().Stop(ctx)
+
+	sqlDB := sqlutils.MakeSQLRunner(conn)
+	generateFingerprints(t, sqlDB, 10 /* distinctFingerprints */)
+	server.SQLServer().(*sql.Server).
+		GetSQLStatsProvider().(*persistedsqlstats.PersistedSQLStats).Flush(ctx)
+
+	rows := sqlDB.QueryStr(t, `
+SELECT table_name, range_count > 0, live_bytes > 0, total_bytes >= live_bytes
+FROM crdb_internal.sql_stats_storage_bytes()
+ORDER BY table_name`)
+	require.Equal(t, [][]string{
+		{"system.statement_statistics", "true", "true", "true"},
+		{"system.transaction_statistics", "true", "true", "true"},
+	}, rows)
+}
+
+func TestSQLStatsByType(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	ctx := context.Background()
+	params, _ := tests.CreateTestServerParams()
+	server, conn, _ := serverutils.StartServer(t, params)
+	defer server.Stopper().Stop(ctx)
+
+	sqlDB := sqlutils.MakeSQLRunner(conn)
+	sqlDB.Exec(t, "CREATE TABLE t (a INT, b INT)")
+	sqlDB.Exec(t, "INSERT INTO t (a) VALUES (1)")
+	sqlDB.Exec(t, "INSERT INTO t (a, b) VALUES (1, 2)")
+	sqlDB.Exec(t, "SELECT * FROM t")
+
+	server.SQLServer().(*sql.Server).
+		GetSQLStatsProvider().(*persistedsqlstats.PersistedSQLStats).Flush(ctx)
+
+	// Internal statements are recorded too, so only lower bounds can be
+	// checked.
+	for stmtType, minCount := range map[string]int{
+		"CREATE TABLE": 1,
+		"INSERT":       2,
+		"SELECT":       1,
+	} {
+		var count int
+		sqlDB.QueryRow(t,
+			"SELECT fingerprint_count FROM crdb_internal.sql_stats_by_type() WHERE statement_type = $1",
+			stmtType,
+		).Scan(&count)
+		require.GreaterOrEqual(t, count, minCount, "statement type %s", stmtType)
+	}
+}
+
+func TestSQLStatsFingerprintDetail(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	ctx := context.Background()
+	params, _ := tests.CreateTestServerParams()
+	server, conn, _ := serverutils.StartServer(t, params)
+	defer server.Stopper().Stop(ctx)
+
+	sqlDB := sqlutils.MakeSQLRunner(conn)
+	sqlDB.Exec(t, "SET CLUSTER SETTING sql.stats.flush.interval = '24h'")
+	sqlStats := server.SQLServer().(*sql.Server).
+		GetSQLStatsProvider().(*persistedsqlstats.PersistedSQLStats)
+
+	const appName = "fingerprint_detail_test"
+	execSelect := func(n int) {
+		sqlDB.Exec(t, "SET application_name = $1", appName)
+		for i := 0; i < n; i++ {
+			sqlDB.Exec(t, "SELECT 1")
+		}
+		sqlDB.Exec(t, "RESET application_name")
+	}
+	execSelect(3)
+
+	var fingerprintID []byte
+	sqlDB.QueryRow(t, `
+SELECT fingerprint_id FROM crdb_internal.sql_stats_top_live(1000)
+WHERE app_name = $1 AND query = 'SELECT _'`, appName).Scan(&fingerprintID)
+	detail := func() [][]string {
+		return sqlDB.QueryStr(t, `
+SELECT source, aggregated_ts IS NULL, execution_count
+FROM crdb_internal.sql_stats_fingerprint_detail($1, $2, '0s')`, fingerprintID, appName)
+	}
+
+	// The executions are only in memory until they are flushed.
+	require.Equal(t, [][]string{{"memory", "true", "3"}}, detail())
+
+	sqlStats.Flush(ctx)
+	execSelect(2)
+	require.Equal(t, [][]string{
+		{"memory", "true", "2"},
+		{"persisted", "false", "3"},
+	}, detail())
+	require.Equal(t, [][]string{{"0"}}, sqlDB.QueryStr(t, `
+SELECT count(*) FROM crdb_internal.sql_stats_fingerprint_detail($1, $2)
+WHERE last_flush_at IS NULL`, fingerprintID, appName))
+
+	sqlDB.ExpectErr(t, "fingerprint_id must be 8 bytes long",
+		"SELECT * FROM crdb_internal.sql_stats_fingerprint_detail('abc', $1)", appName)
+}
+
+func TestSQLStatsForApp(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	ctx := context.Background()
+	params, _ := tests.CreateTestServerParams()
+	server, conn, _ := serverutils.StartServer(t, params)
+	defer server.Stopper().Stop(ctx)
+
+	sqlDB := sqlutils.MakeSQLRunner(conn)
+	sqlDB.Exec(t, "SET CLUSTER SETTING sql.stats.flush.interval = '24h'")
+	sqlStats := server.SQLServer().(*sql.Server).
+		GetSQLStatsProvider().(*persistedsqlstats.PersistedSQLStats)
+
+	const appName = "stats_for_app_test"
+	sqlDB.Exec(t, "SET application_name = $1", appName)
+	for i := 0; i < 3; i++ {
+		sqlDB.Exec(t, "SELECT 1")
+	}
+	sqlDB.Exec(t, "SELECT 1, 1")
+	sqlDB.Exec(t, "RESET application_name")
+
+	var fingerprintID []byte
+	sqlDB.QueryRow(t, `
+SELECT fingerprint_id FROM crdb_internal.sql_stats_top_live(1000)
+WHERE app_name = $1 AND query = 'SELECT _'`, appName).Scan(&fingerprintID)
+	forApp := func() [][]string {
+		return sqlDB.QueryStr(t, `
+SELECT execution_count, windows, first_aggregated_ts = last_aggregated_ts
+FROM crdb_internal.sql_stats_for_app($1, '0s')
+WHERE fingerprint_id = $2`, appName, fingerprintID)
+	}
+
+	// The executions are not returned until they are flushed.
+	require.Empty(t, forApp())
+
+	sqlStats.Flush(ctx)
+	require.Equal(t, [][]string{{"3", "1", "true"}}, forApp())
+
+	// The most executed fingerprint comes first, and the fingerprints of the
+	// other applications are not returned.
+	require.Equal(t, [][]string{{"true"}}, sqlDB.QueryStr(t, `
+SELECT fingerprint_id = $2
+FROM crdb_internal.sql_stats_for_app($1, '0s')
+LIMIT 1`, appName, fingerprintID))
+	require.Empty(t, sqlDB.QueryStr(t,
+		"SELECT * FROM crdb_internal.sql_stats_for_app('no_such_app', '0s')"))
+
+	// The windows starting before since are not read.
+	require.Equal(t, [][]string{{"3", "1", "true"}}, sqlDB.QueryStr(t, `
+SELECT execution_count, windows, first_aggregated_ts = last_aggregated_ts
+FROM crdb_internal.sql_stats_for_app($1, now() - '2h'::INTERVAL, '0s')
+WHERE fingerprint_id = $2`, appName, fingerprintID))
+	require.Empty(t, sqlDB.QueryStr(t, `
+SELECT * FROM crdb_internal.sql_stats_for_app($1, now() + '2h'::INTERVAL, '0s')`,
+		appName))
+
+	sqlDB.ExpectErr(t, "internal application",
+		"SELECT * FROM crdb_internal.sql_stats_for_app('$ internal-test')")
+}
+
+func TestSQLStatsReadMaxStaleness(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	ctx := context.Background()
+	params, _ := tests.CreateTestServerParams()
+	server, conn, _ := serverutils.StartServer(t, params)
+	defer server.Stopper().Stop(ctx)
+
+	sqlDB := sqlutils.MakeSQLRunner(conn)
+	sqlDB.Exec(t, "CREATE TABLE t (a INT)")
+	server.SQLServer().(*sql.Server).
+		GetSQLStatsProvider().(*persistedsqlstats.PersistedSQLStats).Flush(ctx)
+
+	// A max_staleness of zero reads the current data, so the flushed stats
+	// are visible right away.
+	var count int
+	sqlDB.QueryRow(t, `
+SELECT fingerprint_count FROM crdb_internal.sql_stats_by_type('0s')
+WHERE statement_type = 'CREATE TABLE'`).Scan(&count)
+	require.GreaterOrEqual(t, count, 1)
+
+	tables := [][]string{{"system.statement_statistics"}, {"system.transaction_statistics"}}
+	for _, maxStaleness := range []string{"0s", "1ms"} {
+		require.Equal(t, tables, sqlDB.QueryStr(t,
+			"SELECT table_name FROM crdb_internal.sql_stats_compaction_diff(0, '0s', $1::INTERVAL) ORDER BY 1",
+			maxStaleness), "max_staleness %s", maxStaleness)
+		require.Equal(t, tables, sqlDB.QueryStr(t,
+			"SELECT table_name FROM crdb_internal.sql_stats_binding_policy($1::INTERVAL) ORDER BY 1",
+			maxStaleness), "max_staleness %s", maxStaleness)
+		sqlDB.Exec(t,
+			"SELECT * FROM crdb_internal.sql_stats_compaction_preview($1::INTERVAL)", maxStaleness)
+	}
+
+	sqlDB.ExpectErr(t, "max_staleness must be non-negative",
+		"SELECT * FROM crdb_internal.sql_stats_by_type('-1s')")
+}
+
+func TestSQLStatsFlushBuiltin(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	ctx := context.Background()
+	params, _ := tests.CreateTestServerParams()
+	server, conn, _ := serverutils.StartServer(t, params)
+	defer server.Stopper().Stop(ctx)
+
+	sqlDB := sqlutils.MakeSQLRunner(conn)
+	sqlDB.Exec(t, "SET CLUSTER SETTING sql.stats.flush.interval = '24h'")
+	sqlDB.Exec(t, "SELECT crdb_internal.reset_sql_stats()")
+	sqlDB.Exec(t, "SELECT 1")
+
+	var written, discarded int64
+	var duration string
+	sqlDB.QueryRow(t,
+		"SELECT written, discarded, duration FROM crdb_internal.flush_sql_stats()",
+	).Scan(&written, &discarded, &duration)
+	require.Greater(t, written, int64(0))
+	require.NotEmpty(t, duration)
+
+	var count int
+	sqlDB.QueryRow(t,
+		"SELECT count(*) FROM system.statement_statistics WHERE metadata ->> 'query' = 'SELECT _'",
+	).Scan(&count)
+	require.Equal(t, 1, count)
+
+	// Nothing is written when the flush is disabled.
+	sqlDB.Exec(t, "SET CLUSTER SETTING sql.stats.flush.enabled = false")
+	sqlDB.Exec(t, "SELECT 1")
+	sqlDB.QueryRow(t,
+		"SELECT written FROM crdb_internal.flush_sql_stats()",
+	).Scan(&written)
+	require.Zero(t, written)
+}
+
+func TestSQLStatsDebugBundle(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	ctx := context.Background()
+	server, conn, _ := serverutils.StartServer(t, base.TestServerArgs{
+		Knobs: base.TestingKnobs{
+			SQLStatsKnobs: &sqlstats.TestingKnobs{
+				AOSTClause: "AS OF SYSTEM TIME '-1us'",
+			},
+		},
+	})
+	defer server.Stopper().Stop(ctx)
+
+	sqlDB := sqlutils.MakeSQLRunner(conn)
+	sqlDB.Exec(t, "SET CLUSTER SETTING sql.stats.flush.interval = '24h'")
+	sqlDB.Exec(t, "SET CLUSTER SETTING sql.stats.cleanup.sanity_fraction = 0.25")
+	sqlDB.Exec(t, "SELECT 1")
+	sqlServer := server.SQLServer().(*sql.Server)
+	sqlServer.GetSQLStatsProvider().(*persistedsqlstats.PersistedSQLStats).Flush(ctx)
+	sqlDB.Exec(t, "SELECT 1, 2")
+
+	b, err := sqlServer.GetSQLStatsController().DebugBundle(ctx)
+	require.NoError(t, err)
+	var bundle struct {
+		Health struct {
+			ScheduleStatus string `json:"schedule_status"`
+		} `json:"health"`
+		Config struct {
+			Settings map[string]string `json:"settings"`
+		} `json:"config"`
+		Schedules    []map[string]interface{} `json:"schedules"`
+		FlushMetrics struct {
+			Flushes  int64 `json:"flushes"`
+			Sequence int64 `json:"sequence"`
+		} `json:"flush_metrics"`
+		Counts struct {
+			InMemoryFingerprints int64 `json:"in_memory_fingerprints"`
+			StmtRows             int64 `json:"stmt_rows"`
+			TxnRows              int64 `json:"txn_rows"`
+		} `json:"counts"`
+		Errors []string `json:"errors"`
+	}
+	require.NoError(t, json.Unmarshal(b, &bundle))
+	require.Empty(t, bundle.Errors)
+	require.Equal(t, "ACTIVE", bundle.Health.ScheduleStatus)
+	require.Equal(t, "0.25", bundle.Config.Settings["sql.stats.cleanup.sanity_fraction"])
+	require.NotEmpty(t, bundle.Schedules)
+	require.Positive(t, bundle.FlushMetrics.Flushes)
+	require.Positive(t, bundle.FlushMetrics.Sequence)
+	require.Positive(t, bundle.Counts.InMemoryFingerprints)
+	require.Positive(t, bundle.Counts.StmtRows)
+	require.Positive(t, bundle.Counts.TxnRows)
+}
+
+func TestSQLStatsSetPersistedRowsMax(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	ctx := context.Background()
+	var stubTime atomic.Value
+	stubTime.Store(timeutil.Now().Add(-2 * time.Hour))
+	server, conn, _ := serverutils.StartServer(t, base.TestServerArgs{
+		Knobs: base.TestingKnobs{
+			SQLStatsKnobs: &sqlstats.TestingKnobs{
+				AOSTClause: "AS OF SYSTEM TIME '-1us'",
+				StubTimeNow: func() time.Time {
+					return stubTime.Load().(time.Time)
+				},
+			},
+		},
+	})
+	defer server.Stopper().Stop(ctx)
+
+	sqlDB := sqlutils.MakeSQLRunner(conn)
+	sqlDB.Exec(t, "SET CLUSTER SETTING sql.stats.flush.interval = '24h'")
+	sqlDB.Exec(t, "SET CLUSTER SETTING sql.stats.cleanup.recurrence = '@yearly'")
+	sqlDB.Exec(t, "SELECT crdb_internal.reset_sql_stats()")
+	generateFingerprints(t, sqlDB, 20 /* distinctFingerprints */)
+	server.SQLServer().(*sql.Server).
+		GetSQLStatsProvider().(*persistedsqlstats.PersistedSQLStats).Flush(ctx)
+	stubTime.Store(timeutil.Now())
+
+	controller := server.SQLServer().(*sql.Server).GetSQLStatsController()
+	_, err := controller.SetPersistedRowsMax(ctx, -1 /* newMax */, false /* compactNow */)
+	require.ErrorContains(t, err, "must be non-negative")
+	_, err = controller.SetPersistedRowsMax(ctx, 0 /* newMax */, false /* compactNow */)
+	require.ErrorContains(t, err, "cannot disable sql.stats.persisted_rows.max")
+
+	// Without compactNow, only the setting is changed.
+	stmtStatsCnt, txnStatsCnt := getPersistedStatsEntry(t, sqlDB)
+	results, err := controller.SetPersistedRowsMax(ctx, 100 /* newMax */, false /* compactNow */)
+	require.NoError(t, err)
+	require.Empty(t, results)
+	sqlDB.CheckQueryResultsRetry(t, "SHOW CLUSTER SETTING sql.stats.persisted_rows.max",
+		[][]string{{"100"}})
+	stmtStatsCntAfter, txnStatsCntAfter := getPersistedStatsEntry(t, sqlDB)
+	require.Equal(t, stmtStatsCnt, stmtStatsCntAfter)
+	require.Equal(t, txnStatsCnt, txnStatsCntAfter)
+
+	// With compactNow, the new row cap is enforced right away.
+	results, err = controller.SetPersistedRowsMax(ctx, 8 /* newMax */, true /* compactNow */)
+	require.NoError(t, err)
+	require.Len(t, results, 2)
+	var rowsRemoved int64
+	for _, result := range results {
+		rowsRemoved += result.Rows
+	}
+	stmtStatsCntAfter, txnStatsCntAfter = getPersistedStatsEntry(t, sqlDB)
+	require.LessOrEqual(t, stmtStatsCntAfter, 8)
+	require.LessOrEqual(t, txnStatsCntAfter, 8)
+	require.Equal(t, int64(stmtStatsCnt+txnStatsCnt-stmtStatsCntAfter-txnStatsCntAfter), rowsRemoved)
+}
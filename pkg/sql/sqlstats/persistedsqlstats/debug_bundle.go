@@ -0,0 +1,234 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package persistedsqlstats
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/clusterversion"
+	"github.com/cockroachdb/cockroach/pkg/sql/sem/eval"
+	"github.com/cockroachdb/cockroach/pkg/sql/sem/tree"
+	"github.com/cockroachdb/cockroach/pkg/sql/sessiondata"
+	"github.com/cockroachdb/cockroach/pkg/util/metric"
+	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
+)
+
+// debugBundleCompactionRuns is the number of most recent compaction runs
+// included in the debug bundle.
+const debugBundleCompactionRuns = 10
+
+// debugBundle is the snapshot of the state of the SQL Stats subsystem
+// serialized by Controller.DebugBundle.
+type debugBundle struct {
+	CollectedAt time.Time    `json:"collected_at"`
+	Health      HealthStatus `json:"health"`
+	// Config holds the recurrence of the compaction schedule and the
+	// settings of the compaction that are not set to their default.
+	Config         ScheduleConfig             `json:"config"`
+	Schedules      []debugBundleSchedule      `json:"schedules"`
+	CompactionRuns []debugBundleCompactionRun `json:"compaction_runs"`
+	FlushMetrics   debugBundleFlushMetrics    `json:"flush_metrics"`
+	Counts         debugBundleCounts          `json:"counts"`
+	// Errors lists the parts of the bundle that could not be read.
+	Errors []string `json:"errors,omitempty"`
+}
+
+type debugBundleSchedule struct {
+	ScheduleID int64     `json:"schedule_id"`
+	Name       string    `json:"name"`
+	State      string    `json:"state"`
+	Status     string    `json:"status,omitempty"`
+	Recurrence string    `json:"recurrence"`
+	NextRun    time.Time `json:"next_run"`
+	LastRun    time.Time `json:"last_run"`
+}
+
+type debugBundleCompactionRun struct {
+	CompletedAt     time.Time `json:"completed_at"`
+	JobID           int64     `json:"job_id,omitempty"`
+	Duration        string    `json:"duration"`
+	StmtRowsRemoved int64     `json:"stmt_rows_removed"`
+	TxnRowsRemoved  int64     `json:"txn_rows_removed"`
+	Outcome         string    `json:"outcome"`
+	Error           string    `json:"error,omitempty"`
+}
+
+// debugBundleFlushMetrics are the values of the flush metrics of this node
+// since it started.
+type debugBundleFlushMetrics struct {
+	Flushes            int64                        `json:"flushes"`
+	Failures           int64                        `json:"failures"`
+	FailuresByCategory map[FlushErrorCategory]int64 `json:"failures_by_category,omitempty"`
+	DurationMeanNanos  float64                      `json:"duration_mean_nanos"`
+	SampledOut         int64                        `json:"sampled_out"`
+	DisabledSkips      int64                        `json:"disabled_skips"`
+	Overruns           int64                        `json:"overruns"`
+	TxnRetries         int64                        `json:"txn_retries"`
+	Sequence           int64                        `json:"sequence"`
+}
+
+// debugBundleCounts are the numbers of fingerprints in memory on this node and
+// of rows in the stats tables.
+type debugBundleCounts struct {
+	InMemoryFingerprints int64 `json:"in_memory_fingerprints"`
+	StmtRows             int64 `json:"stmt_rows"`
+	TxnRows              int64 `json:"txn_rows"`
+}
+
+// DebugBundle returns a JSON snapshot of the state of the SQL Stats
+// subsystem, for support investigations: the health of the subsystem as
+// returned by HealthSnapshot, the configuration of the compaction, the
+// schedules, the most recent compaction runs, the flush metrics of this node,
+// and the numbers of fingerprints in memory and of rows in the stats tables.
+// Like HealthSnapshot, it is best effort: the parts that cannot be read are
+// listed in the errors field of the snapshot rather than failing it. The stats
+// tables are read with follower reads.
+func (s *Controller) DebugBundle(ctx context.Context) ([]byte, error) {
+	bundle := debugBundle{
+		CollectedAt: timeutil.Now(),
+		Health:      s.HealthSnapshot(ctx),
+	}
+	addError := func(part string, err error) {
+		bundle.Errors = append(bundle.Errors, part+": "+err.Error())
+	}
+
+	var err error
+	if bundle.Config, err = ExportScheduleConfig(ctx, s.db, s.st); err != nil {
+		addError("config", err)
+	}
+	if bundle.Schedules, err = s.debugBundleSchedules(ctx); err != nil {
+		addError("schedules", err)
+	}
+	if bundle.CompactionRuns, err = s.debugBundleCompactionRuns(ctx); err != nil {
+		addError("compaction runs", err)
+	}
+	bundle.FlushMetrics = s.debugBundleFlushMetrics()
+	bundle.Counts.InMemoryFingerprints = s.sqlStats.SQLStats.GetTotalFingerprintCount()
+	for _, table := range []struct {
+		name  string
+		count *int64
+	}{
+		{name: "system.statement_statistics", count: &bundle.Counts.StmtRows},
+		{name: "system.transaction_statistics", count: &bundle.Counts.TxnRows},
+	} {
+		row, err := s.db.Executor().QueryRowEx(ctx,
+			"sql-stats-debug-bundle-count",
+			nil, /* txn */
+			sessiondata.NodeUserSessionDataOverride,
+			fmt.Sprintf("SELECT count(*) FROM %s %s",
+				table.name, getReadAOSTClause(s.knobs, eval.SQLStatsReadOptions{})),
+		)
+		if err != nil {
+			addError(table.name, err)
+			continue
+		}
+		*table.count = int64(tree.MustBeDInt(row[0]))
+	}
+
+	return json.Marshal(bundle)
+}
+
+func (s *Controller) debugBundleSchedules(ctx context.Context) ([]debugBundleSchedule, error) {
+	schedules, err := s.GetSQLStatsSchedules(ctx)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]debugBundleSchedule, len(schedules))
+	for i, sched := range schedules {
+		res[i] = debugBundleSchedule{
+			ScheduleID: sched.ScheduleID,
+			Name:       sched.Name,
+			State:      sched.State,
+			Status:     sched.Status,
+			Recurrence: sched.Recurrence,
+			NextRun:    sched.NextRun,
+			LastRun:    sched.LastRun,
+		}
+	}
+	return res, nil
+}
+
+// debugBundleCompactionRuns returns the debugBundleCompactionRuns most recent
+// completed compaction runs recorded in system.sql_stats_compaction_runs, most recent
+// first, see RecordCompactionRun.
+func (s *Controller) debugBundleCompactionRuns(
+	ctx context.Context,
+) ([]debugBundleCompactionRun, error) {
+	if !s.st.Version.IsActive(ctx, clusterversion.V23_2_AddSQLStatsCompactionRunsTable) {
+		return nil, nil
+	}
+	rows, err := s.db.Executor().QueryBufferedEx(ctx,
+		"sql-stats-debug-bundle-compaction-runs",
+		nil, /* txn */
+		sessiondata.NodeUserSessionDataOverride,
+		`SELECT completed_at, job_id, duration, stmt_rows_removed, txn_rows_removed, outcome, error
+FROM system.sql_stats_compaction_runs
+WHERE completed_at IS NOT NULL
+ORDER BY completed_at DESC
+LIMIT $1`,
+		debugBundleCompactionRuns,
+	)
+	if err != nil {
+		return nil, err
+	}
+	runs := make([]debugBundleCompactionRun, len(rows))
+	for i, row := range rows {
+		runs[i] = debugBundleCompactionRun{
+			CompletedAt:     tree.MustBeDTimestampTZ(row[0]).Time,
+			Duration:        tree.MustBeDInterval(row[2]).String(),
+			StmtRowsRemoved: int64(tree.MustBeDInt(row[3])),
+			TxnRowsRemoved:  int64(tree.MustBeDInt(row[4])),
+			Outcome:         string(tree.MustBeDString(row[5])),
+		}
+		if row[1] != tree.DNull {
+			runs[i].JobID = int64(tree.MustBeDInt(row[1]))
+		}
+		if row[6] != tree.DNull {
+			runs[i].Error = string(tree.MustBeDString(row[6]))
+		}
+	}
+	return runs, nil
+}
+
+func (s *Controller) debugBundleFlushMetrics() debugBundleFlushMetrics {
+	cfg := s.sqlStats.cfg
+	// count returns the count of the given counter, which may be nil.
+	count := func(c *metric.Counter) int64 {
+		if c == nil {
+			return 0
+		}
+		return c.Count()
+	}
+	m := debugBundleFlushMetrics{
+		Flushes:       count(cfg.FlushCounter),
+		Failures:      count(cfg.FailureCounter),
+		SampledOut:    count(cfg.SampledOutCounter),
+		DisabledSkips: count(cfg.DisabledSkipCounter),
+		Overruns:      count(cfg.OverrunCounter),
+		TxnRetries:    count(cfg.FlushTxnRetries),
+	}
+	if cfg.FlushDuration != nil {
+		m.DurationMeanNanos = cfg.FlushDuration.Mean()
+	}
+	if cfg.FlushSequence != nil {
+		m.Sequence = cfg.FlushSequence.Value()
+	}
+	for category, c := range cfg.FailureCountersByCategory {
+		if m.FailuresByCategory == nil {
+			m.FailuresByCategory = make(map[FlushErrorCategory]int64)
+		}
+		m.FailuresByCategory[category] = count(c)
+	}
+	return m
+}
@@ -0,0 +1,251 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package persistedsqlstats
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/kv/kvpb"
+	"github.com/cockroachdb/cockroach/pkg/sql/isql"
+	"github.com/cockroachdb/cockroach/pkg/sql/pgwire/pgcode"
+	"github.com/cockroachdb/cockroach/pkg/sql/pgwire/pgerror"
+	"github.com/cockroachdb/cockroach/pkg/sql/sem/tree"
+	"github.com/cockroachdb/cockroach/pkg/sql/sessiondata"
+	"github.com/cockroachdb/cockroach/pkg/sql/sqlstats/persistedsqlstats/sqlstatsutil"
+	"github.com/cockroachdb/cockroach/pkg/util/hlc"
+	"github.com/cockroachdb/cockroach/pkg/util/json"
+	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
+	"github.com/cockroachdb/errors"
+)
+
+// ExportOptions configures ExportJSON.
+type ExportOptions struct {
+	// AsOf is the timestamp as of which the persisted stats are read. If zero,
+	// the current persisted stats are read. A non-zero AsOf must not be in the
+	// future, and must be more recent than the GC threshold of the stats
+	// tables.
+	AsOf time.Time
+	// Since restricts the export to the rows whose aggregated_ts is not
+	// before Since, so that the stats can be exported incrementally. If zero,
+	// all the rows are exported.
+	Since time.Time
+}
+
+const exportStmtStatsQuery = `
+SELECT json_build_object(
+  'aggregated_ts', aggregated_ts,
+  'fingerprint_id', encode(fingerprint_id, 'hex'),
+  'transaction_fingerprint_id', encode(transaction_fingerprint_id, 'hex'),
+  'plan_hash', encode(plan_hash, 'hex'),
+  'app_name', app_name,
+  'node_id', node_id,
+  'agg_interval', agg_interval,
+  'metadata', metadata,
+  'statistics', statistics,
+  'plan', plan,
+  'index_recommendations', index_recommendations
+)
+FROM system.statement_statistics
+WHERE aggregated_ts >= $1
+ORDER BY aggregated_ts, fingerprint_id, transaction_fingerprint_id, plan_hash, app_name, node_id`
+
+const exportTxnStatsQuery = `
+SELECT json_build_object(
+  'aggregated_ts', aggregated_ts,
+  'fingerprint_id', encode(fingerprint_id, 'hex'),
+  'app_name', app_name,
+  'node_id', node_id,
+  'agg_interval', agg_interval,
+  'metadata', metadata,
+  'statistics', statistics
+)
+FROM system.transaction_statistics
+WHERE aggregated_ts >= $1
+ORDER BY aggregated_ts, fingerprint_id, app_name, node_id`
+
+// ExportJSON writes the persisted statement and transaction statistics to w
+// as a single JSON object, with one array of rows per stats table:
+//
+//	{"statements": [...], "transactions": [...]}
+//
+// Both tables are read in a single transaction, so that the export reflects a
+// consistent point in time even if the stats are flushed concurrently. The
+// in-memory stats that are yet to be flushed are not exported. The rows are
+// written to w as they are read, rather than buffered, so a failed export
+// may leave a partial object in w.
+//
+// The rows are filtered on aggregated_ts, which is the leading column of the
+// primary key of both tables after the hash shard column, so that an
+// incremental export with opts.Since only scans the recent rows.
+//
+// The exported rows are protected with ProtectStats while they are read, so
+// that a concurrent compaction does not remove them and the GC of the stats
+// tables does not fail a historical export. The protection is released once
+// the rows are read.
+func (s *PersistedSQLStats) ExportJSON(
+	ctx context.Context, w io.Writer, opts ExportOptions,
+) error {
+	if !opts.AsOf.IsZero() && opts.AsOf.After(timeutil.Now()) {
+		return pgerror.Newf(pgcode.InvalidParameterValue,
+			"cannot export SQL stats as of %s, which is in the future", opts.AsOf)
+	}
+
+	release, err := s.ProtectStats(ctx, opts.AsOf, opts.Since)
+	if err != nil {
+		return err
+	}
+	defer release(ctx)
+	if s.cfg.Knobs != nil && s.cfg.Knobs.OnExportProtected != nil {
+		s.cfg.Knobs.OnExportProtected()
+	}
+
+	// The rows are streamed to w as they are read. What was written to w
+	// cannot be taken back, so the rows are read at a fixed timestamp, which
+	// spares the read-only transaction the retries caused by concurrent
+	// writes. If the transaction is retried nonetheless after some rows were
+	// written, the export fails.
+	asOf := hlc.Timestamp{WallTime: opts.AsOf.UnixNano()}
+	if opts.AsOf.IsZero() {
+		asOf = s.cfg.DB.KV().Clock().Now()
+	}
+	ew := &exportWriter{w: w}
+	err = s.cfg.DB.Txn(ctx, func(ctx context.Context, txn isql.Txn) error {
+		if ew.written > 0 {
+			return errors.New("the export of SQL stats was interrupted by a transaction retry")
+		}
+		if err := txn.KV().SetFixedTimestamp(ctx, asOf); err != nil {
+			return err
+		}
+
+		ew.writeString(`{"statements": `)
+		if err := exportRowsJSON(ctx, txn, ew, "export-stmt-stats", exportStmtStatsQuery, opts.Since,
+			decompressExportedStmtRow); err != nil {
+			return err
+		}
+		ew.writeString(`, "transactions": `)
+		if err := exportRowsJSON(ctx, txn, ew, "export-txn-stats", exportTxnStatsQuery, opts.Since,
+			nil /* transform */); err != nil {
+			return err
+		}
+		ew.writeString("}")
+		return ew.err
+	})
+	if errors.HasType(err, (*kvpb.BatchTimestampBeforeGCError)(nil)) {
+		return pgerror.Wrapf(err, pgcode.InvalidParameterValue,
+			"cannot export SQL stats as of %s, which is older than the GC threshold", opts.AsOf)
+	}
+	return err
+}
+
+// exportWriter writes the export to the underlying writer, counting the
+// written bytes. The first error of the underlying writer is recorded, and
+// stops the writes.
+type exportWriter struct {
+	w       io.Writer
+	written int64
+	err     error
+}
+
+func (ew *exportWriter) write(p []byte) {
+	if ew.err != nil {
+		return
+	}
+	n, err := ew.w.Write(p)
+	ew.written += int64(n)
+	ew.err = err
+}
+
+func (ew *exportWriter) writeString(s string) {
+	ew.write([]byte(s))
+}
+
+// exportRowsJSON writes the JSON values returned by the given query to ew as
+// a JSON array, one row at a time. The query only returns the rows
+// aggregated at or after since. If transform is not nil, it is applied to
+// each value before it is written.
+func exportRowsJSON(
+	ctx context.Context,
+	txn isql.Txn,
+	ew *exportWriter,
+	opName string,
+	query string,
+	since time.Time,
+	transform func(json.JSON) (json.JSON, error),
+) (retErr error) {
+	it, err := txn.QueryIteratorEx(ctx, opName, txn.KV(),
+		sessiondata.NodeUserSessionDataOverride, query, since)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		retErr = errors.CombineErrors(retErr, it.Close())
+	}()
+
+	ew.writeString("[")
+	var buf bytes.Buffer
+	var ok bool
+	first := true
+	for ok, err = it.Next(ctx); ok; ok, err = it.Next(ctx) {
+		buf.Reset()
+		if !first {
+			buf.WriteString(", ")
+		}
+		first = false
+		row := tree.MustBeDJSON(it.Cur()[0]).JSON
+		if transform != nil {
+			if row, err = transform(row); err != nil {
+				return err
+			}
+		}
+		row.Format(&buf)
+		ew.write(buf.Bytes())
+		if ew.err != nil {
+			return ew.err
+		}
+	}
+	if err != nil {
+		return err
+	}
+	ew.writeString("]")
+	return ew.err
+}
+
+// decompressExportedStmtRow decompresses the metadata and the plan of an
+// exported row of system.statement_statistics that were compressed by the
+// flush, see SQLStatsFlushCompressText, so that the export does not depend on
+// the setting.
+func decompressExportedStmtRow(row json.JSON) (json.JSON, error) {
+	it, err := row.ObjectIter()
+	if err != nil {
+		return nil, err
+	}
+	if it == nil {
+		return nil, errors.AssertionFailedf("expected a JSON object, found %s", row.Type())
+	}
+	builder := json.NewObjectBuilder(row.Len())
+	for it.Next() {
+		value := it.Value()
+		switch it.Key() {
+		case "metadata":
+			value, err = sqlstatsutil.DecompressStmtMetadataJSON(value)
+		case "plan":
+			value, err = sqlstatsutil.DecompressPlanJSON(value)
+		}
+		if err != nil {
+			return nil, err
+		}
+		builder.Add(it.Key(), value)
+	}
+	return builder.Build(), nil
+}
@@ -0,0 +1,324 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package persistedsqlstats_test
+
+import (
+	"bytes"
+	"context"
+	gojson "encoding/json"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/base"
+	"github.com/cockroachdb/cockroach/pkg/sql"
+	"github.com/cockroachdb/cockroach/pkg/sql/appstatspb"
+	"github.com/cockroachdb/cockroach/pkg/sql/catalog/systemschema"
+	"github.com/cockroachdb/cockroach/pkg/sql/isql"
+	"github.com/cockroachdb/cockroach/pkg/sql/sqlstats"
+	"github.com/cockroachdb/cockroach/pkg/sql/sqlstats/persistedsqlstats"
+	"github.com/cockroachdb/cockroach/pkg/testutils"
+	"github.com/cockroachdb/cockroach/pkg/testutils/serverutils"
+	"github.com/cockroachdb/cockroach/pkg/testutils/sqlutils"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/cockroachdb/cockroach/pkg/util/metric"
+	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
+	"github.com/cockroachdb/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSQLStatsExportJSON(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	ctx := context.Background()
+	server, conn, _ := serverutils.StartServer(t, base.TestServerArgs{})
+	defer server.Stopper().Stop(ctx)
+
+	sqlConn := sqlutils.MakeSQLRunner(conn)
+	sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.flush.interval = '24h'")
+	sqlConn.Exec(t, "SELECT crdb_internal.reset_sql_stats()")
+
+	sqlStats := server.SQLServer().(*sql.Server).
+		GetSQLStatsProvider().(*persistedsqlstats.PersistedSQLStats)
+
+	type export struct {
+		Statements   []map[string]interface{} `json:"statements"`
+		Transactions []map[string]interface{} `json:"transactions"`
+	}
+	exportJSON := func(opts persistedsqlstats.ExportOptions) export {
+		var buf bytes.Buffer
+		require.NoError(t, sqlStats.ExportJSON(ctx, &buf, opts))
+		var res export
+		require.NoError(t, gojson.Unmarshal(buf.Bytes(), &res), buf.String())
+		return res
+	}
+
+	generateFingerprints(t, sqlConn, 5 /* distinctFingerprints */)
+	sqlStats.Flush(ctx)
+	asOf := timeutil.Now()
+	firstExport := exportJSON(persistedsqlstats.ExportOptions{})
+	require.NotEmpty(t, firstExport.Statements)
+	require.NotEmpty(t, firstExport.Transactions)
+	require.Contains(t, firstExport.Statements[0], "fingerprint_id")
+	require.Contains(t, firstExport.Statements[0], "statistics")
+
+	// Stats flushed after asOf are not part of the export as of asOf.
+	generateFingerprints(t, sqlConn, 10 /* distinctFingerprints */)
+	sqlStats.Flush(ctx)
+	require.Greater(t, len(exportJSON(persistedsqlstats.ExportOptions{}).Statements),
+		len(firstExport.Statements))
+	require.Equal(t, firstExport, exportJSON(persistedsqlstats.ExportOptions{AsOf: asOf}))
+
+	t.Run("since", func(t *testing.T) {
+		// The rows flushed above are aggregated in hourly windows, so they are
+		// all aggregated within the last two hours.
+		since := timeutil.Now().Add(-2 * time.Hour)
+		require.Equal(t, exportJSON(persistedsqlstats.ExportOptions{}),
+			exportJSON(persistedsqlstats.ExportOptions{Since: since}))
+
+		incremental := exportJSON(persistedsqlstats.ExportOptions{Since: timeutil.Now().Add(time.Hour)})
+		require.Empty(t, incremental.Statements)
+		require.Empty(t, incremental.Transactions)
+	})
+
+	t.Run("streams rows", func(t *testing.T) {
+		// The rows are written to the writer as they are read, so a writer
+		// failing after some bytes fails the export with its error.
+		w := &failingWriter{limit: 100}
+		err := sqlStats.ExportJSON(ctx, w, persistedsqlstats.ExportOptions{})
+		require.ErrorIs(t, err, errWriterFull)
+		require.Equal(t, 100, w.written)
+	})
+
+	t.Run("rejects future timestamp", func(t *testing.T) {
+		err := sqlStats.ExportJSON(ctx, &bytes.Buffer{}, persistedsqlstats.ExportOptions{
+			AsOf: timeutil.Now().Add(time.Hour),
+		})
+		require.True(t, testutils.IsError(err, "in the future"), "unexpected error: %v", err)
+	})
+}
+
+var errWriterFull = errors.New("writer full")
+
+// failingWriter accepts up to limit bytes, and then fails with errWriterFull.
+type failingWriter struct {
+	limit, written int
+}
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if w.written+len(p) > w.limit {
+		n := w.limit - w.written
+		w.written = w.limit
+		return n, errWriterFull
+	}
+	w.written += len(p)
+	return len(p), nil
+}
+
+func TestSQLStatsExportProtectsFromCompaction(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	ctx := context.Background()
+	var stubTime atomic.Value
+	stubTime.Store(timeutil.Now())
+	// duringExport is called by the exports once their rows are protected.
+	var duringExport func()
+	knobs := &sqlstats.TestingKnobs{
+		AOSTClause: "AS OF SYSTEM TIME '-1us'",
+		StubTimeNow: func() time.Time {
+			return stubTime.Load().(time.Time)
+		},
+		OnExportProtected: func() {
+			if duringExport != nil {
+				duringExport()
+			}
+		},
+	}
+	server, conn, _ := serverutils.StartServer(t, base.TestServerArgs{
+		Knobs: base.TestingKnobs{SQLStatsKnobs: knobs},
+	})
+	defer server.Stopper().Stop(ctx)
+
+	sqlConn := sqlutils.MakeSQLRunner(conn)
+	sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.flush.interval = '24h'")
+	sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.cleanup.recurrence = '@yearly'")
+	sqlConn.Exec(t, "SELECT crdb_internal.reset_sql_stats()")
+	sqlStats := server.SQLServer().(*sql.Server).
+		GetSQLStatsProvider().(*persistedsqlstats.PersistedSQLStats)
+
+	// Persist rows aggregated two hours ago, and keep at most a single row
+	// per hash bucket, so that the compaction removes most of them.
+	stubTime.Store(timeutil.Now().Add(-2 * time.Hour))
+	generateFingerprints(t, sqlConn, 20 /* distinctFingerprints */)
+	sqlStats.Flush(ctx)
+	stubTime.Store(timeutil.Now())
+	sqlConn.Exec(t, fmt.Sprintf("SET CLUSTER SETTING sql.stats.persisted_rows.max = %d",
+		systemschema.SQLStatsHashShardBucketCount))
+	stmtCnt, txnCnt := getPersistedStatsEntry(t, sqlConn)
+	require.Greater(t, stmtCnt, systemschema.SQLStatsHashShardBucketCount)
+
+	metrics := persistedsqlstats.CompactorMetrics{
+		RowsRemoved: metric.NewCounter(metric.Metadata{}),
+	}
+	statsCompactor := persistedsqlstats.NewStatsCompactor(
+		server.ClusterSettings(),
+		server.InternalDB().(isql.DB),
+		metrics,
+		knobs,
+	)
+	protections := func() (count int) {
+		sqlConn.QueryRow(t, "SELECT count(*) FROM system.protected_ts_records WHERE meta_type = $1",
+			persistedsqlstats.StatsProtectionMetaType).Scan(&count)
+		return count
+	}
+	// exportCompacting runs the compaction during an export with the given
+	// options, and returns the number of rows of each table in the export.
+	exportCompacting := func(opts persistedsqlstats.ExportOptions) (stmtRows, txnRows int) {
+		duringExport = func() {
+			require.Equal(t, 1, protections())
+			require.NoError(t, statsCompactor.DeleteOldestEntries(ctx))
+		}
+		defer func() { duringExport = nil }()
+		var buf bytes.Buffer
+		require.NoError(t, sqlStats.ExportJSON(ctx, &buf, opts))
+		var res struct {
+			Statements   []gojson.RawMessage `json:"statements"`
+			Transactions []gojson.RawMessage `json:"transactions"`
+		}
+		require.NoError(t, gojson.Unmarshal(buf.Bytes(), &res), buf.String())
+		return len(res.Statements), len(res.Transactions)
+	}
+
+	// The compaction does not remove the rows read by an export.
+	stmtRows, txnRows := exportCompacting(persistedsqlstats.ExportOptions{})
+	require.Equal(t, stmtCnt, stmtRows)
+	require.Equal(t, txnCnt, txnRows)
+	require.Zero(t, metrics.RowsRemoved.Count())
+	require.Zero(t, protections())
+
+	// The protection of an incremental export only covers the rows it reads,
+	// so the older rows are removed.
+	stmtRows, txnRows = exportCompacting(persistedsqlstats.ExportOptions{
+		Since: timeutil.Now().Add(-time.Hour),
+	})
+	require.Zero(t, stmtRows)
+	require.Zero(t, txnRows)
+	require.Greater(t, metrics.RowsRemoved.Count(), int64(0))
+	require.Zero(t, protections())
+}
+
+func TestSQLStatsExportJSONCompressedText(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	ctx := context.Background()
+	server, conn, _ := serverutils.StartServer(t, base.TestServerArgs{})
+	defer server.Stopper().Stop(ctx)
+
+	sqlConn := sqlutils.MakeSQLRunner(conn)
+	sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.flush.interval = '24h'")
+	sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.flush.compress_text = true")
+	sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.flush.compress_text.min_size = '1B'")
+	sqlConn.Exec(t, "SELECT crdb_internal.reset_sql_stats()")
+
+	sqlStats := server.SQLServer().(*sql.Server).
+		GetSQLStatsProvider().(*persistedsqlstats.PersistedSQLStats)
+
+	var query, fingerprint strings.Builder
+	query.WriteString("SELECT ")
+	fingerprint.WriteString("SELECT ")
+	for i := 0; i < 100; i++ {
+		if i > 0 {
+			query.WriteString(", ")
+			fingerprint.WriteString(", ")
+		}
+		fmt.Fprintf(&query, "%d AS column_%d", i, i)
+		fmt.Fprintf(&fingerprint, "_ AS column_%d", i)
+	}
+	sqlConn.Exec(t, "SET application_name = 'compress_text_test'")
+	sqlConn.Exec(t, query.String())
+	sqlConn.Exec(t, "SELECT 1")
+	sqlConn.Exec(t, "SET application_name = ''")
+	sqlStats.Flush(ctx)
+
+	// The statement text and the plans are compressed in the system table.
+	sqlConn.CheckQueryResults(t, `
+SELECT metadata ? 'queryCompressed', metadata ? 'query', plan ? 'compressed'
+FROM system.statement_statistics
+WHERE app_name = 'compress_text_test' AND metadata ->> 'querySummary' LIKE 'SELECT%'`,
+		[][]string{{"true", "false", "true"}, {"true", "false", "true"}})
+
+	// The virtual tables decompress them in SQL.
+	for _, tc := range []struct{ table, planColumn string }{
+		{"crdb_internal.statement_statistics_persisted", "plan"},
+		{"crdb_internal.statement_statistics", "sampled_plan"},
+	} {
+		sqlConn.CheckQueryResults(t, fmt.Sprintf(`
+SELECT metadata ->> 'query', metadata ? 'queryCompressed', %[2]s ? 'Name'
+FROM %[1]s
+WHERE app_name = 'compress_text_test' AND metadata ->> 'query' LIKE 'SELECT%%'
+ORDER BY 1`, tc.table, tc.planColumn),
+			[][]string{{"SELECT _", "false", "true"}, {fingerprint.String(), "false", "true"}})
+	}
+
+	// The classification of the statements by type doesn't depend on the
+	// statement text.
+	var selectFingerprints int
+	sqlConn.QueryRow(t, `
+SELECT fingerprint_count FROM crdb_internal.sql_stats_by_type('0s')
+WHERE statement_type = 'SELECT'`).Scan(&selectFingerprints)
+	require.GreaterOrEqual(t, selectFingerprints, 2)
+
+	// The persisted stats reader sorts on the statement text decompressed in
+	// SQL, and decompresses the statement text and the plans.
+	var queries []string
+	require.NoError(t, sqlStats.IterateStatementStats(ctx,
+		&sqlstats.IteratorOptions{SortedKey: true, SortedAppNames: true},
+		func(ctx context.Context, stats *appstatspb.CollectedStatementStatistics) error {
+			if stats.Key.App != "compress_text_test" || !strings.HasPrefix(stats.Key.Query, "SELECT") {
+				return nil
+			}
+			require.NotEmpty(t, stats.Stats.SensitiveInfo.MostRecentPlanDescription.Name,
+				"plan of %s", stats.Key.Query)
+			queries = append(queries, stats.Key.Query)
+			return nil
+		}))
+	require.Equal(t, []string{"SELECT _", fingerprint.String()}, queries)
+
+	// The export does not depend on the compression.
+	var buf bytes.Buffer
+	require.NoError(t, sqlStats.ExportJSON(ctx, &buf, persistedsqlstats.ExportOptions{}))
+	var export struct {
+		Statements []struct {
+			AppName  string `json:"app_name"`
+			Metadata struct {
+				Query string `json:"query"`
+			} `json:"metadata"`
+			Plan map[string]interface{} `json:"plan"`
+		} `json:"statements"`
+	}
+	require.NoError(t, gojson.Unmarshal(buf.Bytes(), &export), buf.String())
+	queries = queries[:0]
+	for _, stmt := range export.Statements {
+		if stmt.AppName != "compress_text_test" || !strings.HasPrefix(stmt.Metadata.Query, "SELECT") {
+			continue
+		}
+		require.Contains(t, stmt.Plan, "Name")
+		require.NotContains(t, stmt.Plan, "compressed")
+		queries = append(queries, stmt.Metadata.Query)
+	}
+	require.ElementsMatch(t, []string{fingerprint.String(), "SELECT _"}, queries)
+}
@@ -0,0 +1,103 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package persistedsqlstats
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/appstatspb"
+	"github.com/cockroachdb/cockroach/pkg/sql/pgwire/pgcode"
+	"github.com/cockroachdb/cockroach/pkg/sql/pgwire/pgerror"
+	"github.com/cockroachdb/cockroach/pkg/sql/sem/eval"
+	"github.com/cockroachdb/cockroach/pkg/sql/sem/tree"
+	"github.com/cockroachdb/cockroach/pkg/sql/sessiondata"
+	"github.com/cockroachdb/cockroach/pkg/sql/sqlstats"
+	"github.com/cockroachdb/cockroach/pkg/sql/sqlstats/persistedsqlstats/sqlstatsutil"
+	"github.com/cockroachdb/errors"
+)
+
+// MaxFingerprintDetailWindows is the maximum number of aggregation windows
+// returned by GetSQLStatsFingerprintDetail.
+const MaxFingerprintDetailWindows = 1000
+
+// inMemoryFingerprintCount returns the number of executions of the given
+// statement fingerprint of the given application recorded by this node since
+// its last flush, across all the transactions and plans.
+func (s *PersistedSQLStats) inMemoryFingerprintCount(
+	ctx context.Context, fingerprintID appstatspb.StmtFingerprintID, appName string,
+) (count int64) {
+	_ = s.SQLStats.IterateStatementStats(ctx, &sqlstats.IteratorOptions{},
+		func(ctx context.Context, statistics *appstatspb.CollectedStatementStatistics) error {
+			if statistics.ID == fingerprintID && statistics.Key.App == appName {
+				count += statistics.Stats.Count
+			}
+			return nil
+		})
+	return count
+}
+
+// GetSQLStatsFingerprintDetail implements the eval.SQLStatsController
+// interface. The persisted counts are read through the fingerprint_id index of
+// system.statement_statistics, and are limited to the
+// MaxFingerprintDetailWindows most recent windows. They include the rows
+// persisted under the hash of the application name, see
+// sql.stats.flush.hash_app_names.
+func (s *Controller) GetSQLStatsFingerprintDetail(
+	ctx context.Context, fingerprintID []byte, appName string, opts eval.SQLStatsReadOptions,
+) (detail eval.SQLStatsFingerprintDetail, retErr error) {
+	if len(fingerprintID) != 8 {
+		return detail, pgerror.Newf(pgcode.InvalidParameterValue,
+			"fingerprint_id must be 8 bytes long, got %d", len(fingerprintID))
+	}
+	id, err := sqlstatsutil.DatumToUint64(tree.NewDBytes(tree.DBytes(fingerprintID)))
+	if err != nil {
+		return detail, err
+	}
+	// The in-memory and persisted counts are not read atomically: the
+	// executions flushed concurrently may be counted in both, and the
+	// persisted counts lag behind the flushes by the staleness of the read.
+	detail.LastFlushAt = s.sqlStats.GetLastFlushAt()
+	detail.InMemoryCount = s.sqlStats.inMemoryFingerprintCount(
+		ctx, appstatspb.StmtFingerprintID(id), appName,
+	)
+
+	it, err := s.db.Executor().QueryIteratorEx(
+		ctx,
+		"sql-stats-fingerprint-detail",
+		nil, /* txn */
+		sessiondata.NodeUserSessionDataOverride,
+		fmt.Sprintf(`
+SELECT aggregated_ts, sum(execution_count)::INT8
+FROM system.statement_statistics %s
+WHERE fingerprint_id = $1 AND app_name IN ($2, $3)
+GROUP BY aggregated_ts
+ORDER BY aggregated_ts DESC
+LIMIT $4`, getReadAOSTClause(s.knobs, opts)),
+		fingerprintID, appName, hashAppName(&s.st.SV, appName), MaxFingerprintDetailWindows,
+	)
+	if err != nil {
+		return detail, err
+	}
+	defer func() {
+		retErr = errors.CombineErrors(retErr, it.Close())
+	}()
+
+	var ok bool
+	for ok, err = it.Next(ctx); ok; ok, err = it.Next(ctx) {
+		row := it.Cur()
+		detail.PersistedWindows = append(detail.PersistedWindows, eval.SQLStatsFingerprintWindow{
+			AggregatedTs: tree.MustBeDTimestampTZ(row[0]).Time,
+			Count:        int64(tree.MustBeDInt(row[1])),
+		})
+	}
+	return detail, err
+}
@@ -13,9 +13,11 @@ package persistedsqlstats
 import (
 	"context"
 	"fmt"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/cockroachdb/cockroach/pkg/clusterversion"
 	"github.com/cockroachdb/cockroach/pkg/sql/appstatspb"
 	"github.com/cockroachdb/cockroach/pkg/sql/isql"
 	"github.com/cockroachdb/cockroach/pkg/sql/sem/tree"
@@ -24,21 +26,103 @@ import (
 	"github.com/cockroachdb/cockroach/pkg/sql/sqlstats/persistedsqlstats/sqlstatsutil"
 	"github.com/cockroachdb/cockroach/pkg/sql/types"
 	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/cockroachdb/cockroach/pkg/util/syncutil/singleflight"
 	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
 	"github.com/cockroachdb/errors"
 )
 
+// FlushReport summarizes the outcome of a flush of the in-memory SQL stats.
+type FlushReport struct {
+	// Written is the number of statement and transaction fingerprints that
+	// were written to the stats tables.
+	Written int64
+	// Discarded is the number of fingerprints that were removed from memory
+	// without being written, e.g. because they were sampled out, failed to be
+	// written, or the stats tables were over their limit.
+	Discarded int64
+	// Duration is the time spent flushing.
+	Duration time.Duration
+	// Errors is the number of writes of the flush that failed, by category
+	// as classified by ClassifyFlushError. It is empty if no write failed.
+	Errors map[FlushErrorCategory]int64
+}
+
+// flushGroupKey is the key of the flushes in PersistedSQLStats.flushGroup.
+const flushGroupKey = "flush"
+
 // Flush flushes in-memory sql stats into a system table. Any errors encountered
 // during the flush will be logged as warning.
 func (s *PersistedSQLStats) Flush(ctx context.Context) {
+	_ = s.FlushWithReport(ctx)
+}
+
+// FlushWithReport is like Flush, but also returns a summary of the flush.
+// Concurrent flushes are coalesced: a call made while a flush is in progress
+// waits for it to complete and returns its report, rather than starting
+// another flush.
+//
+// The shared flush runs under a context detached from the one of the caller
+// that started it, so that canceling one caller does not abort the flush for
+// the others. A caller whose ctx is done stops waiting and gets an empty
+// report, while the flush keeps going in the background; the caller is
+// expected to check ctx.Err().
+func (s *PersistedSQLStats) FlushWithReport(ctx context.Context) FlushReport {
+	future, _ := s.flushGroup.DoChan(ctx, flushGroupKey,
+		singleflight.DoOpts{
+			Stop:               s.stopper,
+			InheritCancelation: false,
+		},
+		func(ctx context.Context) (interface{}, error) {
+			return s.runFlush(ctx), nil
+		})
+	select {
+	case <-future.C():
+	case <-ctx.Done():
+		log.VInfof(ctx, 1, "stopped waiting for the flush of SQL stats: %v", ctx.Err())
+		return FlushReport{}
+	}
+	res := future.WaitForResult(ctx)
+	if res.Err != nil {
+		// The flush could not run because the server is quiescing.
+		log.Warningf(ctx, "failed to flush SQL stats: %v", res.Err)
+		return FlushReport{}
+	}
+	return res.Val.(FlushReport)
+}
+
+// runFlush flushes the in-memory SQL stats. It is only called by
+// FlushWithReport.
+func (s *PersistedSQLStats) runFlush(ctx context.Context) (report FlushReport) {
+	s.flushMu.Lock()
+	defer s.flushMu.Unlock()
+
 	now := s.getTimeNow()
+	defer func() {
+		report.Duration = s.getTimeNow().Sub(now)
+	}()
+
+	// While the maintenance is frozen, the in-memory stats are neither
+	// written nor discarded.
+	if SQLStatsMaintenanceFrozen.Get(&s.cfg.Settings.SV) {
+		log.VEventf(ctx, 1, "flush skipped: %s is set", SQLStatsMaintenanceFrozen.Key())
+		return
+	}
 
 	allowDiscardWhenDisabled := DiscardInMemoryStatsWhenFlushDisabled.Get(&s.cfg.Settings.SV)
 	minimumFlushInterval := MinimumInterval.Get(&s.cfg.Settings.SV)
 
-	enabled := SQLStatsFlushEnabled.Get(&s.cfg.Settings.SV)
+	enabled := SQLStatsFlushEnabled.Get(&s.cfg.Settings.SV) && !s.flushDisabled
 	flushingTooSoon := now.Before(s.lastFlushStarted.Add(minimumFlushInterval))
 
+	// There is nothing to flush when the collection of statement statistics is
+	// disabled. We count the skipped flushes to make it clear why the stats
+	// tables are not growing. The stats collected before the collection was
+	// disabled are kept in memory, to be flushed once it is enabled again.
+	if enabled && !sqlstats.StmtStatsEnable.Get(&s.cfg.Settings.SV) {
+		s.cfg.DisabledSkipCounter.Inc(1)
+		return
+	}
+
 	// Handle wiping in-memory stats here, we only wipe in-memory stats under 2
 	// circumstances:
 	// 1. flush is enabled, and we are not early aborting the flush due to flushing
@@ -48,7 +132,11 @@ func (s *PersistedSQLStats) Flush(ctx context.Context) {
 	shouldWipeInMemoryStats = shouldWipeInMemoryStats || (!enabled && allowDiscardWhenDisabled)
 
 	if shouldWipeInMemoryStats {
+		fingerprintCount := s.SQLStats.GetTotalFingerprintCount()
 		defer func() {
+			if fingerprintCount > report.Written {
+				report.Discarded = fingerprintCount - report.Written
+			}
 			if err := s.SQLStats.Reset(ctx); err != nil {
 				log.Warningf(ctx, "fail to reset in-memory SQL Stats: %s", err)
 			}
@@ -67,33 +155,151 @@ func (s *PersistedSQLStats) Flush(ctx context.Context) {
 	}
 
 	s.lastFlushStarted = now
+	s.atomic.lastFlushAt.Store(now)
+	s.resetFlushErrors()
 	log.Infof(ctx, "flushing %d stmt/txn fingerprints (%d bytes) after %s",
 		s.SQLStats.GetTotalFingerprintCount(), s.SQLStats.GetTotalFingerprintBytes(), timeutil.Since(s.lastFlushStarted))
 
-	aggregatedTs := s.ComputeAggregatedTs()
+	// The aggregation interval is read once, so that all the fingerprints of
+	// this flush are assigned to the same window even if the setting changes
+	// during the flush.
+	aggInterval := s.GetAggregationInterval()
+	aggregatedTs := s.computeAggregatedTs(aggInterval)
 
 	if s.stmtsLimitSizeReached(ctx) || s.txnsLimitSizeReached(ctx) {
 		log.Infof(ctx, "unable to flush fingerprints because table limit was reached.")
 	} else {
+		// The stats written to the system tables are also passed to the
+		// registered sinks, if any.
+		var sinkBatch *flushSinkBatch
+		sinks := getFlushSinks()
+		if len(sinks) > 0 {
+			sinkBatch = &flushSinkBatch{}
+		}
+
 		var wg sync.WaitGroup
+		var stmtsWritten, txnsWritten int64
 		wg.Add(2)
 
 		go func() {
 			defer wg.Done()
-			s.flushStmtStats(ctx, aggregatedTs)
+			stmtsWritten = s.flushStmtStats(ctx, aggregatedTs, aggInterval, sinkBatch)
 		}()
 
 		go func() {
 			defer wg.Done()
-			s.flushTxnStats(ctx, aggregatedTs)
+			txnsWritten = s.flushTxnStats(ctx, aggregatedTs, aggInterval, sinkBatch)
 		}()
 
 		wg.Wait()
+		report.Written = stmtsWritten + txnsWritten
+		s.advanceHighWaterMarks(ctx, aggregatedTs, stmtsWritten, txnsWritten)
+		writeToFlushSinks(ctx, sinks, aggregatedTs, sinkBatch)
+		report.Errors = s.resetFlushErrors()
+		if len(report.Errors) == 0 {
+			s.advanceFlushSequence()
+		}
+	}
+
+	s.checkFlushOverrun(ctx, s.getTimeNow().Sub(now), aggInterval)
+	return report
+}
+
+// checkFlushOverrun counts the flushes that took longer than the aggregation
+// interval. When the flushes consistently overrun the interval, the windows
+// pile up faster than they are flushed, and either the interval needs to be
+// increased or the flush needs to be made cheaper.
+func (s *PersistedSQLStats) checkFlushOverrun(
+	ctx context.Context, flushDuration time.Duration, aggInterval time.Duration,
+) {
+	if aggInterval <= 0 || flushDuration <= aggInterval {
+		return
+	}
+	s.cfg.OverrunCounter.Inc(1)
+	if s.overrunLogEvery.ShouldLog() {
+		log.Warningf(ctx, "flushing SQL stats took %s, which exceeds the aggregation interval "+
+			"of %s (sql.stats.aggregation.interval)", flushDuration, aggInterval)
+	}
+}
+
+// advanceFlushSequence advances the sequence number of the successful
+// flushes of this node, i.e. of the flushes that were neither skipped nor
+// aborted, and that wrote all their fingerprints without errors, whether or
+// not they had fingerprints to write. The sequence number is only kept in memory, and starts over from zero when the
+// process restarts: a sequence number that stops advancing indicates that
+// the flushes stalled on this node.
+func (s *PersistedSQLStats) advanceFlushSequence() {
+	if s.cfg.FlushSequence != nil {
+		s.cfg.FlushSequence.Inc(1)
+	}
+}
+
+// advanceHighWaterMarks advances the high-water marks of the stats tables to
+// which the flush wrote fingerprints. If the CheckFlushHighWaterMarks testing
+// knob is set, the high-water marks are then checked against the persisted
+// stats, see checkHighWaterMark.
+func (s *PersistedSQLStats) advanceHighWaterMarks(
+	ctx context.Context, aggregatedTs time.Time, stmtsWritten, txnsWritten int64,
+) {
+	for _, t := range []struct {
+		table         string
+		written       int64
+		highWaterMark *time.Time
+	}{
+		{table: "system.statement_statistics", written: stmtsWritten, highWaterMark: &s.stmtHighWaterMark},
+		{table: "system.transaction_statistics", written: txnsWritten, highWaterMark: &s.txnHighWaterMark},
+	} {
+		if t.written == 0 {
+			continue
+		}
+		if aggregatedTs.After(*t.highWaterMark) {
+			*t.highWaterMark = aggregatedTs
+		}
+		if s.cfg.Knobs != nil && s.cfg.Knobs.CheckFlushHighWaterMarks {
+			s.checkHighWaterMark(ctx, t.table, *t.highWaterMark)
+		}
+	}
+}
+
+// checkHighWaterMark logs an error if the most recent aggregated_ts persisted
+// by this node in the given table precedes its high-water mark, i.e. if the
+// flush counted fingerprints as written that are missing from the table. The
+// check is only an invariant as long as the persisted stats are not reset
+// concurrently (crdb_internal.reset_sql_stats()) and the node_id of the rows
+// does not change (sql.stats.gateway_node.enabled), and it scans the table,
+// which is why it is only performed in tests.
+func (s *PersistedSQLStats) checkHighWaterMark(
+	ctx context.Context, table string, highWaterMark time.Time,
+) {
+	row, err := s.cfg.DB.Executor().QueryRowEx(
+		ctx,
+		"check-sql-stats-high-water-mark",
+		nil, /* txn */
+		sessiondata.NodeUserSessionDataOverride,
+		fmt.Sprintf("SELECT max(aggregated_ts) FROM %s WHERE node_id = $1", table),
+		s.GetEnabledSQLInstanceID(),
+	)
+	if err != nil {
+		log.Warningf(ctx, "unable to check the high-water mark of %s: %v", table, err)
+		return
+	}
+	var persistedAggTs time.Time
+	if row[0] != tree.DNull {
+		persistedAggTs = tree.MustBeDTimestampTZ(row[0]).Time
+	}
+	if persistedAggTs.Before(highWaterMark) {
+		log.Errorf(ctx, "SQL stats invariant violated: the most recent aggregated_ts flushed by "+
+			"this node to %s is %s, which precedes the high-water mark of the flush %s",
+			table, persistedAggTs, highWaterMark)
 	}
 }
 
 func (s *PersistedSQLStats) stmtsLimitSizeReached(ctx context.Context) bool {
 	maxPersistedRows := float64(SQLStatsMaxPersistedRows.Get(&s.SQLStats.GetClusterSettings().SV))
+	if maxPersistedRows == 0 {
+		// There is no row cap, the table size is bounded by the age limit.
+		return false
+	}
 
 	readStmt := `
 SELECT
@@ -119,6 +325,9 @@ FROM
 
 func (s *PersistedSQLStats) txnsLimitSizeReached(ctx context.Context) bool {
 	maxPersistedRows := float64(SQLStatsMaxPersistedRows.Get(&s.SQLStats.GetClusterSettings().SV))
+	if maxPersistedRows == 0 {
+		return false
+	}
 
 	readStmt := `
 SELECT
@@ -142,14 +351,32 @@ FROM
 	return actualSize > (maxPersistedRows * 1.5)
 }
 
-func (s *PersistedSQLStats) flushStmtStats(ctx context.Context, aggregatedTs time.Time) {
+// flushStmtStats flushes the in-memory statement stats and returns the number
+// of fingerprints written. The written stats are added to sinkBatch.
+func (s *PersistedSQLStats) flushStmtStats(
+	ctx context.Context, aggregatedTs time.Time, aggInterval time.Duration, sinkBatch *flushSinkBatch,
+) (written int64) {
+	if SQLStatsFlushStagingEnabled.Get(&s.cfg.Settings.SV) {
+		return s.flushStmtStatsStaged(ctx, aggregatedTs, aggInterval, sinkBatch)
+	}
+
 	// s.doFlush directly logs errors if they are encountered. Therefore,
 	// no error is returned here.
 	_ = s.SQLStats.IterateStatementStats(ctx, &sqlstats.IteratorOptions{},
 		func(ctx context.Context, statistics *appstatspb.CollectedStatementStatistics) error {
-			s.doFlush(ctx, func() error {
-				return s.doFlushSingleStmtStats(ctx, statistics, aggregatedTs)
-			}, "failed to flush statement statistics" /* errMsg */)
+			if !s.stmtSampler.shouldRecord(
+				s.cfg.Settings, aggregatedTs, statistics.Key.App, uint64(statistics.ID),
+			) {
+				s.cfg.SampledOutCounter.Inc(1)
+				return nil
+			}
+			statistics = s.stmtStatsToPersist(statistics)
+			if err := s.doFlush(ctx, func() error {
+				return s.doFlushSingleStmtStats(ctx, statistics, aggregatedTs, aggInterval)
+			}, "failed to flush statement statistics" /* errMsg */); err == nil {
+				written++
+				sinkBatch.addStmtStats(statistics)
+			}
 
 			return nil
 		})
@@ -157,14 +384,33 @@ func (s *PersistedSQLStats) flushStmtStats(ctx context.Context, aggregatedTs tim
 	if s.cfg.Knobs != nil && s.cfg.Knobs.OnStmtStatsFlushFinished != nil {
 		s.cfg.Knobs.OnStmtStatsFlushFinished()
 	}
+	return written
 }
 
-func (s *PersistedSQLStats) flushTxnStats(ctx context.Context, aggregatedTs time.Time) {
+// flushTxnStats flushes the in-memory transaction stats and returns the
+// number of fingerprints written. The written stats are added to sinkBatch.
+func (s *PersistedSQLStats) flushTxnStats(
+	ctx context.Context, aggregatedTs time.Time, aggInterval time.Duration, sinkBatch *flushSinkBatch,
+) (written int64) {
+	if SQLStatsFlushStagingEnabled.Get(&s.cfg.Settings.SV) {
+		return s.flushTxnStatsStaged(ctx, aggregatedTs, aggInterval, sinkBatch)
+	}
+
 	_ = s.SQLStats.IterateTransactionStats(ctx, &sqlstats.IteratorOptions{},
 		func(ctx context.Context, statistics *appstatspb.CollectedTransactionStatistics) error {
-			s.doFlush(ctx, func() error {
-				return s.doFlushSingleTxnStats(ctx, statistics, aggregatedTs)
-			}, "failed to flush transaction statistics" /* errMsg */)
+			if !s.txnSampler.shouldRecord(
+				s.cfg.Settings, aggregatedTs, statistics.App, uint64(statistics.TransactionFingerprintID),
+			) {
+				s.cfg.SampledOutCounter.Inc(1)
+				return nil
+			}
+			statistics = s.txnStatsToPersist(statistics)
+			if err := s.doFlush(ctx, func() error {
+				return s.doFlushSingleTxnStats(ctx, statistics, aggregatedTs, aggInterval)
+			}, "failed to flush transaction statistics" /* errMsg */); err == nil {
+				written++
+				sinkBatch.addTxnStats(statistics)
+			}
 
 			return nil
 		})
@@ -172,36 +418,77 @@ func (s *PersistedSQLStats) flushTxnStats(ctx context.Context, aggregatedTs time
 	if s.cfg.Knobs != nil && s.cfg.Knobs.OnTxnStatsFlushFinished != nil {
 		s.cfg.Knobs.OnTxnStatsFlushFinished()
 	}
+	return written
 }
 
-func (s *PersistedSQLStats) doFlush(ctx context.Context, workFn func() error, errMsg string) {
-	var err error
+// doFlush runs workFn, records its outcome in the flush metrics, and logs the
+// error it returns, if any. The error is also returned.
+func (s *PersistedSQLStats) doFlush(
+	ctx context.Context, workFn func() error, errMsg string,
+) (err error) {
 	flushBegin := s.getTimeNow()
 
 	defer func() {
 		if err != nil {
+			category := ClassifyFlushError(err)
+			s.recordFlushError(category)
 			s.cfg.FailureCounter.Inc(1)
-			log.Warningf(ctx, "%s: %s", errMsg, err)
+			if counter, ok := s.cfg.FailureCountersByCategory[category]; ok {
+				counter.Inc(1)
+			}
+			log.Warningf(ctx, "%s (%s): %s", errMsg, category, err)
 		}
 		flushDuration := s.getTimeNow().Sub(flushBegin)
 		s.cfg.FlushDuration.RecordValue(flushDuration.Nanoseconds())
 		s.cfg.FlushCounter.Inc(1)
 	}()
 
+	if s.cfg.Knobs != nil && s.cfg.Knobs.BeforeFlushWrite != nil {
+		if err = s.cfg.Knobs.BeforeFlushWrite(); err != nil {
+			return err
+		}
+	}
 	err = workFn()
+	return err
+}
+
+// recordFlushError counts a failed write of the flush in progress.
+func (s *PersistedSQLStats) recordFlushError(category FlushErrorCategory) {
+	s.flushErrors.Lock()
+	defer s.flushErrors.Unlock()
+	if s.flushErrors.byCategory == nil {
+		s.flushErrors.byCategory = make(map[FlushErrorCategory]int64)
+	}
+	s.flushErrors.byCategory[category]++
+}
+
+// resetFlushErrors returns the failed writes counted by recordFlushError
+// since the last call, by category.
+func (s *PersistedSQLStats) resetFlushErrors() map[FlushErrorCategory]int64 {
+	s.flushErrors.Lock()
+	defer s.flushErrors.Unlock()
+	errs := s.flushErrors.byCategory
+	s.flushErrors.byCategory = nil
+	return errs
 }
 
 func (s *PersistedSQLStats) doFlushSingleTxnStats(
-	ctx context.Context, stats *appstatspb.CollectedTransactionStatistics, aggregatedTs time.Time,
+	ctx context.Context,
+	stats *appstatspb.CollectedTransactionStatistics,
+	aggregatedTs time.Time,
+	aggInterval time.Duration,
 ) error {
+	attempts := 0
 	return s.cfg.DB.Txn(ctx, func(ctx context.Context, txn isql.Txn) error {
+		attempts++
+		s.countFlushTxnRetry(attempts)
 		// Explicitly copy the stats variable so the txn closure is retryable.
 		scopedStats := *stats
 
 		serializedFingerprintID := sqlstatsutil.EncodeUint64ToBytes(uint64(stats.TransactionFingerprintID))
 
 		insertFn := func(ctx context.Context, txn isql.Txn) (alreadyExists bool, err error) {
-			rowsAffected, err := s.insertTransactionStats(ctx, txn, aggregatedTs, serializedFingerprintID, &scopedStats)
+			rowsAffected, err := s.insertTransactionStats(ctx, txn, aggregatedTs, aggInterval, serializedFingerprintID, &scopedStats)
 
 			if err != nil {
 				return false /* alreadyExists */, err
@@ -238,9 +525,15 @@ func (s *PersistedSQLStats) doFlushSingleTxnStats(
 }
 
 func (s *PersistedSQLStats) doFlushSingleStmtStats(
-	ctx context.Context, stats *appstatspb.CollectedStatementStatistics, aggregatedTs time.Time,
+	ctx context.Context,
+	stats *appstatspb.CollectedStatementStatistics,
+	aggregatedTs time.Time,
+	aggInterval time.Duration,
 ) error {
+	attempts := 0
 	return s.cfg.DB.Txn(ctx, func(ctx context.Context, txn isql.Txn) error {
+		attempts++
+		s.countFlushTxnRetry(attempts)
 		// Explicitly copy the stats so that this closure is retryable.
 		scopedStats := *stats
 
@@ -253,6 +546,7 @@ func (s *PersistedSQLStats) doFlushSingleStmtStats(
 				ctx,
 				txn,
 				aggregatedTs,
+				aggInterval,
 				serializedFingerprintID,
 				serializedTransactionFingerprintID,
 				serializedPlanHash,
@@ -310,6 +604,14 @@ func (s *PersistedSQLStats) doFlushSingleStmtStats(
 	})
 }
 
+// countFlushTxnRetry counts the retries of the transactions of the flush, given
+// the number of the current attempt of the transaction.
+func (s *PersistedSQLStats) countFlushTxnRetry(attempts int) {
+	if attempts > 1 && s.cfg.FlushTxnRetries != nil {
+		s.cfg.FlushTxnRetries.Inc(1)
+	}
+}
+
 func (s *PersistedSQLStats) doInsertElseDoUpdate(
 	ctx context.Context,
 	txn isql.Txn,
@@ -340,12 +642,14 @@ func (s *PersistedSQLStats) doInsertElseDoUpdate(
 // ComputeAggregatedTs returns the aggregation timestamp to assign
 // in-memory SQL stats during storage or aggregation.
 func (s *PersistedSQLStats) ComputeAggregatedTs() time.Time {
-	interval := SQLStatsAggregationInterval.Get(&s.cfg.Settings.SV)
-	now := s.getTimeNow()
-
-	aggTs := now.Truncate(interval)
+	return s.computeAggregatedTs(s.GetAggregationInterval())
+}
 
-	return aggTs
+// computeAggregatedTs returns the start of the aggregation window of the given
+// interval that contains the current time. The windows are aligned on the
+// zero time, so that all the nodes agree on them.
+func (s *PersistedSQLStats) computeAggregatedTs(interval time.Duration) time.Time {
+	return s.getTimeNow().Truncate(interval)
 }
 
 // GetAggregationInterval returns the current aggregation interval
@@ -366,38 +670,107 @@ func (s *PersistedSQLStats) insertTransactionStats(
 	ctx context.Context,
 	txn isql.Txn,
 	aggregatedTs time.Time,
+	aggInterval time.Duration,
 	serializedFingerprintID []byte,
 	stats *appstatspb.CollectedTransactionStatistics,
 ) (rowsAffected int, err error) {
-	insertStmt := `
-INSERT INTO system.transaction_statistics
-VALUES ($1, $2, $3, $4, $5, $6, $7)
+	withLastExecutionTs := s.hasLastExecutionTs(ctx)
+	args, err := s.buildTxnStatsRow(
+		aggregatedTs, aggInterval, serializedFingerprintID, stats, withLastExecutionTs,
+	)
+	if err != nil {
+		return 0 /* rowsAffected */, err
+	}
+	var values strings.Builder
+	appendValuesRow(&values, 1 /* first */, make([]string, len(args)))
+	insertStmt := fmt.Sprintf(`
+INSERT INTO system.transaction_statistics (%s)
+VALUES %s
 ON CONFLICT (crdb_internal_aggregated_ts_app_name_fingerprint_id_node_id_shard_8, aggregated_ts, fingerprint_id, app_name, node_id)
 DO NOTHING
-`
+`, txnStatsRowColumns(withLastExecutionTs), values.String())
 
-	aggInterval := s.GetAggregationInterval()
+	rowsAffected, err = txn.ExecEx(
+		ctx,
+		"insert-txn-stats",
+		txn.KV(),
+		sessiondata.NodeUserSessionDataOverride,
+		insertStmt,
+		args...,
+	)
+
+	return rowsAffected, err
+}
+
+// hasLastExecutionTs returns whether the stats tables have the
+// last_execution_ts column, which holds the last execution of the fingerprint
+// of each row and is populated by the flush. The compaction relies on it to
+// retain the recently executed fingerprints, see notRecentlyExecutedPredicate.
+func (s *PersistedSQLStats) hasLastExecutionTs(ctx context.Context) bool {
+	return s.cfg.Settings.Version.IsActive(ctx, clusterversion.V23_2_AddSQLStatsLastExecutionTs)
+}
+
+// stmtStatsRowColumns returns the columns of the rows built by
+// buildStmtStatsRow.
+func stmtStatsRowColumns(withLastExecutionTs bool) string {
+	columns := "aggregated_ts, fingerprint_id, transaction_fingerprint_id, plan_hash, app_name, " +
+		"node_id, agg_interval, metadata, statistics, plan, index_recommendations"
+	if withLastExecutionTs {
+		columns += ", last_execution_ts"
+	}
+	return columns
+}
 
-	// Prepare data for insertion.
+// txnStatsRowColumns returns the columns of the rows built by
+// buildTxnStatsRow.
+func txnStatsRowColumns(withLastExecutionTs bool) string {
+	columns := "aggregated_ts, fingerprint_id, app_name, node_id, agg_interval, metadata, statistics"
+	if withLastExecutionTs {
+		columns += ", last_execution_ts"
+	}
+	return columns
+}
+
+// stmtLastExecutionTs returns the last_execution_ts of the row persisting the
+// given stats, i.e. the last execution of the statement recorded in them.
+func stmtLastExecutionTs(stats *appstatspb.CollectedStatementStatistics) interface{} {
+	if stats.Stats.LastExecTimestamp.IsZero() {
+		return nil
+	}
+	return stats.Stats.LastExecTimestamp
+}
+
+// txnLastExecutionTs returns the last_execution_ts of the row persisting the
+// stats of a transaction. The transaction stats do not record the time of
+// their last execution, so the time of the flush, which follows it, is used.
+func (s *PersistedSQLStats) txnLastExecutionTs() time.Time {
+	return s.getTimeNow()
+}
+
+// buildTxnStatsRow returns the values of the columns of the row of
+// system.transaction_statistics persisting the given stats, see
+// txnStatsRowColumns.
+func (s *PersistedSQLStats) buildTxnStatsRow(
+	aggregatedTs time.Time,
+	aggInterval time.Duration,
+	serializedFingerprintID []byte,
+	stats *appstatspb.CollectedTransactionStatistics,
+	withLastExecutionTs bool,
+) ([]interface{}, error) {
 	metadataJSON, err := sqlstatsutil.BuildTxnMetadataJSON(stats)
 	if err != nil {
-		return 0 /* rowsAffected */, err
+		return nil, err
 	}
 	metadata := tree.NewDJSON(metadataJSON)
 
 	statisticsJSON, err := sqlstatsutil.BuildTxnStatisticsJSON(stats)
 	if err != nil {
-		return 0 /* rowsAffected */, err
+		return nil, err
 	}
 	statistics := tree.NewDJSON(statisticsJSON)
 
 	nodeID := s.GetEnabledSQLInstanceID()
-	rowsAffected, err = txn.ExecEx(
-		ctx,
-		"insert-txn-stats",
-		txn.KV(),
-		sessiondata.NodeUserSessionDataOverride,
-		insertStmt,
+	row := []interface{}{
 		aggregatedTs,            // aggregated_ts
 		serializedFingerprintID, // fingerprint_id
 		stats.App,               // app_name
@@ -405,9 +778,11 @@ DO NOTHING
 		aggInterval,             // agg_interval
 		metadata,                // metadata
 		statistics,              // statistics
-	)
-
-	return rowsAffected, err
+	}
+	if withLastExecutionTs {
+		row = append(row, s.txnLastExecutionTs()) // last_execution_ts
+	}
+	return row, nil
 }
 func (s *PersistedSQLStats) updateTransactionStats(
 	ctx context.Context,
@@ -432,17 +807,31 @@ WHERE fingerprint_id = $2
 	statistics := tree.NewDJSON(statisticsJSON)
 
 	nodeID := s.GetEnabledSQLInstanceID()
+	args := []interface{}{
+		statistics,              // statistics
+		serializedFingerprintID, // fingerprint_id
+		aggregatedTs,            // aggregated_ts
+		stats.App,               // app_name
+		nodeID,                  // node_id
+	}
+	if s.hasLastExecutionTs(ctx) {
+		updateStmt = `
+UPDATE system.transaction_statistics
+SET statistics = $1, last_execution_ts = greatest(last_execution_ts, $6::TIMESTAMPTZ)
+WHERE fingerprint_id = $2
+	AND aggregated_ts = $3
+  AND app_name = $4
+  AND node_id = $5
+`
+		args = append(args, s.txnLastExecutionTs()) // last_execution_ts
+	}
 	rowsAffected, err := txn.ExecEx(
 		ctx,
 		"update-stmt-stats",
 		txn.KV(), /* txn */
 		sessiondata.NodeUserSessionDataOverride,
 		updateStmt,
-		statistics,              // statistics
-		serializedFingerprintID, // fingerprint_id
-		aggregatedTs,            // aggregated_ts
-		stats.App,               // app_name
-		nodeID,                  // node_id
+		args...,
 	)
 
 	if err != nil {
@@ -482,20 +871,13 @@ WHERE fingerprint_id = $3
 		return err
 	}
 	statistics := tree.NewDJSON(statisticsJSON)
-	indexRecommendations := tree.NewDArray(types.String)
-	for _, recommendation := range stats.Stats.IndexRecommendations {
-		if err := indexRecommendations.Append(tree.NewDString(recommendation)); err != nil {
-			return err
-		}
+	indexRecommendations, err := buildIndexRecommendations(stats)
+	if err != nil {
+		return err
 	}
 
 	nodeID := s.GetEnabledSQLInstanceID()
-	rowsAffected, err := txn.ExecEx(
-		ctx,
-		"update-stmt-stats",
-		txn.KV(), /* txn */
-		sessiondata.NodeUserSessionDataOverride,
-		updateStmt,
+	args := []interface{}{
 		statistics,                         // statistics
 		indexRecommendations,               // index_recommendations
 		serializedFingerprintID,            // fingerprint_id
@@ -504,6 +886,29 @@ WHERE fingerprint_id = $3
 		stats.Key.App,                      // app_name
 		serializedPlanHash,                 // plan_hash
 		nodeID,                             // node_id
+	}
+	if s.hasLastExecutionTs(ctx) {
+		updateStmt = `
+UPDATE system.statement_statistics
+SET statistics = $1,
+index_recommendations = $2,
+last_execution_ts = greatest(last_execution_ts, $9::TIMESTAMPTZ)
+WHERE fingerprint_id = $3
+  AND transaction_fingerprint_id = $4
+	AND aggregated_ts = $5
+  AND app_name = $6
+  AND plan_hash = $7
+  AND node_id = $8
+`
+		args = append(args, stmtLastExecutionTs(stats)) // last_execution_ts
+	}
+	rowsAffected, err := txn.ExecEx(
+		ctx,
+		"update-stmt-stats",
+		txn.KV(), /* txn */
+		sessiondata.NodeUserSessionDataOverride,
+		updateStmt,
+		args...,
 	)
 
 	if err != nil {
@@ -529,39 +934,90 @@ func (s *PersistedSQLStats) insertStatementStats(
 	ctx context.Context,
 	txn isql.Txn,
 	aggregatedTs time.Time,
+	aggInterval time.Duration,
 	serializedFingerprintID []byte,
 	serializedTransactionFingerprintID []byte,
 	serializedPlanHash []byte,
 	stats *appstatspb.CollectedStatementStatistics,
 ) (rowsAffected int, err error) {
+	withLastExecutionTs := s.hasLastExecutionTs(ctx)
+	args, err := s.buildStmtStatsRow(
+		aggregatedTs,
+		aggInterval,
+		serializedFingerprintID,
+		serializedTransactionFingerprintID,
+		serializedPlanHash,
+		stats,
+		withLastExecutionTs,
+	)
+	if err != nil {
+		return 0 /* rowsAffected */, err
+	}
 
-	aggInterval := s.GetAggregationInterval()
+	var values strings.Builder
+	appendValuesRow(&values, 1 /* first */, make([]string, len(args)))
+	insertStmt := fmt.Sprintf(`
+INSERT INTO system.statement_statistics (%s)
+VALUES %s
+ON CONFLICT (crdb_internal_aggregated_ts_app_name_fingerprint_id_node_id_plan_hash_transaction_fingerprint_id_shard_8,
+             aggregated_ts, fingerprint_id, transaction_fingerprint_id, app_name, plan_hash, node_id)
+DO NOTHING
+`, stmtStatsRowColumns(withLastExecutionTs), values.String())
+	rowsAffected, err = txn.ExecEx(
+		ctx,
+		"insert-stmt-stats",
+		txn.KV(), /* txn */
+		sessiondata.NodeUserSessionDataOverride,
+		insertStmt,
+		args...,
+	)
+
+	return rowsAffected, err
+}
 
-	// Prepare data for insertion.
+// buildStmtStatsRow returns the values of the columns of the row of
+// system.statement_statistics persisting the given stats, see
+// stmtStatsRowColumns.
+func (s *PersistedSQLStats) buildStmtStatsRow(
+	aggregatedTs time.Time,
+	aggInterval time.Duration,
+	serializedFingerprintID []byte,
+	serializedTransactionFingerprintID []byte,
+	serializedPlanHash []byte,
+	stats *appstatspb.CollectedStatementStatistics,
+	withLastExecutionTs bool,
+) ([]interface{}, error) {
 	metadataJSON, err := sqlstatsutil.BuildStmtMetadataJSON(stats)
 	if err != nil {
-		return 0 /* rowsAffected */, err
+		return nil, err
 	}
-	metadata := tree.NewDJSON(metadataJSON)
 
 	statisticsJSON, err := sqlstatsutil.BuildStmtStatisticsJSON(&stats.Stats)
 	if err != nil {
-		return 0 /* rowsAffected */, err
+		return nil, err
 	}
 	statistics := tree.NewDJSON(statisticsJSON)
 
-	plan := tree.NewDJSON(sqlstatsutil.ExplainTreePlanNodeToJSON(&stats.Stats.SensitiveInfo.MostRecentPlanDescription))
+	planJSON := sqlstatsutil.ExplainTreePlanNodeToJSON(&stats.Stats.SensitiveInfo.MostRecentPlanDescription)
+	if SQLStatsFlushCompressText.Get(&s.cfg.Settings.SV) {
+		minSize := int(SQLStatsFlushCompressTextMinSize.Get(&s.cfg.Settings.SV))
+		if metadataJSON, err = sqlstatsutil.CompressStmtMetadataJSON(metadataJSON, minSize); err != nil {
+			return nil, err
+		}
+		if planJSON, err = sqlstatsutil.CompressPlanJSON(planJSON, minSize); err != nil {
+			return nil, err
+		}
+	}
+	metadata := tree.NewDJSON(metadataJSON)
+	plan := tree.NewDJSON(planJSON)
 	nodeID := s.GetEnabledSQLInstanceID()
 
-	indexRecommendations := tree.NewDArray(types.String)
-	for _, recommendation := range stats.Stats.IndexRecommendations {
-		if err := indexRecommendations.Append(tree.NewDString(recommendation)); err != nil {
-			return 0, err
-		}
+	indexRecommendations, err := buildIndexRecommendations(stats)
+	if err != nil {
+		return nil, err
 	}
 
-	values := "$1 ,$2, $3, $4, $5, $6, $7, $8, $9, $10, $11"
-	args := append(make([]interface{}, 0, 11),
+	row := []interface{}{
 		aggregatedTs,                       // aggregated_ts
 		serializedFingerprintID,            // fingerprint_id
 		serializedTransactionFingerprintID, // transaction_fingerprint_id
@@ -573,25 +1029,25 @@ func (s *PersistedSQLStats) insertStatementStats(
 		statistics,                         // statistics
 		plan,                               // plan
 		indexRecommendations,               // index_recommendations
-	)
-
-	insertStmt := fmt.Sprintf(`
-INSERT INTO system.statement_statistics
-VALUES (%s)
-ON CONFLICT (crdb_internal_aggregated_ts_app_name_fingerprint_id_node_id_plan_hash_transaction_fingerprint_id_shard_8,
-             aggregated_ts, fingerprint_id, transaction_fingerprint_id, app_name, plan_hash, node_id)
-DO NOTHING
-`, values)
-	rowsAffected, err = txn.ExecEx(
-		ctx,
-		"insert-stmt-stats",
-		txn.KV(), /* txn */
-		sessiondata.NodeUserSessionDataOverride,
-		insertStmt,
-		args...,
-	)
+	}
+	if withLastExecutionTs {
+		row = append(row, stmtLastExecutionTs(stats)) // last_execution_ts
+	}
+	return row, nil
+}
 
-	return rowsAffected, err
+// buildIndexRecommendations returns the index_recommendations column of the
+// row persisting the given stats.
+func buildIndexRecommendations(
+	stats *appstatspb.CollectedStatementStatistics,
+) (*tree.DArray, error) {
+	indexRecommendations := tree.NewDArray(types.String)
+	for _, recommendation := range stats.Stats.IndexRecommendations {
+		if err := indexRecommendations.Append(tree.NewDString(recommendation)); err != nil {
+			return nil, err
+		}
+	}
+	return indexRecommendations, nil
 }
 
 func (s *PersistedSQLStats) fetchPersistedTransactionStats(
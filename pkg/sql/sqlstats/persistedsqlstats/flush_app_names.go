@@ -0,0 +1,135 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package persistedsqlstats
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+
+	"github.com/cockroachdb/cockroach/pkg/settings"
+	"github.com/cockroachdb/cockroach/pkg/sql/appstatspb"
+	"github.com/cockroachdb/cockroach/pkg/sql/sem/catconstants"
+)
+
+// hashedAppNamePrefix is the prefix of the hashed application names
+// persisted when sql.stats.flush.hash_app_names is set.
+const hashedAppNamePrefix = "hashed:"
+
+// maxHashedAppNames bounds the number of hashed application names that a
+// process can map back to their names, see LookupHashedAppName. The names
+// hashed once the bound is reached are still hashed, but cannot be looked up.
+const maxHashedAppNames = 10000
+
+// clusterSecretSettingName is the name of the cluster.secret setting, which
+// keys the hash of the application names. The setting is registered by the
+// sql package, which cannot be imported from here.
+const clusterSecretSettingName = "cluster.secret"
+
+// getClusterSecret returns the value of the cluster.secret setting, or an
+// empty string if the setting is not registered.
+func getClusterSecret(sv *settings.Values) string {
+	setting, ok := settings.LookupForLocalAccess(clusterSecretSettingName, true /* forSystemTenant */)
+	if !ok {
+		return ""
+	}
+	secret, ok := setting.(*settings.StringSetting)
+	if !ok {
+		return ""
+	}
+	return secret.Get(sv)
+}
+
+// hashAppName returns the hash under which the statistics of the given
+// application are persisted when sql.stats.flush.hash_app_names is set. The
+// hash is an HMAC-SHA256 of the name keyed by the cluster.secret setting, so
+// that it cannot be reversed by hashing candidate names without the secret,
+// while all the nodes persist the statistics of an application under the
+// same name. The hashes change if cluster.secret changes.
+func hashAppName(sv *settings.Values, appName string) string {
+	mac := hmac.New(sha256.New, []byte(getClusterSecret(sv)))
+	// Write never returns an error.
+	_, _ = mac.Write([]byte(appName))
+	return hashedAppNamePrefix + hex.EncodeToString(mac.Sum(nil))
+}
+
+// persistedAppNames returns the names under which the statistics of the given
+// applications may be persisted: the names themselves and their hashes, see
+// sql.stats.flush.hash_app_names. Both are returned regardless of the
+// setting, since the stats tables may hold rows flushed before it changed.
+func persistedAppNames(sv *settings.Values, appNames []string) []string {
+	names := make([]string, 0, 2*len(appNames))
+	for _, appName := range appNames {
+		names = append(names, appName, hashAppName(sv, appName))
+	}
+	return names
+}
+
+// maybeHashAppName returns the name under which the statistics of the given
+// application are persisted: its hash if sql.stats.flush.hash_app_names is
+// set, and the name itself otherwise. Internal application names are never
+// hashed. The mapping from the hash to the name is only kept in the memory of
+// this process, see LookupHashedAppName.
+func (s *PersistedSQLStats) maybeHashAppName(appName string) string {
+	if !SQLStatsFlushHashAppNames.Get(&s.cfg.Settings.SV) ||
+		strings.HasPrefix(appName, catconstants.InternalAppNamePrefix) {
+		return appName
+	}
+	hashed := hashAppName(&s.cfg.Settings.SV, appName)
+	s.hashedAppNames.Lock()
+	defer s.hashedAppNames.Unlock()
+	if s.hashedAppNames.m == nil {
+		s.hashedAppNames.m = make(map[string]string)
+	}
+	if _, ok := s.hashedAppNames.m[hashed]; ok || len(s.hashedAppNames.m) < maxHashedAppNames {
+		s.hashedAppNames.m[hashed] = appName
+	}
+	return hashed
+}
+
+// LookupHashedAppName returns the application name that this process
+// persisted under the given hash, see sql.stats.flush.hash_app_names. ok is
+// false if the name is unknown, e.g. because it was hashed by another node,
+// before this process started, or after maxHashedAppNames names were hashed.
+func (s *PersistedSQLStats) LookupHashedAppName(hashed string) (appName string, ok bool) {
+	s.hashedAppNames.Lock()
+	defer s.hashedAppNames.Unlock()
+	appName, ok = s.hashedAppNames.m[hashed]
+	return appName, ok
+}
+
+// stmtStatsToPersist returns the statement statistics to persist, i.e. a copy
+// of the given ones with the application name hashed if needed.
+func (s *PersistedSQLStats) stmtStatsToPersist(
+	stats *appstatspb.CollectedStatementStatistics,
+) *appstatspb.CollectedStatementStatistics {
+	appName := s.maybeHashAppName(stats.Key.App)
+	if appName == stats.Key.App {
+		return stats
+	}
+	hashedStats := *stats
+	hashedStats.Key.App = appName
+	return &hashedStats
+}
+
+// txnStatsToPersist is the transaction counterpart of stmtStatsToPersist.
+func (s *PersistedSQLStats) txnStatsToPersist(
+	stats *appstatspb.CollectedTransactionStatistics,
+) *appstatspb.CollectedTransactionStatistics {
+	appName := s.maybeHashAppName(stats.App)
+	if appName == stats.App {
+		return stats
+	}
+	hashedStats := *stats
+	hashedStats.App = appName
+	return &hashedStats
+}
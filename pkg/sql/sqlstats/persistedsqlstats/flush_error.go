@@ -0,0 +1,88 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package persistedsqlstats
+
+import (
+	"context"
+	"strings"
+
+	"github.com/cockroachdb/cockroach/pkg/kv/kvpb"
+	"github.com/cockroachdb/cockroach/pkg/sql/pgwire/pgcode"
+	"github.com/cockroachdb/cockroach/pkg/sql/pgwire/pgerror"
+	"github.com/cockroachdb/cockroach/pkg/sql/sqlerrors"
+	"github.com/cockroachdb/errors"
+)
+
+// FlushErrorCategory classifies the errors encountered when flushing the
+// in-memory SQL stats, so that transient failures can be told apart from
+// structural ones.
+type FlushErrorCategory string
+
+// SafeValue implements the redact.SafeValue interface.
+func (FlushErrorCategory) SafeValue() {}
+
+const (
+	// FlushErrorUnclassified is the category of the errors that do not fall
+	// into any of the other categories.
+	FlushErrorUnclassified FlushErrorCategory = "unclassified"
+	// FlushErrorRetryableKV is the category of the transient KV errors, such
+	// as transaction retry errors and ambiguous results.
+	FlushErrorRetryableKV FlushErrorCategory = "retryable_kv"
+	// FlushErrorMemory is the category of the errors caused by exceeding a
+	// memory budget.
+	FlushErrorMemory FlushErrorCategory = "memory"
+	// FlushErrorContextCanceled is the category of the errors caused by the
+	// flush being canceled or timing out, e.g. when the node is draining.
+	FlushErrorContextCanceled FlushErrorCategory = "context_canceled"
+	// FlushErrorSchema is the category of the errors caused by an unexpected
+	// schema of the stats tables, such as a missing table or column.
+	FlushErrorSchema FlushErrorCategory = "schema"
+	// FlushErrorPermission is the category of the errors caused by missing
+	// privileges on the stats tables.
+	FlushErrorPermission FlushErrorCategory = "permission"
+)
+
+// FlushErrorCategories lists the categories that flush errors are classified
+// into, other than FlushErrorUnclassified.
+var FlushErrorCategories = []FlushErrorCategory{
+	FlushErrorRetryableKV,
+	FlushErrorMemory,
+	FlushErrorContextCanceled,
+	FlushErrorSchema,
+	FlushErrorPermission,
+}
+
+// ClassifyFlushError returns the category of an error encountered when
+// flushing the in-memory SQL stats, based on the causes of the error.
+func ClassifyFlushError(err error) FlushErrorCategory {
+	code := pgerror.GetPGCode(err)
+	switch {
+	case errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) ||
+		code == pgcode.QueryCanceled:
+		return FlushErrorContextCanceled
+	case errors.HasInterface(err, (*kvpb.ClientVisibleRetryError)(nil)) ||
+		errors.HasInterface(err, (*kvpb.ClientVisibleAmbiguousError)(nil)) ||
+		code == pgcode.SerializationFailure || pgerror.IsSQLRetryableError(err):
+		return FlushErrorRetryableKV
+	case sqlerrors.IsOutOfMemoryError(err):
+		return FlushErrorMemory
+	// The insufficient privileges also belong to class 42, and are checked
+	// first.
+	case code == pgcode.InsufficientPrivilege:
+		return FlushErrorPermission
+	// Class 42 - Syntax Error or Access Rule Violation, which includes the
+	// undefined tables and columns as well as the datatype mismatches.
+	case strings.HasPrefix(code.String(), "42"):
+		return FlushErrorSchema
+	default:
+		return FlushErrorUnclassified
+	}
+}
@@ -0,0 +1,153 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package persistedsqlstats
+
+import (
+	"context"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/appstatspb"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
+)
+
+// FlushSink receives the SQL stats written to the system tables by each
+// flush, e.g. to stream them to an external observability pipeline. The
+// system tables remain the authoritative store of the stats: the errors
+// returned by a sink are logged, and do not fail the flush. The sinks receive
+// the stats collected since the previous flush, which are not combined with
+// the stats of the same aggregation window that are already persisted.
+//
+// The sinks are called synchronously at the end of each flush, so they
+// should hand the stats off rather than block on external systems. They
+// must not modify the stats.
+type FlushSink interface {
+	// Name identifies the sink in the logs.
+	Name() string
+	// WriteStmtStats receives the statement statistics of the aggregation
+	// window starting at aggregatedTs that a flush wrote to
+	// system.statement_statistics.
+	WriteStmtStats(
+		ctx context.Context, aggregatedTs time.Time, stats []*appstatspb.CollectedStatementStatistics,
+	) error
+	// WriteTxnStats receives the transaction statistics of the aggregation
+	// window starting at aggregatedTs that a flush wrote to
+	// system.transaction_statistics.
+	WriteTxnStats(
+		ctx context.Context, aggregatedTs time.Time, stats []*appstatspb.CollectedTransactionStatistics,
+	) error
+}
+
+// NoopFlushSink is a FlushSink that discards the stats.
+type NoopFlushSink struct{}
+
+var _ FlushSink = NoopFlushSink{}
+
+// Name implements the FlushSink interface.
+func (NoopFlushSink) Name() string { return "noop" }
+
+// WriteStmtStats implements the FlushSink interface.
+func (NoopFlushSink) WriteStmtStats(
+	context.Context, time.Time, []*appstatspb.CollectedStatementStatistics,
+) error {
+	return nil
+}
+
+// WriteTxnStats implements the FlushSink interface.
+func (NoopFlushSink) WriteTxnStats(
+	context.Context, time.Time, []*appstatspb.CollectedTransactionStatistics,
+) error {
+	return nil
+}
+
+var flushSinks struct {
+	syncutil.Mutex
+	sinks  map[int]FlushSink
+	nextID int
+}
+
+// RegisterFlushSink registers a sink that receives the SQL stats written by
+// the flushes from then on, in addition to the system tables. The returned
+// function unregisters the sink.
+func RegisterFlushSink(sink FlushSink) (unregister func()) {
+	flushSinks.Lock()
+	defer flushSinks.Unlock()
+	if flushSinks.sinks == nil {
+		flushSinks.sinks = make(map[int]FlushSink)
+	}
+	id := flushSinks.nextID
+	flushSinks.nextID++
+	flushSinks.sinks[id] = sink
+	return func() {
+		flushSinks.Lock()
+		defer flushSinks.Unlock()
+		delete(flushSinks.sinks, id)
+	}
+}
+
+// getFlushSinks returns the registered sinks, in registration order.
+func getFlushSinks() []FlushSink {
+	flushSinks.Lock()
+	defer flushSinks.Unlock()
+	sinks := make([]FlushSink, 0, len(flushSinks.sinks))
+	for id := 0; id < flushSinks.nextID; id++ {
+		if sink, ok := flushSinks.sinks[id]; ok {
+			sinks = append(sinks, sink)
+		}
+	}
+	return sinks
+}
+
+// flushSinkBatch collects the stats written by a flush, which are passed to
+// the registered sinks once the flush completes. The statement and
+// transaction stats are collected by different goroutines. A nil batch
+// collects nothing, so that no stats are retained when no sink is
+// registered.
+type flushSinkBatch struct {
+	stmts []*appstatspb.CollectedStatementStatistics
+	txns  []*appstatspb.CollectedTransactionStatistics
+}
+
+func (b *flushSinkBatch) addStmtStats(stats ...*appstatspb.CollectedStatementStatistics) {
+	if b != nil {
+		b.stmts = append(b.stmts, stats...)
+	}
+}
+
+func (b *flushSinkBatch) addTxnStats(stats ...*appstatspb.CollectedTransactionStatistics) {
+	if b != nil {
+		b.txns = append(b.txns, stats...)
+	}
+}
+
+// writeToFlushSinks passes the stats collected in the batch to the given
+// sinks. The errors of the sinks are logged.
+func writeToFlushSinks(
+	ctx context.Context, sinks []FlushSink, aggregatedTs time.Time, batch *flushSinkBatch,
+) {
+	if batch == nil {
+		return
+	}
+	for _, sink := range sinks {
+		if len(batch.stmts) > 0 {
+			if err := sink.WriteStmtStats(ctx, aggregatedTs, batch.stmts); err != nil {
+				log.Warningf(ctx, "failed to write statement statistics to SQL stats sink %s: %v",
+					sink.Name(), err)
+			}
+		}
+		if len(batch.txns) > 0 {
+			if err := sink.WriteTxnStats(ctx, aggregatedTs, batch.txns); err != nil {
+				log.Warningf(ctx, "failed to write transaction statistics to SQL stats sink %s: %v",
+					sink.Name(), err)
+			}
+		}
+	}
+}
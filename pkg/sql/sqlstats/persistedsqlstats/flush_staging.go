@@ -0,0 +1,563 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package persistedsqlstats
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/appstatspb"
+	"github.com/cockroachdb/cockroach/pkg/sql/isql"
+	"github.com/cockroachdb/cockroach/pkg/sql/sem/tree"
+	"github.com/cockroachdb/cockroach/pkg/sql/sessiondata"
+	"github.com/cockroachdb/cockroach/pkg/sql/sqlstats"
+	"github.com/cockroachdb/cockroach/pkg/sql/sqlstats/persistedsqlstats/sqlstatsutil"
+	"github.com/cockroachdb/errors"
+)
+
+// stagingBatchSize is the number of rows written by each statement of the
+// merge of the staged stats.
+const stagingBatchSize = 100
+
+// stmtRowKey identifies the row of system.statement_statistics of a
+// fingerprint within the aggregation window and the node of the flush.
+type stmtRowKey struct {
+	fingerprintID, transactionFingerprintID, planHash, app string
+}
+
+func makeStmtRowKey(stats *appstatspb.CollectedStatementStatistics) stmtRowKey {
+	return stmtRowKey{
+		fingerprintID:            string(sqlstatsutil.EncodeUint64ToBytes(uint64(stats.ID))),
+		transactionFingerprintID: string(sqlstatsutil.EncodeUint64ToBytes(uint64(stats.Key.TransactionFingerprintID))),
+		planHash:                 string(sqlstatsutil.EncodeUint64ToBytes(stats.Key.PlanHash)),
+		app:                      stats.Key.App,
+	}
+}
+
+// txnRowKey identifies the row of system.transaction_statistics of a
+// fingerprint within the aggregation window and the node of the flush.
+type txnRowKey struct {
+	fingerprintID, app string
+}
+
+func makeTxnRowKey(stats *appstatspb.CollectedTransactionStatistics) txnRowKey {
+	return txnRowKey{
+		fingerprintID: string(sqlstatsutil.EncodeUint64ToBytes(uint64(stats.TransactionFingerprintID))),
+		app:           stats.App,
+	}
+}
+
+// sumFingerprints returns the number of in-memory fingerprints combined into
+// the given staged rows.
+func sumFingerprints(fingerprints []int64) (sum int64) {
+	for _, n := range fingerprints {
+		sum += n
+	}
+	return sum
+}
+
+// flushStmtStatsStaged is the staged counterpart of flushStmtStats, used when
+// sql.stats.flush.staging.enabled is set. The in-memory stats are first
+// staged, combining the fingerprints that map to the same row, and are then
+// merged into system.statement_statistics in batches, see
+// mergeStagedStmtStats. This replaces the transaction per fingerprint, and its
+// round trips, with a transaction of a few statements per batch. Each batch
+// commits on its own, so that the locks taken by the merge are only held for
+// the duration of a batch. An error discards the stats of the batch that
+// failed and of the following ones; the stats of the batches that were
+// already merged are kept and added to sinkBatch.
+func (s *PersistedSQLStats) flushStmtStatsStaged(
+	ctx context.Context, aggregatedTs time.Time, aggInterval time.Duration, sinkBatch *flushSinkBatch,
+) (written int64) {
+	var staged []*appstatspb.CollectedStatementStatistics
+	// fingerprints[i] is the number of in-memory fingerprints combined into
+	// staged[i].
+	var fingerprints []int64
+	stagedByKey := make(map[stmtRowKey]int)
+	_ = s.SQLStats.IterateStatementStats(ctx, &sqlstats.IteratorOptions{},
+		func(ctx context.Context, statistics *appstatspb.CollectedStatementStatistics) error {
+			if !s.stmtSampler.shouldRecord(
+				s.cfg.Settings, aggregatedTs, statistics.Key.App, uint64(statistics.ID),
+			) {
+				s.cfg.SampledOutCounter.Inc(1)
+				return nil
+			}
+			statistics = s.stmtStatsToPersist(statistics)
+			key := makeStmtRowKey(statistics)
+			if i, ok := stagedByKey[key]; ok {
+				staged[i].Stats.Add(&statistics.Stats)
+				fingerprints[i]++
+				return nil
+			}
+			stagedStats := *statistics
+			stagedByKey[key] = len(staged)
+			staged = append(staged, &stagedStats)
+			fingerprints = append(fingerprints, 1)
+			return nil
+		})
+
+	if len(staged) > 0 {
+		var merged int
+		_ = s.doFlush(ctx, func() (err error) {
+			merged, err = s.mergeStagedStmtStats(ctx, staged, aggregatedTs, aggInterval)
+			return err
+		}, "failed to flush staged statement statistics" /* errMsg */)
+		written = sumFingerprints(fingerprints[:merged])
+		sinkBatch.addStmtStats(staged[:merged]...)
+	}
+
+	if s.cfg.Knobs != nil && s.cfg.Knobs.OnStmtStatsFlushFinished != nil {
+		s.cfg.Knobs.OnStmtStatsFlushFinished()
+	}
+	return written
+}
+
+// flushTxnStatsStaged is the staged counterpart of flushTxnStats, see
+// flushStmtStatsStaged.
+func (s *PersistedSQLStats) flushTxnStatsStaged(
+	ctx context.Context, aggregatedTs time.Time, aggInterval time.Duration, sinkBatch *flushSinkBatch,
+) (written int64) {
+	var staged []*appstatspb.CollectedTransactionStatistics
+	var fingerprints []int64
+	stagedByKey := make(map[txnRowKey]int)
+	_ = s.SQLStats.IterateTransactionStats(ctx, &sqlstats.IteratorOptions{},
+		func(ctx context.Context, statistics *appstatspb.CollectedTransactionStatistics) error {
+			if !s.txnSampler.shouldRecord(
+				s.cfg.Settings, aggregatedTs, statistics.App, uint64(statistics.TransactionFingerprintID),
+			) {
+				s.cfg.SampledOutCounter.Inc(1)
+				return nil
+			}
+			statistics = s.txnStatsToPersist(statistics)
+			key := makeTxnRowKey(statistics)
+			if i, ok := stagedByKey[key]; ok {
+				staged[i].Stats.Add(&statistics.Stats)
+				fingerprints[i]++
+				return nil
+			}
+			stagedStats := *statistics
+			stagedByKey[key] = len(staged)
+			staged = append(staged, &stagedStats)
+			fingerprints = append(fingerprints, 1)
+			return nil
+		})
+
+	if len(staged) > 0 {
+		var merged int
+		_ = s.doFlush(ctx, func() (err error) {
+			merged, err = s.mergeStagedTxnStats(ctx, staged, aggregatedTs, aggInterval)
+			return err
+		}, "failed to flush staged transaction statistics" /* errMsg */)
+		written = sumFingerprints(fingerprints[:merged])
+		sinkBatch.addTxnStats(staged[:merged]...)
+	}
+
+	if s.cfg.Knobs != nil && s.cfg.Knobs.OnTxnStatsFlushFinished != nil {
+		s.cfg.Knobs.OnTxnStatsFlushFinished()
+	}
+	return written
+}
+
+// mergeStagedStmtStats merges the staged stats into
+// system.statement_statistics, in a transaction per batch of stagingBatchSize
+// rows. In each batch, the rows that do not exist yet are inserted by a single
+// statement. The statistics of the rows that already exist are then read by a
+// single statement, combined with the staged ones, and written back by a
+// single statement. It returns the number of staged rows that were merged
+// before an error, if any.
+func (s *PersistedSQLStats) mergeStagedStmtStats(
+	ctx context.Context,
+	staged []*appstatspb.CollectedStatementStatistics,
+	aggregatedTs time.Time,
+	aggInterval time.Duration,
+) (merged int, _ error) {
+	for merged < len(staged) {
+		end := merged + stagingBatchSize
+		if end > len(staged) {
+			end = len(staged)
+		}
+		attempts := 0
+		if err := s.cfg.DB.Txn(ctx, func(ctx context.Context, txn isql.Txn) error {
+			attempts++
+			s.countFlushTxnRetry(attempts)
+			return s.mergeStmtStatsBatch(ctx, txn, staged[merged:end], aggregatedTs, aggInterval)
+		}); err != nil {
+			return merged, errors.Wrap(err, "merging staged statement statistics")
+		}
+		merged = end
+	}
+	return merged, nil
+}
+
+func (s *PersistedSQLStats) mergeStmtStatsBatch(
+	ctx context.Context,
+	txn isql.Txn,
+	batch []*appstatspb.CollectedStatementStatistics,
+	aggregatedTs time.Time,
+	aggInterval time.Duration,
+) error {
+	withLastExecutionTs := s.hasLastExecutionTs(ctx)
+	var values strings.Builder
+	args := make([]interface{}, 0, len(batch)*12)
+	for _, stats := range batch {
+		key := makeStmtRowKey(stats)
+		rowArgs, err := s.buildStmtStatsRow(
+			aggregatedTs,
+			aggInterval,
+			[]byte(key.fingerprintID),
+			[]byte(key.transactionFingerprintID),
+			[]byte(key.planHash),
+			stats,
+			withLastExecutionTs,
+		)
+		if err != nil {
+			return err
+		}
+		appendValuesRow(&values, len(args)+1, make([]string, len(rowArgs)))
+		args = append(args, rowArgs...)
+	}
+	inserted, err := txn.QueryBufferedEx(
+		ctx,
+		"insert-staged-stmt-stats",
+		txn.KV(),
+		sessiondata.NodeUserSessionDataOverride,
+		fmt.Sprintf(`
+INSERT INTO system.statement_statistics (%s)
+VALUES %s
+ON CONFLICT (crdb_internal_aggregated_ts_app_name_fingerprint_id_node_id_plan_hash_transaction_fingerprint_id_shard_8,
+             aggregated_ts, fingerprint_id, transaction_fingerprint_id, app_name, plan_hash, node_id)
+DO NOTHING
+RETURNING fingerprint_id, transaction_fingerprint_id, plan_hash, app_name
+`, stmtStatsRowColumns(withLastExecutionTs), values.String()),
+		args...,
+	)
+	if err != nil {
+		return err
+	}
+	if len(inserted) == len(batch) {
+		return nil
+	}
+
+	// Read the statistics of the rows that already existed.
+	insertedKeys := make(map[stmtRowKey]struct{}, len(inserted))
+	for _, row := range inserted {
+		insertedKeys[stmtRowKey{
+			fingerprintID:            string(tree.MustBeDBytes(row[0])),
+			transactionFingerprintID: string(tree.MustBeDBytes(row[1])),
+			planHash:                 string(tree.MustBeDBytes(row[2])),
+			app:                      string(tree.MustBeDString(row[3])),
+		}] = struct{}{}
+	}
+	existing := make(map[stmtRowKey]*appstatspb.CollectedStatementStatistics, len(batch)-len(inserted))
+	values.Reset()
+	nodeID := s.GetEnabledSQLInstanceID()
+	args = append(args[:0], aggregatedTs, nodeID)
+	for _, stats := range batch {
+		key := makeStmtRowKey(stats)
+		if _, ok := insertedKeys[key]; ok {
+			continue
+		}
+		// Copy the stats so that the transaction remains retryable.
+		scopedStats := *stats
+		existing[key] = &scopedStats
+		appendValuesRow(&values, len(args)+1, []string{"BYTES", "BYTES", "BYTES", "STRING"})
+		args = append(args,
+			[]byte(key.fingerprintID), []byte(key.transactionFingerprintID), []byte(key.planHash), key.app)
+	}
+	persisted, err := txn.QueryBufferedEx(
+		ctx,
+		"fetch-staged-stmt-stats",
+		txn.KV(),
+		sessiondata.NodeUserSessionDataOverride,
+		fmt.Sprintf(`
+SELECT fingerprint_id, transaction_fingerprint_id, plan_hash, app_name, statistics
+FROM system.statement_statistics
+WHERE aggregated_ts = $1
+  AND node_id = $2
+  AND (fingerprint_id, transaction_fingerprint_id, plan_hash, app_name) IN (%s)
+FOR UPDATE
+`, values.String()),
+		args...,
+	)
+	if err != nil {
+		return err
+	}
+	if len(persisted) != len(existing) {
+		return errors.AssertionFailedf("expected %d existing statement statistics rows, found %d",
+			len(existing), len(persisted))
+	}
+
+	// Write back the combined statistics.
+	values.Reset()
+	args = append(args[:0], aggregatedTs, nodeID)
+	for _, row := range persisted {
+		key := stmtRowKey{
+			fingerprintID:            string(tree.MustBeDBytes(row[0])),
+			transactionFingerprintID: string(tree.MustBeDBytes(row[1])),
+			planHash:                 string(tree.MustBeDBytes(row[2])),
+			app:                      string(tree.MustBeDString(row[3])),
+		}
+		stats, ok := existing[key]
+		if !ok {
+			return errors.AssertionFailedf("unexpected statement statistics row for fingerprint_id: %x",
+				key.fingerprintID)
+		}
+		var persistedData appstatspb.StatementStatistics
+		if err := sqlstatsutil.DecodeStmtStatsStatisticsJSON(
+			tree.MustBeDJSON(row[4]).JSON, &persistedData,
+		); err != nil {
+			return err
+		}
+		stats.Stats.Add(&persistedData)
+
+		statisticsJSON, err := sqlstatsutil.BuildStmtStatisticsJSON(&stats.Stats)
+		if err != nil {
+			return err
+		}
+		indexRecommendations, err := buildIndexRecommendations(stats)
+		if err != nil {
+			return err
+		}
+		appendValuesRow(&values, len(args)+1,
+			[]string{"BYTES", "BYTES", "BYTES", "STRING", "JSONB", "STRING[]", "TIMESTAMPTZ"})
+		args = append(args,
+			[]byte(key.fingerprintID), []byte(key.transactionFingerprintID), []byte(key.planHash), key.app,
+			tree.NewDJSON(statisticsJSON), indexRecommendations, stmtLastExecutionTs(stats))
+	}
+	// The last execution is only written once the column exists, see
+	// hasLastExecutionTs.
+	setLastExecutionTs := ""
+	if withLastExecutionTs {
+		setLastExecutionTs = ", last_execution_ts = greatest(s.last_execution_ts, v.last_execution_ts)"
+	}
+	rowsAffected, err := txn.ExecEx(
+		ctx,
+		"update-staged-stmt-stats",
+		txn.KV(),
+		sessiondata.NodeUserSessionDataOverride,
+		fmt.Sprintf(`
+UPDATE system.statement_statistics AS s
+SET statistics = v.statistics, index_recommendations = v.index_recommendations%s
+FROM (VALUES %s) AS v (fingerprint_id, transaction_fingerprint_id, plan_hash, app_name, statistics, index_recommendations, last_execution_ts)
+WHERE s.aggregated_ts = $1
+  AND s.node_id = $2
+  AND s.fingerprint_id = v.fingerprint_id
+  AND s.transaction_fingerprint_id = v.transaction_fingerprint_id
+  AND s.plan_hash = v.plan_hash
+  AND s.app_name = v.app_name
+`, setLastExecutionTs, values.String()),
+		args...,
+	)
+	if err != nil {
+		return err
+	}
+	if rowsAffected != len(existing) {
+		return errors.AssertionFailedf("expected to update %d statement statistics rows, updated %d",
+			len(existing), rowsAffected)
+	}
+	return nil
+}
+
+// mergeStagedTxnStats merges the staged stats into
+// system.transaction_statistics, in a transaction per batch, see
+// mergeStagedStmtStats.
+func (s *PersistedSQLStats) mergeStagedTxnStats(
+	ctx context.Context,
+	staged []*appstatspb.CollectedTransactionStatistics,
+	aggregatedTs time.Time,
+	aggInterval time.Duration,
+) (merged int, _ error) {
+	for merged < len(staged) {
+		end := merged + stagingBatchSize
+		if end > len(staged) {
+			end = len(staged)
+		}
+		attempts := 0
+		if err := s.cfg.DB.Txn(ctx, func(ctx context.Context, txn isql.Txn) error {
+			attempts++
+			s.countFlushTxnRetry(attempts)
+			return s.mergeTxnStatsBatch(ctx, txn, staged[merged:end], aggregatedTs, aggInterval)
+		}); err != nil {
+			return merged, errors.Wrap(err, "merging staged transaction statistics")
+		}
+		merged = end
+	}
+	return merged, nil
+}
+
+func (s *PersistedSQLStats) mergeTxnStatsBatch(
+	ctx context.Context,
+	txn isql.Txn,
+	batch []*appstatspb.CollectedTransactionStatistics,
+	aggregatedTs time.Time,
+	aggInterval time.Duration,
+) error {
+	withLastExecutionTs := s.hasLastExecutionTs(ctx)
+	var values strings.Builder
+	args := make([]interface{}, 0, len(batch)*8)
+	for _, stats := range batch {
+		key := makeTxnRowKey(stats)
+		rowArgs, err := s.buildTxnStatsRow(
+			aggregatedTs, aggInterval, []byte(key.fingerprintID), stats, withLastExecutionTs,
+		)
+		if err != nil {
+			return err
+		}
+		appendValuesRow(&values, len(args)+1, make([]string, len(rowArgs)))
+		args = append(args, rowArgs...)
+	}
+	inserted, err := txn.QueryBufferedEx(
+		ctx,
+		"insert-staged-txn-stats",
+		txn.KV(),
+		sessiondata.NodeUserSessionDataOverride,
+		fmt.Sprintf(`
+INSERT INTO system.transaction_statistics (%s)
+VALUES %s
+ON CONFLICT (crdb_internal_aggregated_ts_app_name_fingerprint_id_node_id_shard_8, aggregated_ts, fingerprint_id, app_name, node_id)
+DO NOTHING
+RETURNING fingerprint_id, app_name
+`, txnStatsRowColumns(withLastExecutionTs), values.String()),
+		args...,
+	)
+	if err != nil {
+		return err
+	}
+	if len(inserted) == len(batch) {
+		return nil
+	}
+
+	// Read the statistics of the rows that already existed.
+	insertedKeys := make(map[txnRowKey]struct{}, len(inserted))
+	for _, row := range inserted {
+		insertedKeys[txnRowKey{
+			fingerprintID: string(tree.MustBeDBytes(row[0])),
+			app:           string(tree.MustBeDString(row[1])),
+		}] = struct{}{}
+	}
+	existing := make(map[txnRowKey]*appstatspb.CollectedTransactionStatistics, len(batch)-len(inserted))
+	values.Reset()
+	nodeID := s.GetEnabledSQLInstanceID()
+	args = append(args[:0], aggregatedTs, nodeID)
+	for _, stats := range batch {
+		key := makeTxnRowKey(stats)
+		if _, ok := insertedKeys[key]; ok {
+			continue
+		}
+		// Copy the stats so that the transaction remains retryable.
+		scopedStats := *stats
+		existing[key] = &scopedStats
+		appendValuesRow(&values, len(args)+1, []string{"BYTES", "STRING"})
+		args = append(args, []byte(key.fingerprintID), key.app)
+	}
+	persisted, err := txn.QueryBufferedEx(
+		ctx,
+		"fetch-staged-txn-stats",
+		txn.KV(),
+		sessiondata.NodeUserSessionDataOverride,
+		fmt.Sprintf(`
+SELECT fingerprint_id, app_name, statistics
+FROM system.transaction_statistics
+WHERE aggregated_ts = $1
+  AND node_id = $2
+  AND (fingerprint_id, app_name) IN (%s)
+FOR UPDATE
+`, values.String()),
+		args...,
+	)
+	if err != nil {
+		return err
+	}
+	if len(persisted) != len(existing) {
+		return errors.AssertionFailedf("expected %d existing transaction statistics rows, found %d",
+			len(existing), len(persisted))
+	}
+
+	// Write back the combined statistics.
+	values.Reset()
+	args = append(args[:0], aggregatedTs, nodeID)
+	setLastExecutionTs := ""
+	if withLastExecutionTs {
+		args = append(args, s.txnLastExecutionTs())
+		setLastExecutionTs = ", last_execution_ts = greatest(s.last_execution_ts, $3::TIMESTAMPTZ)"
+	}
+	for _, row := range persisted {
+		key := txnRowKey{
+			fingerprintID: string(tree.MustBeDBytes(row[0])),
+			app:           string(tree.MustBeDString(row[1])),
+		}
+		stats, ok := existing[key]
+		if !ok {
+			return errors.AssertionFailedf("unexpected transaction statistics row for fingerprint_id: %x",
+				key.fingerprintID)
+		}
+		var persistedData appstatspb.TransactionStatistics
+		if err := sqlstatsutil.DecodeTxnStatsStatisticsJSON(
+			tree.MustBeDJSON(row[2]).JSON, &persistedData,
+		); err != nil {
+			return err
+		}
+		stats.Stats.Add(&persistedData)
+
+		statisticsJSON, err := sqlstatsutil.BuildTxnStatisticsJSON(stats)
+		if err != nil {
+			return err
+		}
+		appendValuesRow(&values, len(args)+1, []string{"BYTES", "STRING", "JSONB"})
+		args = append(args, []byte(key.fingerprintID), key.app, tree.NewDJSON(statisticsJSON))
+	}
+	rowsAffected, err := txn.ExecEx(
+		ctx,
+		"update-staged-txn-stats",
+		txn.KV(),
+		sessiondata.NodeUserSessionDataOverride,
+		fmt.Sprintf(`
+UPDATE system.transaction_statistics AS s
+SET statistics = v.statistics%s
+FROM (VALUES %s) AS v (fingerprint_id, app_name, statistics)
+WHERE s.aggregated_ts = $1
+  AND s.node_id = $2
+  AND s.fingerprint_id = v.fingerprint_id
+  AND s.app_name = v.app_name
+`, setLastExecutionTs, values.String()),
+		args...,
+	)
+	if err != nil {
+		return err
+	}
+	if rowsAffected != len(existing) {
+		return errors.AssertionFailedf("expected to update %d transaction statistics rows, updated %d",
+			len(existing), rowsAffected)
+	}
+	return nil
+}
+
+// appendValuesRow appends to b a parenthesized row of placeholders, numbered
+// from first, with one placeholder per type annotation. The placeholders with
+// an empty type annotation are left untyped.
+func appendValuesRow(b *strings.Builder, first int, typeAnnotations []string) {
+	if b.Len() > 0 {
+		b.WriteString(", ")
+	}
+	b.WriteString("(")
+	for i, typ := range typeAnnotations {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		fmt.Fprintf(b, "$%d", first+i)
+		if typ != "" {
+			fmt.Fprintf(b, "::%s", typ)
+		}
+	}
+	b.WriteString(")")
+}
@@ -12,28 +12,42 @@ package persistedsqlstats_test
 
 import (
 	"context"
+	"crypto/hmac"
+	"crypto/sha256"
 	gosql "database/sql"
+	"encoding/hex"
 	"fmt"
+	"math"
 	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/cockroachdb/cockroach/pkg/base"
 	"github.com/cockroachdb/cockroach/pkg/roachpb"
 	"github.com/cockroachdb/cockroach/pkg/security/username"
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
 	"github.com/cockroachdb/cockroach/pkg/sql"
 	"github.com/cockroachdb/cockroach/pkg/sql/appstatspb"
+	"github.com/cockroachdb/cockroach/pkg/sql/pgwire/pgcode"
+	"github.com/cockroachdb/cockroach/pkg/sql/pgwire/pgerror"
 	"github.com/cockroachdb/cockroach/pkg/sql/sqlstats"
 	"github.com/cockroachdb/cockroach/pkg/sql/sqlstats/persistedsqlstats"
 	"github.com/cockroachdb/cockroach/pkg/sql/tests"
+	"github.com/cockroachdb/cockroach/pkg/testutils"
 	"github.com/cockroachdb/cockroach/pkg/testutils/serverutils"
 	"github.com/cockroachdb/cockroach/pkg/testutils/skip"
 	"github.com/cockroachdb/cockroach/pkg/testutils/sqlutils"
 	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
 	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/cockroachdb/cockroach/pkg/util/log/logpb"
 	"github.com/cockroachdb/cockroach/pkg/util/stop"
 	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
 	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
+	"github.com/cockroachdb/errors"
 	"github.com/stretchr/testify/require"
 )
 
@@ -428,6 +442,726 @@ func TestInMemoryStatsDiscard(t *testing.T) {
 	})
 }
 
+func TestInMemoryStatsDiscardWithoutServer(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	ctx := context.Background()
+	st := cluster.MakeTestingClusterSettings()
+	persistedsqlstats.SQLStatsFlushEnabled.Override(ctx, &st.SV, false)
+
+	// The flush never reaches the system tables when it is disabled, so no
+	// database is needed.
+	sqlStats := persistedsqlstats.NewForTesting(st, nil /* db */, nil /* knobs */)
+	appStats := sqlStats.GetApplicationStats("flush_disabled_test", false /* internal */)
+	key := appstatspb.StatementStatisticsKey{Query: "SELECT _", App: "flush_disabled_test"}
+	for _, stmt := range []sqlstats.RecordedStmtStats{
+		{RowsAffected: 2, ServiceLatency: 1},
+		{RowsAffected: 4, ServiceLatency: 3},
+	} {
+		_, err := appStats.RecordStatement(ctx, key, stmt)
+		require.NoError(t, err)
+	}
+	require.Equal(t, int64(1), sqlStats.GetTotalFingerprintCount())
+
+	// checkInMemoryStats checks the in-memory stats of the two executions of
+	// the statement above.
+	checkInMemoryStats := func() {
+		t.Helper()
+		var stats []appstatspb.CollectedStatementStatistics
+		require.NoError(t, sqlStats.SQLStats.IterateStatementStats(ctx, &sqlstats.IteratorOptions{},
+			func(ctx context.Context, s *appstatspb.CollectedStatementStatistics) error {
+				stats = append(stats, *s)
+				return nil
+			}))
+		require.Len(t, stats, 1)
+		require.Equal(t, "SELECT _", stats[0].Key.Query)
+		require.Equal(t, "flush_disabled_test", stats[0].Key.App)
+		require.Equal(t, int64(2), stats[0].Stats.Count)
+		require.Equal(t, float64(3), stats[0].Stats.NumRows.Mean)
+		require.Equal(t, float64(2), stats[0].Stats.ServiceLat.Mean)
+	}
+	checkInMemoryStats()
+
+	// The in-memory stats are kept if they cannot be discarded.
+	persistedsqlstats.DiscardInMemoryStatsWhenFlushDisabled.Override(ctx, &st.SV, false)
+	sqlStats.Flush(ctx)
+	require.Equal(t, int64(1), sqlStats.GetTotalFingerprintCount())
+	checkInMemoryStats()
+
+	persistedsqlstats.DiscardInMemoryStatsWhenFlushDisabled.Override(ctx, &st.SV, true)
+	sqlStats.Flush(ctx)
+	require.Zero(t, sqlStats.GetTotalFingerprintCount())
+	require.NoError(t, sqlStats.SQLStats.IterateStatementStats(ctx, &sqlstats.IteratorOptions{},
+		func(ctx context.Context, s *appstatspb.CollectedStatementStatistics) error {
+			return errors.Newf("unexpected statement stats after the discard: %s", s.Key.Query)
+		}))
+}
+
+func TestSQLStatsFlushDisabledOnNode(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	ctx := context.Background()
+	st := cluster.MakeTestingClusterSettings()
+	persistedsqlstats.SQLStatsFlushEnabled.Override(ctx, &st.SV, true)
+
+	// The flush never reaches the system tables when it is disabled on the
+	// node, so no database is needed.
+	sqlStats := persistedsqlstats.NewForTesting(st, nil /* db */, &sqlstats.TestingKnobs{
+		DisableFlushOnNode: true,
+	})
+	appStats := sqlStats.GetApplicationStats("flush_disabled_on_node_test", false /* internal */)
+	_, err := appStats.RecordStatement(
+		ctx,
+		appstatspb.StatementStatisticsKey{Query: "SELECT _", App: "flush_disabled_on_node_test"},
+		sqlstats.RecordedStmtStats{},
+	)
+	require.NoError(t, err)
+
+	// The in-memory stats are still served.
+	report := sqlStats.FlushWithReport(ctx)
+	require.Zero(t, report.Written)
+	require.Equal(t, int64(1), sqlStats.GetTotalFingerprintCount())
+
+	// As when the flush is disabled cluster-wide, the in-memory stats are
+	// discarded if sql.stats.flush.force_cleanup.enabled is set.
+	persistedsqlstats.DiscardInMemoryStatsWhenFlushDisabled.Override(ctx, &st.SV, true)
+	sqlStats.Flush(ctx)
+	require.Zero(t, sqlStats.GetTotalFingerprintCount())
+}
+
+func TestSQLStatsFlushHighWaterMarkCheck(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	sc := log.ScopeWithoutShowLogs(t)
+	defer sc.Close(t)
+
+	ctx := context.Background()
+	var db *gosql.DB
+	var dropFlushedRows int32
+	s, conn, _ := serverutils.StartServer(t, base.TestServerArgs{
+		Knobs: base.TestingKnobs{
+			SQLStatsKnobs: &sqlstats.TestingKnobs{
+				CheckFlushHighWaterMarks: true,
+				// Simulate a flush that counts the statement fingerprints as
+				// written without persisting them.
+				OnStmtStatsFlushFinished: func() {
+					if atomic.LoadInt32(&dropFlushedRows) == 0 {
+						return
+					}
+					if _, err := db.Exec("DELETE FROM system.statement_statistics WHERE true"); err != nil {
+						t.Errorf("unexpected error: %v", err)
+					}
+				},
+			},
+		},
+	})
+	defer s.Stopper().Stop(ctx)
+	db = conn
+
+	sqlConn := sqlutils.MakeSQLRunner(conn)
+	sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.flush.interval = '24h'")
+	sqlStats := s.SQLServer().(*sql.Server).
+		GetSQLStatsProvider().(*persistedsqlstats.PersistedSQLStats)
+
+	violations := func() []logpb.Entry {
+		log.FlushFileSinks()
+		entries, err := log.FetchEntriesFromFiles(
+			0, /* startTimestamp */
+			math.MaxInt64,
+			100, /* maxEntries */
+			regexp.MustCompile(`SQL stats invariant violated`),
+			log.WithMarkedSensitiveData,
+		)
+		require.NoError(t, err)
+		return entries
+	}
+
+	sqlConn.Exec(t, "SELECT 1")
+	sqlStats.Flush(ctx)
+	require.Empty(t, violations())
+
+	atomic.StoreInt32(&dropFlushedRows, 1)
+	sqlConn.Exec(t, "SELECT 1")
+	sqlStats.Flush(ctx)
+	entries := violations()
+	require.Len(t, entries, 1)
+	require.Contains(t, entries[0].Message, "system.statement_statistics")
+}
+
+func TestClassifyFlushError(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+
+	for _, tc := range []struct {
+		err      error
+		expected persistedsqlstats.FlushErrorCategory
+	}{
+		{err: errors.Wrap(context.Canceled, "flushing"), expected: persistedsqlstats.FlushErrorContextCanceled},
+		{err: pgerror.New(pgcode.QueryCanceled, "query canceled"), expected: persistedsqlstats.FlushErrorContextCanceled},
+		{err: pgerror.New(pgcode.SerializationFailure, "restart transaction"), expected: persistedsqlstats.FlushErrorRetryableKV},
+		{err: pgerror.New(pgcode.OutOfMemory, "budget exceeded"), expected: persistedsqlstats.FlushErrorMemory},
+		{err: pgerror.New(pgcode.UndefinedTable, "relation does not exist"), expected: persistedsqlstats.FlushErrorSchema},
+		{err: pgerror.New(pgcode.UndefinedColumn, "column does not exist"), expected: persistedsqlstats.FlushErrorSchema},
+		{err: pgerror.New(pgcode.InsufficientPrivilege, "permission denied"), expected: persistedsqlstats.FlushErrorPermission},
+		{err: errors.New("boom"), expected: persistedsqlstats.FlushErrorUnclassified},
+	} {
+		t.Run(tc.err.Error(), func(t *testing.T) {
+			require.Equal(t, tc.expected, persistedsqlstats.ClassifyFlushError(tc.err))
+		})
+	}
+}
+
+func TestSQLStatsFlushDisabledSkips(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	ctx := context.Background()
+	s, conn, _ := serverutils.StartServer(t, base.TestServerArgs{})
+	defer s.Stopper().Stop(ctx)
+
+	sqlConn := sqlutils.MakeSQLRunner(conn)
+	sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.flush.interval = '24h'")
+	sqlstats.StmtStatsEnable.Override(ctx, &s.ClusterSettings().SV, false)
+
+	sqlServer := s.SQLServer().(*sql.Server)
+	skips := sqlServer.ServerMetrics.StatsMetrics.SQLStatsFlushDisabledSkips
+	flushes := sqlServer.ServerMetrics.StatsMetrics.SQLStatsFlushStarted
+	skipsBefore, flushesBefore := skips.Count(), flushes.Count()
+
+	sqlStats := sqlServer.GetSQLStatsProvider().(*persistedsqlstats.PersistedSQLStats)
+	sqlStats.Flush(ctx)
+	require.Equal(t, skipsBefore+1, skips.Count())
+	require.Equal(t, flushesBefore, flushes.Count())
+
+	sqlstats.StmtStatsEnable.Override(ctx, &s.ClusterSettings().SV, true)
+	sqlStats.Flush(ctx)
+	require.Equal(t, skipsBefore+1, skips.Count())
+}
+
+func TestSQLStatsFlushDisabledKeepsInMemoryStats(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	ctx := context.Background()
+	s, conn, _ := serverutils.StartServer(t, base.TestServerArgs{})
+	defer s.Stopper().Stop(ctx)
+
+	sqlConn := sqlutils.MakeSQLRunner(conn)
+	sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.flush.interval = '24h'")
+	sqlStats := s.SQLServer().(*sql.Server).
+		GetSQLStatsProvider().(*persistedsqlstats.PersistedSQLStats)
+
+	const appName = "flush_disabled_test"
+	sqlConn.Exec(t, "SET application_name = $1", appName)
+	sqlConn.Exec(t, "SELECT 1")
+	sqlConn.Exec(t, "RESET application_name")
+
+	// The flush skipped while the collection is disabled neither writes nor
+	// discards the stats collected before.
+	sqlstats.StmtStatsEnable.Override(ctx, &s.ClusterSettings().SV, false)
+	fingerprintCount := sqlStats.SQLStats.GetTotalFingerprintCount()
+	require.Positive(t, fingerprintCount)
+	report := sqlStats.FlushWithReport(ctx)
+	require.Zero(t, report.Written)
+	require.Zero(t, report.Discarded)
+	require.Equal(t, fingerprintCount, sqlStats.SQLStats.GetTotalFingerprintCount())
+
+	sqlstats.StmtStatsEnable.Override(ctx, &s.ClusterSettings().SV, true)
+	sqlStats.Flush(ctx)
+	var count int
+	sqlConn.QueryRow(t, `
+SELECT count(*) FROM system.statement_statistics
+WHERE app_name = $1 AND metadata ->> 'query' = 'SELECT _'`, appName).Scan(&count)
+	require.Equal(t, 1, count)
+}
+
+func TestSQLStatsAggregationInterval(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	ctx := context.Background()
+	fakeTime := &stubTime{}
+	fakeTime.setTime(time.Date(2023, 1, 1, 10, 35, 0, 0, time.UTC))
+	s, conn, _ := serverutils.StartServer(t, base.TestServerArgs{
+		Knobs: base.TestingKnobs{
+			SQLStatsKnobs: &sqlstats.TestingKnobs{
+				StubTimeNow: fakeTime.Now,
+			},
+		},
+	})
+	defer s.Stopper().Stop(ctx)
+
+	sqlConn := sqlutils.MakeSQLRunner(conn)
+	sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.flush.interval = '24h'")
+	sqlStats := s.SQLServer().(*sql.Server).
+		GetSQLStatsProvider().(*persistedsqlstats.PersistedSQLStats)
+
+	sqlConn.Exec(t, "SET application_name = 'agg_interval'")
+	sqlConn.Exec(t, "SELECT 1")
+	sqlStats.Flush(ctx)
+
+	// The stats flushed after the interval changes are assigned to a window of
+	// the new interval, and the existing row is left untouched.
+	sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.aggregation.interval = '10m'")
+	sqlConn.Exec(t, "SELECT 1")
+	sqlStats.Flush(ctx)
+
+	rows := sqlConn.Query(t, `
+SELECT aggregated_ts, agg_interval::STRING
+FROM system.statement_statistics
+WHERE app_name = 'agg_interval' AND metadata ->> 'query' = 'SELECT _'
+ORDER BY aggregated_ts`)
+	defer rows.Close()
+	type window struct {
+		aggregatedTs time.Time
+		aggInterval  string
+	}
+	var windows []window
+	for rows.Next() {
+		var w window
+		require.NoError(t, rows.Scan(&w.aggregatedTs, &w.aggInterval))
+		windows = append(windows, w)
+	}
+	require.NoError(t, rows.Err())
+	require.Len(t, windows, 2)
+	require.True(t, windows[0].aggregatedTs.Equal(time.Date(2023, 1, 1, 10, 0, 0, 0, time.UTC)))
+	require.Equal(t, "01:00:00", windows[0].aggInterval)
+	require.True(t, windows[1].aggregatedTs.Equal(time.Date(2023, 1, 1, 10, 30, 0, 0, time.UTC)))
+	require.Equal(t, "00:10:00", windows[1].aggInterval)
+}
+
+func TestSQLStatsFlushOverrun(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	ctx := context.Background()
+	fakeTime := &stubTime{}
+	fakeTime.setTime(timeutil.Now())
+	// slowFlush makes the flushes appear to take longer than the aggregation
+	// interval by moving the time forward once the statement stats are
+	// flushed.
+	var slowFlush atomic.Bool
+	s, conn, _ := serverutils.StartServer(t, base.TestServerArgs{
+		Knobs: base.TestingKnobs{
+			SQLStatsKnobs: &sqlstats.TestingKnobs{
+				StubTimeNow: fakeTime.Now,
+				OnStmtStatsFlushFinished: func() {
+					if slowFlush.Load() {
+						fakeTime.setTime(fakeTime.Now().Add(2 * time.Hour))
+					}
+				},
+			},
+		},
+	})
+	defer s.Stopper().Stop(ctx)
+
+	sqlConn := sqlutils.MakeSQLRunner(conn)
+	sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.flush.interval = '24h'")
+
+	sqlServer := s.SQLServer().(*sql.Server)
+	overruns := sqlServer.ServerMetrics.StatsMetrics.SQLStatsFlushOverrun
+	overrunsBefore := overruns.Count()
+	sqlStats := sqlServer.GetSQLStatsProvider().(*persistedsqlstats.PersistedSQLStats)
+
+	sqlConn.Exec(t, "SELECT 1")
+	sqlStats.Flush(ctx)
+	require.Equal(t, overrunsBefore, overruns.Count())
+
+	slowFlush.Store(true)
+	sqlConn.Exec(t, "SELECT 1")
+	sqlStats.Flush(ctx)
+	require.Equal(t, overrunsBefore+1, overruns.Count())
+}
+
+func TestSQLStatsFlushSequence(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	ctx := context.Background()
+	var failWrites atomic.Bool
+	s, conn, _ := serverutils.StartServer(t, base.TestServerArgs{
+		Knobs: base.TestingKnobs{
+			SQLStatsKnobs: &sqlstats.TestingKnobs{
+				BeforeFlushWrite: func() error {
+					if failWrites.Load() {
+						return errors.New("injected error")
+					}
+					return nil
+				},
+			},
+		},
+	})
+	defer s.Stopper().Stop(ctx)
+
+	sqlConn := sqlutils.MakeSQLRunner(conn)
+	sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.flush.interval = '24h'")
+
+	sqlServer := s.SQLServer().(*sql.Server)
+	sequence := sqlServer.ServerMetrics.StatsMetrics.SQLStatsFlushSequence
+	sqlStats := sqlServer.GetSQLStatsProvider().(*persistedsqlstats.PersistedSQLStats)
+
+	// Each successful flush advances the sequence number, even if it has
+	// nothing to write.
+	sqlConn.Exec(t, "SELECT 1")
+	sqlStats.Flush(ctx)
+	sequenceBefore := sequence.Value()
+	require.Positive(t, sequenceBefore)
+	sqlStats.Flush(ctx)
+	require.Equal(t, sequenceBefore+1, sequence.Value())
+
+	// The flushes that are skipped do not.
+	sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.maintenance.frozen = true")
+	sqlConn.Exec(t, "SELECT 1")
+	sqlStats.Flush(ctx)
+	require.Equal(t, sequenceBefore+1, sequence.Value())
+
+	sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.maintenance.frozen = false")
+	sqlStats.Flush(ctx)
+	require.Equal(t, sequenceBefore+2, sequence.Value())
+
+	// Nor do the flushes that failed to write some of their fingerprints.
+	// Their errors are reported by category.
+	failWrites.Store(true)
+	sqlConn.Exec(t, "SELECT 1")
+	report := sqlStats.FlushWithReport(ctx)
+	require.Equal(t, sequenceBefore+2, sequence.Value())
+	require.Len(t, report.Errors, 1)
+	require.Positive(t, report.Errors[persistedsqlstats.FlushErrorUnclassified])
+
+	failWrites.Store(false)
+	report = sqlStats.FlushWithReport(ctx)
+	require.Equal(t, sequenceBefore+3, sequence.Value())
+	require.Empty(t, report.Errors)
+}
+
+func TestSQLStatsFlushHashAppNames(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	ctx := context.Background()
+	s, conn, _ := serverutils.StartServer(t, base.TestServerArgs{})
+	defer s.Stopper().Stop(ctx)
+
+	sqlConn := sqlutils.MakeSQLRunner(conn)
+	sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.flush.interval = '24h'")
+	sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.flush.hash_app_names = true")
+	sqlStats := s.SQLServer().(*sql.Server).
+		GetSQLStatsProvider().(*persistedsqlstats.PersistedSQLStats)
+
+	const appName = "jane.doe@example.com"
+	sqlConn.Exec(t, "SET application_name = $1", appName)
+	sqlConn.Exec(t, "SELECT 1")
+	sqlConn.Exec(t, "RESET application_name")
+	sqlStats.Flush(ctx)
+
+	for _, table := range []string{"system.statement_statistics", "system.transaction_statistics"} {
+		var count int
+		sqlConn.QueryRow(t,
+			fmt.Sprintf("SELECT count(*) FROM %s WHERE app_name = $1", table), appName,
+		).Scan(&count)
+		require.Zero(t, count, "%s holds the application name in clear", table)
+
+		// The hashed application name is mapped back to the application name
+		// in the memory of the node.
+		rows := sqlConn.QueryStr(t, fmt.Sprintf(
+			"SELECT DISTINCT app_name FROM %s WHERE app_name LIKE 'hashed:%%'", table))
+		var found bool
+		for _, row := range rows {
+			if name, ok := sqlStats.LookupHashedAppName(row[0]); ok && name == appName {
+				found = true
+			}
+		}
+		require.True(t, found, "%s does not hold the hashed application name", table)
+	}
+
+	// The hash is keyed by cluster.secret.
+	var secret string
+	sqlConn.QueryRow(t, "SHOW CLUSTER SETTING cluster.secret").Scan(&secret)
+	require.NotEmpty(t, secret)
+	mac := hmac.New(sha256.New, []byte(secret))
+	_, _ = mac.Write([]byte(appName))
+	var count int
+	sqlConn.QueryRow(t,
+		"SELECT count(*) FROM system.statement_statistics WHERE app_name = $1",
+		"hashed:"+hex.EncodeToString(mac.Sum(nil)),
+	).Scan(&count)
+	require.Positive(t, count)
+}
+
+// recordingFlushSink is a FlushSink that records the application names of
+// the stats it receives, and optionally fails.
+type recordingFlushSink struct {
+	fail bool
+	mu   struct {
+		syncutil.Mutex
+		stmtApps, txnApps map[string]int
+	}
+}
+
+var _ persistedsqlstats.FlushSink = &recordingFlushSink{}
+
+func newRecordingFlushSink(fail bool) *recordingFlushSink {
+	s := &recordingFlushSink{fail: fail}
+	s.mu.stmtApps = make(map[string]int)
+	s.mu.txnApps = make(map[string]int)
+	return s
+}
+
+func (s *recordingFlushSink) Name() string { return "recording" }
+
+func (s *recordingFlushSink) WriteStmtStats(
+	_ context.Context, _ time.Time, stats []*appstatspb.CollectedStatementStatistics,
+) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, stat := range stats {
+		s.mu.stmtApps[stat.Key.App]++
+	}
+	if s.fail {
+		return errors.New("sink unavailable")
+	}
+	return nil
+}
+
+func (s *recordingFlushSink) WriteTxnStats(
+	_ context.Context, _ time.Time, stats []*appstatspb.CollectedTransactionStatistics,
+) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, stat := range stats {
+		s.mu.txnApps[stat.App]++
+	}
+	if s.fail {
+		return errors.New("sink unavailable")
+	}
+	return nil
+}
+
+func TestSQLStatsFlushSink(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	ctx := context.Background()
+	s, conn, _ := serverutils.StartServer(t, base.TestServerArgs{})
+	defer s.Stopper().Stop(ctx)
+
+	sqlConn := sqlutils.MakeSQLRunner(conn)
+	sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.flush.interval = '24h'")
+	sqlStats := s.SQLServer().(*sql.Server).
+		GetSQLStatsProvider().(*persistedsqlstats.PersistedSQLStats)
+
+	testutils.RunTrueAndFalse(t, "staging", func(t *testing.T, staging bool) {
+		sqlConn.Exec(t, fmt.Sprintf("SET CLUSTER SETTING sql.stats.flush.staging.enabled = %t", staging))
+		appName := fmt.Sprintf("flush_sink_test_%t", staging)
+
+		// A failing sink does not prevent the other sinks nor the system
+		// tables from receiving the stats.
+		failing := newRecordingFlushSink(true /* fail */)
+		defer persistedsqlstats.RegisterFlushSink(failing)()
+		recording := newRecordingFlushSink(false /* fail */)
+		defer persistedsqlstats.RegisterFlushSink(recording)()
+		defer persistedsqlstats.RegisterFlushSink(persistedsqlstats.NoopFlushSink{})()
+
+		sqlConn.Exec(t, "SET application_name = $1", appName)
+		sqlConn.Exec(t, "SELECT 1")
+		sqlConn.Exec(t, "RESET application_name")
+		sqlStats.Flush(ctx)
+
+		for _, sink := range []*recordingFlushSink{failing, recording} {
+			sink.mu.Lock()
+			require.Equal(t, 1, sink.mu.stmtApps[appName])
+			require.Equal(t, 1, sink.mu.txnApps[appName])
+			sink.mu.Unlock()
+		}
+		for _, table := range []string{"system.statement_statistics", "system.transaction_statistics"} {
+			var count int
+			sqlConn.QueryRow(t,
+				fmt.Sprintf("SELECT count(*) FROM %s WHERE app_name = $1", table), appName,
+			).Scan(&count)
+			require.Equal(t, 1, count, "%s", table)
+		}
+	})
+}
+
+func TestSQLStatsMaintenanceFrozen(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	ctx := context.Background()
+	s, conn, _ := serverutils.StartServer(t, base.TestServerArgs{})
+	defer s.Stopper().Stop(ctx)
+
+	sqlConn := sqlutils.MakeSQLRunner(conn)
+	sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.flush.interval = '24h'")
+	sqlStats := s.SQLServer().(*sql.Server).
+		GetSQLStatsProvider().(*persistedsqlstats.PersistedSQLStats)
+
+	const appName = "maintenance_frozen_test"
+	countRows := func(table string) int {
+		var count int
+		sqlConn.QueryRow(t,
+			fmt.Sprintf("SELECT count(*) FROM %s WHERE app_name = $1", table), appName,
+		).Scan(&count)
+		return count
+	}
+
+	sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.maintenance.frozen = true")
+	sqlConn.Exec(t, "SET application_name = $1", appName)
+	sqlConn.Exec(t, "SELECT 1")
+	sqlConn.Exec(t, "RESET application_name")
+
+	// The flush does not write the stats, and keeps them in memory.
+	sqlStats.Flush(ctx)
+	require.Zero(t, countRows("system.statement_statistics"))
+	require.Zero(t, countRows("system.transaction_statistics"))
+	require.Equal(t, 1, countRows("crdb_internal.node_statement_statistics"))
+
+	// The compaction cannot be forced.
+	sqlConn.ExpectErr(t, "the SQL stats maintenance is frozen",
+		"SELECT * FROM crdb_internal.sql_stats_compact_now(false)")
+
+	// Once the freeze is lifted, the retained stats are flushed.
+	sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.maintenance.frozen = false")
+	sqlStats.Flush(ctx)
+	require.Equal(t, 1, countRows("system.statement_statistics"))
+	require.Equal(t, 1, countRows("system.transaction_statistics"))
+}
+
+func TestSQLStatsTopFingerprints(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	ctx := context.Background()
+	s, conn, _ := serverutils.StartServer(t, base.TestServerArgs{})
+	defer s.Stopper().Stop(ctx)
+
+	sqlConn := sqlutils.MakeSQLRunner(conn)
+	sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.flush.interval = '24h'")
+	sqlStats := s.SQLServer().(*sql.Server).
+		GetSQLStatsProvider().(*persistedsqlstats.PersistedSQLStats)
+
+	const appName = "top_fingerprints_test"
+	sqlConn.Exec(t, "SET application_name = $1", appName)
+	for i := 0; i < 3; i++ {
+		sqlConn.Exec(t, "SELECT 1")
+	}
+	for i := 0; i < 2; i++ {
+		sqlConn.Exec(t, "SELECT 1, 2")
+	}
+	sqlConn.Exec(t, "SELECT 1, 2, 3")
+	sqlConn.Exec(t, "RESET application_name")
+
+	var queries []string
+	var counts []int64
+	for _, summary := range sqlStats.TopFingerprints(ctx, persistedsqlstats.MaxTopFingerprints) {
+		if summary.AppName == appName && strings.HasPrefix(summary.Query, "SELECT _") {
+			queries = append(queries, summary.Query)
+			counts = append(counts, summary.Count)
+		}
+	}
+	require.Equal(t, []string{"SELECT _", "SELECT _, _", "SELECT _, _, _"}, queries)
+	require.Equal(t, []int64{3, 2, 1}, counts)
+	require.Len(t, sqlStats.TopFingerprints(ctx, 2), 2)
+	require.Empty(t, sqlStats.TopFingerprints(ctx, 0))
+
+	require.Equal(t, [][]string{
+		{"SELECT _", "3"},
+		{"SELECT _, _", "2"},
+		{"SELECT _, _, _", "1"},
+	}, sqlConn.QueryStr(t, `
+SELECT query, count
+FROM crdb_internal.sql_stats_top_live(1000)
+WHERE app_name = $1 AND query LIKE 'SELECT \_%'`, appName))
+	sqlConn.ExpectErr(t, "n must be between 0 and 1000",
+		"SELECT * FROM crdb_internal.sql_stats_top_live(1001)")
+
+	// The flushed stats are no longer live.
+	sqlStats.Flush(ctx)
+	require.Equal(t, [][]string{{"0"}}, sqlConn.QueryStr(t,
+		"SELECT count(*) FROM crdb_internal.sql_stats_top_live(1000) WHERE app_name = $1", appName))
+}
+
+func TestSQLStatsFlushCoalescing(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	ctx := context.Background()
+	// blockFlush makes the flushes wait for unblockFlush once the statement
+	// stats are flushed.
+	var blockFlush atomic.Bool
+	var flushes atomic.Int32
+	flushStarted := make(chan struct{})
+	unblockFlush := make(chan struct{})
+	s, conn, _ := serverutils.StartServer(t, base.TestServerArgs{
+		Knobs: base.TestingKnobs{
+			SQLStatsKnobs: &sqlstats.TestingKnobs{
+				OnStmtStatsFlushFinished: func() {
+					flushes.Add(1)
+					if blockFlush.Load() {
+						flushStarted <- struct{}{}
+						<-unblockFlush
+					}
+				},
+			},
+		},
+	})
+	defer s.Stopper().Stop(ctx)
+
+	sqlConn := sqlutils.MakeSQLRunner(conn)
+	sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.flush.interval = '24h'")
+	sqlStats := s.SQLServer().(*sql.Server).
+		GetSQLStatsProvider().(*persistedsqlstats.PersistedSQLStats)
+
+	sqlConn.Exec(t, "SELECT 1")
+	blockFlush.Store(true)
+	flushesBefore := flushes.Load()
+
+	var wg sync.WaitGroup
+	reports := make([]persistedsqlstats.FlushReport, 2)
+	leaderCtx, cancelLeader := context.WithCancel(ctx)
+	defer cancelLeader()
+	leaderDone := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(leaderDone)
+		reports[0] = sqlStats.FlushWithReport(leaderCtx)
+	}()
+	<-flushStarted
+
+	// A flush requested while the first one is in progress waits for it
+	// rather than starting another one.
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		reports[1] = sqlStats.FlushWithReport(ctx)
+	}()
+	testutils.SucceedsSoon(t, func() error {
+		if n := sqlStats.NumFlushCallersForTesting(); n != 2 {
+			return errors.Newf("expected 2 callers sharing the flush, found %d", n)
+		}
+		return nil
+	})
+
+	// Canceling the caller that started the flush makes it stop waiting, but
+	// neither aborts the flush nor the other caller.
+	cancelLeader()
+	<-leaderDone
+	require.Equal(t, persistedsqlstats.FlushReport{}, reports[0])
+
+	// A caller whose ctx is already done doesn't wait for the flush either.
+	canceledCtx, cancel := context.WithCancel(ctx)
+	cancel()
+	require.Equal(t, persistedsqlstats.FlushReport{}, sqlStats.FlushWithReport(canceledCtx))
+
+	blockFlush.Store(false)
+	close(unblockFlush)
+	wg.Wait()
+
+	require.Equal(t, flushesBefore+1, flushes.Load())
+	require.Positive(t, reports[1].Written)
+}
+
 func TestSQLStatsGatewayNodeSetting(t *testing.T) {
 	defer leaktest.AfterTest(t)()
 	defer log.Scope(t).Close(t)
@@ -458,6 +1192,114 @@ func TestSQLStatsGatewayNodeSetting(t *testing.T) {
 	verifyNodeID(t, sqlConn, "SELECT _", false, "gateway_disabled")
 }
 
+func TestSQLStatsFlushSampling(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	ctx := context.Background()
+	params, _ := tests.CreateTestServerParams()
+	params.Knobs.SQLStatsKnobs = &sqlstats.TestingKnobs{
+		FingerprintSamplingSeed: 42,
+	}
+	s, conn, _ := serverutils.StartServer(t, params)
+	defer s.Stopper().Stop(ctx)
+	sqlConn := sqlutils.MakeSQLRunner(conn)
+
+	sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.flush.sampling.enabled = true")
+	sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.flush.sampling.app_fingerprint_threshold = 5")
+	sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.flush.sampling.fraction = 0")
+	sqlConn.Exec(t, "SELECT crdb_internal.reset_sql_stats()")
+
+	sqlServer := s.SQLServer().(*sql.Server)
+	sampledOut := sqlServer.ServerMetrics.StatsMetrics.SQLStatsFlushSampledOut
+	sampledOutBefore := sampledOut.Count()
+
+	sqlConn.Exec(t, "SET application_name = 'sampling_test'")
+	generateFingerprints(t, sqlConn, 20 /* distinctFingerprints */)
+	sqlConn.Exec(t, "SET application_name = ''")
+
+	countStmtFingerprints := func(appName string) (count int) {
+		sqlConn.QueryRow(t, `
+SELECT count(DISTINCT fingerprint_id)
+FROM system.statement_statistics
+WHERE app_name = $1`, appName).Scan(&count)
+		return count
+	}
+
+	// With a fraction of zero, only the fingerprints below the threshold are
+	// recorded.
+	sqlServer.GetSQLStatsProvider().(*persistedsqlstats.PersistedSQLStats).Flush(ctx)
+	require.Equal(t, 5, countStmtFingerprints("sampling_test"))
+	require.GreaterOrEqual(t, sampledOut.Count()-sampledOutBefore, int64(15))
+
+	// With a partial fraction, the sampling only depends on the fingerprints
+	// and the seed, so two applications running the same statements record
+	// the same fingerprints.
+	sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.flush.sampling.fraction = 0.5")
+	for _, appName := range []string{"sampling_test_a", "sampling_test_b"} {
+		sqlConn.Exec(t, "SET application_name = $1", appName)
+		generateFingerprints(t, sqlConn, 20 /* distinctFingerprints */)
+	}
+	sqlConn.Exec(t, "SET application_name = ''")
+	sqlServer.GetSQLStatsProvider().(*persistedsqlstats.PersistedSQLStats).Flush(ctx)
+	sampledA := countStmtFingerprints("sampling_test_a")
+	require.GreaterOrEqual(t, sampledA, 5)
+	require.Less(t, sampledA, 20)
+	require.Equal(t, sampledA, countStmtFingerprints("sampling_test_b"))
+
+	// Disabling the sampling lets all the fingerprints through again.
+	sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.flush.sampling.enabled = false")
+	sqlConn.Exec(t, "SET application_name = 'sampling_test'")
+	generateFingerprints(t, sqlConn, 20 /* distinctFingerprints */)
+	sqlConn.Exec(t, "SET application_name = ''")
+	sqlServer.GetSQLStatsProvider().(*persistedsqlstats.PersistedSQLStats).Flush(ctx)
+	require.GreaterOrEqual(t, countStmtFingerprints("sampling_test"), 20)
+}
+
+func TestSQLStatsFlushStaging(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	fakeTime := stubTime{
+		aggInterval: time.Hour,
+	}
+	fakeTime.setTime(timeutil.Now())
+
+	ctx := context.Background()
+	s, conn, _ := serverutils.StartServer(t, base.TestServerArgs{
+		Knobs: base.TestingKnobs{
+			SQLStatsKnobs: &sqlstats.TestingKnobs{
+				StubTimeNow: fakeTime.Now,
+			},
+		},
+	})
+	defer s.Stopper().Stop(ctx)
+	sqlConn := sqlutils.MakeSQLRunner(conn)
+	sqlStats := s.SQLServer().(*sql.Server).GetSQLStatsProvider().(*persistedsqlstats.PersistedSQLStats)
+
+	sqlConn.Exec(t, "SET CLUSTER SETTING sql.stats.flush.staging.enabled = true")
+	sqlConn.Exec(t, "SET application_name = 'flush_unit_test'")
+
+	// The first flush of the window inserts the rows, and the second one merges
+	// its stats into the existing rows.
+	queries := append([]testCase(nil), testQueries...)
+	for round := int64(1); round <= 2; round++ {
+		for _, tc := range queries {
+			for i := int64(0); i < tc.count; i++ {
+				sqlConn.Exec(t, tc.query)
+			}
+		}
+		verifyInMemoryStatsCorrectness(t, queries, sqlStats)
+		sqlStats.Flush(ctx)
+		verifyInMemoryStatsEmpty(t, queries, sqlStats)
+
+		for _, tc := range queries {
+			verifyNumOfInsertedEntries(t, sqlConn, tc.fingerprint, s.NodeID(), 1 /* expectedStmtEntryCnt */, 1 /* expectedTxnEntryCtn */)
+			verifyInsertedFingerprintExecCount(t, sqlConn, tc.fingerprint, fakeTime.getAggTimeTs(), s.NodeID(), round*tc.count)
+		}
+	}
+}
+
 func TestSQLStatsPersistedLimitReached(t *testing.T) {
 	skip.WithIssue(t, 97488)
 	defer leaktest.AfterTest(t)()
@@ -0,0 +1,67 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package persistedsqlstats
+
+import (
+	"context"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/scheduledjobs"
+)
+
+// HealthStatus is a snapshot of the state of the SQL Stats subsystem, as seen
+// from this node. See Controller.HealthSnapshot.
+type HealthStatus struct {
+	// LastFlush is the time at which the most recent flush of this node
+	// started, or the zero time if it has not flushed yet.
+	LastFlush time.Time `json:"last_flush"`
+	// LastCompaction is the completion time of the most recent compaction run
+	// of the cluster, and LastCompactionOutcome is its outcome, succeeded or
+	// failed. They are empty if no run was recorded yet.
+	LastCompaction        time.Time `json:"last_compaction"`
+	LastCompactionOutcome string    `json:"last_compaction_outcome"`
+	// ScheduleStatus is the status of the compaction schedule, ACTIVE or
+	// PAUSED, or empty if it could not be read.
+	ScheduleStatus string `json:"schedule_status"`
+	// MemoryUsedBytes is the memory used by the in-memory stats of this node,
+	// out of MemoryLimitBytes.
+	MemoryUsedBytes  int64 `json:"memory_used_bytes"`
+	MemoryLimitBytes int64 `json:"memory_limit_bytes"`
+	// Errors lists the parts of the snapshot that could not be read.
+	Errors []string `json:"errors,omitempty"`
+}
+
+// HealthSnapshot returns the HealthStatus of the SQL Stats subsystem, for the
+// health endpoint of the node. It is best effort: the failures to read the
+// persisted state, e.g. because the system tables are unavailable, are
+// reported in HealthStatus.Errors rather than failing the snapshot.
+func (s *Controller) HealthSnapshot(ctx context.Context) HealthStatus {
+	var status HealthStatus
+	status.LastFlush = s.sqlStats.GetLastFlushAt()
+	status.MemoryUsedBytes, status.MemoryLimitBytes = s.sqlStats.GetMemoryUsage()
+
+	completedAt, outcome, ok, err := GetLastCompactionRun(ctx, s.db, s.st)
+	if err != nil {
+		status.Errors = append(status.Errors, "last compaction: "+err.Error())
+	} else if ok {
+		status.LastCompaction, status.LastCompactionOutcome = completedAt, outcome
+	}
+
+	scheduleStatus, err := CompactionScheduleStatus(
+		ctx, s.db.Executor(), scheduledjobs.ProdJobSchedulerEnv,
+	)
+	if err != nil {
+		status.Errors = append(status.Errors, "compaction schedule: "+err.Error())
+	} else {
+		status.ScheduleStatus = scheduleStatus
+	}
+	return status
+}
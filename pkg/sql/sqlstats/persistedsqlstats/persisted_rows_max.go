@@ -0,0 +1,99 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package persistedsqlstats
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/pgwire/pgcode"
+	"github.com/cockroachdb/cockroach/pkg/sql/pgwire/pgerror"
+	"github.com/cockroachdb/cockroach/pkg/sql/sem/eval"
+	"github.com/cockroachdb/cockroach/pkg/sql/sessiondata"
+	"github.com/cockroachdb/cockroach/pkg/util/retry"
+	"github.com/cockroachdb/errors"
+)
+
+// settingPropagationRetryOptions are the options used by SetPersistedRowsMax
+// to wait for the new value of sql.stats.persisted_rows.max to be visible on
+// this node.
+var settingPropagationRetryOptions = retry.Options{
+	InitialBackoff: 10 * time.Millisecond,
+	MaxBackoff:     time.Second,
+	Multiplier:     2,
+	MaxRetries:     15,
+}
+
+// SetPersistedRowsMax sets sql.stats.persisted_rows.max to newMax. If
+// compactNow is set, it then runs the compaction on this node to enforce the
+// new row cap right away, rather than on the next run of the compaction job,
+// and returns the number of rows removed from each stats table, as
+// CompactSQLStatsNow does.
+//
+// newMax must be non-negative, and can only be zero, which disables the row
+// cap, if sql.stats.persisted_rows.max_age is set. With compactNow, the
+// setting is left untouched if the compaction cannot run, e.g. because a
+// compaction job is running.
+func (s *Controller) SetPersistedRowsMax(
+	ctx context.Context, newMax int64, compactNow bool,
+) ([]eval.SQLStatsCompactionResult, error) {
+	if newMax < 0 {
+		return nil, pgerror.Newf(pgcode.InvalidParameterValue,
+			"%s must be non-negative, got %d", SQLStatsMaxPersistedRows.Key(), newMax)
+	}
+	if newMax == 0 && SQLStatsMaxPersistedRowsAge.Get(&s.st.SV) == 0 {
+		return nil, errors.WithHintf(
+			pgerror.Newf(pgcode.InvalidParameterValue,
+				"cannot disable %s while %s is disabled", SQLStatsMaxPersistedRows.Key(),
+				SQLStatsMaxPersistedRowsAge.Key()),
+			"set %s first", SQLStatsMaxPersistedRowsAge.Key())
+	}
+	if compactNow {
+		if err := s.checkCanCompactNow(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	if _, err := s.db.Executor().ExecEx(ctx,
+		"set-sql-stats-persisted-rows-max",
+		nil, /* txn */
+		sessiondata.NodeUserSessionDataOverride,
+		fmt.Sprintf("SET CLUSTER SETTING %s = %d", SQLStatsMaxPersistedRows.Key(), newMax),
+	); err != nil {
+		return nil, errors.Wrapf(err, "setting %s", SQLStatsMaxPersistedRows.Key())
+	}
+	if !compactNow {
+		return nil, nil
+	}
+
+	// The new value is propagated to the nodes asynchronously, and the
+	// compaction reads the row cap from the settings of this node.
+	if err := s.waitForPersistedRowsMax(ctx, newMax); err != nil {
+		return nil, err
+	}
+	return s.compactNow(ctx)
+}
+
+// waitForPersistedRowsMax waits until sql.stats.persisted_rows.max is set to
+// the given value on this node.
+func (s *Controller) waitForPersistedRowsMax(ctx context.Context, value int64) error {
+	for r := retry.StartWithCtx(ctx, settingPropagationRetryOptions); r.Next(); {
+		if SQLStatsMaxPersistedRows.Get(&s.st.SV) == value {
+			return nil
+		}
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return errors.Newf("%s was set to %d, but the new value is not visible on this node yet; "+
+		"the next run of the compaction job enforces it", SQLStatsMaxPersistedRows.Key(), value)
+}
@@ -22,19 +22,40 @@ import (
 
 	"github.com/cockroachdb/cockroach/pkg/base"
 	"github.com/cockroachdb/cockroach/pkg/jobs"
+	"github.com/cockroachdb/cockroach/pkg/kv/kvserver/protectedts"
 	"github.com/cockroachdb/cockroach/pkg/server/serverpb"
 	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
 	"github.com/cockroachdb/cockroach/pkg/sql/isql"
+	"github.com/cockroachdb/cockroach/pkg/sql/sqlliveness"
 	"github.com/cockroachdb/cockroach/pkg/sql/sqlstats"
 	"github.com/cockroachdb/cockroach/pkg/sql/sqlstats/sslocal"
+	"github.com/cockroachdb/cockroach/pkg/util/envutil"
 	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/cockroachdb/cockroach/pkg/util/log/logpb"
 	"github.com/cockroachdb/cockroach/pkg/util/metric"
 	"github.com/cockroachdb/cockroach/pkg/util/mon"
 	"github.com/cockroachdb/cockroach/pkg/util/stop"
 	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
+	"github.com/cockroachdb/cockroach/pkg/util/syncutil/singleflight"
 	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
 )
 
+// flushDisabledOnNode disables the flush of the in-memory SQL stats on this
+// node, regardless of sql.stats.flush.enabled. It is meant for nodes that
+// originate little SQL traffic, e.g. read-only or standby nodes, to avoid
+// writing to the stats tables from them. The node still collects SQL stats in
+// memory and serves them, e.g. through the cluster-wide fan-out of the status
+// server, and may still run the compaction job, whose schedule is
+// cluster-wide.
+//
+// The statistics of the statements executed on the node are thus never
+// persisted: they are missing from the persisted stats, and from the
+// historical views of the DB Console, and are lost when the node restarts.
+// As when the flush is disabled cluster-wide, the in-memory stats of the node
+// are only discarded if sql.stats.flush.force_cleanup.enabled is set, and
+// otherwise stop growing once the in-memory limits are reached.
+var flushDisabledOnNode = envutil.EnvOrDefaultBool("COCKROACH_DISABLE_SQL_STATS_FLUSH", false)
+
 // Config is a configuration struct for the persisted SQL stats subsystem.
 type Config struct {
 	Settings                *cluster.Settings
@@ -42,11 +63,48 @@ type Config struct {
 	DB                      isql.DB
 	SQLIDContainer          *base.SQLIDContainer
 	JobRegistry             *jobs.Registry
+	// ProtectedTimestamps is used by ProtectStats to protect the stats read
+	// by the exports. It may be nil, in which case the exports are not
+	// protected.
+	ProtectedTimestamps protectedts.Manager
+	// SQLLiveness provides the session of this node, which holds the
+	// compaction lock during the compactions requested through the
+	// Controller, see AcquireCompactionLock.
+	SQLLiveness sqlliveness.Instance
 
 	// Metrics.
 	FlushCounter   *metric.Counter
 	FlushDuration  metric.IHistogram
 	FailureCounter *metric.Counter
+	// FailureCountersByCategory counts the flush errors of each category, as
+	// classified by ClassifyFlushError. The unclassified errors are only
+	// counted by FailureCounter.
+	FailureCountersByCategory map[FlushErrorCategory]*metric.Counter
+	// SampledOutCounter counts the fingerprints that were not flushed due to
+	// sql.stats.flush.sampling.enabled.
+	SampledOutCounter *metric.Counter
+	// DisabledSkipCounter counts the flushes that were skipped because
+	// sql.metrics.statement_details.enabled is false.
+	DisabledSkipCounter *metric.Counter
+	// OverrunCounter counts the flushes that took longer than
+	// sql.stats.aggregation.interval.
+	OverrunCounter *metric.Counter
+	// FlushTxnRetries counts the retries of the transactions writing the
+	// flushed stats, e.g. due to contention on the stats tables. It may be nil.
+	FlushTxnRetries *metric.Counter
+	// FlushSequence is the sequence number of the last successful flush of
+	// this node, see advanceFlushSequence. It may be nil.
+	FlushSequence *metric.Gauge
+	// ScheduleClockSkew records the skew of the compaction schedule in
+	// seconds, as last checked by the job monitor of this node.
+	ScheduleClockSkew *metric.Gauge
+	// CompactorMetrics are updated by the compactions requested through the
+	// Controller, as they are by the compaction job.
+	CompactorMetrics CompactorMetrics
+
+	// LogCompactionEvent records an event of a compaction requested through
+	// the Controller in the event log. It may be nil.
+	LogCompactionEvent func(ctx context.Context, event logpb.EventPayload)
 
 	// Testing knobs.
 	Knobs *sqlstats.TestingKnobs
@@ -74,12 +132,64 @@ type PersistedSQLStats struct {
 		signalCh chan<- struct{}
 	}
 
+	// compactionNotifyMu holds the channels of the subscribers of
+	// CompactionNotifyCh, each of them is signaled when a SQL stats compaction
+	// completes on this node.
+	compactionNotifyMu struct {
+		syncutil.Mutex
+		subscribers map[chan struct{}]struct{}
+	}
+
+	// flushGroup coalesces the flushes, which can be requested concurrently
+	// by the flush loop, the drain and crdb_internal.flush_sql_stats(), see
+	// FlushWithReport.
+	flushGroup *singleflight.Group
+	// stopper is the stopper the provider was started with, it is nil until
+	// Start is called. The shared flushes run as tasks of this stopper.
+	stopper *stop.Stopper
+	// flushMu protects the state of the flush.
+	flushMu          syncutil.Mutex
 	lastFlushStarted time.Time
 	jobMonitor       jobMonitor
 	atomic           struct {
 		nextFlushAt atomic.Value
+		// lastFlushAt mirrors lastFlushStarted so that it can be read
+		// without waiting for a flush in progress, see GetLastFlushAt.
+		lastFlushAt atomic.Value
+	}
+
+	// flushErrors counts the writes of the flush in progress that failed,
+	// by category, see doFlush.
+	flushErrors struct {
+		syncutil.Mutex
+		byCategory map[FlushErrorCategory]int64
 	}
 
+	// stmtSampler and txnSampler are used to sample the fingerprints of
+	// applications with high fingerprint cardinality.
+	stmtSampler fingerprintSampler
+	txnSampler  fingerprintSampler
+
+	// overrunLogEvery throttles the warnings logged when a flush takes longer
+	// than the aggregation interval.
+	overrunLogEvery log.EveryN
+
+	// hashedAppNames maps the hashes under which the flush persisted the
+	// statistics of applications to their names, see maybeHashAppName.
+	hashedAppNames struct {
+		syncutil.Mutex
+		m map[string]string
+	}
+
+	// flushDisabled is set if the flush is disabled on this node, see
+	// flushDisabledOnNode.
+	flushDisabled bool
+
+	// stmtHighWaterMark and txnHighWaterMark are the most recent aggregated_ts
+	// to which this node flushed statement and transaction statistics
+	// respectively. They are protected by flushMu.
+	stmtHighWaterMark, txnHighWaterMark time.Time
+
 	// drain is closed when a graceful drain is initiated.
 	drain       chan struct{}
 	setDraining sync.Once
@@ -96,6 +206,9 @@ func New(cfg *Config, memSQLStats *sslocal.SQLStats) *PersistedSQLStats {
 		cfg:                  cfg,
 		memoryPressureSignal: make(chan struct{}),
 		drain:                make(chan struct{}),
+		flushGroup:           singleflight.NewGroup("flush-sql-stats", "key"),
+		overrunLogEvery:      log.Every(time.Minute),
+		flushDisabled:        flushDisabledOnNode,
 	}
 
 	p.jobMonitor = jobMonitor{
@@ -103,9 +216,16 @@ func New(cfg *Config, memSQLStats *sslocal.SQLStats) *PersistedSQLStats {
 		db:           cfg.DB,
 		scanInterval: defaultScanInterval,
 		jitterFn:     p.jitterInterval,
+		clockSkew:    cfg.ScheduleClockSkew,
 	}
 	if cfg.Knobs != nil {
+		p.flushDisabled = p.flushDisabled || cfg.Knobs.DisableFlushOnNode
 		p.jobMonitor.testingKnobs.updateCheckInterval = cfg.Knobs.JobMonitorUpdateCheckInterval
+		if cfg.Knobs.JobMonitorScanInterval != 0 {
+			p.jobMonitor.scanInterval = cfg.Knobs.JobMonitorScanInterval
+		}
+		p.stmtSampler.seed = cfg.Knobs.FingerprintSamplingSeed
+		p.txnSampler.seed = cfg.Knobs.FingerprintSamplingSeed
 	}
 
 	return p
@@ -113,8 +233,17 @@ func New(cfg *Config, memSQLStats *sslocal.SQLStats) *PersistedSQLStats {
 
 // Start implements sqlstats.Provider interface.
 func (s *PersistedSQLStats) Start(ctx context.Context, stopper *stop.Stopper) {
+	s.stopper = stopper
+	if s.flushDisabled {
+		log.Infof(ctx, "the flush of SQL stats is disabled on this node, "+
+			"the statistics of its statements are not persisted")
+	}
 	s.startSQLStatsFlushLoop(ctx, stopper)
-	s.jobMonitor.start(ctx, stopper, s.drain, &s.tasksDoneWG)
+	if s.cfg.Knobs != nil && s.cfg.Knobs.DisableSQLStatsCompactionSchedule {
+		log.Infof(ctx, "the SQL stats compaction schedule is disabled by a testing knob")
+	} else {
+		s.jobMonitor.start(ctx, stopper, s.drain, &s.tasksDoneWG)
+	}
 	stopper.AddCloser(stop.CloserFn(func() {
 		// TODO(knz,yahor): This really should be just Stop(), but there
 		// is a leak somewhere and would cause a panic when a hard stop
@@ -142,6 +271,44 @@ func (s *PersistedSQLStats) SetFlushDoneSignalCh(sigCh chan<- struct{}) {
 	s.flushDoneMu.signalCh = sigCh
 }
 
+// CompactionNotifyCh subscribes to the completion of the SQL stats compaction
+// jobs on this node, which indicates that the contents of the persisted stats
+// tables changed. In-process components that cache data derived from the
+// persisted stats can drain the returned channel instead of polling. Each
+// subscriber gets its own channel, and must call the returned function once
+// it is no longer interested in the notifications.
+//
+// At most one signal is buffered: if the channel is not drained between two
+// compactions, the subscriber observes a single signal for both.
+func (s *PersistedSQLStats) CompactionNotifyCh() (_ <-chan struct{}, unsubscribe func()) {
+	ch := make(chan struct{}, 1)
+	s.compactionNotifyMu.Lock()
+	defer s.compactionNotifyMu.Unlock()
+	if s.compactionNotifyMu.subscribers == nil {
+		s.compactionNotifyMu.subscribers = make(map[chan struct{}]struct{})
+	}
+	s.compactionNotifyMu.subscribers[ch] = struct{}{}
+	return ch, func() {
+		s.compactionNotifyMu.Lock()
+		defer s.compactionNotifyMu.Unlock()
+		delete(s.compactionNotifyMu.subscribers, ch)
+	}
+}
+
+// NotifyCompactionDone signals the subscribers of CompactionNotifyCh that a
+// compaction has completed. It never blocks, so that a slow subscriber cannot
+// hold up the compaction job or the other subscribers.
+func (s *PersistedSQLStats) NotifyCompactionDone() {
+	s.compactionNotifyMu.Lock()
+	defer s.compactionNotifyMu.Unlock()
+	for ch := range s.compactionNotifyMu.subscribers {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
 // GetController returns the controller of the PersistedSQLStats.
 func (s *PersistedSQLStats) GetController(server serverpb.SQLStatusServer) *Controller {
 	return NewController(s, server, s.cfg.DB)
@@ -222,6 +389,13 @@ func (s *PersistedSQLStats) GetNextFlushAt() time.Time {
 	return s.atomic.nextFlushAt.Load().(time.Time)
 }
 
+// GetLastFlushAt returns the time at which the most recent flush of this node
+// started, or the zero time if it has not flushed yet.
+func (s *PersistedSQLStats) GetLastFlushAt() time.Time {
+	t, _ := s.atomic.lastFlushAt.Load().(time.Time)
+	return t
+}
+
 // GetSQLInstanceID returns the SQLInstanceID.
 func (s *PersistedSQLStats) GetSQLInstanceID() base.SQLInstanceID {
 	return s.cfg.SQLIDContainer.SQLInstanceID()
@@ -0,0 +1,98 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package persistedsqlstats
+
+import (
+	"math"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/util/syncutil"
+)
+
+// fingerprintSampler limits the number of distinct fingerprints that each
+// application can write to the persisted stats tables within an aggregation
+// window. Once an application has recorded more distinct fingerprints than
+// sql.stats.flush.sampling.app_fingerprint_threshold in the current window,
+// only a fraction (sql.stats.flush.sampling.fraction) of its new distinct
+// fingerprints are recorded.
+//
+// The sampling decision is a deterministic function of the fingerprint ID and
+// of the seed, so a given fingerprint is consistently either recorded or
+// sampled out across flushes and across nodes. This keeps the recorded subset
+// representative instead of randomly dropping some of the flushes of each
+// fingerprint.
+type fingerprintSampler struct {
+	// seed is mixed into the sampling decisions. It is zero, except in tests,
+	// see sqlstats.TestingKnobs.FingerprintSamplingSeed.
+	seed uint64
+
+	mu struct {
+		syncutil.Mutex
+		// window is the aggregation timestamp the recorded fingerprints belong
+		// to. The sampler is reset when the aggregation window changes.
+		window time.Time
+		// recorded contains, for each application, the set of distinct
+		// fingerprint IDs that have been admitted in the current window.
+		recorded map[string]map[uint64]struct{}
+	}
+}
+
+// shouldRecord returns whether the stats for the given fingerprint should be
+// written to the persisted stats tables.
+func (f *fingerprintSampler) shouldRecord(
+	st *cluster.Settings, aggregatedTs time.Time, appName string, fingerprintID uint64,
+) bool {
+	if !SQLStatsFlushSamplingEnabled.Get(&st.SV) {
+		return true
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if !f.mu.window.Equal(aggregatedTs) || f.mu.recorded == nil {
+		f.mu.window = aggregatedTs
+		f.mu.recorded = make(map[string]map[uint64]struct{})
+	}
+
+	fingerprints, ok := f.mu.recorded[appName]
+	if !ok {
+		fingerprints = make(map[uint64]struct{})
+		f.mu.recorded[appName] = fingerprints
+	}
+	if _, ok := fingerprints[fingerprintID]; ok {
+		return true
+	}
+
+	threshold := SQLStatsFlushSamplingAppFingerprintThreshold.Get(&st.SV)
+	if int64(len(fingerprints)) >= threshold &&
+		!fingerprintSampledIn(fingerprintID, f.seed, SQLStatsFlushSamplingFraction.Get(&st.SV)) {
+		return false
+	}
+
+	fingerprints[fingerprintID] = struct{}{}
+	return true
+}
+
+// fingerprintSampledIn deterministically maps the fingerprint ID and the seed
+// to [0, 1) and returns whether it falls within the sampled fraction.
+func fingerprintSampledIn(fingerprintID, seed uint64, fraction float64) bool {
+	// Fingerprint IDs are hashes already, but mix the bits anyway
+	// (splitmix64 finalizer) so that the sampling does not depend on the
+	// quality of the low bits.
+	h := fingerprintID ^ seed
+	h ^= h >> 30
+	h *= 0xbf58476d1ce4e5b9
+	h ^= h >> 27
+	h *= 0x94d049bb133111eb
+	h ^= h >> 31
+	return float64(h>>11)/float64(1<<53) < math.Min(fraction, 1)
+}
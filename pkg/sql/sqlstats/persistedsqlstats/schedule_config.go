@@ -0,0 +1,185 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package persistedsqlstats
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/jobs"
+	"github.com/cockroachdb/cockroach/pkg/settings"
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/sql/isql"
+	"github.com/cockroachdb/cockroach/pkg/sql/lexbase"
+	"github.com/cockroachdb/cockroach/pkg/sql/pgwire/pgcode"
+	"github.com/cockroachdb/cockroach/pkg/sql/pgwire/pgerror"
+	"github.com/cockroachdb/cockroach/pkg/sql/sessiondata"
+	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
+	"github.com/cockroachdb/errors"
+	"github.com/robfig/cron/v3"
+)
+
+// ScheduleConfig is the configuration of the SQL stats compaction, as
+// exported by ExportScheduleConfig and applied by ImportScheduleConfig, e.g.
+// to carry it over to a rebuilt cluster. It can be serialized to JSON.
+type ScheduleConfig struct {
+	// Recurrence is the cron expression of the compaction schedule.
+	Recurrence string `json:"recurrence"`
+	// Settings maps the names of the settings of the compaction that are not
+	// set to their default value to their value, in the form accepted by SET
+	// CLUSTER SETTING. See scheduleConfigSettings for the settings of the
+	// compaction.
+	Settings map[string]string `json:"settings,omitempty"`
+}
+
+// scheduleConfigSettings are the settings that configure the SQL stats
+// compaction, besides sql.stats.cleanup.recurrence which is carried by
+// ScheduleConfig.Recurrence.
+var scheduleConfigSettings = []settings.NonMaskedSetting{
+	SQLStatsMaxPersistedRows,
+	SQLStatsMaxPersistedRowsAge,
+	SQLStatsCleanupRetainRecentlyExecuted,
+	SQLStatsCleanupRetainLatestPerFingerprint,
+	SQLStatsCleanupRetainIndexRecommendationSources,
+	SQLStatsCleanupRetainPerPlan,
+	SQLStatsCleanupEvictionOrder,
+	SQLStatsCleanupPinnedAppNames,
+	SQLStatsCleanupMaxPinnedRows,
+	SQLStatsCleanupMinRecurrenceInterval,
+	CompactionJobRowsToDeletePerTxn,
+	SQLStatsCleanupCatchUpEnabled,
+	SQLStatsCleanupCatchUpBacklogThreshold,
+	SQLStatsCleanupCatchUpRowsPerRun,
+	SQLStatsCleanupGCHintEnabled,
+	SQLStatsCleanupGCHintThreshold,
+	SQLStatsCleanupMaxPauseDuration,
+	SQLStatsCleanupWindow,
+	SQLStatsCleanupCoalesceWindowsEnabled,
+	SQLStatsCleanupRollupEnabled,
+	SQLStatsCleanupRollupAfter,
+	SQLStatsCleanupWindowGrace,
+	SQLStatsCleanupMaxRowsPerRun,
+	SQLStatsCleanupDeleteRateLimit,
+	SQLStatsCleanupDeleteParallelism,
+	SQLStatsCleanupVerify,
+	SQLStatsCleanupSanityFraction,
+	SQLStatsCleanupAppNameTTLs,
+}
+
+// ExportScheduleConfig returns the configuration of the SQL stats compaction:
+// the recurrence of the compaction schedule, and the values of the settings of
+// the compaction that differ from their default.
+func ExportScheduleConfig(
+	ctx context.Context, db isql.DB, st *cluster.Settings,
+) (ScheduleConfig, error) {
+	var sj *jobs.ScheduledJob
+	if err := runScheduleStoreTxn(ctx, db, func(ctx context.Context, txn isql.Txn) (err error) {
+		sj, err = loadCompactionSchedule(ctx, txn)
+		return err
+	}); err != nil {
+		return ScheduleConfig{}, err
+	}
+
+	cfg := ScheduleConfig{Recurrence: sj.ScheduleExpr()}
+	for _, s := range scheduleConfigSettings {
+		if s.Encoded(&st.SV) == s.EncodedDefault() {
+			continue
+		}
+		if cfg.Settings == nil {
+			cfg.Settings = make(map[string]string)
+		}
+		cfg.Settings[s.Key()] = s.String(&st.SV)
+	}
+	return cfg, nil
+}
+
+// ImportScheduleConfig applies the given configuration of the SQL stats
+// compaction, as returned by ExportScheduleConfig. The settings of the
+// compaction listed in the configuration are set, the other ones are reset to
+// their default, and sql.stats.cleanup.recurrence is set to the recurrence of
+// the configuration, which the job monitor then applies to the schedule.
+//
+// The configuration is validated before any setting is changed: it must only
+// list settings of the compaction, and its recurrence must pass the anomaly
+// checks of CheckScheduleAnomaly, i.e. be a valid cron expression that runs
+// the compaction at least once a day, and not run it more frequently than
+// sql.stats.cleanup.min_recurrence_interval as configured. The values of the
+// settings are validated when they are set, so an invalid value fails the
+// import after the settings preceding it were applied.
+func ImportScheduleConfig(
+	ctx context.Context, db isql.DB, st *cluster.Settings, cfg ScheduleConfig,
+) error {
+	if err := validateScheduleConfig(cfg, timeutil.Now()); err != nil {
+		return err
+	}
+
+	for _, s := range scheduleConfigSettings {
+		stmt := fmt.Sprintf("RESET CLUSTER SETTING %s", s.Key())
+		if value, ok := cfg.Settings[s.Key()]; ok {
+			stmt = fmt.Sprintf("SET CLUSTER SETTING %s = %s", s.Key(), lexbase.EscapeSQLString(value))
+		}
+		if _, err := db.Executor().ExecEx(ctx,
+			"import-sql-stats-schedule-config",
+			nil, /* txn */
+			sessiondata.NodeUserSessionDataOverride,
+			stmt,
+		); err != nil {
+			return errors.Wrapf(err, "importing %s", s.Key())
+		}
+	}
+	if _, err := db.Executor().ExecEx(ctx,
+		"import-sql-stats-schedule-config",
+		nil, /* txn */
+		sessiondata.NodeUserSessionDataOverride,
+		fmt.Sprintf("SET CLUSTER SETTING %s = %s",
+			SQLStatsCleanupRecurrence.Key(), lexbase.EscapeSQLString(cfg.Recurrence)),
+	); err != nil {
+		return errors.Wrapf(err, "importing %s", SQLStatsCleanupRecurrence.Key())
+	}
+	return nil
+}
+
+// validateScheduleConfig checks that cfg only lists settings of the
+// compaction, and that its recurrence passes the anomaly checks as of now.
+func validateScheduleConfig(cfg ScheduleConfig, now time.Time) error {
+	known := make(map[string]settings.NonMaskedSetting, len(scheduleConfigSettings))
+	for _, s := range scheduleConfigSettings {
+		known[s.Key()] = s
+	}
+	for key := range cfg.Settings {
+		if _, ok := known[key]; !ok {
+			return pgerror.Newf(pgcode.InvalidParameterValue,
+				"%s is not a setting of the SQL stats compaction", key)
+		}
+	}
+
+	if err := checkScheduleExpr(cfg.Recurrence); err != nil {
+		return err
+	}
+	schedule, err := cron.ParseStandard(cfg.Recurrence)
+	if err != nil {
+		return err
+	}
+	if next := schedule.Next(now); next.IsZero() || next.Sub(now) > longIntervalWarningThreshold {
+		return errors.Wrapf(ErrScheduleIntervalTooLong, "sql stats compaction schedule recurrence "+
+			"(%q) does not run within the warning threshold (%s)", cfg.Recurrence,
+			longIntervalWarningThreshold)
+	}
+	minInterval := SQLStatsCleanupMinRecurrenceInterval.Default()
+	if value, ok := cfg.Settings[SQLStatsCleanupMinRecurrenceInterval.Key()]; ok {
+		if minInterval, err = time.ParseDuration(value); err != nil {
+			return pgerror.Wrapf(err, pgcode.InvalidParameterValue,
+				"invalid value for %s", SQLStatsCleanupMinRecurrenceInterval.Key())
+		}
+	}
+	return checkScheduleIntervalNotTooShort(schedule, minInterval)
+}
@@ -17,15 +17,20 @@ import (
 
 	"github.com/cockroachdb/cockroach/pkg/jobs"
 	"github.com/cockroachdb/cockroach/pkg/scheduledjobs"
+	"github.com/cockroachdb/cockroach/pkg/security/username"
+	"github.com/cockroachdb/cockroach/pkg/settings"
 	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
 	"github.com/cockroachdb/cockroach/pkg/sql/isql"
+	"github.com/cockroachdb/cockroach/pkg/sql/sem/eval"
 	"github.com/cockroachdb/cockroach/pkg/sql/sem/tree"
 	"github.com/cockroachdb/cockroach/pkg/sql/sessiondata"
 	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/cockroachdb/cockroach/pkg/util/metric"
 	"github.com/cockroachdb/cockroach/pkg/util/retry"
 	"github.com/cockroachdb/cockroach/pkg/util/stop"
 	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
 	"github.com/cockroachdb/errors"
+	"github.com/robfig/cron/v3"
 )
 
 // We don't need this monitor to run very frequent. Normally, the schedule
@@ -43,17 +48,58 @@ var (
 	// warning threshold is 24 hours.
 	ErrScheduleIntervalTooLong = errors.New("sql stats compaction schedule interval too long")
 
+	// ErrScheduleIntervalTooShort is returned when sql stats compaction's
+	// schedule would run the compaction more frequently than allowed by
+	// sql.stats.cleanup.min_recurrence_interval.
+	ErrScheduleIntervalTooShort = errors.New("sql stats compaction schedule interval too short")
+
 	// ErrSchedulePaused is returned when monitor detects that the schedule is
 	// paused.
 	ErrSchedulePaused = errors.New("sql stats compaction schedule paused")
 
+	// ErrScheduleExprInvalid is returned when monitor detects that the
+	// schedule expression cannot be parsed, e.g. because system.scheduled_jobs
+	// was modified directly. Such a schedule never runs again until its
+	// expression is reset.
+	ErrScheduleExprInvalid = errors.New("sql stats compaction schedule expression invalid")
+
+	// ErrScheduleOwnerInvalid is returned when monitor detects that the owner
+	// of the schedule does not exist, e.g. because system.users was restored
+	// from a backup taken before the owner was created. The scheduled job
+	// system cannot run such a schedule.
+	ErrScheduleOwnerInvalid = errors.New("sql stats compaction schedule owner invalid")
+
+	// ErrScheduleWrongExecutor is returned when monitor detects that the
+	// executor type of the schedule is not the SQL stats compaction executor,
+	// e.g. because system.scheduled_jobs was modified directly. The scheduled
+	// job system does not run the compaction job for such a schedule.
+	ErrScheduleWrongExecutor = errors.New("sql stats compaction schedule executor type invalid")
+
+	// ErrScheduleClockSkew is returned when monitor detects that the next run
+	// of the schedule diverges from the next run implied by its expression
+	// and the current time, e.g. because the clock of the node that last
+	// computed the next run was skewed. Such a schedule runs prematurely or
+	// late.
+	ErrScheduleClockSkew = errors.New("sql stats compaction schedule clock skew")
+
 	// ErrScheduleUndroppable is returned when user is attempting to drop sql stats
 	// compaction schedule.
 	ErrScheduleUndroppable = errors.New("sql stats compaction schedule cannot be dropped")
+
+	// ErrScheduleStoreUnavailable marks the errors returned when
+	// system.scheduled_jobs could not be accessed after retrying transient
+	// failures, see runScheduleStoreTxn. The operation may succeed later.
+	ErrScheduleStoreUnavailable = errors.New("sql stats compaction schedule store unavailable")
 )
 
 var longIntervalWarningThreshold = time.Hour * 24
 
+// clockSkewWarningThreshold is the divergence between the next run of the
+// schedule and its expected next run beyond which the monitor warns. It is
+// well above the polling interval of the job scheduler, so that a schedule
+// waiting to be picked up by the scheduler is not reported as delayed.
+var clockSkewWarningThreshold = time.Minute * 5
+
 // jobMonitor monitors the system.scheduled_jobs table to ensure that we would
 // always have one sql stats scheduled compaction job running.
 // It performs this check immediately upon start() and runs the check
@@ -63,6 +109,9 @@ type jobMonitor struct {
 	db           isql.DB
 	scanInterval time.Duration
 	jitterFn     func(time.Duration) time.Duration
+	// clockSkew, if set, records the skew of the schedule in seconds, see
+	// CheckScheduleClockSkew.
+	clockSkew    *metric.Gauge
 	testingKnobs struct {
 		updateCheckInterval time.Duration
 	}
@@ -128,30 +177,7 @@ func (j *jobMonitor) start(
 func (j *jobMonitor) getSchedule(
 	ctx context.Context, txn isql.Txn,
 ) (sj *jobs.ScheduledJob, _ error) {
-	row, err := txn.QueryRowEx(
-		ctx,
-		"load-sql-stats-scheduled-job",
-		txn.KV(),
-		sessiondata.NodeUserSessionDataOverride,
-		"SELECT schedule_id FROM system.scheduled_jobs WHERE schedule_name = $1",
-		compactionScheduleName,
-	)
-	if err != nil {
-		return nil, err
-	}
-
-	if row == nil {
-		return nil, errScheduleNotFound
-	}
-
-	scheduledJobID := int64(tree.MustBeDInt(row[0]))
-
-	sj, err = jobs.ScheduledJobTxn(txn).Load(ctx, scheduledjobs.ProdJobSchedulerEnv, scheduledJobID)
-	if err != nil {
-		return nil, err
-	}
-
-	return sj, nil
+	return loadCompactionSchedule(ctx, txn)
 }
 
 func (j *jobMonitor) updateSchedule(ctx context.Context, cronExpr string) {
@@ -162,13 +188,15 @@ func (j *jobMonitor) updateSchedule(ctx context.Context, cronExpr string) {
 		MaxBackoff:     10 * time.Minute,
 	}
 	for r := retry.StartWithCtx(ctx, retryOptions); r.Next(); {
-		if err = j.db.Txn(ctx, func(ctx context.Context, txn isql.Txn) error {
+		if err = runScheduleStoreTxn(ctx, j.db, func(ctx context.Context, txn isql.Txn) error {
 			// We check if we can get load the schedule, if the schedule cannot be
-			// loaded because it's not found, we recreate the schedule.
+			// loaded because it's not found, we recreate the schedule. Any other
+			// error, e.g. a transient failure to read system.scheduled_jobs, does
+			// not mean that the schedule is missing.
 			sj, err = j.getSchedule(ctx, txn)
 
 			if err != nil {
-				if !jobs.HasScheduledJobNotFoundError(err) && !errors.Is(err, errScheduleNotFound) {
+				if !isScheduleNotFoundError(err) {
 					return err
 				}
 				sj, err = CreateSQLStatsCompactionScheduleIfNotYetExist(ctx, txn, j.st)
@@ -177,16 +205,62 @@ func (j *jobMonitor) updateSchedule(ctx context.Context, cronExpr string) {
 				}
 			}
 
+			if err := checkScheduleExpr(sj.ScheduleExpr()); err != nil {
+				// The recurrence setting is validated when it is set, but we
+				// fall back to its default rather than keeping a schedule that
+				// can never run if it fails to parse as well.
+				if checkScheduleExpr(cronExpr) != nil {
+					cronExpr = SQLStatsCleanupRecurrence.Default()
+				}
+				log.Warningf(ctx, "%v, resetting it to %q", err, cronExpr)
+			}
+
+			ownerValid, err := isValidScheduleOwner(ctx, txn, sj.Owner())
+			if err != nil {
+				return err
+			}
+			if !ownerValid {
+				log.Warningf(ctx, "%v: %s does not exist, resetting it to %s",
+					ErrScheduleOwnerInvalid, sj.Owner(), username.NodeUserName())
+				sj.SetOwner(username.NodeUserName())
+			}
+
+			executorErr := checkScheduleExecutor(sj)
+			if executorErr != nil {
+				log.Warningf(ctx, "%v, resetting it", executorErr)
+				if err := setCompactionExecutionDetails(sj); err != nil {
+					return err
+				}
+			}
+
 			if sj.ScheduleExpr() == cronExpr {
-				return nil
+				if ownerValid && executorErr == nil {
+					return nil
+				}
+				return jobs.ScheduledJobTxn(txn).Update(ctx, sj)
 			}
+			// A schedule paused, either indefinitely or until some time with
+			// crdb_internal.pause_sql_stats_compaction, stays paused: only
+			// its recurrence changes, and it takes effect once the schedule
+			// runs again.
+			paused := sj.NextRun().IsZero() || isCompactionScheduleTemporarilyPaused(sj)
+			nextRun, status := sj.NextRun(), sj.ScheduleStatus()
 			if err := sj.SetSchedule(cronExpr); err != nil {
 				return err
 			}
-			sj.SetScheduleStatus(string(jobs.StatusPending))
+			if paused {
+				sj.SetNextRun(nextRun)
+				sj.SetScheduleStatus("%s", status)
+			} else {
+				sj.SetScheduleStatus(string(jobs.StatusPending))
+			}
 			return jobs.ScheduledJobTxn(txn).Update(ctx, sj)
 		}); err != nil && ctx.Err() == nil {
-			log.Errorf(ctx, "failed to update stats scheduled compaction job: %s", err)
+			if errors.Is(err, ErrScheduleStoreUnavailable) {
+				log.Warningf(ctx, "failed to update stats scheduled compaction job, will retry: %s", err)
+			} else {
+				log.Errorf(ctx, "failed to update stats scheduled compaction job: %s", err)
+			}
 		} else {
 			break
 		}
@@ -196,13 +270,34 @@ func (j *jobMonitor) updateSchedule(ctx context.Context, cronExpr string) {
 		if err = CheckScheduleAnomaly(sj); err != nil {
 			log.Warningf(ctx, "schedule anomaly detected, disabling sql stats compaction may cause performance impact: %s", err)
 		}
+		j.checkClockSkew(ctx, sj)
 	}
+}
 
+// checkClockSkew records the clock skew of the given schedule and warns if
+// it exceeds clockSkewWarningThreshold.
+func (j *jobMonitor) checkClockSkew(ctx context.Context, sj *jobs.ScheduledJob) {
+	skew, err := CheckScheduleClockSkew(sj, timeutil.Now())
+	if j.clockSkew != nil {
+		j.clockSkew.Update(int64(skew.Seconds()))
+	}
+	if err != nil {
+		log.Warningf(ctx, "%v", err)
+	}
 }
 
-// CheckScheduleAnomaly checks a given schedule to see if it is either paused
-// or has unusually long run interval.
+// CheckScheduleAnomaly checks a given schedule to see if it either has the
+// wrong executor type, has an invalid schedule expression, is paused or has
+// unusually long run interval.
 func CheckScheduleAnomaly(sj *jobs.ScheduledJob) error {
+	if err := checkScheduleExecutor(sj); err != nil {
+		return err
+	}
+
+	if err := checkScheduleExpr(sj.ScheduleExpr()); err != nil {
+		return err
+	}
+
 	if (sj.NextRun() == time.Time{}) {
 		return ErrSchedulePaused
 	}
@@ -214,3 +309,126 @@ func CheckScheduleAnomaly(sj *jobs.ScheduledJob) error {
 	}
 	return nil
 }
+
+// CheckScheduleClockSkew compares the next run of the given schedule to the
+// next run implied by its expression at time now, which is read from the
+// clock of this node. It returns the skew of the schedule, which is positive
+// if the next run is delayed, and negative if it is premature:
+//   - if the next run is in the past, the schedule is overdue by now minus
+//     the next run;
+//   - otherwise, the schedule is off by the next run minus the expected next
+//     run. Since the expected next run is the first run of the expression
+//     after now, a next run that precedes it is not a run of the expression.
+//
+// The returned error wraps ErrScheduleClockSkew if the skew exceeds
+// clockSkewWarningThreshold. Schedules that are paused, either indefinitely
+// or through crdb_internal.pause_sql_stats_compaction, and schedules with an
+// invalid expression are reported by CheckScheduleAnomaly rather than as
+// skewed.
+func CheckScheduleClockSkew(sj *jobs.ScheduledJob, now time.Time) (time.Duration, error) {
+	nextRun := sj.NextRun()
+	if nextRun.IsZero() || isCompactionScheduleTemporarilyPaused(sj) {
+		return 0, nil
+	}
+	schedule, err := cron.ParseStandard(sj.ScheduleExpr())
+	if err != nil {
+		// Reported by CheckScheduleAnomaly.
+		return 0, nil //nolint:returnerrcheck
+	}
+
+	var skew time.Duration
+	if nextRun.Before(now) {
+		skew = now.Sub(nextRun)
+	} else {
+		skew = nextRun.Sub(schedule.Next(now))
+	}
+	if skew > clockSkewWarningThreshold {
+		return skew, errors.Wrapf(ErrScheduleClockSkew, "sql stats compaction schedule next run "+
+			"(%s) is delayed by %s relative to the clock of this node (%s), exceeding the warning "+
+			"threshold (%s)", nextRun, skew, now, clockSkewWarningThreshold)
+	}
+	if -skew > clockSkewWarningThreshold {
+		return skew, errors.Wrapf(ErrScheduleClockSkew, "sql stats compaction schedule next run "+
+			"(%s) is premature by %s relative to the clock of this node (%s), exceeding the warning "+
+			"threshold (%s)", nextRun, -skew, now, clockSkewWarningThreshold)
+	}
+	return skew, nil
+}
+
+// checkScheduleExecutor returns ErrScheduleWrongExecutor if the executor type
+// of the given schedule is not the SQL stats compaction executor.
+func checkScheduleExecutor(sj *jobs.ScheduledJob) error {
+	if expected := tree.ScheduledSQLStatsCompactionExecutor.InternalName(); sj.ExecutorType() != expected {
+		return errors.Wrapf(ErrScheduleWrongExecutor, "sql stats compaction schedule executor type "+
+			"(%q) is not %q", sj.ExecutorType(), expected)
+	}
+	return nil
+}
+
+// checkScheduleExpr returns ErrScheduleExprInvalid if the given schedule
+// expression cannot be parsed as a cron expression.
+func checkScheduleExpr(expr string) error {
+	if _, err := cron.ParseStandard(expr); err != nil {
+		return errors.Wrapf(ErrScheduleExprInvalid, "sql stats compaction schedule expression "+
+			"(%q) cannot be parsed: %v", expr, err)
+	}
+	return nil
+}
+
+// ValidateScheduleRecurrence validates expr as a value of
+// sql.stats.cleanup.recurrence, with the same parser as the scheduler, and
+// computes the next numRuns runs of the compaction after now under the
+// recurrence. It reports whether the recurrence would be rejected by the
+// setting for running the compaction too frequently
+// (ErrScheduleIntervalTooShort), and whether the schedule monitor would warn
+// about its next run being too far in the future (ErrScheduleIntervalTooLong).
+func ValidateScheduleRecurrence(
+	sv *settings.Values, expr string, now time.Time, numRuns int,
+) eval.SQLStatsRecurrenceValidation {
+	res := eval.SQLStatsRecurrenceValidation{
+		Err: SQLStatsCleanupRecurrence.Validate(sv, expr),
+	}
+	res.IntervalTooShort = errors.Is(res.Err, ErrScheduleIntervalTooShort)
+	schedule, err := cron.ParseStandard(expr)
+	if err != nil {
+		return res
+	}
+	res.IntervalTooLong = schedule.Next(now).Sub(now) > longIntervalWarningThreshold
+	next := now
+	for i := 0; i < numRuns; i++ {
+		if next = schedule.Next(next); next.IsZero() {
+			break
+		}
+		res.NextRuns = append(res.NextRuns, next)
+	}
+	return res
+}
+
+// scheduleIntervalSamples is the number of consecutive runs of a schedule
+// inspected by checkScheduleIntervalNotTooShort. Cron expressions can have
+// irregular intervals (e.g. "0,1 * * * *"), so we look at more than one
+// interval to find the shortest one.
+const scheduleIntervalSamples = 64
+
+// checkScheduleIntervalNotTooShort returns ErrScheduleIntervalTooShort if
+// the schedule would run more frequently than minInterval.
+func checkScheduleIntervalNotTooShort(schedule cron.Schedule, minInterval time.Duration) error {
+	if minInterval <= 0 {
+		return nil
+	}
+	// Use a fixed starting point so that the validation is deterministic.
+	prev := schedule.Next(time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC))
+	for i := 0; i < scheduleIntervalSamples; i++ {
+		next := schedule.Next(prev)
+		if next.IsZero() {
+			break
+		}
+		if interval := next.Sub(prev); interval < minInterval {
+			return errors.Wrapf(ErrScheduleIntervalTooShort, "sql stats compaction schedule interval "+
+				"(%s) is shorter than the minimum (%s) configured by %s", interval, minInterval,
+				SQLStatsCleanupMinRecurrenceInterval.Key())
+		}
+		prev = next
+	}
+	return nil
+}
@@ -12,17 +12,25 @@ package persistedsqlstats_test
 
 import (
 	"context"
+	gosql "database/sql"
+	"encoding/json"
 	"fmt"
+	"math"
 	"strings"
 	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/cockroachdb/cockroach/pkg/base"
 	"github.com/cockroachdb/cockroach/pkg/jobs"
 	"github.com/cockroachdb/cockroach/pkg/jobs/jobstest"
 	"github.com/cockroachdb/cockroach/pkg/scheduledjobs"
+	"github.com/cockroachdb/cockroach/pkg/security/username"
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
 	"github.com/cockroachdb/cockroach/pkg/sql"
 	"github.com/cockroachdb/cockroach/pkg/sql/isql"
+	"github.com/cockroachdb/cockroach/pkg/sql/pgwire/pgcode"
+	"github.com/cockroachdb/cockroach/pkg/sql/pgwire/pgerror"
 	"github.com/cockroachdb/cockroach/pkg/sql/sem/tree"
 	"github.com/cockroachdb/cockroach/pkg/sql/sqlstats"
 	"github.com/cockroachdb/cockroach/pkg/sql/sqlstats/persistedsqlstats"
@@ -140,6 +148,7 @@ func TestScheduledSQLStatsCompaction(t *testing.T) {
 	helper.sqlDB.Exec(t, "SELECT 1; SELECT 1, 1")
 	helper.server.SQLServer().(*sql.Server).GetSQLStatsProvider().(*persistedsqlstats.PersistedSQLStats).Flush(ctx)
 	helper.sqlDB.Exec(t, "SET CLUSTER SETTING sql.stats.persisted_rows.max = 1")
+	helper.sqlDB.Exec(t, "SET CLUSTER SETTING sql.stats.cleanup.event_log.enabled = true")
 
 	stmtStatsCnt, txnStatsCnt := getPersistedStatsEntry(t, helper.sqlDB)
 	require.True(t, stmtStatsCnt >= 2,
@@ -162,11 +171,52 @@ func TestScheduledSQLStatsCompaction(t *testing.T) {
 	schedule = getSQLStatsCompactionSchedule(t, helper)
 	require.Equal(t, string(jobs.StatusSucceeded), schedule.ScheduleStatus())
 
+	// The job was started a minute after the run was due.
+	var scheduleLag int64
+	helper.sqlDB.QueryRow(t, `
+SELECT value
+FROM crdb_internal.node_metrics
+WHERE name = 'sql.stats.compaction.schedule_lag_seconds'`,
+	).Scan(&scheduleLag)
+	require.Equal(t, int64(time.Minute.Seconds()), scheduleLag)
+
 	stmtStatsCntPostCompact, txnStatsCntPostCompact := getPersistedStatsEntry(t, helper.sqlDB)
 	require.Less(t, stmtStatsCntPostCompact, stmtStatsCnt,
 		"expecting persisted stmt fingerprints count to be less than %d, but found: %d", stmtStatsCnt, stmtStatsCntPostCompact)
 	require.Less(t, txnStatsCntPostCompact, txnStatsCnt,
 		"expecting persisted txn fingerprints count to be less than %d, but found: %d", txnStatsCnt, txnStatsCntPostCompact)
+
+	// The run is recorded in system.sql_stats_compaction_runs.
+	var outcome string
+	var stmtRowsRemoved, txnRowsRemoved int64
+	helper.sqlDB.QueryRow(t, `
+SELECT outcome, stmt_rows_removed, txn_rows_removed
+FROM system.sql_stats_compaction_runs
+WHERE job_id IS NOT NULL`,
+	).Scan(&outcome, &stmtRowsRemoved, &txnRowsRemoved)
+	require.Equal(t, persistedsqlstats.CompactionRunSucceeded, outcome)
+	require.Positive(t, stmtRowsRemoved)
+	require.Positive(t, txnRowsRemoved)
+
+	// The start and the finish of the run are recorded in system.eventlog.
+	helper.sqlDB.CheckQueryResults(t, `
+SELECT "eventType", info::JSONB->>'Status', info::JSONB->>'JobType'
+FROM system.eventlog
+WHERE "eventType" LIKE 'sql_stats_compaction_%'
+ORDER BY timestamp`,
+		[][]string{
+			{"sql_stats_compaction_start", string(jobs.StatusRunning), "AUTO SQL STATS COMPACTION"},
+			{"sql_stats_compaction_finish", string(jobs.StatusSucceeded), "AUTO SQL STATS COMPACTION"},
+		},
+	)
+	var eventRowsRemoved, eventDuration int64
+	helper.sqlDB.QueryRow(t, `
+SELECT (info::JSONB->>'RowsRemoved')::INT8, (info::JSONB->>'Duration')::INT8
+FROM system.eventlog
+WHERE "eventType" = 'sql_stats_compaction_finish'`,
+	).Scan(&eventRowsRemoved, &eventDuration)
+	require.Equal(t, stmtRowsRemoved+txnRowsRemoved, eventRowsRemoved)
+	require.Positive(t, eventDuration)
 }
 
 func TestSQLStatsScheduleOperations(t *testing.T) {
@@ -196,14 +246,40 @@ func TestSQLStatsScheduleOperations(t *testing.T) {
 			fmt.Sprintf("SELECT schedule_status FROM [SHOW SCHEDULE %d]", schedID),
 			[][]string{{"PAUSED"}},
 		)
+		status, err := persistedsqlstats.CompactionScheduleStatus(
+			ctx, helper.server.InternalExecutor().(isql.Executor), helper.env)
+		require.NoError(t, err)
+		require.Equal(t, "PAUSED", status)
 
 		// Reload schedule from DB.
 		sj := getSQLStatsCompactionSchedule(t, helper)
-		err := persistedsqlstats.CheckScheduleAnomaly(sj)
+		err = persistedsqlstats.CheckScheduleAnomaly(sj)
 		require.True(t, errors.Is(err, persistedsqlstats.ErrSchedulePaused),
 			"expected ErrSchedulePaused, but found %+v", err)
 	})
 
+	t.Run("reject_schedule_short_run_interval", func(t *testing.T) {
+		helper.sqlDB.ExpectErr(t, "schedule interval too short",
+			"SET CLUSTER SETTING sql.stats.cleanup.recurrence = '@every 10s'")
+		helper.sqlDB.ExpectErr(t, "invalid cron expression",
+			"SET CLUSTER SETTING sql.stats.cleanup.recurrence = 'not a cron'")
+
+		// A recurrence of exactly the minimum interval is allowed.
+		helper.sqlDB.Exec(t, "SET CLUSTER SETTING sql.stats.cleanup.recurrence = '* * * * *'")
+
+		helper.sqlDB.Exec(t, "SET CLUSTER SETTING sql.stats.cleanup.min_recurrence_interval = '5m'")
+		helper.sqlDB.ExpectErr(t, "schedule interval too short",
+			"SET CLUSTER SETTING sql.stats.cleanup.recurrence = '0,1 * * * *'")
+		helper.sqlDB.Exec(t, "SET CLUSTER SETTING sql.stats.cleanup.recurrence = '*/5 * * * *'")
+
+		helper.sqlDB.Exec(t, "RESET CLUSTER SETTING sql.stats.cleanup.min_recurrence_interval")
+		helper.sqlDB.Exec(t, "RESET CLUSTER SETTING sql.stats.cleanup.recurrence")
+		helper.sqlDB.CheckQueryResultsRetry(t,
+			`SHOW CLUSTER SETTING sql.stats.cleanup.recurrence`,
+			[][]string{{"@hourly"}},
+		)
+	})
+
 	t.Run("warn_schedule_long_run_interval", func(t *testing.T) {
 		t.Run("via cluster setting", func(t *testing.T) {
 			// Craft an expression that next repeats next month.
@@ -267,3 +343,589 @@ FROM system.scheduled_jobs WHERE schedule_id = %d`, sj.ScheduleID()),
 		})
 	})
 }
+
+func TestSQLStatsScheduleClockSkew(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	now := time.Date(2023, time.June, 1, 10, 30, 0, 0, time.UTC)
+	env := jobstest.NewJobSchedulerTestEnv(
+		jobstest.UseSystemTables, now, tree.ScheduledSQLStatsCompactionExecutor)
+	sj := jobs.NewScheduledJob(env)
+	require.NoError(t, sj.SetSchedule("@hourly"))
+	require.Equal(t, now.Add(30*time.Minute), sj.NextRun())
+
+	for _, tc := range []struct {
+		name    string
+		nextRun time.Time
+		now     time.Time
+		skew    time.Duration
+		skewed  bool
+	}{
+		{name: "on time", nextRun: now.Add(30 * time.Minute), now: now},
+		{name: "waiting for scheduler", nextRun: now.Add(30 * time.Minute), now: now.Add(32 * time.Minute),
+			skew: 2 * time.Minute},
+		{name: "overdue", nextRun: now.Add(30 * time.Minute), now: now.Add(90 * time.Minute),
+			skew: time.Hour, skewed: true},
+		{name: "delayed", nextRun: now.Add(90 * time.Minute), now: now,
+			skew: time.Hour, skewed: true},
+		{name: "premature", nextRun: now.Add(10 * time.Minute), now: now,
+			skew: -20 * time.Minute, skewed: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			sj.SetNextRun(tc.nextRun)
+			skew, err := persistedsqlstats.CheckScheduleClockSkew(sj, tc.now)
+			require.Equal(t, tc.skew, skew)
+			if tc.skewed {
+				require.True(t, errors.Is(err, persistedsqlstats.ErrScheduleClockSkew),
+					"expected ErrScheduleClockSkew, but found %+v", err)
+			} else {
+				require.NoError(t, err)
+			}
+		})
+	}
+
+	t.Run("paused", func(t *testing.T) {
+		sj.SetNextRun(time.Time{})
+		skew, err := persistedsqlstats.CheckScheduleClockSkew(sj, now)
+		require.NoError(t, err)
+		require.Zero(t, skew)
+	})
+}
+
+func TestValidateScheduleRecurrence(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	st := cluster.MakeTestingClusterSettings()
+	now := time.Date(2023, time.June, 1, 10, 30, 0, 0, time.UTC)
+
+	t.Run("valid", func(t *testing.T) {
+		res := persistedsqlstats.ValidateScheduleRecurrence(&st.SV, "@hourly", now, 3 /* numRuns */)
+		require.NoError(t, res.Err)
+		require.Equal(t, []time.Time{
+			now.Add(30 * time.Minute),
+			now.Add(90 * time.Minute),
+			now.Add(150 * time.Minute),
+		}, res.NextRuns)
+		require.False(t, res.IntervalTooLong)
+		require.False(t, res.IntervalTooShort)
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		res := persistedsqlstats.ValidateScheduleRecurrence(&st.SV, "not a cron", now, 3 /* numRuns */)
+		require.True(t, testutils.IsError(res.Err, "invalid cron expression"), "%v", res.Err)
+		require.Empty(t, res.NextRuns)
+	})
+
+	t.Run("interval too short", func(t *testing.T) {
+		res := persistedsqlstats.ValidateScheduleRecurrence(&st.SV, "@every 10s", now, 2 /* numRuns */)
+		require.True(t, errors.Is(res.Err, persistedsqlstats.ErrScheduleIntervalTooShort), "%v", res.Err)
+		require.True(t, res.IntervalTooShort)
+		require.Equal(t, []time.Time{now.Add(10 * time.Second), now.Add(20 * time.Second)}, res.NextRuns)
+	})
+
+	t.Run("interval too long", func(t *testing.T) {
+		res := persistedsqlstats.ValidateScheduleRecurrence(&st.SV, "@weekly", now, 1 /* numRuns */)
+		require.NoError(t, res.Err)
+		require.True(t, res.IntervalTooLong)
+		require.Len(t, res.NextRuns, 1)
+	})
+}
+
+func TestSQLStatsValidateScheduleRecurrenceBuiltin(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	ctx := context.Background()
+	s, db, _ := serverutils.StartServer(t, base.TestServerArgs{})
+	defer s.Stopper().Stop(ctx)
+	sqlDB := sqlutils.MakeSQLRunner(db)
+
+	sqlDB.CheckQueryResults(t, `
+SELECT valid, error IS NULL, cardinality(next_runs), interval_too_long, interval_too_short
+FROM crdb_internal.validate_schedule_recurrence('@hourly')`,
+		[][]string{{"true", "true", "5", "false", "false"}})
+	sqlDB.CheckQueryResults(t, `
+SELECT valid, cardinality(next_runs), interval_too_short
+FROM crdb_internal.validate_schedule_recurrence('@every 10s', 2)`,
+		[][]string{{"false", "2", "true"}})
+	sqlDB.CheckQueryResults(t, `
+SELECT valid, error LIKE 'invalid cron expression%', next_runs
+FROM crdb_internal.validate_schedule_recurrence('not a cron')`,
+		[][]string{{"false", "true", "{}"}})
+	sqlDB.ExpectErr(t, "num_runs must be between 0 and 100",
+		"SELECT * FROM crdb_internal.validate_schedule_recurrence('@hourly', 1000)")
+
+	// The validation does not change the recurrence.
+	sqlDB.CheckQueryResults(t, "SHOW CLUSTER SETTING sql.stats.cleanup.recurrence",
+		[][]string{{"@hourly"}})
+}
+
+func TestSQLStatsSchedulesBuiltin(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	helper, helperCleanup := newTestHelper(t, &sqlstats.TestingKnobs{})
+	defer helperCleanup()
+
+	const query = `
+SELECT schedule_id, schedule_name, state, status, recurrence, next_run, last_run
+FROM crdb_internal.sql_stats_schedules()`
+	type scheduleRow struct {
+		id               int64
+		name, state      string
+		status           gosql.NullString
+		recurrence       string
+		nextRun, lastRun gosql.NullTime
+	}
+	readSchedules := func() (rows []scheduleRow) {
+		r := helper.sqlDB.Query(t, query)
+		defer r.Close()
+		for r.Next() {
+			var row scheduleRow
+			require.NoError(t, r.Scan(
+				&row.id, &row.name, &row.state, &row.status, &row.recurrence, &row.nextRun, &row.lastRun,
+			))
+			rows = append(rows, row)
+		}
+		require.NoError(t, r.Err())
+		return rows
+	}
+
+	// The compaction schedule is listed, and has not run yet.
+	schedule := getSQLStatsCompactionSchedule(t, helper)
+	rows := readSchedules()
+	require.Len(t, rows, 1)
+	require.Equal(t, schedule.ScheduleID(), rows[0].id)
+	require.Equal(t, "sql-stats-compaction", rows[0].name)
+	require.Equal(t, "ACTIVE", rows[0].state)
+	require.Equal(t, schedule.ScheduleStatus(), rows[0].status.String)
+	require.Equal(t, "@hourly", rows[0].recurrence)
+	require.True(t, rows[0].nextRun.Valid)
+	require.WithinDuration(t, schedule.NextRun(), rows[0].nextRun.Time, time.Microsecond)
+	require.False(t, rows[0].lastRun.Valid)
+
+	// Once the schedule has run, its last run is reported.
+	helper.env.SetTime(schedule.NextRun().Add(time.Minute))
+	require.NoError(t, helper.executeSchedules())
+	helper.waitForSuccessfulScheduledJob(t, schedule)
+	rows = readSchedules()
+	require.Len(t, rows, 1)
+	require.Equal(t, string(jobs.StatusSucceeded), rows[0].status.String)
+	require.True(t, rows[0].lastRun.Valid)
+
+	// A paused schedule has no next run.
+	helper.sqlDB.Exec(t, "PAUSE SCHEDULE $1", schedule.ScheduleID())
+	rows = readSchedules()
+	require.Len(t, rows, 1)
+	require.Equal(t, "PAUSED", rows[0].state)
+	require.False(t, rows[0].nextRun.Valid)
+}
+
+func TestSQLStatsScheduleExprInvalid(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	helper, helperCleanup := newTestHelper(t, &sqlstats.TestingKnobs{
+		JobMonitorUpdateCheckInterval: time.Second,
+		JobMonitorScanInterval:        time.Second,
+	})
+	defer helperCleanup()
+
+	sj := getSQLStatsCompactionSchedule(t, helper)
+	helper.sqlDB.Exec(t, `
+UPDATE system.scheduled_jobs
+SET schedule_expr = 'not a cron'
+WHERE schedule_id = $1`, sj.ScheduleID())
+
+	// The corrupted schedule may be repaired by the job monitor at any point,
+	// so we only check the anomaly if we loaded it before that.
+	sj = getSQLStatsCompactionSchedule(t, helper)
+	if sj.ScheduleExpr() == "not a cron" {
+		err := persistedsqlstats.CheckScheduleAnomaly(sj)
+		require.True(t, errors.Is(err, persistedsqlstats.ErrScheduleExprInvalid),
+			"expected ErrScheduleExprInvalid, but found %+v", err)
+	}
+
+	// The job monitor resets the schedule expression to the recurrence
+	// configured by sql.stats.cleanup.recurrence.
+	helper.sqlDB.CheckQueryResultsRetry(t,
+		fmt.Sprintf(`
+SELECT schedule_expr
+FROM system.scheduled_jobs WHERE schedule_id = %d`, sj.ScheduleID()),
+		[][]string{{"@hourly"}},
+	)
+	sj = getSQLStatsCompactionSchedule(t, helper)
+	require.NoError(t, persistedsqlstats.CheckScheduleAnomaly(sj))
+}
+
+func TestSQLStatsScheduleOwnerInvalid(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	ctx := context.Background()
+	helper, helperCleanup := newTestHelper(t, &sqlstats.TestingKnobs{
+		JobMonitorUpdateCheckInterval: time.Second,
+		JobMonitorScanInterval:        time.Second,
+	})
+	defer helperCleanup()
+
+	db := helper.server.InternalDB().(isql.DB)
+	reassign := func(owner username.SQLUsername) error {
+		return db.Txn(ctx, func(ctx context.Context, txn isql.Txn) error {
+			return persistedsqlstats.ReassignCompactionScheduleOwner(ctx, txn, owner)
+		})
+	}
+
+	require.True(t, testutils.IsError(
+		reassign(username.MakeSQLUsernameFromPreNormalizedString("nobody")), "does not exist"))
+
+	helper.sqlDB.Exec(t, "CREATE USER stats_owner")
+	require.NoError(t, reassign(username.MakeSQLUsernameFromPreNormalizedString("stats_owner")))
+	require.Equal(t, "stats_owner", getSQLStatsCompactionSchedule(t, helper).Owner().Normalized())
+
+	// The schedule owner cannot be dropped through DROP USER, but it can
+	// disappear if system.users is modified directly.
+	helper.sqlDB.ExpectErr(t, "it owns 1 scheduled jobs", "DROP USER stats_owner")
+	helper.sqlDB.Exec(t, "DELETE FROM system.users WHERE username = 'stats_owner'")
+
+	// The job monitor resets the owner of the schedule to the node user.
+	helper.sqlDB.CheckQueryResultsRetry(t, `
+SELECT owner
+FROM system.scheduled_jobs WHERE schedule_name = 'sql-stats-compaction'`,
+		[][]string{{username.NodeUser}},
+	)
+}
+
+func TestSQLStatsScheduleWrongExecutor(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	helper, helperCleanup := newTestHelper(t, &sqlstats.TestingKnobs{
+		JobMonitorUpdateCheckInterval: time.Second,
+		JobMonitorScanInterval:        time.Second,
+	})
+	defer helperCleanup()
+
+	sj := getSQLStatsCompactionSchedule(t, helper)
+	helper.sqlDB.Exec(t, `
+UPDATE system.scheduled_jobs
+SET executor_type = 'not-an-executor'
+WHERE schedule_id = $1`, sj.ScheduleID())
+
+	// The corrupted schedule may be repaired by the job monitor at any point,
+	// so we only check the anomaly if we loaded it before that.
+	sj = getSQLStatsCompactionSchedule(t, helper)
+	if sj.ExecutorType() == "not-an-executor" {
+		err := persistedsqlstats.CheckScheduleAnomaly(sj)
+		require.True(t, errors.Is(err, persistedsqlstats.ErrScheduleWrongExecutor),
+			"expected ErrScheduleWrongExecutor, but found %+v", err)
+	}
+
+	// The job monitor resets the executor type of the schedule.
+	helper.sqlDB.CheckQueryResultsRetry(t,
+		fmt.Sprintf(`
+SELECT executor_type
+FROM system.scheduled_jobs WHERE schedule_id = %d`, sj.ScheduleID()),
+		[][]string{{tree.ScheduledSQLStatsCompactionExecutor.InternalName()}},
+	)
+	sj = getSQLStatsCompactionSchedule(t, helper)
+	require.NoError(t, persistedsqlstats.CheckScheduleAnomaly(sj))
+	require.Equal(t, "@hourly", sj.ScheduleExpr())
+}
+
+func TestSQLStatsScheduleRecreatedAfterDelete(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	ctx := context.Background()
+	helper, helperCleanup := newTestHelper(t, &sqlstats.TestingKnobs{
+		JobMonitorUpdateCheckInterval: time.Second,
+		JobMonitorScanInterval:        time.Second,
+	})
+	defer helperCleanup()
+
+	schedID := getSQLStatsCompactionSchedule(t, helper).ScheduleID()
+
+	// The schedule cannot be dropped through DROP SCHEDULE, but it can
+	// disappear if system.scheduled_jobs is modified directly.
+	helper.sqlDB.Exec(t, "DELETE FROM system.scheduled_jobs WHERE schedule_id = $1", schedID)
+
+	// The job monitor recreates the schedule with the default recurrence and
+	// owner.
+	helper.sqlDB.CheckQueryResultsRetry(t, `
+SELECT schedule_expr, owner
+FROM system.scheduled_jobs WHERE schedule_name = 'sql-stats-compaction'`,
+		[][]string{{"@hourly", username.NodeUser}},
+	)
+	sj := getSQLStatsCompactionSchedule(t, helper)
+	require.NotEqual(t, schedID, sj.ScheduleID())
+	require.NoError(t, persistedsqlstats.CheckScheduleAnomaly(sj))
+
+	// The recreated schedule cannot be dropped either.
+	_, err := helper.sqlDB.DB.ExecContext(ctx, "DROP SCHEDULE $1", sj.ScheduleID())
+	require.True(t,
+		strings.Contains(err.Error(), persistedsqlstats.ErrScheduleUndroppable.Error()),
+		"expected to found ErrScheduleUndroppable, but found %+v", err)
+}
+
+func TestSQLStatsCompactionScheduleDisabledByKnob(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	helper, helperCleanup := newTestHelper(t, &sqlstats.TestingKnobs{
+		DisableSQLStatsCompactionSchedule: true,
+	})
+	defer helperCleanup()
+
+	countSchedules := func() (count int) {
+		helper.sqlDB.QueryRow(t, `
+SELECT count(*) FROM system.scheduled_jobs WHERE schedule_name = 'sql-stats-compaction'`,
+		).Scan(&count)
+		return count
+	}
+	require.Zero(t, countSchedules())
+
+	// The schedule can still be created explicitly.
+	helper.sqlDB.Exec(t, "SELECT crdb_internal.schedule_sql_stats_compaction()")
+	require.Equal(t, 1, countSchedules())
+}
+
+func TestSQLStatsScheduleConfigExportImport(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	ctx := context.Background()
+	helper, helperCleanup := newTestHelper(t, &sqlstats.TestingKnobs{
+		JobMonitorUpdateCheckInterval: time.Second,
+	})
+	defer helperCleanup()
+
+	db := helper.server.InternalDB().(isql.DB)
+	st := helper.server.ClusterSettings()
+
+	// The default configuration only carries the recurrence.
+	cfg, err := persistedsqlstats.ExportScheduleConfig(ctx, db, st)
+	require.NoError(t, err)
+	require.Equal(t, persistedsqlstats.ScheduleConfig{Recurrence: "@hourly"}, cfg)
+
+	helper.sqlDB.Exec(t, "SET CLUSTER SETTING sql.stats.cleanup.min_recurrence_interval = '30m'")
+	helper.sqlDB.Exec(t, "SET CLUSTER SETTING sql.stats.persisted_rows.max = 8")
+	helper.sqlDB.Exec(t, "SET CLUSTER SETTING sql.stats.cleanup.recurrence = '0 */2 * * *'")
+	helper.sqlDB.CheckQueryResultsRetry(t, `
+SELECT schedule_expr FROM system.scheduled_jobs WHERE schedule_name = 'sql-stats-compaction'`,
+		[][]string{{"0 */2 * * *"}},
+	)
+
+	cfg, err = persistedsqlstats.ExportScheduleConfig(ctx, db, st)
+	require.NoError(t, err)
+	expected := persistedsqlstats.ScheduleConfig{
+		Recurrence: "0 */2 * * *",
+		Settings: map[string]string{
+			"sql.stats.cleanup.min_recurrence_interval": "30m0s",
+			"sql.stats.persisted_rows.max":              "8",
+		},
+	}
+	require.Equal(t, expected, cfg)
+
+	// The configuration survives a round trip through JSON.
+	encoded, err := json.Marshal(cfg)
+	require.NoError(t, err)
+	var decoded persistedsqlstats.ScheduleConfig
+	require.NoError(t, json.Unmarshal(encoded, &decoded))
+	require.Equal(t, expected, decoded)
+
+	// Importing the configuration restores the settings and the schedule, and
+	// resets the settings that are not part of it.
+	helper.sqlDB.Exec(t, "RESET CLUSTER SETTING sql.stats.cleanup.recurrence")
+	helper.sqlDB.Exec(t, "RESET CLUSTER SETTING sql.stats.persisted_rows.max")
+	helper.sqlDB.Exec(t, "RESET CLUSTER SETTING sql.stats.cleanup.min_recurrence_interval")
+	helper.sqlDB.Exec(t, "SET CLUSTER SETTING sql.stats.cleanup.pinned_app_names = 'app'")
+	require.NoError(t, persistedsqlstats.ImportScheduleConfig(ctx, db, st, decoded))
+	helper.sqlDB.CheckQueryResultsRetry(t, `
+SELECT schedule_expr FROM system.scheduled_jobs WHERE schedule_name = 'sql-stats-compaction'`,
+		[][]string{{"0 */2 * * *"}},
+	)
+	helper.sqlDB.CheckQueryResults(t, "SHOW CLUSTER SETTING sql.stats.persisted_rows.max", [][]string{{"8"}})
+	helper.sqlDB.CheckQueryResults(t,
+		"SHOW CLUSTER SETTING sql.stats.cleanup.min_recurrence_interval", [][]string{{"00:30:00"}})
+	helper.sqlDB.CheckQueryResults(t,
+		"SHOW CLUSTER SETTING sql.stats.cleanup.pinned_app_names", [][]string{{""}})
+
+	t.Run("rejects invalid configurations", func(t *testing.T) {
+		for _, tc := range []struct {
+			name     string
+			cfg      persistedsqlstats.ScheduleConfig
+			expected error
+			errMsg   string
+		}{
+			{
+				name:     "invalid recurrence",
+				cfg:      persistedsqlstats.ScheduleConfig{Recurrence: "not a cron"},
+				expected: persistedsqlstats.ErrScheduleExprInvalid,
+			},
+			{
+				name:     "recurrence too long",
+				cfg:      persistedsqlstats.ScheduleConfig{Recurrence: "@weekly"},
+				expected: persistedsqlstats.ErrScheduleIntervalTooLong,
+			},
+			{
+				name: "recurrence too short",
+				cfg: persistedsqlstats.ScheduleConfig{
+					Recurrence: "*/10 * * * *",
+					Settings: map[string]string{
+						"sql.stats.cleanup.min_recurrence_interval": "30m0s",
+					},
+				},
+				expected: persistedsqlstats.ErrScheduleIntervalTooShort,
+			},
+			{
+				name: "unknown setting",
+				cfg: persistedsqlstats.ScheduleConfig{
+					Recurrence: "@hourly",
+					Settings:   map[string]string{"sql.stats.flush.enabled": "false"},
+				},
+				errMsg: "is not a setting of the SQL stats compaction",
+			},
+		} {
+			t.Run(tc.name, func(t *testing.T) {
+				err := persistedsqlstats.ImportScheduleConfig(ctx, db, st, tc.cfg)
+				require.Error(t, err)
+				if tc.expected != nil {
+					require.True(t, errors.Is(err, tc.expected), "unexpected error: %+v", err)
+				} else {
+					require.Contains(t, err.Error(), tc.errMsg)
+				}
+			})
+		}
+		// The rejected configurations are not applied.
+		helper.sqlDB.CheckQueryResults(t, "SHOW CLUSTER SETTING sql.stats.persisted_rows.max", [][]string{{"8"}})
+		helper.sqlDB.CheckQueryResults(t,
+			"SHOW CLUSTER SETTING sql.stats.cleanup.recurrence", [][]string{{"0 */2 * * *"}})
+	})
+}
+
+func TestSQLStatsCompactionPause(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	helper, helperCleanup := newTestHelper(t, &sqlstats.TestingKnobs{JobMonitorUpdateCheckInterval: time.Second})
+	defer helperCleanup()
+
+	t.Run("rejects invalid durations", func(t *testing.T) {
+		helper.sqlDB.ExpectErr(t, "pause duration must be positive",
+			"SELECT crdb_internal.pause_sql_stats_compaction('0s')")
+		helper.sqlDB.ExpectErr(t, "exceeds the maximum of 24h0m0s",
+			"SELECT crdb_internal.pause_sql_stats_compaction('25h')")
+	})
+
+	t.Run("pauses with auto-resume", func(t *testing.T) {
+		before := timeutil.Now()
+		var resumeAt time.Time
+		helper.sqlDB.QueryRow(t,
+			"SELECT crdb_internal.pause_sql_stats_compaction('2h')").Scan(&resumeAt)
+		require.False(t, resumeAt.Before(before.Add(2*time.Hour)))
+
+		// The schedule does not run again until the pause expires, at which
+		// point it resumes its usual recurrence.
+		sj := getSQLStatsCompactionSchedule(t, helper)
+		require.WithinDuration(t, resumeAt, sj.NextRun(), time.Millisecond)
+		require.Contains(t, sj.ScheduleStatus(), "paused until")
+		require.Equal(t, "@hourly", sj.ScheduleExpr())
+		require.NoError(t, persistedsqlstats.CheckScheduleAnomaly(sj))
+		// The pushed back next run is not reported as skewed.
+		_, err := persistedsqlstats.CheckScheduleClockSkew(sj, timeutil.Now())
+		require.NoError(t, err)
+	})
+
+	t.Run("keeps the pause when the recurrence changes", func(t *testing.T) {
+		var resumeAt time.Time
+		helper.sqlDB.QueryRow(t,
+			"SELECT crdb_internal.pause_sql_stats_compaction('2h')").Scan(&resumeAt)
+		helper.sqlDB.Exec(t, "SET CLUSTER SETTING sql.stats.cleanup.recurrence = '*/5 * * * *'")
+		defer helper.sqlDB.Exec(t, "RESET CLUSTER SETTING sql.stats.cleanup.recurrence")
+
+		// The job monitor applies the new recurrence, but the schedule does
+		// not run before the end of the pause.
+		testutils.SucceedsSoon(t, func() error {
+			sj := getSQLStatsCompactionSchedule(t, helper)
+			if sj.ScheduleExpr() != "*/5 * * * *" {
+				return errors.Newf("recurrence not updated yet: %s", sj.ScheduleExpr())
+			}
+			return nil
+		})
+		sj := getSQLStatsCompactionSchedule(t, helper)
+		require.WithinDuration(t, resumeAt, sj.NextRun(), time.Millisecond)
+		require.Contains(t, sj.ScheduleStatus(), "paused until")
+	})
+
+	t.Run("respects the configured maximum", func(t *testing.T) {
+		helper.sqlDB.Exec(t, "SET CLUSTER SETTING sql.stats.cleanup.max_pause_duration = '1h'")
+		helper.sqlDB.ExpectErr(t, "exceeds the maximum of 1h0m0s",
+			"SELECT crdb_internal.pause_sql_stats_compaction('2h')")
+	})
+}
+
+// flakyScheduleStoreDB is an isql.DB whose transactions fail until failures
+// reaches zero, with a range unavailable error, or with an uncategorized
+// error if uncategorized is set.
+type flakyScheduleStoreDB struct {
+	isql.DB
+	failures      int64
+	uncategorized int32
+}
+
+func (db *flakyScheduleStoreDB) Txn(
+	ctx context.Context, f func(context.Context, isql.Txn) error, opts ...isql.TxnOption,
+) error {
+	if atomic.AddInt64(&db.failures, -1) >= 0 {
+		if atomic.LoadInt32(&db.uncategorized) != 0 {
+			return errors.New("system.scheduled_jobs is broken")
+		}
+		return pgerror.New(pgcode.RangeUnavailable, "system.scheduled_jobs is unavailable")
+	}
+	return db.DB.Txn(ctx, f, opts...)
+}
+
+func TestSQLStatsScheduleStoreUnavailable(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	ctx := context.Background()
+	helper, helperCleanup := newTestHelper(t, &sqlstats.TestingKnobs{JobMonitorUpdateCheckInterval: time.Second})
+	defer helperCleanup()
+
+	sqlStats := helper.server.SQLServer().(*sql.Server).GetSQLStatsProvider().(*persistedsqlstats.PersistedSQLStats)
+	db := &flakyScheduleStoreDB{DB: helper.server.InternalDB().(isql.DB)}
+	controller := persistedsqlstats.NewController(sqlStats, nil /* status */, db)
+
+	t.Run("retries transient failures", func(t *testing.T) {
+		atomic.StoreInt64(&db.failures, 2)
+		_, err := controller.PauseSQLStatsCompaction(ctx, time.Hour)
+		require.NoError(t, err)
+		require.Contains(t, getSQLStatsCompactionSchedule(t, helper).ScheduleStatus(), "paused until")
+	})
+
+	t.Run("reports the store as unavailable", func(t *testing.T) {
+		atomic.StoreInt64(&db.failures, math.MaxInt64)
+		_, err := controller.PauseSQLStatsCompaction(ctx, time.Hour)
+		require.True(t, errors.Is(err, persistedsqlstats.ErrScheduleStoreUnavailable), "%+v", err)
+		require.Equal(t, pgcode.RangeUnavailable, pgerror.GetPGCode(err))
+
+		// The schedule is not recreated because of the failures.
+		verifySQLStatsCompactionScheduleCreatedOnStartup(t, helper)
+	})
+
+	t.Run("does not retry uncategorized failures", func(t *testing.T) {
+		atomic.StoreInt32(&db.uncategorized, 1)
+		defer atomic.StoreInt32(&db.uncategorized, 0)
+		atomic.StoreInt64(&db.failures, 2)
+		_, err := controller.PauseSQLStatsCompaction(ctx, time.Hour)
+		require.Error(t, err)
+		require.False(t, errors.Is(err, persistedsqlstats.ErrScheduleStoreUnavailable), "%+v", err)
+		// A single attempt was made.
+		require.Equal(t, int64(1), atomic.LoadInt64(&db.failures))
+		atomic.StoreInt64(&db.failures, 0)
+	})
+}
@@ -0,0 +1,180 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package sqlstatsutil
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+
+	"github.com/cockroachdb/cockroach/pkg/util/json"
+	"github.com/cockroachdb/errors"
+	"github.com/golang/snappy"
+)
+
+const (
+	// queryKey is the key of the statement text in the metadata of statement
+	// statistics.
+	queryKey = "query"
+	// compressedQueryKey is the key under which CompressStmtMetadataJSON
+	// stores the compressed statement text, in place of queryKey.
+	compressedQueryKey = "queryCompressed"
+	// compressedPlanKey is the only key of a plan compressed by
+	// CompressPlanJSON. It cannot collide with the keys of the JSON produced
+	// by ExplainTreePlanNodeToJSON.
+	compressedPlanKey = "compressed"
+)
+
+// The compressed text can also be restored in SQL, with the decompress
+// builtin, which expects the snappy framing format. The following expressions
+// restore the metadata and plan columns of system.statement_statistics, so
+// that the SQL readers of these columns, e.g. the virtual tables, do not
+// depend on sql.stats.flush.compress_text.
+const (
+	// StmtQuerySQL is a SQL expression returning the statement text of the
+	// metadata column, decompressed if needed.
+	StmtQuerySQL = `COALESCE(metadata ->> 'query', ` +
+		`convert_from(decompress(decode(metadata ->> 'queryCompressed', 'base64'), 'snappy'), 'UTF8'))`
+	// DecompressedStmtMetadataSQL is a SQL expression returning the metadata
+	// column restored as by DecompressStmtMetadataJSON.
+	DecompressedStmtMetadataSQL = `CASE WHEN metadata ? 'queryCompressed' ` +
+		`THEN (metadata - 'queryCompressed') || jsonb_build_object('query', ` + StmtQuerySQL + `) ` +
+		`ELSE metadata END`
+	// DecompressedPlanSQL is a SQL expression returning the plan column
+	// restored as by DecompressPlanJSON. The keys of the plans are
+	// capitalized, so only a compressed plan has the compressedPlanKey key.
+	DecompressedPlanSQL = `CASE WHEN plan ? 'compressed' ` +
+		`THEN convert_from(decompress(decode(plan ->> 'compressed', 'base64'), 'snappy'), 'UTF8')::JSONB ` +
+		`ELSE plan END`
+)
+
+// CompressStmtMetadataJSON replaces the statement text of the given metadata
+// of statement statistics with its compressed form if the text is at least
+// minBytes long. The text is compressed with snappy, in the framing format,
+// and encoded in base64, since JSON cannot hold arbitrary bytes. The other fields, including the
+// query summary, are left as is, so that they can still be queried in SQL.
+// The metadata is restored by DecompressStmtMetadataJSON.
+func CompressStmtMetadataJSON(metadata json.JSON, minBytes int) (json.JSON, error) {
+	queryJSON, err := metadata.FetchValKey(queryKey)
+	if err != nil || queryJSON == nil {
+		return metadata, err
+	}
+	query, err := queryJSON.AsText()
+	if err != nil || query == nil || len(*query) < minBytes {
+		return metadata, err
+	}
+	compressed, err := compressText(*query)
+	if err != nil {
+		return nil, err
+	}
+	return replaceObjectKey(metadata, queryKey, compressedQueryKey, compressed)
+}
+
+// DecompressStmtMetadataJSON restores the statement text of metadata
+// compressed by CompressStmtMetadataJSON. The metadata that is not compressed
+// is returned as is.
+func DecompressStmtMetadataJSON(metadata json.JSON) (json.JSON, error) {
+	compressed, err := metadata.FetchValKey(compressedQueryKey)
+	if err != nil || compressed == nil {
+		return metadata, err
+	}
+	query, err := decompressText(compressed)
+	if err != nil {
+		return nil, errors.Wrap(err, "decompressing statement text")
+	}
+	return replaceObjectKey(metadata, compressedQueryKey, queryKey, json.FromString(query))
+}
+
+// CompressPlanJSON replaces the given plan, as produced by
+// ExplainTreePlanNodeToJSON, with an object holding its compressed text
+// representation if the text is at least minBytes long. The plan is restored
+// by DecompressPlanJSON.
+func CompressPlanJSON(plan json.JSON, minBytes int) (json.JSON, error) {
+	text := plan.String()
+	if len(text) < minBytes {
+		return plan, nil
+	}
+	compressed, err := compressText(text)
+	if err != nil {
+		return nil, err
+	}
+	builder := json.NewObjectBuilder(1 /* numAddsHint */)
+	builder.Add(compressedPlanKey, compressed)
+	return builder.Build(), nil
+}
+
+// DecompressPlanJSON restores a plan compressed by CompressPlanJSON. The plan
+// that is not compressed is returned as is.
+func DecompressPlanJSON(plan json.JSON) (json.JSON, error) {
+	if plan.Type() != json.ObjectJSONType || plan.Len() != 1 {
+		return plan, nil
+	}
+	compressed, err := plan.FetchValKey(compressedPlanKey)
+	if err != nil || compressed == nil {
+		return plan, err
+	}
+	text, err := decompressText(compressed)
+	if err != nil {
+		return nil, errors.Wrap(err, "decompressing plan")
+	}
+	return json.ParseJSON(text)
+}
+
+func compressText(text string) (json.JSON, error) {
+	var buf bytes.Buffer
+	w := snappy.NewBufferedWriter(&buf)
+	if _, err := w.Write([]byte(text)); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return json.FromString(base64.StdEncoding.EncodeToString(buf.Bytes())), nil
+}
+
+func decompressText(compressed json.JSON) (string, error) {
+	encoded, err := compressed.AsText()
+	if err != nil {
+		return "", err
+	}
+	if encoded == nil {
+		return "", errors.New("compressed text is null")
+	}
+	b, err := base64.StdEncoding.DecodeString(*encoded)
+	if err != nil {
+		return "", err
+	}
+	text, err := io.ReadAll(snappy.NewReader(bytes.NewReader(b)))
+	if err != nil {
+		return "", err
+	}
+	return string(text), nil
+}
+
+// replaceObjectKey returns a copy of the given JSON object in which the value
+// of oldKey is removed, and newKey is set to value.
+func replaceObjectKey(obj json.JSON, oldKey, newKey string, value json.JSON) (json.JSON, error) {
+	it, err := obj.ObjectIter()
+	if err != nil {
+		return nil, err
+	}
+	if it == nil {
+		return nil, errors.AssertionFailedf("expected a JSON object, found %s", obj.Type())
+	}
+	builder := json.NewObjectBuilder(obj.Len())
+	for it.Next() {
+		if key := it.Key(); key != oldKey && key != newKey {
+			builder.Add(key, it.Value())
+		}
+	}
+	builder.Add(newKey, value)
+	return builder.Build(), nil
+}
@@ -0,0 +1,164 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package sqlstatsutil
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/appstatspb"
+	"github.com/cockroachdb/cockroach/pkg/util/json"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/stretchr/testify/require"
+)
+
+// genLargeStmtStats returns statement statistics whose query and plan
+// consist of the given number of columns.
+func genLargeStmtStats(columns int) *appstatspb.CollectedStatementStatistics {
+	var query strings.Builder
+	query.WriteString("SELECT ")
+	plan := appstatspb.ExplainTreePlanNode{Name: "render"}
+	for i := 0; i < columns; i++ {
+		if i > 0 {
+			query.WriteString(", ")
+		}
+		fmt.Fprintf(&query, "_ AS column_%d", i)
+		plan.Attrs = append(plan.Attrs, &appstatspb.ExplainTreePlanNode_Attr{
+			Key:   fmt.Sprintf("render_%d", i),
+			Value: fmt.Sprintf("column_%d", i),
+		})
+	}
+	stats := &appstatspb.CollectedStatementStatistics{}
+	stats.Key.Query = query.String()
+	stats.Key.QuerySummary = "SELECT _ AS column_0, ..."
+	stats.Key.Database = "defaultdb"
+	stats.Stats.SQLType = "TypeDML"
+	stats.Stats.SensitiveInfo.MostRecentPlanDescription = plan
+	return stats
+}
+
+func TestCompressStmtMetadataAndPlanJSON(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	stats := genLargeStmtStats(100 /* columns */)
+	metadata, err := BuildStmtMetadataJSON(stats)
+	require.NoError(t, err)
+	plan := ExplainTreePlanNodeToJSON(&stats.Stats.SensitiveInfo.MostRecentPlanDescription)
+
+	t.Run("below minimum size", func(t *testing.T) {
+		compressed, err := CompressStmtMetadataJSON(metadata, len(stats.Key.Query)+1)
+		require.NoError(t, err)
+		jsonTestHelper(t, metadata.String(), compressed)
+
+		compressed, err = CompressPlanJSON(plan, len(plan.String())+1)
+		require.NoError(t, err)
+		jsonTestHelper(t, plan.String(), compressed)
+	})
+
+	t.Run("round trip", func(t *testing.T) {
+		compressedMetadata, err := CompressStmtMetadataJSON(metadata, 0 /* minBytes */)
+		require.NoError(t, err)
+		query, err := compressedMetadata.FetchValKey(queryKey)
+		require.NoError(t, err)
+		require.Nil(t, query)
+		summary, err := compressedMetadata.FetchValKey("querySummary")
+		require.NoError(t, err)
+		require.NotNil(t, summary)
+		require.Less(t, len(compressedMetadata.String()), len(metadata.String()))
+
+		var decoded appstatspb.CollectedStatementStatistics
+		require.NoError(t, DecodeStmtStatsMetadataJSON(compressedMetadata, &decoded))
+		require.Equal(t, stats.Key.Query, decoded.Key.Query)
+		require.Equal(t, stats.Key.QuerySummary, decoded.Key.QuerySummary)
+		require.Equal(t, stats.Stats.SQLType, decoded.Stats.SQLType)
+
+		compressedPlan, err := CompressPlanJSON(plan, 0 /* minBytes */)
+		require.NoError(t, err)
+		require.Less(t, len(compressedPlan.String()), len(plan.String()))
+		decodedPlan, err := JSONToExplainTreePlanNode(compressedPlan)
+		require.NoError(t, err)
+		jsonTestHelper(t, plan.String(), ExplainTreePlanNodeToJSON(decodedPlan))
+	})
+
+	t.Run("not compressed", func(t *testing.T) {
+		decompressed, err := DecompressStmtMetadataJSON(metadata)
+		require.NoError(t, err)
+		jsonTestHelper(t, metadata.String(), decompressed)
+
+		decompressed, err = DecompressPlanJSON(plan)
+		require.NoError(t, err)
+		jsonTestHelper(t, plan.String(), decompressed)
+	})
+
+	t.Run("corrupted", func(t *testing.T) {
+		corrupted, err := json.ParseJSON(`{"queryCompressed": "not base64!"}`)
+		require.NoError(t, err)
+		_, err = DecompressStmtMetadataJSON(corrupted)
+		require.ErrorContains(t, err, "decompressing statement text")
+	})
+}
+
+// BenchmarkCompressStmtStatsJSON measures the CPU cost of the compression of
+// the statement text and plan of various sizes, and reports the ratio of the
+// size of the compressed fields to the size of the original ones.
+func BenchmarkCompressStmtStatsJSON(b *testing.B) {
+	defer log.Scope(b).Close(b)
+
+	for _, columns := range []int{10, 100, 1000} {
+		stats := genLargeStmtStats(columns)
+		metadata, err := BuildStmtMetadataJSON(stats)
+		if err != nil {
+			b.Fatal(err)
+		}
+		plan := ExplainTreePlanNodeToJSON(&stats.Stats.SensitiveInfo.MostRecentPlanDescription)
+		uncompressedSize := len(metadata.String()) + len(plan.String())
+
+		compressedMetadata, err := CompressStmtMetadataJSON(metadata, 0 /* minBytes */)
+		if err != nil {
+			b.Fatal(err)
+		}
+		compressedPlan, err := CompressPlanJSON(plan, 0 /* minBytes */)
+		if err != nil {
+			b.Fatal(err)
+		}
+		compressedSize := len(compressedMetadata.String()) + len(compressedPlan.String())
+
+		b.Run(fmt.Sprintf("columns=%d", columns), func(b *testing.B) {
+			b.Run("compress", func(b *testing.B) {
+				b.SetBytes(int64(uncompressedSize))
+				for i := 0; i < b.N; i++ {
+					if _, err := CompressStmtMetadataJSON(metadata, 0 /* minBytes */); err != nil {
+						b.Fatal(err)
+					}
+					if _, err := CompressPlanJSON(plan, 0 /* minBytes */); err != nil {
+						b.Fatal(err)
+					}
+				}
+				b.ReportMetric(float64(compressedSize)/float64(uncompressedSize), "size-ratio")
+			})
+
+			b.Run("decompress", func(b *testing.B) {
+				b.SetBytes(int64(uncompressedSize))
+				for i := 0; i < b.N; i++ {
+					if _, err := DecompressStmtMetadataJSON(compressedMetadata); err != nil {
+						b.Fatal(err)
+					}
+					if _, err := DecompressPlanJSON(compressedPlan); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		})
+	}
+}
@@ -38,10 +38,15 @@ func DecodeTxnStatsStatisticsJSON(
 
 // DecodeStmtStatsMetadataJSON decodes the 'metadata' field of the JSON
 // representation of the statement statistics into
-// appstatspb.CollectedStatementStatistics.
+// appstatspb.CollectedStatementStatistics. The statement text compressed by
+// CompressStmtMetadataJSON is decompressed.
 func DecodeStmtStatsMetadataJSON(
 	metadata json.JSON, result *appstatspb.CollectedStatementStatistics,
 ) error {
+	metadata, err := DecompressStmtMetadataJSON(metadata)
+	if err != nil {
+		return err
+	}
 	return (*stmtStatsMetadata)(result).jsonFields().decodeJSON(metadata)
 }
 
@@ -62,8 +67,13 @@ func DecodeStmtStatsStatisticsJSON(
 }
 
 // JSONToExplainTreePlanNode decodes the JSON-formatted ExplainTreePlanNode
-// produced by ExplainTreePlanNodeToJSON.
+// produced by ExplainTreePlanNodeToJSON, which may have been compressed by
+// CompressPlanJSON.
 func JSONToExplainTreePlanNode(jsonVal json.JSON) (*appstatspb.ExplainTreePlanNode, error) {
+	jsonVal, err := DecompressPlanJSON(jsonVal)
+	if err != nil {
+		return nil, err
+	}
 	node := appstatspb.ExplainTreePlanNode{}
 
 	nameAttr, err := jsonVal.FetchValKey("Name")
@@ -51,6 +51,7 @@ func ExplainTreePlanNodeToJSON(node *appstatspb.ExplainTreePlanNode) json.JSON {
 //	  "type": "object",
 //	  "properties": {
 //	    "stmtTyp":              { "type": "string" },
+//	    "stmtTag":              { "type": "string" },
 //	    "query":                { "type": "string" },
 //	    "db":                   { "type": "string" },
 //	    "distsql":              { "type": "boolean" },
@@ -42,6 +42,7 @@ func TestSQLStatsJsonEncoding(t *testing.T) {
 		expectedMetadataStrTemplate := `
 {
   "stmtTyp":      "{{.String}}",
+  "stmtTag":      "{{.String}}",
   "query":        "{{.String}}",
   "querySummary": "{{.String}}",
   "db":           "{{.String}}",
@@ -93,6 +93,7 @@ type stmtStatsMetadata appstatspb.CollectedStatementStatistics
 func (s *stmtStatsMetadata) jsonFields() jsonFields {
 	return jsonFields{
 		{"stmtTyp", (*jsonString)(&s.Stats.SQLType)},
+		{"stmtTag", (*jsonString)(&s.Stats.StatementTag)},
 		{"query", (*jsonString)(&s.Key.Query)},
 		{"querySummary", (*jsonString)(&s.Key.QuerySummary)},
 		{"db", (*jsonString)(&s.Key.Database)},
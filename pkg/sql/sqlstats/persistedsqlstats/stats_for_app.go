@@ -0,0 +1,103 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package persistedsqlstats
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/pgwire/pgcode"
+	"github.com/cockroachdb/cockroach/pkg/sql/pgwire/pgerror"
+	"github.com/cockroachdb/cockroach/pkg/sql/sem/catconstants"
+	"github.com/cockroachdb/cockroach/pkg/sql/sem/eval"
+	"github.com/cockroachdb/cockroach/pkg/sql/sem/tree"
+	"github.com/cockroachdb/cockroach/pkg/sql/sessiondata"
+	"github.com/cockroachdb/errors"
+)
+
+// MaxAppFingerprints is the maximum number of statement fingerprints returned
+// by GetSQLStatsForApp.
+const MaxAppFingerprints = 1000
+
+// GetSQLStatsForApp implements the eval.SQLStatsController interface. The
+// persisted counts are read through the execution_count_idx partial index of
+// system.statement_statistics, which covers the query, rather than through the
+// primary index, whose rows hold the statistics JSON. As that index excludes
+// the internal applications, their stats are not supported. Like
+// GetSQLStatsFingerprintDetail, the counts include the rows persisted under
+// the hash of the application name, see sql.stats.flush.hash_app_names.
+//
+// The index leads with aggregated_ts, so the predicate on the application
+// name does not constrain the scan: without since, the whole index is read. If
+// since is set, only the aggregation windows starting at or after since are
+// read.
+func (s *Controller) GetSQLStatsForApp(
+	ctx context.Context, appName string, since time.Time, opts eval.SQLStatsReadOptions,
+) (fingerprints []eval.SQLStatsAppFingerprint, retErr error) {
+	if strings.HasPrefix(appName, catconstants.InternalAppNamePrefix) {
+		return nil, pgerror.Newf(pgcode.InvalidParameterValue,
+			"the stats of the internal application %q are not supported", appName)
+	}
+
+	qargs := []interface{}{appName, hashAppName(&s.st.SV, appName), MaxAppFingerprints}
+	var sincePredicate string
+	if !since.IsZero() {
+		sinceDatum, err := tree.MakeDTimestampTZ(since, time.Microsecond)
+		if err != nil {
+			return nil, err
+		}
+		sincePredicate = "AND aggregated_ts >= $4"
+		qargs = append(qargs, sinceDatum)
+	}
+
+	// The predicate on the prefix of the application name is implied by the
+	// one on the name itself, but it is spelled out for the optimizer to match
+	// the predicate of the partial index.
+	it, err := s.db.Executor().QueryIteratorEx(
+		ctx,
+		"sql-stats-for-app",
+		nil, /* txn */
+		sessiondata.NodeUserSessionDataOverride,
+		fmt.Sprintf(`
+SELECT fingerprint_id,
+       sum(execution_count)::INT8,
+       count(DISTINCT aggregated_ts),
+       min(aggregated_ts),
+       max(aggregated_ts)
+FROM system.statement_statistics %s
+WHERE app_name IN ($1, $2) AND app_name NOT LIKE '$ internal%%' %s
+GROUP BY fingerprint_id
+ORDER BY 2 DESC, fingerprint_id
+LIMIT $3`, getReadAOSTClause(s.knobs, opts), sincePredicate),
+		qargs...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		retErr = errors.CombineErrors(retErr, it.Close())
+	}()
+
+	var ok bool
+	for ok, err = it.Next(ctx); ok; ok, err = it.Next(ctx) {
+		row := it.Cur()
+		fingerprints = append(fingerprints, eval.SQLStatsAppFingerprint{
+			FingerprintID:     []byte(tree.MustBeDBytes(row[0])),
+			ExecutionCount:    int64(tree.MustBeDInt(row[1])),
+			Windows:           int64(tree.MustBeDInt(row[2])),
+			FirstAggregatedTs: tree.MustBeDTimestampTZ(row[3]).Time,
+			LastAggregatedTs:  tree.MustBeDTimestampTZ(row[4]).Time,
+		})
+	}
+	return fingerprints, err
+}
@@ -0,0 +1,164 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package persistedsqlstats
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/keys"
+	"github.com/cockroachdb/cockroach/pkg/kv/kvserver/protectedts/ptpb"
+	"github.com/cockroachdb/cockroach/pkg/sql/catalog/descpb"
+	"github.com/cockroachdb/cockroach/pkg/sql/isql"
+	"github.com/cockroachdb/cockroach/pkg/sql/sem/tree"
+	"github.com/cockroachdb/cockroach/pkg/sql/sessiondata"
+	"github.com/cockroachdb/cockroach/pkg/util/hlc"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/cockroachdb/cockroach/pkg/util/timeutil"
+	"github.com/cockroachdb/cockroach/pkg/util/uuid"
+	"github.com/cockroachdb/errors"
+)
+
+// StatsProtectionMetaType is the meta type of the protected timestamp records
+// written by ProtectStats.
+const StatsProtectionMetaType = "sql_stats"
+
+// statsProtectionExpiry bounds how long a protection written by ProtectStats
+// is honored. Past it, the compaction ignores the protection and the protected
+// timestamp reconciler removes its record, so that a reader that never
+// released its protection, e.g. because its node crashed, does not hold back
+// the compaction and the GC of the stats tables forever.
+const statsProtectionExpiry = time.Hour
+
+// statsProtectionMeta is the meta of the protected timestamp records written
+// by ProtectStats, encoded in JSON.
+type statsProtectionMeta struct {
+	// Since is the aggregated_ts from which the rows are protected from the
+	// compaction.
+	Since time.Time `json:"since"`
+	// ExpiresAt is the time after which the protection is no longer honored,
+	// see statsProtectionExpiry.
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// ProtectStats protects the persisted stats that an external reader, e.g.
+// ExportJSON, reads as of asOf, or as of now if asOf is zero, until the
+// returned function releases the protection:
+//
+//   - the stats tables are protected from GC as of the read timestamp with a
+//     protected timestamp record, so that the historical read does not fail
+//     mid-way because the GC threshold moved past it;
+//   - the rows aggregated at or after since are not removed by the
+//     compaction, on any node, see loadStatsProtections.
+//
+// A protection that is not released expires after statsProtectionExpiry. If
+// the protected timestamp subsystem is not configured, no protection is taken
+// and the returned function is a no-op.
+func (s *PersistedSQLStats) ProtectStats(
+	ctx context.Context, asOf, since time.Time,
+) (release func(context.Context), _ error) {
+	if s.cfg.ProtectedTimestamps == nil {
+		return func(context.Context) {}, nil
+	}
+	now := timeutil.Now()
+	if asOf.IsZero() {
+		asOf = now
+	}
+	meta, err := json.Marshal(statsProtectionMeta{
+		Since:     since,
+		ExpiresAt: now.Add(statsProtectionExpiry),
+	})
+	if err != nil {
+		return nil, err
+	}
+	id := uuid.MakeV4()
+	record := &ptpb.Record{
+		ID:        id.GetBytesMut(),
+		Timestamp: hlc.Timestamp{WallTime: asOf.UnixNano()},
+		Mode:      ptpb.PROTECT_AFTER,
+		MetaType:  StatsProtectionMetaType,
+		Meta:      meta,
+		Target: ptpb.MakeSchemaObjectsTarget(descpb.IDs{
+			keys.StatementStatisticsTableID, keys.TransactionStatisticsTableID,
+		}),
+	}
+	if err := s.cfg.DB.Txn(ctx, func(ctx context.Context, txn isql.Txn) error {
+		return s.cfg.ProtectedTimestamps.WithTxn(txn).Protect(ctx, record)
+	}); err != nil {
+		return nil, errors.Wrap(err, "protecting the SQL stats")
+	}
+
+	return func(ctx context.Context) {
+		if err := s.cfg.DB.Txn(ctx, func(ctx context.Context, txn isql.Txn) error {
+			return s.cfg.ProtectedTimestamps.WithTxn(txn).Release(ctx, id)
+		}); err != nil {
+			log.Warningf(ctx, "failed to release the protection %s of the SQL stats, "+
+				"it expires at %s: %v", id, now.Add(statsProtectionExpiry), err)
+		}
+	}, nil
+}
+
+// StatsProtectionStatusFunc is the protected timestamp reconciler status
+// function of the records written by ProtectStats: the records are removed
+// once expired.
+func StatsProtectionStatusFunc(
+	_ context.Context, _ isql.Txn, meta []byte,
+) (shouldRemove bool, _ error) {
+	var m statsProtectionMeta
+	if err := json.Unmarshal(meta, &m); err != nil {
+		// A record that cannot be decoded cannot be honored either.
+		return true, nil //nolint:returnerrcheck
+	}
+	return timeutil.Now().After(m.ExpiresAt), nil
+}
+
+// loadStatsProtections reads the protections written by ProtectStats that
+// have not expired, and holds back the compaction run that follows at the
+// earliest aggregated_ts they protect, see getGraceCutoff.
+func (c *StatsCompactor) loadStatsProtections(ctx context.Context) error {
+	c.protectedSince = nil
+	rows, err := c.db.Executor().QueryBufferedEx(ctx,
+		"sql-stats-protections",
+		nil, /* txn */
+		sessiondata.NodeUserSessionDataOverride,
+		`SELECT meta FROM system.protected_ts_records WHERE meta_type = $1`,
+		StatsProtectionMetaType,
+	)
+	if err != nil {
+		return errors.Wrap(err, "reading the protections of the SQL stats")
+	}
+	now := timeutil.Now()
+	var active int
+	for _, row := range rows {
+		if row[0] == tree.DNull {
+			continue
+		}
+		var m statsProtectionMeta
+		if err := json.Unmarshal([]byte(tree.MustBeDBytes(row[0])), &m); err != nil {
+			log.Warningf(ctx, "ignoring undecodable protection of the SQL stats: %v", err)
+			continue
+		}
+		if now.After(m.ExpiresAt) {
+			continue
+		}
+		active++
+		if c.protectedSince == nil || m.Since.Before(*c.protectedSince) {
+			since := m.Since
+			c.protectedSince = &since
+		}
+	}
+	if c.protectedSince != nil {
+		log.Infof(ctx, "%d active protections of the SQL stats, the rows aggregated "+
+			"from %s are retained", active, *c.protectedSince)
+	}
+	return nil
+}
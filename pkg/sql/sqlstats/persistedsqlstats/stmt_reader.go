@@ -136,7 +136,8 @@ FROM
 	//  column. This is so that we are backward compatible with the way
 	//  we are ordering the in-memory stats.
 	if options.SortedKey {
-		orderByColumns = append(orderByColumns, "metadata ->> 'query'")
+		// The statement text may be compressed by the flush.
+		orderByColumns = append(orderByColumns, sqlstatsutil.StmtQuerySQL)
 	}
 
 	orderByColumns = append(orderByColumns, "transaction_fingerprint_id")
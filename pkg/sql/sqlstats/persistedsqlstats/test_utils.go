@@ -0,0 +1,86 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package persistedsqlstats
+
+import (
+	"context"
+	"math"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/base"
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/sql/isql"
+	"github.com/cockroachdb/cockroach/pkg/sql/sqlstats"
+	"github.com/cockroachdb/cockroach/pkg/sql/sqlstats/insights"
+	"github.com/cockroachdb/cockroach/pkg/sql/sqlstats/sslocal"
+	"github.com/cockroachdb/cockroach/pkg/util/metric"
+	"github.com/cockroachdb/cockroach/pkg/util/mon"
+)
+
+// NewForTesting returns a PersistedSQLStats that does not depend on a running
+// server. The in-memory stats are stored in a fresh sslocal.SQLStats backed by
+// an unlimited memory monitor, and the persisted stats are read and written
+// through db, which tests can stub to exercise the flush logic in isolation.
+// The compaction logic can be exercised similarly by passing the same db to
+// NewStatsCompactor.
+//
+// The returned PersistedSQLStats has no job registry, so Start must not be
+// called on it.
+//
+// NewForTesting is only meant to be used in tests.
+func NewForTesting(
+	st *cluster.Settings, db isql.DB, knobs *sqlstats.TestingKnobs,
+) *PersistedSQLStats {
+	monitor := mon.NewUnlimitedMonitor(
+		context.Background(), "persisted-sql-stats-test", mon.MemoryResource,
+		nil /* curCount */, nil /* maxHist */, math.MaxInt64, st,
+	)
+	insightsProvider := insights.New(st, insights.NewMetrics())
+	memSQLStats := sslocal.New(
+		st,
+		sqlstats.MaxMemSQLStatsStmtFingerprints,
+		sqlstats.MaxMemSQLStatsTxnFingerprints,
+		nil, /* curMemoryBytesCount */
+		nil, /* maxMemoryBytesHist */
+		insightsProvider.Writer,
+		monitor,
+		nil, /* reportingSink */
+		knobs,
+		insightsProvider.LatencyInformation(),
+	)
+	return New(&Config{
+		Settings:                st,
+		InternalExecutorMonitor: monitor,
+		DB:                      db,
+		SQLIDContainer:          base.TestingIDContainer,
+		FlushCounter:            metric.NewCounter(metric.Metadata{}),
+		FlushDuration: metric.NewHistogram(metric.HistogramOptions{
+			Mode:     metric.HistogramModePreferHdrLatency,
+			Metadata: metric.Metadata{},
+			Duration: time.Minute,
+			Buckets:  metric.IOLatencyBuckets,
+		}),
+		FailureCounter:      metric.NewCounter(metric.Metadata{}),
+		SampledOutCounter:   metric.NewCounter(metric.Metadata{}),
+		DisabledSkipCounter: metric.NewCounter(metric.Metadata{}),
+		OverrunCounter:      metric.NewCounter(metric.Metadata{}),
+		FlushTxnRetries:     metric.NewCounter(metric.Metadata{}),
+		FlushSequence:       metric.NewGauge(metric.Metadata{}),
+		Knobs:               knobs,
+	}, memSQLStats)
+}
+
+// NumFlushCallersForTesting returns the number of callers of FlushWithReport
+// sharing the flush in progress, including the one that started it, or 0 if
+// no flush is in progress.
+func (s *PersistedSQLStats) NumFlushCallersForTesting() int {
+	return s.flushGroup.NumCalls(flushGroupKey)
+}
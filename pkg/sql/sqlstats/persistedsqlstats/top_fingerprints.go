@@ -0,0 +1,118 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package persistedsqlstats
+
+import (
+	"container/heap"
+	"context"
+	"sort"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/appstatspb"
+	"github.com/cockroachdb/cockroach/pkg/sql/sqlstats"
+)
+
+// MaxTopFingerprints is the maximum number of fingerprints returned by
+// TopFingerprints.
+const MaxTopFingerprints = 1000
+
+// FingerprintSummary summarizes the in-memory statistics of a statement
+// fingerprint, i.e. the statistics collected by this node since its last
+// flush.
+type FingerprintSummary struct {
+	FingerprintID            appstatspb.StmtFingerprintID
+	TransactionFingerprintID appstatspb.TransactionFingerprintID
+	AppName                  string
+	Query                    string
+	Count                    int64
+	// ServiceLatencyMean is the mean service latency, in seconds.
+	ServiceLatencyMean float64
+	LastExecAt         time.Time
+}
+
+// TopFingerprints returns the summaries of the n statement fingerprints with
+// the highest execution counts among the in-memory statistics of this node,
+// by decreasing count. It does not read the persisted statistics, so it only
+// reflects the executions since the last flush. At most MaxTopFingerprints
+// summaries are returned, and only n of them are held in memory while the
+// in-memory statistics are scanned.
+func (s *PersistedSQLStats) TopFingerprints(ctx context.Context, n int) []FingerprintSummary {
+	if n > MaxTopFingerprints {
+		n = MaxTopFingerprints
+	}
+	if n <= 0 {
+		return nil
+	}
+	top := make(fingerprintSummaryHeap, 0, n)
+	_ = s.SQLStats.IterateStatementStats(ctx, &sqlstats.IteratorOptions{},
+		func(ctx context.Context, statistics *appstatspb.CollectedStatementStatistics) error {
+			summary := FingerprintSummary{
+				FingerprintID:            statistics.ID,
+				TransactionFingerprintID: statistics.Key.TransactionFingerprintID,
+				AppName:                  statistics.Key.App,
+				Query:                    statistics.Key.Query,
+				Count:                    statistics.Stats.Count,
+				ServiceLatencyMean:       statistics.Stats.ServiceLat.Mean,
+				LastExecAt:               statistics.Stats.LastExecTimestamp,
+			}
+			if len(top) < n {
+				heap.Push(&top, summary)
+			} else if top.less(top[0], summary) {
+				top[0] = summary
+				heap.Fix(&top, 0)
+			}
+			return nil
+		})
+	sort.Slice(top, func(i, j int) bool { return top.less(top[j], top[i]) })
+	return top
+}
+
+// fingerprintSummaryHeap is a min-heap of fingerprint summaries ordered by
+// count, used to retain the summaries with the highest counts.
+type fingerprintSummaryHeap []FingerprintSummary
+
+var _ heap.Interface = (*fingerprintSummaryHeap)(nil)
+
+// less orders the summaries by count. The ties are broken by fingerprint ID
+// and application name, so that the result does not depend on the iteration
+// order.
+func (h fingerprintSummaryHeap) less(a, b FingerprintSummary) bool {
+	if a.Count != b.Count {
+		return a.Count < b.Count
+	}
+	if a.FingerprintID != b.FingerprintID {
+		return a.FingerprintID > b.FingerprintID
+	}
+	return a.AppName > b.AppName
+}
+
+// Len implements the heap.Interface interface.
+func (h fingerprintSummaryHeap) Len() int { return len(h) }
+
+// Less implements the heap.Interface interface.
+func (h fingerprintSummaryHeap) Less(i, j int) bool { return h.less(h[i], h[j]) }
+
+// Swap implements the heap.Interface interface.
+func (h fingerprintSummaryHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+// Push implements the heap.Interface interface.
+func (h *fingerprintSummaryHeap) Push(x interface{}) {
+	*h = append(*h, x.(FingerprintSummary))
+}
+
+// Pop implements the heap.Interface interface.
+func (h *fingerprintSummaryHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	*h = old[:n-1]
+	return x
+}
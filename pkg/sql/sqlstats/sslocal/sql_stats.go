@@ -69,6 +69,10 @@ type SQLStats struct {
 
 	insights           insights.WriterProvider
 	latencyInformation insights.LatencyInformation
+
+	// parentMon is the monitor that the memory used by the in-memory stats is
+	// drawn from.
+	parentMon *mon.BytesMonitor
 }
 
 func newSQLStats(
@@ -100,6 +104,7 @@ func newSQLStats(
 		knobs:                      knobs,
 		insights:                   insightsWriter,
 		latencyInformation:         latencyInformation,
+		parentMon:                  parentMon,
 	}
 	s.mu.apps = make(map[string]*ssmemstorage.Container)
 	s.mu.mon = monitor
@@ -122,6 +127,21 @@ func (s *SQLStats) GetTotalFingerprintBytes() int64 {
 	return s.mu.mon.AllocBytes()
 }
 
+// GetMemoryUsage returns the number of bytes currently allocated for the
+// in-memory statistics, and the memory limit that applies to them. The limit
+// is the one of the pool that the statistics draw their memory from, unless
+// the statistics are limited further.
+func (s *SQLStats) GetMemoryUsage() (usedBytes, limitBytes int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	usedBytes = s.mu.mon.AllocBytes()
+	limitBytes = s.mu.mon.Limit()
+	if s.parentMon != nil && s.parentMon.Limit() < limitBytes {
+		limitBytes = s.parentMon.Limit()
+	}
+	return usedBytes, limitBytes
+}
+
 func (s *SQLStats) getStatsForApplication(appName string) *ssmemstorage.Container {
 	s.mu.Lock()
 	defer s.mu.Unlock()
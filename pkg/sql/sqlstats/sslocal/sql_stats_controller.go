@@ -50,6 +50,11 @@ func (s *Controller) ResetClusterSQLStats(ctx context.Context) error {
 	return nil
 }
 
+// GetSQLStatsMemoryUsage implements the eval.SQLStatsController interface.
+func (s *Controller) GetSQLStatsMemoryUsage(_ context.Context) (usedBytes, limitBytes int64) {
+	return s.sqlStats.GetMemoryUsage()
+}
+
 // ResetLocalSQLStats resets the node-local sql stats.
 func (s *Controller) ResetLocalSQLStats(ctx context.Context) {
 	err := s.sqlStats.Reset(ctx)
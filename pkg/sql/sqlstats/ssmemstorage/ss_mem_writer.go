@@ -125,6 +125,7 @@ func (s *Container) RecordStatement(
 	}
 
 	stats.mu.data.SQLType = value.StatementType.String()
+	stats.mu.data.StatementTag = value.StatementTag
 	stats.mu.data.NumRows.Record(stats.mu.data.Count, float64(value.RowsAffected))
 	stats.mu.data.IdleLat.Record(stats.mu.data.Count, value.IdleLatency)
 	stats.mu.data.ParseLat.Record(stats.mu.data.Count, value.ParseLatency)
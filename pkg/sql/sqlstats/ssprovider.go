@@ -211,6 +211,7 @@ type RecordedStmtStats struct {
 	Nodes                []int64
 	Regions              []string
 	StatementType        tree.StatementType
+	StatementTag         string
 	Plan                 *appstatspb.ExplainTreePlanNode
 	PlanGist             string
 	StatementError       error
@@ -23,9 +23,26 @@ type TestingKnobs struct {
 	OnTxnStatsFlushFinished func()
 
 	// OnCleanupStartForShard is a callback that is triggered when background
-	// cleanup job starts to delete data from a shard from the system table.
+	// cleanup job starts to delete data from a shard from the system table. It
+	// is called concurrently for different shards if
+	// sql.stats.cleanup.delete_parallelism is greater than 1.
 	OnCleanupStartForShard func(shardIdx int, existingCountInShard, shardLimit int64)
 
+	// BeforeCompactionDelete, if set, is called with the statement and the
+	// arguments of each DELETE run by the cleanup job to remove stale rows. If
+	// it returns an error, the statement fails with that error.
+	BeforeCompactionDelete func(stmt string, qargs []interface{}) error
+
+	// BeforeFlushWrite, if set, is called before each write of the flush of
+	// the in-memory stats to the stats tables. If it returns an error, the
+	// write fails with that error.
+	BeforeFlushWrite func() error
+
+	// OnExportProtected, if set, is called by the export of the persisted stats
+	// once the stats it reads are protected from the compaction, before they
+	// are read.
+	OnExportProtected func()
+
 	// StubTimeNow allows tests to override the timeutil.Now() function used
 	// by the flush operation to calculate aggregated_ts timestamp.
 	StubTimeNow func() time.Time
@@ -39,6 +56,34 @@ type TestingKnobs struct {
 	// updated.
 	JobMonitorUpdateCheckInterval time.Duration
 
+	// JobMonitorScanInterval if non-zero overrides the frequency at which the
+	// job monitor checks the schedule for anomalies (e.g. a missing schedule
+	// or an invalid schedule expression) and repairs it.
+	JobMonitorScanInterval time.Duration
+
+	// DisableSQLStatsCompactionSchedule disables the job monitor of the
+	// server, so that the server neither creates nor repairs the SQL stats
+	// compaction schedule. It is meant for the tests that do not exercise the
+	// compaction, and spares them the startup work of creating the schedule.
+	// The schedule can still be created explicitly, e.g. with
+	// crdb_internal.schedule_sql_stats_compaction().
+	DisableSQLStatsCompactionSchedule bool
+
+	// DisableFlushOnNode disables the flush of the in-memory SQL stats on the
+	// node, as COCKROACH_DISABLE_SQL_STATS_FLUSH does.
+	DisableFlushOnNode bool
+
+	// CheckFlushHighWaterMarks makes each flush check the high-water marks of
+	// the stats tables it wrote to against the persisted stats. The check
+	// scans the stats tables.
+	CheckFlushHighWaterMarks bool
+
+	// FingerprintSamplingSeed, if set, seeds the sampling of the fingerprints
+	// of the applications with high fingerprint cardinality (see
+	// sql.stats.flush.sampling.enabled), so that tests can pick which
+	// fingerprints are sampled out. It must be the same on all the nodes.
+	FingerprintSamplingSeed uint64
+
 	// SkipZoneConfigBootstrap used for backup tests where we want to skip
 	// the Zone Config TTL setup.
 	SkipZoneConfigBootstrap bool
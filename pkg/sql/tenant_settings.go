@@ -22,19 +22,63 @@ import (
 	"github.com/cockroachdb/cockroach/pkg/sql/sem/eval"
 	"github.com/cockroachdb/cockroach/pkg/sql/sem/tree"
 	"github.com/cockroachdb/cockroach/pkg/sql/sessiondata"
+	"github.com/cockroachdb/cockroach/pkg/sql/types"
 	"github.com/cockroachdb/cockroach/pkg/util/log/eventpb"
 	"github.com/cockroachdb/errors"
 )
 
+// tenantSelectorMaxTenants limits the number of tenants that a single
+// ALTER TENANT IN (<select>) SET CLUSTER SETTING statement can modify, to
+// guard against selectors that unexpectedly match a large part of the fleet.
+var tenantSelectorMaxTenants = settings.RegisterIntSetting(
+	settings.SystemOnly,
+	"sql.tenant_settings.selector.max_tenants",
+	"maximum number of tenants that can be selected by ALTER TENANT IN (...) "+
+		"SET CLUSTER SETTING",
+	100, /* defaultValue */
+	settings.PositiveInt,
+)
+
+// ErrSystemTenantOverride is reported when ALTER TENANT ... SET CLUSTER
+// SETTING targets the system tenant. The overrides of system.tenant_settings
+// are only read by the secondary tenants: the system tenant is configured with
+// SET CLUSTER SETTING, so an override that targets it would have no effect.
+// Such a statement is usually a mistyped tenant ID, or a selector that
+// unintentionally matches the system tenant.
+var ErrSystemTenantOverride = errors.New(
+	"cannot use this statement to access cluster settings in system tenant")
+
 // alterTenantSetClusterSettingNode represents an
 // ALTER TENANT ... SET CLUSTER SETTING statement.
+//
+// The overrides are written to system.tenant_settings in the transaction of
+// the statement, and the tenants only observe them once they are committed
+// (through the rangefeed of the tenant settings watcher). Within an explicit
+// transaction, the overrides are thus undone if the transaction rolls back,
+// and they must not be written or applied through any other path.
 type alterTenantSetClusterSettingNode struct {
-	name       string
 	tenantSpec tenantSpec
-	st         *cluster.Settings
-	setting    settings.NonMaskedSetting
+	// tenantSelector is set instead of tenantSpec when the tenants are
+	// selected by a query returning tenant IDs.
+	tenantSelector tree.SelectStatement
+	st             *cluster.Settings
+	// assignments contains one entry per setting to modify. All of them are
+	// applied in the same transaction.
+	assignments []tenantSettingAssignment
+}
+
+// tenantSettingAssignment is a single validated setting assignment of an
+// ALTER TENANT ... SET CLUSTER SETTING statement.
+type tenantSettingAssignment struct {
+	name    string
+	setting settings.NonMaskedSetting
 	// If value is nil, the setting should be reset.
 	value tree.TypedExpr
+	// rawValue is the value as it was written in the statement. It is used
+	// when reporting the change so that literals with units (e.g. '500ms' or
+	// '2GiB') are reported as the user wrote them instead of in the
+	// normalized form of the typed expression.
+	rawValue tree.Expr
 }
 
 // AlterTenantSetClusterSetting sets tenant level session variables.
@@ -55,44 +99,273 @@ func (p *planner) AlterTenantSetClusterSetting(
 			"ALTER TENANT can only be called by system operators")
 	}
 
-	name := strings.ToLower(n.Name)
-	st := p.EvalContext().Settings
-	setting, ok := settings.LookupForLocalAccess(name, true /* forSystemTenant - checked above already */)
-	if !ok {
-		return nil, errors.Errorf("unknown cluster setting '%s'", name)
+	// Validate every assignment up front, so that an invalid entry in the
+	// list form is reported before anything is written.
+	var assignments []tenantSettingAssignment
+	seen := make(map[string]struct{})
+	for _, a := range n.Assignments() {
+		name := strings.ToLower(a.Name)
+		if _, ok := seen[name]; ok {
+			return nil, pgerror.Newf(pgcode.InvalidParameterValue,
+				"cluster setting '%s' specified multiple times", name)
+		}
+		seen[name] = struct{}{}
+		setting, ok := settings.LookupForLocalAccess(name, true /* forSystemTenant - checked above already */)
+		if !ok {
+			return nil, errors.Errorf("unknown cluster setting '%s'", name)
+		}
+		// Error out if we're trying to set a system-only variable.
+		if setting.Class() == settings.SystemOnly {
+			return nil, systemOnlyTenantSettingError(name, a)
+		}
+		value, err := p.getAndValidateTypedClusterSetting(ctx, name, a.Value, setting)
+		if err != nil {
+			return nil, err
+		}
+		assignments = append(assignments, tenantSettingAssignment{
+			name:     name,
+			setting:  setting,
+			value:    value,
+			rawValue: a.Value,
+		})
 	}
-	// Error out if we're trying to set a system-only variable.
-	if setting.Class() == settings.SystemOnly {
-		return nil, pgerror.Newf(pgcode.InsufficientPrivilege,
-			"%s is a system-only setting and must be set in the admin tenant using SET CLUSTER SETTING", name)
+
+	node := alterTenantSetClusterSettingNode{
+		st:          p.EvalContext().Settings,
+		assignments: assignments,
+	}
+	if n.TenantSelector != nil {
+		subquery, ok := n.TenantSelector.(*tree.Subquery)
+		if !ok {
+			return nil, errors.AssertionFailedf("unexpected tenant selector %T", n.TenantSelector)
+		}
+		if err := checkTenantSelectorReadOnly(subquery.Select); err != nil {
+			return nil, err
+		}
+		if err := p.typeTenantSelectorPlaceholders(subquery.Select); err != nil {
+			return nil, err
+		}
+		node.tenantSelector = subquery.Select
+		return &node, nil
 	}
 
-	tspec, err := p.planTenantSpec(ctx, n.TenantSpec, "ALTER TENANT SET CLUSTER SETTING "+name)
+	op := "ALTER TENANT SET CLUSTER SETTING"
+	if len(assignments) == 1 {
+		op += " " + assignments[0].name
+	}
+	tspec, err := p.planTenantSpec(ctx, n.TenantSpec, op)
 	if err != nil {
 		return nil, err
 	}
+	node.tenantSpec = tspec
+	return &node, nil
+}
 
-	value, err := p.getAndValidateTypedClusterSetting(ctx, name, n.Value, setting)
+// systemOnlyTenantSettingError returns the error reported when ALTER TENANT
+// SET CLUSTER SETTING targets a system-only setting. Such settings control
+// the shared storage and KV layers (e.g. admission control or rebalancing),
+// so they cannot be overridden for a single tenant. The hint spells out the
+// statement that changes the setting for the whole cluster instead.
+func systemOnlyTenantSettingError(name string, a tree.SetClusterSetting) error {
+	err := pgerror.Newf(pgcode.InsufficientPrivilege,
+		"%s is a system-only setting and must be set in the admin tenant using SET CLUSTER SETTING", name)
+	err = errors.WithDetailf(err,
+		"The setting class of %s is system-only: it applies to the storage and KV layers "+
+			"shared by all the tenants, and cannot be overridden for individual tenants.", name)
+	return errors.WithHintf(err,
+		"To change the setting for the whole cluster, run in the system tenant: %s", tree.AsString(&a))
+}
+
+// checkTenantSelectorReadOnly returns an error if the tenant selector contains
+// a statement other than a query, e.g. a mutation in a common table
+// expression or in a statement source. The selector is run on its own by
+// selectTenants, rather than planned as part of the ALTER TENANT statement,
+// so it must not have side effects.
+func checkTenantSelectorReadOnly(sel tree.SelectStatement) error {
+	var err error
+	var checkStmt func(stmt tree.Statement)
+	var checkTableExpr func(expr tree.TableExpr)
+	checkStmt = func(stmt tree.Statement) {
+		if err != nil {
+			return
+		}
+		switch s := stmt.(type) {
+		case *tree.Select:
+			if s.With != nil {
+				for _, cte := range s.With.CTEList {
+					checkStmt(cte.Stmt)
+				}
+			}
+			checkStmt(s.Select)
+			// The subqueries in the expressions, e.g. in the WHERE clause,
+			// are checked as statements as well.
+			_, _ = tree.SimpleStmtVisit(s, func(expr tree.Expr) (bool, tree.Expr, error) {
+				if subquery, ok := expr.(*tree.Subquery); ok {
+					checkStmt(subquery.Select)
+					return false, expr, nil
+				}
+				return true, expr, nil
+			})
+		case *tree.ParenSelect:
+			checkStmt(s.Select)
+		case *tree.UnionClause:
+			checkStmt(s.Left)
+			checkStmt(s.Right)
+		case *tree.SelectClause:
+			for _, table := range s.From.Tables {
+				checkTableExpr(table)
+			}
+		case *tree.ValuesClause, *tree.LiteralValuesClause:
+		default:
+			err = pgerror.Newf(pgcode.FeatureNotSupported,
+				"tenant selector cannot contain a %s statement, it must be a query", stmt.StatementTag())
+		}
+	}
+	checkTableExpr = func(expr tree.TableExpr) {
+		switch t := expr.(type) {
+		case *tree.AliasedTableExpr:
+			checkTableExpr(t.Expr)
+		case *tree.ParenTableExpr:
+			checkTableExpr(t.Expr)
+		case *tree.JoinTableExpr:
+			checkTableExpr(t.Left)
+			checkTableExpr(t.Right)
+		case *tree.Subquery:
+			checkStmt(t.Select)
+		case *tree.StatementSource:
+			checkStmt(t.Statement)
+		}
+	}
+	checkStmt(sel)
+	return err
+}
+
+// typeTenantSelectorPlaceholders assigns a type to the placeholders of the
+// tenant selector whose type is not known from the client. The selector is
+// not type-checked as part of the statement, so their type cannot be
+// inferred: they are typed as strings, and their values are substituted as
+// string literals, which the selector then types from their context, see
+// bindTenantSelectorPlaceholders.
+func (p *planner) typeTenantSelectorPlaceholders(sel tree.SelectStatement) error {
+	_, err := tree.SimpleStmtVisit(sel, func(expr tree.Expr) (bool, tree.Expr, error) {
+		placeholder, ok := expr.(*tree.Placeholder)
+		if !ok {
+			return true, expr, nil
+		}
+		if _, ok, err := p.semaCtx.Placeholders.Type(placeholder.Idx); err != nil || ok {
+			return false, expr, err
+		}
+		return false, expr, p.semaCtx.Placeholders.SetType(placeholder.Idx, types.String)
+	})
+	return err
+}
+
+// bindTenantSelectorPlaceholders returns a copy of the tenant selector in which
+// the placeholders are replaced by their values, so that the selector can be
+// run on its own by selectTenants. The string values are replaced by string
+// literals, see typeTenantSelectorPlaceholders.
+func bindTenantSelectorPlaceholders(
+	ctx context.Context, evalCtx *eval.Context, sel tree.SelectStatement,
+) (tree.Statement, error) {
+	return tree.SimpleStmtVisit(sel, func(expr tree.Expr) (bool, tree.Expr, error) {
+		placeholder, ok := expr.(*tree.Placeholder)
+		if !ok {
+			return true, expr, nil
+		}
+		value, ok := evalCtx.Placeholders.Value(placeholder.Idx)
+		if !ok {
+			return false, nil, tree.NewNoValueProvidedForPlaceholderErr(placeholder.Idx)
+		}
+		d, err := eval.Expr(ctx, evalCtx, value)
+		if err != nil {
+			return false, nil, err
+		}
+		if s, ok := d.(*tree.DString); ok {
+			return false, tree.NewStrVal(string(*s)), nil
+		}
+		return false, d, nil
+	})
+}
+
+// selectTenants runs the tenant selector query and returns the IDs of the
+// selected tenants. The query runs with the privileges of the current user,
+// with the values of the placeholders of the statement.
+func (n *alterTenantSetClusterSettingNode) selectTenants(
+	ctx context.Context, p *planner,
+) (tenantIDs []uint64, retErr error) {
+	maxTenants := tenantSelectorMaxTenants.Get(&n.st.SV)
+	sel, err := bindTenantSelectorPlaceholders(ctx, p.EvalContext(), n.tenantSelector)
+	if err != nil {
+		return nil, err
+	}
+	it, err := p.InternalSQLTxn().QueryIteratorEx(
+		ctx, "select-tenants", p.Txn(),
+		sessiondata.InternalExecutorOverride{User: p.User()},
+		tree.AsStringWithFlags(sel, tree.FmtParsable),
+	)
 	if err != nil {
 		return nil, err
 	}
+	defer func() {
+		retErr = errors.CombineErrors(retErr, it.Close())
+	}()
 
-	node := alterTenantSetClusterSettingNode{
-		name:       name,
-		tenantSpec: tspec,
-		st:         st,
-		setting:    setting, value: value,
+	seen := make(map[uint64]struct{})
+	var ok bool
+	for ok, err = it.Next(ctx); ok; ok, err = it.Next(ctx) {
+		row := it.Cur()
+		if len(row) != 1 {
+			return nil, pgerror.Newf(pgcode.DatatypeMismatch,
+				"tenant selector must return a single column of tenant IDs, found %d columns", len(row))
+		}
+		id, isInt := tree.AsDInt(row[0])
+		if !isInt {
+			return nil, pgerror.Newf(pgcode.DatatypeMismatch,
+				"tenant selector must return tenant IDs, found %s", row[0])
+		}
+		if id <= 0 {
+			return nil, pgerror.Newf(pgcode.InvalidParameterValue, "invalid tenant ID %d", id)
+		}
+		if _, ok := seen[uint64(id)]; ok {
+			continue
+		}
+		seen[uint64(id)] = struct{}{}
+		if int64(len(tenantIDs)) >= maxTenants {
+			return nil, errors.WithHintf(pgerror.Newf(pgcode.ProgramLimitExceeded,
+				"tenant selector returned more than %d tenants", maxTenants),
+				"Narrow down the selector, or raise %s.", tenantSelectorMaxTenants.Key())
+		}
+		tenantIDs = append(tenantIDs, uint64(id))
 	}
-	return &node, nil
+	return tenantIDs, err
 }
 
 func (n *alterTenantSetClusterSettingNode) startExec(params runParams) error {
-	var tenantID uint64
-	if _, ok := n.tenantSpec.(tenantSpecAll); ok {
+	var tenantIDs []uint64
+	if n.tenantSelector != nil {
+		// Case for TENANT IN (<select>). Every selected tenant must exist
+		// in system.tenants.
+		selected, err := n.selectTenants(params.ctx, params.p)
+		if err != nil {
+			return err
+		}
+		for _, id := range selected {
+			tid, err := roachpb.MakeTenantID(id)
+			if err != nil {
+				return pgerror.WithCandidateCode(err, pgcode.InvalidParameterValue)
+			}
+			if _, err := GetTenantRecordByID(
+				params.ctx, params.p.InternalSQLTxn(), tid, params.p.ExecCfg().Settings,
+			); err != nil {
+				return err
+			}
+		}
+		tenantIDs = selected
+	} else if _, ok := n.tenantSpec.(tenantSpecAll); ok {
 		// Processing for TENANT ALL.
 		// We will be writing rows with tenant_id = 0 in
 		// system.tenant_settings.
-		tenantID = 0
+		tenantIDs = []uint64{0}
 	} else {
 		// Case for TENANT <tenant_id>. We'll check that the provided
 		// tenant ID is non zero and refers to a tenant that exists in
@@ -101,62 +374,164 @@ func (n *alterTenantSetClusterSettingNode) startExec(params runParams) error {
 		if err != nil {
 			return err
 		}
-		tenantID = rec.ID
-		if roachpb.MustMakeTenantID(tenantID).IsSystem() {
-			return errors.WithHint(pgerror.Newf(pgcode.InvalidParameterValue,
-				"cannot use this statement to access cluster settings in system tenant"),
-				"Use a regular SET CLUSTER SETTING statement.")
-		}
-	}
-
-	// Write the setting.
-	var reportedValue string
-	if n.value == nil {
-		// TODO(radu,knz): DEFAULT might be confusing, we really want to say "NO OVERRIDE"
-		reportedValue = "DEFAULT"
-		if _, err := params.p.InternalSQLTxn().ExecEx(
-			params.ctx, "reset-tenant-setting", params.p.Txn(),
-			sessiondata.RootUserSessionDataOverride,
-			"DELETE FROM system.tenant_settings WHERE tenant_id = $1 AND name = $2", tenantID, n.name,
-		); err != nil {
-			return err
+		tenantIDs = []uint64{rec.ID}
+	}
+	for _, tenantID := range tenantIDs {
+		if tenantID != 0 && roachpb.MustMakeTenantID(tenantID).IsSystem() {
+			return systemTenantOverrideError()
 		}
-	} else {
-		reportedValue = tree.AsStringWithFlags(n.value, tree.FmtBareStrings)
-		value, err := eval.Expr(params.ctx, params.p.EvalContext(), n.value)
+	}
+
+	// Encode all the values before writing any of them, so that a value
+	// which fails to encode does not leave the overrides partially applied.
+	encodedValues := make([]string, len(n.assignments))
+	for i, a := range n.assignments {
+		if a.value == nil {
+			continue
+		}
+		value, err := eval.Expr(params.ctx, params.p.EvalContext(), a.value)
 		if err != nil {
 			return err
 		}
-		encoded, err := toSettingString(params.ctx, n.st, n.name, n.setting, value)
+		encodedValues[i], err = toSettingString(params.ctx, n.st, a.name, a.setting, value)
 		if err != nil {
 			return err
 		}
-		if _, err := params.p.InternalSQLTxn().ExecEx(
-			params.ctx, "update-tenant-setting", params.p.Txn(),
-			sessiondata.RootUserSessionDataOverride,
-			`UPSERT INTO system.tenant_settings (tenant_id, name, value, last_updated, value_type) VALUES ($1, $2, $3, now(), $4)`,
-			tenantID, n.name, encoded, n.setting.Typ(),
-		); err != nil {
-			return err
+	}
+
+	// The writes below must all use the transaction of the statement, see
+	// alterTenantSetClusterSettingNode.
+	for _, tenantID := range tenantIDs {
+		for i, a := range n.assignments {
+			// Write the setting.
+			var reportedValue string
+			if a.value == nil {
+				// TODO(radu,knz): DEFAULT might be confusing, we really want to say "NO OVERRIDE"
+				reportedValue = "DEFAULT"
+				if _, err := params.p.InternalSQLTxn().ExecEx(
+					params.ctx, "reset-tenant-setting", params.p.Txn(),
+					sessiondata.RootUserSessionDataOverride,
+					"DELETE FROM system.tenant_settings WHERE tenant_id = $1 AND name = $2", tenantID, a.name,
+				); err != nil {
+					return err
+				}
+			} else {
+				reportedValue = tree.AsStringWithFlags(a.rawValue, tree.FmtBareStrings)
+				if _, err := params.p.InternalSQLTxn().ExecEx(
+					params.ctx, "update-tenant-setting", params.p.Txn(),
+					sessiondata.RootUserSessionDataOverride,
+					`UPSERT INTO system.tenant_settings (tenant_id, name, value, last_updated, value_type) VALUES ($1, $2, $3, now(), $4)`,
+					tenantID, a.name, encodedValues[i], a.setting.Typ(),
+				); err != nil {
+					return err
+				}
+			}
+
+			// Finally, log the event.
+			if err := params.p.logEvent(
+				params.ctx,
+				0, /* no target */
+				&eventpb.SetTenantClusterSetting{
+					SettingName: a.name,
+					Value:       reportedValue,
+					TenantId:    tenantID,
+					AllTenants:  tenantID == 0,
+				}); err != nil {
+				return err
+			}
 		}
 	}
+	return nil
+}
 
-	// Finally, log the event.
-	return params.p.logEvent(
-		params.ctx,
-		0, /* no target */
-		&eventpb.SetTenantClusterSetting{
-			SettingName: n.name,
-			Value:       reportedValue,
-			TenantId:    tenantID,
-			AllTenants:  tenantID == 0,
-		})
+// systemTenantOverrideError returns ErrSystemTenantOverride, with a hint
+// pointing to SET CLUSTER SETTING.
+func systemTenantOverrideError() error {
+	return errors.WithHint(pgerror.WithCandidateCode(ErrSystemTenantOverride, pgcode.InvalidParameterValue),
+		"Use a regular SET CLUSTER SETTING statement.")
 }
 
 func (n *alterTenantSetClusterSettingNode) Next(_ runParams) (bool, error) { return false, nil }
 func (n *alterTenantSetClusterSettingNode) Values() tree.Datums            { return nil }
 func (n *alterTenantSetClusterSettingNode) Close(_ context.Context)        {}
 
+// alterTenantResetAllClusterSettingsNode represents an
+// ALTER TENANT ... RESET ALL CLUSTER SETTINGS statement. As for
+// alterTenantSetClusterSettingNode, the overrides are removed in the
+// transaction of the statement.
+type alterTenantResetAllClusterSettingsNode struct {
+	tenantSpec tenantSpec
+}
+
+// AlterTenantResetAllClusterSettings removes all the overrides specific to a
+// tenant, so that the all-tenants overrides apply to it again. With
+// ALTER TENANT ALL, it removes the all-tenants overrides instead.
+// Privileges: MANAGETENANT.
+func (p *planner) AlterTenantResetAllClusterSettings(
+	ctx context.Context, n *tree.AlterTenantResetAllClusterSettings,
+) (planNode, error) {
+	if err := CanManageTenant(ctx, p); err != nil {
+		return nil, err
+	}
+	if !p.execCfg.Codec.ForSystemTenant() {
+		return nil, pgerror.Newf(pgcode.InsufficientPrivilege,
+			"ALTER TENANT can only be called by system operators")
+	}
+	tspec, err := p.planTenantSpec(ctx, n.TenantSpec, "ALTER TENANT RESET ALL CLUSTER SETTINGS")
+	if err != nil {
+		return nil, err
+	}
+	return &alterTenantResetAllClusterSettingsNode{
+		tenantSpec: tspec,
+	}, nil
+}
+
+func (n *alterTenantResetAllClusterSettingsNode) startExec(params runParams) error {
+	// As for ALTER TENANT ALL SET CLUSTER SETTING, the all-tenants overrides
+	// are the rows with tenant_id = 0.
+	var tenantID uint64
+	if _, ok := n.tenantSpec.(tenantSpecAll); !ok {
+		rec, err := n.tenantSpec.getTenantInfo(params.ctx, params.p)
+		if err != nil {
+			return err
+		}
+		tenantID = rec.ID
+		if roachpb.MustMakeTenantID(tenantID).IsSystem() {
+			return systemTenantOverrideError()
+		}
+	}
+
+	// The version override is maintained by the upgrades rather than by the
+	// operator, so it is kept.
+	rows, err := params.p.InternalSQLTxn().QueryBufferedEx(
+		params.ctx, "reset-all-tenant-settings", params.p.Txn(),
+		sessiondata.RootUserSessionDataOverride,
+		"DELETE FROM system.tenant_settings WHERE tenant_id = $1 AND name != 'version' RETURNING name",
+		tenantID,
+	)
+	if err != nil {
+		return err
+	}
+	for _, row := range rows {
+		if err := params.p.logEvent(
+			params.ctx,
+			0, /* no target */
+			&eventpb.SetTenantClusterSetting{
+				SettingName: string(tree.MustBeDString(row[0])),
+				Value:       "DEFAULT",
+				TenantId:    tenantID,
+				AllTenants:  tenantID == 0,
+			}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (n *alterTenantResetAllClusterSettingsNode) Next(_ runParams) (bool, error) { return false, nil }
+func (n *alterTenantResetAllClusterSettingsNode) Values() tree.Datums            { return nil }
+func (n *alterTenantResetAllClusterSettingsNode) Close(_ context.Context)        {}
+
 // ShowTenantClusterSetting shows the value of a cluster setting for a tenant.
 // Privileges: super user.
 func (p *planner) ShowTenantClusterSetting(
@@ -253,3 +628,41 @@ FROM
 			return true, string(encoded), nil
 		})
 }
+
+// GetTenantSettingSentStatus is part of the eval.TenantOperator interface.
+// The status is observed from the TenantSettings streams open on this node,
+// which send the overrides of system.tenant_settings to the tenants, see
+// tenantsettingswatcher.Watcher.GetSentStatus. The status is node-local: the
+// other nodes are not consulted.
+// Privileges: admin.
+func (p *planner) GetTenantSettingSentStatus(
+	ctx context.Context, name string,
+) ([]eval.TenantSettingSentStatus, error) {
+	const op = "crdb_internal.tenant_setting_sent_status"
+	if err := p.RequireAdminRole(ctx, "view the overrides sent to the tenants"); err != nil {
+		return nil, err
+	}
+	if !p.execCfg.Codec.ForSystemTenant() {
+		return nil, pgerror.Newf(pgcode.InsufficientPrivilege,
+			"%s can only be called by system operators", op)
+	}
+	name = strings.ToLower(name)
+	if _, ok := settings.LookupForLocalAccess(name, true /* forSystemTenant */); !ok {
+		return nil, errors.Errorf("unknown setting: %q", name)
+	}
+	if p.execCfg.TenantSettingsWatcher == nil {
+		return nil, errors.AssertionFailedf("tenant settings watcher not configured")
+	}
+	w, err := p.execCfg.TenantSettingsWatcher.Get(op)
+	if err != nil {
+		return nil, err
+	}
+	var res []eval.TenantSettingSentStatus
+	for _, s := range w.GetSentStatus(name) {
+		res = append(res, eval.TenantSettingSentStatus{
+			TenantID: s.TenantID,
+			Sent:     s.Sent,
+		})
+	}
+	return res, nil
+}
@@ -13,6 +13,7 @@ package sql
 import (
 	"context"
 	"fmt"
+	"go/constant"
 
 	"github.com/cockroachdb/cockroach/pkg/multitenant/mtinfopb"
 	"github.com/cockroachdb/cockroach/pkg/roachpb"
@@ -41,22 +42,32 @@ var _ tenantSpec = (*tenantSpecId)(nil)
 func (p *planner) planTenantSpec(
 	ctx context.Context, ts *tree.TenantSpec, op string,
 ) (tenantSpec, error) {
-	if ts.All {
+	if ts.Kind() == tree.TenantSpecAll {
 		return tenantSpecAll{}, nil
 	}
 	var dummyHelper tree.IndexedVarHelper
-	if !ts.IsName {
+	if idExpr, ok := ts.ID(); ok {
 		// By-ID reference.
+		if err := ValidateTenantIDExpr(idExpr); err != nil {
+			return nil, err
+		}
 		typedTenantID, err := p.analyzeExpr(
-			ctx, ts.Expr, nil, dummyHelper, types.Int, true, op)
+			ctx, idExpr, nil, dummyHelper, types.Int, true, op)
 		if err != nil {
 			return nil, err
 		}
+		// Reject invalid constant IDs upfront. The IDs provided through
+		// placeholders or other expressions are validated when evaluated.
+		if d, ok := typedTenantID.(tree.Datum); ok {
+			if _, err := tenantIDFromDatum(d); err != nil {
+				return nil, err
+			}
+		}
 		return &tenantSpecId{TypedExpr: typedTenantID}, nil
 	}
 
 	// By-name reference.
-	e := ts.Expr
+	e, _ := ts.Name()
 
 	// If the expression is a simple identifier, handle
 	// that specially: we promote that identifier to a SQL string.
@@ -112,12 +123,67 @@ func (ts *tenantSpecId) getTenantParameters(
 	if err != nil {
 		return tid, tenantName, err
 	}
+	tid, err = tenantIDFromDatum(tenantIDd)
+	return tid, tenantName, err
+}
+
+// tenantIDFromDatum converts the given INT datum to a tenant ID, and returns
+// an error if it is NULL or not positive.
+func tenantIDFromDatum(tenantIDd tree.Datum) (roachpb.TenantID, error) {
 	if tenantIDd == tree.DNull {
-		return tid, tenantName, pgerror.New(pgcode.Syntax, "tenant ID cannot be NULL")
+		return roachpb.TenantID{}, pgerror.New(pgcode.Syntax, "tenant ID cannot be NULL")
+	}
+	tenantID := int64(tree.MustBeDInt(tenantIDd))
+	if err := checkTenantIDPositive(tenantID); err != nil {
+		return roachpb.TenantID{}, err
+	}
+	return roachpb.MakeTenantID(uint64(tenantID))
+}
+
+func checkTenantIDPositive(tenantID int64) error {
+	if tenantID <= 0 {
+		return pgerror.Newf(pgcode.InvalidParameterValue,
+			"invalid tenant ID %d: tenant IDs must be positive", tenantID)
+	}
+	return nil
+}
+
+// ValidateTenantIDExpr checks the expression designating a tenant by ID in
+// ALTER TENANT [<expr>] SET CLUSTER SETTING and the other tenant statements,
+// before it is type checked, so that the invalid IDs are reported consistently
+// by all the statements. The expression can be a placeholder or a positive
+// integer literal, possibly in parentheses. NULL, zero and negative integers,
+// non-integer numbers, and string literals are rejected: a tenant is
+// designated by name without the brackets. The other expressions, e.g. casts,
+// are left to type checking, and their value is validated when they are
+// evaluated, see tenantIDFromDatum.
+func ValidateTenantIDExpr(e tree.Expr) error {
+	switch t := tree.StripParens(e).(type) {
+	case *tree.Placeholder:
+		return nil
+	case *tree.NumVal:
+		if t.Kind() != constant.Int {
+			return pgerror.Newf(pgcode.InvalidParameterValue,
+				"invalid tenant ID %s: tenant IDs must be integers", t)
+		}
+		tenantID, err := t.AsInt64()
+		if err != nil {
+			return pgerror.Wrapf(err, pgcode.InvalidParameterValue, "invalid tenant ID %s", t)
+		}
+		return checkTenantIDPositive(tenantID)
+	case *tree.DInt:
+		return checkTenantIDPositive(int64(*t))
+	case *tree.StrVal:
+		return errors.WithHint(
+			pgerror.Newf(pgcode.InvalidParameterValue,
+				"invalid tenant ID %s: tenant IDs must be integers", t),
+			"to designate a tenant by name, omit the brackets, e.g. ALTER TENANT <name>")
+	default:
+		if t == tree.DNull {
+			return pgerror.New(pgcode.Syntax, "tenant ID cannot be NULL")
+		}
+		return nil
 	}
-	tenantID := uint64(tree.MustBeDInt(tenantIDd))
-	tid, err = roachpb.MakeTenantID(tenantID)
-	return tid, tenantName, err
 }
 
 func (tenantSpecAll) getTenantInfo(
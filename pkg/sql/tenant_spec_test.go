@@ -0,0 +1,84 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package sql
+
+import (
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/parser"
+	"github.com/cockroachdb/cockroach/pkg/sql/pgwire/pgcode"
+	"github.com/cockroachdb/cockroach/pkg/sql/pgwire/pgerror"
+	"github.com/cockroachdb/cockroach/pkg/sql/sem/tree"
+	"github.com/cockroachdb/cockroach/pkg/testutils"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateTenantIDExpr(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	testData := []struct {
+		expr string
+		code pgcode.Code
+		err  string
+	}{
+		{expr: `2`},
+		{expr: `(2)`},
+		{expr: `$1`},
+		{expr: `($1)`},
+		// The other expressions are validated once evaluated.
+		{expr: `2::INT8`},
+		{expr: `(SELECT 2)`},
+
+		{expr: `0`, code: pgcode.InvalidParameterValue,
+			err: `invalid tenant ID 0: tenant IDs must be positive`},
+		{expr: `-1`, code: pgcode.InvalidParameterValue,
+			err: `invalid tenant ID -1: tenant IDs must be positive`},
+		{expr: `((-1))`, code: pgcode.InvalidParameterValue,
+			err: `invalid tenant ID -1: tenant IDs must be positive`},
+		{expr: `1.5`, code: pgcode.InvalidParameterValue,
+			err: `invalid tenant ID 1.5: tenant IDs must be integers`},
+		{expr: `2.0`, code: pgcode.InvalidParameterValue,
+			err: `invalid tenant ID 2.0: tenant IDs must be integers`},
+		{expr: `1e3`, code: pgcode.InvalidParameterValue,
+			err: `invalid tenant ID 1e3: tenant IDs must be integers`},
+		{expr: `99999999999999999999`, code: pgcode.InvalidParameterValue,
+			err: `invalid tenant ID 99999999999999999999: numeric constant out of int64 range`},
+		// The tenants are designated by name without the brackets.
+		{expr: `'tenant-2'`, code: pgcode.InvalidParameterValue,
+			err: `invalid tenant ID 'tenant-2': tenant IDs must be integers`},
+		{expr: `'2'`, code: pgcode.InvalidParameterValue,
+			err: `invalid tenant ID '2': tenant IDs must be integers`},
+		{expr: `''`, code: pgcode.InvalidParameterValue,
+			err: `invalid tenant ID '': tenant IDs must be integers`},
+		{expr: `NULL`, code: pgcode.Syntax,
+			err: `tenant ID cannot be NULL`},
+	}
+	for _, test := range testData {
+		t.Run(test.expr, func(t *testing.T) {
+			expr, err := parser.ParseExpr(test.expr)
+			require.NoError(t, err)
+			err = ValidateTenantIDExpr(expr)
+			if test.err == "" {
+				require.NoError(t, err)
+				return
+			}
+			require.True(t, testutils.IsError(err, test.err), "unexpected error: %v", err)
+			require.Equal(t, test.code, pgerror.GetPGCode(err))
+		})
+	}
+
+	// The expressions that are already typed are validated as well.
+	require.NoError(t, ValidateTenantIDExpr(tree.NewDInt(3)))
+	require.Error(t, ValidateTenantIDExpr(tree.NewDInt(0)))
+}
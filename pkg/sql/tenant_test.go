@@ -24,11 +24,14 @@ import (
 	"github.com/cockroachdb/cockroach/pkg/server"
 	"github.com/cockroachdb/cockroach/pkg/sql"
 	"github.com/cockroachdb/cockroach/pkg/sql/isql"
+	"github.com/cockroachdb/cockroach/pkg/sql/pgwire/pgcode"
 	"github.com/cockroachdb/cockroach/pkg/testutils/serverutils"
 	"github.com/cockroachdb/cockroach/pkg/testutils/sqlutils"
 	"github.com/cockroachdb/cockroach/pkg/testutils/testcluster"
 	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
 	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/cockroachdb/errors"
+	"github.com/lib/pq"
 	"github.com/stretchr/testify/require"
 )
 
@@ -134,6 +137,69 @@ func TestGetTenantIds(t *testing.T) {
 	require.Equal(t, expectedIds, ids)
 }
 
+// TestAlterTenantSetSystemOnlyClusterSetting checks that overriding a
+// system-only setting for a tenant is rejected with a hint pointing to the
+// statement that changes the setting for the whole cluster.
+func TestAlterTenantSetSystemOnlyClusterSetting(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+	ctx := context.Background()
+	s, sqlDB, _ := serverutils.StartServer(t, base.TestServerArgs{})
+	defer s.Stopper().Stop(ctx)
+
+	tdb := sqlutils.MakeSQLRunner(sqlDB)
+	tdb.Exec(t, "CREATE TENANT t1")
+
+	_, err := sqlDB.Exec("ALTER TENANT t1 SET CLUSTER SETTING admission.kv.enabled = false")
+	var pqErr *pq.Error
+	require.True(t, errors.As(err, &pqErr), "expected a pq.Error, got %v", err)
+	require.Equal(t, pgcode.InsufficientPrivilege.String(), string(pqErr.Code))
+	require.Contains(t, pqErr.Message, "admission.kv.enabled is a system-only setting")
+	require.Contains(t, pqErr.Detail, "The setting class of admission.kv.enabled is system-only")
+	require.Contains(t, pqErr.Hint, "SET CLUSTER SETTING admission.kv.enabled = false")
+}
+
+// TestAlterTenantSetClusterSettingInExplicitTxn verifies that the overrides
+// written by ALTER TENANT SET CLUSTER SETTING only take effect if the
+// transaction commits.
+func TestAlterTenantSetClusterSettingInExplicitTxn(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+	ctx := context.Background()
+	s, sqlDB, _ := serverutils.StartServer(t, base.TestServerArgs{})
+	defer s.Stopper().Stop(ctx)
+
+	tdb := sqlutils.MakeSQLRunner(sqlDB)
+	tdb.Exec(t, "CREATE TENANT t1")
+
+	const showOverride = `SELECT count(*) FROM system.tenant_settings
+WHERE name = 'sql.notices.enabled' AND value = 'false'`
+
+	// The override is visible within the transaction, and undone by the
+	// rollback.
+	txn, err := sqlDB.Begin()
+	require.NoError(t, err)
+	_, err = txn.Exec("ALTER TENANT t1 SET CLUSTER SETTING sql.notices.enabled = false")
+	require.NoError(t, err)
+	var count int
+	require.NoError(t, txn.QueryRow(showOverride).Scan(&count))
+	require.Equal(t, 1, count)
+	require.NoError(t, txn.Rollback())
+	tdb.CheckQueryResults(t, showOverride, [][]string{{"0"}})
+	tdb.CheckQueryResults(t,
+		"SHOW CLUSTER SETTING sql.notices.enabled FOR TENANT t1", [][]string{{"NULL"}})
+
+	// The same statements take effect once the transaction commits.
+	txn, err = sqlDB.Begin()
+	require.NoError(t, err)
+	_, err = txn.Exec("ALTER TENANT t1 SET CLUSTER SETTING sql.notices.enabled = false")
+	require.NoError(t, err)
+	require.NoError(t, txn.Commit())
+	tdb.CheckQueryResults(t, showOverride, [][]string{{"1"}})
+	tdb.CheckQueryResults(t,
+		"SHOW CLUSTER SETTING sql.notices.enabled FOR TENANT t1", [][]string{{"false"}})
+}
+
 func TestAlterTenantCapabilityMixedVersion22_2_23_1(t *testing.T) {
 	defer leaktest.AfterTest(t)()
 	defer log.Scope(t).Close(t)
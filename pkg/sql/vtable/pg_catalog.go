@@ -753,6 +753,17 @@ CREATE TABLE pg_catalog.pg_tablespace (
 	spcoptions TEXT[]
 )`
 
+// PGCatalogTenantSettingOverrides describes the schema of the
+// pg_catalog.pg_tenant_setting_overrides table. It has no counterpart in
+// Postgres.
+const PGCatalogTenantSettingOverrides = `
+CREATE TABLE pg_catalog.pg_tenant_setting_overrides (
+	tenant_id INT8,
+	variable TEXT,
+	value TEXT,
+	source TEXT
+)`
+
 // PGCatalogTrigger describes the schema of the pg_catalog.pg_trigger table.
 // https://www.postgresql.org/docs/9.5/catalog-pg-trigger.html,
 const PGCatalogTrigger = `
@@ -0,0 +1,54 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package upgrades
+
+import (
+	"context"
+
+	"github.com/cockroachdb/cockroach/pkg/clusterversion"
+	"github.com/cockroachdb/cockroach/pkg/keys"
+	"github.com/cockroachdb/cockroach/pkg/sql/catalog/systemschema"
+	"github.com/cockroachdb/cockroach/pkg/upgrade"
+)
+
+const addStmtStatsLastExecutionTsCol = `
+ALTER TABLE system.statement_statistics
+ADD COLUMN IF NOT EXISTS "last_execution_ts" TIMESTAMPTZ
+FAMILY "primary"
+`
+
+const addTxnStatsLastExecutionTsCol = `
+ALTER TABLE system.transaction_statistics
+ADD COLUMN IF NOT EXISTS "last_execution_ts" TIMESTAMPTZ
+FAMILY "primary"
+`
+
+// alterSystemSQLStatsAddLastExecutionTs adds the last_execution_ts column to
+// system.statement_statistics and system.transaction_statistics. The rows
+// persisted before the upgrade are left with a NULL last_execution_ts.
+func alterSystemSQLStatsAddLastExecutionTs(
+	ctx context.Context, cs clusterversion.ClusterVersion, d upgrade.TenantDeps,
+) error {
+	if err := migrateTable(ctx, cs, d, operation{
+		name:           "add-statement-statistics-last-execution-ts-col",
+		schemaList:     []string{"last_execution_ts"},
+		query:          addStmtStatsLastExecutionTsCol,
+		schemaExistsFn: hasColumn,
+	}, keys.StatementStatisticsTableID, systemschema.StatementStatisticsTable); err != nil {
+		return err
+	}
+	return migrateTable(ctx, cs, d, operation{
+		name:           "add-transaction-statistics-last-execution-ts-col",
+		schemaList:     []string{"last_execution_ts"},
+		query:          addTxnStatsLastExecutionTsCol,
+		schemaExistsFn: hasColumn,
+	}, keys.TransactionStatisticsTableID, systemschema.TransactionStatisticsTable)
+}
@@ -0,0 +1,97 @@
+// Copyright 2023 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package upgrades_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/base"
+	"github.com/cockroachdb/cockroach/pkg/clusterversion"
+	"github.com/cockroachdb/cockroach/pkg/server"
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
+	"github.com/cockroachdb/cockroach/pkg/sql/catalog/descpb"
+	"github.com/cockroachdb/cockroach/pkg/sql/catalog/systemschema"
+	"github.com/cockroachdb/cockroach/pkg/testutils/skip"
+	"github.com/cockroachdb/cockroach/pkg/testutils/testcluster"
+	"github.com/cockroachdb/cockroach/pkg/upgrade/upgrades"
+	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSQLStatsCompactionRunsMigration(t *testing.T) {
+	skip.UnderStressRace(t)
+	defer leaktest.AfterTest(t)()
+	ctx := context.Background()
+
+	settings := cluster.MakeTestingClusterSettingsWithVersions(
+		clusterversion.TestingBinaryVersion,
+		clusterversion.TestingBinaryMinSupportedVersion,
+		false,
+	)
+
+	tc := testcluster.StartTestCluster(t, 1, base.TestClusterArgs{
+		ServerArgs: base.TestServerArgs{
+			Settings: settings,
+			Knobs: base.TestingKnobs{
+				Server: &server.TestingKnobs{
+					DisableAutomaticVersionUpgrade: make(chan struct{}),
+					BinaryVersionOverride:          clusterversion.TestingBinaryMinSupportedVersion,
+				},
+			},
+		},
+	})
+	defer tc.Stopper().Stop(ctx)
+
+	db := tc.ServerConn(0)
+	defer db.Close()
+
+	// NB: the table is baked into the bootstrap schema, so this only shows
+	// that the upgrade is idempotent, and that it leaves the table with the
+	// expected schema.
+	upgrades.Upgrade(
+		t,
+		db,
+		clusterversion.V23_2_AddSQLStatsCompactionRunsTable,
+		nil,
+		false,
+	)
+
+	var tableID descpb.ID
+	require.NoError(t, db.QueryRow(
+		"SELECT 'system.sql_stats_compaction_runs'::REGCLASS::OID",
+	).Scan(&tableID))
+	upgrades.ValidateSchemaExists(
+		ctx,
+		t,
+		tc.Server(0),
+		db,
+		tableID,
+		systemschema.SQLStatsCompactionRunsTable,
+		[]string{
+			"SELECT id, completed_at, job_id, duration, stmt_rows_removed, txn_rows_removed, " +
+				"outcome, error, session_id FROM system.sql_stats_compaction_runs@completed_at_idx",
+		},
+		[]upgrades.Schema{
+			{Name: "id", ValidationFn: upgrades.HasColumn},
+			{Name: "completed_at", ValidationFn: upgrades.HasColumn},
+			{Name: "job_id", ValidationFn: upgrades.HasColumn},
+			{Name: "duration", ValidationFn: upgrades.HasColumn},
+			{Name: "stmt_rows_removed", ValidationFn: upgrades.HasColumn},
+			{Name: "txn_rows_removed", ValidationFn: upgrades.HasColumn},
+			{Name: "outcome", ValidationFn: upgrades.HasColumn},
+			{Name: "error", ValidationFn: upgrades.HasColumn},
+			{Name: "session_id", ValidationFn: upgrades.HasColumn},
+			{Name: "completed_at_idx", ValidationFn: upgrades.HasIndex},
+		},
+		true, /* expectExists */
+	)
+}
@@ -316,6 +316,18 @@ var upgrades = []upgradebase.Upgrade{
 		upgrade.NoPrecondition,
 		NoTenantUpgradeFunc,
 	),
+	upgrade.NewTenantUpgrade(
+		"create system.sql_stats_compaction_runs",
+		toCV(clusterversion.V23_2_AddSQLStatsCompactionRunsTable),
+		upgrade.NoPrecondition,
+		systemSQLStatsCompactionRunsTableMigration,
+	),
+	upgrade.NewTenantUpgrade(
+		"add last_execution_ts to system.statement_statistics and system.transaction_statistics",
+		toCV(clusterversion.V23_2_AddSQLStatsLastExecutionTs),
+		upgrade.NoPrecondition,
+		alterSystemSQLStatsAddLastExecutionTs,
+	),
 }
 
 func init() {